@@ -0,0 +1,178 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// artifactTypeAliases are the short names which can be used instead of the
+// artifact types of common kinds of referrers.
+var artifactTypeAliases = map[string]string{
+	"sbom":        "application/spdx+json",
+	"spdx":        "application/spdx+json",
+	"cyclonedx":   "application/vnd.cyclonedx+json",
+	"attestation": "application/vnd.in-toto+json",
+}
+
+// parseArtifactType resolves a --type value, which is either one of the
+// artifactTypeAliases or a media type.
+func parseArtifactType(value string) (string, error) {
+	if artifactType, ok := artifactTypeAliases[value]; ok {
+		return artifactType, nil
+	}
+	if !strings.Contains(value, "/") {
+		return "", errors.Errorf("unknown artifact type %q: must be a media type or one of sbom, spdx, cyclonedx, attestation", value)
+	}
+	return value, nil
+}
+
+var attachCommand = cli.Command{
+	Name:  "attach",
+	Usage: "attaches an artifact (such as an SBOM) to a tagged image",
+	ArgsUsage: `--image <image-path>[:<tag>] --type <type> <file>[:<media-type>]...
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to attach the artifact to (if not specified, defaults to
+"latest"), "<type>" is the type of the artifact and each "<file>" is a file to
+add to the artifact.
+
+The type is either a media type or one of "sbom" (or "spdx"), "cyclonedx" and
+"attestation", which are short for the media types of SPDX and CycloneDX SBOMs
+and in-toto attestations. Each file is added with the media type given after
+the last ":" (which must contain a "/"), or with the type of the artifact if
+none is given, and with the name of the file as its title.
+
+The artifact is stored in the image as a referrer of the tagged manifest (an
+artifact manifest whose subject is the tagged manifest), which can be listed
+and retrieved with umoci-referrers(1). Referrers are kept by umoci-gc(1) for as
+long as the tagged manifest is.`,
+
+	// attach modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "type of the artifact (a media type, or one of sbom, spdx, cyclonedx, attestation)",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "add an annotation (of the form 'name=value') to the artifact",
+		},
+	},
+
+	Action: attach,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() == 0 {
+			return errors.Errorf("invalid number of positional arguments: expected at least one <file>")
+		}
+		if !ctx.IsSet("type") {
+			return errors.Errorf("missing mandatory argument: --type")
+		}
+		if _, err := parseArtifactType(ctx.String("type")); err != nil {
+			return errors.Wrap(err, "invalid --type")
+		}
+		for _, annotation := range ctx.StringSlice("annotation") {
+			if _, _, err := parseKV(annotation); err != nil {
+				return errors.Wrap(err, "invalid --annotation")
+			}
+		}
+		for _, file := range ctx.Args() {
+			if path, _ := parseArtifactBlob(file, ""); path == "" {
+				return errors.Errorf("invalid <file>: path cannot be empty: %q", file)
+			}
+		}
+		return nil
+	},
+}
+
+func attach(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	artifactType, err := parseArtifactType(ctx.String("type"))
+	if err != nil {
+		// Should _never_ be reached.
+		return errors.Wrap(err, "[internal error] invalid --type")
+	}
+	createTime, err := creationTime()
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	root, err := tagRoot(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+
+	artifact := mutate.Artifact{
+		ArtifactType: artifactType,
+		Annotations: map[string]string{
+			ispec.AnnotationCreated: createTime.Format(igen.ISO8601),
+		},
+	}
+	for _, annotation := range ctx.StringSlice("annotation") {
+		name, value, _ := parseKV(annotation)
+		artifact.Annotations[name] = value
+	}
+	for _, file := range ctx.Args() {
+		path, mediaType := parseArtifactBlob(file, artifactType)
+		blob, err := putFileBlob(context.Background(), engineExt, path, mediaType)
+		if err != nil {
+			return errors.Wrapf(err, "add %s", path)
+		}
+		blob.Annotations = map[string]string{
+			ispec.AnnotationTitle: filepath.Base(path),
+		}
+		artifact.Blobs = append(artifact.Blobs, blob)
+	}
+
+	descriptor, err := mutate.AttachArtifact(context.Background(), engineExt, *root, artifact)
+	if err != nil {
+		return errors.Wrap(err, "attach artifact")
+	}
+	log.WithFields(log.Fields{
+		"type":    artifactType,
+		"subject": root.Digest,
+	}).Infof("attached artifact: %s", descriptor.Digest)
+	return nil
+}
@@ -0,0 +1,449 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var buildCommand = cli.Command{
+	Name:  "build",
+	Usage: "builds a tagged image from a build specification",
+	ArgsUsage: `--image <image-path>[:<tag>] <spec>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tag to build (if not specified, defaults to "latest") and "<spec>" is the path
+to a JSON build specification of the form
+
+  {
+    "from": "<base-tag>",
+    "steps": [
+      {"run": ["<command>", "<arg>"...]},
+      {"run": "<shell command>"},
+      {"copy": {"src": "<host-path>", "dest": "<path>"}},
+      {"config": {"<umoci-config-option>": <value>...}}
+    ]
+  }
+
+The steps are applied in order, starting from "<base-tag>" (a tag in the same
+image). "run" steps run a command (or a shell command with /bin/sh -c) in a
+container as with umoci-run(1), "copy" steps copy a file or directory from the
+host (relative to the directory containing "<spec>") into the image, and
+"config" steps modify the image configuration as with umoci-config(1), where
+each key is the name of an option (such as "config.env") and each value is a
+string, boolean, number or list of strings.
+
+Consecutive run and copy steps are applied to a single bundle unpacked with
+umoci-unpack(1), and are repacked into a single layer with umoci-repack(1).`,
+
+	// build creates a new tag.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "OCI runtime used to run containers (default: runc or crun)",
+		},
+		rootlessFlag("enable rootless unpacking support"),
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "re-use (and store) snapshots of extracted layers in the given directory",
+		},
+	},
+
+	Action: build,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <spec>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("spec path cannot be empty")
+		}
+		ctx.App.Metadata["spec"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// buildSpec is the build specification read by umoci-build(1).
+type buildSpec struct {
+	// From is the tag the build starts from.
+	From string `json:"from"`
+
+	// Steps are the steps of the build, applied in order.
+	Steps []buildStep `json:"steps"`
+}
+
+// buildStep is a single step of a buildSpec. Exactly one of the fields must
+// be set.
+type buildStep struct {
+	// Run is a command to run in a container of the image.
+	Run buildArgs `json:"run,omitempty"`
+
+	// Copy is a path to copy from the host into the image.
+	Copy *buildCopy `json:"copy,omitempty"`
+
+	// Config is a set of umoci-config(1) options to apply to the image.
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// buildCopy is the source and destination of a copy step.
+type buildCopy struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
+}
+
+// buildArgs is the command of a run step. It can either be given as a list
+// of arguments or as a string, which is run with "/bin/sh -c".
+type buildArgs []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *buildArgs) UnmarshalJSON(data []byte) error {
+	var shell string
+	if err := json.Unmarshal(data, &shell); err == nil {
+		*c = buildArgs{"/bin/sh", "-c", shell}
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return errors.Errorf("run must be a string or a list of strings")
+	}
+	*c = buildArgs(args)
+	return nil
+}
+
+// String returns a description of the step, used for history entries.
+func (step buildStep) String() string {
+	switch {
+	case step.Run != nil:
+		return "run " + strings.Join(step.Run, " ")
+	case step.Copy != nil:
+		return fmt.Sprintf("copy %s %s", step.Copy.Src, step.Copy.Dest)
+	}
+	return "config"
+}
+
+// readBuildSpec reads and validates the build specification at the given
+// path.
+func readBuildSpec(path string) (buildSpec, error) {
+	var spec buildSpec
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return spec, errors.Wrap(err, "read spec")
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return spec, errors.Wrap(err, "parse spec")
+	}
+
+	if spec.From == "" {
+		return spec, errors.Errorf("spec: from cannot be empty")
+	}
+	if !refRegexp.MatchString(spec.From) {
+		return spec, errors.Errorf("spec: from is an invalid reference: %s", spec.From)
+	}
+	for idx, step := range spec.Steps {
+		set := 0
+		if step.Run != nil {
+			set++
+			if len(step.Run) == 0 {
+				return spec, errors.Errorf("spec: step %d: run cannot be empty", idx)
+			}
+		}
+		if step.Copy != nil {
+			set++
+			if step.Copy.Src == "" || step.Copy.Dest == "" {
+				return spec, errors.Errorf("spec: step %d: copy needs both src and dest", idx)
+			}
+		}
+		if step.Config != nil {
+			set++
+			if _, err := buildConfigArgs(step.Config); err != nil {
+				return spec, errors.Wrapf(err, "spec: step %d", idx)
+			}
+		}
+		if set != 1 {
+			return spec, errors.Errorf("spec: step %d: exactly one of run, copy and config must be set", idx)
+		}
+	}
+	return spec, nil
+}
+
+// buildConfigArgs converts the options of a config step to umoci-config(1)
+// arguments.
+func buildConfigArgs(config map[string]interface{}) ([]string, error) {
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		switch key {
+		case "", "image", "tag":
+			return nil, errors.Errorf("config: invalid option %q", key)
+		}
+		if strings.HasPrefix(key, "-") {
+			return nil, errors.Errorf("config: option %q must not start with '-'", key)
+		}
+		flag := "--" + key
+		switch value := config[key].(type) {
+		case string:
+			args = append(args, flag+"="+value)
+		case bool:
+			args = append(args, flag+"="+strconv.FormatBool(value))
+		case float64:
+			args = append(args, flag+"="+strconv.FormatFloat(value, 'f', -1, 64))
+		case []interface{}:
+			for _, elem := range value {
+				str, ok := elem.(string)
+				if !ok {
+					return nil, errors.Errorf("config: %s: lists must only contain strings", key)
+				}
+				args = append(args, flag+"="+str)
+			}
+		default:
+			return nil, errors.Errorf("config: %s: unsupported value %v", key, value)
+		}
+	}
+	return args, nil
+}
+
+// copyIntoRootfs copies the host path src (and everything underneath it, if
+// it is a directory) to dest inside the given rootfs. As with a Dockerfile
+// COPY, the contents of a directory are copied into dest, and a file is
+// copied into dest if it is an existing directory or ends with "/". The
+// copied paths are owned by root, unless rootless is set (in which case they
+// are owned by the current user, which is mapped to root).
+func copyIntoRootfs(rootfs, src, dest string, rootless bool) error {
+	srcFi, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrap(err, "stat source")
+	}
+	if !srcFi.IsDir() {
+		destPath, err := securejoin.SecureJoin(rootfs, dest)
+		if err != nil {
+			return errors.Wrap(err, "resolve destination")
+		}
+		if fi, err := os.Stat(destPath); strings.HasSuffix(dest, "/") || (err == nil && fi.IsDir()) {
+			dest = filepath.Join(dest, filepath.Base(src))
+		}
+	}
+
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target, err := securejoin.SecureJoin(rootfs, filepath.Join(dest, rel))
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", rel)
+		}
+		if path == src {
+			// The top-level source is followed if it is a symlink.
+			fi = srcFi
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return errors.Wrap(err, "create parent directory")
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return errors.Wrap(err, "mkdir")
+			}
+			if err := os.Chmod(target, fi.Mode()&os.ModePerm); err != nil {
+				return errors.Wrap(err, "chmod")
+			}
+		case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+			linkname, err := os.Readlink(path)
+			if err != nil {
+				return errors.Wrap(err, "readlink")
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return errors.Wrap(err, "remove old path")
+			}
+			if err := os.Symlink(linkname, target); err != nil {
+				return errors.Wrap(err, "symlink")
+			}
+		case fi.Mode().IsRegular():
+			if err := copyRegularFile(path, target, fi.Mode()&os.ModePerm); err != nil {
+				return errors.Wrapf(err, "copy %s", rel)
+			}
+		default:
+			return errors.Errorf("cannot copy %s: unsupported file type %s", path, fi.Mode().String())
+		}
+
+		if !rootless {
+			if err := os.Lchown(target, 0, 0); err != nil {
+				return errors.Wrap(err, "chown")
+			}
+		}
+		return nil
+	})
+}
+
+// copyRegularFile copies the contents of the regular file src to a new file
+// dst with the given mode, replacing any existing path at dst.
+func copyRegularFile(src, dst string, mode os.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer srcFile.Close()
+
+	// Never modify an existing file in-place, because it might be hardlinked
+	// to other paths.
+	if err := os.RemoveAll(dst); err != nil {
+		return errors.Wrap(err, "remove old path")
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	defer dstFile.Close()
+
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return errors.Wrap(err, "copy contents")
+	}
+	if err := dstFile.Chmod(mode); err != nil {
+		return errors.Wrap(err, "chmod")
+	}
+	return errors.Wrap(dstFile.Close(), "close")
+}
+
+func build(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	specPath := ctx.App.Metadata["spec"].(string)
+
+	spec, err := readBuildSpec(specPath)
+	if err != nil {
+		return err
+	}
+	// Copy sources are relative to the spec.
+	contextDir := filepath.Dir(specPath)
+
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	// The resolved mode is always passed, so that --rootless=auto is only
+	// detected once.
+	unpackArgs := []string{"--rootless=" + strconv.FormatBool(rootless)}
+	if ctx.IsSet("layer-cache") {
+		unpackArgs = append(unpackArgs, "--layer-cache", ctx.String("layer-cache"))
+	}
+
+	var runtime string
+	for _, step := range spec.Steps {
+		if step.Run != nil {
+			if runtime, err = findRuntime(ctx.String("runtime")); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// current is the tag containing the result of the steps so far.
+	current := spec.From
+	steps := spec.Steps
+	for len(steps) > 0 {
+		step := steps[0]
+		if step.Config != nil {
+			log.Infof("build: %s", step)
+			args, _ := buildConfigArgs(step.Config)
+			args = append([]string{"config", "--image", imagePath + ":" + current, "--tag", tagName}, args...)
+			if err := runSubcommand(ctx, args...); err != nil {
+				return errors.Wrap(err, "config step")
+			}
+			current = tagName
+			steps = steps[1:]
+			continue
+		}
+
+		// Apply all of the consecutive run and copy steps to a single bundle.
+		var group []buildStep
+		for len(steps) > 0 && steps[0].Config == nil {
+			group = append(group, steps[0])
+			steps = steps[1:]
+		}
+		if err := withTempBundle(ctx, imagePath, current, unpackArgs, func(bundle string) error {
+			var descriptions []string
+			for _, step := range group {
+				log.Infof("build: %s", step)
+				descriptions = append(descriptions, step.String())
+				if step.Run != nil {
+					if err := runBundle(runtime, bundle, step.Run); err != nil {
+						return errors.Wrapf(err, "%s", step)
+					}
+					continue
+				}
+				src := step.Copy.Src
+				if !filepath.IsAbs(src) {
+					src = filepath.Join(contextDir, src)
+				}
+				if err := copyIntoRootfs(filepath.Join(bundle, layer.RootfsName), src, step.Copy.Dest, rootless); err != nil {
+					return errors.Wrapf(err, "%s", step)
+				}
+			}
+			createdBy := "umoci build: " + strings.Join(descriptions, " && ")
+			return errors.Wrap(runSubcommand(ctx, "repack", "--image", imagePath+":"+tagName, "--history.created_by", createdBy, bundle), "repack bundle")
+		}); err != nil {
+			return err
+		}
+		current = tagName
+	}
+
+	// With no steps, the result is the base image.
+	if current != tagName {
+		if err := runSubcommand(ctx, "tag", "--image", imagePath+":"+current, tagName); err != nil {
+			return errors.Wrap(err, "tag base image")
+		}
+	}
+	log.Infof("built %s", tagName)
+
+	if !ctx.GlobalBool("json") {
+		return nil
+	}
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+	return outputTagResult(ctx, casext.NewEngine(engine), tagName)
+}
@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var catCommand = cli.Command{
+	Name:  "cat",
+	Usage: "writes the contents of a file in an image to stdout",
+	ArgsUsage: `--image <image-path>[:<tag>] <path>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to read from (if not specified, defaults to "latest") and
+"<path>" is the path of a regular file in the image.
+
+The layers of the image are read from the top down without extracting them,
+so only the layers above (and including) the topmost layer containing the file
+are read. Symlinks are not followed.`,
+
+	// cat reads manifest information.
+	Category: "image",
+
+	Action: cat,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <path>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("path cannot be empty")
+		}
+		ctx.App.Metadata["path"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func cat(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	path := ctx.App.Metadata["path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, manifest, err := tagManifest(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("reading %s from image: %s", path, descriptor.Digest)
+	contents, err := layer.ReadFile(context.Background(), engineExt, manifest, path)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(contents)
+	return errors.Wrap(err, "write contents")
+}
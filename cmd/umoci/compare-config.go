@@ -0,0 +1,448 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var compareConfigCommand = cli.Command{
+	Name:  "compare-config",
+	Usage: "shows the differences between the configurations of two images",
+	ArgsUsage: `--image <image-path>[:<tag>] [<new-tag> | --with <other-image>[:<other-tag>]]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to compare against (if not specified, defaults to "latest"),
+"<new-tag>" is the name of another tagged image in the same OCI image and
+"<other-image>" is the path to a different OCI image (with "<other-tag>"
+defaulting to "latest") to compare against instead.
+
+Each difference between the image configurations and manifests is listed,
+such as changes to the environment, labels, entrypoint, healthcheck,
+annotations, history and the list of layers (which are compared by their
+diff_id). Entries of the environment, labels, annotations, exposed ports,
+volumes and history are compared individually. Use umoci-diff(1) to compare the
+contents of the layers.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// compare-config reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "with",
+			Usage: "compare against a tagged image in another OCI image (path[:tag])",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the differences as a JSON encoded blob",
+		},
+	},
+
+	Action: compareConfig,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("with") {
+			if ctx.NArg() != 0 {
+				return errors.Errorf("invalid number of positional arguments: expected none with --with")
+			}
+			dir, tag, err := parseImageRef(ctx.String("with"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --with")
+			}
+			ctx.App.Metadata["--with-path"] = dir
+			ctx.App.Metadata["--with-tag"] = tag
+			return nil
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <new-tag>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("new tag cannot be empty")
+		}
+		if !refRegexp.MatchString(ctx.Args().First()) {
+			return errors.Errorf("new tag is an invalid reference")
+		}
+		ctx.App.Metadata["new-tag"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// configChange is a single difference between two images, as output by
+// umoci-compare-config(1).
+type configChange struct {
+	// Type is whether the field was added, modified or removed.
+	Type string `json:"type"`
+
+	// Field is the name of the field which changed, using the names of the
+	// image-spec JSON fields (such as "config.Entrypoint"). Entries of the
+	// environment, labels, annotations, exposed ports, volumes and history
+	// are separate fields (such as "config.Labels[version]" or
+	// "history[0]"), as are layers (such as "layers[sha256:...]").
+	Field string `json:"field"`
+
+	// Old and New are the values of the field in each image (which are
+	// omitted if the field was added or removed respectively).
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// configLayer is the value of a "layers[...]" configChange.
+type configLayer struct {
+	// Index is the index of the layer in the image.
+	Index int `json:"index"`
+
+	// Digest and Size are from the descriptor of the layer blob.
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+
+	// DiffID is the diff_id of the layer.
+	DiffID digest.Digest `json:"diff_id"`
+}
+
+// configImage is an image compared by umoci-compare-config(1).
+type configImage struct {
+	manifest ispec.Manifest
+	config   ispec.Image
+	docker   mutate.DockerConfig
+}
+
+// readConfigImage reads the manifest and configuration of the given tag.
+func readConfigImage(engineExt casext.Engine, tagName string) (configImage, error) {
+	var image configImage
+
+	_, manifest, err := tagManifest(engineExt, tagName)
+	if err != nil {
+		return image, err
+	}
+	image.manifest = manifest
+
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		return image, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return image, errors.Errorf("config is not an image configuration: %s", configBlob.MediaType)
+	}
+	image.config = config
+
+	// The Docker-specific fields are dropped when parsing an ispec.Image, so
+	// they have to be read from the raw blob.
+	data, err := readRawBlob(context.Background(), engineExt, manifest.Config)
+	if err != nil {
+		return image, errors.Wrap(err, "read config")
+	}
+	var dockerImage struct {
+		Config mutate.DockerConfig `json:"config"`
+	}
+	if err := json.Unmarshal(data, &dockerImage); err != nil {
+		return image, errors.Wrap(err, "parse config")
+	}
+	image.docker = dockerImage.Config
+	return image, nil
+}
+
+// compareValue appends a change to changes if old and new differ. Zero
+// values are treated as the field being unset.
+func compareValue(changes []configChange, field string, old, new interface{}) []configChange {
+	oldZero := reflect.ValueOf(old).IsZero()
+	newZero := reflect.ValueOf(new).IsZero()
+	switch {
+	case oldZero && newZero:
+	case oldZero:
+		changes = append(changes, configChange{Type: "added", Field: field, New: new})
+	case newZero:
+		changes = append(changes, configChange{Type: "removed", Field: field, Old: old})
+	case !reflect.DeepEqual(old, new):
+		changes = append(changes, configChange{Type: "modified", Field: field, Old: old, New: new})
+	}
+	return changes
+}
+
+// compareMap appends a change to changes for each key whose value differs
+// between old and new, in the order of the keys.
+func compareMap(changes []configChange, field string, old, new map[string]string) []configChange {
+	keys := map[string]struct{}{}
+	for key := range old {
+		keys[key] = struct{}{}
+	}
+	for key := range new {
+		keys[key] = struct{}{}
+	}
+	var sortedKeys []string
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	for _, key := range sortedKeys {
+		oldValue, oldOk := old[key]
+		newValue, newOk := new[key]
+		name := fmt.Sprintf("%s[%s]", field, key)
+		switch {
+		case !oldOk:
+			changes = append(changes, configChange{Type: "added", Field: name, New: newValue})
+		case !newOk:
+			changes = append(changes, configChange{Type: "removed", Field: name, Old: oldValue})
+		case oldValue != newValue:
+			changes = append(changes, configChange{Type: "modified", Field: name, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+// envMap converts a list of "key=value" environment variables to a map.
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m
+}
+
+// setMap converts a set (such as ExposedPorts or Volumes) to a map with
+// empty values.
+func setMap(set map[string]struct{}) map[string]string {
+	m := map[string]string{}
+	for key := range set {
+		m[key] = ""
+	}
+	return m
+}
+
+// configLayers returns the layers of an image.
+func configLayers(image configImage) []configLayer {
+	var layers []configLayer
+	for idx, descriptor := range image.manifest.Layers {
+		layer := configLayer{
+			Index:  idx,
+			Digest: descriptor.Digest,
+			Size:   descriptor.Size,
+		}
+		if idx < len(image.config.RootFS.DiffIDs) {
+			layer.DiffID = image.config.RootFS.DiffIDs[idx]
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// compareLayers appends a change to changes for each layer which was added,
+// removed or moved (or whose blob changed, such as by being recompressed).
+// Layers are matched by their diff_id.
+func compareLayers(changes []configChange, old, new []configLayer) []configChange {
+	oldLayers := map[digest.Digest]configLayer{}
+	for _, layer := range old {
+		oldLayers[layer.DiffID] = layer
+	}
+	newLayers := map[digest.Digest]configLayer{}
+	for _, layer := range new {
+		newLayers[layer.DiffID] = layer
+	}
+
+	for _, layer := range old {
+		if _, ok := newLayers[layer.DiffID]; !ok {
+			changes = append(changes, configChange{Type: "removed", Field: fmt.Sprintf("layers[%s]", layer.DiffID), Old: layer})
+		}
+	}
+	for _, layer := range new {
+		name := fmt.Sprintf("layers[%s]", layer.DiffID)
+		oldLayer, ok := oldLayers[layer.DiffID]
+		switch {
+		case !ok:
+			changes = append(changes, configChange{Type: "added", Field: name, New: layer})
+		case oldLayer != layer:
+			changes = append(changes, configChange{Type: "modified", Field: name, Old: oldLayer, New: layer})
+		}
+	}
+	return changes
+}
+
+// compareHistory appends a change to changes for each history entry which
+// differs between old and new, comparing the entries by their index.
+func compareHistory(changes []configChange, old, new []ispec.History) []configChange {
+	// Timestamps parsed from different timezones are otherwise not equal.
+	normalize := func(history []ispec.History, idx int) ispec.History {
+		if idx >= len(history) {
+			return ispec.History{}
+		}
+		entry := history[idx]
+		if entry.Created != nil {
+			created := entry.Created.UTC()
+			entry.Created = &created
+		}
+		return entry
+	}
+
+	n := len(old)
+	if len(new) > n {
+		n = len(new)
+	}
+	for idx := 0; idx < n; idx++ {
+		changes = compareValue(changes, fmt.Sprintf("history[%d]", idx), normalize(old, idx), normalize(new, idx))
+	}
+	return changes
+}
+
+// compareImages returns the differences between the configurations and
+// manifests of two images.
+func compareImages(old, new configImage) []configChange {
+	changes := []configChange{}
+
+	changes = compareValue(changes, "architecture", old.config.Architecture, new.config.Architecture)
+	changes = compareValue(changes, "os", old.config.OS, new.config.OS)
+	changes = compareValue(changes, "author", old.config.Author, new.config.Author)
+	var oldCreated, newCreated string
+	if old.config.Created != nil {
+		oldCreated = old.config.Created.UTC().Format(igen.ISO8601)
+	}
+	if new.config.Created != nil {
+		newCreated = new.config.Created.UTC().Format(igen.ISO8601)
+	}
+	changes = compareValue(changes, "created", oldCreated, newCreated)
+
+	oldConfig, newConfig := old.config.Config, new.config.Config
+	changes = compareValue(changes, "config.User", oldConfig.User, newConfig.User)
+	changes = compareMap(changes, "config.Env", envMap(oldConfig.Env), envMap(newConfig.Env))
+	changes = compareValue(changes, "config.Entrypoint", oldConfig.Entrypoint, newConfig.Entrypoint)
+	changes = compareValue(changes, "config.Cmd", oldConfig.Cmd, newConfig.Cmd)
+	changes = compareValue(changes, "config.WorkingDir", oldConfig.WorkingDir, newConfig.WorkingDir)
+	changes = compareValue(changes, "config.StopSignal", oldConfig.StopSignal, newConfig.StopSignal)
+	changes = compareMap(changes, "config.Labels", oldConfig.Labels, newConfig.Labels)
+	changes = compareMap(changes, "config.ExposedPorts", setMap(oldConfig.ExposedPorts), setMap(newConfig.ExposedPorts))
+	changes = compareMap(changes, "config.Volumes", setMap(oldConfig.Volumes), setMap(newConfig.Volumes))
+	changes = compareValue(changes, "config.Healthcheck", old.docker.Healthcheck, new.docker.Healthcheck)
+	changes = compareValue(changes, "config.Shell", old.docker.Shell, new.docker.Shell)
+	changes = compareValue(changes, "config.OnBuild", old.docker.OnBuild, new.docker.OnBuild)
+
+	changes = compareValue(changes, "rootfs.type", old.config.RootFS.Type, new.config.RootFS.Type)
+	changes = compareValue(changes, "rootfs.diff_ids", old.config.RootFS.DiffIDs, new.config.RootFS.DiffIDs)
+	changes = compareHistory(changes, old.config.History, new.config.History)
+
+	changes = compareMap(changes, "annotations", old.manifest.Annotations, new.manifest.Annotations)
+	changes = compareLayers(changes, configLayers(old), configLayers(new))
+	return changes
+}
+
+// describeConfigValue returns a short human-readable description of the value
+// of a configChange.
+func describeConfigValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case configLayer:
+		return fmt.Sprintf("#%d %s (%s)", value.Index, value.Digest, units.HumanSize(float64(value.Size)))
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// formatConfigChanges writes a human-readable table of the given changes to w.
+func formatConfigChanges(w io.Writer, changes []configChange) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	for _, change := range changes {
+		var details string
+		switch change.Type {
+		case "added":
+			details = describeConfigValue(change.New)
+		case "removed":
+			details = describeConfigValue(change.Old)
+		case "modified":
+			details = describeConfigValue(change.Old) + " -> " + describeConfigValue(change.New)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", change.Type, change.Field, details)
+	}
+	return tw.Flush()
+}
+
+func compareConfig(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	oldImage, err := readConfigImage(engineExt, tagName)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", tagName)
+	}
+
+	newEngineExt, newTag := engineExt, ""
+	if withPath, ok := ctx.App.Metadata["--with-path"].(string); ok {
+		newEngine, err := dir.Open(withPath)
+		if err != nil {
+			return errors.Wrap(err, "open --with CAS")
+		}
+		defer newEngine.Close()
+		newEngineExt = casext.NewEngine(newEngine)
+		newTag = ctx.App.Metadata["--with-tag"].(string)
+	} else {
+		newTag = ctx.App.Metadata["new-tag"].(string)
+	}
+	newImage, err := readConfigImage(newEngineExt, newTag)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", newTag)
+	}
+
+	changes := compareImages(oldImage, newImage)
+	if jsonOutput(ctx) {
+		if err := json.NewEncoder(os.Stdout).Encode(changes); err != nil {
+			return errors.Wrap(err, "encoding changes")
+		}
+		return nil
+	}
+	if err := formatConfigChanges(os.Stdout, changes); err != nil {
+		return errors.Wrap(err, "format changes")
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+// completionScripts are the completion scripts output by umoci-completion(1)
+// for each supported shell. All of them defer to the hidden "__complete"
+// command to compute the candidates, so that they don't need to be updated
+// whenever a command or flag is added.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for umoci(1).
+#
+# Load it into the current shell with:
+#   source <(umoci completion bash)
+
+_umoci() {
+	local line="${COMP_LINE:0:COMP_POINT}"
+	local -a words
+	read -ra words <<<"$line"
+	if [[ "$line" =~ [[:space:]]$ ]]; then
+		words+=("")
+	fi
+	local cur="${words[${#words[@]}-1]}"
+
+	local IFS=$'\n'
+	COMPREPLY=($(command "${words[0]}" __complete "${words[@]:1}" 2>/dev/null))
+
+	# Don't add a space after directories, or after the "<path>:" of --image.
+	if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == *[/:=] ]]; then
+		compopt -o nospace
+	fi
+
+	# Bash treats the characters in COMP_WORDBREAKS (usually including ":"
+	# and "=") as separate words, so we have to strip the part of the current
+	# word before the last such character from the candidates.
+	local breaks="${COMP_WORDBREAKS//[^:=]/}"
+	if [[ -n "$breaks" && "$cur" == *["$breaks"]* ]]; then
+		local prefix="${cur%"${cur##*["$breaks"]}"}"
+		COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+	fi
+}
+
+complete -F _umoci umoci
+`,
+	"zsh": `#compdef umoci
+# zsh completion for umoci(1).
+#
+# Load it into the current shell with:
+#   source <(umoci completion zsh)
+
+_umoci() {
+	local -a candidates
+	local candidate
+	candidates=("${(@f)$(command "${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	for candidate in "${candidates[@]}"; do
+		[[ -z "$candidate" ]] && continue
+		# Don't add a space after directories, or after the "<path>:" of --image.
+		if [[ "$candidate" == *[/:=] ]]; then
+			compadd -Q -S '' -- "$candidate"
+		else
+			compadd -Q -- "$candidate"
+		fi
+	done
+}
+
+compdef _umoci umoci
+`,
+	"fish": `# fish completion for umoci(1).
+#
+# Load it into the current shell with:
+#   umoci completion fish | source
+
+function __umoci_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	set -l cur (commandline -ct)
+	umoci __complete $words "$cur" 2>/dev/null
+end
+
+complete -c umoci -f -a '(__umoci_complete)'
+`,
+}
+
+var completionCommand = cli.Command{
+	Name:  "completion",
+	Usage: "outputs a shell completion script",
+	ArgsUsage: `<shell>
+
+Where "<shell>" is the shell to output a completion script for, which is one
+of "bash", "zsh" or "fish".
+
+The completion script completes subcommands, flags, the paths to OCI image
+layouts and the tags in those layouts.`,
+
+	Action: completion,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <shell>")
+		}
+		shell := ctx.Args().First()
+		if _, ok := completionScripts[shell]; !ok {
+			return errors.Errorf("unsupported shell: %s", shell)
+		}
+		ctx.App.Metadata["shell"] = shell
+		return nil
+	},
+}
+
+func completion(ctx *cli.Context) error {
+	shell := ctx.App.Metadata["shell"].(string)
+	_, err := fmt.Fprint(os.Stdout, completionScripts[shell])
+	return err
+}
+
+// completeCommand is used by the completion scripts to compute the candidates
+// for the last word of a (partial) command-line, which are output one per
+// line. It is hidden because it is not meant to be used directly.
+var completeCommand = cli.Command{
+	Name:   "__complete",
+	Hidden: true,
+
+	// The arguments are the words of the command-line being completed, which
+	// will contain flags that are not ours.
+	SkipFlagParsing: true,
+
+	Action: complete,
+}
+
+func complete(ctx *cli.Context) error {
+	words := []string(ctx.Args())
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	for _, candidate := range completeWords(ctx.App, words) {
+		fmt.Println(candidate)
+	}
+	return nil
+}
+
+// flagNames returns the names (including aliases) of the given flag.
+func flagNames(flag cli.Flag) []string {
+	var names []string
+	for _, name := range strings.Split(flag.GetName(), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// flagTakesValue returns whether the given flag takes a value.
+func flagTakesValue(flag cli.Flag) bool {
+	switch flag := flag.(type) {
+	case cli.BoolFlag, cli.BoolTFlag:
+		return false
+	case cli.GenericFlag:
+		// Flags such as --rootless can be given without a value.
+		if value, ok := flag.Value.(interface{ IsBoolFlag() bool }); ok {
+			return !value.IsBoolFlag()
+		}
+	}
+	return true
+}
+
+// findFlag returns the flag with the given name (without leading dashes) in
+// flags, or nil if there is no such flag.
+func findFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, flag := range flags {
+		for _, flagName := range flagNames(flag) {
+			if flagName == name {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// findCommand returns the command with the given name (or alias) in cmds, or
+// nil if there is no such command.
+func findCommand(cmds []cli.Command, name string) *cli.Command {
+	for idx, cmd := range cmds {
+		if cmd.HasName(name) {
+			return &cmds[idx]
+		}
+	}
+	return nil
+}
+
+// completeWords returns the candidates for the last word in words, which are
+// the words of a command-line (without the program name) up to the word being
+// completed.
+func completeWords(app *cli.App, words []string) []string {
+	cur := words[len(words)-1]
+	words = words[:len(words)-1]
+
+	// Figure out which (sub)command is being completed, and whether we are in
+	// the middle of a flag's value.
+	var (
+		cmd        *cli.Command
+		cmds       = app.Commands
+		flags      = app.Flags
+		valueFlag  string
+		positional bool
+	)
+	for _, word := range words {
+		if valueFlag != "" {
+			valueFlag = ""
+			continue
+		}
+		if word == "--" {
+			positional = true
+			continue
+		}
+		if strings.HasPrefix(word, "-") && len(word) > 1 && !positional {
+			name := strings.TrimLeft(word, "-")
+			if strings.Contains(name, "=") {
+				continue
+			}
+			if flag := findFlag(flags, name); flag != nil && flagTakesValue(flag) {
+				valueFlag = name
+			}
+			continue
+		}
+		if !positional {
+			if sub := findCommand(cmds, word); sub != nil {
+				cmd = sub
+				cmds = sub.Subcommands
+				flags = sub.Flags
+				continue
+			}
+		}
+		positional = true
+	}
+
+	if valueFlag != "" {
+		return completeFlagValue(valueFlag, "", cur)
+	}
+
+	var candidates []string
+	switch {
+	case strings.HasPrefix(cur, "-") && !positional:
+		if idx := strings.Index(cur, "="); idx >= 0 {
+			name := strings.TrimLeft(cur[:idx], "-")
+			return completeFlagValue(name, cur[:idx+1], cur[idx+1:])
+		}
+		// The global flags already include --help and --version, but the
+		// --help flag is only added to a command's flags when it is run.
+		if cmd != nil && !cmd.HideHelp {
+			flags = append([]cli.Flag{cli.HelpFlag}, flags...)
+		}
+		for _, flag := range flags {
+			for _, name := range flagNames(flag) {
+				prefix := "--"
+				if len(name) == 1 {
+					prefix = "-"
+				}
+				candidates = append(candidates, prefix+name)
+			}
+		}
+	case !positional && (cmd == nil || len(cmds) > 0):
+		for _, sub := range cmds {
+			if sub.Hidden {
+				continue
+			}
+			candidates = append(candidates, sub.Names()...)
+		}
+		if cmd == nil || !cmd.HideHelp {
+			candidates = append(candidates, "help")
+		}
+	default:
+		return completePaths(cur, false)
+	}
+	return filterPrefix(candidates, cur)
+}
+
+// completeFlagValue returns the candidates for the value of the given flag,
+// which is the word cur. Each candidate is prefixed with prefix (which is
+// used for --flag=value words).
+func completeFlagValue(name, prefix, cur string) []string {
+	var candidates []string
+	switch name {
+	case "log":
+		candidates = filterPrefix([]string{"debug", "info", "warn", "error", "fatal"}, cur)
+	case "rootless":
+		candidates = filterPrefix([]string{string(rootlessOn), string(rootlessOff), string(rootlessAuto)}, cur)
+	case "layout":
+		candidates = completePaths(cur, true)
+	case "image":
+		candidates = completeImages(cur)
+	default:
+		candidates = completePaths(cur, false)
+	}
+	for idx := range candidates {
+		candidates[idx] = prefix + candidates[idx]
+	}
+	return candidates
+}
+
+// completeImages returns the candidates for an --image value. The "<path>"
+// component is completed like a directory (with "<path>:" also being offered
+// for OCI image layouts), and the ":<tag>" component is completed using the
+// tags in the image layout.
+func completeImages(cur string) []string {
+	if idx := strings.LastIndex(cur, ":"); idx >= 0 {
+		path := cur[:idx]
+		tags, err := layoutReferences(context.Background(), path)
+		if err == nil {
+			var candidates []string
+			for _, tag := range filterPrefix(tags, cur[idx+1:]) {
+				candidates = append(candidates, path+":"+tag)
+			}
+			return candidates
+		}
+	}
+
+	var candidates []string
+	for _, candidate := range completePaths(cur, true) {
+		candidates = append(candidates, candidate)
+		path := strings.TrimSuffix(candidate, "/")
+		if _, err := layoutReferences(context.Background(), path); err == nil {
+			candidates = append(candidates, path+":")
+		}
+	}
+	return candidates
+}
+
+// completePaths returns the paths which start with cur. Directories are given
+// a trailing "/", and if dirsOnly is set only directories are returned.
+func completePaths(cur string, dirsOnly bool) []string {
+	dir, base := filepath.Split(cur)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	infos, err := ioutil.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		// Like most shells, only show hidden files if explicitly asked for.
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		// Follow symlinks to directories.
+		if fi, err := os.Stat(filepath.Join(readDir, name)); err == nil && fi.IsDir() {
+			candidates = append(candidates, dir+name+"/")
+		} else if !dirsOnly {
+			candidates = append(candidates, dir+name)
+		}
+	}
+	return candidates
+}
+
+// filterPrefix returns the candidates which start with prefix.
+func filterPrefix(candidates []string, prefix string) []string {
+	var filtered []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
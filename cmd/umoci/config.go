@@ -18,14 +18,22 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/third_party/user"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -34,7 +42,7 @@ import (
 
 // FIXME: We should also implement a raw mode that just does modifications of
 //        JSON blobs (allowing this all to be used outside of our build setup).
-var configCommand = uxHistory(uxTag(cli.Command{
+var configCommand = uxDryRun(uxPlatform(uxCreated(uxHistory(uxTag(cli.Command{
 	Name:  "config",
 	Usage: "modifies the image configuration of an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
@@ -43,7 +51,20 @@ Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image from which the config modifications will be based (if not
 specified, it defaults to "latest"). "<new-tag>" is the new reference name to
 save the new image as, if this is not specified then umoci will replace the old
-image.`,
+image.
+
+If "<tag>" refers to an image index containing manifests for several
+platforms, --platform selects the manifest to modify, while --all-platforms
+applies the same modifications to the manifest of every platform (rewriting
+the index to match).
+
+If --from-image is specified, the configuration (such as the entrypoint and
+environment) of the given image is copied before any other modifications are
+made. If that image has manifests for several platforms, the manifest with the
+same platform as the one being modified is used.
+
+If --dry-run is specified, the image is not modified. Instead, the
+modifications which would have been made are printed as JSON.`,
 
 	// config modifies a particular image manifest.
 	Category: "image",
@@ -56,29 +77,54 @@ image.`,
 		if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
 			return errors.Errorf("missing mandatory argument: --image")
 		}
+		if ctx.IsSet("from-image") {
+			dir, tag, err := parseImageRef(ctx.String("from-image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --from-image")
+			}
+			ctx.App.Metadata["--from-image-path"] = dir
+			ctx.App.Metadata["--from-image-tag"] = tag
+		}
 		return nil
 	},
 
 	Flags: []cli.Flag{
 		cli.StringFlag{Name: "config.user"},
+		cli.BoolFlag{Name: "config.user.resolve"},
 		cli.StringSliceFlag{Name: "config.exposedports"},
 		cli.StringSliceFlag{Name: "config.env"},
+		cli.StringSliceFlag{Name: "config.env.remove"},
 		cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
-		cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
+		cli.StringSliceFlag{Name: "config.entrypoint.append"},
+		cli.StringSliceFlag{Name: "config.cmd"}, // FIXME: This interface is weird.
+		cli.StringSliceFlag{Name: "config.cmd.append"},
 		cli.StringSliceFlag{Name: "config.volume"},
 		cli.StringSliceFlag{Name: "config.label"},
+		cli.StringSliceFlag{Name: "config.label.remove"},
 		cli.StringFlag{Name: "config.workingdir"},
 		cli.StringFlag{Name: "config.stopsignal"},
-		cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
-		cli.StringFlag{Name: "author"},
+		cli.StringSliceFlag{Name: "config.healthcheck"}, // FIXME: This interface is weird.
+		cli.StringFlag{Name: "config.healthcheck.interval"},
+		cli.StringFlag{Name: "config.healthcheck.timeout"},
+		cli.StringFlag{Name: "config.healthcheck.startperiod"},
+		cli.IntFlag{Name: "config.healthcheck.retries"},
+		cli.StringSliceFlag{Name: "config.shell"}, // FIXME: This interface is weird.
+		cli.StringSliceFlag{Name: "config.onbuild"},
 		cli.StringFlag{Name: "architecture"},
 		cli.StringFlag{Name: "os"},
 		cli.StringSliceFlag{Name: "manifest.annotation"},
+		cli.StringSliceFlag{Name: "manifest.annotation.remove"},
+		cli.StringSliceFlag{Name: "descriptor.annotation"},
+		cli.StringSliceFlag{Name: "descriptor.annotation.remove"},
+		cli.StringSliceFlag{Name: "index.annotation"},
+		cli.StringSliceFlag{Name: "index.annotation.remove"},
 		cli.StringSliceFlag{Name: "clear"},
+		cli.StringFlag{Name: "patch"},
+		cli.StringFlag{Name: "from-image"},
 	},
 
 	Action: config,
-}))
+})))))
 
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
@@ -104,6 +150,69 @@ func fromImage(image ispec.Image) (ispec.ImageConfig, mutate.Meta) {
 	}
 }
 
+// healthcheckTest converts the given --config.healthcheck values into the
+// Test of a mutate.HealthConfig. If the first value is not one of the test
+// types ("NONE", "CMD" or "CMD-SHELL"), the values are treated as the
+// arguments of a "CMD" test.
+func healthcheckTest(values []string) ([]string, error) {
+	if len(values) == 0 {
+		return nil, errors.Errorf("must not be empty")
+	}
+	switch values[0] {
+	case "NONE":
+		if len(values) != 1 {
+			return nil, errors.Errorf("NONE test must not have any arguments")
+		}
+	case "CMD-SHELL":
+		if len(values) != 2 {
+			return nil, errors.Errorf("CMD-SHELL test must have exactly one command")
+		}
+	case "CMD":
+		if len(values) < 2 {
+			return nil, errors.Errorf("CMD test must have a command")
+		}
+	default:
+		values = append([]string{"CMD"}, values...)
+	}
+	return values, nil
+}
+
+// parseDuration parses the given non-negative duration (such as "30s").
+func parseDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, errors.Errorf("must not be negative: %s", value)
+	}
+	return duration, nil
+}
+
+// modifyAnnotations applies the --<scope>.annotation.remove and
+// --<scope>.annotation flags (in that order) to the given annotations, and
+// returns the modified annotations and whether either flag was set.
+func modifyAnnotations(ctx *cli.Context, scope string, annotations map[string]string) (map[string]string, bool, error) {
+	setFlag, removeFlag := scope+".annotation", scope+".annotation.remove"
+	if !ctx.IsSet(setFlag) && !ctx.IsSet(removeFlag) {
+		return annotations, false, nil
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	for _, name := range ctx.StringSlice(removeFlag) {
+		delete(annotations, name)
+	}
+	for _, annotation := range ctx.StringSlice(setFlag) {
+		name, value, err := parseKV(annotation)
+		if err != nil {
+			return nil, false, errors.Wrap(err, setFlag)
+		}
+		annotations[name] = value
+	}
+	return annotations, true, nil
+}
+
 // parseKV splits a given string (of the form name=value) into (name,
 // value). An error is returned if there is no "=" in the line or if the
 // name is empty.
@@ -120,6 +229,67 @@ func parseKV(input string) (string, string, error) {
 	return name, value, nil
 }
 
+// resolveUser resolves the given user specification (of the form
+// user[:group]) into the numeric "uid:gid" form, using the /etc/passwd and
+// /etc/group files in the root filesystem of the image with the given
+// manifest.
+func resolveUser(engine cas.Engine, manifest ispec.Manifest, userSpec string) (string, error) {
+	var sources []io.Reader
+	for _, path := range []string{"/etc/passwd", "/etc/group"} {
+		contents, err := layer.ReadFile(context.Background(), engine, manifest, path)
+		if os.IsNotExist(err) {
+			// GetExecUser treats a nil reader as an empty file.
+			sources = append(sources, nil)
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "read %s", path)
+		}
+		sources = append(sources, bytes.NewReader(contents))
+	}
+	execUser, err := user.GetExecUser(userSpec, nil, sources[0], sources[1])
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve user %q", userSpec)
+	}
+	return fmt.Sprintf("%d:%d", execUser.Uid, execUser.Gid), nil
+}
+
+// configSource is the image whose configuration is copied by --from-image.
+type configSource struct {
+	engine          cas.Engine
+	descriptorPaths []casext.DescriptorPath
+}
+
+// config returns the configuration of the source image to copy into an image
+// with the given metadata. If the source image has several manifests, the
+// one with the same platform is used.
+func (s *configSource) config(ctx context.Context, meta mutate.Meta) (ispec.ImageConfig, mutate.DockerConfig, error) {
+	for _, descriptorPath := range s.descriptorPaths {
+		mutator, err := mutate.New(s.engine, descriptorPath)
+		if err != nil {
+			return ispec.ImageConfig{}, mutate.DockerConfig{}, errors.Wrap(err, "create mutator for manifest")
+		}
+		sourceMeta, err := mutator.Meta(ctx)
+		if err != nil {
+			return ispec.ImageConfig{}, mutate.DockerConfig{}, errors.Wrap(err, "get metadata")
+		}
+		if len(s.descriptorPaths) > 1 && (sourceMeta.OS != meta.OS || sourceMeta.Architecture != meta.Architecture) {
+			continue
+		}
+
+		config, err := mutator.Config(ctx)
+		if err != nil {
+			return ispec.ImageConfig{}, mutate.DockerConfig{}, errors.Wrap(err, "get config")
+		}
+		dockerConfig, err := mutator.DockerConfig(ctx)
+		if err != nil {
+			return ispec.ImageConfig{}, mutate.DockerConfig{}, errors.Wrap(err, "get docker config")
+		}
+		return config, dockerConfig, nil
+	}
+	return ispec.ImageConfig{}, mutate.DockerConfig{}, errors.Errorf("no manifest for platform %s/%s", meta.OS, meta.Architecture)
+}
+
 func config(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
@@ -135,41 +305,162 @@ func config(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
-	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
+	engine, batch, err := stageDryRun(ctx, engine)
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		defer batch.Close()
+	}
+	engineExt := casext.NewEngine(engine)
 
 	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
 	if err != nil {
 		return errors.Wrap(err, "get descriptor")
 	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+	indices, err := selectManifests(ctx, fromName, fromDescriptorPaths)
+	if err != nil {
+		return err
+	}
+
+	// The source image is only resolved once, and the manifest matching each
+	// modified manifest is picked by configSource.config.
+	var source *configSource
+	if sourcePath, ok := ctx.App.Metadata["--from-image-path"]; ok {
+		sourceName := ctx.App.Metadata["--from-image-tag"].(string)
+
+		sourceEngine, err := dir.Open(sourcePath.(string))
+		if err != nil {
+			return errors.Wrap(err, "open --from-image CAS")
+		}
+		defer sourceEngine.Close()
+
+		sourceDescriptorPaths, err := casext.NewEngine(sourceEngine).ResolveReference(context.Background(), sourceName)
+		if err != nil {
+			return errors.Wrap(err, "get --from-image descriptor")
+		}
+		if len(sourceDescriptorPaths) == 0 {
+			return errors.Errorf("--from-image tag not found: %s", sourceName)
+		}
+		source = &configSource{
+			engine:          sourceEngine,
+			descriptorPaths: sourceDescriptorPaths,
+		}
+	}
+
+	// The patch is read once, since it is applied to every manifest.
+	var patch []byte
+	if ctx.IsSet("patch") {
+		var reader io.Reader = os.Stdin
+		if path := ctx.String("patch"); path != "-" {
+			fh, err := os.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "open --patch")
+			}
+			defer fh.Close()
+			reader = fh
+		}
+		if patch, err = ioutil.ReadAll(reader); err != nil {
+			return errors.Wrap(err, "read --patch")
+		}
+	}
+
+	// Each manifest is modified in turn. Committing a manifest rewrites the
+	// blobs above it, so the remaining manifests are resolved again from the
+	// new root (the order of the paths is unchanged by a commit).
+	root := fromDescriptorPaths[0].Root()
+	for _, idx := range indices {
+		descriptorPaths, err := engineExt.ResolveDescriptor(context.Background(), root)
+		if err != nil {
+			return errors.Wrap(err, "resolve manifests")
+		}
+		if len(descriptorPaths) != len(fromDescriptorPaths) {
+			return errors.Errorf("[internal error] number of manifests changed from %d to %d", len(fromDescriptorPaths), len(descriptorPaths))
+		}
+		newDescriptorPath, err := configManifest(ctx, engine, descriptorPaths[idx], patch, source)
+		if err != nil {
+			if len(descriptorPaths) > 1 {
+				err = errors.Wrapf(err, "modify manifest for platform %s", formatPlatform(descriptorPaths[idx].Descriptor()))
+			}
+			return err
+		}
+		root = newDescriptorPath.Root()
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, root); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+	if batch != nil {
+		return finishDryRun(batch)
 	}
 
-	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
+
+// configManifest applies the configuration changes (the configuration of the
+// source image and the patch, if not nil, followed by the flags) to the
+// manifest at the end of the given descriptor path, and returns the new
+// descriptor path.
+func configManifest(ctx *cli.Context, engine cas.Engine, descriptorPath casext.DescriptorPath, patch []byte, source *configSource) (casext.DescriptorPath, error) {
+	mutator, err := mutate.New(engine, descriptorPath)
 	if err != nil {
-		return errors.Wrap(err, "create mutator for manifest")
+		return casext.DescriptorPath{}, errors.Wrap(err, "create mutator for manifest")
 	}
 
 	imageConfig, err := mutator.Config(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "get base config")
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base config")
 	}
 
 	imageMeta, err := mutator.Meta(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "get base metadata")
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base metadata")
 	}
 
 	annotations, err := mutator.Annotations(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "get base annotations")
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base annotations")
+	}
+
+	dockerConfig, err := mutator.DockerConfig(context.Background())
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base docker config")
+	}
+
+	descriptorAnnotations, err := mutator.DescriptorAnnotations(context.Background())
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base descriptor annotations")
+	}
+
+	// The index annotations are only modified if requested, since the
+	// top-level index is shared by every image in the layout.
+	indexAnnotations, err := mutator.IndexAnnotations(context.Background())
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base index annotations")
+	}
+	var indexModified bool
+
+	if source != nil {
+		imageConfig, dockerConfig, err = source.config(context.Background(), imageMeta)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "from-image")
+		}
+	}
+
+	if patch != nil {
+		image, docker, err := mutate.PatchConfig(toImage(imageConfig, imageMeta), dockerConfig, patch)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "patch")
+		}
+		imageConfig, imageMeta = fromImage(image)
+		dockerConfig = docker
 	}
 
 	g, err := igen.NewFromImage(toImage(imageConfig, imageMeta))
 	if err != nil {
-		return errors.Wrap(err, "create new generator")
+		return casext.DescriptorPath{}, errors.Wrap(err, "create new generator")
 	}
 
 	if ctx.IsSet("clear") {
@@ -179,6 +470,11 @@ func config(ctx *cli.Context) error {
 				g.ClearConfigLabels()
 			case "manifest.annotations":
 				annotations = nil
+			case "descriptor.annotations":
+				descriptorAnnotations = nil
+			case "index.annotations":
+				indexAnnotations = nil
+				indexModified = true
 			case "config.exposedports":
 				g.ClearConfigExposedPorts()
 			case "config.env":
@@ -187,24 +483,36 @@ func config(ctx *cli.Context) error {
 				g.ClearConfigVolumes()
 			case "rootfs.diffids":
 				//g.ClearRootfsDiffIDs()
-				return errors.Errorf("--clear=rootfs.diffids is not safe")
+				return casext.DescriptorPath{}, errors.Errorf("--clear=rootfs.diffids is not safe")
 			case "config.cmd":
 				g.ClearConfigCmd()
 			case "config.entrypoint":
 				g.ClearConfigEntrypoint()
+			case "config.healthcheck":
+				dockerConfig.Healthcheck = nil
+			case "config.shell":
+				dockerConfig.Shell = nil
+			case "config.onbuild":
+				dockerConfig.OnBuild = nil
 			default:
-				return errors.Errorf("unknown key to --clear: %s", key)
+				return casext.DescriptorPath{}, errors.Errorf("unknown key to --clear: %s", key)
 			}
 		}
 	}
 
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
 	if ctx.IsSet("created") {
 		// How do we handle other formats?
 		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
 		if err != nil {
-			return errors.Wrap(err, "parse --created")
+			return casext.DescriptorPath{}, errors.Wrap(err, "parse --created")
 		}
 		g.SetCreated(created)
+	} else if epoch != nil {
+		g.SetCreated(*epoch)
 	}
 	if ctx.IsSet("author") {
 		g.SetAuthor(ctx.String("author"))
@@ -218,22 +526,49 @@ func config(ctx *cli.Context) error {
 	if ctx.IsSet("config.user") {
 		g.SetConfigUser(ctx.String("config.user"))
 	}
+	if ctx.Bool("config.user.resolve") && g.ConfigUser() != "" {
+		manifest, err := mutator.Manifest(context.Background())
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "get base manifest")
+		}
+		resolved, err := resolveUser(engine, manifest, g.ConfigUser())
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "config.user.resolve")
+		}
+		g.SetConfigUser(resolved)
+	}
 	if ctx.IsSet("config.stopsignal") {
-		g.SetConfigStopSignal(ctx.String("config.stopsignal"))
+		signal, err := igen.NormalizeStopSignal(ctx.String("config.stopsignal"), g.OS())
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "config.stopsignal")
+		}
+		g.SetConfigStopSignal(signal)
 	}
 	if ctx.IsSet("config.workingdir") {
 		g.SetConfigWorkingDir(ctx.String("config.workingdir"))
 	}
 	if ctx.IsSet("config.exposedports") {
 		for _, port := range ctx.StringSlice("config.exposedports") {
+			port, err := igen.NormalizeExposedPort(port)
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.exposedports")
+			}
 			g.AddConfigExposedPort(port)
 		}
 	}
+	// Removals are applied before any of the new values are added.
+	if ctx.IsSet("config.env.remove") {
+		for _, pattern := range ctx.StringSlice("config.env.remove") {
+			if err := g.RemoveConfigEnv(pattern); err != nil {
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.env.remove")
+			}
+		}
+	}
 	if ctx.IsSet("config.env") {
 		for _, env := range ctx.StringSlice("config.env") {
 			name, value, err := parseKV(env)
 			if err != nil {
-				return errors.Wrap(err, "config.env")
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.env")
 			}
 			g.AddConfigEnv(name, value)
 		}
@@ -242,76 +577,148 @@ func config(ctx *cli.Context) error {
 	if ctx.IsSet("config.entrypoint") {
 		g.SetConfigEntrypoint(ctx.StringSlice("config.entrypoint"))
 	}
+	if ctx.IsSet("config.entrypoint.append") {
+		g.AppendConfigEntrypoint(ctx.StringSlice("config.entrypoint.append"))
+	}
 	// FIXME: This interface is weird.
 	if ctx.IsSet("config.cmd") {
 		g.SetConfigCmd(ctx.StringSlice("config.cmd"))
 	}
+	if ctx.IsSet("config.cmd.append") {
+		g.AppendConfigCmd(ctx.StringSlice("config.cmd.append"))
+	}
 	if ctx.IsSet("config.volume") {
 		for _, volume := range ctx.StringSlice("config.volume") {
+			volume, err := igen.NormalizeVolume(volume, g.OS())
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.volume")
+			}
 			g.AddConfigVolume(volume)
 		}
 	}
+	if ctx.IsSet("config.label.remove") {
+		for _, pattern := range ctx.StringSlice("config.label.remove") {
+			if err := g.RemoveConfigLabels(pattern); err != nil {
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.label.remove")
+			}
+		}
+	}
 	if ctx.IsSet("config.label") {
 		for _, label := range ctx.StringSlice("config.label") {
 			name, value, err := parseKV(label)
 			if err != nil {
-				return errors.Wrap(err, "config.label")
+				return casext.DescriptorPath{}, errors.Wrap(err, "config.label")
 			}
 			g.AddConfigLabel(name, value)
 		}
 	}
-	if ctx.IsSet("manifest.annotation") {
-		if annotations == nil {
-			annotations = map[string]string{}
+	// Docker-specific fields, which are not part of the OCI configuration.
+	healthcheck := dockerConfig.Healthcheck
+	if healthcheck == nil {
+		healthcheck = &mutate.HealthConfig{}
+	} else {
+		// Don't modify the base configuration's healthcheck.
+		copied := *healthcheck
+		healthcheck = &copied
+	}
+	// FIXME: This interface is weird.
+	if ctx.IsSet("config.healthcheck") {
+		test, err := healthcheckTest(ctx.StringSlice("config.healthcheck"))
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "config.healthcheck")
 		}
-		for _, label := range ctx.StringSlice("manifest.annotation") {
-			parts := strings.SplitN(label, "=", 2)
-			annotations[parts[0]] = parts[1]
+		healthcheck.Test = test
+	}
+	for _, field := range []struct {
+		flag  string
+		value *time.Duration
+	}{
+		{"config.healthcheck.interval", &healthcheck.Interval},
+		{"config.healthcheck.timeout", &healthcheck.Timeout},
+		{"config.healthcheck.startperiod", &healthcheck.StartPeriod},
+	} {
+		if ctx.IsSet(field.flag) {
+			duration, err := parseDuration(ctx.String(field.flag))
+			if err != nil {
+				return casext.DescriptorPath{}, errors.Wrap(err, field.flag)
+			}
+			*field.value = duration
 		}
 	}
+	if ctx.IsSet("config.healthcheck.retries") {
+		retries := ctx.Int("config.healthcheck.retries")
+		if retries < 0 {
+			return casext.DescriptorPath{}, errors.Errorf("config.healthcheck.retries: must not be negative: %d", retries)
+		}
+		healthcheck.Retries = retries
+	}
+	for _, flag := range []string{"config.healthcheck", "config.healthcheck.interval", "config.healthcheck.timeout", "config.healthcheck.startperiod", "config.healthcheck.retries"} {
+		if ctx.IsSet(flag) {
+			dockerConfig.Healthcheck = healthcheck
+		}
+	}
+	// FIXME: This interface is weird.
+	if ctx.IsSet("config.shell") {
+		dockerConfig.Shell = ctx.StringSlice("config.shell")
+	}
+	if ctx.IsSet("config.onbuild") {
+		dockerConfig.OnBuild = append(dockerConfig.OnBuild, ctx.StringSlice("config.onbuild")...)
+	}
+
+	annotations, _, err = modifyAnnotations(ctx, "manifest", annotations)
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	descriptorAnnotations, _, err = modifyAnnotations(ctx, "descriptor", descriptorAnnotations)
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	indexAnnotations, changed, err := modifyAnnotations(ctx, "index", indexAnnotations)
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	indexModified = indexModified || changed
 
-	created := time.Now()
-	history := ispec.History{
+	created, err := creationTime()
+	if err != nil {
+		return casext.DescriptorPath{}, err
+	}
+	history, err := historyEntry(ctx, ispec.History{
 		Author:     g.Author(),
 		Comment:    "",
 		Created:    &created,
 		CreatedBy:  "umoci config",
 		EmptyLayer: true,
+	})
+	if err != nil {
+		return casext.DescriptorPath{}, err
 	}
 
-	if val, ok := ctx.App.Metadata["--history.author"]; ok {
-		history.Author = val.(string)
+	newConfig, newMeta := fromImage(g.Image())
+	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "set modified configuration")
 	}
-	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
-		history.Comment = val.(string)
+	if err := mutator.SetDockerConfig(context.Background(), dockerConfig); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "set modified docker configuration")
 	}
-	if val, ok := ctx.App.Metadata["--history.created"]; ok {
-		created, err := time.Parse(igen.ISO8601, val.(string))
-		if err != nil {
-			return errors.Wrap(err, "parsing --history.created")
-		}
-		history.Created = &created
+	if err := mutator.SetDescriptorAnnotations(context.Background(), descriptorAnnotations); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "set modified descriptor annotations")
 	}
-	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
-		history.CreatedBy = val.(string)
+	if indexModified {
+		if err := mutator.SetIndexAnnotations(context.Background(), indexAnnotations); err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "set modified index annotations")
+		}
 	}
 
-	newConfig, newMeta := fromImage(g.Image())
-	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
-		return errors.Wrap(err, "set modified configuration")
+	if err := applyCreation(ctx, mutator); err != nil {
+		return casext.DescriptorPath{}, err
 	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
 	if err != nil {
-		return errors.Wrap(err, "commit mutated image")
+		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated image")
 	}
 
 	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
-
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
-	log.Infof("created new tag for image manifest: %s", tagName)
-	return nil
+	return newDescriptorPath, nil
 }
@@ -0,0 +1,118 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var convertCommand = uxTag(cli.Command{
+	Name:  "convert",
+	Usage: "converts the media types of an image between the OCI and Docker formats",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --format <format>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to convert (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image.
+
+"<format>" is either "oci" (the media types of the OCI image-spec) or "docker"
+(the media types of Docker's image manifest schema version 2). The media types
+of every manifest, index, configuration and layer referenced by the tag are
+converted, with image indexes being converted to and from manifest lists.
+
+Note that most umoci commands only operate on images using the OCI format, so
+images should be converted to the Docker format as the last step before they
+are used.`,
+
+	// convert modifies a particular image (or index).
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format to convert the image to (oci or docker)",
+		},
+	},
+
+	Action: convert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("format") {
+			return errors.Errorf("missing mandatory argument: --format")
+		}
+		format, err := mutate.ParseFormat(ctx.String("format"))
+		if err != nil {
+			return errors.Wrap(err, "parse --format")
+		}
+		ctx.App.Metadata["--format"] = format
+		return nil
+	},
+})
+
+func convert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	format := ctx.App.Metadata["--format"].(mutate.Format)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	root, err := tagRoot(engineExt, fromName)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+
+	log.Infof("converting %s to the %s format", fromName, format)
+	newRoot, err := mutate.Convert(context.Background(), engine, *root, format)
+	if err != nil {
+		return errors.Wrap(err, "convert image")
+	}
+
+	log.Infof("new image created: %s (%s)", newRoot.Digest, newRoot.MediaType)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newRoot); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
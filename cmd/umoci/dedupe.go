@@ -0,0 +1,84 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var dedupeCommand = cli.Command{
+	Name:  "dedupe",
+	Usage: "deduplicates identical layers stored as different blobs",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command finds layers in the provided OCI image which have the same
+diff_id but are stored as different blobs (such as layers which were
+compressed with different settings), and rewrites every manifest to use the
+smallest of those blobs. Unless --no-gc is specified, the blobs which are no
+longer referenced are then garbage collected (see umoci-gc(1)).`,
+
+	// dedupe modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-gc",
+			Usage: "do not garbage collect the image after deduplicating layers",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		return nil
+	},
+
+	Action: dedupe,
+}
+
+func dedupe(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	replaced, err := mutate.Deduplicate(context.Background(), engine)
+	if err != nil {
+		return errors.Wrap(err, "deduplicate layers")
+	}
+	log.Infof("replaced %d duplicate layer references", replaced)
+
+	if ctx.Bool("no-gc") {
+		return nil
+	}
+	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+}
@@ -0,0 +1,226 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var diffCommand = cli.Command{
+	Name:  "diff",
+	Usage: "shows the file-level changes between two images",
+	ArgsUsage: `--image <image-path>[:<tag>] [<new-tag> | --bundle <bundle>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to compare against (if not specified, defaults to "latest"),
+"<new-tag>" is the name of another tagged image in the same OCI image and
+"<bundle>" is the path to a bundle (created by umoci-unpack(1)) whose root
+filesystem should be compared instead of another tagged image.
+
+Each path which was added, modified or deleted is listed, along with the
+changes to its type, mode, owner, size, contents and link target.
+Modification times are not compared.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// diff reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "compare against the root filesystem of the given bundle",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the changes as a JSON encoded blob",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("bundle") {
+			if ctx.NArg() != 0 {
+				return errors.Errorf("invalid number of positional arguments: expected none with --bundle")
+			}
+			if ctx.String("bundle") == "" {
+				return errors.Errorf("bundle path cannot be empty")
+			}
+			return nil
+		}
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <new-tag>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("new tag cannot be empty")
+		}
+		if !refRegexp.MatchString(ctx.Args().First()) {
+			return errors.Errorf("new tag is an invalid reference")
+		}
+		ctx.App.Metadata["new-tag"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// manifestTree returns the layer.FileTree of the manifest the given tag
+// refers to.
+func manifestTree(engineExt casext.Engine, tagName string) (layer.FileTree, error) {
+	descriptor, manifest, err := tagManifest(engineExt, tagName)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("reading image: %s", descriptor.Digest)
+	return layer.ManifestTree(context.Background(), engineExt, manifest, nil)
+}
+
+// bundleTree returns the layer.FileTree of the root filesystem of the given
+// bundle, as it would be repacked.
+func bundleTree(bundlePath string) (layer.FileTree, error) {
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		return nil, errors.Errorf("cannot diff a bundle unpacked with --overlay-layers")
+	}
+
+	log.Infof("reading bundle: %s", bundlePath)
+	return layer.RootfsTree(filepath.Join(bundlePath, layer.RootfsName), &layer.RepackOptions{
+		MapOptions:       meta.MapOptions,
+		EmulateXattrs:    meta.EmulateXattrs,
+		EmulateOwnership: meta.EmulateOwnership,
+		Devices:          meta.Devices,
+	})
+}
+
+func diff(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	oldTree, err := manifestTree(engineExt, tagName)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", tagName)
+	}
+
+	var newTree layer.FileTree
+	if bundlePath := ctx.String("bundle"); bundlePath != "" {
+		newTree, err = bundleTree(bundlePath)
+		if err != nil {
+			return errors.Wrapf(err, "read bundle %s", bundlePath)
+		}
+	} else {
+		newTag := ctx.App.Metadata["new-tag"].(string)
+		newTree, err = manifestTree(engineExt, newTag)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", newTag)
+		}
+	}
+
+	changes := layer.DiffTrees(oldTree, newTree)
+	if jsonOutput(ctx) {
+		// Always output a list, even if nothing changed.
+		if changes == nil {
+			changes = []layer.FileChange{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(changes); err != nil {
+			return errors.Wrap(err, "encoding changes")
+		}
+		return nil
+	}
+	if err := formatChanges(os.Stdout, changes); err != nil {
+		return errors.Wrap(err, "format changes")
+	}
+	return nil
+}
+
+// describeFile returns a short human-readable description of a path.
+func describeFile(info *layer.FileInfo) string {
+	desc := fmt.Sprintf("%s %04o %d:%d", info.Type, info.Mode, info.UID, info.GID)
+	switch info.Type {
+	case "file", "hardlink":
+		desc += " " + units.HumanSize(float64(info.Size))
+	}
+	if info.Linkname != "" {
+		desc += " -> " + info.Linkname
+	}
+	return desc
+}
+
+// formatChanges writes a human-readable table of the given changes to w.
+func formatChanges(w io.Writer, changes []layer.FileChange) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	for _, change := range changes {
+		var details string
+		switch change.Type {
+		case layer.ChangeAdded:
+			details = describeFile(change.New)
+		case layer.ChangeDeleted:
+			details = describeFile(change.Old)
+		case layer.ChangeModified:
+			var fields []string
+			for _, field := range change.Fields() {
+				from, to := change.Old, change.New
+				switch field {
+				case "type":
+					field = fmt.Sprintf("type %s -> %s", from.Type, to.Type)
+				case "mode":
+					field = fmt.Sprintf("mode %04o -> %04o", from.Mode, to.Mode)
+				case "owner":
+					field = fmt.Sprintf("owner %d:%d -> %d:%d", from.UID, from.GID, to.UID, to.GID)
+				case "size":
+					field = fmt.Sprintf("size %s -> %s", units.HumanSize(float64(from.Size)), units.HumanSize(float64(to.Size)))
+				case "linkname":
+					field = fmt.Sprintf("link %s -> %s", from.Linkname, to.Linkname)
+				case "device":
+					field = fmt.Sprintf("device %d:%d -> %d:%d", from.Devmajor, from.Devminor, to.Devmajor, to.Devminor)
+				}
+				fields = append(fields, field)
+			}
+			details = strings.Join(fields, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t/%s\t%s\n", change.Type, change.Path, details)
+	}
+	return tw.Flush()
+}
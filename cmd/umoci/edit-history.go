@@ -0,0 +1,243 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var editHistoryCommand = uxTag(cli.Command{
+	Name:  "edit-history",
+	Usage: "modifies the history entries of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image.
+
+The history entries given with --entry (counting from zero at the start of the
+history, with negative indices counting from the end) are modified according
+to the other options. If --entry is not specified, every history entry is
+modified. No layers are modified, and no history entry is added for the
+modification.`,
+
+	// edit-history modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "entry",
+			Usage: "index of a history entry to modify (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "created_by",
+			Usage: "new created_by value of the history entries",
+		},
+		cli.StringFlag{
+			Name:  "author",
+			Usage: "new author value of the history entries",
+		},
+		cli.StringFlag{
+			Name:  "comment",
+			Usage: "new comment value of the history entries",
+		},
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "new creation date of the history entries (ISO8601 format)",
+		}, // FIXME: Implement TimeFlag.
+		cli.StringFlag{
+			Name:  "empty-layer",
+			Usage: "whether the history entries correspond to an empty layer (true or false)",
+		},
+		cli.StringSliceFlag{
+			Name:  "replace",
+			Usage: "replace all instances of <old> with <new> in the created_by, author and comment values of the history entries (<old>=<new>)",
+		},
+	},
+
+	Action: editHistory,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		var modified bool
+		for _, flag := range []string{"created_by", "author", "comment", "created", "empty-layer", "replace"} {
+			if ctx.IsSet(flag) {
+				modified = true
+			}
+		}
+		if !modified {
+			return errors.Errorf("no history modifications specified")
+		}
+		return nil
+	},
+})
+
+// historyEntries converts the given --entry values (each an index, which may
+// be negative to count from the end of the history) into the set of indices
+// of history entries to modify. If no values are given, all entries are
+// returned.
+func historyEntries(values []string, numEntries int) (map[int]struct{}, error) {
+	entries := map[int]struct{}{}
+	if len(values) == 0 {
+		for idx := 0; idx < numEntries; idx++ {
+			entries[idx] = struct{}{}
+		}
+		return entries, nil
+	}
+	for _, value := range values {
+		idx, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Errorf("invalid --entry %q: must be an index", value)
+		}
+		if idx < 0 {
+			idx += numEntries
+		}
+		if idx < 0 || idx >= numEntries {
+			return nil, errors.Errorf("invalid --entry %s: image has %d history entries", value, numEntries)
+		}
+		entries[idx] = struct{}{}
+	}
+	return entries, nil
+}
+
+func editHistory(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Parse the modifications before touching the image.
+	var created *time.Time
+	if ctx.IsSet("created") {
+		value, err := time.Parse(igen.ISO8601, ctx.String("created"))
+		if err != nil {
+			return errors.Wrap(err, "parse --created")
+		}
+		created = &value
+	}
+	var emptyLayer *bool
+	if ctx.IsSet("empty-layer") {
+		value, err := strconv.ParseBool(ctx.String("empty-layer"))
+		if err != nil {
+			return errors.Wrap(err, "parse --empty-layer")
+		}
+		emptyLayer = &value
+	}
+	var replacements []string
+	for _, replace := range ctx.StringSlice("replace") {
+		parts := strings.SplitN(replace, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("--replace requires an argument of the form <old>=<new>: %q", replace)
+		}
+		replacements = append(replacements, parts...)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get history")
+	}
+	entries, err := historyEntries(ctx.StringSlice("entry"), len(history))
+	if err != nil {
+		return err
+	}
+
+	for idx := range history {
+		if _, ok := entries[idx]; !ok {
+			continue
+		}
+		entry := &history[idx]
+		if ctx.IsSet("created_by") {
+			entry.CreatedBy = ctx.String("created_by")
+		}
+		if ctx.IsSet("author") {
+			entry.Author = ctx.String("author")
+		}
+		if ctx.IsSet("comment") {
+			entry.Comment = ctx.String("comment")
+		}
+		if created != nil {
+			entry.Created = created
+		}
+		if emptyLayer != nil {
+			entry.EmptyLayer = *emptyLayer
+		}
+		entry.CreatedBy = replacer.Replace(entry.CreatedBy)
+		entry.Author = replacer.Replace(entry.Author)
+		entry.Comment = replacer.Replace(entry.Comment)
+		log.Debugf("edit-history: modified history entry %d", idx)
+	}
+
+	if err := mutator.SetHistory(context.Background(), history); err != nil {
+		return errors.Wrap(err, "set history")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
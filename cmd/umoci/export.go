@@ -0,0 +1,209 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/archive"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var exportCommand = uxPlatform(cli.Command{
+	Name:  "export",
+	Usage: "writes an image to a docker-archive or oci-archive tarball",
+	ArgsUsage: `--image <image-path>[:<tag>] --output <file>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to export (if not specified, defaults to "latest").
+"<file>" is the path of the archive to write ("-" writes the archive to
+stdout).
+
+With --format=docker-archive (the default), the archive can be loaded with
+"docker load" and is tagged with each --repo-tag (by default, the basename of
+<image-path> and <tag>). Only a single manifest can be exported this way, so
+--platform must be given for a multi-platform image. With
+--format=oci-archive, the archive contains an OCI image layout with the whole
+image (or only the manifest selected by --platform), tagged with <tag>.`,
+
+	// export reads a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the archive (docker-archive or oci-archive)",
+			Value: string(archive.DockerArchive),
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path of the archive to write (- for stdout)",
+		},
+		cli.StringSliceFlag{
+			Name:  "repo-tag",
+			Usage: "name (repository:tag) of the image when it is loaded from a docker-archive (can be specified multiple times)",
+		},
+	},
+
+	Action: export,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		format, err := archive.ParseFormat(ctx.String("format"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --format")
+		}
+		ctx.App.Metadata["--format"] = format
+		if ctx.String("output") == "" {
+			return errors.Errorf("--output must be specified")
+		}
+		if ctx.IsSet("repo-tag") && format != archive.DockerArchive {
+			return errors.Errorf("--repo-tag can only be used with --format=%s", archive.DockerArchive)
+		}
+		for _, repoTag := range ctx.StringSlice("repo-tag") {
+			if err := validateRepoTag(repoTag); err != nil {
+				return errors.Wrap(err, "invalid --repo-tag")
+			}
+		}
+		return nil
+	},
+})
+
+// validateRepoTag checks that the given name can be used as one of the
+// RepoTags of an image in a docker-archive.
+func validateRepoTag(repoTag string) error {
+	ref, err := remote.ParseReference(repoTag)
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" {
+		return errors.Errorf("%s: must not contain a digest", repoTag)
+	}
+	return nil
+}
+
+func export(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	format := ctx.App.Metadata["--format"].(archive.Format)
+	output := ctx.String("output")
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+
+	// Figure out what is going to be exported before creating the output, so
+	// that we don't leave an empty archive behind.
+	var write func(io.Writer) error
+	switch format {
+	case archive.DockerArchive:
+		indices, err := selectManifests(ctx, fromName, fromDescriptorPaths)
+		if err != nil {
+			return err
+		}
+		if len(indices) != 1 {
+			return errors.Errorf("a docker-archive can only contain a single manifest, use --platform")
+		}
+		repoTags := ctx.StringSlice("repo-tag")
+		if !ctx.IsSet("repo-tag") {
+			repoTag := filepath.Base(imagePath) + ":" + fromName
+			if err := validateRepoTag(repoTag); err != nil {
+				return errors.Wrap(err, "default repository tag is invalid, use --repo-tag")
+			}
+			repoTags = []string{repoTag}
+		}
+		image := archive.DockerImage{
+			Manifest: fromDescriptorPaths[indices[0]].Descriptor(),
+			RepoTags: repoTags,
+		}
+		write = func(w io.Writer) error {
+			return archive.WriteDockerArchive(context.Background(), engine, w, []archive.DockerImage{image})
+		}
+	case archive.OCIArchive:
+		if len(fromDescriptorPaths) == 0 {
+			return errors.Errorf("tag not found: %s", fromName)
+		}
+		root := fromDescriptorPaths[0].Root()
+		if _, ok := ctx.App.Metadata["--platform"]; ok {
+			indices, err := selectManifests(ctx, fromName, fromDescriptorPaths)
+			if err != nil {
+				return err
+			}
+			root = fromDescriptorPaths[indices[0]].Descriptor()
+		} else {
+			for _, descriptorPath := range fromDescriptorPaths {
+				if descriptorPath.Root().Digest != root.Digest {
+					// TODO: Handle this more nicely.
+					return errors.Errorf("tag is ambiguous: %s", fromName)
+				}
+			}
+		}
+		write = func(w io.Writer) error {
+			return archive.WriteOCIArchive(context.Background(), engine, w, root, fromName)
+		}
+	}
+
+	if output == "-" {
+		return errors.Wrapf(write(os.Stdout), "export %s", fromName)
+	}
+
+	// Write to a temporary file next to the output and rename it into place,
+	// so that a failed export doesn't leave a partial archive behind.
+	fh, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".")
+	if err != nil {
+		return errors.Wrap(err, "create output")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if err := write(fh); err != nil {
+		return errors.Wrapf(err, "export %s", fromName)
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close output")
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return errors.Wrap(err, "set output mode")
+	}
+	if err := os.Rename(fh.Name(), output); err != nil {
+		return errors.Wrap(err, "rename output")
+	}
+
+	log.Infof("exported %s to %s (%s)", fromName, output, format)
+	return nil
+}
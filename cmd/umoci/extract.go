@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var extractCommand = cli.Command{
+	Name:  "extract",
+	Usage: "copies a file or directory out of an image without unpacking it",
+	ArgsUsage: `--image <image-path>[:<tag>] <path> <dest>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to extract from (if not specified, defaults to "latest"),
+"<path>" is the path in the image to extract and "<dest>" is the destination
+on the host (which must not already exist).
+
+If "<path>" is a directory, "<dest>" is created as a copy of it (including
+everything underneath it). The layers of the image are read without being
+extracted, and only the paths inside "<path>" are written to disk. Hardlinks
+to files outside of "<path>" are skipped.`,
+
+	// extract reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to use when extracting (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to use when extracting (container:host:size)",
+		},
+		rootlessFlag("enable rootless extraction support"),
+	},
+
+	Action: extract,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <path> <dest>")
+		}
+		if ctx.Args().Get(0) == "" {
+			return errors.Errorf("path cannot be empty")
+		}
+		if ctx.Args().Get(1) == "" {
+			return errors.Errorf("destination cannot be empty")
+		}
+		ctx.App.Metadata["path"] = ctx.Args().Get(0)
+		ctx.App.Metadata["dest"] = ctx.Args().Get(1)
+		return nil
+	},
+}
+
+func extract(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	path := ctx.App.Metadata["path"].(string)
+	dest := ctx.App.Metadata["dest"].(string)
+
+	var unpackOptions layer.UnpackOptions
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	unpackOptions.MapOptions.Rootless = rootless
+	if unpackOptions.MapOptions.Rootless {
+		if !ctx.IsSet("uid-map") {
+			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
+		}
+		if !ctx.IsSet("gid-map") {
+			ctx.Set("gid-map", fmt.Sprintf("0:%d:1", os.Getegid()))
+		}
+	}
+	unpackOptions.MapOptions.UIDMappings, err = parseIDMappings("uid-map", ctx.StringSlice("uid-map"))
+	if err != nil {
+		return err
+	}
+	unpackOptions.MapOptions.GIDMappings, err = parseIDMappings("gid-map", ctx.StringSlice("gid-map"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, manifest, err := tagManifest(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("extracting %s from image: %s", path, descriptor.Digest)
+	if err := layer.ExtractPath(context.Background(), engineExt, manifest, path, dest, &unpackOptions); err != nil {
+		return err
+	}
+	log.Infof("extracted %s to %s", path, dest)
+	return nil
+}
@@ -18,8 +18,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
@@ -34,21 +39,60 @@ Where "<image-path>" is the path to the OCI image.
 
 This command will do a mark-and-sweep garbage collection of the provided OCI
 image, only retaining blobs which can be reached by a descriptor path from the
-root set of references. All other blobs will be removed.`,
+root set of references. All other blobs will be removed.
+
+Blobs can also be retained using a retention policy. --keep-newer-than keeps
+any blob written to the image less than the given duration (such as "24h")
+ago, and --keep-tagged-history keeps the images that each tag previously
+referred to (as restored by umoci-rollback(1)). With --dry-run, the digests of
+the blobs which would be removed are printed and nothing is removed.`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "keep-newer-than",
+			Usage: "keep blobs written to the image less than this duration ago",
+		},
+		cli.IntFlag{
+			Name:  "keep-tagged-history",
+			Usage: "keep the previous <n> images that each tag referred to",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the blobs which would be removed without removing them",
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
 			return errors.Errorf("missing mandatory argument: --layout")
 		}
+		if ctx.Duration("keep-newer-than") < 0 {
+			return errors.Errorf("--keep-newer-than must not be negative")
+		}
+		if ctx.Int("keep-tagged-history") < 0 {
+			return errors.Errorf("--keep-tagged-history must not be negative")
+		}
 		return nil
 	},
 
 	Action: gc,
 }
 
+// gcResult is the result of umoci-gc(1), which is output if the global --json
+// flag is set.
+type gcResult struct {
+	// Removed are the digests of the blobs which were removed (or which would
+	// have been removed with --dry-run).
+	Removed []digest.Digest `json:"removed"`
+
+	// DryRun is whether --dry-run was set, in which case no blobs were
+	// actually removed.
+	DryRun bool `json:"dry_run"`
+}
+
 func gc(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
@@ -61,5 +105,29 @@ func gc(ctx *cli.Context) error {
 	defer engine.Close()
 
 	// Run the GC.
-	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+	removed, err := engineExt.GCWithOptions(context.Background(), &casext.GCOptions{
+		KeepNewerThan: ctx.Duration("keep-newer-than"),
+		KeepHistory:   ctx.Int("keep-tagged-history"),
+		DryRun:        ctx.Bool("dry-run"),
+		Workers:       ctx.GlobalInt("workers"),
+	})
+	if err != nil {
+		return errors.Wrap(err, "gc")
+	}
+	if ctx.GlobalBool("json") {
+		if removed == nil {
+			removed = []digest.Digest{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(gcResult{
+			Removed: removed,
+			DryRun:  ctx.Bool("dry-run"),
+		}); err != nil {
+			return errors.Wrap(err, "encoding result")
+		}
+	} else if ctx.Bool("dry-run") {
+		for _, digest := range removed {
+			fmt.Println(digest)
+		}
+	}
+	return nil
 }
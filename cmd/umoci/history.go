@@ -0,0 +1,216 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var historyCommand = uxFormat(cli.Command{
+	Name:  "history",
+	Usage: "shows the history of an image and the layers it created",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose history is shown. If "<image-path>" is "-", the image is
+read from a docker-archive or oci-archive on stdin (see umoci-import(1)), and
+"<tag>" selects the image if the archive contains several images.
+
+Each entry in the history of the image is shown (most recent first) together
+with the layer it created: the digest and compressed size of the layer blob
+and the layer's diff_id. Entries which did not create a layer are shown as
+"<empty>", and entries whose layer is missing from the image manifest are
+shown as "<missing>". Layers with no corresponding history entry are also
+shown. Digests and commands are truncated unless --no-trunc is given.
+
+If --format is specified, each entry is instead formatted using the given Go
+template (see text/template), with the same fields as --json (such as
+"{{.CreatedBy}} {{.DiffID}}"). The --json output is the same as the history in
+umoci-stat(1) --json, but most recent first.
+
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it
+is easy for humans to read, and might change in future versions.`,
+
+	// history gives information about a manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the history as a JSON encoded blob",
+		},
+		cli.BoolFlag{
+			Name:  "no-trunc",
+			Usage: "do not truncate digests and commands",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: history,
+})
+
+// historyCreatedByWidth is the width that the command which created each
+// history entry is truncated to by umoci-history(1).
+const historyCreatedByWidth = 45
+
+// truncateDigest truncates the given digest string to the first 12
+// characters of its encoded portion (as is done by docker-history(1)).
+func truncateDigest(value string) string {
+	encoded := digest.Digest(value).Hex()
+	if len(encoded) > 12 {
+		encoded = encoded[:12]
+	}
+	return encoded
+}
+
+// truncateString truncates the given string to the given number of runes,
+// replacing the end of the string with "..." if it was truncated.
+func truncateString(value string, width int) string {
+	runes := []rune(value)
+	if len(runes) <= width {
+		return value
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+// formatHistory writes the given history entries (most recent first) as a
+// table to the given writer.
+func formatHistory(w io.Writer, entries []historyStat, noTrunc bool) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tDIFF ID\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for _, entry := range entries {
+		var (
+			layerID   = "<missing>"
+			diffID    = "<missing>"
+			created   = "<none>"
+			createdBy = strings.Replace(entry.CreatedBy, "\t", " ", -1)
+			size      = "<none>"
+			comment   = strings.Replace(entry.Comment, "\t", " ", -1)
+		)
+
+		if entry.EmptyLayer {
+			layerID = "<empty>"
+			diffID = "<empty>"
+		}
+		if entry.Layer != nil {
+			layerID = entry.Layer.Digest.String()
+			size = units.HumanSize(float64(entry.Layer.Size))
+			if !noTrunc {
+				layerID = truncateDigest(layerID)
+			}
+		}
+		if entry.DiffID != "" {
+			diffID = entry.DiffID
+			if !noTrunc {
+				diffID = truncateDigest(diffID)
+			}
+		}
+		if entry.Created != nil {
+			created = entry.Created.Format(igen.ISO8601)
+		}
+		if !noTrunc {
+			createdBy = truncateString(createdBy, historyCreatedByWidth)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", layerID, diffID, created, createdBy, size, comment)
+	}
+	return tw.Flush()
+}
+
+func history(ctx *cli.Context) error {
+	cleanup, err := stageStdinImage(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	manifestDescriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(manifestDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	ms, err := Stat(context.Background(), engineExt, manifestDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+
+	// Show the most recent entries first.
+	entries := []historyStat{}
+	for idx := len(ms.History) - 1; idx >= 0; idx-- {
+		entries = append(entries, ms.History[idx])
+	}
+
+	if tmpl, ok := ctx.App.Metadata["--format"].(*template.Template); ok {
+		for _, entry := range entries {
+			if err := executeTemplate(os.Stdout, tmpl, entry); err != nil {
+				return err
+			}
+		}
+	} else if jsonOutput(ctx) {
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding history")
+		}
+	} else {
+		if err := formatHistory(os.Stdout, entries, ctx.Bool("no-trunc")); err != nil {
+			return errors.Wrap(err, "format history")
+		}
+	}
+	return nil
+}
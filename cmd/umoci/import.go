@@ -0,0 +1,225 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/archive"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var importCommand = cli.Command{
+	Name:  "import",
+	Usage: "reads an image from a docker-archive or oci-archive tarball",
+	ArgsUsage: `--image <image-path>[:<tag>] <archive>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tag that the imported image will be saved as (if not specified, defaults
+to "latest"). If the OCI image does not exist, it is created.
+
+"<archive>" is the path of a docker-archive (as produced by "docker save") or
+an oci-archive (a tar archive of an OCI image layout). If "<archive>" is "-",
+the archive is read from stdin. The format of the archive is detected
+automatically unless --format is given.
+
+If the archive contains several images, --archive-name must be given to
+select the image to import, by one of its names in the archive (a RepoTags
+entry of a docker-archive, or a reference name of an oci-archive).`,
+
+	// import modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format of the archive (docker-archive or oci-archive)",
+		},
+		cli.StringFlag{
+			Name:  "archive-name",
+			Usage: "name of the image to import from an archive containing several images",
+		},
+	},
+
+	Action: importArchive,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("archive cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = ctx.Args().First()
+
+		if ctx.IsSet("format") {
+			format, err := archive.ParseFormat(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --format")
+			}
+			ctx.App.Metadata["--format"] = format
+		}
+		return nil
+	},
+}
+
+// selectArchiveImage returns the image with the given name (or, if name is
+// empty, the only image) of an archive.
+func selectArchiveImage(images []archive.Image, name string) (archive.Image, error) {
+	if name == "" {
+		if len(images) != 1 {
+			var names []string
+			for _, image := range images {
+				names = append(names, image.Names...)
+			}
+			return archive.Image{}, errors.Errorf("archive contains %d images, use --archive-name (available names: %s)", len(images), strings.Join(names, ", "))
+		}
+		return images[0], nil
+	}
+	for _, image := range images {
+		for _, candidate := range image.Names {
+			if candidate == name {
+				return image, nil
+			}
+		}
+	}
+	return archive.Image{}, errors.Errorf("archive contains no image named %s", name)
+}
+
+// stdinImagePath is the --image path which causes the image to be read from
+// an archive on stdin (see stageStdinImage).
+const stdinImagePath = "-"
+
+// stageStdinImage reads the image from an archive on stdin if --image was
+// given as "-", for commands which can read images that are piped to them. The
+// archive is imported into a temporary image layout (which replaces
+// ctx.App.Metadata["--image-path"]), and the image is tagged with the
+// requested tag. If the archive contains several images, the tag selects the
+// image by name. The returned function removes the temporary image layout.
+func stageStdinImage(ctx *cli.Context) (func(), error) {
+	if ctx.App.Metadata["--image-path"] != stdinImagePath {
+		return func() {}, nil
+	}
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	tempDir, err := ioutil.TempDir("", "umoci-stdin-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary image")
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			log.Warnf("could not remove temporary image %s: %v", tempDir, err)
+		}
+	}
+	// dir.Create requires the image path to not exist.
+	imagePath := filepath.Join(tempDir, "image")
+	if err := dir.Create(imagePath); err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "create temporary image")
+	}
+
+	if err := func() error {
+		engine, err := dir.Open(imagePath)
+		if err != nil {
+			return errors.Wrap(err, "open CAS")
+		}
+		engineExt := casext.NewEngine(engine)
+		defer engine.Close()
+
+		log.Infof("reading image from stdin")
+		images, err := archive.ReadArchive(context.Background(), engine, os.Stdin, "")
+		if err != nil {
+			return errors.Wrap(err, "read image from stdin")
+		}
+		var image archive.Image
+		if len(images) == 1 {
+			image = images[0]
+		} else if image, err = selectArchiveImage(images, tagName); err != nil {
+			return errors.Wrapf(err, "archive on stdin contains %d images, select one with --image -:<name>", len(images))
+		}
+		return errors.Wrap(engineExt.UpdateReference(context.Background(), tagName, image.Descriptor), "add new tag")
+	}(); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	ctx.App.Metadata["--image-path"] = imagePath
+	return cleanup, nil
+}
+
+func importArchive(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+
+	var format archive.Format
+	if val, ok := ctx.App.Metadata["--format"]; ok {
+		format = val.(archive.Format)
+	}
+
+	var input io.Reader = os.Stdin
+	if archivePath != "-" {
+		fh, err := os.Open(archivePath)
+		if err != nil {
+			return errors.Wrap(err, "open archive")
+		}
+		defer fh.Close()
+		input = fh
+	}
+
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		if err := dir.Create(imagePath); err != nil {
+			return errors.Wrap(err, "image layout creation")
+		}
+		log.Infof("created new OCI image: %s", imagePath)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	log.Infof("importing %s", archivePath)
+	images, err := archive.ReadArchive(context.Background(), engine, input, format)
+	if err != nil {
+		return errors.Wrapf(err, "import %s", archivePath)
+	}
+	image, err := selectArchiveImage(images, ctx.String("archive-name"))
+	if err != nil {
+		return err
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, image.Descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("imported %s as %s: %s", archivePath, tagName, image.Descriptor.Digest)
+	return outputTagResult(ctx, engineExt, tagName)
+}
@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var indexAddCommand = uxTag(cli.Command{
+	Name:  "add",
+	Usage: "adds the manifest for a platform to an image index",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <source-tag>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the image index to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new index as, if this is not
+specified then umoci will replace the old index. "<source-tag>" is the name of
+a tagged image in the same OCI image, which must refer to a single image
+manifest.
+
+The image manifest of "<source-tag>" is added to the index as the manifest for
+its platform, which is taken from its image configuration unless --platform is
+specified. The index must not already have an entry for the same platform. If
+"<tag>" doesn't exist, a new image index is created, and if it refers to an
+image manifest it is first converted to an image index containing only that
+manifest.`,
+
+	// index add modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform (os/architecture[/variant]) of the added manifest",
+		},
+		cli.StringFlag{
+			Name:  "os.version",
+			Usage: "operating system version of the added manifest",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "annotation of the entry for the added manifest (<name>=<value>)",
+		},
+	},
+
+	Action: indexAdd,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <source-tag>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("source tag cannot be empty")
+		}
+		ctx.App.Metadata["source-tag"] = ctx.Args().First()
+		return nil
+	},
+})
+
+func indexAdd(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	sourceName := ctx.App.Metadata["source-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	annotations := map[string]string{}
+	for _, annotation := range ctx.StringSlice("annotation") {
+		name, value, err := parseKV(annotation)
+		if err != nil {
+			return errors.Wrap(err, "annotation")
+		}
+		annotations[name] = value
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	sourceDescriptorPaths, err := engineExt.ResolveReference(context.Background(), sourceName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(sourceDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", sourceName)
+	}
+	if len(sourceDescriptorPaths) != 1 {
+		return errors.Errorf("tag is ambiguous: %s (it refers to %d manifests)", sourceName, len(sourceDescriptorPaths))
+	}
+	source := sourceDescriptorPaths[0].Descriptor()
+
+	platform, err := manifestPlatform(engine, source)
+	if err != nil {
+		return err
+	}
+	if ctx.IsSet("platform") {
+		value, err := parsePlatform(ctx.String("platform"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --platform")
+		}
+		platform.OS = value.OS
+		platform.Architecture = value.Architecture
+		platform.Variant = value.Variant
+	}
+	if ctx.IsSet("os.version") {
+		platform.OSVersion = ctx.String("os.version")
+	}
+
+	index, err := openIndex(engine, fromName, true)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("adding %s to %s as the manifest for %s", sourceName, fromName, formatPlatform(ispec.Descriptor{Platform: &platform}))
+	if err := index.Add(context.Background(), ispec.Descriptor{
+		MediaType:   source.MediaType,
+		Digest:      source.Digest,
+		Size:        source.Size,
+		Platform:    &platform,
+		Annotations: annotations,
+	}); err != nil {
+		return errors.Wrapf(err, "add manifest of %s", sourceName)
+	}
+
+	return commitIndex(ctx, engine, index, tagName)
+}
@@ -0,0 +1,89 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var indexRemoveCommand = uxTag(cli.Command{
+	Name:  "remove",
+	Usage: "removes the manifest for a platform from an image index",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <platform>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the image index to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new index as, if this is not
+specified then umoci will replace the old index. "<platform>" is the platform
+(of the form os/architecture[/variant]) whose manifest is removed. If no
+variant is given, the manifests for every variant of the architecture are
+removed.`,
+
+	// index remove modifies an image layout.
+	Category: "image",
+
+	Action: indexRemove,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <platform>")
+		}
+		platform, err := parsePlatform(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <platform>")
+		}
+		ctx.App.Metadata["platform"] = platform
+		return nil
+	},
+})
+
+func indexRemove(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	platform := ctx.App.Metadata["platform"].(ispec.Platform)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	index, err := openIndex(engine, fromName, false)
+	if err != nil {
+		return err
+	}
+
+	removed, err := index.Remove(context.Background(), platform)
+	if err != nil {
+		return errors.Wrapf(err, "remove platform %s", ctx.Args().First())
+	}
+	log.Infof("removed %d manifests for %s from %s", removed, ctx.Args().First(), fromName)
+
+	return commitIndex(ctx, engine, index, tagName)
+}
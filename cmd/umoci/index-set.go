@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var indexSetCommand = uxTag(cli.Command{
+	Name:  "set",
+	Usage: "modifies the entry for a platform of an image index",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <platform>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the image index to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new index as, if this is not
+specified then umoci will replace the old index. "<platform>" is the platform
+(of the form os/architecture[/variant]) of the entry to modify, which must
+match exactly one entry of the index.
+
+The platform fields and annotations of the entry are modified according to the
+other options. The referenced manifest is not modified.`,
+
+	// index set modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "variant",
+			Usage: "new architecture variant of the entry (empty to remove it)",
+		},
+		cli.StringFlag{
+			Name:  "os.version",
+			Usage: "new operating system version of the entry (empty to remove it)",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Usage: "set an annotation of the entry (<name>=<value>)",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation.remove",
+			Usage: "remove an annotation of the entry",
+		},
+	},
+
+	Action: indexSet,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <platform>")
+		}
+		platform, err := parsePlatform(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <platform>")
+		}
+		ctx.App.Metadata["platform"] = platform
+		var modified bool
+		for _, flag := range []string{"variant", "os.version", "annotation", "annotation.remove"} {
+			if ctx.IsSet(flag) {
+				modified = true
+			}
+		}
+		if !modified {
+			return errors.Errorf("no modifications specified")
+		}
+		return nil
+	},
+})
+
+func indexSet(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	match := ctx.App.Metadata["platform"].(ispec.Platform)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	index, err := openIndex(engine, fromName, false)
+	if err != nil {
+		return err
+	}
+
+	if ctx.IsSet("annotation") || ctx.IsSet("annotation.remove") {
+		annotations, err := index.Annotations(context.Background(), match)
+		if err != nil {
+			return errors.Wrap(err, "get annotations")
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for _, name := range ctx.StringSlice("annotation.remove") {
+			delete(annotations, name)
+		}
+		for _, annotation := range ctx.StringSlice("annotation") {
+			name, value, err := parseKV(annotation)
+			if err != nil {
+				return errors.Wrap(err, "annotation")
+			}
+			annotations[name] = value
+		}
+		if err := index.SetAnnotations(context.Background(), match, annotations); err != nil {
+			return errors.Wrap(err, "set annotations")
+		}
+	}
+
+	platform, err := index.Platform(context.Background(), match)
+	if err != nil {
+		return errors.Wrapf(err, "get platform %s", ctx.Args().First())
+	}
+	if ctx.IsSet("variant") {
+		platform.Variant = ctx.String("variant")
+	}
+	if ctx.IsSet("os.version") {
+		platform.OSVersion = ctx.String("os.version")
+	}
+	if err := index.SetPlatform(context.Background(), match, platform); err != nil {
+		return errors.Wrapf(err, "set platform %s", ctx.Args().First())
+	}
+
+	log.Infof("modified the entry for %s of %s", formatPlatform(ispec.Descriptor{Platform: &platform}), fromName)
+
+	return commitIndex(ctx, engine, index, tagName)
+}
@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var indexSubcommand = cli.Command{
+	Name:  "index",
+	Usage: "manages the platforms of an image index",
+	ArgsUsage: `index <command> [<args>...]
+
+The umoci-index(1) subcommands modify the entries of an image index, which
+reference the image manifest for each platform of a multi-platform image. They
+can be used to assemble a multi-platform image from images built for each
+platform.`,
+
+	Subcommands: []cli.Command{
+		indexAddCommand,
+		indexRemoveCommand,
+		indexSetCommand,
+	},
+}
+
+// manifestPlatform returns the platform of the image manifest referenced by
+// the given descriptor, which is taken from the descriptor if it has one (such
+// as when the manifest is referenced by an image index) and from the image
+// configuration otherwise.
+func manifestPlatform(engine cas.Engine, descriptor ispec.Descriptor) (ispec.Platform, error) {
+	if descriptor.Platform != nil {
+		return *descriptor.Platform, nil
+	}
+	platform, err := mutate.ConfigPlatform(context.Background(), engine, descriptor)
+	if err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "get platform from config")
+	}
+	return platform, nil
+}
+
+// openIndex returns an IndexMutator for the image index that the given tag
+// refers to. If create is set, tags which don't exist are created as a new
+// empty index and tags which refer to an image manifest are converted to an
+// index containing only that manifest. Otherwise the tag must refer to an image
+// index.
+func openIndex(engine cas.Engine, name string, create bool) (*mutate.IndexMutator, error) {
+	root, err := tagRoot(casext.NewEngine(engine), name)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		if !create {
+			return nil, errors.Errorf("tag not found: %s", name)
+		}
+		log.Infof("creating new image index for %s", name)
+		return mutate.NewEmptyIndex(engine), nil
+	}
+
+	switch root.MediaType {
+	case ispec.MediaTypeImageIndex:
+		return mutate.NewIndex(engine, *root)
+	case ispec.MediaTypeImageManifest:
+		if !create {
+			break
+		}
+		platform, err := manifestPlatform(engine, *root)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("converting %s to an image index containing its manifest (%s)", name, formatPlatform(ispec.Descriptor{Platform: &platform}))
+		index := mutate.NewEmptyIndex(engine)
+		if err := index.Add(context.Background(), ispec.Descriptor{
+			MediaType: root.MediaType,
+			Digest:    root.Digest,
+			Size:      root.Size,
+			Platform:  &platform,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "add manifest of %s", name)
+		}
+		return index, nil
+	}
+	return nil, errors.Errorf("tag %s does not refer to an image index: %s", name, root.MediaType)
+}
+
+// commitIndex commits the given IndexMutator and updates the given tag to refer
+// to the new image index.
+func commitIndex(ctx *cli.Context, engine cas.Engine, index *mutate.IndexMutator, name string) error {
+	descriptor, err := index.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated index")
+	}
+
+	log.Infof("new image index created: %s", descriptor.Digest)
+
+	if err := casext.NewEngine(engine).UpdateReference(context.Background(), name, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image index: %s", name)
+	return outputTagResult(ctx, casext.NewEngine(engine), name)
+}
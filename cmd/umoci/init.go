@@ -18,16 +18,25 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 )
 
-var initCommand = cli.Command{
+var initCommand = uxRemote(cli.Command{
 	Name:  "init",
 	Usage: "create a new OCI layout",
 	ArgsUsage: `--layout <image-path>
@@ -36,15 +45,133 @@ Where "<image-path>" is the path to the OCI image to be created.
 
 The new OCI image does not contain any references or blobs, but those can be
 created through the use of umoci-new(1), umoci-tag(1) and other similar
-commands.`,
+commands.
+
+If --template is given, the new OCI image is populated with the images listed
+in the JSON template of the form
+
+  {
+    "images": [
+      {"tag": "<tag>", "from": "docker://[<registry>/]<repository>[:<tag>|@<digest>]"},
+      {"tag": "<tag>", "from": "<image-path>[:<tag>]"}
+    ]
+  }
+
+where each image is either pulled from a registry (as with umoci-pull(1)) or
+copied from another OCI image (relative to the directory containing the
+template), and then tagged as "<tag>". If any image cannot be added, the new
+OCI image is removed.`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "template",
+			Usage: "path to a JSON template listing the images to populate the new layout with",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("template") {
+			if ctx.String("template") == "" {
+				return errors.Errorf("--template cannot be empty")
+			}
+			// Validate the template before creating anything.
+			template, err := readInitTemplate(ctx.String("template"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --template")
+			}
+			ctx.App.Metadata["--template"] = template
+		}
+		return nil
+	},
+
 	Action: initLayout,
+})
+
+// initTemplate is the template read by umoci-init(1) --template.
+type initTemplate struct {
+	// Images are the images added to the new layout, in order.
+	Images []initTemplateImage `json:"images"`
+}
+
+// initTemplateImage is a single image of an initTemplate.
+type initTemplateImage struct {
+	// Tag is the tag the image is added as.
+	Tag string `json:"tag"`
+
+	// From is the source of the image, either a docker:// reference or a
+	// local <image-path>[:<tag>].
+	From string `json:"from"`
+
+	// ref is the parsed From, if it is a docker:// reference.
+	ref *remote.Reference
+
+	// path and tag are the parsed From, if it is a local image.
+	path, tag string
+}
+
+// String returns a description of the source of the image.
+func (image initTemplateImage) String() string {
+	if image.ref != nil {
+		return image.ref.String()
+	}
+	return image.path + ":" + image.tag
+}
+
+// readInitTemplate reads and validates the template at the given path. Local
+// image paths are made relative to the directory containing the template.
+func readInitTemplate(path string) (initTemplate, error) {
+	var template initTemplate
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return template, errors.Wrap(err, "read template")
+	}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return template, errors.Wrap(err, "parse template")
+	}
+
+	tags := map[string]bool{}
+	for idx := range template.Images {
+		image := &template.Images[idx]
+		if image.Tag == "" {
+			return template, errors.Errorf("template: image %d: tag cannot be empty", idx)
+		}
+		if !refRegexp.MatchString(image.Tag) {
+			return template, errors.Errorf("template: image %d: tag is an invalid reference: %s", idx, image.Tag)
+		}
+		if tags[image.Tag] {
+			return template, errors.Errorf("template: image %d: duplicate tag: %s", idx, image.Tag)
+		}
+		tags[image.Tag] = true
+
+		if image.From == "" {
+			return template, errors.Errorf("template: image %d: from cannot be empty", idx)
+		}
+		if strings.Contains(image.From, "://") {
+			ref, err := remote.ParseReference(image.From)
+			if err != nil {
+				return template, errors.Wrapf(err, "template: image %d", idx)
+			}
+			image.ref = &ref
+		} else {
+			image.path, image.tag, err = parseImageRef(image.From)
+			if err != nil {
+				return template, errors.Wrapf(err, "template: image %d", idx)
+			}
+			if !filepath.IsAbs(image.path) {
+				image.path = filepath.Join(filepath.Dir(path), image.path)
+			}
+		}
+	}
+	return template, nil
 }
 
-func initLayout(ctx *cli.Context) error {
+func initLayout(ctx *cli.Context) (Err error) {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	if _, err := os.Stat(imagePath); !os.IsNotExist(err) {
@@ -59,5 +186,98 @@ func initLayout(ctx *cli.Context) error {
 	}
 
 	log.Infof("created new OCI image: %s", imagePath)
+
+	template, ok := ctx.App.Metadata["--template"].(initTemplate)
+	if !ok {
+		return nil
+	}
+
+	// Don't leave a partially populated layout behind.
+	defer func() {
+		if Err != nil {
+			if err := os.RemoveAll(imagePath); err != nil {
+				log.Warnf("failed to remove partially populated image %s: %v", imagePath, err)
+			}
+		}
+	}()
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	client := remote.NewClient(ctx.App.Metadata["--remote-options"].(remote.Options))
+	for _, image := range template.Images {
+		var descriptor ispec.Descriptor
+		if image.ref != nil {
+			log.Infof("pulling %s", image)
+			descriptor, err = client.Pull(context.Background(), *image.ref, engine, remote.PullOptions{
+				Workers: ctx.GlobalInt("workers"),
+			})
+		} else {
+			log.Infof("copying %s", image)
+			descriptor, err = copyLocalImage(context.Background(), engine, image.path, image.tag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "add %s", image)
+		}
+
+		if err := engineExt.UpdateReference(context.Background(), image.Tag, descriptor); err != nil {
+			return errors.Wrapf(err, "add new tag %s", image.Tag)
+		}
+		log.Infof("added %s as %s: %s", image, image.Tag, descriptor.Digest)
+	}
 	return nil
 }
+
+// copyLocalImage copies the image with the given tag (and every blob it
+// refers to) from the OCI image at srcPath into the given engine, and returns
+// the descriptor of the image. The descriptor is not added to the top-level
+// index of the engine.
+func copyLocalImage(ctx context.Context, engine cas.Engine, srcPath, tag string) (ispec.Descriptor, error) {
+	srcEngine, err := dir.Open(srcPath)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open source CAS")
+	}
+	srcEngineExt := casext.NewEngine(srcEngine)
+	defer srcEngine.Close()
+
+	descriptorPaths, err := srcEngineExt.ResolveReference(ctx, tag)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Descriptor{}, errors.Errorf("tag not found: %s", tag)
+	}
+	// The whole image (including every platform of an index) is copied, so
+	// every path must come from the same entry of the top-level index.
+	descriptor := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths {
+		if descriptorPath.Root().Digest != descriptor.Digest {
+			return ispec.Descriptor{}, errors.Errorf("tag is ambiguous: %s", tag)
+		}
+	}
+
+	digests, err := srcEngineExt.Reachable(ctx, descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "find reachable blobs")
+	}
+	for _, blobDigest := range digests {
+		reader, err := srcEngine.GetBlob(ctx, blobDigest)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "get blob %s", blobDigest)
+		}
+		newDigest, _, err := engine.PutBlob(ctx, reader)
+		reader.Close()
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "put blob %s", blobDigest)
+		}
+		if newDigest != blobDigest {
+			return ispec.Descriptor{}, errors.Errorf("blob has the wrong digest: %s (expected %s)", newDigest, blobDigest)
+		}
+	}
+	return descriptor, nil
+}
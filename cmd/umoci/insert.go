@@ -0,0 +1,285 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var insertCommand = uxCreated(uxHistory(uxTag(cli.Command{
+	Name:  "insert",
+	Usage: "inserts content into an image as a new layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <source> <target>
+   umoci insert --image <image-path>[:<tag>] [--tag <new-tag>] (--tar <archive> | --from-stdin) <target>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image. "<target>" is the path in the
+image the content is inserted at.
+
+The content is either the file or directory "<source>" on the host, or the
+contents of the uncompressed tar archive "<archive>" (or the archive read from
+stdin with --from-stdin, or with "--tar -"), such as one produced by another
+build step. Every entry of the archive is moved underneath "<target>".
+
+The content is added to the image as a new layer, without unpacking the image.
+If "<target>" is an existing directory, the content is merged with it unless
+--opaque is specified, in which case "<target>" only contains the new
+content.`,
+
+	// insert modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "tar",
+			Usage: "insert the contents of the given tar archive ('-' for stdin)",
+		},
+		cli.BoolFlag{
+			Name:  "from-stdin",
+			Usage: "insert the contents of the tar archive read from stdin (same as --tar -)",
+		},
+		cli.BoolFlag{
+			Name:  "opaque",
+			Usage: "replace the existing contents of <target> rather than merging with them",
+		},
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the new layer (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+		rootlessFlag("insert <source> owned by root (using the rootless uid and gid mappings)"),
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to use when inserting <source>",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to use when inserting <source>",
+		},
+	},
+
+	Action: insert,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("tar") && ctx.Bool("from-stdin") {
+			return errors.Errorf("--tar and --from-stdin are mutually exclusive")
+		}
+		if ctx.IsSet("tar") && ctx.String("tar") == "" {
+			return errors.Errorf("--tar cannot be empty")
+		}
+
+		args := []string{"source", "target"}
+		if ctx.IsSet("tar") || ctx.Bool("from-stdin") {
+			for _, flag := range []string{"rootless", "uid-map", "gid-map"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s cannot be used with --tar or --from-stdin", flag)
+				}
+			}
+			args = []string{"target"}
+		}
+		if ctx.NArg() != len(args) {
+			if len(args) == 1 {
+				return errors.Errorf("invalid number of positional arguments: expected <target>")
+			}
+			return errors.Errorf("invalid number of positional arguments: expected <source> <target>")
+		}
+		for idx, name := range args {
+			if ctx.Args().Get(idx) == "" {
+				return errors.Errorf("%s cannot be empty", name)
+			}
+			ctx.App.Metadata[name] = ctx.Args().Get(idx)
+		}
+		return nil
+	},
+})))
+
+// insertTarReader is the layer generated from a tar archive, which also
+// closes the archive when it is closed.
+type insertTarReader struct {
+	io.ReadCloser
+	input io.Closer
+}
+
+func (r insertTarReader) Close() error {
+	r.ReadCloser.Close()
+	return r.input.Close()
+}
+
+// insertLayer returns the layer described by the positional arguments and
+// --tar or --from-stdin, as well as a description of the inserted content
+// for the history entry.
+func insertLayer(ctx *cli.Context, target string) (io.ReadCloser, string, error) {
+	tarPath := ctx.String("tar")
+	if ctx.Bool("from-stdin") {
+		tarPath = "-"
+	}
+	if tarPath != "" {
+		var input io.ReadCloser = os.Stdin
+		if tarPath != "-" {
+			inputFile, err := os.Open(tarPath)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "open --tar")
+			}
+			input = inputFile
+		}
+		reader, err := layer.GenerateInsertTarLayer(input, target, ctx.Bool("opaque"))
+		if err != nil {
+			input.Close()
+			return nil, "", err
+		}
+		return insertTarReader{reader, input}, "--tar " + tarPath, nil
+	}
+
+	source := ctx.App.Metadata["source"].(string)
+	var mapOptions layer.MapOptions
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	mapOptions.Rootless = rootless
+	if rootless {
+		if !ctx.IsSet("uid-map") {
+			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
+		}
+		if !ctx.IsSet("gid-map") {
+			ctx.Set("gid-map", fmt.Sprintf("0:%d:1", os.Getegid()))
+		}
+	}
+	mapOptions.UIDMappings, err = parseIDMappings("uid-map", ctx.StringSlice("uid-map"))
+	if err != nil {
+		return nil, "", err
+	}
+	mapOptions.GIDMappings, err = parseIDMappings("gid-map", ctx.StringSlice("gid-map"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	reader, err := layer.GenerateInsertLayer(source, target, ctx.Bool("opaque"), &layer.RepackOptions{
+		MapOptions: mapOptions,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return reader, source, nil
+}
+
+func insert(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	target := ctx.App.Metadata["target"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	reader, source, err := insertLayer(ctx, target)
+	if err != nil {
+		return errors.Wrap(err, "generate insert layer")
+	}
+	defer reader.Close()
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	createdBy := fmt.Sprintf("umoci insert %s %s", source, target)
+	if ctx.Bool("opaque") {
+		createdBy = fmt.Sprintf("umoci insert --opaque %s %s", source, target)
+	}
+	history, err := historyEntry(ctx, ispec.History{
+		Author:     imageMeta.Author,
+		Created:    &created,
+		CreatedBy:  createdBy,
+		EmptyLayer: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("inserting %s at %s in %s", source, target, fromName)
+	if err := mutator.AddLayer(context.Background(), reader, history, &mutate.AddOptions{
+		Compressor: compressor,
+	}); err != nil {
+		return errors.Wrap(err, "add insert layer")
+	}
+
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
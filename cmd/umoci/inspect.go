@@ -0,0 +1,241 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var inspectCommand = uxPlatform(cli.Command{
+	Name:  "inspect",
+	Usage: "dumps the index entry, manifest and config of a tagged image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to inspect (if not specified, defaults to "latest").
+
+The entry for the tag in the top-level index, the image index it refers to (if
+any), and the manifest and config of the image (or artifact) are output as a
+single pretty-printed JSON object. If the tag refers to an image index,
+--platform selects which manifest to inspect (with --all-platforms, an array
+with an object for each manifest is output).
+
+With --type, only the given document (one of "descriptor", "index",
+"manifest" or "config") is output. With --raw, the document is output exactly
+as it is stored in the image rather than being pretty-printed, which is
+required for the config of artifacts whose config is not JSON.`,
+
+	// inspect reads a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "only output the given document (descriptor, index, manifest or config)",
+		},
+		cli.BoolFlag{
+			Name:  "raw",
+			Usage: "output the document as it is stored rather than pretty-printing it",
+		},
+	},
+
+	Action: inspect,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		switch ctx.String("type") {
+		case "", "descriptor", "index", "manifest", "config":
+		default:
+			return errors.Errorf("invalid --type: %s", ctx.String("type"))
+		}
+		if ctx.Bool("raw") {
+			switch ctx.String("type") {
+			case "index", "manifest", "config":
+			default:
+				return errors.Errorf("--raw requires --type to be index, manifest or config")
+			}
+			if ctx.Bool("all-platforms") {
+				return errors.Errorf("--raw cannot be used with --all-platforms")
+			}
+		}
+		return nil
+	},
+})
+
+// inspectInfo is the output of umoci-inspect(1) for a single manifest. The
+// documents are stored as they are in the image, so that fields unknown to
+// umoci are not lost.
+type inspectInfo struct {
+	// Descriptor is the entry in the top-level index for the tag.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// Index is the image index which references the manifest, if the manifest
+	// is not referenced directly by the top-level index.
+	Index json.RawMessage `json:"index,omitempty"`
+
+	// Manifest and Config are the manifest and its config.
+	Manifest json.RawMessage `json:"manifest"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// readRawBlob returns the contents of the blob referenced by the given
+// descriptor.
+func readRawBlob(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) ([]byte, error) {
+	blob, err := engineExt.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read blob %s", descriptor.Digest)
+	}
+	return data, nil
+}
+
+// inspectManifest collects the documents of the given descriptor path to a
+// manifest. If only is non-empty, only the named document is read.
+func inspectManifest(ctx context.Context, engineExt casext.Engine, descriptorPath casext.DescriptorPath, only string) (inspectInfo, error) {
+	info := inspectInfo{Descriptor: descriptorPath.Root()}
+
+	if only == "" || only == "index" {
+		if len(descriptorPath.Walk) > 1 {
+			data, err := readRawBlob(ctx, engineExt, descriptorPath.Walk[len(descriptorPath.Walk)-2])
+			if err != nil {
+				return info, errors.Wrap(err, "get index")
+			}
+			info.Index = data
+		} else if only == "index" {
+			return info, errors.Errorf("tag does not refer to an image index")
+		}
+	}
+	if only == "" || only == "manifest" {
+		data, err := readRawBlob(ctx, engineExt, descriptorPath.Descriptor())
+		if err != nil {
+			return info, errors.Wrap(err, "get manifest")
+		}
+		info.Manifest = data
+	}
+	if only == "" || only == "config" {
+		manifestBlob, err := engineExt.FromDescriptor(ctx, descriptorPath.Descriptor())
+		if err != nil {
+			return info, errors.Wrap(err, "get manifest")
+		}
+		manifestBlob.Close()
+		manifest, ok := manifestBlob.Data.(ispec.Manifest)
+		if !ok {
+			// Should _never_ be reached.
+			return info, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+		}
+		data, err := readRawBlob(ctx, engineExt, manifest.Config)
+		if err != nil {
+			return info, errors.Wrap(err, "get config")
+		}
+		info.Config = data
+	}
+	return info, nil
+}
+
+// validJSON makes sure that the documents can be pretty-printed. The
+// configuration of an artifact need not be JSON, in which case it can only be
+// output with --raw.
+func (info inspectInfo) validJSON() error {
+	for _, data := range []json.RawMessage{info.Index, info.Manifest} {
+		if data != nil && !json.Valid(data) {
+			return errors.Errorf("image contains a document which is not valid JSON")
+		}
+	}
+	if info.Config != nil && !json.Valid(info.Config) {
+		return errors.Errorf("config is not valid JSON (it can be output with --raw --type config)")
+	}
+	return nil
+}
+
+func inspect(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	only := ctx.String("type")
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	indices, err := selectManifests(ctx, tagName, descriptorPaths)
+	if err != nil {
+		return err
+	}
+
+	var infos []interface{}
+	for _, idx := range indices {
+		info, err := inspectManifest(context.Background(), engineExt, descriptorPaths[idx], only)
+		if err != nil {
+			return errors.Wrapf(err, "inspect %s", descriptorPaths[idx].Descriptor().Digest)
+		}
+
+		var output interface{} = info
+		switch only {
+		case "descriptor":
+			output = info.Descriptor
+		case "index":
+			output = info.Index
+		case "manifest":
+			output = info.Manifest
+		case "config":
+			output = info.Config
+		}
+		if ctx.Bool("raw") {
+			_, err := os.Stdout.Write(output.(json.RawMessage))
+			return errors.Wrap(err, "write document")
+		}
+		if err := info.validJSON(); err != nil {
+			return errors.Wrapf(err, "inspect %s", descriptorPaths[idx].Descriptor().Digest)
+		}
+		infos = append(infos, output)
+	}
+
+	var output interface{} = infos
+	if _, ok := ctx.App.Metadata["--all-platforms"]; !ok {
+		output = infos[0]
+	}
+	data, err := json.MarshalIndent(output, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode documents")
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return errors.Wrap(err, "write documents")
+}
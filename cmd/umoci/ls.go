@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var lsCommand = uxFormat(uxLayout(uxImage(cli.Command{
+	Name:  "ls",
+	Usage: "lists the files in an image without unpacking it",
+	ArgsUsage: `--image <image-path>[:<tag>] [<path>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to list (if not specified, defaults to "latest") and "<path>" is
+an optional path in the image to restrict the listing to (the path itself and
+everything underneath it).
+
+The layers of the image are read (without extracting them) and the whiteouts
+in each layer are applied, so the listing matches the root filesystem that
+umoci-unpack(1) would create. With --verbose, the mode, owner and size of
+each path is listed, along with the layer that it comes from. If --format is
+specified, each path is instead formatted using the given Go template (see
+text/template), with the same fields as --json (such as "{{.Path}} {{.Size}}").
+
+For compatibility, "umoci ls --layout <image-path>" lists the tags of an
+image (as with umoci-list(1)).
+
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it
+is easy for humans to read, and might change in future versions.`,
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "verbose, v",
+			Usage: "show the mode, owner, size and layer of each path",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the listing as a JSON encoded blob",
+		},
+	},
+
+	Action: ls,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("image") && ctx.IsSet("layout") {
+			return errors.Errorf("--image and --layout are mutually exclusive")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --image")
+		}
+		if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
+			// Listing tags.
+			if ctx.NArg() != 0 {
+				return errors.Errorf("invalid number of positional arguments: expected none with --layout")
+			}
+			return nil
+		}
+		switch ctx.NArg() {
+		case 0:
+			ctx.App.Metadata["path"] = "."
+		case 1:
+			if ctx.Args().First() == "" {
+				return errors.Errorf("path cannot be empty")
+			}
+			ctx.App.Metadata["path"] = layer.CleanPath(strings.TrimLeft(ctx.Args().First(), "/"))
+		default:
+			return errors.Errorf("invalid number of positional arguments: expected [<path>]")
+		}
+		return nil
+	},
+})))
+
+func ls(ctx *cli.Context) error {
+	if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
+		return tagList(ctx)
+	}
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	path := ctx.App.Metadata["path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptor, manifest, err := tagManifest(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("listing image: %s", descriptor.Digest)
+	entries, err := layer.ListManifest(context.Background(), engineExt, manifest, nil)
+	if err != nil {
+		return errors.Wrap(err, "list image")
+	}
+
+	// Restrict the listing to the requested path.
+	if path != "." {
+		var matched []layer.ListEntry
+		for _, entry := range entries {
+			if entry.Path == path || strings.HasPrefix(entry.Path, path+"/") {
+				matched = append(matched, entry)
+			}
+		}
+		if matched == nil {
+			return &os.PathError{Op: "ls", Path: "/" + path, Err: os.ErrNotExist}
+		}
+		entries = matched
+	}
+
+	if tmpl, ok := ctx.App.Metadata["--format"].(*template.Template); ok {
+		for _, entry := range entries {
+			if err := executeTemplate(os.Stdout, tmpl, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if jsonOutput(ctx) {
+		// Always output a list, even if the image is empty.
+		if entries == nil {
+			entries = []layer.ListEntry{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(entries); err != nil {
+			return errors.Wrap(err, "encoding listing")
+		}
+		return nil
+	}
+	if err := formatListing(os.Stdout, entries, ctx.Bool("verbose")); err != nil {
+		return errors.Wrap(err, "format listing")
+	}
+	return nil
+}
+
+// listMode returns the os.FileMode of the given path, for display purposes.
+func listMode(info layer.FileInfo) os.FileMode {
+	mode := os.FileMode(info.Mode & 0777)
+	if info.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if info.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if info.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	switch info.Type {
+	case "dir":
+		mode |= os.ModeDir
+	case "symlink":
+		mode |= os.ModeSymlink
+	case "char":
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case "block":
+		mode |= os.ModeDevice
+	case "fifo":
+		mode |= os.ModeNamedPipe
+	}
+	return mode
+}
+
+// formatListing writes a human-readable listing of the given entries to w.
+func formatListing(w io.Writer, entries []layer.ListEntry, verbose bool) error {
+	if !verbose {
+		for _, entry := range entries {
+			fmt.Fprintf(w, "/%s\n", entry.Path)
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	for _, entry := range entries {
+		var size string
+		switch entry.Type {
+		case "file", "hardlink":
+			size = units.HumanSize(float64(entry.Size))
+		case "char", "block":
+			size = fmt.Sprintf("%d,%d", entry.Devmajor, entry.Devminor)
+		}
+		name := "/" + entry.Path
+		switch entry.Type {
+		case "symlink":
+			name += " -> " + entry.Linkname
+		case "hardlink":
+			name += " => /" + entry.Linkname
+		}
+		layerID := entry.LayerDigest.String()
+		if encoded := entry.LayerDigest.Encoded(); len(encoded) > 12 {
+			layerID = fmt.Sprintf("%s:%s", entry.LayerDigest.Algorithm(), encoded[:12])
+		}
+		fmt.Fprintf(tw, "%s\t%d:%d\t%s\t%s\t%d\t%s\n", listMode(entry.FileInfo), entry.UID, entry.GID, size, name, entry.Layer, layerID)
+	}
+	return tw.Flush()
+}
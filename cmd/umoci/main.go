@@ -23,6 +23,7 @@ import (
 
 	"github.com/apex/log"
 	logcli "github.com/apex/log/handlers/cli"
+	"github.com/openSUSE/umoci/pkg/parallel"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -74,6 +75,15 @@ func main() {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the results of commands as JSON",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Usage: "maximum number of concurrent operations (layers, blobs) in each command (unpack and mount default to 1 unless this is set)",
+			Value: parallel.DefaultWorkers(),
+		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
@@ -93,6 +103,10 @@ func main() {
 
 		log.SetLevel(level)
 
+		if ctx.GlobalInt("workers") < 1 {
+			return errors.New("--workers must be at least 1")
+		}
+
 		if level == log.DebugLevel {
 			errors.Debug(true)
 		}
@@ -104,12 +118,52 @@ func main() {
 		unpackCommand,
 		repackCommand,
 		gcCommand,
+		pruneCommand,
+		verifyCommand,
+		validateCommand,
+		signCommand,
+		verifySignatureCommand,
+		attachCommand,
+		referrersCommand,
+		dedupeCommand,
 		initCommand,
 		newCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
+		tagRenameCommand,
+		lsCommand,
+		catCommand,
+		extractCommand,
+		rollbackCommand,
 		statCommand,
+		historyCommand,
+		inspectCommand,
+		watchCommand,
+		squashCommand,
+		removeLayerCommand,
+		replaceLayerCommand,
+		insertCommand,
+		reorderLayersCommand,
+		editHistoryCommand,
+		recompressCommand,
+		normalizeCommand,
+		convertCommand,
+		pullCommand,
+		pushCommand,
+		serveCommand,
+		diffCommand,
+		compareConfigCommand,
+		exportCommand,
+		importCommand,
+		mountCommand,
+		unmountCommand,
+		runCommand,
+		shellCommand,
+		buildCommand,
+		completionCommand,
+		completeCommand,
+		indexSubcommand,
 		rawSubcommand,
 	}
 
@@ -156,7 +210,7 @@ func main() {
 		// that --rootless might help. We probably should only be doing this if
 		// we're an unprivileged user.
 		if os.IsPermission(errors.Cause(err)) {
-			log.Info("umoci encountered a permission error: maybe --rootless will help?")
+			log.Info("umoci encountered a permission error: maybe --rootless (or --rootless=auto) will help?")
 		}
 		log.Fatalf("%v", err)
 	}
@@ -0,0 +1,242 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var mountCommand = uxSignature(uxPlatform(cli.Command{
+	Name:  "mount",
+	Usage: "mounts a read-only view of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] <mountpoint>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to mount (if not specified, defaults to "latest").
+"<mountpoint>" is the directory the image is mounted on (it is created if it
+does not exist).
+
+Each layer of the image is extracted into its own directory inside a layer
+store (unless it was already extracted by a previous mount or by
+"umoci unpack --overlay-store"), and the layers are mounted as a read-only
+overlayfs. In rootless mode, fuse-overlayfs is used. The mount must be removed
+with umoci-unmount(1).
+
+Layers are extracted one at a time unless --workers (or the global --workers)
+is set, in which case up to that many layers are extracted in parallel.`,
+
+	// mount reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to use when extracting layers (container:host:size)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to use when extracting layers (container:host:size)",
+		},
+		rootlessFlag("enable rootless mounting support (using fuse-overlayfs)"),
+		cli.StringFlag{
+			Name:  "overlay-store",
+			Usage: "extract layers into (and re-use layers from) the given directory",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of layers to extract in parallel (defaults to 1, or the global --workers if it is set)",
+			Value: 1,
+		},
+	},
+
+	Action: mount,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <mountpoint>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("mountpoint cannot be empty")
+		}
+		ctx.App.Metadata["mountpoint"] = ctx.Args().First()
+		return nil
+	},
+}))
+
+// defaultLayerStore returns the layer store used by umoci-mount(1) if
+// --overlay-store is not given. Layers extracted with different mappings
+// cannot be shared, so each set of mappings has its own store inside the
+// user's cache directory.
+func defaultLayerStore(mapOptions layer.MapOptions) (string, error) {
+	cacheDir, err := userCacheDir("layers")
+	if err != nil {
+		return "", err
+	}
+	mapData, err := json.Marshal(mapOptions)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal mappings")
+	}
+	name := digest.SHA256.FromBytes(mapData).Hex()[:16]
+	return filepath.Join(cacheDir, name), nil
+}
+
+func mount(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	mountpoint := ctx.App.Metadata["mountpoint"].(string)
+
+	var mapOptions layer.MapOptions
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	mapOptions.Rootless = rootless
+	if mapOptions.Rootless {
+		if !ctx.IsSet("uid-map") {
+			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
+		}
+		if !ctx.IsSet("gid-map") {
+			ctx.Set("gid-map", fmt.Sprintf("0:%d:1", os.Getegid()))
+		}
+	}
+	mapOptions.UIDMappings, err = parseIDMappings("uid-map", ctx.StringSlice("uid-map"))
+	if err != nil {
+		return err
+	}
+	mapOptions.GIDMappings, err = parseIDMappings("gid-map", ctx.StringSlice("gid-map"))
+	if err != nil {
+		return err
+	}
+
+	workers, err := numWorkers(ctx)
+	if err != nil {
+		return err
+	}
+
+	layerStore := ctx.String("overlay-store")
+	if layerStore == "" {
+		layerStore, err = defaultLayerStore(mapOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	indices, err := selectManifests(ctx, fromName, fromDescriptorPaths)
+	if err != nil {
+		return err
+	}
+	if len(indices) != 1 {
+		return errors.Errorf("only a single manifest can be mounted, use --platform")
+	}
+	fromDescriptorPath := fromDescriptorPaths[indices[0]]
+
+	// Refuse to mount an image without a trusted signature.
+	if err := verifyImageSignature(ctx, engine, fromDescriptorPath.Root()); err != nil {
+		return err
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptorPath.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok || manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType)
+	}
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return errors.Wrap(err, "create mountpoint")
+	}
+
+	log.WithFields(log.Fields{
+		"image":       imagePath,
+		"ref":         fromName,
+		"mountpoint":  mountpoint,
+		"layer-store": layerStore,
+	}).Debugf("umoci: mounting OCI image")
+
+	if err := layer.MountManifest(context.Background(), engine, mountpoint, manifest, &layer.UnpackOptions{
+		MapOptions: mapOptions,
+		LayerStore: layerStore,
+		Workers:    workers,
+	}); err != nil {
+		return errors.Wrap(err, "mount image")
+	}
+
+	log.Infof("mounted %s at %s", fromName, mountpoint)
+	return nil
+}
+
+var unmountCommand = cli.Command{
+	Name:  "unmount",
+	Usage: "unmounts an image mounted with umoci-mount(1)",
+	ArgsUsage: `<mountpoint>
+
+Where "<mountpoint>" is the directory an image was mounted on with
+umoci-mount(1). The extracted layers are kept in the layer store, so that
+they can be re-used by later mounts.`,
+
+	Action: unmount,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <mountpoint>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("mountpoint cannot be empty")
+		}
+		ctx.App.Metadata["mountpoint"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func unmount(ctx *cli.Context) error {
+	mountpoint := ctx.App.Metadata["mountpoint"].(string)
+
+	if err := layer.Unmount(mountpoint); err != nil {
+		return errors.Wrapf(err, "unmount %s", mountpoint)
+	}
+	log.Infof("unmounted %s", mountpoint)
+	return nil
+}
@@ -18,10 +18,14 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
@@ -43,12 +47,139 @@ of the tag for the empty manifest.
 Once you create a new image with umoci-new(1) you can directly use the image
 with umoci-unpack(1), umoci-repack(1), and umoci-config(1) to modify the new
 manifest as you see fit. This allows you to create entirely new images without
-needing a base image to start from.`,
+needing a base image to start from.
+
+The creation time of the image is the current time, unless --created is
+specified or the SOURCE_DATE_EPOCH environment variable is set.
+
+If --artifact-type or --config-media-type is specified, an artifact manifest
+(such as a Helm chart or a WASM module) is created rather than an image. The
+configuration of the artifact is the empty JSON object, unless --config-file
+is specified (in which case --config-media-type must be specified), and each
+--blob of the form "<path>[:<media-type>]" is added to the artifact (with the
+"application/octet-stream" media type if none is given, and the name of the
+file as its title). The creation time is stored as an annotation.`,
 
 	// new modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "creation time of the image (ISO8601 date)",
+		},
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "create an artifact of the given type rather than an image",
+		},
+		cli.StringFlag{
+			Name:  "config-media-type",
+			Usage: "media type of the configuration of the artifact",
+		},
+		cli.StringFlag{
+			Name:  "config-file",
+			Usage: "file containing the configuration of the artifact (requires --config-media-type)",
+		},
+		cli.StringSliceFlag{
+			Name:  "blob",
+			Usage: "add a file to the artifact, of the form '<path>[:<media-type>]'",
+		},
+	},
+
 	Action: newImage,
+
+	Before: func(ctx *cli.Context) error {
+		artifact := ctx.IsSet("artifact-type") || ctx.IsSet("config-media-type")
+		if !artifact {
+			for _, flag := range []string{"config-file", "blob"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--%s can only be used with --artifact-type or --config-media-type", flag)
+				}
+			}
+			return nil
+		}
+		if ctx.IsSet("artifact-type") && ctx.String("artifact-type") == "" {
+			return errors.Errorf("--artifact-type cannot be empty")
+		}
+		if ctx.IsSet("config-media-type") {
+			mediaType := ctx.String("config-media-type")
+			if mediaType == "" {
+				return errors.Errorf("--config-media-type cannot be empty")
+			}
+			if casext.IsImageConfig(mediaType) {
+				return errors.Errorf("--config-media-type cannot be an image configuration: %s", mediaType)
+			}
+		}
+		if ctx.IsSet("config-file") && !ctx.IsSet("config-media-type") {
+			return errors.Errorf("--config-file requires --config-media-type")
+		}
+		if !ctx.IsSet("artifact-type") && !ctx.IsSet("config-file") {
+			return errors.Errorf("--config-media-type requires --config-file (or --artifact-type)")
+		}
+		for _, blob := range ctx.StringSlice("blob") {
+			if path, _ := parseArtifactBlob(blob, defaultBlobMediaType); path == "" {
+				return errors.Errorf("invalid --blob: path cannot be empty: %q", blob)
+			}
+		}
+		return nil
+	},
+}
+
+// defaultBlobMediaType is the media type of artifact blobs without an
+// explicit media type.
+const defaultBlobMediaType = "application/octet-stream"
+
+// parseArtifactBlob parses a blob argument of the form <path>[:<media-type>],
+// using defaultMediaType if no media type is given. Since media types always
+// contain a "/", a suffix is only treated as the media type if it contains one
+// (so paths can contain ":").
+func parseArtifactBlob(value, defaultMediaType string) (string, string) {
+	if sep := strings.LastIndex(value, ":"); sep != -1 && strings.Contains(value[sep+1:], "/") {
+		return value[:sep], value[sep+1:]
+	}
+	return value, defaultMediaType
+}
+
+// putFileBlob adds the contents of the file to the image as a blob with the
+// given media type.
+func putFileBlob(ctx context.Context, engine casext.Engine, path, mediaType string) (ispec.Descriptor, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "open blob")
+	}
+	defer fh.Close()
+	return mutate.PutBlob(ctx, engine, mediaType, fh)
+}
+
+// newArtifact creates the artifact manifest described by the --artifact-type,
+// --config-media-type, --config-file and --blob flags, returning its
+// descriptor.
+func newArtifact(ctx *cli.Context, engineExt casext.Engine, createTime time.Time) (ispec.Descriptor, error) {
+	artifact := mutate.Artifact{
+		ArtifactType: ctx.String("artifact-type"),
+		Annotations: map[string]string{
+			ispec.AnnotationCreated: createTime.Format(igen.ISO8601),
+		},
+	}
+	if ctx.IsSet("config-file") {
+		config, err := putFileBlob(context.Background(), engineExt, ctx.String("config-file"), ctx.String("config-media-type"))
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "add --config-file")
+		}
+		artifact.Config = &config
+	}
+	for _, value := range ctx.StringSlice("blob") {
+		path, mediaType := parseArtifactBlob(value, defaultBlobMediaType)
+		blob, err := putFileBlob(context.Background(), engineExt, path, mediaType)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "add --blob %s", path)
+		}
+		blob.Annotations = map[string]string{
+			ispec.AnnotationTitle: filepath.Base(path),
+		}
+		artifact.Blobs = append(artifact.Blobs, blob)
+	}
+	return mutate.NewArtifact(context.Background(), engineExt, artifact)
 }
 
 func newImage(ctx *cli.Context) error {
@@ -70,7 +201,29 @@ func newImage(ctx *cli.Context) error {
 
 	// Create a new image config.
 	g := igen.New()
-	createTime := time.Now()
+	createTime, err := creationTime()
+	if err != nil {
+		return err
+	}
+	if ctx.IsSet("created") {
+		createTime, err = time.Parse(igen.ISO8601, ctx.String("created"))
+		if err != nil {
+			return errors.Wrap(err, "parse --created")
+		}
+	}
+
+	if ctx.IsSet("artifact-type") || ctx.IsSet("config-media-type") {
+		descriptor, err := newArtifact(ctx, engineExt, createTime)
+		if err != nil {
+			return errors.Wrap(err, "create artifact")
+		}
+		log.Infof("new artifact manifest created: %s", descriptor.Digest)
+		if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+			return errors.Wrap(err, "add new tag")
+		}
+		log.Infof("created new tag for artifact manifest: %s", tagName)
+		return outputTagResult(ctx, engineExt, tagName)
+	}
 
 	// Set all of the defaults we need.
 	g.SetCreated(createTime)
@@ -135,6 +288,5 @@ func newImage(ctx *cli.Context) error {
 	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
-
-	return nil
+	return outputTagResult(ctx, engineExt, tagName)
 }
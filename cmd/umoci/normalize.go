@@ -0,0 +1,184 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var normalizeCommand = uxTag(cli.Command{
+	Name:  "normalize",
+	Usage: "makes an existing image reproducible",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image.
+
+Every layer is recompressed using --layer-format, and every creation time in
+the image configuration and history later than --clamp-time is clamped. If
+--rewrite-layers is specified, the tar archives of the layers are also
+rewritten to remove modification times later than --clamp-time, access and
+change times, and user and group names (which changes their diff_ids). No
+history entry is added. The digests of the manifest, configuration and layers
+before and after normalization are printed.`,
+
+	// normalize modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "clamp-time",
+			Usage: "latest timestamp permitted in the image (ISO8601 format, defaults to SOURCE_DATE_EPOCH or the Unix epoch)",
+		},
+		cli.BoolFlag{
+			Name:  "rewrite-layers",
+			Usage: "also remove timestamps and user and group names from the tar archives of the layers",
+		},
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the recompressed layers (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+	},
+
+	Action: normalize,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+})
+
+func normalize(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	clampTime := time.Unix(0, 0).UTC()
+	if ctx.IsSet("clamp-time") {
+		value, err := time.Parse(igen.ISO8601, ctx.String("clamp-time"))
+		if err != nil {
+			return errors.Wrap(err, "parse --clamp-time")
+		}
+		clampTime = value
+	} else {
+		epoch, err := sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		if epoch != nil {
+			clampTime = *epoch
+		}
+	}
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	log.Infof("normalizing %s", fromName)
+	if err := mutator.Normalize(context.Background(), mutate.NormalizeOptions{
+		ClampTime:     clampTime,
+		RewriteLayers: ctx.Bool("rewrite-layers"),
+		Compressor:    compressor,
+		Workers:       ctx.GlobalInt("workers"),
+	}); err != nil {
+		return errors.Wrap(err, "normalize image")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+	newManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	if ctx.GlobalBool("json") {
+		return outputTagResult(ctx, engineExt, tagName)
+	}
+	return printNormalized(fromDescriptorPaths[0].Descriptor(), newDescriptorPath.Descriptor(), oldManifest, newManifest)
+}
+
+// printNormalized prints the digests of the manifest, configuration and
+// layers before and after normalization.
+func printNormalized(oldDescriptor, newDescriptor ispec.Descriptor, oldManifest, newManifest ispec.Manifest) error {
+	tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "BLOB\tOLD\tNEW\n")
+	fmt.Fprintf(tw, "manifest\t%s\t%s\n", oldDescriptor.Digest, newDescriptor.Digest)
+	fmt.Fprintf(tw, "config\t%s\t%s\n", oldManifest.Config.Digest, newManifest.Config.Digest)
+	for idx := range newManifest.Layers {
+		fmt.Fprintf(tw, "layer %d\t%s\t%s\n", idx, oldManifest.Layers[idx].Digest, newManifest.Layers[idx].Digest)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,299 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "removes stale tags from an OCI image",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+This command removes every tag in the provided OCI image which matches one of
+the --match patterns (shell globs, such as "ci-*") and which is older than the
+--older-than duration (such as "168h"). At least one of the two must be given,
+and a tag only has to satisfy the ones which were given. The age of a tag is
+taken from the "org.opencontainers.image.created" annotation of its entry or
+manifests if present, and otherwise from the creation time in its image
+configurations. Tags with no known creation time are never considered to be
+older than --older-than.
+
+With --rollback-only, the tags are kept but the images they previously
+referred to (as restored by umoci-rollback(1)) are forgotten instead, and all
+tags are considered if neither --match nor --older-than is given. With --gc,
+the image is garbage collected afterwards (see umoci-gc(1)). With --dry-run,
+the tags which would be pruned are printed and the image is not modified.`,
+
+	// prune modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "match",
+			Usage: "only prune tags whose names match this pattern (can be specified multiple times)",
+		},
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "only prune tags created more than this duration ago",
+		},
+		cli.BoolFlag{
+			Name:  "rollback-only",
+			Usage: "forget the previous images of the tags rather than removing them",
+		},
+		cli.BoolFlag{
+			Name:  "gc",
+			Usage: "garbage collect the image after pruning",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the tags which would be pruned without modifying the image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, pattern := range ctx.StringSlice("match") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "invalid --match pattern %q", pattern)
+			}
+		}
+		if ctx.Duration("older-than") < 0 {
+			return errors.Errorf("--older-than must not be negative")
+		}
+		if !ctx.Bool("rollback-only") && !ctx.IsSet("match") && !ctx.IsSet("older-than") {
+			return errors.Errorf("at least one of --match or --older-than must be specified")
+		}
+		if ctx.Bool("gc") && ctx.Bool("dry-run") {
+			return errors.Errorf("--gc cannot be used with --dry-run")
+		}
+		return nil
+	},
+
+	Action: prune,
+}
+
+// pruneResult is the result of umoci-prune(1), which is output if the global
+// --json flag is set.
+type pruneResult struct {
+	// Pruned are the names of the tags which were removed (or whose previous
+	// images were forgotten with --rollback-only).
+	Pruned []string `json:"pruned"`
+
+	// Removed are the digests of the blobs which were removed by --gc.
+	Removed []digest.Digest `json:"removed,omitempty"`
+
+	// DryRun is whether --dry-run was set, in which case the image was not
+	// modified.
+	DryRun bool `json:"dry_run"`
+}
+
+// referenceCreated returns the latest creation time of the image referred to
+// by the given top-level index entry. The "org.opencontainers.image.created"
+// annotation is preferred, falling back to the creation time in the image
+// configurations. nil is returned if no creation time is known.
+func referenceCreated(ctx context.Context, engineExt casext.Engine, root ispec.Descriptor) (*time.Time, error) {
+	var created *time.Time
+	update := func(t time.Time) {
+		if created == nil || t.After(*created) {
+			created = &t
+		}
+	}
+	parseAnnotation := func(annotations map[string]string) (bool, error) {
+		value, ok := annotations[ispec.AnnotationCreated]
+		if !ok {
+			return false, nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false, errors.Wrapf(err, "parse %s annotation", ispec.AnnotationCreated)
+		}
+		update(t)
+		return true, nil
+	}
+
+	if ok, err := parseAnnotation(root.Annotations); err != nil || ok {
+		return created, err
+	}
+
+	descriptorPaths, err := engineExt.ResolveDescriptor(ctx, root)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve descriptor")
+	}
+	for _, descriptorPath := range descriptorPaths {
+		descriptor := descriptorPath.Descriptor()
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+		manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrap(err, "get manifest")
+		}
+		manifestBlob.Close()
+		manifest := manifestBlob.Data.(ispec.Manifest)
+		if ok, err := parseAnnotation(manifest.Annotations); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "get config")
+		}
+		configBlob.Close()
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok || config.Created == nil {
+			continue
+		}
+		update(*config.Created)
+	}
+	return created, nil
+}
+
+// matchesAny returns whether name matches any of the given patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// The patterns were validated in Before.
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func prune(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	patterns := ctx.StringSlice("match")
+	rollbackOnly := ctx.Bool("rollback-only")
+	dryRun := ctx.Bool("dry-run")
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	var cutoff time.Time
+	if ctx.IsSet("older-than") {
+		cutoff = time.Now().Add(-ctx.Duration("older-than"))
+	}
+
+	pruned := []string{}
+	var newManifests []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		name, ok := descriptor.Annotations[ispec.AnnotationRefName]
+		stale := ok
+		if stale && len(patterns) > 0 {
+			stale = matchesAny(patterns, name)
+		}
+		if stale && !cutoff.IsZero() {
+			created, err := referenceCreated(context.Background(), engineExt, descriptor)
+			if err != nil {
+				return errors.Wrapf(err, "get creation time of tag %s", name)
+			}
+			if created == nil {
+				log.Warnf("tag %s has no creation time -- not pruning it", name)
+			}
+			stale = created != nil && created.Before(cutoff)
+		}
+		if stale && rollbackOnly {
+			_, stale = descriptor.Annotations[casext.AnnotationPreviousReference]
+		}
+		if !stale {
+			newManifests = append(newManifests, descriptor)
+			continue
+		}
+
+		pruned = append(pruned, name)
+		if rollbackOnly {
+			annotations := map[string]string{}
+			for key, value := range descriptor.Annotations {
+				annotations[key] = value
+			}
+			delete(annotations, casext.AnnotationPreviousReference)
+			descriptor.Annotations = annotations
+			newManifests = append(newManifests, descriptor)
+		}
+	}
+
+	if !dryRun && len(pruned) > 0 {
+		index.Manifests = newManifests
+		if err := engineExt.PutIndex(context.Background(), index); err != nil {
+			return errors.Wrap(err, "replace index")
+		}
+	}
+	if rollbackOnly {
+		log.Infof("forgot the previous images of %d tags", len(pruned))
+	} else {
+		log.Infof("pruned %d tags", len(pruned))
+	}
+
+	var removed []digest.Digest
+	if ctx.Bool("gc") {
+		removed, err = engineExt.GCWithOptions(context.Background(), &casext.GCOptions{
+			Workers: ctx.GlobalInt("workers"),
+		})
+		if err != nil {
+			return errors.Wrap(err, "gc")
+		}
+	}
+
+	if ctx.GlobalBool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(pruneResult{
+			Pruned:  pruned,
+			Removed: removed,
+			DryRun:  dryRun,
+		}); err != nil {
+			return errors.Wrap(err, "encoding result")
+		}
+	} else if dryRun {
+		for _, name := range pruned {
+			fmt.Println(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pullCommand = uxRemote(cli.Command{
+	Name:  "pull",
+	Usage: "fetches an image from a registry",
+	ArgsUsage: `--image <image-path>[:<tag>] <source>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tag that the pulled image will be saved as (if not specified, defaults to
+"latest"). If the OCI image does not exist, it is created.
+
+"<source>" is the image in the registry, of the form
+docker://[<registry>/]<repository>[:<tag>|@<digest>]. If no registry is given,
+docker.io is used.
+
+Every blob of the image (including every manifest of a multi-platform image)
+is downloaded into the OCI image, except for blobs which are already in it.
+If --platform is given and "<source>" is a multi-platform image (an image
+index or a Docker manifest list), only the manifest for that platform is
+downloaded and tagged. If --format is given, the pulled image is converted to
+that format as with umoci-convert(1) (for instance, Docker manifest lists are
+stored as image indexes with "--format oci"). Credentials are read from the
+docker client configuration unless --creds or --authfile are given.`,
+
+	// pull modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "only pull the manifest for the given platform (os/architecture[/variant]) of a multi-platform image",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format to convert the pulled image to (oci or docker)",
+		},
+	},
+
+	Action: pull,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <source>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("source cannot be empty")
+		}
+		ref, err := remote.ParseReference(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <source>")
+		}
+		ctx.App.Metadata["source"] = ref
+		if ctx.IsSet("platform") {
+			platform, err := parsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = platform
+		}
+		if ctx.IsSet("format") {
+			format, err := mutate.ParseFormat(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "parse --format")
+			}
+			ctx.App.Metadata["--format"] = format
+		}
+		return nil
+	},
+})
+
+func pull(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	ref := ctx.App.Metadata["source"].(remote.Reference)
+	options := ctx.App.Metadata["--remote-options"].(remote.Options)
+
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		if err := dir.Create(imagePath); err != nil {
+			return errors.Wrap(err, "image layout creation")
+		}
+		log.Infof("created new OCI image: %s", imagePath)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	log.Infof("pulling %s", ref)
+	client := remote.NewClient(options)
+	opt := remote.PullOptions{
+		Workers: ctx.GlobalInt("workers"),
+	}
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform := val.(ispec.Platform)
+		opt.Platform = &platform
+	}
+	descriptor, err := client.Pull(context.Background(), ref, engine, opt)
+	if err != nil {
+		return errors.Wrapf(err, "pull %s", ref)
+	}
+
+	if val, ok := ctx.App.Metadata["--format"]; ok {
+		format := val.(mutate.Format)
+		log.Infof("converting %s to the %s format", ref, format)
+		descriptor, err = mutate.Convert(context.Background(), engine, descriptor, format)
+		if err != nil {
+			return errors.Wrap(err, "convert image")
+		}
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("pulled %s as %s: %s", ref, tagName, descriptor.Digest)
+	return outputTagResult(ctx, engineExt, tagName)
+}
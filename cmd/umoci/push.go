@@ -0,0 +1,227 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var pushCommand = uxRemote(cli.Command{
+	Name:  "push",
+	Usage: "uploads an image to a registry",
+	ArgsUsage: `--image <image-path>[:<tag>] <destination>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to upload (if not specified, defaults to "latest").
+
+"<destination>" is the image in the registry, of the form
+docker://[<registry>/]<repository>[:<tag>|@<digest>]. If no registry is given,
+docker.io is used.
+
+Every blob of the image (including every manifest of a multi-platform image)
+is uploaded, except for blobs which are already in the repository. Blobs which
+are in one of the --mount-from repositories are mounted rather than uploaded,
+if the registry allows it. The status of each blob is printed as it is
+uploaded.
+
+If --chunk-size is given, large blobs are uploaded in chunks and failed chunks
+are retried (up to --retries times) from the data the registry has received.
+If --resume-file is given, the upload sessions of chunked uploads are stored in
+that file, so that running the same push again after it was interrupted resumes
+the uploads rather than starting them again.
+
+If --format is given, the image is converted to that format (as with
+umoci-convert(1)) before it is uploaded, without modifying the OCI image. For
+instance, "--format docker" uploads image indexes as Docker manifest lists,
+for registries which do not support image indexes.`,
+
+	// push reads a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "mount-from",
+			Usage: "repository of the same registry to mount existing blobs from (can be specified multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format to convert the image to before uploading it (oci or docker)",
+		},
+		cli.StringFlag{
+			Name:  "chunk-size",
+			Usage: "upload blobs larger than the given size (such as 64MB) in chunks of that size",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "number of times a failed chunk is retried (with --chunk-size)",
+			Value: 3,
+		},
+		cli.StringFlag{
+			Name:  "resume-file",
+			Usage: "file storing the upload sessions of chunked uploads, so that interrupted pushes can be resumed (with --chunk-size)",
+		},
+	},
+
+	Action: push,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <destination>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("destination cannot be empty")
+		}
+		ref, err := remote.ParseReference(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <destination>")
+		}
+		ctx.App.Metadata["destination"] = ref
+		if ctx.IsSet("format") {
+			format, err := mutate.ParseFormat(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "parse --format")
+			}
+			ctx.App.Metadata["--format"] = format
+		}
+		return nil
+	},
+})
+
+func push(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	ref := ctx.App.Metadata["destination"].(remote.Reference)
+	options := ctx.App.Metadata["--remote-options"].(remote.Options)
+
+	var chunkSize int64
+	if ctx.IsSet("chunk-size") {
+		var err error
+		chunkSize, err = units.RAMInBytes(ctx.String("chunk-size"))
+		if err != nil {
+			return errors.Wrap(err, "parse --chunk-size")
+		}
+		if chunkSize <= 0 {
+			return errors.Errorf("--chunk-size must be positive")
+		}
+	}
+	if ctx.Int("retries") < 0 {
+		return errors.Errorf("--retries must not be negative")
+	}
+	var sessions remote.UploadSessions
+	if ctx.IsSet("resume-file") {
+		if chunkSize == 0 {
+			return errors.Errorf("--resume-file can only be used with --chunk-size")
+		}
+		if ctx.String("resume-file") == "" {
+			return errors.Errorf("--resume-file cannot be empty")
+		}
+		sessions = remote.NewUploadSessionFile(ctx.String("resume-file"))
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	// The whole image (including every platform of an index) is pushed, so
+	// every path must come from the same entry of the top-level index.
+	descriptor := fromDescriptorPaths[0].Root()
+	for _, descriptorPath := range fromDescriptorPaths {
+		if descriptorPath.Root().Digest != descriptor.Digest {
+			// TODO: Handle this more nicely.
+			return errors.Errorf("tag is ambiguous: %s", fromName)
+		}
+	}
+
+	// The converted image is only staged, so that the OCI image is left
+	// unmodified.
+	pushEngine := engine
+	if val, ok := ctx.App.Metadata["--format"]; ok {
+		format := val.(mutate.Format)
+		batch, err := mutate.NewBatch(context.Background(), engine)
+		if err != nil {
+			return errors.Wrap(err, "stage converted image")
+		}
+		defer batch.Close()
+		pushEngine = batch.Engine()
+
+		log.Infof("converting %s to the %s format", fromName, format)
+		descriptor, err = mutate.Convert(context.Background(), pushEngine, descriptor, format)
+		if err != nil {
+			return errors.Wrap(err, "convert image")
+		}
+	}
+
+	log.Infof("pushing %s to %s", fromName, ref)
+	client := remote.NewClient(options)
+	if err := client.Push(context.Background(), pushEngine, descriptor, ref, remote.PushOptions{
+		ChunkSize: chunkSize,
+		Sessions:  sessions,
+		Retries:   ctx.Int("retries"),
+		MountFrom: ctx.StringSlice("mount-from"),
+		Progress:  printPushProgress(),
+		Workers:   ctx.GlobalInt("workers"),
+	}); err != nil {
+		return errors.Wrapf(err, "push %s", ref)
+	}
+
+	log.Infof("pushed %s as %s: %s", fromName, ref, descriptor.Digest)
+	return nil
+}
+
+// printPushProgress returns a remote.PushOptions.Progress callback which
+// prints the status of each blob to stderr.
+func printPushProgress() func(ispec.Descriptor, remote.BlobStatus, int64) {
+	var lock sync.Mutex
+	return func(descriptor ispec.Descriptor, status remote.BlobStatus, uploaded int64) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch status {
+		case remote.BlobUploading:
+			fmt.Fprintf(os.Stderr, "blob %s: %s / %s\n", descriptor.Digest, units.HumanSize(float64(uploaded)), units.HumanSize(float64(descriptor.Size)))
+		case remote.BlobExists:
+			fmt.Fprintf(os.Stderr, "blob %s: already exists\n", descriptor.Digest)
+		default:
+			fmt.Fprintf(os.Stderr, "blob %s: %s (%s)\n", descriptor.Digest, status, units.HumanSize(float64(descriptor.Size)))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawAddBlobCommand = cli.Command{
+	Name:  "add-blob",
+	Usage: "adds the contents of a file to an image's blobs",
+	ArgsUsage: `--layout <image-path> <input>
+
+Where "<image-path>" is the path to the OCI image, and "<input>" is the file
+to add as a blob. If "<input>" is "-", the blob is read from stdin.
+
+The digest of the blob is printed to stdout. The blob is not referenced by any
+image, and so will be removed by umoci-gc(1) unless it is referenced by an
+image before then.`,
+
+	// add-blob modifies an image layout.
+	Category: "layout",
+
+	Action: rawAddBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <input>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("input path cannot be empty")
+		}
+		ctx.App.Metadata["input"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawAddBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	inputPath := ctx.App.Metadata["input"].(string)
+
+	var input io.Reader = os.Stdin
+	if inputPath != "-" {
+		inputFile, err := os.Open(inputPath)
+		if err != nil {
+			return errors.Wrap(err, "open input")
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	blobDigest, size, err := engine.PutBlob(context.Background(), input)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+
+	log.WithFields(log.Fields{
+		"size": size,
+	}).Infof("added blob: %s", blobDigest)
+	fmt.Println(blobDigest)
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawCatBlobCommand = cli.Command{
+	Name:  "cat-blob",
+	Usage: "writes the contents of a blob to stdout",
+	ArgsUsage: `--layout <image-path> <digest>
+
+Where "<image-path>" is the path to the OCI image, and "<digest>" is the
+digest of the blob to output.
+
+The blob is output exactly as it is stored (compressed layers are not
+decompressed, see umoci-raw-dump-layer(1)). If the contents of the blob do not
+match its digest, an error is returned once the whole blob has been output.`,
+
+	// cat-blob reads an image layout.
+	Category: "layout",
+
+	Action: rawCatBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("digest cannot be empty")
+		}
+		ctx.App.Metadata["digest"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawCatBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	blobDigest, err := digest.Parse(ctx.App.Metadata["digest"].(string))
+	if err != nil {
+		return errors.Wrap(err, "parse digest")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	blob, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	verifier := blobDigest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(os.Stdout, verifier), blob); err != nil {
+		return errors.Wrap(err, "output blob")
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("blob %s does not match its digest", blobDigest)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vbatts/go-mtree"
+)
+
+var rawChangesetCommand = cli.Command{
+	Name:  "changeset",
+	Usage: "writes the changes made to a bundle as an uncompressed layer",
+	ArgsUsage: `[--from <old-bundle>] <bundle> <output>
+
+Where "<bundle>" is a bundle unpacked by umoci-unpack(1) and "<output>" is the
+file to write the (uncompressed) layer to. If "<output>" is "-", the layer is
+written to stdout.
+
+By default the layer contains the changes made to "<bundle>" since it was
+unpacked, exactly as umoci-repack(1) would generate them, but the layer is not
+added to any image. If --from is specified, the layer instead contains the
+changes needed to turn the rootfs of "<old-bundle>" into the rootfs of
+"<bundle>" (both bundles must have been unpacked with the same mappings).
+Removed paths are represented using OCI whiteouts, so the layer can be fed
+directly into other image assembly tools.
+
+Paths matching the patterns in "<bundle>/.umociignore" or passed with
+--exclude, as well as paths under any --mask-path, are ignored. The
+--xattr-filter, --no-posix-acls, --sparse, --metadata-only, --reproducible
+and --clamp-mtime options have the same meaning as in umoci-repack(1).`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "bundle to compute the changes from (rather than the bundle's own mtree manifest)",
+		},
+		cli.StringSliceFlag{
+			Name:  "mask-path",
+			Usage: "set of path prefixes in which changes will be ignored",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "pattern of paths which will be ignored (in addition to the bundle's .umociignore)",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-filter",
+			Usage: "rule for which xattrs are included in the layer ([+-]<pattern>)",
+		},
+		cli.BoolFlag{
+			Name:  "no-posix-acls",
+			Usage: "do not include POSIX ACLs in the layer",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "store files containing holes as sparse files in the layer",
+		},
+		cli.StringFlag{
+			Name:  "socket-policy",
+			Usage: "how to handle sockets, which cannot be stored in a layer (skip, placeholder or error)",
+		},
+		cli.StringFlag{
+			Name:  "setuid-policy",
+			Usage: "how to handle setuid and setgid bits (keep, strip or error)",
+		},
+		cli.StringFlag{
+			Name:  "max-mode",
+			Usage: "clear any permission bits not in the given octal mask (such as 0755) in the layer",
+		},
+		cli.StringFlag{
+			Name:  "metadata-only",
+			Usage: "how to handle files whose contents are unchanged but whose metadata changed (include, warn or skip)",
+		},
+		cli.StringFlag{
+			Name:  "metadata-only-min-size",
+			Usage: "only apply --metadata-only to files of at least the given size (such as 1MB)",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "omit host-specific information from the layer",
+		},
+		cli.StringFlag{
+			Name:  "clamp-mtime",
+			Usage: "clamp modification times in the layer to the given ISO8601 date",
+		},
+	},
+
+	Action: rawChangeset,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle> <output>")
+		}
+		if ctx.Args().Get(0) == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		if ctx.Args().Get(1) == "" {
+			return errors.Errorf("output path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().Get(0)
+		ctx.App.Metadata["output"] = ctx.Args().Get(1)
+		return nil
+	},
+}
+
+func rawChangeset(ctx *cli.Context) (Err error) {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+	outputPath := ctx.App.Metadata["output"].(string)
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		return errors.Errorf("cannot generate a changeset for a bundle unpacked with --overlay-layers")
+	}
+
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	keywords := meta.mtreeKeywords()
+
+	log.Info("computing filesystem diff ...")
+	var diffs []mtree.InodeDelta
+	if fromPath := ctx.String("from"); fromPath != "" {
+		fromMeta, err := ReadBundleMeta(fromPath)
+		if err != nil {
+			return errors.Wrap(err, "read --from umoci.json metadata")
+		}
+		if fromMeta.OnDiskFormat == layer.OverlayfsLayers {
+			return errors.Errorf("cannot generate a changeset from a bundle unpacked with --overlay-layers")
+		}
+		if !reflect.DeepEqual(fromMeta.MapOptions, meta.MapOptions) {
+			return errors.Errorf("--from bundle was unpacked with different mappings")
+		}
+		diffs, err = layer.DiffRootfs(filepath.Join(fromPath, layer.RootfsName), fullRootfsPath, keywords, &meta.MapOptions)
+		if err != nil {
+			return errors.Wrap(err, "diff bundles")
+		}
+	} else {
+		spec, err := readBundleManifest(bundlePath, meta)
+		if err != nil {
+			return errors.Wrap(err, "read mtree")
+		}
+
+		fsEval := fseval.DefaultFsEval
+		if meta.MapOptions.Rootless {
+			fsEval = fseval.RootlessFsEval
+		}
+		diffs, err = mtree.Check(fullRootfsPath, spec, keywords, fsEval)
+		if err != nil {
+			return errors.Wrap(err, "check mtree")
+		}
+	}
+	log.Info("... done")
+
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.MaskFilter(ctx.StringSlice("mask-path")))
+
+	ignorePatterns, err := readIgnorePatterns(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read ignore patterns")
+	}
+	ignorePatterns = append(ignorePatterns, ctx.StringSlice("exclude")...)
+	ignoreFilter, err := mtreefilter.IgnoreFilter(ignorePatterns)
+	if err != nil {
+		return errors.Wrap(err, "parse ignore patterns")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, ignoreFilter)
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: computed changeset")
+
+	xattrRules := meta.XattrFilter
+	if ctx.IsSet("xattr-filter") {
+		xattrRules = ctx.StringSlice("xattr-filter")
+	}
+	xattrFilter, err := parseXattrFilter(xattrRules, meta.NoPosixACLs || ctx.Bool("no-posix-acls"))
+	if err != nil {
+		return err
+	}
+	modeMask, err := parseModeMask(ctx.String("max-mode"))
+	if err != nil {
+		return err
+	}
+	var metadataOnlyMinSize int64
+	if ctx.IsSet("metadata-only-min-size") {
+		metadataOnlyMinSize, err = units.RAMInBytes(ctx.String("metadata-only-min-size"))
+		if err != nil {
+			return errors.Wrap(err, "parse --metadata-only-min-size")
+		}
+	}
+
+	clampTime, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	reproducible := ctx.Bool("reproducible") || clampTime != nil
+	if ctx.IsSet("clamp-mtime") {
+		clamp, err := time.Parse(igen.ISO8601, ctx.String("clamp-mtime"))
+		if err != nil {
+			return errors.Wrap(err, "parsing --clamp-mtime")
+		}
+		clampTime = &clamp
+	}
+
+	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &layer.RepackOptions{
+		MapOptions:    meta.MapOptions,
+		XattrFilter:   xattrFilter,
+		EmulateXattrs: meta.EmulateXattrs,
+		Sparse:        ctx.Bool("sparse"),
+		Reproducible:  reproducible,
+		ClampTime:     clampTime,
+		SocketPolicy:  layer.SocketPolicy(ctx.String("socket-policy")),
+		SetuidPolicy:  layer.SetuidPolicy(ctx.String("setuid-policy")),
+		ModeMask:      modeMask,
+
+		MetadataOnly:        layer.MetadataOnlyPolicy(ctx.String("metadata-only")),
+		MetadataOnlyMinSize: metadataOnlyMinSize,
+
+		EmulateOwnership: meta.EmulateOwnership,
+		Devices:          meta.Devices,
+	})
+	if err != nil {
+		return errors.Wrap(err, "generate changeset")
+	}
+	defer reader.Close()
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		outputFile, err := os.Create(outputPath)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer outputFile.Close()
+		// Don't leave a partial layer behind.
+		defer func() {
+			if Err != nil {
+				_ = os.Remove(outputPath)
+			}
+		}()
+		output = outputFile
+	}
+
+	if _, err := io.Copy(output, reader); err != nil {
+		return errors.Wrap(err, "write changeset")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawConvertManifestCommand = cli.Command{
+	Name:  "convert-manifest",
+	Usage: "converts the manifest of a bundle to a different format",
+	ArgsUsage: `--format <format> <bundle>
+
+Where "<bundle>" is a bundle unpacked by umoci-unpack(1) and "<format>" is the
+manifest format to convert the bundle's manifest to ("mtree" or "binary", as
+with umoci-unpack(1) --manifest-format).
+
+The bundle's manifest is replaced by an equivalent manifest in the new format,
+and "<bundle>/umoci.json" is updated accordingly, so that umoci-repack(1) will
+detect the same changes to the rootfs as before the conversion.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "format to convert the manifest to (mtree or binary)",
+		},
+	},
+
+	Action: rawConvertManifest,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		if !ctx.IsSet("format") {
+			return errors.Errorf("missing mandatory argument: --format")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawConvertManifest(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	format, err := parseManifestFormat(ctx.String("format"))
+	if err != nil {
+		return err
+	}
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		return errors.Errorf("bundle unpacked with --overlay-layers has no manifest")
+	}
+	if meta.Checkpoint != nil {
+		return errors.Errorf("bundle has not been completely unpacked (use umoci-unpack(1) --resume)")
+	}
+	if meta.ManifestFormat == format {
+		log.Infof("manifest is already in the requested format: %s", meta.manifestPath(bundlePath))
+		return nil
+	}
+
+	dh, err := readBundleManifest(bundlePath, meta)
+	if err != nil {
+		return errors.Wrap(err, "read manifest")
+	}
+
+	// Write the new manifest before switching umoci.json over to it, so that
+	// the bundle always has a usable manifest.
+	newMeta := meta
+	newMeta.ManifestFormat = format
+	if err := writeBundleManifest(bundlePath, newMeta, dh); err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+	if err := WriteBundleMeta(bundlePath, newMeta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+	if err := os.Remove(meta.manifestPath(bundlePath)); err != nil {
+		return errors.Wrap(err, "remove old manifest")
+	}
+
+	log.Infof("converted manifest: %s", newMeta.manifestPath(bundlePath))
+	return nil
+}
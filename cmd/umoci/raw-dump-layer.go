@@ -0,0 +1,165 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawDumpLayerCommand = cli.Command{
+	Name:  "dump-layer",
+	Usage: "writes the uncompressed contents of a layer blob as a tar archive",
+	ArgsUsage: `--layout <image-path> <digest> <output>
+
+Where "<image-path>" is the path to the OCI image, "<digest>" is the digest of
+the (compressed) layer blob in the image and "<output>" is the file to write
+the uncompressed tar archive to. If "<output>" is "-", the archive is written
+to stdout.
+
+Gzip-compressed (including eStargz), zstd-compressed and uncompressed layer
+blobs are supported. If --diff-id is given, the uncompressed archive must match it.`,
+
+	// dump-layer reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "diff-id",
+			Usage: "diff_id that the uncompressed archive must match",
+		},
+	},
+
+	Action: rawDumpLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest> <output>")
+		}
+		for idx, name := range []string{"digest", "output"} {
+			if ctx.Args().Get(idx) == "" {
+				return errors.Errorf("%s cannot be empty", name)
+			}
+			ctx.App.Metadata[name] = ctx.Args().Get(idx)
+		}
+		return nil
+	},
+}
+
+// gzipMagic is the header of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// zstdMagic is the header of a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func rawDumpLayer(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	outputPath := ctx.App.Metadata["output"].(string)
+
+	blobDigest, err := digest.Parse(ctx.App.Metadata["digest"].(string))
+	if err != nil {
+		return errors.Wrap(err, "parse digest")
+	}
+	var diffID digest.Digest
+	if ctx.IsSet("diff-id") {
+		diffID, err = digest.Parse(ctx.String("diff-id"))
+		if err != nil {
+			return errors.Wrap(err, "parse --diff-id")
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	blob, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	// Layer blobs don't carry their media type, so figure out whether the
+	// blob is compressed from its contents.
+	bufBlob := bufio.NewReader(blob)
+	header, err := bufBlob.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "read layer blob")
+	}
+	var layer io.Reader = bufBlob
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzr, err := gzip.NewReader(bufBlob)
+		if err != nil {
+			return errors.Wrap(err, "create gzip reader")
+		}
+		defer gzr.Close()
+		layer = gzr
+	case bytes.HasPrefix(header, zstdMagic):
+		zr, err := zstd.NewReader(bufBlob)
+		if err != nil {
+			return errors.Wrap(err, "create zstd reader")
+		}
+		defer zr.Close()
+		layer = zr
+	}
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		outputFile, err := os.Create(outputPath)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer outputFile.Close()
+		// Don't leave a partial archive behind.
+		defer func() {
+			if Err != nil {
+				_ = os.Remove(outputPath)
+			}
+		}()
+		output = outputFile
+	}
+
+	diffIDDigester := digest.SHA256.Digester()
+	size, err := io.Copy(io.MultiWriter(output, diffIDDigester.Hash()), layer)
+	if err != nil {
+		return errors.Wrap(err, "write archive")
+	}
+	if diffID != "" && diffIDDigester.Digest() != diffID {
+		return errors.Errorf("layer blob %s: diff_id mismatch: got %s expected %s", blobDigest, diffIDDigester.Digest(), diffID)
+	}
+
+	log.WithFields(log.Fields{
+		"diff_id": diffIDDigester.Digest(),
+		"size":    size,
+	}).Debugf("dumped layer: %s", blobDigest)
+	return nil
+}
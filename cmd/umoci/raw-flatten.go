@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawFlattenCommand = cli.Command{
+	Name:  "flatten",
+	Usage: "writes the flattened root filesystem of an image as a tar archive",
+	ArgsUsage: `--image <image-path>[:<tag>] <output>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to flatten (if not specified, defaults to "latest") and "<output>"
+is the file to write the (uncompressed) tar archive to. If "<output>" is "-",
+the archive is written to stdout.
+
+All of the layers of the image are applied (including whiteouts) without
+extracting anything to disk, so the archive can be piped directly into tools
+which consume a root filesystem tarball. The owners of paths in the archive are
+the same as in the image.`,
+
+	// flatten reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "xattr-filter",
+			Usage: "rule for which xattrs are included in the archive ([+-]<pattern>)",
+		},
+		cli.BoolFlag{
+			Name:  "no-posix-acls",
+			Usage: "do not include POSIX ACLs in the archive",
+		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "only warn if a layer does not match its diff_id in the image configuration",
+		},
+	},
+
+	Action: rawFlatten,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <output>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("output path cannot be empty")
+		}
+		ctx.App.Metadata["output"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawFlatten(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	outputPath := ctx.App.Metadata["output"].(string)
+
+	xattrFilter, err := parseXattrFilter(ctx.StringSlice("xattr-filter"), ctx.Bool("no-posix-acls"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	fromDescriptor := fromDescriptorPaths[0].Descriptor()
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid --image tag")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		outputFile, err := os.Create(outputPath)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer outputFile.Close()
+		// Don't leave a partial archive behind.
+		defer func() {
+			if Err != nil {
+				_ = os.Remove(outputPath)
+			}
+		}()
+		output = outputFile
+	}
+
+	log.Infof("flattening image: %s", fromDescriptor.Digest)
+	if err := layer.FlattenManifest(context.Background(), engineExt, output, manifest, &layer.FlattenOptions{
+		XattrFilter: xattrFilter,
+		NoVerify:    ctx.Bool("no-verify"),
+	}); err != nil {
+		return errors.Wrap(err, "flatten image")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawPackLayerCommand = cli.Command{
+	Name:  "pack-layer",
+	Usage: "compresses an uncompressed layer and adds it to an image's blobs",
+	ArgsUsage: `--layout <image-path> <input>
+
+Where "<image-path>" is the path to the OCI image, and "<input>" is the
+uncompressed layer (a tar archive, using OCI whiteouts for removed paths) to
+add. If "<input>" is "-", the layer is read from stdin.
+
+The layer is compressed (as with umoci-repack(1) --layer-format) and stored as
+a blob in the image, and the digest of the compressed blob is printed to
+stdout. The diff_id and size of the layer are logged (with --log=info). The
+blob is not added to any image manifest, and so will be removed by umoci-gc(1)
+unless it is referenced by an image before then. Layers written by
+umoci-raw-changeset(1) can be piped directly into this command, and
+umoci-raw-dump-layer(1) does the reverse.`,
+
+	// pack-layer modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the compressed layer (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+	},
+
+	Action: rawPackLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <input>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("input path cannot be empty")
+		}
+		ctx.App.Metadata["input"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawPackLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	inputPath := ctx.App.Metadata["input"].(string)
+
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	var input io.Reader = os.Stdin
+	if inputPath != "-" {
+		inputFile, err := os.Open(inputPath)
+		if err != nil {
+			return errors.Wrap(err, "open input")
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	layerDescriptor, diffID, err := mutate.PutLayer(context.Background(), engine, input, compressor)
+	if err != nil {
+		return errors.Wrap(err, "pack layer")
+	}
+
+	log.WithFields(log.Fields{
+		"diff_id": diffID,
+		"size":    layerDescriptor.Size,
+	}).Infof("packed layer: %s", layerDescriptor.Digest)
+	fmt.Println(layerDescriptor.Digest)
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rawReassembleCommand = cli.Command{
+	Name:  "reassemble",
+	Usage: "regenerates an uncompressed layer byte-for-byte from a bundle",
+	ArgsUsage: `<bundle> <diff-id> <output>
+
+Where "<bundle>" is a bundle unpacked by umoci-unpack(1) with --tar-split,
+"<diff-id>" is the diff_id of the layer to regenerate (as listed in the
+rootfs.diff_ids of the image configuration) and "<output>" is the file to write
+the (uncompressed) layer to. If "<output>" is "-", the layer is written to
+stdout.
+
+The layer is regenerated from the tar-split metadata stored by umoci-unpack(1)
+and the contents of the files in the bundle, so the result is identical to the
+original layer (this is verified against "<diff-id>"). This is only possible if
+none of the files in the layer have since been modified or replaced, either by
+a later layer or by changes made to the bundle.`,
+
+	Action: rawReassemble,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 3 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle> <diff-id> <output>")
+		}
+		for idx, name := range []string{"bundle", "diff-id", "output"} {
+			if ctx.Args().Get(idx) == "" {
+				return errors.Errorf("%s cannot be empty", name)
+			}
+			ctx.App.Metadata[name] = ctx.Args().Get(idx)
+		}
+		return nil
+	},
+}
+
+func rawReassemble(ctx *cli.Context) (Err error) {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+	outputPath := ctx.App.Metadata["output"].(string)
+
+	diffID, err := digest.Parse(ctx.App.Metadata["diff-id"].(string))
+	if err != nil {
+		return errors.Wrap(err, "parse diff-id")
+	}
+
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if !meta.TarSplit {
+		return errors.Errorf("bundle was not unpacked with --tar-split: %s", bundlePath)
+	}
+
+	var output io.Writer = os.Stdout
+	if outputPath != "-" {
+		outputFile, err := os.Create(outputPath)
+		if err != nil {
+			return errors.Wrap(err, "create output")
+		}
+		defer outputFile.Close()
+		// Don't leave a partial layer behind.
+		defer func() {
+			if Err != nil {
+				_ = os.Remove(outputPath)
+			}
+		}()
+		output = outputFile
+	}
+
+	log.Infof("reassembling layer: %s", diffID)
+	if err := layer.ReassembleLayer(output, bundlePath, diffID, &meta.MapOptions); err != nil {
+		return errors.Wrap(err, "reassemble layer")
+	}
+	return nil
+}
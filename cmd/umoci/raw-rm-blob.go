@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawRmBlobCommand = cli.Command{
+	Name:  "rm-blob",
+	Usage: "removes a blob from an image",
+	ArgsUsage: `--layout <image-path> <digest>
+
+Where "<image-path>" is the path to the OCI image, and "<digest>" is the
+digest of the blob to remove.
+
+The blob is only removed if it cannot be reached from any of the tags in the
+image, as removing such a blob would break those images. With --force, the
+blob is removed regardless. Use umoci-gc(1) to remove every unreferenced
+blob.`,
+
+	// rm-blob modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "remove the blob even if it is referenced by an image",
+		},
+	},
+
+	Action: rawRmBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("digest cannot be empty")
+		}
+		ctx.App.Metadata["digest"] = ctx.Args().First()
+		return nil
+	},
+}
+
+func rawRmBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	blobDigest, err := digest.Parse(ctx.App.Metadata["digest"].(string))
+	if err != nil {
+		return errors.Wrap(err, "parse digest")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	if !ctx.Bool("force") {
+		references, err := blobReferences(context.Background(), engineExt, blobDigest)
+		if err != nil {
+			return errors.Wrap(err, "get blob references (use --force to remove the blob anyway)")
+		}
+		if len(references) > 0 {
+			return errors.Errorf("blob %s is referenced by %s (use --force to remove it anyway)", blobDigest, strings.Join(references, ", "))
+		}
+	}
+
+	if err := engine.DeleteBlob(context.Background(), blobDigest); err != nil {
+		return errors.Wrap(err, "delete blob")
+	}
+
+	log.Infof("removed blob: %s", blobDigest)
+	return nil
+}
@@ -25,7 +25,6 @@ import (
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
-	"github.com/openSUSE/umoci/pkg/idtools"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -59,10 +58,7 @@ Note that the results of this may not agree with umoci-unpack(1) because the
 			Name:  "gid-map",
 			Usage: "specifies a gid mapping to use when generating config",
 		},
-		cli.BoolFlag{
-			Name:  "rootless",
-			Usage: "generate rootless configuration",
-		},
+		rootlessFlag("generate rootless configuration"),
 		cli.StringFlag{
 			Name:  "rootfs",
 			Usage: "path to secondary source of truth (root filesystem)",
@@ -93,7 +89,11 @@ func rawConfig(ctx *cli.Context) error {
 
 	// Parse map options.
 	// We need to set mappings if we're in rootless mode.
-	meta.MapOptions.Rootless = ctx.Bool("rootless")
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	meta.MapOptions.Rootless = rootless
 	if meta.MapOptions.Rootless {
 		if !ctx.IsSet("uid-map") {
 			ctx.Set("uid-map", fmt.Sprintf("%d:0:1", os.Geteuid()))
@@ -103,20 +103,16 @@ func rawConfig(ctx *cli.Context) error {
 		}
 	}
 	// Parse and set up the mapping options.
-	for _, uidmap := range ctx.StringSlice("uid-map") {
-		idMap, err := idtools.ParseMapping(uidmap)
-		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
-		}
-		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
+	uidMappings, err := parseIDMappings("uid-map", ctx.StringSlice("uid-map"))
+	if err != nil {
+		return err
 	}
-	for _, gidmap := range ctx.StringSlice("gid-map") {
-		idMap, err := idtools.ParseMapping(gidmap)
-		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
-		}
-		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
+	meta.MapOptions.UIDMappings = uidMappings
+	gidMappings, err := parseIDMappings("gid-map", ctx.StringSlice("gid-map"))
+	if err != nil {
+		return err
 	}
+	meta.MapOptions.GIDMappings = gidMappings
 
 	log.WithFields(log.Fields{
 		"map.uid": meta.MapOptions.UIDMappings,
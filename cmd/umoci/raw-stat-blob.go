@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rawStatBlobCommand = cli.Command{
+	Name:  "stat-blob",
+	Usage: "displays information about a blob",
+	ArgsUsage: `--layout <image-path> <digest>
+
+Where "<image-path>" is the path to the OCI image, and "<digest>" is the
+digest of the blob.
+
+The size of the blob, whether its contents match its digest, and the tags
+from which it can be reached are output.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// stat-blob reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the blob information as a JSON encoded blob",
+		},
+	},
+
+	Action: rawStatBlob,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <digest>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("digest cannot be empty")
+		}
+		ctx.App.Metadata["digest"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// blobStat is the information about a blob output by umoci-raw-stat-blob(1).
+type blobStat struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the blob in bytes.
+	Size int64 `json:"size"`
+
+	// Verified is whether the contents of the blob match its digest.
+	Verified bool `json:"verified"`
+
+	// References are the names of the references in the top-level index from
+	// which the blob can be reached (see blobReferences).
+	References []string `json:"references"`
+}
+
+func rawStatBlob(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	blobDigest, err := digest.Parse(ctx.App.Metadata["digest"].(string))
+	if err != nil {
+		return errors.Wrap(err, "parse digest")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	blob, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	verifier := blobDigest.Verifier()
+	size, err := io.Copy(ioutil.Discard, io.TeeReader(blob, verifier))
+	if err != nil {
+		return errors.Wrap(err, "read blob")
+	}
+
+	references, err := blobReferences(context.Background(), engineExt, blobDigest)
+	if err != nil {
+		return errors.Wrap(err, "get blob references")
+	}
+
+	bs := blobStat{
+		Digest:     blobDigest,
+		Size:       size,
+		Verified:   verifier.Verified(),
+		References: references,
+	}
+	if bs.References == nil {
+		bs.References = []string{}
+	}
+
+	if jsonOutput(ctx) {
+		if err := json.NewEncoder(os.Stdout).Encode(bs); err != nil {
+			return errors.Wrap(err, "encoding blob stat")
+		}
+		return nil
+	}
+
+	referenced := strings.Join(bs.References, ", ")
+	if referenced == "" {
+		referenced = "<none>"
+	}
+	fmt.Printf("Digest: %s\n", bs.Digest)
+	fmt.Printf("Size: %d\n", bs.Size)
+	fmt.Printf("Verified: %t\n", bs.Verified)
+	fmt.Printf("Referenced by: %s\n", referenced)
+	return nil
+}
@@ -34,5 +34,15 @@ should be sufficient for most use-cases.`,
 
 	Subcommands: []cli.Command{
 		rawConfigCommand,
+		rawFlattenCommand,
+		rawChangesetCommand,
+		rawReassembleCommand,
+		rawConvertManifestCommand,
+		rawPackLayerCommand,
+		rawDumpLayerCommand,
+		rawAddBlobCommand,
+		rawCatBlobCommand,
+		rawStatBlobCommand,
+		rawRmBlobCommand,
 	},
 }
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var recompressCommand = uxTag(cli.Command{
+	Name:  "recompress",
+	Usage: "recompresses the layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [<layer>...]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image. Each "<layer>" is a layer to
+recompress, in the same format as umoci-remove-layer(1). If no layers are
+specified, every layer of the image is recompressed.
+
+Each layer is decompressed and compressed again using --layer-format, without
+being extracted. The uncompressed contents of the layers (and thus the diff_ids
+in the image configuration) are unchanged, except for the metadata added by
+some formats (such as the table of contents of eStargz layers), so no history
+entry is added. This can be used to migrate an image from gzip to zstd layers
+(with --layer-format zstd).`,
+
+	// recompress modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the recompressed layers (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+	},
+
+	Action: recompress,
+})
+
+func recompress(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	var indices []int
+	if ctx.NArg() == 0 {
+		for idx := range manifest.Layers {
+			indices = append(indices, idx)
+		}
+	}
+	seen := map[int]bool{}
+	for _, layer := range ctx.Args() {
+		idx, err := resolveLayer(mutator, layer)
+		if err != nil {
+			return err
+		}
+		if !seen[idx] {
+			seen[idx] = true
+			indices = append(indices, idx)
+		}
+	}
+
+	log.Infof("recompressing %d layers of %s", len(indices), fromName)
+	if err := mutator.RecompressLayers(context.Background(), indices, compressor, ctx.GlobalInt("workers")); err != nil {
+		return errors.Wrap(err, "recompress layers")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
@@ -0,0 +1,282 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var referrersCommand = uxFormat(cli.Command{
+	Name:  "referrers",
+	Usage: "lists (and retrieves) the artifacts attached to a tagged image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose referrers (the artifacts attached to it, such as the
+SBOMs attached with umoci-attach(1) or the signatures stored by
+umoci-sign(1)) are listed.
+
+If --type is specified, only referrers of the given type (which can be one of
+the short names accepted by umoci-attach(1)) are listed. If --output is
+specified, the files of the listed referrers are also written to the given
+directory, named after their title (or their digest if they have no title).
+
+If --format is specified, the referrers are formatted using the given Go
+template (see text/template) rather than the default formatting. The fields are
+the same as with --json, using the names of the Go structures (such as
+"{{range .}}{{.Descriptor.Digest}}{{end}}").
+
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it
+is easy for humans to read, and might change in future versions.`,
+
+	// referrers reads an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "type",
+			Usage: "only list referrers of the given type",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "write the files of the listed referrers to the given directory",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the referrers as a JSON encoded blob",
+		},
+	},
+
+	Action: referrers,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("type") {
+			if _, err := parseArtifactType(ctx.String("type")); err != nil {
+				return errors.Wrap(err, "invalid --type")
+			}
+		}
+		if ctx.IsSet("output") && ctx.String("output") == "" {
+			return errors.Errorf("--output cannot be empty")
+		}
+		return nil
+	},
+})
+
+// referrerInfo describes a referrer of an image, as output by umoci-referrers.
+type referrerInfo struct {
+	// Descriptor is the descriptor of the artifact manifest.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// ArtifactType is the type of the artifact.
+	ArtifactType string `json:"artifactType"`
+
+	// Blobs are the descriptors of the files of the artifact.
+	Blobs []ispec.Descriptor `json:"blobs"`
+
+	// Annotations are the annotations of the artifact manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// readReferrerInfo reads the artifact manifest of the given referrer.
+func readReferrerInfo(ctx context.Context, engineExt casext.Engine, referrer casext.Referrer) (referrerInfo, error) {
+	info := referrerInfo{
+		Descriptor:   referrer.Descriptor,
+		ArtifactType: referrer.ArtifactType,
+		Blobs:        []ispec.Descriptor{},
+	}
+
+	data, err := readRawBlob(ctx, engineExt, referrer.Descriptor)
+	if err != nil {
+		return info, err
+	}
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return info, errors.Wrapf(err, "parse manifest %s", referrer.Descriptor.Digest)
+	}
+	for _, blob := range manifest.Layers {
+		// Artifacts without any files contain only the empty JSON object.
+		if blob.MediaType == casext.MediaTypeEmptyJSON {
+			continue
+		}
+		info.Blobs = append(info.Blobs, blob)
+	}
+	info.Annotations = manifest.Annotations
+	return info, nil
+}
+
+// referrerBlobName returns the name of the file a blob of a referrer is
+// written to by --output. Titles which are not a plain file name are ignored.
+func referrerBlobName(blob ispec.Descriptor) string {
+	title := blob.Annotations[ispec.AnnotationTitle]
+	if title == "" || title == "." || title == ".." || filepath.Base(title) != title {
+		return blob.Digest.Encoded()
+	}
+	return title
+}
+
+// writeReferrerBlob writes the given blob to the given path, verifying its
+// contents.
+func writeReferrerBlob(ctx context.Context, engineExt casext.Engine, blob ispec.Descriptor, path string) (Err error) {
+	reader, err := engineExt.GetBlob(ctx, blob.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "get blob %s", blob.Digest)
+	}
+	defer reader.Close()
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer fh.Close()
+	// Don't leave a partial (or corrupted) file behind.
+	defer func() {
+		if Err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	verifier := blob.Digest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(fh, verifier), reader); err != nil {
+		return errors.Wrapf(err, "write blob %s", blob.Digest)
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("blob %s does not match its digest", blob.Digest)
+	}
+	return errors.Wrap(fh.Close(), "close file")
+}
+
+// formatReferrers writes a human-readable table of the referrers to w.
+func formatReferrers(w io.Writer, infos []referrerInfo) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "DIGEST\tARTIFACT TYPE\tCREATED\tFILES\n")
+	for _, info := range infos {
+		created := info.Annotations[ispec.AnnotationCreated]
+		if created == "" {
+			created = "<none>"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", info.Descriptor.Digest, info.ArtifactType, created, len(info.Blobs))
+	}
+	return tw.Flush()
+}
+
+func referrers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	var artifactType string
+	if ctx.IsSet("type") {
+		var err error
+		artifactType, err = parseArtifactType(ctx.String("type"))
+		if err != nil {
+			// Should _never_ be reached.
+			return errors.Wrap(err, "[internal error] invalid --type")
+		}
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	root, err := tagRoot(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+
+	referrers, err := engineExt.Referrers(context.Background(), root.Digest)
+	if err != nil {
+		return errors.Wrap(err, "find referrers")
+	}
+	infos := []referrerInfo{}
+	for _, referrer := range referrers {
+		if artifactType != "" && referrer.ArtifactType != artifactType {
+			continue
+		}
+		info, err := readReferrerInfo(context.Background(), engineExt, referrer)
+		if err != nil {
+			return errors.Wrapf(err, "read referrer %s", referrer.Descriptor.Digest)
+		}
+		infos = append(infos, info)
+	}
+
+	if outputDir := ctx.String("output"); outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return errors.Wrap(err, "create --output directory")
+		}
+		written := map[string]digest.Digest{}
+		for _, info := range infos {
+			for _, blob := range info.Blobs {
+				name := referrerBlobName(blob)
+				if other, ok := written[name]; ok {
+					if other == blob.Digest {
+						continue
+					}
+					return errors.Errorf("several referrer files are named %s: %s and %s", name, other, blob.Digest)
+				}
+				written[name] = blob.Digest
+
+				path := filepath.Join(outputDir, name)
+				if err := writeReferrerBlob(context.Background(), engineExt, blob, path); err != nil {
+					return errors.Wrapf(err, "write %s", path)
+				}
+				log.Infof("wrote %s: %s", blob.Digest, path)
+			}
+		}
+	}
+
+	// Output the referrers.
+	if tmpl, ok := ctx.App.Metadata["--format"].(*template.Template); ok {
+		if err := executeTemplate(os.Stdout, tmpl, infos); err != nil {
+			return err
+		}
+	} else if jsonOutput(ctx) {
+		if err := json.NewEncoder(os.Stdout).Encode(infos); err != nil {
+			return errors.Wrap(err, "encoding referrers")
+		}
+	} else {
+		if err := formatReferrers(os.Stdout, infos); err != nil {
+			return errors.Wrap(err, "format referrers")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var removeLayerCommand = uxCreated(uxHistory(uxTag(cli.Command{
+	Name:  "remove-layer",
+	Usage: "removes a layer from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <layer>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image.
+
+"<layer>" is either the index of the layer to remove (counting from zero at
+the base of the image, with negative indices counting from the top of the
+image) or the digest of the layer (either the digest of its blob or its
+diff_id). The layer's diff_id and history entry are removed from the image
+configuration, and an empty-layer history entry recording the removal is
+appended.
+
+Note that layers above the removed layer may depend on its contents, and that
+the removed layer's blob is only deleted from the image by umoci-gc(1) once it
+is no longer referenced.`,
+
+	// remove-layer modifies a particular image manifest.
+	Category: "image",
+
+	Action: removeLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <layer>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("layer cannot be empty")
+		}
+		ctx.App.Metadata["layer"] = ctx.Args().First()
+		return nil
+	},
+})))
+
+// resolveLayer converts the given <layer> argument (either an index, which may
+// be negative to count from the top of the image, or the digest of a layer
+// blob or diff_id) to the index of a layer in the image being modified.
+func resolveLayer(mutator *mutate.Mutator, layer string) (int, error) {
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return -1, errors.Wrap(err, "get manifest")
+	}
+	if idx, err := strconv.Atoi(layer); err == nil {
+		return layerIndex("layer", idx, len(manifest.Layers))
+	}
+	layerDigest, err := digest.Parse(layer)
+	if err != nil {
+		return -1, errors.Errorf("invalid layer %q: must be an index or a digest", layer)
+	}
+	return mutator.LayerIndex(context.Background(), layerDigest)
+}
+
+func removeLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	index, err := resolveLayer(mutator, ctx.App.Metadata["layer"].(string))
+	if err != nil {
+		return err
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	history, err := historyEntry(ctx, ispec.History{
+		Author:     imageMeta.Author,
+		Created:    &created,
+		CreatedBy:  fmt.Sprintf("umoci remove-layer %d", index),
+		EmptyLayer: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("removing layer %d of %s", index, fromName)
+	if err := mutator.RemoveLayer(context.Background(), index, history); err != nil {
+		return errors.Wrap(err, "remove layer")
+	}
+
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
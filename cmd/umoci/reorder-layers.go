@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var reorderLayersCommand = uxCreated(uxHistory(uxTag(cli.Command{
+	Name:  "reorder-layers",
+	Usage: "changes the order of the layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] <layer>...
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image.
+
+Each "<layer>" is either the index of a layer (counting from zero at the base
+of the image, with negative indices counting from the top of the image) or the
+digest of a layer (either the digest of its blob or its diff_id). Every layer
+of the image must be given exactly once, in the new order (starting from the
+base of the image). The diff_ids and history entries of the layers are
+reordered to match, and an empty-layer history entry recording the
+reordering is appended.
+
+No layers are modified, so if several layers modify the same path then
+reordering them changes the contents of the image. If --overlap-policy is
+"warn" or "error", every layer is read to find such paths beforehand.`,
+
+	// reorder-layers modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "overlap-policy",
+			Usage: "how to handle reordering layers which modify the same path (ignore, warn or error)",
+			Value: "ignore",
+		},
+	},
+
+	Action: reorderLayers,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() == 0 {
+			return errors.Errorf("invalid number of positional arguments: expected <layer>...")
+		}
+		switch ctx.String("overlap-policy") {
+		case "ignore", "warn", "error":
+		default:
+			return errors.Errorf("invalid --overlap-policy %q: must be ignore, warn or error", ctx.String("overlap-policy"))
+		}
+		ctx.App.Metadata["layers"] = []string(ctx.Args())
+		return nil
+	},
+})))
+
+func reorderLayers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	overlapPolicy := ctx.String("overlap-policy")
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	var order []int
+	var orderStrings []string
+	for _, value := range ctx.App.Metadata["layers"].([]string) {
+		index, err := resolveLayer(mutator, value)
+		if err != nil {
+			return err
+		}
+		order = append(order, index)
+		orderStrings = append(orderStrings, strconv.Itoa(index))
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	history, err := historyEntry(ctx, ispec.History{
+		Author:     imageMeta.Author,
+		Created:    &created,
+		CreatedBy:  fmt.Sprintf("umoci reorder-layers %s", strings.Join(orderStrings, " ")),
+		EmptyLayer: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The overlaps are found in the original manifest.
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	log.Infof("reordering layers of %s", fromName)
+	if err := mutator.ReorderLayers(context.Background(), order, history); err != nil {
+		return errors.Wrap(err, "reorder layers")
+	}
+
+	if overlapPolicy != "ignore" {
+		overlaps, err := layer.FindOverlaps(context.Background(), engine, manifest)
+		if err != nil {
+			return errors.Wrap(err, "find overlapping layers")
+		}
+		var reordered int
+		for _, overlap := range overlaps {
+			if !overlap.Reordered(order) {
+				continue
+			}
+			reordered++
+			log.Warnf("reorder-layers: layers %v all modify /%s, so reordering them changes its contents", overlap.Layers, overlap.Path)
+		}
+		if reordered > 0 && overlapPolicy == "error" {
+			return errors.Errorf("reordering layers changes the contents of %d overlapping paths", reordered)
+		}
+	}
+
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
@@ -25,12 +25,14 @@ import (
 	"time"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/fswatch"
 	"github.com/openSUSE/umoci/pkg/mtreefilter"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -39,7 +41,7 @@ import (
 	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+var repackCommand = uxDryRun(uxCreated(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -56,7 +58,55 @@ original manifest to add the diff layer.
 All uid-map and gid-map settings are automatically loaded from the bundle
 metadata (which is generated by umoci-unpack(1)) so if you unpacked an image
 using a particular mapping then the same mapping will be used to generate the
-new layer.
+new layer. Similarly, the --xattr-filter rules used by umoci-unpack(1) are
+re-used unless --xattr-filter is specified (see umoci-unpack(1) for the rule
+format), and POSIX ACLs are not included if --no-posix-acls was passed to
+either umoci-unpack(1) or umoci-repack(1). If the bundle was unpacked with
+--emulate-xattrs, the emulated xattrs are included under their real names, and
+if it was unpacked with --emulate-ownership the owners recorded in the
+user.rootlesscontainers xattr are used.
+
+If --reproducible is specified, host-specific information (such as user and
+group names, and the time of generation) is omitted from the new layer so that
+repacking the same changes always produces the same layer. --clamp-mtime can be
+used to clamp all modification times in the layer to a given date (using a date
+of "1970-01-01T00:00:00Z" will zero all timestamps). If the SOURCE_DATE_EPOCH
+environment variable is set, it implies --reproducible and is used as the
+default for --clamp-mtime and --history.created.
+
+If --split-layer-size is specified, the changes are split (at file boundaries)
+into several layers each containing roughly the given amount of file data,
+rather than adding a single layer to the image. This can improve the
+performance of pushing and pulling images with large amounts of new content.
+
+The --layer-format option controls how new layers are compressed. The default
+("gzip") compresses each layer as a single gzip stream, while "estargz"
+generates eStargz layers (which are still valid gzip layers) that can be lazily
+pulled by runtimes using the stargz-snapshotter. "zstd" compresses each layer
+as a zstd stream, which is faster to decompress but requires a runtime with
+zstd support.
+
+Paths matching any of the patterns in "<bundle>/.umociignore" (one per line)
+or passed with --exclude are ignored when generating the new layer, which is
+useful for excluding build caches or editor temporary files. The patterns use
+similar semantics to .gitignore: "*" and "**" wildcards are supported, patterns
+without a "/" match at any depth, patterns starting with "!" re-include paths,
+and lines starting with "#" are comments.
+
+If --watch-log is specified, only the paths recorded by umoci-watch(1) in
+"<bundle>/umoci-watch.log" are checked for changes (rather than the entire
+rootfs), which is much faster for large root filesystems. If the log is
+incomplete, the entire rootfs is checked.
+
+The bundle is not modified by default, so the changes will be included again
+if the bundle is repacked a second time. If --refresh-bundle is specified, the
+bundle's mtree manifest and metadata are regenerated to refer to the new image,
+so that the bundle can be modified and repacked again (as though it had just
+been unpacked from the new image).
+
+If --dry-run is specified, the image is not modified. Instead, the
+modifications which would have been made (including the new layer blobs) are
+printed as JSON.
 
 It should be noted that this is not the same as oci-create-layer because it
 uses go-mtree to create diff layers from runtime bundles unpacked with
@@ -75,6 +125,67 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "no-mask-volumes",
 			Usage: "do not add the Config.Volumes of the image to the set of masked paths",
 		},
+		cli.BoolFlag{
+			Name:  "watch-log",
+			Usage: "only check the paths recorded by umoci-watch(1) for changes",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "pattern of paths which will be ignored when generating new layers (in addition to the bundle's .umociignore)",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-filter",
+			Usage: "rule for which xattrs are included in the new layer ([+-]<pattern>)",
+		},
+		cli.BoolFlag{
+			Name:  "no-posix-acls",
+			Usage: "do not include POSIX ACLs in the new layer",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "store files containing holes as sparse files in the new layer",
+		},
+		cli.StringFlag{
+			Name:  "socket-policy",
+			Usage: "how to handle sockets, which cannot be stored in a layer (skip, placeholder or error)",
+		},
+		cli.StringFlag{
+			Name:  "setuid-policy",
+			Usage: "how to handle setuid and setgid bits (keep, strip or error)",
+		},
+		cli.StringFlag{
+			Name:  "max-mode",
+			Usage: "clear any permission bits not in the given octal mask (such as 0755) in the new layer",
+		},
+		cli.StringFlag{
+			Name:  "metadata-only",
+			Usage: "how to handle files whose contents are unchanged but whose metadata changed (include, warn or skip)",
+		},
+		cli.StringFlag{
+			Name:  "metadata-only-min-size",
+			Usage: "only apply --metadata-only to files of at least the given size (such as 1MB)",
+		},
+		cli.StringFlag{
+			Name:  "split-layer-size",
+			Usage: "split the changes into multiple layers of roughly the given size (such as 512MB)",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "omit host-specific information from the new layer",
+		},
+		cli.StringFlag{
+			Name:  "clamp-mtime",
+			Usage: "clamp modification times in the new layer to the given ISO8601 date",
+		},
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the new layer (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+		cli.BoolFlag{
+			Name:  "refresh-bundle",
+			Usage: "update the bundle to refer to the new image, so it can be repacked again",
+		},
 	},
 
 	Action: repack,
@@ -83,13 +194,16 @@ manifest and configuration information uses the new diff atop the old manifest.`
 		if ctx.NArg() != 1 {
 			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
 		}
+		if ctx.Bool("refresh-bundle") && ctx.Bool("dry-run") {
+			return errors.Errorf("--refresh-bundle cannot be used with --dry-run")
+		}
 		if ctx.Args().First() == "" {
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
-})
+})))
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
@@ -108,6 +222,10 @@ func repack(ctx *cli.Context) error {
 		"map_options": meta.MapOptions,
 	}).Debugf("umoci: loaded UmociMeta metadata")
 
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		return errors.Errorf("cannot repack a bundle unpacked with --overlay-layers")
+	}
+
 	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
 	}
@@ -117,8 +235,15 @@ func repack(ctx *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
-	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
+	engine, batch, err := stageDryRun(ctx, engine)
+	if err != nil {
+		return err
+	}
+	if batch != nil {
+		defer batch.Close()
+	}
+	engineExt := casext.NewEngine(engine)
 
 	// Create the mutator.
 	mutator, err := mutate.New(engine, meta.From)
@@ -126,8 +251,7 @@ func repack(ctx *cli.Context) error {
 		return errors.Wrap(err, "create mutator for base image")
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	mtreePath := meta.manifestPath(bundlePath)
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
@@ -137,19 +261,14 @@ func repack(ctx *cli.Context) error {
 		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
-	}
-	defer mfh.Close()
-
-	spec, err := mtree.ParseSpec(mfh)
+	spec, err := readBundleManifest(bundlePath, meta)
 	if err != nil {
-		return errors.Wrap(err, "parse mtree")
+		return errors.Wrap(err, "read mtree")
 	}
 
+	keywords := meta.mtreeKeywords()
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 	}).Debugf("umoci: parsed mtree spec")
 
 	fsEval := fseval.DefaultFsEval
@@ -157,8 +276,25 @@ func repack(ctx *cli.Context) error {
 		fsEval = fseval.RootlessFsEval
 	}
 
+	var watchLog *fswatch.Log
+	if ctx.Bool("watch-log") {
+		watchLog, err = readWatchLog(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "read watch log")
+		}
+		if watchLog.Incomplete {
+			log.Warnf("watch log %s is incomplete, checking the entire rootfs", UmociWatchLogName)
+			watchLog = nil
+		}
+	}
+
 	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
+	var diffs []mtree.InodeDelta
+	if watchLog != nil {
+		diffs, err = fswatch.Check(fullRootfsPath, spec, keywords, fsEval, watchLog)
+	} else {
+		diffs, err = mtree.Check(fullRootfsPath, spec, keywords, fsEval)
+	}
 	if err != nil {
 		return errors.Wrap(err, "check mtree")
 	}
@@ -181,47 +317,142 @@ func repack(ctx *cli.Context) error {
 	}
 	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.MaskFilter(maskedPaths))
 
-	reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
+	// Ignore any paths matched by the bundle's ignore file or --exclude.
+	ignorePatterns, err := readIgnorePatterns(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read ignore patterns")
+	}
+	ignorePatterns = append(ignorePatterns, ctx.StringSlice("exclude")...)
+	ignoreFilter, err := mtreefilter.IgnoreFilter(ignorePatterns)
+	if err != nil {
+		return errors.Wrap(err, "parse ignore patterns")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, ignoreFilter)
+
+	xattrRules := meta.XattrFilter
+	if ctx.IsSet("xattr-filter") {
+		xattrRules = ctx.StringSlice("xattr-filter")
+	}
+	xattrFilter, err := parseXattrFilter(xattrRules, meta.NoPosixACLs || ctx.Bool("no-posix-acls"))
 	if err != nil {
-		return errors.Wrap(err, "generate diff layer")
+		return err
+	}
+
+	// SOURCE_DATE_EPOCH implies that the layer should be reproducible, with
+	// all timestamps clamped to the epoch.
+	clampTime, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	reproducible := ctx.Bool("reproducible") || clampTime != nil
+	if ctx.IsSet("clamp-mtime") {
+		clamp, err := time.Parse(igen.ISO8601, ctx.String("clamp-mtime"))
+		if err != nil {
+			return errors.Wrap(err, "parsing --clamp-mtime")
+		}
+		clampTime = &clamp
 	}
-	defer reader.Close()
 
 	imageMeta, err := mutator.Meta(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "get image metadata")
 	}
 
-	created := time.Now()
-	history := ispec.History{
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	history, err := historyEntry(ctx, ispec.History{
 		Author:     imageMeta.Author,
 		Comment:    "",
 		Created:    &created,
-		CreatedBy:  "umoci config", // XXX: Should we append argv to this?
+		CreatedBy:  "umoci repack", // XXX: Should we append argv to this?
 		EmptyLayer: false,
+	})
+	if err != nil {
+		return err
 	}
 
-	if val, ok := ctx.App.Metadata["--history.author"]; ok {
-		history.Author = val.(string)
+	var splitSize int64
+	if ctx.IsSet("split-layer-size") {
+		splitSize, err = units.RAMInBytes(ctx.String("split-layer-size"))
+		if err != nil {
+			return errors.Wrap(err, "parse --split-layer-size")
+		}
+	}
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
 	}
-	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
-		history.Comment = val.(string)
+	modeMask, err := parseModeMask(ctx.String("max-mode"))
+	if err != nil {
+		return err
 	}
-	if val, ok := ctx.App.Metadata["--history.created"]; ok {
-		created, err := time.Parse(igen.ISO8601, val.(string))
+	var metadataOnlyMinSize int64
+	if ctx.IsSet("metadata-only-min-size") {
+		metadataOnlyMinSize, err = units.RAMInBytes(ctx.String("metadata-only-min-size"))
 		if err != nil {
-			return errors.Wrap(err, "parsing --history.created")
+			return errors.Wrap(err, "parse --metadata-only-min-size")
 		}
-		history.Created = &created
 	}
-	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
-		history.CreatedBy = val.(string)
+
+	groups, err := layer.SplitDeltas(fullRootfsPath, diffs, splitSize, &meta.MapOptions)
+	if err != nil {
+		return errors.Wrap(err, "split diff layer")
+	}
+
+	for idx, group := range groups {
+		log.WithFields(log.Fields{
+			"layer":  idx,
+			"ndiff":  len(group),
+			"nlayer": len(groups),
+		}).Debugf("umoci: generating diff layer")
+
+		reader, err := layer.GenerateLayer(fullRootfsPath, group, &layer.RepackOptions{
+			MapOptions:    meta.MapOptions,
+			XattrFilter:   xattrFilter,
+			EmulateXattrs: meta.EmulateXattrs,
+			Sparse:        ctx.Bool("sparse"),
+			Reproducible:  reproducible,
+			ClampTime:     clampTime,
+			SocketPolicy:  layer.SocketPolicy(ctx.String("socket-policy")),
+			SetuidPolicy:  layer.SetuidPolicy(ctx.String("setuid-policy")),
+			ModeMask:      modeMask,
+
+			MetadataOnly:        layer.MetadataOnlyPolicy(ctx.String("metadata-only")),
+			MetadataOnlyMinSize: metadataOnlyMinSize,
+
+			EmulateOwnership: meta.EmulateOwnership,
+			Devices:          meta.Devices,
+		})
+		if err != nil {
+			return errors.Wrap(err, "generate diff layer")
+		}
+
+		// Each of the split layers gets its own history entry, so make it
+		// clear which part of the changes it contains.
+		layerHistory := history
+		if history != nil && len(groups) > 1 {
+			entry := *history
+			part := fmt.Sprintf("(part %d/%d)", idx+1, len(groups))
+			entry.CreatedBy = strings.TrimSpace(entry.CreatedBy + " " + part)
+			entry.Comment = strings.TrimSpace(entry.Comment + " " + part)
+			layerHistory = &entry
+		}
+
+		// TODO: We should add a flag to allow for a new layer to be made
+		//       non-distributable.
+		err = mutator.AddLayer(context.Background(), reader, layerHistory, &mutate.AddOptions{
+			Compressor: compressor,
+		})
+		reader.Close()
+		if err != nil {
+			return errors.Wrap(err, "add diff layer")
+		}
 	}
 
-	// TODO: We should add a flag to allow for a new layer to be made
-	//       non-distributable.
-	if err := mutator.Add(context.Background(), reader, history); err != nil {
-		return errors.Wrap(err, "add diff layer")
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
 	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
@@ -234,7 +465,55 @@ func repack(ctx *cli.Context) error {
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
+	if batch != nil {
+		return finishDryRun(batch)
+	}
 
 	log.Infof("created new tag for image manifest: %s", tagName)
+
+	if ctx.Bool("refresh-bundle") {
+		if err := refreshBundle(bundlePath, meta, newDescriptorPath, fsEval); err != nil {
+			return err
+		}
+	} else {
+		log.Infof("bundle still refers to the original image (use --refresh-bundle to update it)")
+	}
+	return outputTagResult(ctx, engineExt, tagName)
+}
+
+// refreshBundle regenerates the mtree manifest of the bundle from its rootfs
+// and updates its metadata to refer to the given (newly repacked) image, so
+// that later repacks only include changes made after this point.
+func refreshBundle(bundlePath string, meta UmociMeta, newFrom casext.DescriptorPath, fsEval fseval.FsEval) error {
+	oldMtreePath := meta.manifestPath(bundlePath)
+	meta.From = newFrom
+	mtreePath := meta.manifestPath(bundlePath)
+
+	log.Info("refreshing bundle manifest ...")
+	dh, err := mtree.Walk(filepath.Join(bundlePath, layer.RootfsName), nil, meta.mtreeKeywords(), fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+	log.Info("... done")
+
+	// The manifest is only replaced in-place if the image is unchanged.
+	if mtreePath == oldMtreePath {
+		if err := os.Remove(oldMtreePath); err != nil {
+			return errors.Wrap(err, "remove old mtree")
+		}
+	}
+	if err := writeBundleManifest(bundlePath, meta, dh); err != nil {
+		return errors.Wrap(err, "write mtree")
+	}
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+	if mtreePath != oldMtreePath {
+		if err := os.Remove(oldMtreePath); err != nil {
+			return errors.Wrap(err, "remove old mtree")
+		}
+	}
+
+	log.Infof("refreshed bundle to refer to %s", newFrom.Descriptor().Digest)
 	return nil
 }
@@ -0,0 +1,256 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var replaceLayerCommand = uxCreated(uxHistory(uxTag(cli.Command{
+	Name:  "replace-layer",
+	Usage: "replaces a layer of an image with a different layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--blob] <layer> <input>
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to modify (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the new image as, if this is not
+specified then umoci will replace the old image. "<layer>" is the layer to
+replace, in the same format as umoci-remove-layer(1).
+
+"<input>" is the uncompressed replacement layer (a tar archive, using OCI
+whiteouts for removed paths, such as one generated by umoci-raw-changeset(1)).
+If "<input>" is "-", the layer is read from stdin. If --blob is specified,
+"<input>" is instead the digest of a layer blob which is already in the image
+(such as one added by umoci-raw-pack-layer(1)).
+
+The diff_id of the layer in the image configuration is updated to match the
+replacement, and the layer's history entry is replaced with a new entry (or
+kept as-is with --no-history). The other layers of the image are left
+untouched.`,
+
+	// replace-layer modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "blob",
+			Usage: "<input> is the digest of a layer blob already in the image",
+		},
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the replacement layer (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+	},
+
+	Action: replaceLayer,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <layer> <input>")
+		}
+		for idx, name := range []string{"layer", "input"} {
+			if ctx.Args().Get(idx) == "" {
+				return errors.Errorf("%s cannot be empty", name)
+			}
+			ctx.App.Metadata[name] = ctx.Args().Get(idx)
+		}
+		return nil
+	},
+})))
+
+// describeLayerBlob returns a descriptor for the layer blob with the given
+// digest. Blobs don't carry their media type, so whether the layer is
+// compressed is figured out from its contents.
+func describeLayerBlob(engine cas.Engine, blobDigest digest.Digest, nonDistributable bool) (ispec.Descriptor, error) {
+	blob, err := engine.GetBlob(context.Background(), blobDigest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get layer blob")
+	}
+	defer blob.Close()
+
+	bufBlob := bufio.NewReader(blob)
+	header, err := bufBlob.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return ispec.Descriptor{}, errors.Wrap(err, "read layer blob")
+	}
+	var mediaType string
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		mediaType = ispec.MediaTypeImageLayerGzip
+		if nonDistributable {
+			mediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+		}
+	case bytes.HasPrefix(header, zstdMagic):
+		mediaType = casext.MediaTypeImageLayerZstd
+		if nonDistributable {
+			mediaType = casext.MediaTypeImageLayerNonDistributableZstd
+		}
+	default:
+		mediaType = ispec.MediaTypeImageLayer
+		if nonDistributable {
+			mediaType = ispec.MediaTypeImageLayerNonDistributable
+		}
+	}
+
+	size, err := io.Copy(ioutil.Discard, bufBlob)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "read layer blob")
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      size,
+	}, nil
+}
+
+func replaceLayer(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	inputPath := ctx.App.Metadata["input"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	index, err := resolveLayer(mutator, ctx.App.Metadata["layer"].(string))
+	if err != nil {
+		return err
+	}
+
+	// The contents of a non-distributable layer must not end up in a
+	// distributable layer.
+	nonDistributable := strings.HasPrefix(manifest.Layers[index].MediaType, ispec.MediaTypeImageLayerNonDistributable)
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	history, err := historyEntry(ctx, ispec.History{
+		Author:     imageMeta.Author,
+		Created:    &created,
+		CreatedBy:  fmt.Sprintf("umoci replace-layer %d", index),
+		EmptyLayer: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("replacing layer %d of %s", index, fromName)
+	if ctx.Bool("blob") {
+		blobDigest, err := digest.Parse(inputPath)
+		if err != nil {
+			return errors.Wrap(err, "parse blob digest")
+		}
+		layerDescriptor, err := describeLayerBlob(engine, blobDigest, nonDistributable)
+		if err != nil {
+			return err
+		}
+		if err := mutator.ReplaceLayerBlob(context.Background(), index, layerDescriptor, history); err != nil {
+			return errors.Wrap(err, "replace layer")
+		}
+	} else {
+		var input io.Reader = os.Stdin
+		if inputPath != "-" {
+			inputFile, err := os.Open(inputPath)
+			if err != nil {
+				return errors.Wrap(err, "open input")
+			}
+			defer inputFile.Close()
+			input = inputFile
+		}
+		if err := mutator.ReplaceLayer(context.Background(), index, input, history, &mutate.AddOptions{
+			Compressor:       compressor,
+			NonDistributable: nonDistributable,
+		}); err != nil {
+			return errors.Wrap(err, "replace layer")
+		}
+	}
+
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
@@ -0,0 +1,75 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var rollbackCommand = cli.Command{
+	Name:  "rollback",
+	Usage: "restores a tag to the image it referred to before it was last modified",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tag to restore (if not specified, defaults to "latest").
+
+Whenever umoci replaces a tag (such as when modifying an image with
+umoci-config(1) or umoci-repack(1) without --tag), the image it previously
+referred to is recorded. This command restores the tag to that image, which is
+only possible until the previous image is removed by umoci-gc(1). Running it
+again undoes the rollback.`,
+
+	// rollback modifies an image layout.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: rollback,
+}
+
+func rollback(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	descriptor, err := mutate.Rollback(context.Background(), engine, tagName)
+	if err != nil {
+		return errors.Wrap(err, "rollback")
+	}
+
+	log.Infof("restored tag %s to %s", tagName, descriptor.Digest)
+	return outputTagResult(ctx, casext.NewEngine(engine), tagName)
+}
@@ -0,0 +1,292 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+)
+
+// defaultRuntimes are the OCI runtimes used by umoci-run(1) (in order of
+// preference) if --runtime is not given.
+var defaultRuntimes = []string{"runc", "crun"}
+
+var runCommand = uxTag(uxImage(cli.Command{
+	Name:  "run",
+	Usage: "runs a command in a runtime bundle using an OCI runtime",
+	ArgsUsage: `{--bundle <bundle> | --image <image-path>[:<tag>] [--repack]} [<command>...]
+
+Where "<bundle>" is the path to a runtime bundle which was created with
+umoci-unpack(1). With --image, the tagged image is instead unpacked into a
+temporary bundle (which is removed once the container exits), and "<image-path>"
+and "<tag>" are as in umoci-unpack(1).
+
+The container is run using the OCI runtime given by --runtime (by default runc
+or crun, whichever is found first) with the bundle's config.json, and with the
+standard input, output and error of umoci. If "<command>" is given, it is run
+instead of the image's entrypoint and command. A terminal is only allocated if
+the standard input is a terminal.
+
+With --repack, the temporary bundle is repacked (as with umoci-repack(1)) into
+the tag given by --tag (by default, the tag the image was unpacked from) if
+the container exits successfully.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "path of an existing runtime bundle to run",
+		},
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "OCI runtime used to run the container (default: runc or crun)",
+		},
+		rootlessFlag("enable rootless unpacking support"),
+		cli.BoolFlag{
+			Name:  "repack",
+			Usage: "repack the temporary bundle into the image if the container exits successfully",
+		},
+	},
+
+	Action: run,
+
+	Before: func(ctx *cli.Context) error {
+		_, hasImage := ctx.App.Metadata["--image-path"]
+		if hasImage == ctx.IsSet("bundle") {
+			return errors.Errorf("exactly one of --image and --bundle must be specified")
+		}
+		if ctx.IsSet("bundle") && ctx.String("bundle") == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		if ctx.Bool("repack") && !hasImage {
+			return errors.Errorf("--repack can only be used with --image")
+		}
+		if _, ok := ctx.App.Metadata["--tag"]; ok && !ctx.Bool("repack") {
+			return errors.Errorf("--tag can only be used with --repack")
+		}
+		ctx.App.Metadata["args"] = []string(ctx.Args())
+		return nil
+	},
+}))
+
+// runSubcommand runs another umoci subcommand in-process with the given
+// arguments (and the same global options), with its own metadata.
+func runSubcommand(ctx *cli.Context, args ...string) error {
+	metadata := ctx.App.Metadata
+	ctx.App.Metadata = map[string]interface{}{}
+	defer func() {
+		ctx.App.Metadata = metadata
+	}()
+
+	fullArgs := []string{ctx.App.Name, "--log", ctx.GlobalString("log")}
+	if ctx.GlobalIsSet("workers") {
+		fullArgs = append(fullArgs, "--workers", strconv.Itoa(ctx.GlobalInt("workers")))
+	}
+	return ctx.App.Run(append(fullArgs, args...))
+}
+
+// findRuntime returns the path of the OCI runtime to use.
+func findRuntime(runtime string) (string, error) {
+	if runtime != "" {
+		path, err := exec.LookPath(runtime)
+		return path, errors.Wrap(err, "find runtime")
+	}
+	for _, runtime := range defaultRuntimes {
+		if path, err := exec.LookPath(runtime); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.Errorf("no OCI runtime found (tried %v), use --runtime", defaultRuntimes)
+}
+
+// prepareRunConfig modifies the config.json of the given bundle so that the
+// process runs the given command (if any), and only uses a terminal if the
+// standard input is a terminal. It returns a function which restores the
+// original config.json.
+func prepareRunConfig(bundle string, args []string) (func() error, error) {
+	configPath := filepath.Join(bundle, "config.json")
+	original, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config.json")
+	}
+	var config rspec.Spec
+	if err := json.Unmarshal(original, &config); err != nil {
+		return nil, errors.Wrap(err, "parse config.json")
+	}
+	if config.Process == nil {
+		return nil, errors.Errorf("config.json has no process")
+	}
+
+	if len(args) > 0 {
+		config.Process.Args = args
+	}
+	config.Process.Terminal = terminal.IsTerminal(int(os.Stdin.Fd()))
+
+	modified, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal config.json")
+	}
+	if err := ioutil.WriteFile(configPath, modified, 0644); err != nil {
+		return nil, errors.Wrap(err, "write config.json")
+	}
+	return func() error {
+		return errors.Wrap(ioutil.WriteFile(configPath, original, 0644), "restore config.json")
+	}, nil
+}
+
+// runBundle runs the container described by the given bundle using the given
+// OCI runtime, connected to the standard input, output and error of umoci.
+func runBundle(runtime, bundle string, args []string) error {
+	restore, err := prepareRunConfig(bundle, args)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := restore(); err != nil {
+			log.Warnf("%v", err)
+		}
+	}()
+
+	containerID := fmt.Sprintf("umoci-run-%d", os.Getpid())
+	cmd := exec.Command(runtime, "run", "--bundle", bundle, containerID)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The runtime forwards signals to the container, so we must not be killed
+	// by them before the container has exited (and the bundle has been
+	// cleaned up).
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	defer signal.Stop(sigs)
+
+	log.Infof("running %s in %s with %s", containerID, bundle, runtime)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "start runtime")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	for {
+		select {
+		case sig := <-sigs:
+			_ = cmd.Process.Signal(sig)
+		case err := <-done:
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return errors.Errorf("container exited with %s", exitErr.ProcessState)
+			}
+			return errors.Wrap(err, "run runtime")
+		}
+	}
+}
+
+func run(ctx *cli.Context) error {
+	args := ctx.App.Metadata["args"].([]string)
+
+	runtime, err := findRuntime(ctx.String("runtime"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.IsSet("bundle") {
+		return runBundle(runtime, ctx.String("bundle"), args)
+	}
+
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	var repackTag string
+	if ctx.Bool("repack") {
+		repackTag = fromName
+		if val, ok := ctx.App.Metadata["--tag"]; ok {
+			repackTag = val.(string)
+		}
+	}
+
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	// The resolved mode is always passed, so that --rootless=auto is only
+	// detected once.
+	unpackArgs := []string{"--rootless=" + strconv.FormatBool(rootless)}
+	return runImage(ctx, runtime, imagePath, fromName, unpackArgs, args, repackTag)
+}
+
+// runImage unpacks the given tagged image into a temporary bundle (passing
+// the extra unpackArgs to umoci-unpack(1)) and runs the given command in it
+// with runBundle. If repackTag is not empty and the container exits
+// successfully, the bundle is repacked into repackTag. The temporary bundle is
+// always removed.
+func runImage(ctx *cli.Context, runtime, imagePath, fromName string, unpackArgs, args []string, repackTag string) error {
+	return withTempBundle(ctx, imagePath, fromName, unpackArgs, func(bundle string) error {
+		if err := runBundle(runtime, bundle, args); err != nil {
+			return err
+		}
+
+		if repackTag != "" {
+			if err := runSubcommand(ctx, "repack", "--image", imagePath+":"+repackTag, bundle); err != nil {
+				return errors.Wrap(err, "repack bundle")
+			}
+			log.Infof("repacked container into %s", repackTag)
+		}
+		return nil
+	})
+}
+
+// withTempBundle unpacks the given tagged image into a temporary bundle
+// (passing the extra unpackArgs to umoci-unpack(1)) and calls fn with the
+// path of the bundle. The temporary bundle is always removed.
+func withTempBundle(ctx *cli.Context, imagePath, fromName string, unpackArgs []string, fn func(bundle string) error) error {
+	tempDir, err := ioutil.TempDir("", "umoci-run-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary bundle")
+	}
+	bundle := filepath.Join(tempDir, "bundle")
+
+	// The rootfs may contain files we cannot remove with os.RemoveAll in
+	// rootless mode.
+	defer func() {
+		fsEval := fseval.DefaultFsEval
+		if meta, err := ReadBundleMeta(bundle); err == nil && meta.MapOptions.Rootless {
+			fsEval = fseval.RootlessFsEval
+		}
+		if err := fsEval.RemoveAll(tempDir); err != nil {
+			log.Warnf("remove temporary bundle: %v", err)
+		}
+	}()
+
+	unpackArgs = append([]string{"unpack", "--image", imagePath + ":" + fromName}, unpackArgs...)
+	if err := runSubcommand(ctx, append(unpackArgs, bundle)...); err != nil {
+		return errors.Wrap(err, "unpack image")
+	}
+	return fn(bundle)
+}
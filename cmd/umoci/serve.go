@@ -0,0 +1,155 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+var serveCommand = cli.Command{
+	Name:  "serve",
+	Usage: "serves an image layout over the OCI distribution API",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The image layout is served as a registry (using the OCI distribution API, also
+known as the Docker registry HTTP API V2), so that its tags can be pulled by
+any registry client. Every tag of the layout is a tag of the served repository.
+By default the layout is served read-only as every repository name, use
+--repository to only serve it as a single repository. If --read-write is
+given, clients can also push images (and delete tags) to the layout. The
+server runs until it is interrupted.`,
+
+	// serve reads (and possibly modifies) an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "address to listen on",
+			Value: "localhost:5000",
+		},
+		cli.StringFlag{
+			Name:  "repository",
+			Usage: "name of the repository to serve the layout as (defaults to every repository)",
+		},
+		cli.BoolFlag{
+			Name:  "read-write",
+			Usage: "allow clients to push images and delete tags",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "path of the TLS certificate to serve HTTPS with (requires --tls-key)",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "path of the TLS private key to serve HTTPS with (requires --tls-cert)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.String("listen") == "" {
+			return errors.Errorf("--listen cannot be empty")
+		}
+		if (ctx.String("tls-cert") == "") != (ctx.String("tls-key") == "") {
+			return errors.Errorf("--tls-cert and --tls-key must be specified together")
+		}
+		return nil
+	},
+
+	Action: serve,
+}
+
+func serve(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+
+	server := remote.NewServer(engine, remote.ServerOptions{
+		Repository: ctx.String("repository"),
+		ReadWrite:  ctx.Bool("read-write"),
+	})
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", ctx.String("listen"))
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	httpServer := &http.Server{Handler: server}
+
+	scheme := "http"
+	tlsCert, tlsKey := ctx.String("tls-cert"), ctx.String("tls-key")
+	if tlsCert != "" {
+		scheme = "https"
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if tlsCert != "" {
+			done <- httpServer.ServeTLS(listener, tlsCert, tlsKey)
+		} else {
+			done <- httpServer.Serve(listener)
+		}
+	}()
+
+	mode := "read-only"
+	if ctx.Bool("read-write") {
+		mode = "read-write"
+	}
+	log.Infof("serving %s (%s) on %s://%s", imagePath, mode, scheme, listener.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-done:
+		return errors.Wrap(err, "serve")
+	case sig := <-sigs:
+		log.Infof("received %s, stopping server", sig)
+	}
+
+	// Let any in-flight requests finish before we close the CAS.
+	if err := httpServer.Shutdown(context.Background()); err != nil {
+		return errors.Wrap(err, "shutdown server")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var shellCommand = cli.Command{
+	Name:  "shell",
+	Usage: "runs an interactive shell in a temporary container of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--commit <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to run a shell in (if not specified, defaults to "latest").
+
+The image is unpacked in rootless mode (so the container runs in a user
+namespace, with root in the container mapped to the current user) into a
+temporary bundle, re-using snapshots from the layer cache given by
+--layer-cache. --shell (by default /bin/sh) is then run in the container using
+an OCI runtime, as with umoci-run(1). The bundle is removed once the shell
+exits.
+
+If --commit is given, the changes made in the container are saved as
+"<new-tag>" (as with umoci-repack(1)) if the shell exits successfully.`,
+
+	// shell reads manifest information.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "commit",
+			Usage: "save the changes made in the container as the given tag when the shell exits",
+		},
+		cli.StringFlag{
+			Name:  "shell",
+			Usage: "path of the shell to run in the container",
+			Value: "/bin/sh",
+		},
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "OCI runtime used to run the container (default: runc or crun)",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "re-use (and store) snapshots of extracted layers in the given directory (default: ~/.cache/umoci/layer-cache)",
+		},
+		cli.BoolFlag{
+			Name:  "no-layer-cache",
+			Usage: "do not use a layer cache",
+		},
+	},
+
+	Action: shell,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.IsSet("commit") {
+			tag := ctx.String("commit")
+			if !refRegexp.MatchString(tag) {
+				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --commit")
+			}
+			if tag == "" {
+				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --commit")
+			}
+		}
+		if ctx.String("shell") == "" {
+			return errors.Errorf("--shell cannot be empty")
+		}
+		if ctx.IsSet("layer-cache") && ctx.Bool("no-layer-cache") {
+			return errors.Errorf("--layer-cache and --no-layer-cache are mutually exclusive")
+		}
+		return nil
+	},
+}
+
+func shell(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	runtime, err := findRuntime(ctx.String("runtime"))
+	if err != nil {
+		return err
+	}
+
+	// Rootless unpacks generate a configuration with a user namespace, even
+	// when run as root.
+	unpackArgs := []string{"--rootless"}
+	if !ctx.Bool("no-layer-cache") {
+		layerCache := ctx.String("layer-cache")
+		if layerCache == "" {
+			layerCache, err = userCacheDir("layer-cache")
+			if err != nil {
+				return err
+			}
+		}
+		unpackArgs = append(unpackArgs, "--layer-cache", layerCache)
+	}
+
+	return runImage(ctx, runtime, imagePath, fromName, unpackArgs, []string{ctx.String("shell")}, ctx.String("commit"))
+}
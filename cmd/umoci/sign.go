@@ -0,0 +1,252 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/signature"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var signCommand = cli.Command{
+	Name:  "sign",
+	Usage: "signs a tagged image",
+	ArgsUsage: `--image <image-path>[:<tag>] --key <private-key>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to sign (if not specified, defaults to "latest") and
+"<private-key>" is the path of the PEM-encoded (unencrypted) private key to sign
+the image with.
+
+The signature is compatible with cosign, and is stored in the image as a
+referrer of the signed manifest (or in a sidecar file, if --signature-file is
+given).`,
+
+	// sign modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "path of the private key to sign the image with",
+		},
+		cli.StringFlag{
+			Name:  "reference",
+			Usage: "name the image is published as, which is included in the signature (defaults to the tag)",
+		},
+		cli.StringFlag{
+			Name:  "signature-file",
+			Usage: "write the signature to a sidecar file rather than storing it in the image",
+		},
+	},
+
+	Action: sign,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("key") == "" {
+			return errors.Errorf("missing mandatory argument: --key")
+		}
+		return nil
+	},
+}
+
+func sign(ctx *cli.Context) (Err error) {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	keyData, err := ioutil.ReadFile(ctx.String("key"))
+	if err != nil {
+		return errors.Wrap(err, "read --key")
+	}
+	signer, err := signature.LoadPrivateKey(keyData)
+	if err != nil {
+		return errors.Wrap(err, "invalid --key")
+	}
+	reference := tagName
+	if ctx.IsSet("reference") {
+		reference = ctx.String("reference")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	root, err := tagRoot(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+
+	sig, err := signature.Sign(signer, reference, root.Digest)
+	if err != nil {
+		return errors.Wrap(err, "sign image")
+	}
+
+	if sidecarPath := ctx.String("signature-file"); sidecarPath != "" {
+		sidecarFile, err := os.Create(sidecarPath)
+		if err != nil {
+			return errors.Wrap(err, "create signature file")
+		}
+		defer sidecarFile.Close()
+		// Don't leave a partial signature behind.
+		defer func() {
+			if Err != nil {
+				_ = os.Remove(sidecarPath)
+			}
+		}()
+		if err := signature.WriteSidecar(sidecarFile, *sig); err != nil {
+			return err
+		}
+		log.Infof("signed %s: wrote signature to %s", root.Digest, sidecarPath)
+		return nil
+	}
+
+	descriptor, err := signature.Attach(context.Background(), engine, *root, *sig)
+	if err != nil {
+		return errors.Wrap(err, "attach signature")
+	}
+	log.Infof("signed %s: stored signature as %s", root.Digest, descriptor.Digest)
+	return nil
+}
+
+// verifyImageSignature verifies that the image with the given (tag root)
+// descriptor has a signature trusted by the signature.Verifier set up by
+// uxSignature, using the signature in the --signature-file sidecar (if one
+// was given) or the signatures stored in the image. It returns nil without
+// doing anything if no verifier was set up.
+func verifyImageSignature(ctx *cli.Context, engine cas.Engine, descriptor ispec.Descriptor) error {
+	val, ok := ctx.App.Metadata["--signature-verifier"]
+	if !ok {
+		return nil
+	}
+	verifier := val.(signature.Verifier)
+
+	var sigs []signature.Signature
+	if sidecarPath, ok := ctx.App.Metadata["--signature-file"]; ok {
+		sidecarFile, err := os.Open(sidecarPath.(string))
+		if err != nil {
+			return errors.Wrap(err, "open signature file")
+		}
+		defer sidecarFile.Close()
+		sig, err := signature.ReadSidecar(sidecarFile)
+		if err != nil {
+			return errors.Wrap(err, "read signature file")
+		}
+		sigs = append(sigs, *sig)
+	} else {
+		var err error
+		sigs, err = signature.Find(context.Background(), engine, descriptor.Digest)
+		if err != nil {
+			return errors.Wrap(err, "find signatures")
+		}
+	}
+
+	sig, err := signature.VerifyManifest(sigs, descriptor.Digest, verifier)
+	if err != nil {
+		return errors.Wrap(err, "verify signature")
+	}
+	payload, err := sig.ParsePayload()
+	if err != nil {
+		// Should _never_ be reached.
+		return errors.Wrap(err, "[internal error] parse verified payload")
+	}
+	log.WithFields(log.Fields{
+		"digest":    descriptor.Digest,
+		"reference": payload.Critical.Identity.DockerReference,
+	}).Infof("verified image signature")
+	return nil
+}
+
+var verifySignatureCommand = uxSignature(cli.Command{
+	Name:  "verify-signature",
+	Usage: "verifies the signature of a tagged image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--key <public-key> | --certificate-identity <identity> --certificate-oidc-issuer <issuer> --ca-roots <roots>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to verify (if not specified, defaults to "latest") and
+"<public-key>" is the path of the PEM-encoded public key the image must be
+signed with.
+
+Keyless signatures are verified with --certificate-identity instead, in which
+case the signing certificate must have been issued for "<identity>" (as
+authenticated by the OIDC provider "<issuer>") by one of the certificate
+authorities in "<roots>". Transparency logs are not checked.
+
+The command fails unless at least one valid signature is found.`,
+
+	// verify-signature reads manifest information.
+	Category: "image",
+
+	Action: verifySignature,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--signature-verifier"]; !ok {
+			return errors.Errorf("missing mandatory argument: --key or --certificate-identity")
+		}
+		return nil
+	},
+})
+
+func verifySignature(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	root, err := tagRoot(engineExt, tagName)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+
+	if err := verifyImageSignature(ctx, engine, *root); err != nil {
+		return err
+	}
+	fmt.Printf("%s: signature verified\n", root.Digest)
+	return nil
+}
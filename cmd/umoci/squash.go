@@ -0,0 +1,232 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var squashCommand = uxCreated(uxHistory(uxTag(cli.Command{
+	Name:  "squash",
+	Usage: "squashes a range of layers of an image into a single layer",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--first <n>] [--last <m>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image whose layers will be squashed (if not specified, defaults to
+"latest"). "<new-tag>" is the new reference name to save the new image as, if
+this is not specified then umoci will replace the old image.
+
+The layers --first through --last (inclusive, counting from zero at the base
+of the image) are replaced by a single layer which has the same effect on the
+root filesystem. Negative indices count from the top of the image, so
+"--first=-5" squashes the top five layers. By default all layers are squashed.
+Layers outside of the range (such as a shared base image) are left untouched,
+and the diff_ids and history of the image are updated to match.
+
+Whiteouts within the range are applied, and whiteouts which affect the layers
+below the range are kept in the squashed layer. No layers are extracted to
+disk.`,
+
+	// squash modifies a particular image manifest.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "first",
+			Usage: "index of the first layer to squash (negative indices count from the top)",
+			Value: 0,
+		},
+		cli.IntFlag{
+			Name:  "last",
+			Usage: "index of the last layer to squash (negative indices count from the top)",
+			Value: -1,
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-filter",
+			Usage: "rule for which xattrs are included in the squashed layer ([+-]<pattern>)",
+		},
+		cli.BoolFlag{
+			Name:  "no-posix-acls",
+			Usage: "do not include POSIX ACLs in the squashed layer",
+		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "only warn if a layer does not match its diff_id in the image configuration",
+		},
+		cli.StringFlag{
+			Name:  "layer-format",
+			Usage: "format of the squashed layer (gzip, estargz, zstd)",
+			Value: "gzip",
+		},
+	},
+
+	Action: squash,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+})))
+
+// layerIndex converts the given layer index argument (such as --first, which
+// may be negative to count from the top of the image) to a layer index.
+func layerIndex(name string, value, numLayers int) (int, error) {
+	idx := value
+	if idx < 0 {
+		idx += numLayers
+	}
+	if idx < 0 || idx >= numLayers {
+		return 0, errors.Errorf("invalid %s %d: image has %d layers", name, value, numLayers)
+	}
+	return idx, nil
+}
+
+func squash(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	xattrFilter, err := parseXattrFilter(ctx.StringSlice("xattr-filter"), ctx.Bool("no-posix-acls"))
+	if err != nil {
+		return err
+	}
+	compressor, err := layerCompressor(ctx.String("layer-format"))
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+
+	first, err := layerIndex("--first", ctx.Int("first"), len(manifest.Layers))
+	if err != nil {
+		return err
+	}
+	last, err := layerIndex("--last", ctx.Int("last"), len(manifest.Layers))
+	if err != nil {
+		return err
+	}
+	if first > last {
+		return errors.Errorf("--first (layer %d) must not be above --last (layer %d)", first, last)
+	}
+
+	// The contents of a non-distributable layer must not end up in a
+	// distributable layer.
+	var nonDistributable bool
+	for _, layerDescriptor := range manifest.Layers[first : last+1] {
+		if strings.HasPrefix(layerDescriptor.MediaType, ispec.MediaTypeImageLayerNonDistributable) {
+			nonDistributable = true
+		}
+	}
+
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get image metadata")
+	}
+	created, err := creationTime()
+	if err != nil {
+		return err
+	}
+	history, err := historyEntry(ctx, ispec.History{
+		Author:     imageMeta.Author,
+		Created:    &created,
+		CreatedBy:  "umoci squash",
+		EmptyLayer: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("squashing layers %d..%d of %s", first, last, fromName)
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		err := layer.SquashLayers(context.Background(), engineExt, pipeWriter, manifest, first, last, &layer.FlattenOptions{
+			XattrFilter: xattrFilter,
+			NoVerify:    ctx.Bool("no-verify"),
+		})
+		pipeWriter.CloseWithError(err)
+	}()
+
+	if err := mutator.ReplaceLayers(context.Background(), first, last, pipeReader, history, &mutate.AddOptions{
+		Compressor:       compressor,
+		NonDistributable: nonDistributable,
+	}); err != nil {
+		return errors.Wrap(err, "replace squashed layers")
+	}
+
+	if err := applyCreation(ctx, mutator); err != nil {
+		return err
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.Infof("created new tag for image manifest: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
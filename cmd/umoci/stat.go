@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"text/template"
 
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
@@ -30,17 +31,24 @@ import (
 	"golang.org/x/net/context"
 )
 
-var statCommand = cli.Command{
+var statCommand = uxFormat(cli.Command{
 	Name:  "stat",
 	Usage: "displays status information of an image manifest",
 	ArgsUsage: `--image <image-path>[:<tag>]
 
 Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
-the tagged image to stat.
+the tagged image to stat. If "<image-path>" is "-", the image is read from a
+docker-archive or oci-archive on stdin (see umoci-import(1)), and "<tag>"
+selects the image if the archive contains several images.
 
-WARNING: Do not depend on the output of this tool unless you're using --json.
-The intention of the default formatting of this tool is that it is easy for
-humans to read, and might change in future versions.`,
+If --format is specified, the stat information is formatted using the given Go
+template (see text/template) rather than the default formatting. The fields are
+the same as with --json, using the names of the Go structures (such as
+"{{range .History}}{{.CreatedBy}}{{end}}").
+
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it
+is easy for humans to read, and might change in future versions.`,
 
 	// stat gives information about a manifest.
 	Category: "image",
@@ -53,9 +61,15 @@ humans to read, and might change in future versions.`,
 	},
 
 	Action: stat,
-}
+})
 
 func stat(ctx *cli.Context) error {
+	cleanup, err := stageStdinImage(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
@@ -89,7 +103,11 @@ func stat(ctx *cli.Context) error {
 	}
 
 	// Output the stat information.
-	if ctx.Bool("json") {
+	if tmpl, ok := ctx.App.Metadata["--format"].(*template.Template); ok {
+		if err := executeTemplate(os.Stdout, tmpl, ms); err != nil {
+			return err
+		}
+	} else if jsonOutput(ctx) {
 		// Use JSON.
 		if err := json.NewEncoder(os.Stdout).Encode(ms); err != nil {
 			return errors.Wrap(err, "encoding stat")
@@ -18,11 +18,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
@@ -86,7 +99,7 @@ func tagAdd(ctx *cli.Context) error {
 	}
 
 	log.Infof("created new tag: %q -> %q", tagName, fromName)
-	return nil
+	return outputTagResult(ctx, engineExt, tagName)
 }
 
 var tagRemoveCommand = cli.Command{
@@ -123,24 +136,362 @@ func tagRemove(ctx *cli.Context) error {
 	}
 
 	log.Infof("removed tag: %s", tagName)
+	return outputTagResult(ctx, engineExt, tagName)
+}
+
+var tagRenameCommand = cli.Command{
+	Name:    "rename",
+	Aliases: []string{"rename-tags"},
+	Usage:   "renames every tag in an OCI image matching a pattern",
+	ArgsUsage: `--layout <image-path> <pattern> <replacement>
+
+Where "<image-path>" is the path to the OCI image, "<pattern>" is a shell glob
+(or a regular expression with --regex) which must match the whole name of a
+tag for it to be renamed, and "<replacement>" is the new name of each matching
+tag.
+
+In "<replacement>", "{}" is replaced with the old name of the tag and "{n}" is
+replaced with the text matched by the n-th wildcard of the glob (or the n-th
+group of the regular expression). For example, "umoci rename --layout image
+'v1.2.*' 'release-1.2.{1}'" renames "v1.2.3" to "release-1.2.3". All of the
+tags are renamed at once, so the image is not modified if any of them cannot
+be renamed (such as when the new name is already used by another tag).`,
+
+	// tag modifies an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "regex",
+			Usage: "interpret <pattern> as a regular expression rather than a glob",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the tags which would be renamed without modifying the image",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <pattern> <replacement>")
+		}
+		var (
+			pattern *regexp.Regexp
+			err     error
+		)
+		if ctx.Bool("regex") {
+			pattern, err = regexp.Compile("^(?:" + ctx.Args().Get(0) + ")$")
+		} else {
+			pattern, err = globRegexp(ctx.Args().Get(0))
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid <pattern>")
+		}
+		ctx.App.Metadata["pattern"] = pattern
+		ctx.App.Metadata["replacement"] = ctx.Args().Get(1)
+		return nil
+	},
+
+	Action: tagRename,
+}
+
+// globRegexp converts a shell glob (as used by path.Match) into an anchored
+// regular expression, with each wildcard ("*", "?" or a character class) as a
+// capturing group.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			expr += "(.*)"
+		case '?':
+			expr += "(.)"
+		case '[':
+			end := i + 1
+			if end < len(glob) && (glob[end] == '!' || glob[end] == '^') {
+				end++
+			}
+			if end < len(glob) && glob[end] == ']' {
+				end++
+			}
+			for end < len(glob) && glob[end] != ']' {
+				end++
+			}
+			if end >= len(glob) {
+				return nil, errors.Errorf("unterminated character class in %q", glob)
+			}
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "([" + class + "])"
+			i = end
+		case '\\':
+			if i+1 >= len(glob) {
+				return nil, errors.Errorf("trailing escape in %q", glob)
+			}
+			i++
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		default:
+			expr += regexp.QuoteMeta(string(ch))
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+// expandReplacement expands "{}" and "{n}" in replacement using the given
+// submatches of a tag name (as returned by regexp.FindStringSubmatch).
+func expandReplacement(replacement string, submatches []string) (string, error) {
+	var expanded string
+	for {
+		start := strings.Index(replacement, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(replacement[start:], "}")
+		if end < 0 {
+			return "", errors.Errorf("unterminated \"{\" in replacement %q", replacement)
+		}
+		end += start
+
+		group := 0
+		if key := replacement[start+1 : end]; key != "" {
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 1 || n >= len(submatches) {
+				return "", errors.Errorf("invalid group {%s} in replacement %q", key, replacement)
+			}
+			group = n
+		}
+		expanded += replacement[:start] + submatches[group]
+		replacement = replacement[end+1:]
+	}
+	return expanded + replacement, nil
+}
+
+// tagRenameResult is the result of umoci-rename(1), which is output if the
+// global --json flag is set.
+type tagRenameResult struct {
+	// Renamed are the tags which were renamed (or which would have been
+	// renamed with --dry-run), sorted by their old names.
+	Renamed []renamedTag `json:"renamed"`
+
+	// DryRun is whether --dry-run was set, in which case the image was not
+	// modified.
+	DryRun bool `json:"dry_run"`
+}
+
+// renamedTag is a single tag renamed by umoci-rename(1).
+type renamedTag struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func tagRename(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	pattern := ctx.App.Metadata["pattern"].(*regexp.Regexp)
+	replacement := ctx.App.Metadata["replacement"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	names, err := engineExt.ListReferences(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "list references")
+	}
+
+	renames := map[string]string{}
+	result := tagRenameResult{
+		Renamed: []renamedTag{},
+		DryRun:  ctx.Bool("dry-run"),
+	}
+	for _, name := range names {
+		submatches := pattern.FindStringSubmatch(name)
+		if submatches == nil {
+			continue
+		}
+		newName, err := expandReplacement(replacement, submatches)
+		if err != nil {
+			return err
+		}
+		if newName == name {
+			continue
+		}
+		if newName == "" || !refRegexp.MatchString(newName) {
+			return errors.Errorf("cannot rename tag %s: new tag %q is an invalid reference", name, newName)
+		}
+		if _, ok := renames[name]; !ok {
+			result.Renamed = append(result.Renamed, renamedTag{From: name, To: newName})
+		}
+		renames[name] = newName
+	}
+	sort.Slice(result.Renamed, func(i, j int) bool {
+		return result.Renamed[i].From < result.Renamed[j].From
+	})
+
+	if !result.DryRun {
+		if err := engineExt.RenameReferences(context.Background(), renames); err != nil {
+			return errors.Wrap(err, "rename references")
+		}
+		log.Infof("renamed %d tags", len(renames))
+	}
+
+	if ctx.GlobalBool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			return errors.Wrap(err, "encoding result")
+		}
+	} else if result.DryRun {
+		for _, rename := range result.Renamed {
+			fmt.Printf("%s -> %s\n", rename.From, rename.To)
+		}
+	}
 	return nil
 }
 
-var tagListCommand = cli.Command{
+var tagListCommand = uxFormat(cli.Command{
 	Name:    "list",
-	Aliases: []string{"ls"},
+	Aliases: []string{"list-tags"},
 	Usage:   "lists the set of tags in an OCI image",
 	ArgsUsage: `--layout <image-path>
 
 Where "<image-path>" is the path to the OCI image.
 
 Gives the full list of tags in an OCI image, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. See umoci-stat(1) to get more information about each tagged image.
+
+With --long, the digest, total compressed size, platforms and creation time
+of each tagged image is also listed. If --format is specified, each tag is
+instead formatted using the given Go template (see text/template), with the
+same fields as --json (such as "{{.Name}} {{.Digest}}").
+
+WARNING: Do not depend on the output of --long unless you're using --json or
+--format. The intention of the default formatting of this tool is that it is
+easy for humans to read, and might change in future versions.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "long, l",
+			Usage: "show the digest, size, platforms and creation time of each tag",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the tags and their information as a JSON encoded blob",
+		},
+	},
+
 	Action: tagList,
+})
+
+// tagInfo is the information about a tag output by umoci-list(1).
+type tagInfo struct {
+	// Name is the name of the tag.
+	Name string `json:"name"`
+
+	// Digest and MediaType are the digest and media type of the blob that the
+	// tag refers to (which may be an index rather than a manifest).
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+
+	// Size is the total compressed size of every distinct blob reachable from
+	// the tag, including the blob it refers to.
+	Size int64 `json:"size"`
+
+	// Platforms is the sorted set of platforms ("os/arch[/variant]") of the
+	// manifests the tag resolves to.
+	Platforms []string `json:"platforms"`
+
+	// Created is the latest creation time of the manifests the tag resolves
+	// to, if any of them specify one.
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// imagePlatform returns the platform of the given image configuration, in the
+// same format as formatPlatform.
+func imagePlatform(config ispec.Image) string {
+	// TODO: Image configurations don't store the variant.
+	return config.OS + "/" + config.Architecture
+}
+
+// getTagInfo computes the tagInfo for the given tag.
+func getTagInfo(ctx context.Context, engineExt casext.Engine, name string) (tagInfo, error) {
+	info := tagInfo{Name: name}
+
+	root, err := tagRoot(engineExt, name)
+	if err != nil {
+		return info, err
+	}
+	if root == nil {
+		return info, errors.Errorf("tag not found: %s", name)
+	}
+	info.Digest = root.Digest
+	info.MediaType = root.MediaType
+
+	// Sum the sizes of every distinct blob.
+	seen := map[digest.Digest]struct{}{}
+	if err := engineExt.Walk(ctx, *root, func(descriptorPath casext.DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		if _, ok := seen[descriptor.Digest]; !ok {
+			seen[descriptor.Digest] = struct{}{}
+			info.Size += descriptor.Size
+		}
+		return nil
+	}); err != nil {
+		return info, errors.Wrap(err, "walk image")
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		return info, errors.Wrap(err, "get descriptor")
+	}
+	platforms := map[string]struct{}{}
+	for _, descriptorPath := range descriptorPaths {
+		descriptor := descriptorPath.Descriptor()
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+		manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+		if err != nil {
+			return info, errors.Wrap(err, "get manifest")
+		}
+		manifest := manifestBlob.Data.(ispec.Manifest)
+		manifestBlob.Close()
+
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			return info, errors.Wrap(err, "get config")
+		}
+		configBlob.Close()
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok {
+			// Not an image (such as an artifact), so there's nothing to list.
+			continue
+		}
+
+		if descriptor.Platform != nil {
+			platforms[formatPlatform(descriptor)] = struct{}{}
+		} else {
+			platforms[imagePlatform(config)] = struct{}{}
+		}
+		if config.Created != nil && (info.Created == nil || config.Created.After(*info.Created)) {
+			info.Created = config.Created
+		}
+	}
+	info.Platforms = []string{}
+	for platform := range platforms {
+		info.Platforms = append(info.Platforms, platform)
+	}
+	sort.Strings(info.Platforms)
+	return info, nil
 }
 
 func tagList(ctx *cli.Context) error {
@@ -159,8 +510,49 @@ func tagList(ctx *cli.Context) error {
 		return errors.Wrap(err, "list references")
 	}
 
+	tmpl, hasFormat := ctx.App.Metadata["--format"].(*template.Template)
+	if !hasFormat && !ctx.Bool("long") && !jsonOutput(ctx) {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	infos := []tagInfo{}
 	for _, name := range names {
-		fmt.Println(name)
+		info, err := getTagInfo(context.Background(), engineExt, name)
+		if err != nil {
+			return errors.Wrapf(err, "get information about tag %s", name)
+		}
+		infos = append(infos, info)
+	}
+
+	switch {
+	case hasFormat:
+		for _, info := range infos {
+			if err := executeTemplate(os.Stdout, tmpl, info); err != nil {
+				return err
+			}
+		}
+	case jsonOutput(ctx):
+		if err := json.NewEncoder(os.Stdout).Encode(infos); err != nil {
+			return errors.Wrap(err, "encoding tags")
+		}
+	default:
+		tw := tabwriter.NewWriter(os.Stdout, 4, 2, 1, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tDIGEST\tSIZE\tPLATFORMS\tCREATED\n")
+		for _, info := range infos {
+			created := "<none>"
+			if info.Created != nil {
+				created = info.Created.Format(igen.ISO8601)
+			}
+			platforms := strings.Join(info.Platforms, ",")
+			if platforms == "" {
+				platforms = "<none>"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Name, info.Digest, units.HumanSize(float64(info.Size)), platforms, created)
+		}
+		tw.Flush()
 	}
 	return nil
 }
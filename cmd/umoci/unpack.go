@@ -21,14 +21,14 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"reflect"
 
 	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/fseval"
-	"github.com/openSUSE/umoci/pkg/idtools"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -36,18 +36,74 @@ import (
 	"golang.org/x/net/context"
 )
 
-var unpackCommand = cli.Command{
+var unpackCommand = uxSignature(cli.Command{
 	Name:  "unpack",
 	Usage: "unpacks a reference into an OCI runtime bundle",
 	ArgsUsage: `--image <image-path>[:<tag>] <bundle>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
-is the destination to unpack the image to.
+is the destination to unpack the image to. If "<image-path>" is "-", the image
+is read from a docker-archive or oci-archive on stdin (see umoci-import(1)),
+and "<tag>" selects the image if the archive contains several images.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
-creation with umoci-repack(1).`,
+creation with umoci-repack(1).
+
+If --overlay-layers is specified, each layer is extracted into its own
+directory inside "<bundle>/layers" (using overlayfs whiteout conventions) so
+that the directories can be used directly as overlayfs lowerdirs. Bundles
+unpacked this way cannot be used with umoci-repack(1).
+
+If --overlay-store is specified, layers are extracted into (or re-used from)
+the given layer store directory and "<bundle>/rootfs" is an overlayfs mount of
+those layers, with all changes written to "<bundle>/upper". This avoids
+re-extracting the base layers of an image on every unpack.
+
+Each --xattr-filter rule is of the form "[+-]<pattern>", where "<pattern>" is
+either an xattr name or a prefix ending in "*". The last rule matching an xattr
+decides whether it is restored ("+") or dropped ("-"), and xattrs matching no
+rule are restored. If no rules are given, "security.selinux" is dropped (use
+--xattr-filter=+security.selinux to restore it). The rules are saved in the
+bundle and re-used by umoci-repack(1).
+
+If --workers is greater than one, subsequent layers are decompressed and
+verified concurrently while earlier layers are being applied. With
+--overlay-layers or --overlay-store (where layers are independent) the layers
+are also extracted in parallel. Unlike most commands, --workers defaults to 1
+(rather than the number of CPUs) unless the global --workers is set, because
+layers which are processed ahead of time are staged uncompressed inside the
+bundle.
+
+If --layer-cache is specified, a snapshot of the rootfs after each layer has
+been applied is stored in the given directory (keyed by the ChainID of the
+layers), and the unpack starts from the most recent snapshot of the image's
+layers. Files are cloned from the cache using reflinks (falling back to
+copying) unless --layer-cache-mode=hardlink is given, in which case files in
+the rootfs must not be modified in-place. Least-recently used snapshots are
+removed once the cache is larger than --layer-cache-size.
+
+Each --mtree-keyword rule is of the form "[+-]<keyword>", and adds or removes
+the given mtree(8) keyword from the set of keywords recorded in the bundle's
+mtree manifest (which umoci-repack(1) uses to detect changes to the rootfs).
+For instance, "-tar_time" ignores changes which only modify timestamps. The
+default keywords are "size", "type", "uid", "gid", "mode", "link", "nlink",
+"tar_time", "sha256digest" and "xattr".
+
+The manifest is stored as "<bundle>/sha256_<digest>.mtree" in the textual
+mtree(8) format by default. With --manifest-format=binary it is instead stored
+as "<bundle>/sha256_<digest>.bmtree" in a compressed binary format, which is
+much faster to write and read for large images but cannot be used by other
+mtree(8) tools. Use umoci-raw-convert-manifest(1) to convert between the two.
+
+If --tar-split is specified, the raw tar headers of each layer (and the digests
+of the files in it) are stored in "<bundle>/tar-split", so that any layer whose
+files are unchanged can later be regenerated byte-for-byte (with the same
+diff_id) using umoci-raw-reassemble(1).
+
+If --key or --certificate-identity is specified, the image is only unpacked if
+it has a valid signature (see umoci-verify-signature(1)).`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -61,9 +117,89 @@ creation with umoci-repack(1).`,
 			Name:  "gid-map",
 			Usage: "specifies a gid mapping to use when repacking (container:host:size)",
 		},
+		rootlessFlag("enable rootless unpacking support"),
 		cli.BoolFlag{
-			Name:  "rootless",
-			Usage: "enable rootless unpacking support",
+			Name:  "overlay-layers",
+			Usage: "extract each layer into a separate overlayfs-compatible directory",
+		},
+		cli.StringFlag{
+			Name:  "overlay-store",
+			Usage: "re-use layers extracted in the given directory and mount the rootfs as an overlayfs",
+		},
+		cli.StringSliceFlag{
+			Name:  "xattr-filter",
+			Usage: "rule for which xattrs are restored when extracting layers ([+-]<pattern>)",
+		},
+		cli.BoolFlag{
+			Name:  "no-posix-acls",
+			Usage: "do not restore POSIX ACLs when extracting layers",
+		},
+		cli.BoolFlag{
+			Name:  "emulate-xattrs",
+			Usage: "store xattrs which cannot be set in rootless mode as user xattrs",
+		},
+		cli.BoolFlag{
+			Name:  "emulate-ownership",
+			Usage: "record the owner of each path in rootless mode in the user.rootlesscontainers xattr",
+		},
+		cli.StringFlag{
+			Name:  "device-policy",
+			Usage: "how to handle device nodes in rootless mode (placeholder, skip or error)",
+		},
+		cli.StringFlag{
+			Name:  "strictness",
+			Usage: "how to handle malformed layer entries (error, skip or correct)",
+		},
+		cli.StringFlag{
+			Name:  "dirlink-policy",
+			Usage: "how to handle directories replacing symlinks to directories (replace, follow or error)",
+		},
+		cli.BoolFlag{
+			Name:  "aufs-compat",
+			Usage: "normalise the whiteouts and metadata of layers generated with AUFS",
+		},
+		cli.StringFlag{
+			Name:  "extraction-report",
+			Usage: "write a JSON report of the malformed layer entries which were skipped or corrected to the given file",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue an interrupted unpack of the same image into the bundle",
+		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "only warn if a layer does not match its diff_id in the image configuration",
+		},
+		cli.BoolFlag{
+			Name:  "tar-split",
+			Usage: "store the metadata needed to regenerate each layer byte-for-byte from the bundle",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Usage: "maximum number of layers to decompress and extract concurrently (defaults to 1, or the global --workers if it is set)",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:  "layer-cache",
+			Usage: "re-use (and store) snapshots of extracted layers in the given directory",
+		},
+		cli.StringFlag{
+			Name:  "layer-cache-mode",
+			Usage: "how files are cloned from the layer cache (reflink, hardlink)",
+			Value: string(layer.LayerCacheReflink),
+		},
+		cli.StringFlag{
+			Name:  "layer-cache-size",
+			Usage: "maximum size of the layer cache (such as 10GB)",
+		},
+		cli.StringSliceFlag{
+			Name:  "mtree-keyword",
+			Usage: "add or remove a keyword recorded in the bundle's mtree manifest ([+-]<keyword>)",
+		},
+		cli.StringFlag{
+			Name:  "manifest-format",
+			Usage: "format of the bundle's manifest (mtree or binary)",
+			Value: string(ManifestMtree),
 		},
 	},
 
@@ -79,9 +215,15 @@ creation with umoci-repack(1).`,
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
 		return nil
 	},
-}
+})
 
 func unpack(ctx *cli.Context) error {
+	cleanup, err := stageStdinImage(ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
@@ -91,7 +233,11 @@ func unpack(ctx *cli.Context) error {
 
 	// Parse map options.
 	// We need to set mappings if we're in rootless mode.
-	meta.MapOptions.Rootless = ctx.Bool("rootless")
+	rootless, err := rootlessEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	meta.MapOptions.Rootless = rootless
 	if meta.MapOptions.Rootless {
 		if !ctx.IsSet("uid-map") {
 			ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid()))
@@ -101,26 +247,101 @@ func unpack(ctx *cli.Context) error {
 		}
 	}
 	// Parse and set up the mapping options.
-	for _, uidmap := range ctx.StringSlice("uid-map") {
-		idMap, err := idtools.ParseMapping(uidmap)
-		if err != nil {
-			return errors.Wrapf(err, "failure parsing --uid-map %s: %s", uidmap)
-		}
-		meta.MapOptions.UIDMappings = append(meta.MapOptions.UIDMappings, idMap)
+	uidMappings, err := parseIDMappings("uid-map", ctx.StringSlice("uid-map"))
+	if err != nil {
+		return err
 	}
-	for _, gidmap := range ctx.StringSlice("gid-map") {
-		idMap, err := idtools.ParseMapping(gidmap)
-		if err != nil {
-			return errors.Wrapf(err, "failure parsing --gid-map %s: %s", gidmap)
-		}
-		meta.MapOptions.GIDMappings = append(meta.MapOptions.GIDMappings, idMap)
+	meta.MapOptions.UIDMappings = uidMappings
+	gidMappings, err := parseIDMappings("gid-map", ctx.StringSlice("gid-map"))
+	if err != nil {
+		return err
 	}
+	meta.MapOptions.GIDMappings = gidMappings
 
 	log.WithFields(log.Fields{
 		"map.uid": meta.MapOptions.UIDMappings,
 		"map.gid": meta.MapOptions.GIDMappings,
 	}).Debugf("parsed mappings")
 
+	if ctx.Bool("overlay-layers") {
+		meta.OnDiskFormat = layer.OverlayfsLayers
+	}
+	if ctx.IsSet("overlay-store") {
+		if meta.OnDiskFormat != "" {
+			return errors.Errorf("--overlay-store and --overlay-layers are mutually exclusive")
+		}
+		meta.OnDiskFormat = layer.OverlayfsMount
+	}
+
+	meta.XattrFilter = ctx.StringSlice("xattr-filter")
+	meta.NoPosixACLs = ctx.Bool("no-posix-acls")
+	meta.EmulateXattrs = ctx.Bool("emulate-xattrs")
+	if meta.EmulateXattrs && !meta.MapOptions.Rootless {
+		return errors.Errorf("--emulate-xattrs can only be used with --rootless")
+	}
+	meta.EmulateOwnership = ctx.Bool("emulate-ownership")
+	if meta.EmulateOwnership && !meta.MapOptions.Rootless {
+		return errors.Errorf("--emulate-ownership can only be used with --rootless")
+	}
+	devicePolicy := layer.DevicePolicy(ctx.String("device-policy"))
+	if devicePolicy != "" && !meta.MapOptions.Rootless {
+		return errors.Errorf("--device-policy can only be used with --rootless")
+	}
+	xattrFilter, err := parseXattrFilter(meta.XattrFilter, meta.NoPosixACLs)
+	if err != nil {
+		return err
+	}
+
+	workers, err := numWorkers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctx.IsSet("mtree-keyword") {
+		keywords, err := parseMtreeKeywords(ctx.StringSlice("mtree-keyword"))
+		if err != nil {
+			return err
+		}
+		meta.MtreeKeywords = mtree.FromKeywords(keywords)
+	}
+
+	meta.ManifestFormat, err = parseManifestFormat(ctx.String("manifest-format"))
+	if err != nil {
+		return err
+	}
+
+	noVerify := ctx.Bool("no-verify")
+	if noVerify && (ctx.IsSet("overlay-store") || ctx.IsSet("layer-cache")) {
+		return errors.Errorf("--no-verify cannot be used with --overlay-store or --layer-cache")
+	}
+
+	meta.TarSplit = ctx.Bool("tar-split")
+	if meta.TarSplit && (ctx.IsSet("overlay-store") || ctx.IsSet("layer-cache")) {
+		return errors.Errorf("--tar-split cannot be used with --overlay-store or --layer-cache")
+	}
+
+	if ctx.Bool("resume") && (meta.OnDiskFormat != "" || ctx.IsSet("layer-cache")) {
+		return errors.Errorf("--resume cannot be used with --overlay-layers, --overlay-store or --layer-cache")
+	}
+
+	layerCache := ctx.String("layer-cache")
+	var layerCacheSize int64
+	if layerCache != "" {
+		if meta.OnDiskFormat != "" {
+			return errors.Errorf("--layer-cache cannot be used with --overlay-layers or --overlay-store")
+		}
+		meta.LayerCacheMode = layer.LayerCacheMode(ctx.String("layer-cache-mode"))
+		if meta.LayerCacheMode != layer.LayerCacheReflink && meta.LayerCacheMode != layer.LayerCacheHardlink {
+			return errors.Errorf("unknown --layer-cache-mode: %s", meta.LayerCacheMode)
+		}
+		if ctx.IsSet("layer-cache-size") {
+			layerCacheSize, err = units.RAMInBytes(ctx.String("layer-cache-size"))
+			if err != nil {
+				return errors.Wrap(err, "parse --layer-cache-size")
+			}
+		}
+	}
+
 	// Get a reference to the CAS.
 	engine, err := dir.Open(imagePath)
 	if err != nil {
@@ -139,6 +360,11 @@ func unpack(ctx *cli.Context) error {
 	}
 	meta.From = fromDescriptorPaths[0]
 
+	// Refuse to unpack an image without a trusted signature.
+	if err := verifyImageSignature(ctx, engine, meta.From.Root()); err != nil {
+		return err
+	}
+
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
 		return errors.Wrap(err, "get manifest")
@@ -149,8 +375,7 @@ func unpack(ctx *cli.Context) error {
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid --image tag")
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
-	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	mtreePath := meta.manifestPath(bundlePath)
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
@@ -167,6 +392,25 @@ func unpack(ctx *cli.Context) error {
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
 	}
 
+	// When resuming, the interrupted unpack must have been of the same image
+	// with the same options, and we continue from its last checkpoint.
+	devices := layer.NewDeviceRecord(nil)
+	var resume *layer.Checkpoint
+	if ctx.Bool("resume") {
+		oldMeta, err := ReadBundleMeta(bundlePath)
+		if err != nil {
+			return errors.Wrap(err, "resume unpack")
+		}
+		if oldMeta.Checkpoint == nil {
+			return errors.Errorf("resume unpack: bundle is not an interrupted unpack")
+		}
+		if err := checkResumeMeta(oldMeta, meta); err != nil {
+			return errors.Wrap(err, "resume unpack")
+		}
+		resume = oldMeta.Checkpoint
+		devices = layer.NewDeviceRecord(oldMeta.Devices)
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return errors.Wrap(err, "create bundle path")
@@ -177,13 +421,69 @@ func unpack(ctx *cli.Context) error {
 	//        should be fixed once the CAS engine PR is merged into
 	//        image-tools. https://github.com/opencontainers/image-tools/pull/5
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions); err != nil {
+	report := layer.NewExtractionReport()
+	unpackOptions := &layer.UnpackOptions{
+		MapOptions:    meta.MapOptions,
+		OnDiskFormat:  meta.OnDiskFormat,
+		LayerStore:    ctx.String("overlay-store"),
+		XattrFilter:   xattrFilter,
+		EmulateXattrs: meta.EmulateXattrs,
+		NoVerify:      noVerify,
+		TarSplit:      meta.TarSplit,
+		Workers:       workers,
+
+		EmulateOwnership: meta.EmulateOwnership,
+		DevicePolicy:     devicePolicy,
+		Devices:          devices,
+		Strictness:       layer.Strictness(ctx.String("strictness")),
+		Report:           report,
+		DirlinkPolicy:    layer.DirlinkPolicy(ctx.String("dirlink-policy")),
+		AUFSCompat:       ctx.Bool("aufs-compat"),
+
+		LayerCache:     layerCache,
+		LayerCacheMode: meta.LayerCacheMode,
+		LayerCacheSize: layerCacheSize,
+
+		Resume: resume,
+	}
+	// Record the progress of the unpack in umoci.json, so that it can be
+	// resumed if it is interrupted.
+	if meta.OnDiskFormat == "" && layerCache == "" {
+		unpackOptions.Checkpoint = func(checkpoint layer.Checkpoint) error {
+			checkpointMeta := meta
+			checkpointMeta.Checkpoint = &checkpoint
+			checkpointMeta.Devices = devices.Devices()
+			return errors.Wrap(WriteBundleMeta(bundlePath, checkpointMeta), "write umoci.json checkpoint")
+		}
+	}
+	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, unpackOptions); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
 
+	// Devices which couldn't be created are recorded so that umoci-repack(1)
+	// can restore them.
+	meta.Devices = devices.Devices()
+
+	if reportPath := ctx.String("extraction-report"); reportPath != "" {
+		if err := writeExtractionReport(reportPath, report.Issues()); err != nil {
+			return err
+		}
+	}
+
+	// There is no flattened rootfs to generate an mtree manifest from when
+	// each layer has been extracted separately.
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		if err := WriteBundleMeta(bundlePath, meta); err != nil {
+			return errors.Wrap(err, "write umoci.json metadata")
+		}
+		log.Infof("unpacked image layers: %s", filepath.Join(bundlePath, layer.LayersName))
+		return nil
+	}
+
+	keywords := meta.mtreeKeywords()
 	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
+		"keywords": keywords,
 		"mtree":    mtreePath,
 	}).Debugf("umoci: generating mtree manifest")
 
@@ -193,21 +493,15 @@ func unpack(ctx *cli.Context) error {
 	}
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := mtree.Walk(fullRootfsPath, nil, keywords, fsEval)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
 	}
 	log.Info("... done")
 
-	fh, err := os.OpenFile(mtreePath, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
-	}
-	defer fh.Close()
-
 	log.Debugf("umoci: saving mtree manifest")
 
-	if _, err := dh.WriteTo(fh); err != nil {
+	if err := writeBundleManifest(bundlePath, meta, dh); err != nil {
 		return errors.Wrap(err, "write mtree")
 	}
 
@@ -224,3 +518,30 @@ func unpack(ctx *cli.Context) error {
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// checkResumeMeta checks that the unpack described by meta is the same as the
+// interrupted unpack described by oldMeta (the same image unpacked with the
+// same options), so that it can be resumed.
+func checkResumeMeta(oldMeta, meta UmociMeta) error {
+	if oldDigest, digest := oldMeta.From.Descriptor().Digest, meta.From.Descriptor().Digest; oldDigest != digest {
+		return errors.Errorf("bundle was unpacked from a different image: %s (not %s)", oldDigest, digest)
+	}
+	// Only the options which affect the contents of the rootfs need to match.
+	for _, m := range []*UmociMeta{&oldMeta, &meta} {
+		m.From = casext.DescriptorPath{}
+		m.Devices = nil
+		m.Checkpoint = nil
+		m.ManifestFormat = ""
+		// Empty lists are omitted from umoci.json.
+		if len(m.XattrFilter) == 0 {
+			m.XattrFilter = nil
+		}
+		if len(m.MtreeKeywords) == 0 {
+			m.MtreeKeywords = nil
+		}
+	}
+	if !reflect.DeepEqual(oldMeta, meta) {
+		return errors.Errorf("bundle was unpacked with different options")
+	}
+	return nil
+}
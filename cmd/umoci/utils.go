@@ -18,21 +18,40 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"text/template"
+	"time"
 
+	"github.com/apex/log"
 	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/binmtree"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	"github.com/openSUSE/umoci/pkg/fswatch"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"github.com/urfave/cli"
 	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
@@ -43,9 +62,9 @@ import (
 //        code which repacks images (the changes to the config, manifest and
 //        CAS should be made into a library).
 
-// MtreeKeywords is the set of keywords used by umoci for verification and diff
-// generation of a bundle. This is based on mtree.DefaultKeywords, but is
-// hardcoded here to ensure that vendor changes don't mess things up.
+// MtreeKeywords is the default set of keywords used by umoci for verification
+// and diff generation of a bundle. This is based on mtree.DefaultKeywords, but
+// is hardcoded here to ensure that vendor changes don't mess things up.
 var MtreeKeywords = []mtree.Keyword{
 	"size",
 	"type",
@@ -63,6 +82,44 @@ var MtreeKeywords = []mtree.Keyword{
 // bundles extracted by umoci.
 const UmociMetaName = "umoci.json"
 
+// UmociIgnoreName is the name of the (optional) ignore file inside a bundle,
+// which lists patterns of paths that umoci-repack(1) should not include in new
+// layers (in the format accepted by mtreefilter.IgnoreFilter).
+const UmociIgnoreName = ".umociignore"
+
+// UmociWatchLogName is the name of the log of changes to a bundle's rootfs
+// recorded by umoci-watch(1), which can be used by umoci-repack(1).
+const UmociWatchLogName = "umoci-watch.log"
+
+// readWatchLog reads the log of changes recorded by umoci-watch(1) in the
+// given bundle.
+func readWatchLog(bundle string) (*fswatch.Log, error) {
+	fh, err := os.Open(filepath.Join(bundle, UmociWatchLogName))
+	if err != nil {
+		return nil, errors.Wrap(err, "open watch log")
+	}
+	defer fh.Close()
+	return fswatch.ReadLog(fh)
+}
+
+// readIgnorePatterns reads the ignore patterns from the bundle's ignore file.
+// If the bundle has no ignore file, no patterns are returned.
+func readIgnorePatterns(bundle string) ([]string, error) {
+	fh, err := os.Open(filepath.Join(bundle, UmociIgnoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open ignore file")
+	}
+	defer fh.Close()
+
+	patterns, err := mtreefilter.ParseIgnoreFile(fh)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", UmociIgnoreName)
+	}
+	return patterns, nil
+}
+
 // UmociMetaVersion is the version of UmociMeta supported by this code. The
 // value is only bumped for updates which are not backwards compatible.
 const UmociMetaVersion = "2"
@@ -86,6 +143,386 @@ type UmociMeta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// OnDiskFormat is the on-disk format used by umoci-unpack(1) to extract
+	// the image. If it is empty, the image was extracted as a single rootfs
+	// (layer.DirRootfs).
+	OnDiskFormat layer.OnDiskFormat `json:"on_disk_format,omitempty"`
+
+	// XattrFilter is the set of xattr filter rules (as passed to
+	// --xattr-filter) used by umoci-unpack(1). umoci-repack(1) uses the same
+	// rules unless overridden. If it is empty, the default rules are used.
+	XattrFilter []string `json:"xattr_filter,omitempty"`
+
+	// NoPosixACLs is whether POSIX ACLs were excluded by umoci-unpack(1)
+	// (with --no-posix-acls). umoci-repack(1) will also exclude them if set.
+	NoPosixACLs bool `json:"no_posix_acls,omitempty"`
+
+	// EmulateXattrs is whether umoci-unpack(1) emulated xattrs which could
+	// not be set in rootless mode (with --emulate-xattrs). umoci-repack(1)
+	// will restore the emulated xattrs if set.
+	EmulateXattrs bool `json:"emulate_xattrs,omitempty"`
+
+	// EmulateOwnership is whether umoci-unpack(1) recorded the owner of each
+	// path in the user.rootlesscontainers xattr (with --emulate-ownership).
+	// umoci-repack(1) will use the recorded owners if set.
+	EmulateOwnership bool `json:"emulate_ownership,omitempty"`
+
+	// Devices are the devices which umoci-unpack(1) could not create in
+	// rootless mode (see --device-policy). umoci-repack(1) converts any
+	// unmodified placeholders for these devices back into devices.
+	Devices []layer.Device `json:"devices,omitempty"`
+
+	// LayerCacheMode is how files were cloned from the layer cache by
+	// umoci-unpack(1) (with --layer-cache). If it is layer.LayerCacheHardlink,
+	// umoci-repack(1) ignores changes in the link count of files (which
+	// change whenever the cache is used).
+	LayerCacheMode layer.LayerCacheMode `json:"layer_cache_mode,omitempty"`
+
+	// TarSplit is whether umoci-unpack(1) stored the tar-split metadata of
+	// each layer in the bundle (with --tar-split), which is needed by
+	// umoci-raw-reassemble(1).
+	TarSplit bool `json:"tar_split,omitempty"`
+
+	// MtreeKeywords is the set of mtree keywords recorded by umoci-unpack(1)
+	// (as modified by --mtree-keyword), which umoci-repack(1) uses to
+	// compute the filesystem delta. If it is empty, MtreeKeywords is used.
+	MtreeKeywords []string `json:"mtree_keywords,omitempty"`
+
+	// ManifestFormat is the format of the bundle's manifest, as selected with
+	// --manifest-format (or changed by umoci-raw-convert-manifest(1)). If it
+	// is empty, the manifest is a textual mtree(8) manifest (ManifestMtree).
+	ManifestFormat ManifestFormat `json:"manifest_format,omitempty"`
+
+	// Checkpoint is the progress of an umoci-unpack(1) which has not yet
+	// completed. It is only set while the bundle is being unpacked, and is
+	// used by umoci-unpack(1) with --resume to continue an interrupted
+	// unpack.
+	Checkpoint *layer.Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// mtreeKeywords returns the set of mtree keywords used to record and compare
+// the bundle's rootfs.
+func (m UmociMeta) mtreeKeywords() []mtree.Keyword {
+	keywords := MtreeKeywords
+	if len(m.MtreeKeywords) > 0 {
+		keywords = mtree.ToKeywords(m.MtreeKeywords)
+	}
+
+	// Files hardlinked to the layer cache have their link count changed
+	// whenever the cache is used, which isn't a change to the rootfs.
+	if m.LayerCacheMode == layer.LayerCacheHardlink {
+		var filtered []mtree.Keyword
+		for _, keyword := range keywords {
+			if keyword != "nlink" {
+				filtered = append(filtered, keyword)
+			}
+		}
+		keywords = filtered
+	}
+	return keywords
+}
+
+// ManifestFormat is the format of the manifest used to detect changes to a
+// bundle's rootfs.
+type ManifestFormat string
+
+const (
+	// ManifestMtree is a textual mtree(8) manifest, which can be used with
+	// other mtree(8) tools (such as gomtree).
+	ManifestMtree ManifestFormat = "mtree"
+
+	// ManifestBinary is a binary manifest (see pkg/binmtree), which is much
+	// faster to write and read for large rootfs trees.
+	ManifestBinary ManifestFormat = "binary"
+)
+
+// manifestExtensions is the file extension used for each ManifestFormat.
+var manifestExtensions = map[ManifestFormat]string{
+	ManifestMtree:  ".mtree",
+	ManifestBinary: ".bmtree",
+}
+
+// parseManifestFormat parses the given --manifest-format value. The default
+// (ManifestMtree) is returned as "", so that it is omitted from umoci.json.
+func parseManifestFormat(value string) (ManifestFormat, error) {
+	format := ManifestFormat(value)
+	if _, ok := manifestExtensions[format]; !ok && format != "" {
+		return "", errors.Errorf("invalid manifest format %q: must be mtree or binary", value)
+	}
+	if format == ManifestMtree {
+		format = ""
+	}
+	return format, nil
+}
+
+// manifestPath returns the path of the bundle's manifest, which is named
+// after the digest of the image manifest the bundle was unpacked from.
+func (m UmociMeta) manifestPath(bundle string) string {
+	format := m.ManifestFormat
+	if format == "" {
+		format = ManifestMtree
+	}
+	name := strings.Replace(m.From.Descriptor().Digest.String(), "sha256:", "sha256_", 1)
+	return filepath.Join(bundle, name+manifestExtensions[format])
+}
+
+// writeBundleManifest writes the given manifest of the bundle's rootfs, in the
+// format given by meta.ManifestFormat. The manifest must not already exist.
+func writeBundleManifest(bundle string, meta UmociMeta, dh *mtree.DirectoryHierarchy) (Err error) {
+	fh, err := os.OpenFile(meta.manifestPath(bundle), os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open manifest")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close manifest")
+		}
+	}()
+
+	bufw := bufio.NewWriter(fh)
+	switch meta.ManifestFormat {
+	case ManifestBinary:
+		err = binmtree.Encode(bufw, dh)
+	default:
+		_, err = dh.WriteTo(bufw)
+	}
+	if err != nil {
+		return errors.Wrap(err, "write manifest")
+	}
+	return errors.Wrap(bufw.Flush(), "flush manifest")
+}
+
+// readBundleManifest reads the manifest of the bundle's rootfs written by
+// umoci-unpack(1).
+func readBundleManifest(bundle string, meta UmociMeta) (*mtree.DirectoryHierarchy, error) {
+	fh, err := os.Open(meta.manifestPath(bundle))
+	if err != nil {
+		return nil, errors.Wrap(err, "open manifest")
+	}
+	defer fh.Close()
+
+	var dh *mtree.DirectoryHierarchy
+	bufr := bufio.NewReader(fh)
+	switch meta.ManifestFormat {
+	case ManifestBinary:
+		dh, err = binmtree.Decode(bufr)
+	default:
+		dh, err = mtree.ParseSpec(bufr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parse manifest")
+	}
+	return dh, nil
+}
+
+// parseMtreeKeywords applies the given set of --mtree-keyword rules (of the
+// form "[+-]<keyword>") to MtreeKeywords, and returns the resulting set of
+// keywords. The "type" keyword cannot be removed, because it is necessary to
+// generate correct layers.
+func parseMtreeKeywords(rules []string) ([]mtree.Keyword, error) {
+	keywords := append([]mtree.Keyword{}, MtreeKeywords...)
+	for _, rule := range rules {
+		if len(rule) < 2 || (rule[0] != '+' && rule[0] != '-') {
+			return nil, errors.Errorf("invalid --mtree-keyword %q: must be of the form [+-]<keyword>", rule)
+		}
+		keyword := mtree.KeywordSynonym(rule[1:])
+		if _, ok := mtree.KeywordFuncs[keyword.Prefix()]; !ok {
+			return nil, errors.Errorf("invalid --mtree-keyword %q: unknown keyword %s", rule, keyword)
+		}
+
+		switch rule[0] {
+		case '+':
+			if !mtree.InKeywordSlice(keyword, keywords) {
+				keywords = append(keywords, keyword)
+			}
+		case '-':
+			if keyword == "type" {
+				return nil, errors.Errorf("invalid --mtree-keyword %q: the type keyword cannot be removed", rule)
+			}
+			var filtered []mtree.Keyword
+			for _, other := range keywords {
+				if other != keyword {
+					filtered = append(filtered, other)
+				}
+			}
+			keywords = filtered
+		}
+	}
+	return keywords, nil
+}
+
+// SourceDateEpochEnv is the name of the environment variable used to specify
+// a fixed timestamp for reproducible builds, as described in
+// <https://reproducible-builds.org/specs/source-date-epoch/>.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// sourceDateEpoch returns the timestamp specified by SOURCE_DATE_EPOCH, or nil
+// if it is not set.
+func sourceDateEpoch() (*time.Time, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", SourceDateEpochEnv)
+	}
+	epoch := time.Unix(seconds, 0).UTC()
+	return &epoch, nil
+}
+
+// creationTime returns the timestamp which should be used for newly created
+// objects (such as images and history entries). This is the timestamp
+// specified by SOURCE_DATE_EPOCH if it is set, otherwise the current time.
+func creationTime() (time.Time, error) {
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if epoch != nil {
+		return *epoch, nil
+	}
+	return time.Now(), nil
+}
+
+// historyEntry returns the history entry that should be added to an image by
+// the current command, by applying any --history.* flags (see uxHistory) to
+// the given default entry. If --no-history was given, nil is returned. The
+// values of --created and --author (see uxCreated) take precedence over the
+// default entry, but not over the --history.* flags.
+func historyEntry(ctx *cli.Context, history ispec.History) (*ispec.History, error) {
+	if _, ok := ctx.App.Metadata["--no-history"]; ok {
+		return nil, nil
+	}
+	if val, ok := ctx.App.Metadata["--created"]; ok {
+		created := val.(time.Time)
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.author"]; ok {
+		history.Author = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.comment"]; ok {
+		history.Comment = val.(string)
+	}
+	if val, ok := ctx.App.Metadata["--history.created"]; ok {
+		created, err := time.Parse(igen.ISO8601, val.(string))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--history.created_by"]; ok {
+		history.CreatedBy = val.(string)
+	}
+	return &history, nil
+}
+
+// applyCreation applies the --created, --author and --created-annotation
+// flags (see uxCreated) to the image being modified by the given mutator. It
+// should be called after all other modifications of the image, just before
+// the mutator is committed.
+func applyCreation(ctx *cli.Context, mutator *mutate.Mutator) error {
+	var opt mutate.CreationOptions
+	if val, ok := ctx.App.Metadata["--created"]; ok {
+		created := val.(time.Time)
+		opt.Created = &created
+	}
+	if val, ok := ctx.App.Metadata["--author"]; ok {
+		author := val.(string)
+		opt.Author = &author
+	}
+	_, opt.Annotate = ctx.App.Metadata["--created-annotation"]
+	if err := mutator.SetCreation(context.Background(), opt); err != nil {
+		return errors.Wrap(err, "set creation time")
+	}
+	return nil
+}
+
+// parseXattrFilter parses the given set of --xattr-filter rules. If noACLs is
+// set, rules dropping POSIX ACL xattrs are appended to the rules. If there are
+// no rules, nil is returned (meaning the default filter should be used).
+func parseXattrFilter(rules []string, noACLs bool) (*xattrfilter.Filter, error) {
+	if noACLs {
+		if len(rules) == 0 {
+			rules = xattrfilter.DefaultRules
+		}
+		rules = append([]string{}, rules...)
+		for _, name := range layer.PosixACLXattrs {
+			rules = append(rules, "-"+name)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	filter, err := xattrfilter.Parse(rules)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse --xattr-filter")
+	}
+	return &filter, nil
+}
+
+// userCacheDir returns the path of the given directory inside umoci's
+// directory in the user's cache directory (usually ~/.cache/umoci).
+func userCacheDir(name string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "get cache directory")
+	}
+	return filepath.Join(cacheDir, "umoci", name), nil
+}
+
+// parseIDMappings parses the values of the given --uid-map or --gid-map flag.
+// Each value may contain several comma-separated mappings, and the resulting
+// set of mappings must be valid for a user namespace.
+func parseIDMappings(flag string, specs []string) ([]rspec.LinuxIDMapping, error) {
+	var idMap []rspec.LinuxIDMapping
+	for _, spec := range specs {
+		mappings, err := idtools.ParseMappings(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failure parsing --%s %s", flag, spec)
+		}
+		idMap = append(idMap, mappings...)
+	}
+	if err := idtools.ValidateMappings(idMap); err != nil {
+		return nil, errors.Wrapf(err, "invalid --%s", flag)
+	}
+	return idMap, nil
+}
+
+// parseModeMask parses the value of --max-mode, which is an octal set of
+// permission bits. If the value is empty, nil is returned (meaning that
+// permission bits are not masked).
+func parseModeMask(value string) (*os.FileMode, error) {
+	if value == "" {
+		return nil, nil
+	}
+	mask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse --max-mode")
+	}
+	if os.FileMode(mask)&^os.ModePerm != 0 {
+		return nil, errors.Errorf("--max-mode can only contain permission bits: %s", value)
+	}
+	mode := os.FileMode(mask)
+	return &mode, nil
+}
+
+// layerCompressor returns the mutate.Compressor to use for the given
+// --layer-format.
+func layerCompressor(format string) (mutate.Compressor, error) {
+	switch format {
+	case "", "gzip":
+		return mutate.GzipCompressor, nil
+	case "estargz":
+		return estargz.Compressor{}, nil
+	case "zstd":
+		return mutate.ZstdCompressor, nil
+	}
+	return nil, errors.Errorf("unknown --layer-format: %s", format)
 }
 
 // WriteTo writes a JSON-serialised version of UmociMeta to the given io.Writer.
@@ -96,15 +533,48 @@ func (m UmociMeta) WriteTo(w io.Writer) (int64, error) {
 }
 
 // WriteBundleMeta writes an umoci.json file to the given bundle path.
-func WriteBundleMeta(bundle string, meta UmociMeta) error {
-	fh, err := os.Create(filepath.Join(bundle, UmociMetaName))
+// The file is replaced atomically, so that an interrupted umoci-unpack(1)
+// never leaves a truncated umoci.json behind.
+func WriteBundleMeta(bundle string, meta UmociMeta) (Err error) {
+	fh, err := ioutil.TempFile(bundle, "."+UmociMetaName+"-")
 	if err != nil {
 		return errors.Wrap(err, "create metadata")
 	}
+	defer func() {
+		fh.Close()
+		if Err != nil {
+			_ = os.Remove(fh.Name())
+		}
+	}()
+
+	if err := fh.Chmod(0644); err != nil {
+		return errors.Wrap(err, "chmod metadata")
+	}
+	if _, err := meta.WriteTo(fh); err != nil {
+		return errors.Wrap(err, "write metadata")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close metadata")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), filepath.Join(bundle, UmociMetaName)), "rename metadata")
+}
+
+// writeExtractionReport writes the given issues (found by umoci-unpack(1)) as
+// a JSON array to the file at path.
+func writeExtractionReport(path string, issues []layer.ExtractionIssue) error {
+	if issues == nil {
+		issues = []layer.ExtractionIssue{}
+	}
+
+	fh, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create extraction report")
+	}
 	defer fh.Close()
 
-	_, err = meta.WriteTo(fh)
-	return errors.Wrap(err, "write metadata")
+	enc := json.NewEncoder(fh)
+	enc.SetIndent("", "\t")
+	return errors.Wrap(enc.Encode(issues), "write extraction report")
 }
 
 // ReadBundleMeta reads and parses the umoci.json file from a given bundle path.
@@ -136,6 +606,31 @@ type ManifestStat struct {
 
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// Artifact stores the information about the manifest if it is an
+	// artifact rather than an image, in which case History is empty.
+	Artifact *artifactStat `json:"artifact,omitempty"`
+}
+
+// artifactStat contains information about an artifact manifest (a manifest
+// whose config is not an image configuration).
+type artifactStat struct {
+	// ArtifactType is the type of the artifact, which is the media type of
+	// Config if the manifest doesn't specify one.
+	ArtifactType string `json:"artifact_type"`
+
+	// Config is the descriptor of the configuration of the artifact.
+	Config ispec.Descriptor `json:"config"`
+
+	// Blobs are the descriptors of the blobs of the artifact.
+	Blobs []ispec.Descriptor `json:"blobs"`
+
+	// Subject is the descriptor of the manifest the artifact refers to, if
+	// any.
+	Subject *ispec.Descriptor `json:"subject,omitempty"`
+
+	// Annotations are the annotations of the artifact manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -144,19 +639,26 @@ type ManifestStat struct {
 //       define their own custom templates for different blocks (meaning that
 //       this should use text/template rather than using tabwriters manually.
 func (ms ManifestStat) Format(w io.Writer) error {
+	if ms.Artifact != nil {
+		return ms.Artifact.Format(w)
+	}
+
 	// Output history information.
 	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
 	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
 	for _, histEntry := range ms.History {
 		var (
-			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+			created   = "<none>"
 			createdBy = strings.Replace(histEntry.CreatedBy, "\t", " ", -1)
 			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
 			layerID   = "<none>"
 			size      = "<none>"
 		)
 
-		if !histEntry.EmptyLayer {
+		if histEntry.Created != nil {
+			created = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+		}
+		if histEntry.Layer != nil {
 			layerID = histEntry.Layer.Digest.String()
 			size = units.HumanSize(float64(histEntry.Layer.Size))
 		}
@@ -169,6 +671,36 @@ func (ms ManifestStat) Format(w io.Writer) error {
 	return nil
 }
 
+// Format formats an artifactStat using the default formatting, and writes the
+// result to the given writer.
+func (as artifactStat) Format(w io.Writer) error {
+	fmt.Fprintf(w, "ARTIFACT TYPE: %s\n", as.ArtifactType)
+	fmt.Fprintf(w, "CONFIG: %s (%s, %s)\n", as.Config.Digest, as.Config.MediaType, units.HumanSize(float64(as.Config.Size)))
+	if as.Subject != nil {
+		fmt.Fprintf(w, "SUBJECT: %s (%s)\n", as.Subject.Digest, as.Subject.MediaType)
+	}
+	var keys []string
+	for key := range as.Annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "ANNOTATION: %s=%s\n", key, as.Annotations[key])
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "BLOB\tMEDIA TYPE\tSIZE\tTITLE\n")
+	for _, blob := range as.Blobs {
+		title := blob.Annotations[ispec.AnnotationTitle]
+		if title == "" {
+			title = "<none>"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", blob.Digest, blob.MediaType, units.HumanSize(float64(blob.Size)), strings.Replace(title, "\t", " ", -1))
+	}
+	return tw.Flush()
+}
+
 // historyStat contains information about a single entry in the history of a
 // manifest. This is essentially equivalent to a single record from
 // docker-history(1).
@@ -207,6 +739,16 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		return stat, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
 	}
 
+	// Artifacts don't have an image configuration (or history).
+	if !casext.IsImageConfig(manifest.Config.MediaType) {
+		artifact, err := statArtifact(ctx, engine, manifestDescriptor)
+		if err != nil {
+			return stat, errors.Wrap(err, "stat artifact")
+		}
+		stat.Artifact = &artifact
+		return stat, nil
+	}
+
 	// Now get the config.
 	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
@@ -218,12 +760,51 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		return stat, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
 	}
 
-	// TODO: This should probably be moved into separate functions.
+	stat.History = historyStats(manifest, config)
+	return stat, nil
+}
+
+// statArtifact computes the artifactStat for the given artifact manifest,
+// including the fields which are not part of the vendored image-spec.
+func statArtifact(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (artifactStat, error) {
+	data, err := readRawBlob(ctx, engine, manifestDescriptor)
+	if err != nil {
+		return artifactStat{}, err
+	}
+	var manifest struct {
+		ispec.Manifest
+		ArtifactType string            `json:"artifactType"`
+		Subject      *ispec.Descriptor `json:"subject"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return artifactStat{}, errors.Wrap(err, "parse artifact manifest")
+	}
+
+	artifactType := manifest.ArtifactType
+	if artifactType == "" {
+		artifactType = manifest.Config.MediaType
+	}
+	blobs := manifest.Layers
+	if blobs == nil {
+		blobs = []ispec.Descriptor{}
+	}
+	return artifactStat{
+		ArtifactType: artifactType,
+		Config:       manifest.Config,
+		Blobs:        blobs,
+		Subject:      manifest.Subject,
+		Annotations:  manifest.Annotations,
+	}, nil
+}
 
-	// Generate the history of the image. Because the config.History entries
-	// are in the same order as the manifest.Layer entries this is fairly
-	// simple. However, we only increment the layer index if a layer was
-	// actually generated by a history entry.
+// historyStats correlates the history of an image with its layers. Because the
+// config.History entries are in the same order as the manifest.Layer entries
+// this is fairly simple. However, we only move to the next layer if a layer
+// was actually generated by a history entry. Non-empty entries without a
+// corresponding layer have no Layer, and layers without a corresponding entry
+// are given an entry with only Layer and DiffID set.
+func historyStats(manifest ispec.Manifest, config ispec.Image) []historyStat {
+	var stats []historyStat
 	layerIdx := 0
 	for _, histEntry := range config.History {
 		info := historyStat{
@@ -235,13 +816,386 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		// Only fill the other information and increment layerIdx if it's a
 		// non-empty layer.
 		if !histEntry.EmptyLayer {
-			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
-			info.Layer = &manifest.Layers[layerIdx]
+			if layerIdx < len(manifest.Layers) {
+				info.Layer = &manifest.Layers[layerIdx]
+			}
+			if layerIdx < len(config.RootFS.DiffIDs) {
+				info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
+			}
 			layerIdx++
 		}
 
-		stat.History = append(stat.History, info)
+		stats = append(stats, info)
+	}
+	for ; layerIdx < len(manifest.Layers); layerIdx++ {
+		info := historyStat{
+			Layer: &manifest.Layers[layerIdx],
+		}
+		if layerIdx < len(config.RootFS.DiffIDs) {
+			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
+		}
+		stats = append(stats, info)
 	}
+	return stats
+}
 
-	return stat, nil
+// formatPlatform formats the platform of the given descriptor for use in
+// error messages.
+func formatPlatform(descriptor ispec.Descriptor) string {
+	if descriptor.Platform == nil {
+		return "<unknown>"
+	}
+	platform := descriptor.Platform.OS + "/" + descriptor.Platform.Architecture
+	if descriptor.Platform.Variant != "" {
+		platform += "/" + descriptor.Platform.Variant
+	}
+	return platform
+}
+
+// tagRoot returns the descriptor in the top-level index with the given
+// reference name (rather than the manifests it resolves to), or nil if there is
+// no such descriptor.
+func tagRoot(engine casext.Engine, name string) (*ispec.Descriptor, error) {
+	index, err := engine.GetIndex(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	var roots []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == name {
+			roots = append(roots, descriptor)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	if len(roots) != 1 {
+		// TODO: Handle this more nicely.
+		return nil, errors.Errorf("tag is ambiguous: %s", name)
+	}
+	return &roots[0], nil
+}
+
+// blobReferences returns the names of the references in the top-level index
+// from which the blob with the given digest can be reached. Entries without a
+// name are identified by their digest.
+func blobReferences(ctx context.Context, engine casext.Engine, blobDigest digest.Digest) ([]string, error) {
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	var names []string
+	for _, root := range index.Manifests {
+		name, ok := root.Annotations[ispec.AnnotationRefName]
+		if !ok {
+			name = root.Digest.String()
+		}
+		reachables, err := engine.Reachable(ctx, root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting reachables from %s", name)
+		}
+		for _, reachable := range reachables {
+			if reachable == blobDigest {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// layoutReferences returns the names of the references in the OCI image
+// layout at the given path, sorted by name. An error is returned if the path
+// is not an OCI image layout.
+func layoutReferences(ctx context.Context, path string) ([]string, error) {
+	engine, err := dir.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list references")
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// selectManifests returns the indices of the descriptor paths (as returned by
+// ResolveReference for the given tag) which should be operated on, based on
+// the --platform and --all-platforms flags added by uxPlatform. Without
+// either flag, the tag must refer to exactly one manifest.
+func selectManifests(ctx *cli.Context, tag string, descriptorPaths []casext.DescriptorPath) ([]int, error) {
+	if len(descriptorPaths) == 0 {
+		return nil, errors.Errorf("tag not found: %s", tag)
+	}
+	// We can only rebuild a single tree of blobs.
+	for _, descriptorPath := range descriptorPaths[1:] {
+		if descriptorPath.Root().Digest != descriptorPaths[0].Root().Digest {
+			return nil, errors.Errorf("tag is ambiguous: %s (it refers to several distinct blobs)", tag)
+		}
+	}
+
+	var indices []int
+	if val, ok := ctx.App.Metadata["--platform"]; ok {
+		platform := val.(ispec.Platform)
+		for idx, descriptorPath := range descriptorPaths {
+			if mutate.MatchPlatform(descriptorPath.Descriptor(), platform) {
+				indices = append(indices, idx)
+			}
+		}
+		if len(indices) == 0 {
+			var platforms []string
+			for _, descriptorPath := range descriptorPaths {
+				platforms = append(platforms, formatPlatform(descriptorPath.Descriptor()))
+			}
+			return nil, errors.Errorf("tag %s has no manifest for platform %s (available platforms: %s)", tag, ctx.String("platform"), strings.Join(platforms, ", "))
+		}
+		if len(indices) > 1 {
+			return nil, errors.Errorf("tag %s has %d manifests for platform %s", tag, len(indices), ctx.String("platform"))
+		}
+	} else if _, ok := ctx.App.Metadata["--all-platforms"]; ok {
+		for idx := range descriptorPaths {
+			indices = append(indices, idx)
+		}
+	} else {
+		if len(descriptorPaths) != 1 {
+			return nil, errors.Errorf("tag is ambiguous: %s (it refers to %d manifests, use --platform or --all-platforms)", tag, len(descriptorPaths))
+		}
+		indices = []int{0}
+	}
+	return indices, nil
+}
+
+// stageDryRun returns the engine which should be used to modify the image. If
+// --dry-run was specified (see uxDryRun), the modifications are staged in a
+// mutate.Batch (which is also returned, and must be passed to finishDryRun)
+// rather than being made to the given engine. The caller must Close the batch.
+func stageDryRun(ctx *cli.Context, engine cas.Engine) (cas.Engine, *mutate.Batch, error) {
+	if _, ok := ctx.App.Metadata["--dry-run"]; !ok {
+		return engine, nil, nil
+	}
+	batch, err := mutate.NewBatch(context.Background(), engine)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "stage modifications")
+	}
+	return batch.Engine(), batch, nil
+}
+
+// finishDryRun prints the modifications staged in the given batch (if it is
+// not nil) as JSON.
+func finishDryRun(batch *mutate.Batch) error {
+	if batch == nil {
+		return nil
+	}
+
+	diff, err := batch.Diff(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "compute staged modifications")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(diff); err != nil {
+		return errors.Wrap(err, "encode staged modifications")
+	}
+	return nil
+}
+
+// jsonOutput returns whether the command should output its results as JSON,
+// which is the case if either the command's own --json flag or the global
+// --json flag is set.
+func jsonOutput(ctx *cli.Context) bool {
+	return ctx.Bool("json") || ctx.GlobalBool("json")
+}
+
+// numWorkers returns the number of layers that umoci-unpack(1) or
+// umoci-mount(1) should extract concurrently, which is the value of the
+// command's own --workers flag if it is set, otherwise the value of the global
+// --workers flag if it is set, and otherwise the command's default of 1.
+// Unlike other commands, they don't default to the number of CPUs because each
+// layer being extracted concurrently may need to be staged uncompressed on
+// disk.
+func numWorkers(ctx *cli.Context) (int, error) {
+	workers := ctx.Int("workers")
+	if !ctx.IsSet("workers") && ctx.GlobalIsSet("workers") {
+		workers = ctx.GlobalInt("workers")
+	}
+	if workers < 1 {
+		return 0, errors.Errorf("--workers must be at least 1")
+	}
+	return workers, nil
+}
+
+// rootlessMode is the value of a --rootless flag. For compatibility with the
+// boolean flag it replaced, "--rootless" without a value is "on".
+type rootlessMode string
+
+const (
+	rootlessOff  rootlessMode = "off"
+	rootlessOn   rootlessMode = "on"
+	rootlessAuto rootlessMode = "auto"
+)
+
+// Set implements flag.Value.
+func (m *rootlessMode) Set(value string) error {
+	switch value {
+	case "on", "true", "1":
+		*m = rootlessOn
+	case "off", "false", "0":
+		*m = rootlessOff
+	case "auto":
+		*m = rootlessAuto
+	default:
+		return errors.Errorf("unknown --rootless mode %q (must be on, off or auto)", value)
+	}
+	return nil
+}
+
+// String implements flag.Value.
+func (m *rootlessMode) String() string {
+	if m == nil || *m == "" {
+		return string(rootlessOff)
+	}
+	return string(*m)
+}
+
+// IsBoolFlag allows --rootless to be specified without a value.
+func (m *rootlessMode) IsBoolFlag() bool {
+	return true
+}
+
+// rootlessFlag returns a --rootless flag with the given usage.
+func rootlessFlag(usage string) cli.Flag {
+	return cli.GenericFlag{
+		Name:  "rootless",
+		Usage: usage + " (on, off or auto)",
+		Value: new(rootlessMode),
+	}
+}
+
+// rootlessEnabled returns whether rootless mode should be used for the
+// command, based on its --rootless flag. With --rootless=auto, whether the
+// privileged operations used outside of rootless mode are possible is
+// detected. Enabling rootless mode is reported as a warning (so that it is
+// visible with the default log level), while the details are logged at the
+// info level.
+func rootlessEnabled(ctx *cli.Context) (bool, error) {
+	mode, ok := ctx.Generic("rootless").(*rootlessMode)
+	if !ok {
+		return false, nil
+	}
+	switch *mode {
+	case rootlessOn:
+		return true, nil
+	case rootlessAuto:
+		privileges, err := layer.DetectPrivileges()
+		if err != nil {
+			return false, errors.Wrap(err, "detect privileges for --rootless=auto")
+		}
+		logger := log.WithFields(log.Fields{
+			"euid":         privileges.EUID,
+			"userns":       privileges.UserNamespace,
+			"mapped_ids":   privileges.MappedIDs,
+			"missing_caps": strings.Join(privileges.MissingCapabilities, ","),
+		})
+		if reasons := privileges.Reasons(); len(reasons) > 0 {
+			logger.Warnf("--rootless=auto: enabling rootless mode: %s", strings.Join(reasons, "; "))
+			return true, nil
+		}
+		logger.Infof("--rootless=auto: privileged operations are possible, not enabling rootless mode")
+		return false, nil
+	}
+	return false, nil
+}
+
+// tagResult is the result of a command which modifies a tag, which is output
+// if the global --json flag is set.
+type tagResult struct {
+	// Tag is the name of the modified tag.
+	Tag string `json:"tag"`
+
+	// Descriptor is the entry for the tag in the top-level index, or nil if
+	// the tag was removed.
+	Descriptor *ispec.Descriptor `json:"descriptor"`
+}
+
+// outputTagResult outputs the tagResult for the given (just modified) tag if
+// the global --json flag is set.
+func outputTagResult(ctx *cli.Context, engine casext.Engine, name string) error {
+	if !ctx.GlobalBool("json") {
+		return nil
+	}
+	descriptor, err := tagRoot(engine, name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(tagResult{
+		Tag:        name,
+		Descriptor: descriptor,
+	}); err != nil {
+		return errors.Wrap(err, "encoding result")
+	}
+	return nil
+}
+
+// tagManifest returns the descriptor and contents of the image manifest the
+// given tag refers to.
+func tagManifest(engineExt casext.Engine, tagName string) (ispec.Descriptor, ispec.Manifest, error) {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Errorf("tag not found: %s", tagName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Errorf("tag is ambiguous: %s", tagName)
+	}
+	descriptor := descriptorPaths[0].Descriptor()
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), descriptor)
+	if err != nil {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.MediaType), "invalid tag")
+	}
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+	}
+	return descriptor, manifest, nil
+}
+
+// templateFuncs are the functions available to --format templates, in
+// addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// formatTemplate parses a --format template.
+func formatTemplate(format string) (*template.Template, error) {
+	return template.New("format").Funcs(templateFuncs).Parse(format)
+}
+
+// executeTemplate writes the output of the given --format template for data
+// to w, followed by a newline.
+func executeTemplate(w io.Writer, tmpl *template.Template, data interface{}) error {
+	if err := tmpl.Execute(w, data); err != nil {
+		return errors.Wrap(err, "execute --format template")
+	}
+	_, err := fmt.Fprintln(w)
+	return err
 }
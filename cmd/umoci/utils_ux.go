@@ -18,10 +18,18 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"regexp"
 	"strings"
+	"time"
 
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/remote"
+	"github.com/openSUSE/umoci/oci/signature"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -42,7 +50,8 @@ func flattenCommands(cmds []cli.Command) []*cli.Command {
 // well as adding relevant validation logic to the .Before of the command. The
 // values will be stored in ctx.Metadata with the keys "--history.author",
 // "--history.created", "--history.created_by", "--history.comment", with
-// string values. If they are not set the value will be nil.
+// string values. If they are not set the value will be nil. If --no-history is
+// set, "--no-history" is set to true (and no --history.* flags may be given).
 func uxHistory(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, []cli.Flag{
 		cli.StringFlag{
@@ -61,6 +70,10 @@ func uxHistory(cmd cli.Command) cli.Command {
 			Name:  "history.created_by",
 			Usage: "created_by value for the history entry",
 		},
+		cli.BoolFlag{
+			Name:  "no-history",
+			Usage: "do not add a history entry",
+		},
 	}...)
 
 	oldBefore := cmd.Before
@@ -81,6 +94,15 @@ func uxHistory(cmd cli.Command) cli.Command {
 		if ctx.IsSet("history.created_by") {
 			ctx.App.Metadata["--history.created_by"] = ctx.String("history.created_by")
 		}
+		// Verify --no-history.
+		if ctx.Bool("no-history") {
+			for _, flag := range []string{"history.author", "history.comment", "history.created", "history.created_by"} {
+				if ctx.IsSet(flag) {
+					return errors.Errorf("--no-history cannot be used with --%s", flag)
+				}
+			}
+			ctx.App.Metadata["--no-history"] = true
+		}
 
 		// Include any old befores set.
 		if oldBefore != nil {
@@ -140,32 +162,9 @@ func uxImage(cmd cli.Command) cli.Command {
 	cmd.Before = func(ctx *cli.Context) error {
 		// Verify and parse --image.
 		if ctx.IsSet("image") {
-			image := ctx.String("image")
-
-			var dir, tag string
-			sep := strings.LastIndex(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
-			}
-
-			// Verify directory value.
-			if strings.Contains(dir, ":") {
-				return errors.Wrap(fmt.Errorf("path contains ':' character: '%s'", dir), "invalid --image")
-			}
-			if dir == "" {
-				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
-			}
-
-			// Verify tag value.
-			if !refRegexp.MatchString(tag) {
-				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --image")
-			}
-			if tag == "" {
-				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --image")
+			dir, tag, err := parseImageRef(ctx.String("image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
@@ -181,6 +180,38 @@ func uxImage(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// parseImageRef parses an image reference of the form "path[:tag]" (as used
+// by --image) into its path and tag. If no tag is given, it defaults to
+// "latest".
+func parseImageRef(image string) (string, string, error) {
+	var dir, tag string
+	sep := strings.LastIndex(image, ":")
+	if sep == -1 {
+		dir = image
+		tag = "latest"
+	} else {
+		dir = image[:sep]
+		tag = image[sep+1:]
+	}
+
+	// Verify directory value.
+	if strings.Contains(dir, ":") {
+		return "", "", fmt.Errorf("path contains ':' character: '%s'", dir)
+	}
+	if dir == "" {
+		return "", "", fmt.Errorf("path is empty")
+	}
+
+	// Verify tag value.
+	if !refRegexp.MatchString(tag) {
+		return "", "", fmt.Errorf("tag contains invalid characters: '%s'", tag)
+	}
+	if tag == "" {
+		return "", "", fmt.Errorf("tag is empty")
+	}
+	return dir, tag, nil
+}
+
 // uxLayout adds an --layout flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The value is stored
 // in ctx.App.Metadata["--image-path"] as a string (or nil --layout was not set).
@@ -215,3 +246,360 @@ func uxLayout(cmd cli.Command) cli.Command {
 
 	return cmd
 }
+
+// parsePlatform parses a platform of the form os/architecture[/variant].
+func parsePlatform(value string) (ispec.Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("platform must be of the form os/architecture[/variant]: '%s'", value)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("platform contains an empty component: '%s'", value)
+		}
+	}
+	platform := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// uxPlatform adds the --platform and --all-platforms flags to the given
+// cli.Command, which select the manifests to operate on if the tag refers to
+// an image index (see selectManifests). The parsed value of --platform will be
+// stored in ctx.App.Metadata["--platform"] as an ispec.Platform, and if
+// --all-platforms is set "--all-platforms" is set to true.
+func uxPlatform(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "only modify the manifest for the given platform (os/architecture[/variant]) of an image index",
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "modify the manifests for every platform of an image index",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --platform.
+		if ctx.IsSet("platform") {
+			platform, err := parsePlatform(ctx.String("platform"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+			ctx.App.Metadata["--platform"] = platform
+		}
+		// Verify --all-platforms.
+		if ctx.Bool("all-platforms") {
+			if ctx.IsSet("platform") {
+				return errors.Errorf("--all-platforms cannot be used with --platform")
+			}
+			ctx.App.Metadata["--all-platforms"] = true
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxFormat adds the --format flag to the given cli.Command, for commands which
+// can output their results using a Go template rather than their default
+// formatting. The parsed template (see formatTemplate) is stored in
+// ctx.App.Metadata["--format"] (as a *template.Template).
+func uxFormat(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.StringFlag{
+		Name:  "format",
+		Usage: "format the output using the given Go template",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --format.
+		if ctx.IsSet("format") {
+			if jsonOutput(ctx) {
+				return errors.Errorf("--format and --json are mutually exclusive")
+			}
+			tmpl, err := formatTemplate(ctx.String("format"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --format")
+			}
+			ctx.App.Metadata["--format"] = tmpl
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxDryRun adds the --dry-run flag to the given cli.Command, for commands
+// which modify an image using the engine returned by stageDryRun. If
+// --dry-run is set, "--dry-run" is set to true in ctx.App.Metadata.
+func uxDryRun(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the modifications as JSON without applying them to the image",
+	})
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --dry-run.
+		if ctx.Bool("dry-run") {
+			ctx.App.Metadata["--dry-run"] = true
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxCreated adds the --created, --author and --created-annotation flags to
+// the given cli.Command, as well as adding relevant validation logic to the
+// .Before of the command. The values will be stored in
+// ctx.App.Metadata["--created"] (as a time.Time), ctx.App.Metadata["--author"]
+// (as a string) and ctx.App.Metadata["--created-annotation"] (as true). They
+// are applied to the image by applyCreation, and are the defaults for the
+// history entry returned by historyEntry.
+func uxCreated(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "creation time of the image and of its new history entries (ISO8601 format)",
+		}, // FIXME: Implement TimeFlag.
+		cli.StringFlag{
+			Name:  "author",
+			Usage: "author of the image and of its new history entries",
+		},
+		cli.BoolFlag{
+			Name:  "created-annotation",
+			Usage: "set the org.opencontainers.image.created annotation to the creation time of the image",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --created.
+		if ctx.IsSet("created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("created"))
+			if err != nil {
+				return errors.Wrap(err, "parse --created")
+			}
+			ctx.App.Metadata["--created"] = created
+		}
+		// Verify --author.
+		if ctx.IsSet("author") {
+			ctx.App.Metadata["--author"] = ctx.String("author")
+		}
+		// Verify --created-annotation.
+		if ctx.Bool("created-annotation") {
+			ctx.App.Metadata["--created-annotation"] = true
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxRemote adds the flags used to connect to registries (--authfile, --creds,
+// --tls-verify, --plain-http, --cert-dir and --registries-conf) to the given
+// cli.Command, as well as adding relevant validation logic to the .Before of
+// the command. The resulting remote.Options will be stored in
+// ctx.App.Metadata["--remote-options"].
+func uxRemote(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "authfile",
+			Usage: "path of the registry credentials file (defaults to the docker client configuration)",
+		},
+		cli.StringFlag{
+			Name:  "creds",
+			Usage: "credentials for the registry, of the form 'username[:password]'",
+		},
+		cli.BoolTFlag{
+			Name:  "tls-verify",
+			Usage: "verify the TLS certificates of the registry",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "connect to the registry using HTTP rather than HTTPS",
+		},
+		cli.StringFlag{
+			Name:  "cert-dir",
+			Usage: "directory containing the certificates for each registry (in the layout of /etc/containers/certs.d)",
+		},
+		cli.StringFlag{
+			Name:  "registries-conf",
+			Usage: "path of the registries configuration, which configures mirrors and insecure registries (defaults to the containers-registries.conf(5) configuration)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		options := remote.Options{
+			InsecureSkipVerify: !ctx.BoolT("tls-verify"),
+			PlainHTTP:          ctx.Bool("plain-http"),
+			CertDir:            ctx.String("cert-dir"),
+		}
+
+		// Verify --creds and --authfile.
+		if ctx.IsSet("creds") {
+			if ctx.IsSet("authfile") {
+				return errors.Errorf("--creds cannot be used with --authfile")
+			}
+			parts := strings.SplitN(ctx.String("creds"), ":", 2)
+			if parts[0] == "" {
+				return errors.Wrap(fmt.Errorf("username is empty"), "invalid --creds")
+			}
+			creds := remote.Credentials{Username: parts[0]}
+			if len(parts) == 2 {
+				creds.Password = parts[1]
+			}
+			options.Credentials = remote.StaticCredentials(creds)
+		} else {
+			path := remote.DefaultDockerConfigPath()
+			if ctx.IsSet("authfile") {
+				path = ctx.String("authfile")
+			}
+			config, err := remote.LoadDockerConfig(path)
+			if err != nil && (ctx.IsSet("authfile") || !os.IsNotExist(errors.Cause(err))) {
+				return errors.Wrap(err, "invalid --authfile")
+			}
+			options.Credentials = config.Credentials
+		}
+
+		// Verify --registries-conf.
+		path := remote.DefaultRegistriesConfigPath()
+		if ctx.IsSet("registries-conf") {
+			path = ctx.String("registries-conf")
+		}
+		registries, err := remote.LoadRegistriesConfig(path)
+		if err != nil && (ctx.IsSet("registries-conf") || !os.IsNotExist(errors.Cause(err))) {
+			return errors.Wrap(err, "invalid --registries-conf")
+		}
+		if registries != nil {
+			options.Mirrors = registries.Mirrors
+			options.Registries = registries.RegistryOptions()
+		}
+		ctx.App.Metadata["--remote-options"] = options
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+// uxSignature adds the flags used to verify the signature of an image (--key,
+// --certificate-identity, --certificate-oidc-issuer, --ca-roots and
+// --signature-file) to the given cli.Command, as well as adding relevant
+// validation logic to the .Before of the command. If --key or
+// --certificate-identity was given, the resulting signature.Verifier will be
+// stored in ctx.App.Metadata["--signature-verifier"] (and the path given to
+// --signature-file in ctx.App.Metadata["--signature-file"] as a string).
+func uxSignature(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "path of the public key the image must be signed with",
+		},
+		cli.StringFlag{
+			Name:  "certificate-identity",
+			Usage: "identity (email address or URI) the image must be signed by using a keyless signature",
+		},
+		cli.StringFlag{
+			Name:  "certificate-oidc-issuer",
+			Usage: "OIDC provider which must have authenticated the --certificate-identity",
+		},
+		cli.StringFlag{
+			Name:  "ca-roots",
+			Usage: "path of the PEM-encoded root certificates trusted to issue keyless signing certificates",
+		},
+		cli.StringFlag{
+			Name:  "signature-file",
+			Usage: "path of a sidecar file containing the signature (rather than using the signatures stored in the image)",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		// Verify --key and --certificate-*.
+		if ctx.IsSet("key") {
+			if ctx.IsSet("certificate-identity") || ctx.IsSet("certificate-oidc-issuer") || ctx.IsSet("ca-roots") {
+				return errors.Errorf("--key cannot be used with --certificate-identity, --certificate-oidc-issuer or --ca-roots")
+			}
+			data, err := ioutil.ReadFile(ctx.String("key"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --key")
+			}
+			key, err := signature.LoadPublicKey(data)
+			if err != nil {
+				return errors.Wrap(err, "invalid --key")
+			}
+			ctx.App.Metadata["--signature-verifier"] = signature.KeyVerifier{Key: key}
+		} else if ctx.IsSet("certificate-identity") {
+			if ctx.String("certificate-identity") == "" {
+				return errors.Wrap(fmt.Errorf("identity is empty"), "invalid --certificate-identity")
+			}
+			if ctx.String("certificate-oidc-issuer") == "" {
+				return errors.Errorf("missing mandatory argument: --certificate-oidc-issuer")
+			}
+			if ctx.String("ca-roots") == "" {
+				return errors.Errorf("missing mandatory argument: --ca-roots")
+			}
+			data, err := ioutil.ReadFile(ctx.String("ca-roots"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --ca-roots")
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(data) {
+				return errors.Wrap(fmt.Errorf("no certificates found"), "invalid --ca-roots")
+			}
+			ctx.App.Metadata["--signature-verifier"] = signature.IdentityVerifier{
+				Roots:    roots,
+				Identity: ctx.String("certificate-identity"),
+				Issuer:   ctx.String("certificate-oidc-issuer"),
+			}
+		} else if ctx.IsSet("certificate-oidc-issuer") || ctx.IsSet("ca-roots") || ctx.IsSet("signature-file") {
+			return errors.Errorf("--certificate-oidc-issuer, --ca-roots and --signature-file require --key or --certificate-identity")
+		}
+		if ctx.IsSet("signature-file") {
+			ctx.App.Metadata["--signature-file"] = ctx.String("signature-file")
+		}
+
+		// Include any old befores set.
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+
+	return cmd
+}
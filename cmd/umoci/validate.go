@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/validate"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var validateCommand = cli.Command{
+	Name:  "validate",
+	Usage: "checks that an OCI image layout complies with the image-spec",
+	ArgsUsage: `--layout <image-path>
+
+Where "<image-path>" is the path to the OCI image.
+
+The whole image layout is validated against the OCI image-spec: the
+oci-layout file, the structure of the blobs directory, the schemas of the
+index, manifests and image configurations, the media types and fields of every
+descriptor and the digest and size of every blob (as with umoci-verify(1)).
+Each finding has a severity ("error", "warning" or "info"). If any errors are
+found (or any warnings, if --strict is given) the command fails.`,
+
+	// validate reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the report as a JSON encoded blob",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "fail if any warnings are found, not just errors",
+		},
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "do not output findings with the \"info\" severity",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		return nil
+	},
+
+	Action: validateLayout,
+}
+
+func validateLayout(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	report, err := validate.Layout(context.Background(), imagePath)
+	if err != nil {
+		return errors.Wrap(err, "validate")
+	}
+
+	if ctx.Bool("quiet") {
+		var findings []validate.Finding
+		for _, finding := range report.Findings {
+			if finding.Severity != validate.SeverityInfo {
+				findings = append(findings, finding)
+			}
+		}
+		if findings == nil {
+			findings = []validate.Finding{}
+		}
+		report.Findings = findings
+	}
+
+	if jsonOutput(ctx) {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return errors.Wrap(err, "encoding report")
+		}
+	} else {
+		for _, finding := range report.Findings {
+			fmt.Println(finding)
+		}
+	}
+
+	log.Infof("found %d error(s), %d warning(s) and %d info(s)", report.Errors, report.Warnings, report.Infos)
+	if !report.Valid() {
+		return errors.Errorf("image is not valid: found %d error(s)", report.Errors)
+	}
+	if ctx.Bool("strict") && report.Warnings > 0 {
+		return errors.Errorf("image is not valid: found %d warning(s) with --strict", report.Warnings)
+	}
+	log.Info("image is valid")
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "checks the integrity of an OCI image",
+	ArgsUsage: `--layout <image-path> [<tag>...]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+a tagged image to check. If no tags are given, every image in the OCI image is
+checked.
+
+Every blob which can be reached from the checked tags is re-hashed and
+compared against the digest and size of the descriptors referencing it, the
+uncompressed contents of every layer are compared against the diff_ids of the
+image configuration, and manifests, indexes and image configurations are
+checked against the image-spec. If any problems are found, they are printed
+and the command fails.`,
+
+	// verify reads an image layout.
+	Category: "layout",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the problems found as a JSON encoded blob",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
+			return errors.Errorf("missing mandatory argument: --layout")
+		}
+		for _, tag := range ctx.Args() {
+			if !refRegexp.MatchString(tag) {
+				return errors.Errorf("tag is an invalid reference: %s", tag)
+			}
+		}
+		return nil
+	},
+
+	Action: verify,
+}
+
+func verify(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Get a reference to the CAS.
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var roots []ispec.Descriptor
+	if ctx.NArg() == 0 {
+		index, err := engineExt.GetIndex(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get top-level index")
+		}
+		roots = index.Manifests
+	} else {
+		for _, tag := range ctx.Args() {
+			root, err := tagRoot(engineExt, tag)
+			if err != nil {
+				return err
+			}
+			if root == nil {
+				return errors.Errorf("tag not found: %s", tag)
+			}
+			roots = append(roots, *root)
+		}
+	}
+
+	log.Infof("verifying %d image(s)", len(roots))
+	issues, err := engineExt.Verify(context.Background(), roots)
+	if err != nil {
+		return errors.Wrap(err, "verify")
+	}
+
+	if jsonOutput(ctx) {
+		// Always output a list, even if there were no problems.
+		if issues == nil {
+			issues = []casext.VerifyIssue{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(issues); err != nil {
+			return errors.Wrap(err, "encoding issues")
+		}
+	} else {
+		for _, issue := range issues {
+			name := issue.Path.Root().Annotations[ispec.AnnotationRefName]
+			if name == "" {
+				name = issue.Path.Root().Digest.String()
+			}
+			fmt.Printf("%s: %s\n", name, issue)
+		}
+	}
+
+	if len(issues) > 0 {
+		return errors.Errorf("image is corrupted: found %d problem(s)", len(issues))
+	}
+	log.Info("image is intact")
+	return nil
+}
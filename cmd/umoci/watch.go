@@ -0,0 +1,235 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fswatch"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+var watchCommand = cli.Command{
+	Name:  "watch",
+	Usage: "records changes to a runtime bundle's rootfs for umoci-repack(1)",
+	ArgsUsage: `[--image <image-path>[:<tag>]] <bundle>
+
+Where "<bundle>" is the path to a runtime bundle which was created with
+umoci-unpack(1), "<image-path>" is the path to the OCI image that was used to
+create "<bundle>" and "<tag>" is the prefix of the tags that the bundle is
+automatically repacked into (if not specified, defaults to "latest").
+
+The changes made to the bundle's rootfs are recorded (using inotify(7)) in
+"<bundle>/` + UmociWatchLogName + `" until umoci-watch(1) is interrupted with
+SIGINT or SIGTERM. The log is created once all of the directories in the rootfs
+are being watched, and umoci-repack(1) --watch-log uses it to only check the
+changed paths rather than the entire rootfs. umoci-watch(1) must be running for
+all of the changes made to the rootfs after it was unpacked.
+
+If --image is specified, the bundle is also repacked (with umoci-repack(1)
+--watch-log) whenever the rootfs stops changing for the --debounce duration.
+Each repack creates a new tag "<tag>-<n>" (where "<n>" starts after the
+highest existing such tag), containing all of the changes made since the
+bundle was unpacked as a single layer on top of the original image.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "image",
+			Usage: "automatically repack changes into successive tags of this image (path[:tag])",
+		},
+		cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "how long the rootfs must stop changing before it is automatically repacked",
+			Value: 2 * time.Second,
+		},
+	},
+
+	Action: watch,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		if ctx.Duration("debounce") <= 0 {
+			return errors.Errorf("--debounce must be positive")
+		}
+		if ctx.IsSet("debounce") && !ctx.IsSet("image") {
+			return errors.Errorf("--debounce can only be used with --image")
+		}
+		if ctx.IsSet("image") {
+			dir, tag, err := parseImageRef(ctx.String("image"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
+			}
+			ctx.App.Metadata["--image-path"] = dir
+			ctx.App.Metadata["--image-tag"] = tag
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		return nil
+	},
+}
+
+// nextWatchTag returns the name of the next tag that umoci-watch(1) should
+// repack into, which is "<tag>-<n>" with n one more than the highest existing
+// such tag (or 1).
+func nextWatchTag(imagePath, tagName string) (string, error) {
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return "", errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	names, err := engineExt.ListReferences(context.Background())
+	if err != nil {
+		return "", errors.Wrap(err, "list references")
+	}
+	next := 1
+	for _, name := range names {
+		suffix := strings.TrimPrefix(name, tagName+"-")
+		if suffix == name {
+			continue
+		}
+		if n, err := strconv.Atoi(suffix); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return fmt.Sprintf("%s-%d", tagName, next), nil
+}
+
+func watch(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	// Make sure that this is actually a bundle.
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+	if meta.OnDiskFormat == layer.OverlayfsLayers {
+		return errors.Errorf("cannot watch a bundle unpacked with --overlay-layers")
+	}
+
+	// If there is no existing log, we create it under a temporary name and
+	// only rename it once the rootfs is being watched, so that the presence
+	// of the log means that all later changes will be recorded.
+	logPath := filepath.Join(bundlePath, UmociWatchLogName)
+	tmpPath := logPath
+	if _, err := os.Lstat(logPath); os.IsNotExist(err) {
+		tmpPath = logPath + ".tmp"
+	}
+	fh, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open watch log")
+	}
+	defer fh.Close()
+
+	// An existing log was written by an earlier umoci-watch(1), and any
+	// changes made since it stopped were not recorded. Mark the log as
+	// incomplete so that umoci-repack(1) doesn't silently miss them.
+	if tmpPath == logPath {
+		log.Warnf("watch log %s already exists, marking it as incomplete", UmociWatchLogName)
+		if err := json.NewEncoder(fh).Encode(fswatch.Record{Incomplete: true}); err != nil {
+			return errors.Wrap(err, "mark watch log incomplete")
+		}
+	}
+
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	watcher, err := fswatch.NewWatcher(fullRootfsPath, fh)
+	if err != nil {
+		return errors.Wrap(err, "watch rootfs")
+	}
+	if tmpPath != logPath {
+		if err := os.Rename(tmpPath, logPath); err != nil {
+			watcher.Close()
+			return errors.Wrap(err, "create watch log")
+		}
+	}
+	log.Infof("watching %s for changes (recording to %s)", fullRootfsPath, logPath)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.Run()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	defer signal.Stop(sigs)
+
+	imagePath, repack := ctx.App.Metadata["--image-path"].(string)
+	tagName, _ := ctx.App.Metadata["--image-tag"].(string)
+
+	// The timer is reset on every change, so that we only repack once the
+	// rootfs has stopped changing.
+	var debounce *time.Timer
+	var debounced <-chan time.Time
+loop:
+	for {
+		select {
+		case err := <-done:
+			watcher.Close()
+			return errors.Wrap(err, "watch rootfs")
+		case <-watcher.Changed():
+			if !repack {
+				continue
+			}
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.NewTimer(ctx.Duration("debounce"))
+			debounced = debounce.C
+		case <-debounced:
+			debounce, debounced = nil, nil
+			newTag, err := nextWatchTag(imagePath, tagName)
+			if err != nil {
+				return err
+			}
+			log.Infof("rootfs changed, repacking into %s", newTag)
+			// A failed repack (such as one caused by a path being removed
+			// while it was being repacked) is retried after the next change.
+			if err := runSubcommand(ctx, "repack", "--watch-log", "--image", imagePath+":"+newTag, bundlePath); err != nil {
+				log.Warnf("repack into %s failed: %v", newTag, err)
+				continue
+			}
+		case sig := <-sigs:
+			log.Infof("received %s, stopping", sig)
+			break loop
+		}
+	}
+
+	if err := watcher.Close(); err != nil {
+		return errors.Wrap(err, "stop watching rootfs")
+	}
+	return errors.Wrap(<-done, "watch rootfs")
+}
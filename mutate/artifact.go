@@ -0,0 +1,247 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Artifact is a set of blobs which are not an image, such as auxiliary blobs
+// attached to an image (an SBOM or an attestation) or a standalone artifact
+// (such as a Helm chart or a WASM module). The blobs are not layers, and are
+// never extracted.
+type Artifact struct {
+	// ArtifactType is the type of the artifact, such as
+	// "application/spdx+json" for an SPDX SBOM. It can only be empty if the
+	// artifact has a Config, whose media type is then the type of the
+	// artifact.
+	ArtifactType string
+
+	// Config is the descriptor of the configuration blob of the artifact
+	// (such as the configuration of a Helm chart), which must already be in
+	// the image. If it is nil, the empty JSON object is used.
+	Config *ispec.Descriptor
+
+	// Blobs are the descriptors of the blobs of the artifact, which must
+	// already be in the image (see PutBlob). If there are no blobs, the
+	// artifact consists only of its annotations.
+	Blobs []ispec.Descriptor
+
+	// Annotations are the annotations of the artifact manifest.
+	Annotations map[string]string
+}
+
+// artifactManifest is an artifact manifest, as defined by version 1.1 of the
+// OCI image-spec. The fields it adds to ispec.Manifest are not part of the
+// vendored image-spec.
+type artifactManifest struct {
+	ispec.Manifest
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Subject      *ispec.Descriptor `json:"subject,omitempty"`
+}
+
+// emptyJSON is the content of the blob with the casext.MediaTypeEmptyJSON
+// media type.
+var emptyJSON = []byte("{}")
+
+// PutBlob adds the contents of the reader to the CAS as a blob with the given
+// media type, without adding it to any image. It returns the descriptor of the
+// blob, which can be used as one of the Blobs of an Artifact.
+func PutBlob(ctx context.Context, engine cas.Engine, mediaType string, reader io.Reader) (ispec.Descriptor, error) {
+	if mediaType == "" {
+		return ispec.Descriptor{}, errors.Errorf("blob media type cannot be empty")
+	}
+	blobDigest, blobSize, err := engine.PutBlob(ctx, reader)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put blob")
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      blobSize,
+	}, nil
+}
+
+// validate checks that an artifact manifest can be created for the artifact.
+func (a Artifact) validate() error {
+	if a.ArtifactType == "" && (a.Config == nil || a.Config.MediaType == casext.MediaTypeEmptyJSON) {
+		return errors.Errorf("artifact type cannot be empty")
+	}
+	if a.Config != nil {
+		if a.Config.MediaType == "" {
+			return errors.Errorf("artifact config has no media type")
+		}
+		if casext.IsImageConfig(a.Config.MediaType) {
+			return errors.Errorf("artifact config cannot be an image configuration: %s", a.Config.MediaType)
+		}
+	}
+	for idx, blob := range a.Blobs {
+		if blob.MediaType == "" {
+			return errors.Errorf("artifact blob %d has no media type", idx)
+		}
+	}
+	return nil
+}
+
+// PutArtifact creates an artifact manifest (following the conventions of
+// version 1.1 of the OCI image-spec) containing the blobs of the artifact,
+// whose subject is the given descriptor. The artifact manifest is not added
+// to any index, and its descriptor is returned.
+func PutArtifact(ctx context.Context, engine cas.Engine, subject ispec.Descriptor, artifact Artifact) (ispec.Descriptor, error) {
+	// Only the fields used to identify the subject are included.
+	subject = ispec.Descriptor{
+		MediaType: subject.MediaType,
+		Digest:    subject.Digest,
+		Size:      subject.Size,
+	}
+	return putArtifact(ctx, engine, &subject, artifact)
+}
+
+// AttachArtifact creates an artifact manifest whose subject is the given
+// descriptor (see PutArtifact), and adds it (without a reference name) to the
+// top-level index of the image, which is where referrers are stored in an OCI
+// image layout. The descriptor of the artifact manifest is returned.
+func AttachArtifact(ctx context.Context, engine cas.Engine, subject ispec.Descriptor, artifact Artifact) (ispec.Descriptor, error) {
+	descriptor, err := PutArtifact(ctx, engine, subject, artifact)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get top-level index")
+	}
+	index.Manifests = append(index.Manifests, descriptor)
+	if err := engine.PutIndex(ctx, index); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put top-level index")
+	}
+	return descriptor, nil
+}
+
+// NewArtifact creates a standalone artifact manifest (one without a subject)
+// containing the blobs of the artifact, as with PutArtifact. The artifact
+// manifest is not added to any index, and its descriptor is returned.
+func NewArtifact(ctx context.Context, engine cas.Engine, artifact Artifact) (ispec.Descriptor, error) {
+	return putArtifact(ctx, engine, nil, artifact)
+}
+
+// putArtifact creates an artifact manifest with the given subject (if any).
+func putArtifact(ctx context.Context, engine cas.Engine, subject *ispec.Descriptor, artifact Artifact) (ispec.Descriptor, error) {
+	if err := artifact.validate(); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	// The default configuration of an artifact is the empty JSON object,
+	// which is also used as the only blob of an artifact without any blobs.
+	empty, err := PutBlob(ctx, engine, casext.MediaTypeEmptyJSON, bytes.NewReader(emptyJSON))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put empty config")
+	}
+	config := empty
+	if artifact.Config != nil {
+		config = *artifact.Config
+	}
+	blobs := append([]ispec.Descriptor{}, artifact.Blobs...)
+	if len(blobs) == 0 {
+		blobs = append(blobs, empty)
+	}
+
+	manifest := artifactManifest{
+		Manifest: ispec.Manifest{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Config:      config,
+			Layers:      blobs,
+			Annotations: copyAnnotations(artifact.Annotations),
+		},
+		MediaType:    ispec.MediaTypeImageManifest,
+		ArtifactType: artifact.ArtifactType,
+		Subject:      subject,
+	}
+
+	manifestDigest, manifestSize, err := casext.NewEngine(engine).PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put artifact manifest")
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}, nil
+}
+
+// Attach attaches an artifact to the image. When the image is committed, an
+// artifact manifest whose subject is the new image manifest is created (see
+// PutArtifact), and its descriptor is added (without a reference name) to
+// the top-level index of the image, which is where referrers are stored in
+// an OCI image layout.
+func (m *Mutator) Attach(ctx context.Context, artifact Artifact) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := artifact.validate(); err != nil {
+		return err
+	}
+	if artifact.Config != nil {
+		config := *artifact.Config
+		artifact.Config = &config
+	}
+	artifact.Blobs = append([]ispec.Descriptor{}, artifact.Blobs...)
+	artifact.Annotations = copyAnnotations(artifact.Annotations)
+	m.artifacts = append(m.artifacts, artifact)
+	return nil
+}
+
+// commitArtifacts creates the artifact manifests of the artifacts attached
+// with Attach, with the given manifest as their subject, and adds them to the
+// top-level index.
+func (m *Mutator) commitArtifacts(ctx context.Context, subject ispec.Descriptor) error {
+	if len(m.artifacts) == 0 {
+		return nil
+	}
+
+	var descriptors []ispec.Descriptor
+	for idx, artifact := range m.artifacts {
+		descriptor, err := PutArtifact(ctx, m.engine, subject, artifact)
+		if err != nil {
+			return errors.Wrapf(err, "put artifact %d", idx)
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+
+	index, err := m.engine.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+	index.Manifests = append(index.Manifests, descriptors...)
+	if err := m.engine.PutIndex(ctx, index); err != nil {
+		return errors.Wrap(err, "put top-level index")
+	}
+	m.artifacts = nil
+	return nil
+}
@@ -0,0 +1,512 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Batch stages a sequence of modifications of an image layout, so that their
+// effect can be inspected (see Diff) before any of them are applied to the
+// image. Modifications are made using the cas.Engine returned by Engine (for
+// instance by creating Mutators with it and updating references with a
+// casext.Engine wrapping it). New blobs and index changes are only stored in
+// a staging area until Apply is called, and are discarded by Close.
+type Batch struct {
+	engine cas.Engine
+	staged *stagingEngine
+
+	// base is the top-level index of the image when the batch was created,
+	// which is used to detect concurrent modifications.
+	base ispec.Index
+}
+
+// NewBatch creates a new Batch which stages modifications of the given
+// engine. The caller must Close the batch once it is done with it.
+func NewBatch(ctx context.Context, engine cas.Engine) (*Batch, error) {
+	base, err := engine.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	tempDir, err := ioutil.TempDir("", "umoci-batch-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create staging directory")
+	}
+	return &Batch{
+		engine: engine,
+		staged: &stagingEngine{
+			engine: engine,
+			path:   tempDir,
+			blobs:  map[digest.Digest]int64{},
+		},
+		base: base,
+	}, nil
+}
+
+// Engine returns the cas.Engine which stages modifications for the batch.
+// Reads see the staged modifications on top of the underlying image.
+func (b *Batch) Engine() cas.Engine {
+	return b.staged
+}
+
+// Apply stores the staged blobs in the underlying image and then updates its
+// top-level index, so that the image is only modified once all of the blobs
+// the new index references are present. An error is returned if the index of
+// the image has been modified since the batch was created. The staging area
+// is emptied, so further modifications can be staged afterwards.
+func (b *Batch) Apply(ctx context.Context) error {
+	b.staged.mu.Lock()
+	defer b.staged.mu.Unlock()
+
+	if b.staged.index != nil {
+		current, err := b.engine.GetIndex(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get top-level index")
+		}
+		if !reflect.DeepEqual(current, b.base) {
+			return errors.Errorf("top-level index was modified concurrently")
+		}
+	}
+
+	for blobDigest := range b.staged.blobs {
+		if err := b.applyBlob(ctx, blobDigest); err != nil {
+			return errors.Wrapf(err, "apply blob %s", blobDigest)
+		}
+	}
+	b.staged.blobs = map[digest.Digest]int64{}
+
+	if b.staged.index != nil {
+		if err := b.engine.PutIndex(ctx, *b.staged.index); err != nil {
+			return errors.Wrap(err, "put top-level index")
+		}
+		b.base = *b.staged.index
+		b.staged.index = nil
+	}
+	return nil
+}
+
+func (b *Batch) applyBlob(ctx context.Context, blobDigest digest.Digest) error {
+	fh, err := os.Open(b.staged.blobPath(blobDigest))
+	if err != nil {
+		return errors.Wrap(err, "open staged blob")
+	}
+	defer fh.Close()
+
+	newDigest, _, err := b.engine.PutBlob(ctx, fh)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if newDigest != blobDigest {
+		return errors.Errorf("[internal error] staged blob changed digest to %s", newDigest)
+	}
+	return os.Remove(fh.Name())
+}
+
+// Close discards any modifications which have not been applied, and releases
+// the staging area. The underlying engine is not closed.
+func (b *Batch) Close() error {
+	return b.staged.Close()
+}
+
+// BatchDiff describes the modifications staged in a Batch.
+type BatchDiff struct {
+	// References are the references (in the top-level index) which are
+	// created, modified or removed by the batch, sorted by name.
+	References []ReferenceDiff `json:"references"`
+
+	// Blobs are the new blobs which the batch adds to the image. The media
+	// type of each blob is only included if it is referenced by one of the
+	// new references.
+	Blobs []ispec.Descriptor `json:"blobs"`
+}
+
+// ReferenceDiff describes the modification of a single reference.
+type ReferenceDiff struct {
+	// Name is the name of the reference.
+	Name string `json:"name"`
+
+	// Old and New are the descriptors of the reference before and after the
+	// batch is applied (which are nil if the reference is created or
+	// removed).
+	Old *ispec.Descriptor `json:"old,omitempty"`
+	New *ispec.Descriptor `json:"new,omitempty"`
+
+	// Manifests are the modifications of the image manifests referenced by
+	// the reference, which are matched up by their position.
+	Manifests []ManifestDiff `json:"manifests,omitempty"`
+}
+
+// ManifestDiff describes the modification of a single image manifest.
+type ManifestDiff struct {
+	// Old and New are the descriptors of the manifest before and after the
+	// batch is applied (which are nil if there is no such manifest).
+	Old *ispec.Descriptor `json:"old,omitempty"`
+	New *ispec.Descriptor `json:"new,omitempty"`
+
+	// Manifest and Config are JSON merge patches (see PatchConfig) which
+	// transform the old manifest and image configuration into the new ones.
+	// They are omitted if there are no changes.
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"`
+}
+
+// Diff returns a description of the modifications which have been staged in
+// the batch, comparing the references in the top-level index of the staged
+// image with those of the underlying image.
+func (b *Batch) Diff(ctx context.Context) (BatchDiff, error) {
+	oldEngine := casext.NewEngine(b.engine)
+	newEngine := casext.NewEngine(b.staged)
+
+	oldIndex, err := oldEngine.GetIndex(ctx)
+	if err != nil {
+		return BatchDiff{}, errors.Wrap(err, "get old top-level index")
+	}
+	newIndex, err := newEngine.GetIndex(ctx)
+	if err != nil {
+		return BatchDiff{}, errors.Wrap(err, "get new top-level index")
+	}
+	oldRefs := indexReferences(oldIndex)
+	newRefs := indexReferences(newIndex)
+
+	var names []string
+	for name := range oldRefs {
+		names = append(names, name)
+	}
+	for name := range newRefs {
+		if _, ok := oldRefs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diff := BatchDiff{
+		References: []ReferenceDiff{},
+		Blobs:      []ispec.Descriptor{},
+	}
+	mediaTypes := map[digest.Digest]string{}
+	for _, name := range names {
+		oldRef, newRef := oldRefs[name], newRefs[name]
+		if oldRef != nil && newRef != nil && reflect.DeepEqual(*oldRef, *newRef) {
+			continue
+		}
+		refDiff := ReferenceDiff{
+			Name: name,
+			Old:  oldRef,
+			New:  newRef,
+		}
+		oldPaths, err := resolveOptional(ctx, oldEngine, oldRef)
+		if err != nil {
+			return BatchDiff{}, errors.Wrapf(err, "resolve old %s", name)
+		}
+		newPaths, err := resolveOptional(ctx, newEngine, newRef)
+		if err != nil {
+			return BatchDiff{}, errors.Wrapf(err, "resolve new %s", name)
+		}
+		for idx := 0; idx < len(oldPaths) || idx < len(newPaths); idx++ {
+			var manifestDiff ManifestDiff
+			var oldManifest, newManifest, oldConfig, newConfig interface{}
+			if idx < len(oldPaths) {
+				descriptor := oldPaths[idx].Descriptor()
+				manifestDiff.Old = &descriptor
+				if oldManifest, oldConfig, _, err = manifestDocuments(ctx, oldEngine, descriptor); err != nil {
+					return BatchDiff{}, errors.Wrapf(err, "read old manifest %s", descriptor.Digest)
+				}
+			}
+			if idx < len(newPaths) {
+				var referenced []ispec.Descriptor
+				for _, descriptor := range newPaths[idx].Walk {
+					mediaTypes[descriptor.Digest] = descriptor.MediaType
+				}
+				descriptor := newPaths[idx].Descriptor()
+				manifestDiff.New = &descriptor
+				if newManifest, newConfig, referenced, err = manifestDocuments(ctx, newEngine, descriptor); err != nil {
+					return BatchDiff{}, errors.Wrapf(err, "read new manifest %s", descriptor.Digest)
+				}
+				for _, descriptor := range referenced {
+					mediaTypes[descriptor.Digest] = descriptor.MediaType
+				}
+			}
+			if manifestDiff.Manifest, err = diffDocuments(oldManifest, newManifest); err != nil {
+				return BatchDiff{}, errors.Wrap(err, "diff manifests")
+			}
+			if manifestDiff.Config, err = diffDocuments(oldConfig, newConfig); err != nil {
+				return BatchDiff{}, errors.Wrap(err, "diff configs")
+			}
+			refDiff.Manifests = append(refDiff.Manifests, manifestDiff)
+		}
+		diff.References = append(diff.References, refDiff)
+	}
+
+	for _, blob := range b.staged.stagedBlobs() {
+		blob.MediaType = mediaTypes[blob.Digest]
+		diff.Blobs = append(diff.Blobs, blob)
+	}
+	return diff, nil
+}
+
+// indexReferences returns the entries of the given index with a reference
+// name, by name. Only the last entry for each name is included.
+func indexReferences(index ispec.Index) map[string]*ispec.Descriptor {
+	refs := map[string]*ispec.Descriptor{}
+	for idx := range index.Manifests {
+		descriptor := index.Manifests[idx]
+		if name, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			refs[name] = &descriptor
+		}
+	}
+	return refs
+}
+
+// resolveOptional resolves the manifests referenced by the given descriptor,
+// if it is not nil.
+func resolveOptional(ctx context.Context, engine casext.Engine, descriptor *ispec.Descriptor) ([]casext.DescriptorPath, error) {
+	if descriptor == nil {
+		return nil, nil
+	}
+	return engine.ResolveDescriptor(ctx, *descriptor)
+}
+
+// manifestDocuments returns the JSON documents of the given manifest and of
+// its configuration (if it is an image manifest), as well as the descriptors
+// of the configuration and layers of the manifest.
+func manifestDocuments(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) (interface{}, interface{}, []ispec.Descriptor, error) {
+	manifest, err := blobDocument(ctx, engine, descriptor.Digest)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "read manifest")
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return manifest, nil, nil, nil
+	}
+	var parsed ispec.Manifest
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "encode manifest")
+	}
+	if err := json.Unmarshal(encoded, &parsed); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "parse manifest")
+	}
+	config, err := blobDocument(ctx, engine, parsed.Config.Digest)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "read config")
+	}
+	return manifest, config, append([]ispec.Descriptor{parsed.Config}, parsed.Layers...), nil
+}
+
+// blobDocument returns the JSON document stored in the given blob.
+func blobDocument(ctx context.Context, engine casext.Engine, blobDigest digest.Digest) (interface{}, error) {
+	blob, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	var document interface{}
+	if err := json.NewDecoder(blob).Decode(&document); err != nil {
+		return nil, errors.Wrap(err, "parse blob")
+	}
+	return document, nil
+}
+
+// diffDocuments returns the JSON merge patch which transforms the old
+// document into the new one, or nil if they are identical.
+func diffDocuments(old, new interface{}) (json.RawMessage, error) {
+	if reflect.DeepEqual(old, new) {
+		return nil, nil
+	}
+	return json.Marshal(createMergePatch(old, new))
+}
+
+// createMergePatch returns a JSON merge patch (as defined in RFC 7386) which
+// transforms the old value into the new value, which must differ.
+func createMergePatch(old, new interface{}) interface{} {
+	oldObject, oldOk := old.(map[string]interface{})
+	newObject, newOk := new.(map[string]interface{})
+	if !oldOk || !newOk {
+		return new
+	}
+	patch := map[string]interface{}{}
+	for key, oldValue := range oldObject {
+		newValue, ok := newObject[key]
+		if !ok {
+			patch[key] = nil
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			patch[key] = createMergePatch(oldValue, newValue)
+		}
+	}
+	for key, newValue := range newObject {
+		if _, ok := oldObject[key]; !ok {
+			patch[key] = newValue
+		}
+	}
+	return patch
+}
+
+// stagingEngine is a cas.Engine which stores new blobs and index changes in a
+// staging directory, while reading everything else from the underlying
+// engine.
+type stagingEngine struct {
+	engine cas.Engine
+	path   string
+
+	mu    sync.Mutex
+	blobs map[digest.Digest]int64
+	index *ispec.Index
+}
+
+func (e *stagingEngine) blobPath(blobDigest digest.Digest) string {
+	return filepath.Join(e.path, blobDigest.Algorithm().String()+"-"+blobDigest.Hex())
+}
+
+// PutBlob stores the blob in the staging directory, unless the underlying
+// engine already contains it.
+func (e *stagingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	fh, err := ioutil.TempFile(e.path, "blob-")
+	if err != nil {
+		return "", -1, errors.Wrap(err, "create staged blob")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	digester := cas.BlobAlgorithm.Digester()
+	size, err := io.Copy(io.MultiWriter(fh, digester.Hash()), reader)
+	if err != nil {
+		return "", -1, errors.Wrap(err, "copy to staged blob")
+	}
+	if err := fh.Close(); err != nil {
+		return "", -1, errors.Wrap(err, "close staged blob")
+	}
+	blobDigest := digester.Digest()
+
+	if blob, err := e.engine.GetBlob(ctx, blobDigest); err == nil {
+		// The blob doesn't need to be staged.
+		blob.Close()
+		return blobDigest, size, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := os.Rename(fh.Name(), e.blobPath(blobDigest)); err != nil {
+		return "", -1, errors.Wrap(err, "rename staged blob")
+	}
+	e.blobs[blobDigest] = size
+	return blobDigest, size, nil
+}
+
+// GetBlob returns the staged blob with the given digest, or the blob in the
+// underlying engine if it hasn't been staged.
+func (e *stagingEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	e.mu.Lock()
+	_, staged := e.blobs[blobDigest]
+	e.mu.Unlock()
+	if staged {
+		fh, err := os.Open(e.blobPath(blobDigest))
+		return fh, errors.Wrap(err, "open staged blob")
+	}
+	return e.engine.GetBlob(ctx, blobDigest)
+}
+
+// PutIndex stages the new index.
+func (e *stagingEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.index = &index
+	return nil
+}
+
+// GetIndex returns the staged index, or the index of the underlying engine if
+// no index has been staged.
+func (e *stagingEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	e.mu.Lock()
+	index := e.index
+	e.mu.Unlock()
+	if index != nil {
+		return *index, nil
+	}
+	return e.engine.GetIndex(ctx)
+}
+
+// DeleteBlob is not supported while staging modifications, since deletions
+// cannot be previewed.
+func (e *stagingEngine) DeleteBlob(ctx context.Context, blobDigest digest.Digest) error {
+	return errors.Wrap(cas.ErrNotImplemented, "delete blob in batch")
+}
+
+// ListBlobs returns the blobs of the underlying engine and the staged blobs.
+func (e *stagingEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	digests, err := e.engine.ListBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for blobDigest := range e.blobs {
+		digests = append(digests, blobDigest)
+	}
+	return digests, nil
+}
+
+// stagedBlobs returns the descriptors of the staged blobs, sorted by digest.
+func (e *stagingEngine) stagedBlobs() []ispec.Descriptor {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var blobs []ispec.Descriptor
+	for blobDigest, size := range e.blobs {
+		blobs = append(blobs, ispec.Descriptor{
+			Digest: blobDigest,
+			Size:   size,
+		})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Digest < blobs[j].Digest
+	})
+	return blobs
+}
+
+// Clean does nothing, since the staging directory only contains staged blobs.
+func (e *stagingEngine) Clean(ctx context.Context) error {
+	return nil
+}
+
+// Close removes the staging directory.
+func (e *stagingEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.blobs = map[digest.Digest]int64{}
+	e.index = nil
+	if err := os.RemoveAll(e.path); err != nil {
+		return errors.Wrap(err, "remove staging directory")
+	}
+	log.Debugf("batch: discarded staging directory %s", e.path)
+	return nil
+}
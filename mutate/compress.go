@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compressor is used to compress layers added to an image.
+type Compressor interface {
+	// MediaType returns the (distributable) layer media type of the blobs
+	// produced by the compressor.
+	MediaType() string
+
+	// Compress reads the uncompressed layer from r and writes the compressed
+	// layer to w. It returns the DiffID of the layer (the digest of the
+	// uncompressed contents of the blob, which need not be identical to the
+	// contents of r) and any annotations to set on the layer descriptor.
+	Compress(w io.Writer, r io.Reader) (digest.Digest, map[string]string, error)
+}
+
+// GzipCompressor is the default Compressor, which compresses the layer as a
+// single gzip stream.
+var GzipCompressor Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+// MediaType implements Compressor.
+func (gzipCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+// Compress implements Compressor.
+func (gzipCompressor) Compress(w io.Writer, r io.Reader) (digest.Digest, map[string]string, error) {
+	diffidDigester := cas.BlobAlgorithm.Digester()
+
+	// The gzip header must not contain any timestamps or names, so that the
+	// compressed blob only depends on the layer contents.
+	gzw := gzip.NewWriter(w)
+	gzw.Header = gzip.Header{OS: gzw.Header.OS}
+
+	// The uncompressed stream is hashed as it is compressed.
+	if _, err := io.Copy(io.MultiWriter(gzw, diffidDigester.Hash()), r); err != nil {
+		return "", nil, errors.Wrap(err, "compressing layer")
+	}
+	if err := gzw.Close(); err != nil {
+		return "", nil, errors.Wrap(err, "close gzip writer")
+	}
+	return diffidDigester.Digest(), nil, nil
+}
+
+// ZstdCompressor is a Compressor which compresses the layer as a single zstd
+// stream, using the zstd layer media types.
+var ZstdCompressor Compressor = zstdCompressor{}
+
+type zstdCompressor struct{}
+
+// MediaType implements Compressor.
+func (zstdCompressor) MediaType() string {
+	return casext.MediaTypeImageLayerZstd
+}
+
+// Compress implements Compressor.
+func (zstdCompressor) Compress(w io.Writer, r io.Reader) (digest.Digest, map[string]string, error) {
+	diffidDigester := cas.BlobAlgorithm.Digester()
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create zstd writer")
+	}
+
+	// The uncompressed stream is hashed as it is compressed.
+	if _, err := io.Copy(io.MultiWriter(zw, diffidDigester.Hash()), r); err != nil {
+		zw.Close()
+		return "", nil, errors.Wrap(err, "compressing layer")
+	}
+	if err := zw.Close(); err != nil {
+		return "", nil, errors.Wrap(err, "close zstd writer")
+	}
+	return diffidDigester.Digest(), nil, nil
+}
+
+// nonDistributableMediaType returns the non-distributable equivalent of the
+// given distributable layer media type.
+func nonDistributableMediaType(mediaType string) string {
+	return ispec.MediaTypeImageLayerNonDistributable + strings.TrimPrefix(mediaType, ispec.MediaTypeImageLayer)
+}
+
+// newDecompressor returns a reader for the uncompressed contents of a layer
+// blob with the given media type, read from r. Only the gzip, zstd and
+// uncompressed OCI layer types are supported.
+func newDecompressor(mediaType string, r io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	case casext.MediaTypeImageLayerZstd, casext.MediaTypeImageLayerNonDistributableZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd reader")
+		}
+		return zr.IOReadCloser(), nil
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, errors.Errorf("unsupported layer media type %q", mediaType)
+}
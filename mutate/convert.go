@@ -0,0 +1,273 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"reflect"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Format is a set of media type conventions that an image can be converted
+// to with Convert.
+type Format int
+
+const (
+	// FormatOCI uses the media types of the OCI image-spec.
+	FormatOCI Format = iota
+
+	// FormatDocker uses the media types of Docker's image manifest schema
+	// version 2.
+	FormatDocker
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatOCI:
+		return "oci"
+	case FormatDocker:
+		return "docker"
+	}
+	return "unknown"
+}
+
+// ParseFormat returns the Format with the given name (as returned by
+// Format.String).
+func ParseFormat(name string) (Format, error) {
+	for _, format := range []Format{FormatOCI, FormatDocker} {
+		if name == format.String() {
+			return format, nil
+		}
+	}
+	return 0, errors.Errorf("unknown format %q", name)
+}
+
+// Each of the media types which differ between the formats, in the order
+// FormatOCI, FormatDocker.
+var formatMediaTypes = [][2]string{
+	{ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest},
+	{ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList},
+	{ispec.MediaTypeImageConfig, casext.MediaTypeDockerConfig},
+	{ispec.MediaTypeImageLayer, casext.MediaTypeDockerLayer},
+	{ispec.MediaTypeImageLayerGzip, casext.MediaTypeDockerLayerGzip},
+	{ispec.MediaTypeImageLayerNonDistributable, casext.MediaTypeDockerForeignLayer},
+	{ispec.MediaTypeImageLayerNonDistributableGzip, casext.MediaTypeDockerForeignLayerGzip},
+}
+
+// convertMediaType returns the equivalent of the given media type in the
+// given format.
+func convertMediaType(mediaType string, format Format) (string, error) {
+	for _, mediaTypes := range formatMediaTypes {
+		for _, candidate := range mediaTypes {
+			if candidate == mediaType {
+				return mediaTypes[format], nil
+			}
+		}
+	}
+	return "", errors.Errorf("unsupported media type %q", mediaType)
+}
+
+// The Docker manifest and manifest list blobs must contain their media type,
+// which the ispec types have no field for.
+
+type manifestBlob struct {
+	ispec.Manifest
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+type indexBlob struct {
+	ispec.Index
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// converter stores the state of a single Convert operation.
+type converter struct {
+	engine casext.Engine
+	format Format
+
+	// converted maps the digests of blobs which have already been converted
+	// to the digest and size of the converted blob, so that blobs referenced
+	// several times are only converted once.
+	converted map[digest.Digest]ispec.Descriptor
+}
+
+// Convert rewrites the media types of the image manifest or image index
+// referenced by the given descriptor (and every manifest, index, config and
+// layer it references) to use the conventions of the given format. In
+// particular, OCI image indexes are converted to and from Docker manifest
+// lists. No layer or configuration blobs are modified, only the blobs
+// describing them. The descriptor of the converted blob is returned, with any
+// other fields (such as annotations) of the given descriptor preserved.
+//
+// Note that most of umoci only supports images using the OCI format, so
+// images should be converted to the Docker format as the last step before
+// they are used.
+func Convert(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor, format Format) (ispec.Descriptor, error) {
+	c := &converter{
+		engine:    casext.NewEngine(engine),
+		format:    format,
+		converted: map[digest.Digest]ispec.Descriptor{},
+	}
+	return c.convert(ctx, descriptor)
+}
+
+func (c *converter) convert(ctx context.Context, descriptor ispec.Descriptor) (ispec.Descriptor, error) {
+	mediaType, err := convertMediaType(descriptor.MediaType, c.format)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	switch mediaType {
+	case ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest,
+		ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList:
+	default:
+		// Only the media type of other blobs needs to be changed.
+		descriptor.MediaType = mediaType
+		return descriptor, nil
+	}
+
+	if converted, ok := c.converted[descriptor.Digest]; ok {
+		descriptor.MediaType = converted.MediaType
+		descriptor.Digest = converted.Digest
+		descriptor.Size = converted.Size
+		return descriptor, nil
+	}
+
+	var (
+		data    interface{}
+		changed bool
+	)
+	if mediaType == ispec.MediaTypeImageManifest || mediaType == casext.MediaTypeDockerManifest {
+		manifest, manifestChanged, err := c.manifest(ctx, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "convert manifest %s", descriptor.Digest)
+		}
+		data, changed = manifest, manifestChanged
+	} else {
+		index, indexChanged, err := c.index(ctx, descriptor)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "convert index %s", descriptor.Digest)
+		}
+		data, changed = index, indexChanged
+	}
+
+	// Blobs which already use the format are left as-is, so that converting
+	// an image to the format it already uses doesn't change its digest.
+	if !changed && mediaType == descriptor.MediaType {
+		c.converted[descriptor.Digest] = ispec.Descriptor{
+			MediaType: descriptor.MediaType,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+		}
+		return descriptor, nil
+	}
+
+	blobDigest, blobSize, err := c.engine.PutBlobJSON(ctx, data)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put converted blob")
+	}
+	log.WithFields(log.Fields{
+		"from": descriptor.Digest,
+		"to":   blobDigest,
+	}).Debugf("convert: converted %s to %s", descriptor.MediaType, mediaType)
+
+	c.converted[descriptor.Digest] = ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      blobSize,
+	}
+	descriptor.MediaType = mediaType
+	descriptor.Digest = blobDigest
+	descriptor.Size = blobSize
+	return descriptor, nil
+}
+
+// manifest returns the converted manifest referenced by the descriptor, and
+// whether any of the descriptors it contains were modified.
+func (c *converter) manifest(ctx context.Context, descriptor ispec.Descriptor) (manifestBlob, bool, error) {
+	blob, err := c.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return manifestBlob{}, false, errors.Wrap(err, "get manifest")
+	}
+	defer blob.Close()
+	manifest := blob.Data.(ispec.Manifest)
+	original := manifest
+
+	if manifest.Config, err = c.convert(ctx, manifest.Config); err != nil {
+		return manifestBlob{}, false, errors.Wrap(err, "convert config")
+	}
+	var layers []ispec.Descriptor
+	for idx, layer := range manifest.Layers {
+		if layer, err = c.convert(ctx, layer); err != nil {
+			return manifestBlob{}, false, errors.Wrapf(err, "convert layer %d", idx)
+		}
+		layers = append(layers, layer)
+	}
+	manifest.Layers = layers
+
+	converted := manifestBlob{Manifest: manifest}
+	if c.format == FormatDocker {
+		converted.MediaType = casext.MediaTypeDockerManifest
+	}
+	changed := !reflect.DeepEqual(original.Config, manifest.Config) || !reflect.DeepEqual(original.Layers, manifest.Layers)
+	return converted, changed, nil
+}
+
+// index returns the converted index referenced by the descriptor, and
+// whether any of the descriptors it contains were modified.
+func (c *converter) index(ctx context.Context, descriptor ispec.Descriptor) (indexBlob, bool, error) {
+	blob, err := c.engine.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return indexBlob{}, false, errors.Wrap(err, "get index")
+	}
+	defer blob.Close()
+	index := blob.Data.(ispec.Index)
+	original := index
+
+	var manifests []ispec.Descriptor
+	for idx, manifest := range index.Manifests {
+		// Docker manifest lists may only contain manifests for a particular
+		// platform.
+		if c.format == FormatDocker {
+			if manifest.Platform == nil || manifest.Platform.OS == "" || manifest.Platform.Architecture == "" {
+				return indexBlob{}, false, errors.Errorf("entry %d has no platform, which is required by manifest lists", idx)
+			}
+			if manifest.MediaType != ispec.MediaTypeImageManifest && manifest.MediaType != casext.MediaTypeDockerManifest {
+				return indexBlob{}, false, errors.Errorf("entry %d is not an image manifest, which is required by manifest lists", idx)
+			}
+		}
+		if manifest, err = c.convert(ctx, manifest); err != nil {
+			return indexBlob{}, false, errors.Wrapf(err, "convert entry %d", idx)
+		}
+		manifests = append(manifests, manifest)
+	}
+	index.Manifests = manifests
+
+	converted := indexBlob{Index: index}
+	if c.format == FormatDocker {
+		converted.MediaType = casext.MediaTypeDockerManifestList
+	}
+	return converted, !reflect.DeepEqual(original.Manifests, index.Manifests), nil
+}
@@ -0,0 +1,191 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// dedupeKey identifies layers which can share a blob.
+type dedupeKey struct {
+	diffID           digest.Digest
+	nonDistributable bool
+}
+
+// Deduplicate finds layers in the image layout which have the same DiffID
+// (and are equally distributable) but are stored as different blobs, such as
+// layers which were compressed with different settings. Every manifest in
+// the layout is then rewritten to reference a single canonical blob (the
+// smallest one) for each such layer, and every entry in the top-level index is
+// updated to refer to the rewritten manifests. It returns the number of layer
+// references which were replaced.
+//
+// Only the manifests are modified, so the blobs which are no longer referenced
+// remain in the layout until they are removed with casext.Engine.GC.
+func Deduplicate(ctx context.Context, engine cas.Engine) (int, error) {
+	engineExt := casext.NewEngine(engine)
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "get top-level index")
+	}
+
+	// Find the canonical blob for each layer.
+	canonical := map[dedupeKey]ispec.Descriptor{}
+	for _, root := range index.Manifests {
+		descriptorPaths, err := engineExt.ResolveDescriptor(ctx, root)
+		if err != nil {
+			return 0, errors.Wrapf(err, "resolve %s", root.Digest)
+		}
+		for _, descriptorPath := range descriptorPaths {
+			if descriptorPath.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+				continue
+			}
+			mutator, err := New(engine, descriptorPath)
+			if err != nil {
+				return 0, errors.Wrap(err, "create mutator for manifest")
+			}
+			if err := mutator.cache(ctx); err != nil {
+				return 0, errors.Wrapf(err, "read manifest %s", descriptorPath.Descriptor().Digest)
+			}
+			if len(mutator.config.RootFS.DiffIDs) != len(mutator.manifest.Layers) {
+				log.Warnf("dedupe: skipping manifest %s: number of diff_ids does not match number of layers", descriptorPath.Descriptor().Digest)
+				continue
+			}
+			for idx, layer := range mutator.manifest.Layers {
+				key, ok := layerDedupeKey(layer, mutator.config.RootFS.DiffIDs[idx])
+				if !ok {
+					continue
+				}
+				if current, ok := canonical[key]; !ok || layer.Size < current.Size ||
+					(layer.Size == current.Size && layer.Digest < current.Digest) {
+					canonical[key] = layer
+				}
+			}
+		}
+	}
+
+	// The canonical blobs must actually have the DiffID they replace, which
+	// is only checked once for each blob.
+	for key, layer := range canonical {
+		diffID, err := layerDiffID(ctx, engine, layer)
+		if err != nil {
+			return 0, errors.Wrapf(err, "verify layer %s", layer.Digest)
+		}
+		if diffID != key.diffID {
+			log.Warnf("dedupe: ignoring layer %s: diff_id is %s but image configuration claims %s", layer.Digest, diffID, key.diffID)
+			delete(canonical, key)
+		}
+	}
+
+	// Rewrite every manifest which doesn't use the canonical blobs.
+	var replaced int
+	var modified bool
+	for rootIdx, root := range index.Manifests {
+		descriptorPaths, err := engineExt.ResolveDescriptor(ctx, root)
+		if err != nil {
+			return 0, errors.Wrapf(err, "resolve %s", root.Digest)
+		}
+		for pathIdx := range descriptorPaths {
+			// Each commit modifies the root, so the paths have to be
+			// resolved again from the new root.
+			descriptorPaths, err := engineExt.ResolveDescriptor(ctx, root)
+			if err != nil {
+				return 0, errors.Wrapf(err, "resolve %s", root.Digest)
+			}
+			descriptorPath := descriptorPaths[pathIdx]
+			if descriptorPath.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+				continue
+			}
+
+			mutator, err := New(engine, descriptorPath)
+			if err != nil {
+				return 0, errors.Wrap(err, "create mutator for manifest")
+			}
+			if err := mutator.cache(ctx); err != nil {
+				return 0, errors.Wrapf(err, "read manifest %s", descriptorPath.Descriptor().Digest)
+			}
+			if len(mutator.config.RootFS.DiffIDs) != len(mutator.manifest.Layers) {
+				continue
+			}
+
+			var changed bool
+			for idx, layer := range mutator.manifest.Layers {
+				diffID := mutator.config.RootFS.DiffIDs[idx]
+				key, ok := layerDedupeKey(layer, diffID)
+				if !ok {
+					continue
+				}
+				target, ok := canonical[key]
+				if !ok || target.Digest == layer.Digest {
+					continue
+				}
+				log.Debugf("dedupe: replacing layer %s with %s in manifest %s", layer.Digest, target.Digest, descriptorPath.Descriptor().Digest)
+				if err := mutator.splice(idx, idx, &target, diffID, nil); err != nil {
+					return 0, errors.Wrapf(err, "replace layer %d", idx)
+				}
+				changed = true
+				replaced++
+			}
+			if !changed {
+				continue
+			}
+
+			newPath, err := mutator.Commit(ctx)
+			if err != nil {
+				return 0, errors.Wrap(err, "commit deduplicated manifest")
+			}
+			root = newPath.Root()
+		}
+		if root.Digest != index.Manifests[rootIdx].Digest {
+			index.Manifests[rootIdx] = root
+			modified = true
+		}
+	}
+
+	if modified {
+		if err := engineExt.PutIndex(ctx, index); err != nil {
+			return 0, errors.Wrap(err, "put top-level index")
+		}
+	}
+	return replaced, nil
+}
+
+// layerDedupeKey returns the key of the given layer, and whether the layer
+// can be deduplicated at all (only layers with media types known to umoci can
+// be replaced).
+func layerDedupeKey(layer ispec.Descriptor, diffID digest.Digest) (dedupeKey, bool) {
+	switch layer.MediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip, casext.MediaTypeImageLayerZstd,
+		ispec.MediaTypeImageLayerNonDistributable, ispec.MediaTypeImageLayerNonDistributableGzip, casext.MediaTypeImageLayerNonDistributableZstd:
+	default:
+		return dedupeKey{}, false
+	}
+	return dedupeKey{
+		diffID:           diffID,
+		nonDistributable: strings.HasPrefix(layer.MediaType, ispec.MediaTypeImageLayerNonDistributable),
+	}, true
+}
@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// HealthConfig describes how the health of a container is checked. It is
+// identical to the HealthConfig used by Docker.
+type HealthConfig struct {
+	// Test is the test to run, which is either [] (inherit the test from the
+	// parent image), ["NONE"] (disable the healthcheck), ["CMD", args...]
+	// (run args directly) or ["CMD-SHELL", command] (run command using the
+	// image's shell).
+	Test []string `json:",omitempty"`
+
+	// Interval is the time to wait between checks.
+	Interval time.Duration `json:",omitempty"`
+
+	// Timeout is the time to wait before considering a check to have hung.
+	Timeout time.Duration `json:",omitempty"`
+
+	// StartPeriod is the time for the container to start before failed
+	// checks count towards the number of retries.
+	StartPeriod time.Duration `json:",omitempty"`
+
+	// Retries is the number of consecutive failures needed to consider the
+	// container unhealthy.
+	Retries int `json:",omitempty"`
+}
+
+// DockerConfig is the set of fields of a Docker image configuration which
+// have no equivalent in an OCI image configuration. These are stored in the
+// "config" section of the image configuration using the same names as
+// Docker, which makes them available to Docker-compatible consumers. OCI
+// consumers ignore unknown fields, so they have no effect on OCI runtimes.
+type DockerConfig struct {
+	// Healthcheck describes how to check that the container is healthy.
+	Healthcheck *HealthConfig `json:"Healthcheck,omitempty"`
+
+	// Shell is the shell used for shell-form commands (such as
+	// ["/bin/sh", "-c"]).
+	Shell []string `json:"Shell,omitempty"`
+
+	// OnBuild is the set of build instructions to run when the image is used
+	// as the base of another image.
+	OnBuild []string `json:"OnBuild,omitempty"`
+}
+
+// dockerImage is an ispec.Image which also includes the DockerConfig fields
+// in its "config" section.
+type dockerImage struct {
+	ispec.Image
+	Config dockerImageConfig `json:"config,omitempty"`
+}
+
+type dockerImageConfig struct {
+	ispec.ImageConfig
+	DockerConfig
+}
+
+// cacheDocker loads the DockerConfig fields from the source configuration
+// blob, which are otherwise dropped when the blob is parsed as an
+// ispec.Image.
+func (m *Mutator) cacheDocker(ctx context.Context) error {
+	blob, err := m.engine.GetBlob(ctx, m.manifest.Config.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer blob.Close()
+
+	var image struct {
+		Config DockerConfig `json:"config"`
+	}
+	if err := json.NewDecoder(blob).Decode(&image); err != nil {
+		return errors.Wrap(err, "parse config blob")
+	}
+	m.docker = image.Config
+	return nil
+}
+
+// configBlob returns the value that should be stored as the configuration
+// blob. If there are no DockerConfig fields, this is the ispec.Image itself
+// (so that the blob is identical to one generated without DockerConfig
+// support).
+func (m *Mutator) configBlob() interface{} {
+	if reflect.DeepEqual(m.docker, DockerConfig{}) {
+		return m.config
+	}
+	return dockerImage{
+		Image: *m.config,
+		Config: dockerImageConfig{
+			ImageConfig:  m.config.Config,
+			DockerConfig: m.docker,
+		},
+	}
+}
+
+// DockerConfig returns the current (cached) Docker-specific configuration of
+// the image, which should be used as the source for any modifications using
+// SetDockerConfig.
+func (m *Mutator) DockerConfig(ctx context.Context) (DockerConfig, error) {
+	if err := m.cache(ctx); err != nil {
+		return DockerConfig{}, errors.Wrap(err, "getting cache failed")
+	}
+	return m.docker, nil
+}
+
+// SetDockerConfig sets the Docker-specific configuration of the image. Unlike
+// Set, no history entry is appended (callers will usually also call Set).
+func (m *Mutator) SetDockerConfig(ctx context.Context, docker DockerConfig) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	m.docker = docker
+	return nil
+}
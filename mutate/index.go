@@ -0,0 +1,315 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"reflect"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// IndexMutator is a wrapper around an image index, which allows the entries of
+// the index (such as the manifest for each platform of a multi-platform image)
+// to be modified. It is the image index equivalent of Mutator.
+type IndexMutator struct {
+	engine casext.Engine
+	source ispec.Descriptor
+	index  *ispec.Index
+}
+
+// NewIndex creates a new IndexMutator for the image index referenced by the
+// given descriptor.
+func NewIndex(engine cas.Engine, src ispec.Descriptor) (*IndexMutator, error) {
+	if src.MediaType != ispec.MediaTypeImageIndex {
+		return nil, errors.Errorf("unsupported source type: %s", src.MediaType)
+	}
+	return &IndexMutator{
+		engine: casext.NewEngine(engine),
+		source: src,
+	}, nil
+}
+
+// NewEmptyIndex creates a new IndexMutator for a new image index which has no
+// entries. The index is only added to the image when it is committed.
+func NewEmptyIndex(engine cas.Engine) *IndexMutator {
+	return &IndexMutator{
+		engine: casext.NewEngine(engine),
+		source: ispec.Descriptor{MediaType: ispec.MediaTypeImageIndex},
+		index: &ispec.Index{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+		},
+	}
+}
+
+// cache ensures that the cached version of the index is populated.
+func (m *IndexMutator) cache(ctx context.Context) error {
+	if m.index != nil {
+		return nil
+	}
+
+	blob, err := m.engine.FromDescriptor(ctx, m.source)
+	if err != nil {
+		return errors.Wrap(err, "get source")
+	}
+	defer blob.Close()
+
+	index, ok := blob.Data.(ispec.Index)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown index blob type: %s", blob.MediaType)
+	}
+	m.index = &index
+	return nil
+}
+
+// Index returns the current (cached) image index.
+func (m *IndexMutator) Index(ctx context.Context) (ispec.Index, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "getting cache failed")
+	}
+	index := *m.index
+	index.Manifests = append([]ispec.Descriptor{}, m.index.Manifests...)
+	return index, nil
+}
+
+// MatchPlatform returns whether the given descriptor is for the given
+// platform. If platform has no variant, the descriptor's variant is ignored.
+func MatchPlatform(descriptor ispec.Descriptor, platform ispec.Platform) bool {
+	if descriptor.Platform == nil {
+		return false
+	}
+	if descriptor.Platform.OS != platform.OS || descriptor.Platform.Architecture != platform.Architecture {
+		return false
+	}
+	return platform.Variant == "" || descriptor.Platform.Variant == platform.Variant
+}
+
+// ConfigPlatform returns the platform of the image manifest referenced by the
+// given descriptor, as described by its image configuration. Only the
+// operating system and architecture are known.
+func ConfigPlatform(ctx context.Context, engine cas.Engine, manifest ispec.Descriptor) (ispec.Platform, error) {
+	engineExt := casext.NewEngine(engine)
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, manifest)
+	if err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	if manifestBlob.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Platform{}, errors.Errorf("descriptor does not point to an image manifest: %s", manifestBlob.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifestBlob.Data.(ispec.Manifest).Config)
+	if err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return ispec.Platform{}, errors.Errorf("unsupported config media type: %s", configBlob.MediaType)
+	}
+	return ispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+	}, nil
+}
+
+// samePlatform returns whether the two platforms are identical.
+func samePlatform(a, b ispec.Platform) bool {
+	if len(a.OSFeatures) == 0 && len(b.OSFeatures) == 0 {
+		a.OSFeatures, b.OSFeatures = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// checkPlatform returns an error if the given platform is incomplete, or if
+// an entry of the index other than the one with the given index already has
+// the same platform.
+func (m *IndexMutator) checkPlatform(platform ispec.Platform, skip int) error {
+	if platform.OS == "" || platform.Architecture == "" {
+		return errors.Errorf("platform must have an os and architecture")
+	}
+	for idx, descriptor := range m.index.Manifests {
+		if idx != skip && descriptor.Platform != nil && samePlatform(*descriptor.Platform, platform) {
+			return errors.Errorf("index already has an entry for the platform (entry %d)", idx)
+		}
+	}
+	return nil
+}
+
+// Add adds the image manifest referenced by the given descriptor to the index,
+// as the manifest for the platform of the descriptor (which must be set, and
+// must differ from the platform of every other entry). The manifest must
+// already be in the image.
+func (m *IndexMutator) Add(ctx context.Context, manifest ispec.Descriptor) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if manifest.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Errorf("unsupported manifest media type: %s", manifest.MediaType)
+	}
+	if manifest.Platform == nil {
+		return errors.Errorf("manifest has no platform")
+	}
+	if err := m.checkPlatform(*manifest.Platform, -1); err != nil {
+		return err
+	}
+
+	// Make sure the manifest actually exists.
+	blob, err := m.engine.FromDescriptor(ctx, manifest)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	blob.Close()
+
+	platform := *manifest.Platform
+	platform.OSFeatures = append([]string{}, platform.OSFeatures...)
+	manifest.Platform = &platform
+	manifest.Annotations = copyAnnotations(manifest.Annotations)
+	m.index.Manifests = append(m.index.Manifests, manifest)
+	return nil
+}
+
+// Remove removes every entry of the index for the given platform (with the
+// same semantics as MatchPlatform), returning the number of removed entries.
+// An error is returned if there are no such entries.
+func (m *IndexMutator) Remove(ctx context.Context, platform ispec.Platform) (int, error) {
+	if err := m.cache(ctx); err != nil {
+		return 0, errors.Wrap(err, "getting cache failed")
+	}
+
+	var manifests []ispec.Descriptor
+	for _, descriptor := range m.index.Manifests {
+		if !MatchPlatform(descriptor, platform) {
+			manifests = append(manifests, descriptor)
+		}
+	}
+	removed := len(m.index.Manifests) - len(manifests)
+	if removed == 0 {
+		return 0, errors.Errorf("index has no entry for the platform")
+	}
+	m.index.Manifests = manifests
+	return removed, nil
+}
+
+// entry returns the index of the only entry of the index for the given
+// platform (with the same semantics as MatchPlatform).
+func (m *IndexMutator) entry(platform ispec.Platform) (int, error) {
+	entry := -1
+	for idx, descriptor := range m.index.Manifests {
+		if MatchPlatform(descriptor, platform) {
+			if entry >= 0 {
+				return -1, errors.Errorf("index has several entries for the platform (entries %d and %d)", entry, idx)
+			}
+			entry = idx
+		}
+	}
+	if entry < 0 {
+		return -1, errors.Errorf("index has no entry for the platform")
+	}
+	return entry, nil
+}
+
+// Platform returns the complete platform of the only entry of the index for
+// the given platform (with the same semantics as MatchPlatform).
+func (m *IndexMutator) Platform(ctx context.Context, match ispec.Platform) (ispec.Platform, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "getting cache failed")
+	}
+	entry, err := m.entry(match)
+	if err != nil {
+		return ispec.Platform{}, err
+	}
+	platform := *m.index.Manifests[entry].Platform
+	platform.OSFeatures = append([]string{}, platform.OSFeatures...)
+	return platform, nil
+}
+
+// SetPlatform replaces the platform of the only entry of the index for the
+// platform given as match (with the same semantics as MatchPlatform) with the
+// given platform, which must differ from the platform of every other entry.
+// This can be used to set optional fields such as the variant or OS version.
+func (m *IndexMutator) SetPlatform(ctx context.Context, match ispec.Platform, platform ispec.Platform) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	entry, err := m.entry(match)
+	if err != nil {
+		return err
+	}
+	if err := m.checkPlatform(platform, entry); err != nil {
+		return err
+	}
+	platform.OSFeatures = append([]string{}, platform.OSFeatures...)
+	m.index.Manifests[entry].Platform = &platform
+	return nil
+}
+
+// Annotations returns the annotations of the only entry of the index for the
+// given platform (with the same semantics as MatchPlatform).
+func (m *IndexMutator) Annotations(ctx context.Context, match ispec.Platform) (map[string]string, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+	entry, err := m.entry(match)
+	if err != nil {
+		return nil, err
+	}
+	return copyAnnotations(m.index.Manifests[entry].Annotations), nil
+}
+
+// SetAnnotations replaces the annotations of the only entry of the index for
+// the given platform (with the same semantics as MatchPlatform).
+func (m *IndexMutator) SetAnnotations(ctx context.Context, match ispec.Platform, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	entry, err := m.entry(match)
+	if err != nil {
+		return err
+	}
+	m.index.Manifests[entry].Annotations = copyAnnotations(annotations)
+	return nil
+}
+
+// Commit writes the modified image index to the image, and returns the
+// descriptor of the new index. The other fields (such as the annotations) of
+// the source descriptor are preserved.
+func (m *IndexMutator) Commit(ctx context.Context) (ispec.Descriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	indexDigest, indexSize, err := m.engine.PutBlobJSON(ctx, m.index)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "commit mutated index blob")
+	}
+
+	descriptor := m.source
+	descriptor.Digest = indexDigest
+	descriptor.Size = indexSize
+	descriptor.Annotations = copyAnnotations(m.source.Annotations)
+	return descriptor, nil
+}
@@ -23,8 +23,8 @@
 package mutate
 
 import (
-	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"time"
 
@@ -63,6 +63,21 @@ type Mutator struct {
 	// Cached values of the configuration and manifest.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// docker holds the Docker-specific fields of the configuration, which
+	// are not part of ispec.Image.
+	docker DockerConfig
+
+	// descriptorAnnotations are the annotations of the descriptor
+	// referencing the manifest, and indexAnnotations are the annotations of
+	// the index containing that descriptor (which are only set if they have
+	// been modified).
+	descriptorAnnotations map[string]string
+	indexAnnotations      *map[string]string
+
+	// artifacts are the artifacts attached with Attach, which are created
+	// when the image is committed.
+	artifacts []Artifact
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -106,9 +121,13 @@ func (m *Mutator) cache(ctx context.Context) error {
 
 		// Make a copy of the manifest.
 		m.manifest = manifestPtr(manifest)
+		m.descriptorAnnotations = copyAnnotations(m.source.Descriptor().Annotations)
 	}
 
 	if m.config == nil {
+		if mt := m.manifest.Config.MediaType; !casext.IsImageConfig(mt) {
+			return errors.Errorf("manifest is not an image: unsupported config media type %s", mt)
+		}
 		blob, err := m.engine.FromDescriptor(ctx, m.manifest.Config)
 		if err != nil {
 			return errors.Wrap(err, "cache source config")
@@ -123,6 +142,11 @@ func (m *Mutator) cache(ctx context.Context) error {
 
 		// Make a copy of the config and configDescriptor.
 		m.config = configPtr(config)
+
+		if err := m.cacheDocker(ctx); err != nil {
+			m.config = nil
+			return errors.Wrap(err, "cache source docker config")
+		}
 	}
 
 	return nil
@@ -188,10 +212,95 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// Manifest returns the current (cached) image manifest, including any layers
+// added (or replaced) by the Mutator.
+func (m *Mutator) Manifest(ctx context.Context) (ispec.Manifest, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	manifest := *m.manifest
+	manifest.Layers = append([]ispec.Descriptor{}, m.manifest.Layers...)
+	return manifest, nil
+}
+
+// copyAnnotations returns a copy of the given annotations (or nil if there are
+// no annotations).
+func copyAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	copied := map[string]string{}
+	for k, v := range annotations {
+		copied[k] = v
+	}
+	return copied
+}
+
+// DescriptorAnnotations returns the annotations of the descriptor referencing
+// the manifest (in its parent index), which should be used as the source for
+// any modifications using SetDescriptorAnnotations. Note that if the manifest
+// is referenced by the top-level index, these include the reference name of
+// the image.
+func (m *Mutator) DescriptorAnnotations(ctx context.Context) (map[string]string, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+	return copyAnnotations(m.descriptorAnnotations), nil
+}
+
+// SetDescriptorAnnotations sets the annotations of the descriptor referencing
+// the manifest. The descriptor returned by Commit will have these annotations.
+func (m *Mutator) SetDescriptorAnnotations(ctx context.Context, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	m.descriptorAnnotations = copyAnnotations(annotations)
+	return nil
+}
+
+// IndexAnnotations returns the annotations of the index which contains the
+// descriptor referencing the manifest, which should be used as the source for
+// any modifications using SetIndexAnnotations. If the manifest is referenced
+// by the top-level index of the image, its annotations are returned.
+func (m *Mutator) IndexAnnotations(ctx context.Context) (map[string]string, error) {
+	if m.indexAnnotations != nil {
+		return copyAnnotations(*m.indexAnnotations), nil
+	}
+	if len(m.source.Walk) < 2 {
+		index, err := m.engine.GetIndex(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get top-level index")
+		}
+		return copyAnnotations(index.Annotations), nil
+	}
+	blob, err := m.engine.FromDescriptor(ctx, m.source.Walk[len(m.source.Walk)-2])
+	if err != nil {
+		return nil, errors.Wrap(err, "get parent index")
+	}
+	defer blob.Close()
+	index, ok := blob.Data.(ispec.Index)
+	if !ok {
+		return nil, errors.Errorf("parent of manifest is not an index: %s", blob.MediaType)
+	}
+	return copyAnnotations(index.Annotations), nil
+}
+
+// SetIndexAnnotations sets the annotations of the index which contains the
+// descriptor referencing the manifest. If the manifest is referenced by the
+// top-level index of the image, the top-level index is modified in-place by
+// Commit (which affects every image in the layout).
+func (m *Mutator) SetIndexAnnotations(ctx context.Context, annotations map[string]string) error {
+	annotations = copyAnnotations(annotations)
+	m.indexAnnotations = &annotations
+	return nil
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
-// correspond to what operations were made to the configuration.
-func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta, annotations map[string]string, history ispec.History) error {
+// correspond to what operations were made to the configuration. If history is
+// nil, no history entry is appended.
+func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta, annotations map[string]string, history *ispec.History) error {
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
 	}
@@ -209,105 +318,519 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	m.config.OS = meta.OS
 
 	// Append history.
-	history.EmptyLayer = true
-	m.config.History = append(m.config.History, history)
+	if history != nil {
+		entry := *history
+		entry.EmptyLayer = true
+		m.config.History = append(m.config.History, entry)
+	}
 
 	return nil
 }
 
-// add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+// CreationOptions describes the creation time and author of an image, which
+// can be set with SetCreation.
+type CreationOptions struct {
+	// Created (if not nil) is the creation time of the image.
+	Created *time.Time
+
+	// Author (if not nil) is the author of the image.
+	Author *string
+
+	// Annotate specifies whether the org.opencontainers.image.created
+	// annotation of the manifest should be set to the creation time of the
+	// image (in RFC 3339 format).
+	Annotate bool
+}
+
+// SetCreation sets the creation time and author of the image (and optionally
+// the org.opencontainers.image.created annotation) to the given values, so
+// that they are controlled by the caller rather than inherited from the
+// original image. Unlike Set, no history entry is appended and no other part
+// of the configuration is modified. The creation times and authors of history
+// entries are not modified either, and should be set by the caller when
+// creating them.
+func (m *Mutator) SetCreation(ctx context.Context, opt CreationOptions) error {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return errors.Wrap(err, "getting cache failed")
 	}
 
-	diffidDigester := cas.BlobAlgorithm.Digester()
-	hashReader := io.TeeReader(reader, diffidDigester.Hash())
+	if opt.Created != nil {
+		m.config.Created = timePtr(*opt.Created)
+	}
+	if opt.Author != nil {
+		m.config.Author = *opt.Author
+	}
+	if opt.Annotate {
+		if m.config.Created == nil {
+			return errors.Errorf("cannot annotate the creation time of an image without one")
+		}
+		annotations := copyAnnotations(m.manifest.Annotations)
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[ispec.AnnotationCreated] = m.config.Created.UTC().Format(time.RFC3339Nano)
+		m.manifest.Annotations = annotations
+	}
+	return nil
+}
+
+// History returns a copy of the current (cached) history of the image, which
+// should be used as the source for any modifications using SetHistory.
+func (m *Mutator) History(ctx context.Context) ([]ispec.History, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+	return append([]ispec.History{}, m.config.History...), nil
+}
+
+// SetHistory replaces the history of the image with the given entries, which
+// allows for existing entries to be modified (such as to remove sensitive
+// information) without modifying any layers. Unless the history is empty, the
+// number of entries which are not empty layers must be equal to the number
+// of layers in the image (so that each layer keeps a history entry).
+func (m *Mutator) SetHistory(ctx context.Context, history []ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(history) > 0 {
+		var numLayers int
+		for _, entry := range history {
+			if !entry.EmptyLayer {
+				numLayers++
+			}
+		}
+		if numLayers != len(m.manifest.Layers) {
+			return errors.Errorf("history has %d non-empty entries but the image has %d layers", numLayers, len(m.manifest.Layers))
+		}
+	}
+	m.config.History = append([]ispec.History{}, history...)
+	return nil
+}
+
+// countWriter is an io.Writer which counts the number of bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// add adds the given layer to the CAS (compressed using the given
+// compressor), and mutates the configuration to include the diffID. The
+// returned values are the digest and size of the *compressed* layer, and any
+// annotations for its descriptor.
+func (m *Mutator) add(ctx context.Context, reader io.Reader, compressor Compressor) (digest.Digest, int64, map[string]string, error) {
+	if err := m.cache(ctx); err != nil {
+		return "", -1, nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	layerDescriptor, diffID, err := PutLayer(ctx, m.engine, reader, compressor)
+	if err != nil {
+		return "", -1, nil, err
+	}
+
+	// Add DiffID to configuration.
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffID)
+
+	return layerDescriptor.Digest, layerDescriptor.Size, layerDescriptor.Annotations, nil
+}
+
+// PutLayer compresses the given uncompressed layer using the given compressor
+// (GzipCompressor if nil) and adds it to the CAS, without adding it to any
+// image. It returns the descriptor of the compressed layer blob (with the
+// compressor's media type) and the layer's DiffID.
+//
+// The layer is only read once. The compressor computes the diffID while
+// compressing the stream, and the compressed stream is hashed (and counted) on
+// its way to the CAS, so the layer is never re-read to compute its digests.
+func PutLayer(ctx context.Context, engine cas.Engine, reader io.Reader, compressor Compressor) (ispec.Descriptor, digest.Digest, error) {
+	if compressor == nil {
+		compressor = GzipCompressor
+	}
 
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
+	blobDigester := cas.BlobAlgorithm.Digester()
+	blobCounter := &countWriter{}
+	blobWriter := io.MultiWriter(pipeWriter, blobDigester.Hash(), blobCounter)
+
+	type compressResult struct {
+		diffID      digest.Digest
+		annotations map[string]string
+	}
+	resultCh := make(chan compressResult, 1)
 	go func() {
-		_, err := io.Copy(gzw, hashReader)
+		diffID, annotations, err := compressor.Compress(blobWriter, reader)
 		if err != nil {
-			pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
+			pipeWriter.CloseWithError(err)
 			return
 		}
-		gzw.Close()
+		resultCh <- compressResult{diffID: diffID, annotations: annotations}
 		pipeWriter.Close()
 	}()
 
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
+	layerDigest, layerSize, err := engine.PutBlob(ctx, pipeReader)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return ispec.Descriptor{}, "", errors.Wrap(err, "put layer blob")
 	}
+	result := <-resultCh
 
-	// Add DiffID to configuration.
-	layerDiffID := diffidDigester.Digest()
-	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID)
+	// Make sure the engine stored exactly what we generated.
+	if layerDigest != blobDigester.Digest() || layerSize != blobCounter.n {
+		return ispec.Descriptor{}, "", errors.Errorf("put layer blob: engine stored %s (%d bytes) but generated %s (%d bytes)", layerDigest, layerSize, blobDigester.Digest(), blobCounter.n)
+	}
 
-	return layerDigest, layerSize, nil
+	return ispec.Descriptor{
+		MediaType:   compressor.MediaType(),
+		Digest:      layerDigest,
+		Size:        layerSize,
+		Annotations: result.annotations,
+	}, result.diffID, nil
 }
 
-// Add adds a layer to the image, by reading the layer changeset blob from the
-// provided reader. The stream must not be compressed, as it is used to
-// generate the DiffIDs for the image metatadata. The provided history entry is
-// appended to the image's history and should correspond to what operations
-// were made to the configuration.
-func (m *Mutator) Add(ctx context.Context, r io.Reader, history ispec.History) error {
+// AddOptions describes how a layer is added to an image with AddLayer.
+type AddOptions struct {
+	// Compressor is used to compress the layer. If nil, GzipCompressor is
+	// used.
+	Compressor Compressor
+
+	// NonDistributable specifies whether the layer should be added as a
+	// non-distributable layer.
+	NonDistributable bool
+}
+
+// AddLayer adds a layer to the image, by reading the layer changeset blob
+// from the provided reader. The stream must not be compressed, as it is
+// compressed by the Compressor specified in the options. The provided history
+// entry is appended to the image's history and should correspond to what
+// operations were made to the configuration. If history is nil, no history
+// entry is appended.
+func (m *Mutator) AddLayer(ctx context.Context, r io.Reader, history *ispec.History, opt *AddOptions) error {
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
 	}
 
-	digest, size, err := m.add(ctx, r)
+	var addOptions AddOptions
+	if opt != nil {
+		addOptions = *opt
+	}
+	if addOptions.Compressor == nil {
+		addOptions.Compressor = GzipCompressor
+	}
+
+	mediaType := addOptions.Compressor.MediaType()
+	if addOptions.NonDistributable {
+		mediaType = nonDistributableMediaType(mediaType)
+	}
+
+	digest, size, annotations, err := m.add(ctx, r, addOptions.Compressor)
 	if err != nil {
 		return errors.Wrap(err, "add layer")
 	}
 
 	// Append to layers.
 	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
-		Digest:    digest,
-		Size:      size,
+		MediaType:   mediaType,
+		Digest:      digest,
+		Size:        size,
+		Annotations: annotations,
 	})
 
 	// Append history.
-	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
+	if history != nil {
+		entry := *history
+		entry.EmptyLayer = false
+		m.config.History = append(m.config.History, entry)
+	}
 	return nil
 }
 
-// AddNonDistributable is the same as Add, except it adds a non-distributable
-// layer to the image.
-func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history ispec.History) error {
+// layerHistory returns the indices of the history entries corresponding to
+// each layer of the image (the entries which are not empty layers). If the
+// image has no history, nil is returned.
+func (m *Mutator) layerHistory() ([]int, error) {
+	if len(m.config.History) == 0 {
+		return nil, nil
+	}
+	var indices []int
+	for idx, entry := range m.config.History {
+		if !entry.EmptyLayer {
+			indices = append(indices, idx)
+		}
+	}
+	if len(indices) != len(m.manifest.Layers) {
+		return nil, errors.Errorf("image history has %d non-empty entries but the image has %d layers", len(indices), len(m.manifest.Layers))
+	}
+	return indices, nil
+}
+
+// ReplaceLayers replaces the layers first through last (inclusive, counting
+// from zero) of the image with a single layer, read from the provided reader
+// as with AddLayer (such as a layer generated by layer.SquashLayers). Layers
+// outside of the range are left untouched, and the DiffIDs in the
+// configuration are updated to match.
+//
+// The history entries of the replaced layers are replaced by the given
+// history entry, which takes the place of the entry of the last replaced
+// layer (empty-layer entries are left as-is). If history is nil, the entry of
+// the last replaced layer is kept instead. If the image has no history, none
+// is added, and if its history does not have one entry per layer an error is
+// returned.
+func (m *Mutator) ReplaceLayers(ctx context.Context, first, last int, r io.Reader, history *ispec.History, opt *AddOptions) error {
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
 	}
+	if err := m.checkLayerRange(first, last); err != nil {
+		return err
+	}
+
+	var addOptions AddOptions
+	if opt != nil {
+		addOptions = *opt
+	}
 
-	digest, size, err := m.add(ctx, r)
+	layerDescriptor, diffID, err := PutLayer(ctx, m.engine, r, addOptions.Compressor)
 	if err != nil {
-		return errors.Wrap(err, "add non-distributable layer")
+		return errors.Wrap(err, "put replacement layer")
+	}
+	if addOptions.NonDistributable {
+		layerDescriptor.MediaType = nonDistributableMediaType(layerDescriptor.MediaType)
 	}
 
-	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	return m.splice(first, last, &layerDescriptor, diffID, history)
+}
 
-	// Append history.
-	history.EmptyLayer = false
-	m.config.History = append(m.config.History, history)
+// checkLayerRange returns an error if first..last is not a valid range of
+// layers in the image, or if the image's diff_ids and history cannot be
+// updated to match a change to those layers.
+func (m *Mutator) checkLayerRange(first, last int) error {
+	if first < 0 || last >= len(m.manifest.Layers) || first > last {
+		return errors.Errorf("invalid layer range %d..%d (image has %d layers)", first, last, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("config rootfs.diff_ids has %d entries but the manifest has %d layers", len(m.config.RootFS.DiffIDs), len(m.manifest.Layers))
+	}
+	_, err := m.layerHistory()
+	return err
+}
+
+// splice replaces the layers first through last with the given layer (which
+// has the given diffID), updating the DiffIDs and history of the image. If
+// layer is nil, the layers are removed (along with their history entries) and
+// history is appended as an empty-layer entry instead. Otherwise history
+// takes the place of the entry of the last replaced layer (or that entry is
+// kept if history is nil). The caller must have called checkLayerRange.
+func (m *Mutator) splice(first, last int, layer *ispec.Descriptor, diffID digest.Digest, history *ispec.History) error {
+	historyIndices, err := m.layerHistory()
+	if err != nil {
+		return err
+	}
+
+	var layers []ispec.Descriptor
+	layers = append(layers, m.manifest.Layers[:first]...)
+	if layer != nil {
+		layers = append(layers, *layer)
+	}
+	layers = append(layers, m.manifest.Layers[last+1:]...)
+	m.manifest.Layers = layers
+
+	var diffIDs []digest.Digest
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[:first]...)
+	if layer != nil {
+		diffIDs = append(diffIDs, diffID)
+	}
+	diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[last+1:]...)
+	m.config.RootFS.DiffIDs = diffIDs
+
+	if historyIndices != nil {
+		replaced := map[int]bool{}
+		for _, idx := range historyIndices[first : last+1] {
+			replaced[idx] = true
+		}
+		var entries []ispec.History
+		for idx, entry := range m.config.History {
+			if replaced[idx] {
+				// Keep (or replace) the entry of the last layer if there is
+				// a layer to take its place.
+				if layer == nil || idx != historyIndices[last] {
+					continue
+				}
+				if history != nil {
+					entry = *history
+					entry.EmptyLayer = false
+				}
+			}
+			entries = append(entries, entry)
+		}
+		m.config.History = entries
+	}
+	if layer == nil && history != nil {
+		entry := *history
+		entry.EmptyLayer = true
+		m.config.History = append(m.config.History, entry)
+	}
 	return nil
 }
 
+// RemoveLayer removes the layer with the given index (counting from zero) from
+// the image, along with its DiffID and history entry. This is useful for (for
+// instance) removing a layer which contains secrets, though note that layers
+// above it may depend on its contents. The given history entry (if not nil) is
+// appended to the image's history as an empty-layer entry describing the
+// removal.
+func (m *Mutator) RemoveLayer(ctx context.Context, index int, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := m.checkLayerRange(index, index); err != nil {
+		return err
+	}
+	return m.splice(index, index, nil, "", history)
+}
+
+// ReplaceLayer replaces the layer with the given index (counting from zero)
+// with a new layer read from the provided reader, as with AddLayer. It is
+// equivalent to ReplaceLayers(ctx, index, index, r, history, opt).
+func (m *Mutator) ReplaceLayer(ctx context.Context, index int, r io.Reader, history *ispec.History, opt *AddOptions) error {
+	return m.ReplaceLayers(ctx, index, index, r, history, opt)
+}
+
+// ReplaceLayerBlob replaces the layer with the given index (counting from zero)
+// with a layer blob which is already present in the CAS (such as one created
+// by PutLayer), described by the given descriptor. The blob is read in order
+// to compute its DiffID, which is why its media type must be a gzip-compressed
+// or uncompressed OCI layer type. The history entry is handled in the same
+// way as ReplaceLayers.
+func (m *Mutator) ReplaceLayerBlob(ctx context.Context, index int, layer ispec.Descriptor, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := m.checkLayerRange(index, index); err != nil {
+		return err
+	}
+
+	diffID, err := layerDiffID(ctx, m.engine, layer)
+	if err != nil {
+		return errors.Wrapf(err, "compute diff_id of %s", layer.Digest)
+	}
+	return m.splice(index, index, &layer, diffID, history)
+}
+
+// layerBlobReader reads the uncompressed contents of a layer blob, keeping
+// track of the blob's digest and size so that it can be verified.
+type layerBlobReader struct {
+	io.ReadCloser
+	blob         io.ReadCloser
+	layer        ispec.Descriptor
+	blobDigester digest.Digester
+	blobCounter  *countWriter
+}
+
+// openLayer returns a reader for the uncompressed contents of the given layer
+// blob. Only gzip-compressed, zstd-compressed and uncompressed OCI layer types
+// are supported.
+func openLayer(ctx context.Context, engine cas.Engine, layer ispec.Descriptor) (*layerBlobReader, error) {
+	blob, err := engine.GetBlob(ctx, layer.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+
+	r := &layerBlobReader{
+		blob:         blob,
+		layer:        layer,
+		blobDigester: layer.Digest.Algorithm().Digester(),
+		blobCounter:  &countWriter{},
+	}
+	r.ReadCloser, err = newDecompressor(layer.MediaType, io.TeeReader(blob, io.MultiWriter(r.blobDigester.Hash(), r.blobCounter)))
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify reads the rest of the blob, and returns an error if the blob does not
+// match its descriptor. It must only be called once the uncompressed contents
+// have been read.
+func (r *layerBlobReader) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, r.blob); err != nil {
+		return errors.Wrap(err, "read layer blob")
+	}
+	if r.blobDigester.Digest() != r.layer.Digest || r.blobCounter.n != r.layer.Size {
+		return errors.Errorf("layer blob is %s (%d bytes) but descriptor is %s (%d bytes)", r.blobDigester.Digest(), r.blobCounter.n, r.layer.Digest, r.layer.Size)
+	}
+	return nil
+}
+
+// Close closes the decompressor and the underlying blob.
+func (r *layerBlobReader) Close() error {
+	r.ReadCloser.Close()
+	return r.blob.Close()
+}
+
+// layerDiffID computes the DiffID of the given layer blob, verifying that the
+// blob matches its descriptor.
+func layerDiffID(ctx context.Context, engine cas.Engine, layer ispec.Descriptor) (digest.Digest, error) {
+	reader, err := openLayer(ctx, engine, layer)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	if _, err := io.Copy(diffIDDigester.Hash(), reader); err != nil {
+		return "", errors.Wrap(err, "read layer")
+	}
+	if err := reader.Verify(); err != nil {
+		return "", err
+	}
+	return diffIDDigester.Digest(), nil
+}
+
+// LayerIndex returns the index (counting from zero) of the layer in the image
+// whose blob digest or DiffID is the given digest. An error is returned if
+// there is no such layer, or if there is more than one.
+func (m *Mutator) LayerIndex(ctx context.Context, d digest.Digest) (int, error) {
+	if err := m.cache(ctx); err != nil {
+		return -1, errors.Wrap(err, "getting cache failed")
+	}
+	index := -1
+	for idx, layer := range m.manifest.Layers {
+		matched := layer.Digest == d
+		if idx < len(m.config.RootFS.DiffIDs) && m.config.RootFS.DiffIDs[idx] == d {
+			matched = true
+		}
+		if matched {
+			if index >= 0 {
+				return -1, errors.Errorf("layer %s is ambiguous: matches layers %d and %d", d, index, idx)
+			}
+			index = idx
+		}
+	}
+	if index < 0 {
+		return -1, errors.Errorf("no layer matches %s", d)
+	}
+	return index, nil
+}
+
+// Add adds a layer to the image, by reading the layer changeset blob from the
+// provided reader. The stream must not be compressed, as it is used to
+// generate the DiffIDs for the image metatadata. The provided history entry is
+// appended to the image's history and should correspond to what operations
+// were made to the configuration.
+func (m *Mutator) Add(ctx context.Context, r io.Reader, history *ispec.History) error {
+	return m.AddLayer(ctx, r, history, nil)
+}
+
+// AddNonDistributable is the same as Add, except it adds a non-distributable
+// layer to the image.
+func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history *ispec.History) error {
+	return m.AddLayer(ctx, r, history, &AddOptions{NonDistributable: true})
+}
+
 // Commit writes all of the temporary changes made to the configuration,
 // metadata and manifest to the engine. It then returns a new manifest
 // descriptor (which can be used in place of the source descriptor provided to
@@ -318,7 +841,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	}
 
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.configBlob())
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated config blob")
 	}
@@ -348,6 +871,24 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	end := &newPath.Walk[pathLength-1]
 	end.Digest = manifestDigest
 	end.Size = manifestSize
+	end.Annotations = copyAnnotations(m.descriptorAnnotations)
+
+	// The attached artifacts refer to the new manifest.
+	if err := m.commitArtifacts(ctx, *end); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "commit attached artifacts")
+	}
+
+	// The top-level index is not a blob, so it has to be modified directly.
+	if m.indexAnnotations != nil && pathLength == 1 {
+		index, err := m.engine.GetIndex(ctx)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "get top-level index")
+		}
+		index.Annotations = copyAnnotations(*m.indexAnnotations)
+		if err := m.engine.PutIndex(ctx, index); err != nil {
+			return casext.DescriptorPath{}, errors.Wrap(err, "put top-level index")
+		}
+	}
 
 	// Walk up the path, mutating the parent reference of each descriptor.
 	for idx := pathLength - 1; idx >= 1; idx-- {
@@ -371,6 +912,16 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 			return casext.DescriptorPath{}, errors.Wrapf(err, "rewrite parent-%d blob", idx)
 		}
 
+		// Set the annotations of the manifest's parent index.
+		if m.indexAnnotations != nil && idx == pathLength-1 {
+			index, ok := parentBlob.Data.(ispec.Index)
+			if !ok {
+				return casext.DescriptorPath{}, errors.Errorf("parent of manifest is not an index: %s", parentBlob.MediaType)
+			}
+			index.Annotations = copyAnnotations(*m.indexAnnotations)
+			parentBlob.Data = index
+		}
+
 		// Re-commit the blob.
 		// TODO: This won't handle foreign blobs correctly, we need to make it
 		//       possible to write a modified blob through the blob API.
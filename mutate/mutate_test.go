@@ -20,6 +20,8 @@ package mutate
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,6 +29,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	casdir "github.com/openSUSE/umoci/oci/cas/dir"
@@ -215,7 +218,7 @@ func TestMutateAdd(t *testing.T) {
 	buffer := bytes.NewBufferString("contents")
 
 	// Add a new layer.
-	if err := mutator.Add(context.Background(), buffer, ispec.History{
+	if err := mutator.Add(context.Background(), buffer, &ispec.History{
 		Comment: "new layer",
 	}); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
@@ -295,7 +298,7 @@ func TestMutateAddNonDistributable(t *testing.T) {
 	buffer := bytes.NewBufferString("contents")
 
 	// Add a new layer.
-	if err := mutator.AddNonDistributable(context.Background(), buffer, ispec.History{
+	if err := mutator.AddNonDistributable(context.Background(), buffer, &ispec.History{
 		Comment: "new layer",
 	}); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
@@ -374,7 +377,7 @@ func TestMutateSet(t *testing.T) {
 	// Change the config
 	if err := mutator.Set(context.Background(), ispec.ImageConfig{
 		User: "changed:user",
-	}, Meta{}, nil, ispec.History{
+	}, Meta{}, nil, &ispec.History{
 		Comment: "another layer",
 	}); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
@@ -429,6 +432,56 @@ func TestMutateSet(t *testing.T) {
 	}
 }
 
+func TestMutateNoHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateNoHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither of these should add a history entry.
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// The layer was added, but the history is unchanged.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Errorf("manifest.Layers was not updated")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config.RootFS.DiffIDs was not updated")
+	}
+	if len(mutator.config.History) != 1 {
+		t.Errorf("config.History was updated: %v", mutator.config.History)
+	}
+}
+
 func walkDescriptorRoot(ctx context.Context, engine casext.Engine, root ispec.Descriptor) (casext.DescriptorPath, error) {
 	var foundPath *casext.DescriptorPath
 
@@ -515,7 +568,7 @@ func TestMutatePath(t *testing.T) {
 		config.Labels["org.opensuse.testidx"] = label
 
 		// Update it.
-		if err := mutator.Set(context.Background(), config, meta, nil, ispec.History{
+		if err := mutator.Set(context.Background(), config, meta, nil, &ispec.History{
 			Comment: "change label " + label,
 		}); err != nil {
 			t.Fatalf("%d: unexpected error modifying config: %+v", idx, err)
@@ -564,3 +617,2071 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+// lyingEngine is a cas.Engine which reports the wrong digest for stored blobs.
+type lyingEngine struct {
+	cas.Engine
+}
+
+func (e lyingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	_, size, err := e.Engine.PutBlob(ctx, reader)
+	return digest.FromString("something else"), size, err
+}
+
+func TestMutateAddDigests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddDigests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir = filepath.Join(dir, "image")
+	if err := casdir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+
+	data := bytes.Repeat([]byte("some layer contents\n"), 4096)
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	// The diffID must be the digest of the uncompressed stream.
+	if got, want := mutator.config.RootFS.DiffIDs[0], digest.FromBytes(data); got != want {
+		t.Errorf("unexpected diffID: got %s, expected %s", got, want)
+	}
+
+	// The descriptor must match the blob stored in the engine.
+	desc := mutator.manifest.Layers[0]
+	blob, err := engine.GetBlob(context.Background(), desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer blob: %+v", err)
+	}
+	defer blob.Close()
+	blobData, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := digest.FromBytes(blobData); got != desc.Digest {
+		t.Errorf("layer descriptor digest doesn't match blob: got %s, expected %s", got, desc.Digest)
+	}
+	if int64(len(blobData)) != desc.Size {
+		t.Errorf("layer descriptor size doesn't match blob: got %d, expected %d", len(blobData), desc.Size)
+	}
+
+	// An engine which stores something different must be detected.
+	mutator, err = New(lyingEngine{engine}, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewReader(data), nil); err == nil {
+		t.Errorf("expected an error when the engine stored a different blob")
+	}
+}
+
+func TestPutLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestPutLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir = filepath.Join(dir, "image")
+	if err := casdir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	data := bytes.Repeat([]byte("some layer contents\n"), 4096)
+
+	desc, diffID, err := PutLayer(context.Background(), engine, bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %+v", err)
+	}
+	if diffID != digest.FromBytes(data) {
+		t.Errorf("unexpected diffID: got %s, expected %s", diffID, digest.FromBytes(data))
+	}
+	if desc.MediaType != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected media type: %s", desc.MediaType)
+	}
+
+	// The blob must be in the engine, and must decompress to the layer.
+	blob, err := engine.GetBlob(context.Background(), desc.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer blob: %+v", err)
+	}
+	defer blob.Close()
+	gzr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobData, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blobData, data) {
+		t.Errorf("layer blob doesn't contain the layer")
+	}
+
+	// An engine which stores something different must be detected.
+	if _, _, err := PutLayer(context.Background(), lyingEngine{engine}, bytes.NewReader(data), nil); err == nil {
+		t.Errorf("expected an error when the engine stored a different blob")
+	}
+}
+
+// layeredMutator creates an image in dir with four layers (with an
+// empty-layer history entry between the second and third layer), and returns
+// a Mutator for it. The caller must close the returned engine.
+func layeredMutator(t *testing.T, dir string) (*Mutator, cas.Engine) {
+	if err := casdir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		RootFS: ispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Four layers, with an empty-layer history entry in the middle.
+	for idx := 0; idx < 4; idx++ {
+		if idx == 2 {
+			config, err := mutator.Config(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := mutator.Meta(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mutator.Set(context.Background(), config, meta, nil, &ispec.History{CreatedBy: "config"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mutator.Add(context.Background(), bytes.NewReader([]byte(fmt.Sprintf("layer %d", idx))), &ispec.History{
+			CreatedBy: fmt.Sprintf("layer %d", idx),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mutator, engine
+}
+
+func TestMutateReplaceLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReplaceLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	data := []byte("squashed")
+	if err := mutator.ReplaceLayers(context.Background(), 1, 2, bytes.NewReader(data), &ispec.History{CreatedBy: "squash"}, nil); err != nil {
+		t.Fatalf("unexpected error replacing layers: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(manifest.Layers))
+	}
+	if manifest.Layers[0].Digest != oldManifest.Layers[0].Digest || manifest.Layers[2].Digest != oldManifest.Layers[3].Digest {
+		t.Errorf("layers outside of the replaced range were modified")
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[0], digest.FromBytes(data), oldDiffIDs[3]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diff_ids: got %v, expected %v", mutator.config.RootFS.DiffIDs, expectedDiffIDs)
+	}
+
+	var createdBy []string
+	for _, entry := range mutator.config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+	expectedCreatedBy := []string{"layer 0", "config", "squash", "layer 3"}
+	if !reflect.DeepEqual(createdBy, expectedCreatedBy) {
+		t.Errorf("unexpected history: got %v, expected %v", createdBy, expectedCreatedBy)
+	}
+
+	// Invalid ranges are rejected.
+	for _, bounds := range [][2]int{{-1, 0}, {2, 1}, {0, 3}} {
+		if err := mutator.ReplaceLayers(context.Background(), bounds[0], bounds[1], bytes.NewReader(data), nil, nil); err == nil {
+			t.Errorf("expected an error replacing layers %d..%d", bounds[0], bounds[1])
+		}
+	}
+}
+
+func TestMutateRemoveLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	// Look up the layer by its diff_id.
+	index, err := mutator.LayerIndex(context.Background(), oldDiffIDs[1])
+	if err != nil {
+		t.Fatalf("unexpected error looking up layer: %+v", err)
+	}
+	if index != 1 {
+		t.Fatalf("expected layer 1, got %d", index)
+	}
+	if err := mutator.RemoveLayer(context.Background(), index, &ispec.History{CreatedBy: "remove"}); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLayers := []ispec.Descriptor{oldManifest.Layers[0], oldManifest.Layers[2], oldManifest.Layers[3]}
+	if !reflect.DeepEqual(manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers: got %v, expected %v", manifest.Layers, expectedLayers)
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[0], oldDiffIDs[2], oldDiffIDs[3]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diff_ids: got %v, expected %v", mutator.config.RootFS.DiffIDs, expectedDiffIDs)
+	}
+
+	var createdBy []string
+	for _, entry := range mutator.config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+	expectedCreatedBy := []string{"layer 0", "config", "layer 2", "layer 3", "remove"}
+	if !reflect.DeepEqual(createdBy, expectedCreatedBy) {
+		t.Errorf("unexpected history: got %v, expected %v", createdBy, expectedCreatedBy)
+	}
+	if !mutator.config.History[len(createdBy)-1].EmptyLayer {
+		t.Errorf("expected the removal history entry to be an empty layer")
+	}
+
+	// The removed layer can no longer be found.
+	if _, err := mutator.LayerIndex(context.Background(), oldManifest.Layers[1].Digest); err == nil {
+		t.Errorf("expected an error looking up a removed layer")
+	}
+	if err := mutator.RemoveLayer(context.Background(), 3, nil); err == nil {
+		t.Errorf("expected an error removing a non-existent layer")
+	}
+}
+
+func TestMutateReplaceLayerBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReplaceLayerBlob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	data := []byte("replacement")
+	layer, diffID, err := PutLayer(context.Background(), engine, bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A descriptor which doesn't match the blob is rejected.
+	badLayer := layer
+	badLayer.Size++
+	if err := mutator.ReplaceLayerBlob(context.Background(), 2, badLayer, nil); err == nil {
+		t.Errorf("expected an error replacing a layer with a mismatched descriptor")
+	}
+
+	if err := mutator.ReplaceLayerBlob(context.Background(), 2, layer, nil); err != nil {
+		t.Fatalf("unexpected error replacing layer: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLayers := []ispec.Descriptor{oldManifest.Layers[0], oldManifest.Layers[1], layer, oldManifest.Layers[3]}
+	if !reflect.DeepEqual(manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers: got %v, expected %v", manifest.Layers, expectedLayers)
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[0], oldDiffIDs[1], diffID, oldDiffIDs[3]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diff_ids: got %v, expected %v", mutator.config.RootFS.DiffIDs, expectedDiffIDs)
+	}
+	if diffID != digest.FromBytes(data) {
+		t.Errorf("unexpected diff_id: got %s, expected %s", diffID, digest.FromBytes(data))
+	}
+
+	// With no history entry, the old entry is kept.
+	var createdBy []string
+	for _, entry := range mutator.config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+	expectedCreatedBy := []string{"layer 0", "layer 1", "config", "layer 2", "layer 3"}
+	if !reflect.DeepEqual(createdBy, expectedCreatedBy) {
+		t.Errorf("unexpected history: got %v, expected %v", createdBy, expectedCreatedBy)
+	}
+}
+
+func TestMutateDockerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateDockerConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Without any Docker fields, the configuration is stored as-is.
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, _, err := engineExt.PutBlobJSON(context.Background(), mutator.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.Digest != configDigest {
+		t.Errorf("config without docker fields changed: got %s, expected %s", manifest.Config.Digest, configDigest)
+	}
+
+	docker := DockerConfig{
+		Healthcheck: &HealthConfig{
+			Test:     []string{"CMD-SHELL", "true"},
+			Interval: 30 * time.Second,
+			Retries:  3,
+		},
+		Shell:   []string{"/bin/bash", "-c"},
+		OnBuild: []string{"RUN make"},
+	}
+	mutator, err = New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.User = "nobody"
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetDockerConfig(context.Background(), docker); err != nil {
+		t.Fatal(err)
+	}
+	newPath, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fields are stored in the "config" section, alongside the OCI fields.
+	manifest, err = mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := engine.GetBlob(context.Background(), manifest.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	var raw struct {
+		Config map[string]interface{} `json:"config"`
+	}
+	if err := json.NewDecoder(blob).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"User", "Healthcheck", "Shell", "OnBuild"} {
+		if _, ok := raw.Config[field]; !ok {
+			t.Errorf("config is missing %s field: %v", field, raw.Config)
+		}
+	}
+
+	// A new Mutator for the image sees the same fields.
+	mutator, err = New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotDocker, err := mutator.DockerConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotDocker, docker) {
+		t.Errorf("unexpected docker config: got %+v, expected %+v", gotDocker, docker)
+	}
+	gotConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotConfig.User != "nobody" {
+		t.Errorf("unexpected user: got %q, expected %q", gotConfig.User, "nobody")
+	}
+}
+
+func TestMutateAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	manifestPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reference the manifest from a nested index.
+	manifestDescriptor := manifestPath.Descriptor()
+	manifestDescriptor.Annotations = map[string]string{"descriptor": "old"}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests:   []ispec.Descriptor{manifestDescriptor},
+		Annotations: map[string]string{"index": "old"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err = New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}, manifestDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptorAnnotations, err := mutator.DescriptorAnnotations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(descriptorAnnotations, map[string]string{"descriptor": "old"}) {
+		t.Errorf("unexpected descriptor annotations: %v", descriptorAnnotations)
+	}
+	indexAnnotations, err := mutator.IndexAnnotations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexAnnotations, map[string]string{"index": "old"}) {
+		t.Errorf("unexpected index annotations: %v", indexAnnotations)
+	}
+
+	// Modify all three scopes.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, map[string]string{"manifest": "new"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetDescriptorAnnotations(context.Background(), map[string]string{"descriptor": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetIndexAnnotations(context.Background(), map[string]string{"index": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexBlob, err := engineExt.FromDescriptor(context.Background(), newPath.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexBlob.Close()
+	index := indexBlob.Data.(ispec.Index)
+	if !reflect.DeepEqual(index.Annotations, map[string]string{"index": "new"}) {
+		t.Errorf("unexpected index annotations: %v", index.Annotations)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest in index, got %d", len(index.Manifests))
+	}
+	if !reflect.DeepEqual(index.Manifests[0], newPath.Descriptor()) {
+		t.Errorf("index does not reference new manifest: got %v, expected %v", index.Manifests[0], newPath.Descriptor())
+	}
+	if !reflect.DeepEqual(index.Manifests[0].Annotations, map[string]string{"descriptor": "new"}) {
+		t.Errorf("unexpected descriptor annotations: %v", index.Manifests[0].Annotations)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), newPath.Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifestBlob.Close()
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	if !reflect.DeepEqual(manifest.Annotations, map[string]string{"manifest": "new"}) {
+		t.Errorf("unexpected manifest annotations: %v", manifest.Annotations)
+	}
+
+	// If the manifest is referenced by the top-level index, it is modified
+	// directly.
+	mutator, err = New(engine, manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.SetIndexAnnotations(context.Background(), map[string]string{"top": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	topIndex, err := engine.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(topIndex.Annotations, map[string]string{"top": "new"}) {
+		t.Errorf("unexpected top-level index annotations: %v", topIndex.Annotations)
+	}
+}
+
+func TestMutateSetHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("expected 5 history entries, got %d", len(history))
+	}
+
+	// Modifying the returned history must not modify the image.
+	history[0].CreatedBy = "modified"
+	if mutator.config.History[0].CreatedBy == "modified" {
+		t.Errorf("History returned the cached history rather than a copy")
+	}
+
+	history[1].Author = "someone"
+	history[1].Comment = "fixed"
+	if err := mutator.SetHistory(context.Background(), history); err != nil {
+		t.Fatalf("unexpected error setting history: %+v", err)
+	}
+	newHistory, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(newHistory, history) {
+		t.Errorf("unexpected history: got %v, expected %v", newHistory, history)
+	}
+
+	// The history must still correspond to the layers.
+	history[0].EmptyLayer = true
+	if err := mutator.SetHistory(context.Background(), history); err == nil {
+		t.Errorf("expected an error setting history without an entry for each layer")
+	}
+	if err := mutator.SetHistory(context.Background(), history[:4]); err == nil {
+		t.Errorf("expected an error setting truncated history")
+	}
+	if err := mutator.SetHistory(context.Background(), nil); err != nil {
+		t.Errorf("unexpected error clearing history: %+v", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestConvert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	manifestDescriptor := mutator.source.Descriptor()
+	manifestDescriptor.Annotations = map[string]string{"test": "value"}
+
+	dockerDescriptor, err := Convert(context.Background(), engine, manifestDescriptor, FormatDocker)
+	if err != nil {
+		t.Fatalf("unexpected error converting to docker: %+v", err)
+	}
+	if dockerDescriptor.MediaType != casext.MediaTypeDockerManifest {
+		t.Errorf("unexpected media type: %s", dockerDescriptor.MediaType)
+	}
+	if dockerDescriptor.Annotations["test"] != "value" {
+		t.Errorf("descriptor annotations were not preserved: %v", dockerDescriptor.Annotations)
+	}
+
+	reader, err := engine.GetBlob(context.Background(), dockerDescriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dockerManifest manifestBlob
+	err = json.NewDecoder(reader).Decode(&dockerManifest)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dockerManifest.MediaType != casext.MediaTypeDockerManifest {
+		t.Errorf("manifest blob has unexpected media type: %q", dockerManifest.MediaType)
+	}
+	if dockerManifest.Config.MediaType != casext.MediaTypeDockerConfig {
+		t.Errorf("config has unexpected media type: %q", dockerManifest.Config.MediaType)
+	}
+	if dockerManifest.Config.Digest != mutator.manifest.Config.Digest {
+		t.Errorf("config blob was modified: %s != %s", dockerManifest.Config.Digest, mutator.manifest.Config.Digest)
+	}
+	for idx, layer := range dockerManifest.Layers {
+		if layer.MediaType != casext.MediaTypeDockerLayerGzip {
+			t.Errorf("layer %d has unexpected media type: %q", idx, layer.MediaType)
+		}
+		if layer.Digest != mutator.manifest.Layers[idx].Digest {
+			t.Errorf("layer %d blob was modified", idx)
+		}
+	}
+
+	// Converting back must produce the original manifest.
+	ociDescriptor, err := Convert(context.Background(), engine, dockerDescriptor, FormatOCI)
+	if err != nil {
+		t.Fatalf("unexpected error converting to oci: %+v", err)
+	}
+	if ociDescriptor.Digest != manifestDescriptor.Digest || ociDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("round-trip conversion changed the manifest: %v != %v", ociDescriptor, manifestDescriptor)
+	}
+
+	// Indexes are converted to manifest lists, which require platforms.
+	manifestDescriptor.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{manifestDescriptor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+
+	listDescriptor, err := Convert(context.Background(), engine, indexDescriptor, FormatDocker)
+	if err != nil {
+		t.Fatalf("unexpected error converting index to docker: %+v", err)
+	}
+	if listDescriptor.MediaType != casext.MediaTypeDockerManifestList {
+		t.Errorf("unexpected media type: %s", listDescriptor.MediaType)
+	}
+	listBlob, err := engineExt.FromDescriptor(context.Background(), listDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listBlob.Close()
+	list := listBlob.Data.(ispec.Index)
+	if len(list.Manifests) != 1 || list.Manifests[0].Digest != dockerDescriptor.Digest || list.Manifests[0].MediaType != casext.MediaTypeDockerManifest {
+		t.Errorf("unexpected manifest list entries: %v", list.Manifests)
+	}
+
+	// The converted image must be walkable.
+	paths, err := engineExt.ResolveDescriptor(context.Background(), listDescriptor)
+	if err != nil {
+		t.Fatalf("unexpected error resolving manifest list: %+v", err)
+	}
+	if len(paths) != 1 || paths[0].Descriptor().Digest != dockerDescriptor.Digest {
+		t.Errorf("unexpected resolved paths: %v", paths)
+	}
+
+	ociIndexDescriptor, err := Convert(context.Background(), engine, listDescriptor, FormatOCI)
+	if err != nil {
+		t.Fatalf("unexpected error converting manifest list to oci: %+v", err)
+	}
+	if ociIndexDescriptor.Digest != indexDescriptor.Digest {
+		t.Errorf("round-trip conversion changed the index: %v != %v", ociIndexDescriptor, indexDescriptor)
+	}
+
+	// Converting an image to the format it already uses must not modify it.
+	sameDescriptor, err := Convert(context.Background(), engine, indexDescriptor, FormatOCI)
+	if err != nil {
+		t.Fatalf("unexpected error converting index to oci: %+v", err)
+	}
+	if !reflect.DeepEqual(sameDescriptor, indexDescriptor) {
+		t.Errorf("converting to the same format changed the index: %v != %v", sameDescriptor, indexDescriptor)
+	}
+	sameDescriptor, err = Convert(context.Background(), engine, listDescriptor, FormatDocker)
+	if err != nil {
+		t.Fatalf("unexpected error converting manifest list to docker: %+v", err)
+	}
+	if !reflect.DeepEqual(sameDescriptor, listDescriptor) {
+		t.Errorf("converting to the same format changed the manifest list: %v != %v", sameDescriptor, listDescriptor)
+	}
+
+	manifestDescriptor.Platform = nil
+	indexDigest, indexSize, err = engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{manifestDescriptor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Convert(context.Background(), engine, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}, FormatDocker); err == nil {
+		t.Errorf("expected an error converting an index without platforms to docker")
+	}
+}
+
+func TestMutateAttach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAttach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	sbom, err := PutBlob(context.Background(), engine, "application/spdx+json", bytes.NewBufferString(`{"spdxVersion": "SPDX-2.3"}`))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+
+	if err := mutator.Attach(context.Background(), Artifact{Blobs: []ispec.Descriptor{sbom}}); err == nil {
+		t.Errorf("expected an error attaching an artifact without a type")
+	}
+	if err := mutator.Attach(context.Background(), Artifact{
+		ArtifactType: "application/spdx+json",
+		Blobs:        []ispec.Descriptor{sbom},
+		Annotations:  map[string]string{"org.example.sbom": "1"},
+	}); err != nil {
+		t.Fatalf("unexpected error attaching sbom: %+v", err)
+	}
+	if err := mutator.Attach(context.Background(), Artifact{ArtifactType: "application/vnd.example.signed"}); err != nil {
+		t.Fatalf("unexpected error attaching empty artifact: %+v", err)
+	}
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "latest", newPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artifacts []artifactManifest
+	for _, descriptor := range index.Manifests {
+		if _, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			continue
+		}
+		reader, err := engine.GetBlob(context.Background(), descriptor.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var artifact artifactManifest
+		err = json.NewDecoder(reader).Decode(&artifact)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	if len(artifacts) != 2 {
+		t.Fatalf("expected 2 artifacts in the index, got %d", len(artifacts))
+	}
+
+	for idx, artifact := range artifacts {
+		if artifact.Subject == nil || artifact.Subject.Digest != newPath.Descriptor().Digest {
+			t.Errorf("artifact %d has the wrong subject: %v", idx, artifact.Subject)
+		}
+		if artifact.Config.MediaType != casext.MediaTypeEmptyJSON {
+			t.Errorf("artifact %d has unexpected config media type: %s", idx, artifact.Config.MediaType)
+		}
+		if len(artifact.Layers) != 1 {
+			t.Errorf("artifact %d has %d blobs, expected 1", idx, len(artifact.Layers))
+		}
+	}
+	if artifacts[0].ArtifactType != "application/spdx+json" || artifacts[0].Layers[0].Digest != sbom.Digest || artifacts[0].Annotations["org.example.sbom"] != "1" {
+		t.Errorf("unexpected sbom artifact: %v", artifacts[0])
+	}
+	if artifacts[1].ArtifactType != "application/vnd.example.signed" || artifacts[1].Layers[0].MediaType != casext.MediaTypeEmptyJSON {
+		t.Errorf("unexpected empty artifact: %v", artifacts[1])
+	}
+
+	// The artifacts must be kept by GC.
+	if err := engineExt.GC(context.Background()); err != nil {
+		t.Fatalf("unexpected error in GC: %+v", err)
+	}
+	reader, err := engine.GetBlob(context.Background(), sbom.Digest)
+	if err != nil {
+		t.Fatalf("sbom blob was removed by GC: %+v", err)
+	}
+	reader.Close()
+}
+
+func TestNewArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestNewArtifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	config, err := PutBlob(context.Background(), engine, "application/vnd.cncf.helm.config.v1+json", bytes.NewBufferString(`{"name": "chart"}`))
+	if err != nil {
+		t.Fatalf("unexpected error putting config: %+v", err)
+	}
+	chart, err := PutBlob(context.Background(), engine, "application/vnd.cncf.helm.chart.content.v1.tar+gzip", bytes.NewBufferString("chart"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+
+	for _, invalid := range []Artifact{
+		{Blobs: []ispec.Descriptor{chart}},
+		{ArtifactType: "application/vnd.example", Config: &ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: config.Digest, Size: config.Size}},
+		{ArtifactType: "application/vnd.example", Config: &ispec.Descriptor{Digest: config.Digest, Size: config.Size}},
+	} {
+		if _, err := NewArtifact(context.Background(), engine, invalid); err == nil {
+			t.Errorf("expected an error creating invalid artifact %v", invalid)
+		}
+	}
+
+	// The media type of the config is the type of the artifact.
+	descriptor, err := NewArtifact(context.Background(), engine, Artifact{
+		Config: &config,
+		Blobs:  []ispec.Descriptor{chart},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating artifact: %+v", err)
+	}
+	reader, err := engine.GetBlob(context.Background(), descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artifact artifactManifest
+	err = json.NewDecoder(reader).Decode(&artifact)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.Subject != nil || artifact.ArtifactType != "" {
+		t.Errorf("unexpected subject or artifact type: %v", artifact)
+	}
+	if artifact.Config.Digest != config.Digest || artifact.Config.MediaType != config.MediaType {
+		t.Errorf("unexpected config: %v", artifact.Config)
+	}
+	if len(artifact.Layers) != 1 || artifact.Layers[0].Digest != chart.Digest {
+		t.Errorf("unexpected blobs: %v", artifact.Layers)
+	}
+
+	// Artifacts cannot be modified as images.
+	if err := engineExt.UpdateReference(context.Background(), "chart", descriptor); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := engineExt.ResolveReference(context.Background(), "chart")
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("unexpected error resolving artifact: %v %+v", paths, err)
+	}
+	mutator, err := New(engine, paths[0])
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	if _, err := mutator.Config(context.Background()); err == nil {
+		t.Errorf("expected an error getting the config of an artifact")
+	}
+}
+
+func TestAttachArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAttachArtifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	subject := mutator.source.Descriptor()
+	sbom, err := PutBlob(context.Background(), engine, "application/spdx+json", bytes.NewBufferString(`{"spdxVersion": "SPDX-2.3"}`))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	descriptor, err := AttachArtifact(context.Background(), engine, subject, Artifact{
+		ArtifactType: "application/spdx+json",
+		Blobs:        []ispec.Descriptor{sbom},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error attaching artifact: %+v", err)
+	}
+
+	// The artifact is stored in the index as a referrer of the subject.
+	referrers, err := engineExt.Referrers(context.Background(), subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting referrers: %+v", err)
+	}
+	if len(referrers) != 1 {
+		t.Fatalf("expected one referrer, got %v", referrers)
+	}
+	if referrers[0].Descriptor.Digest != descriptor.Digest || referrers[0].ArtifactType != "application/spdx+json" || referrers[0].Subject.Digest != subject.Digest {
+		t.Errorf("unexpected referrer: %v", referrers[0])
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDeduplicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	originalPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "a", originalPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	original := mutator.manifest.Layers[0]
+
+	// Store the first layer again as a different (larger) gzip stream.
+	blob, err := engine.GetBlob(context.Background(), original.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recompressed bytes.Buffer
+	gzw, err := gzip.NewWriterLevel(&recompressed, gzip.NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzw.Header.Name = "duplicate"
+	if _, err := io.Copy(gzw, gzr); err != nil {
+		t.Fatal(err)
+	}
+	gzw.Close()
+	gzr.Close()
+	blob.Close()
+
+	duplicate, err := PutBlob(context.Background(), engine, ispec.MediaTypeImageLayerGzip, &recompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate.Digest == original.Digest || duplicate.Size <= original.Size {
+		t.Fatalf("recompressed layer is not a larger duplicate: %v %v", duplicate, original)
+	}
+
+	mutator, err = New(engine, originalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.ReplaceLayerBlob(context.Background(), 0, duplicate, nil); err != nil {
+		t.Fatal(err)
+	}
+	duplicatePath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "b", duplicatePath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := Deduplicate(context.Background(), engine)
+	if err != nil {
+		t.Fatalf("unexpected error deduplicating: %+v", err)
+	}
+	if replaced != 1 {
+		t.Errorf("expected 1 layer to be replaced, got %d", replaced)
+	}
+
+	// Both tags must now use the smaller blob.
+	for _, name := range []string{"a", "b"} {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 {
+			t.Fatalf("tag %s resolves to %d paths", name, len(descriptorPaths))
+		}
+		if name == "a" && descriptorPaths[0].Descriptor().Digest != originalPath.Descriptor().Digest {
+			t.Errorf("tag a was modified even though it uses the canonical blob")
+		}
+		mutator, err := New(engine, descriptorPaths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := mutator.Manifest(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Layers[0].Digest != original.Digest {
+			t.Errorf("tag %s uses layer %s rather than the canonical %s", name, manifest.Layers[0].Digest, original.Digest)
+		}
+	}
+
+	// Running again must not change anything.
+	replaced, err = Deduplicate(context.Background(), engine)
+	if err != nil {
+		t.Fatalf("unexpected error deduplicating: %+v", err)
+	}
+	if replaced != 0 {
+		t.Errorf("expected no layers to be replaced, got %d", replaced)
+	}
+
+	// The duplicate blob can now be garbage collected.
+	if err := engineExt.GC(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.GetBlob(context.Background(), duplicate.Digest); err == nil {
+		t.Errorf("duplicate layer blob was not garbage collected")
+	}
+}
+
+// storedCompressor is a Compressor which stores the layer in a named gzip
+// stream without compressing it, so that it differs from GzipCompressor.
+type storedCompressor struct{}
+
+func (storedCompressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+func (storedCompressor) Compress(w io.Writer, r io.Reader) (digest.Digest, map[string]string, error) {
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	gzw, err := gzip.NewWriterLevel(w, gzip.NoCompression)
+	if err != nil {
+		return "", nil, err
+	}
+	gzw.Header.Name = "stored"
+	if _, err := io.Copy(io.MultiWriter(gzw, diffIDDigester.Hash()), r); err != nil {
+		return "", nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return "", nil, err
+	}
+	return diffIDDigester.Digest(), map[string]string{"stored": "true"}, nil
+}
+
+func TestMutateRecompressLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldLayers := append([]ispec.Descriptor{}, mutator.manifest.Layers...)
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+	oldHistory, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.RecompressLayer(context.Background(), 1, storedCompressor{}); err != nil {
+		t.Fatalf("unexpected error recompressing layer: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != len(oldLayers) {
+		t.Fatalf("expected %d layers, got %d", len(oldLayers), len(manifest.Layers))
+	}
+	for idx, layer := range manifest.Layers {
+		if idx == 1 {
+			continue
+		}
+		if !reflect.DeepEqual(layer, oldLayers[idx]) {
+			t.Errorf("layer %d was modified: %v", idx, layer)
+		}
+	}
+	layer := manifest.Layers[1]
+	if layer.Digest == oldLayers[1].Digest {
+		t.Errorf("layer blob was not replaced")
+	}
+	if layer.MediaType != ispec.MediaTypeImageLayerGzip || layer.Annotations["stored"] != "true" {
+		t.Errorf("unexpected recompressed layer descriptor: %v", layer)
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("diff_ids were modified: %v", mutator.config.RootFS.DiffIDs)
+	}
+	if history, err := mutator.History(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(history, oldHistory) {
+		t.Errorf("history was modified: %v", history)
+	}
+	if diffID, err := layerDiffID(context.Background(), engine, layer); err != nil {
+		t.Fatal(err)
+	} else if diffID != oldDiffIDs[1] {
+		t.Errorf("recompressed layer has diff_id %s, expected %s", diffID, oldDiffIDs[1])
+	}
+
+	// Layers which don't match the image configuration must be rejected.
+	mutator.config.RootFS.DiffIDs[2] = oldDiffIDs[3]
+	if err := mutator.RecompressLayer(context.Background(), 2, nil); err == nil {
+		t.Errorf("expected an error recompressing a layer with the wrong diff_id")
+	}
+	mutator.config.RootFS.DiffIDs[2] = oldDiffIDs[2]
+
+	// Layers with urls cannot be recompressed.
+	mutator.manifest.Layers[3].URLs = []string{"https://example.com/layer"}
+	if err := mutator.RecompressLayer(context.Background(), 3, nil); err == nil {
+		t.Errorf("expected an error recompressing a layer with urls")
+	}
+	mutator.manifest.Layers[3].URLs = nil
+
+	if err := mutator.RecompressLayer(context.Background(), 4, nil); err == nil {
+		t.Errorf("expected an error recompressing a nonexistent layer")
+	}
+}
+
+func TestMutateRecompressLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldLayers := append([]ispec.Descriptor{}, mutator.manifest.Layers...)
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+
+	// If any layer cannot be recompressed, no layers are replaced.
+	mutator.config.RootFS.DiffIDs[2] = oldDiffIDs[3]
+	if err := mutator.RecompressLayers(context.Background(), []int{0, 1, 2}, storedCompressor{}, 4); err == nil {
+		t.Errorf("expected an error recompressing a layer with the wrong diff_id")
+	}
+	mutator.config.RootFS.DiffIDs[2] = oldDiffIDs[2]
+	if !reflect.DeepEqual(mutator.manifest.Layers, oldLayers) {
+		t.Errorf("layers were modified by a failed recompression: %v", mutator.manifest.Layers)
+	}
+
+	if err := mutator.RecompressLayers(context.Background(), []int{0, 1, 2}, storedCompressor{}, 4); err != nil {
+		t.Fatalf("unexpected error recompressing layers: %+v", err)
+	}
+	for idx, layer := range mutator.manifest.Layers {
+		if idx > 2 {
+			if !reflect.DeepEqual(layer, oldLayers[idx]) {
+				t.Errorf("layer %d was modified: %v", idx, layer)
+			}
+			continue
+		}
+		if layer.Digest == oldLayers[idx].Digest || layer.Annotations["stored"] != "true" {
+			t.Errorf("layer %d was not recompressed: %v", idx, layer)
+		}
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("diff_ids were modified: %v", mutator.config.RootFS.DiffIDs)
+	}
+}
+
+func TestMutateRecompressLayerZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRecompressLayerZstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldLayers := append([]ispec.Descriptor{}, mutator.manifest.Layers...)
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+	mutator.manifest.Layers[2].MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+
+	if err := mutator.RecompressLayers(context.Background(), []int{1, 2}, ZstdCompressor, 2); err != nil {
+		t.Fatalf("unexpected error recompressing layers: %+v", err)
+	}
+	for idx, mediaType := range map[int]string{
+		1: casext.MediaTypeImageLayerZstd,
+		2: casext.MediaTypeImageLayerNonDistributableZstd,
+	} {
+		layer := mutator.manifest.Layers[idx]
+		if layer.MediaType != mediaType {
+			t.Errorf("layer %d has media type %q, expected %q", idx, layer.MediaType, mediaType)
+		}
+		if layer.Digest == oldLayers[idx].Digest {
+			t.Errorf("layer %d blob was not replaced", idx)
+		}
+		if diffID, err := layerDiffID(context.Background(), engine, layer); err != nil {
+			t.Fatalf("layer %d: %+v", idx, err)
+		} else if diffID != oldDiffIDs[idx] {
+			t.Errorf("zstd layer %d has diff_id %s, expected %s", idx, diffID, oldDiffIDs[idx])
+		}
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("diff_ids were modified: %v", mutator.config.RootFS.DiffIDs)
+	}
+
+	// Converting the layer back to gzip gives the original blob, since the
+	// uncompressed contents are unchanged.
+	if err := mutator.RecompressLayer(context.Background(), 1, nil); err != nil {
+		t.Fatalf("unexpected error recompressing zstd layer: %+v", err)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], oldLayers[1]) {
+		t.Errorf("round-tripped layer %v differs from the original %v", mutator.manifest.Layers[1], oldLayers[1])
+	}
+
+	// New layers can also be added as zstd layers.
+	if err := mutator.AddLayer(context.Background(), bytes.NewReader([]byte("zstd layer")), nil, &AddOptions{
+		Compressor: ZstdCompressor,
+	}); err != nil {
+		t.Fatalf("unexpected error adding zstd layer: %+v", err)
+	}
+	layer := mutator.manifest.Layers[len(mutator.manifest.Layers)-1]
+	if layer.MediaType != casext.MediaTypeImageLayerZstd {
+		t.Errorf("added layer has media type %q", layer.MediaType)
+	}
+	reader, err := openLayer(context.Background(), engine, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if data, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "zstd layer" {
+		t.Errorf("zstd layer has contents %q", data)
+	}
+	if err := reader.Verify(); err != nil {
+		t.Errorf("unexpected error verifying zstd layer: %+v", err)
+	}
+}
+
+func TestIndexMutator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestIndexMutator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.OS = "linux"
+	meta.Architecture = "arm"
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	manifestPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := manifestPath.Descriptor()
+
+	platform, err := ConfigPlatform(context.Background(), engine, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error getting platform: %+v", err)
+	}
+	if expected := (ispec.Platform{OS: "linux", Architecture: "arm"}); !reflect.DeepEqual(platform, expected) {
+		t.Errorf("unexpected platform: got %v expected %v", platform, expected)
+	}
+
+	index := NewEmptyIndex(engine)
+	for _, platform := range []ispec.Platform{
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "amd64"},
+	} {
+		platform := platform
+		manifest.Platform = &platform
+		if err := index.Add(context.Background(), manifest); err != nil {
+			t.Fatalf("unexpected error adding %v: %+v", platform, err)
+		}
+	}
+
+	// Entries must be unique, and must have a platform.
+	manifest.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64", OSFeatures: []string{}}
+	if err := index.Add(context.Background(), manifest); err == nil {
+		t.Errorf("expected an error adding a duplicate platform")
+	}
+	manifest.Platform = nil
+	if err := index.Add(context.Background(), manifest); err == nil {
+		t.Errorf("expected an error adding a manifest without a platform")
+	}
+
+	// Platforms without a variant match every variant.
+	if err := index.SetPlatform(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm"}, ispec.Platform{OS: "linux", Architecture: "arm"}); err == nil {
+		t.Errorf("expected an error modifying an ambiguous platform")
+	}
+	if err := index.SetPlatform(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}); err == nil {
+		t.Errorf("expected an error setting a duplicate platform")
+	}
+	if err := index.SetPlatform(context.Background(), ispec.Platform{OS: "linux", Architecture: "amd64"}, ispec.Platform{OS: "linux", Architecture: "amd64", OSVersion: "1.0"}); err != nil {
+		t.Errorf("unexpected error setting platform: %+v", err)
+	}
+	if err := index.SetAnnotations(context.Background(), ispec.Platform{OS: "linux", Architecture: "amd64"}, map[string]string{"key": "value"}); err != nil {
+		t.Errorf("unexpected error setting annotations: %+v", err)
+	}
+
+	removed, err := index.Remove(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm"})
+	if err != nil {
+		t.Fatalf("unexpected error removing platform: %+v", err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 entries to be removed, got %d", removed)
+	}
+	if _, err := index.Remove(context.Background(), ispec.Platform{OS: "linux", Architecture: "arm"}); err == nil {
+		t.Errorf("expected an error removing a missing platform")
+	}
+
+	descriptor, err := index.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing index: %+v", err)
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageIndex {
+		t.Errorf("unexpected index media type: %s", descriptor.MediaType)
+	}
+
+	// The committed index must contain the modified entry.
+	index, err = NewIndex(engine, descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := index.Index(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committed.Manifests) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(committed.Manifests))
+	}
+	entry := committed.Manifests[0]
+	if entry.Digest != manifest.Digest || entry.Platform == nil || entry.Platform.OSVersion != "1.0" || entry.Annotations["key"] != "value" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	if _, err := Rollback(context.Background(), engine, "tag"); err == nil {
+		t.Errorf("expected an error rolling back a missing tag")
+	}
+
+	originalPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := originalPath.Root()
+	if err := engineExt.UpdateReference(context.Background(), "tag", original); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rollback(context.Background(), engine, "tag"); err == nil {
+		t.Errorf("expected an error rolling back a tag without a previous entry")
+	}
+
+	if err := mutator.RemoveLayer(context.Background(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	modifiedPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := modifiedPath.Root()
+	if err := engineExt.UpdateReference(context.Background(), "tag", modified); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling back restores the original, and rolling back again undoes that.
+	for _, expected := range []ispec.Descriptor{original, modified} {
+		restored, err := Rollback(context.Background(), engine, "tag")
+		if err != nil {
+			t.Fatalf("unexpected error rolling back: %+v", err)
+		}
+		if restored.Digest != expected.Digest || restored.MediaType != expected.MediaType || restored.Size != expected.Size {
+			t.Errorf("rollback restored %v, expected %v", restored, expected)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), "tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 || descriptorPaths[0].Root().Digest != expected.Digest {
+			t.Errorf("tag refers to %v after rollback, expected %s", descriptorPaths, expected.Digest)
+		}
+	}
+
+	// The original image is no longer referenced, so it can't be restored
+	// after it has been garbage collected.
+	if err := engineExt.GC(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rollback(context.Background(), engine, "tag"); err == nil {
+		t.Errorf("expected an error rolling back to a garbage collected image")
+	}
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 || descriptorPaths[0].Root().Digest != modified.Digest {
+		t.Errorf("failed rollback modified the tag: %v", descriptorPaths)
+	}
+}
+
+func TestPatchConfig(t *testing.T) {
+	image := ispec.Image{
+		Author: "author",
+		OS:     "linux",
+		Config: ispec.ImageConfig{
+			User:       "user",
+			Env:        []string{"A=1", "B=2"},
+			Entrypoint: []string{"/init"},
+			Labels:     map[string]string{"keep": "1", "remove": "2"},
+			Volumes:    map[string]struct{}{"/data": {}},
+		},
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{expectedLayerDigest},
+		},
+		History: []ispec.History{{CreatedBy: "base"}},
+	}
+	docker := DockerConfig{Shell: []string{"/bin/sh", "-c"}}
+
+	patch := []byte(`{
+		"author": "patched",
+		"config": {
+			"Env": ["C=3"],
+			"Entrypoint": null,
+			"Labels": {"remove": null, "add": "3"},
+			"Volumes": {"/srv": {}},
+			"Healthcheck": {"Test": ["NONE"]}
+		}
+	}`)
+	expectedImage := ispec.Image{
+		Author: "patched",
+		OS:     "linux",
+		Config: ispec.ImageConfig{
+			User:    "user",
+			Env:     []string{"C=3"},
+			Labels:  map[string]string{"keep": "1", "add": "3"},
+			Volumes: map[string]struct{}{"/data": {}, "/srv": {}},
+		},
+		RootFS:  image.RootFS,
+		History: image.History,
+	}
+	expectedDocker := DockerConfig{
+		Healthcheck: &HealthConfig{Test: []string{"NONE"}},
+		Shell:       []string{"/bin/sh", "-c"},
+	}
+
+	newImage, newDocker, err := PatchConfig(image, docker, patch)
+	if err != nil {
+		t.Fatalf("unexpected error patching config: %+v", err)
+	}
+	if !reflect.DeepEqual(newImage, expectedImage) {
+		t.Errorf("unexpected patched image: got %+v expected %+v", newImage, expectedImage)
+	}
+	if !reflect.DeepEqual(newDocker, expectedDocker) {
+		t.Errorf("unexpected patched docker config: got %+v expected %+v", newDocker, expectedDocker)
+	}
+
+	// Applying the patch again has no effect.
+	againImage, againDocker, err := PatchConfig(newImage, newDocker, patch)
+	if err != nil {
+		t.Fatalf("unexpected error patching config again: %+v", err)
+	}
+	if !reflect.DeepEqual(againImage, newImage) || !reflect.DeepEqual(againDocker, newDocker) {
+		t.Errorf("patch is not idempotent: got %+v %+v", againImage, againDocker)
+	}
+
+	for _, invalid := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"config": {"Usr": "typo"}}`,
+		`{"rootfs": {"type": "layers"}}`,
+		`{"history": []}`,
+		`{"config": {"Env": "A=1"}}`,
+		`{"author": "a"} {}`,
+	} {
+		if _, _, err := PatchConfig(image, docker, []byte(invalid)); err == nil {
+			t.Errorf("expected error applying invalid patch %q", invalid)
+		}
+	}
+}
+
+func TestMutatePatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	user, label := "patched:user", "value"
+	if err := mutator.Patch(context.Background(), ConfigPatch{
+		Config: &ImageConfigPatch{
+			User:   &user,
+			Labels: map[string]*string{"label": &label},
+			Shell:  &[]string{"/bin/bash", "-c"},
+		},
+	}, &ispec.History{CreatedBy: "patch"}); err != nil {
+		t.Fatalf("unexpected error patching: %+v", err)
+	}
+
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.User != user || config.Labels["label"] != label {
+		t.Errorf("unexpected patched config: %+v", config)
+	}
+	docker, err := mutator.DockerConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(docker.Shell, []string{"/bin/bash", "-c"}) {
+		t.Errorf("unexpected patched docker config: %+v", docker)
+	}
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) == 0 || history[len(history)-1].CreatedBy != "patch" || !history[len(history)-1].EmptyLayer {
+		t.Errorf("unexpected history after patch: %+v", history)
+	}
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 4 {
+		t.Errorf("patch modified the layers: %+v", manifest.Layers)
+	}
+
+	if err := mutator.MergePatch(context.Background(), []byte(`{"config": {"User": 1}}`), nil); err == nil {
+		t.Errorf("expected an error applying an invalid patch")
+	}
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected error committing: %+v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestBatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	originalPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "tag", originalPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	originalIndex, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalBlobs, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := NewBatch(context.Background(), engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Close()
+	batchExt := casext.NewEngine(batch.Engine())
+
+	// Stage a new layer and configuration change of the tagged image.
+	batchMutator, err := New(batch.Engine(), casext.DescriptorPath{Walk: []ispec.Descriptor{originalPath.Root()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batchMutator.Add(context.Background(), bytes.NewReader([]byte("staged layer")), &ispec.History{CreatedBy: "staged"}); err != nil {
+		t.Fatal(err)
+	}
+	user := "staged"
+	if err := batchMutator.Patch(context.Background(), ConfigPatch{Config: &ImageConfigPatch{User: &user}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	newPath, err := batchMutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batchExt.UpdateReference(context.Background(), "tag", newPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	if err := batchExt.UpdateReference(context.Background(), "new-tag", newPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been modified in the underlying image.
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index, originalIndex) {
+		t.Errorf("staging modified the index: %+v", index)
+	}
+	blobs, err := engine.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != len(originalBlobs) {
+		t.Errorf("staging added blobs: got %d blobs expected %d", len(blobs), len(originalBlobs))
+	}
+
+	diff, err := batch.Diff(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	if len(diff.References) != 2 || diff.References[0].Name != "new-tag" || diff.References[1].Name != "tag" {
+		t.Fatalf("unexpected references in diff: %+v", diff.References)
+	}
+	if created := diff.References[0]; created.Old != nil || created.New == nil || created.New.Digest != newPath.Root().Digest {
+		t.Errorf("unexpected diff of created reference: %+v", created)
+	}
+	modified := diff.References[1]
+	if modified.Old == nil || modified.Old.Digest != originalPath.Root().Digest || len(modified.Manifests) != 1 {
+		t.Fatalf("unexpected diff of modified reference: %+v", modified)
+	}
+	var configPatch struct {
+		Config struct {
+			User string
+		} `json:"config"`
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(modified.Manifests[0].Config, &configPatch); err != nil {
+		t.Fatalf("unexpected error parsing config patch %s: %+v", modified.Manifests[0].Config, err)
+	}
+	if configPatch.Config.User != user || len(configPatch.RootFS.DiffIDs) != 5 {
+		t.Errorf("unexpected config patch: %s", modified.Manifests[0].Config)
+	}
+	// The new layer, config and manifest.
+	if len(diff.Blobs) != 3 {
+		t.Errorf("unexpected staged blobs: %+v", diff.Blobs)
+	}
+	for _, blob := range diff.Blobs {
+		switch blob.MediaType {
+		case ispec.MediaTypeImageManifest, ispec.MediaTypeImageConfig, ispec.MediaTypeImageLayerGzip:
+		default:
+			t.Errorf("unexpected media type of staged blob %s: %q", blob.Digest, blob.MediaType)
+		}
+	}
+
+	// Once applied, the underlying image has been modified.
+	if err := batch.Apply(context.Background()); err != nil {
+		t.Fatalf("unexpected error applying batch: %+v", err)
+	}
+	for _, name := range []string{"tag", "new-tag"} {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 || descriptorPaths[0].Root().Digest != newPath.Root().Digest {
+			t.Errorf("unexpected %s after applying batch: %+v", name, descriptorPaths)
+		}
+	}
+	for _, blob := range diff.Blobs {
+		reader, err := engine.GetBlob(context.Background(), blob.Digest)
+		if err != nil {
+			t.Errorf("missing blob %s after applying batch: %+v", blob.Digest, err)
+			continue
+		}
+		reader.Close()
+	}
+	if diff, err := batch.Diff(context.Background()); err != nil || len(diff.References) != 0 || len(diff.Blobs) != 0 {
+		t.Errorf("unexpected diff after applying batch: %+v %+v", diff, err)
+	}
+
+	// Concurrent modifications of the index are detected.
+	if err := batchExt.UpdateReference(context.Background(), "tag", originalPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.DeleteReference(context.Background(), "new-tag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Apply(context.Background()); err == nil {
+		t.Errorf("expected an error applying a batch after a concurrent modification")
+	}
+}
+
+func TestMutateReorderLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateReorderLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	oldManifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := mutator.config.RootFS.DiffIDs
+
+	// Invalid orders are rejected.
+	for _, order := range [][]int{
+		{0, 1, 2},
+		{0, 1, 2, 3, 3},
+		{0, 1, 2, 2},
+		{0, 1, 2, 4},
+		{-1, 1, 2, 3},
+	} {
+		if err := mutator.ReorderLayers(context.Background(), order, nil); err == nil {
+			t.Errorf("expected an error reordering layers into %v", order)
+		}
+	}
+
+	if err := mutator.ReorderLayers(context.Background(), []int{3, 0, 2, 1}, &ispec.History{CreatedBy: "reorder"}); err != nil {
+		t.Fatalf("unexpected error reordering layers: %+v", err)
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedLayers := []ispec.Descriptor{oldManifest.Layers[3], oldManifest.Layers[0], oldManifest.Layers[2], oldManifest.Layers[1]}
+	if !reflect.DeepEqual(manifest.Layers, expectedLayers) {
+		t.Errorf("unexpected layers: got %v, expected %v", manifest.Layers, expectedLayers)
+	}
+	expectedDiffIDs := []digest.Digest{oldDiffIDs[3], oldDiffIDs[0], oldDiffIDs[2], oldDiffIDs[1]}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, expectedDiffIDs) {
+		t.Errorf("unexpected diff_ids: got %v, expected %v", mutator.config.RootFS.DiffIDs, expectedDiffIDs)
+	}
+
+	// The empty-layer entry stays in place.
+	var createdBy []string
+	for _, entry := range mutator.config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+	expectedCreatedBy := []string{"layer 3", "layer 0", "config", "layer 2", "layer 1", "reorder"}
+	if !reflect.DeepEqual(createdBy, expectedCreatedBy) {
+		t.Errorf("unexpected history: got %v, expected %v", createdBy, expectedCreatedBy)
+	}
+	if !mutator.config.History[2].EmptyLayer || !mutator.config.History[len(createdBy)-1].EmptyLayer {
+		t.Errorf("expected the config and reorder history entries to be empty layers")
+	}
+
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected error committing reordered image: %+v", err)
+	}
+}
+
+func TestMutateSetCreation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetCreation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC+1", 3600))
+	author := "Jane Doe <jane@example.com>"
+	if err := mutator.SetCreation(context.Background(), CreationOptions{
+		Created:  &created,
+		Author:   &author,
+		Annotate: true,
+	}); err != nil {
+		t.Fatalf("unexpected error setting creation: %+v", err)
+	}
+	oldHistory := append([]ispec.History{}, mutator.config.History...)
+
+	// Unset fields are not modified.
+	if err := mutator.SetCreation(context.Background(), CreationOptions{}); err != nil {
+		t.Fatalf("unexpected error setting creation: %+v", err)
+	}
+
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Created.Equal(created) || meta.Author != author {
+		t.Errorf("unexpected metadata: got %v %q, expected %v %q", meta.Created, meta.Author, created, author)
+	}
+	annotations, err := mutator.Annotations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations[ispec.AnnotationCreated] != "2020-01-02T02:04:05Z" {
+		t.Errorf("unexpected %s annotation: %q", ispec.AnnotationCreated, annotations[ispec.AnnotationCreated])
+	}
+	if !reflect.DeepEqual(mutator.config.History, oldHistory) {
+		t.Errorf("history was modified: %v", mutator.config.History)
+	}
+}
+
+func TestMutateNormalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateNormalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator, engine := layeredMutator(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	clampTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	before := clampTime.Add(-time.Hour)
+	after := clampTime.Add(time.Hour)
+	mutator.config.Created = &after
+	mutator.config.History[0].Created = &before
+	mutator.config.History[1].Created = &after
+	mutator.manifest.Annotations = map[string]string{ispec.AnnotationCreated: after.Format(time.RFC3339)}
+
+	// Replace a layer with a blob that wasn't compressed deterministically.
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	gzw.Header.ModTime = after
+	gzw.Header.Name = "layer"
+	if _, err := gzw.Write([]byte("layer 0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	blobDigest, blobSize, err := engine.PutBlob(context.Background(), &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalLayer := mutator.manifest.Layers[0]
+	if err := mutator.ReplaceLayerBlob(context.Background(), 0, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    blobDigest,
+		Size:      blobSize,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	oldDiffIDs := append([]digest.Digest{}, mutator.config.RootFS.DiffIDs...)
+
+	if err := mutator.Normalize(context.Background(), NormalizeOptions{ClampTime: clampTime}); err != nil {
+		t.Fatalf("unexpected error normalizing image: %+v", err)
+	}
+
+	if !mutator.config.Created.Equal(clampTime) {
+		t.Errorf("image creation time was not clamped: %v", mutator.config.Created)
+	}
+	if !mutator.config.History[0].Created.Equal(before) {
+		t.Errorf("earlier history creation time was modified: %v", mutator.config.History[0].Created)
+	}
+	if !mutator.config.History[1].Created.Equal(clampTime) {
+		t.Errorf("history creation time was not clamped: %v", mutator.config.History[1].Created)
+	}
+	if value := mutator.manifest.Annotations[ispec.AnnotationCreated]; value != "2020-01-01T00:00:00Z" {
+		t.Errorf("%s annotation was not clamped: %q", ispec.AnnotationCreated, value)
+	}
+	if mutator.manifest.Layers[0].Digest != canonicalLayer.Digest {
+		t.Errorf("layer was not recompressed deterministically: got %s expected %s", mutator.manifest.Layers[0].Digest, canonicalLayer.Digest)
+	}
+	if !reflect.DeepEqual(mutator.config.RootFS.DiffIDs, oldDiffIDs) {
+		t.Errorf("diff_ids were modified by recompression: %v", mutator.config.RootFS.DiffIDs)
+	}
+
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected error committing normalized image: %+v", err)
+	}
+}
+
+func TestNormalizeLayer(t *testing.T) {
+	clampTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The same layer, generated at different times on different hosts.
+	var normalized [][]byte
+	for _, generated := range []time.Time{clampTime.Add(time.Hour), clampTime.Add(48 * time.Hour)} {
+		var raw bytes.Buffer
+		tw := tar.NewWriter(&raw)
+		for _, hdr := range []*tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: clampTime.Add(-time.Hour), Uname: generated.String()},
+			{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4, ModTime: generated, AccessTime: generated, ChangeTime: generated, Format: tar.FormatPAX},
+		} {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Size > 0 {
+				if _, err := tw.Write([]byte("data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var output bytes.Buffer
+		if err := normalizeLayer(&output, &raw, clampTime); err != nil {
+			t.Fatalf("unexpected error normalizing layer: %+v", err)
+		}
+		normalized = append(normalized, output.Bytes())
+	}
+	if !bytes.Equal(normalized[0], normalized[1]) {
+		t.Errorf("normalized layers differ")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(normalized[0]))
+	for _, expected := range []struct {
+		name    string
+		modTime time.Time
+		data    string
+	}{
+		{"etc/", clampTime.Add(-time.Hour), ""},
+		{"etc/file", clampTime, "data"},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("unexpected error reading normalized layer: %+v", err)
+		}
+		if hdr.Name != expected.name || !hdr.ModTime.Equal(expected.modTime) || hdr.Uname != "" || !hdr.AccessTime.IsZero() {
+			t.Errorf("unexpected header: %+v", hdr)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected.data {
+			t.Errorf("unexpected contents of %s: %q", hdr.Name, data)
+		}
+	}
+}
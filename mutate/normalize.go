@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// NormalizeOptions describes how an image is normalized by Normalize.
+type NormalizeOptions struct {
+	// ClampTime is the latest timestamp permitted in the image. Any later
+	// creation times (of the image and of its history entries, as well as
+	// the org.opencontainers.image.created annotation) are replaced with
+	// ClampTime, as are any later modification times in the layers if
+	// RewriteLayers is set.
+	ClampTime time.Time
+
+	// RewriteLayers specifies whether the tar archives of the layers should
+	// be rewritten to remove nondeterministic metadata (see Normalize). This
+	// changes the DiffIDs of the layers.
+	RewriteLayers bool
+
+	// Compressor is used to recompress the layers. If nil, GzipCompressor is
+	// used.
+	Compressor Compressor
+
+	// Workers is the maximum number of layers which are recompressed (or
+	// rewritten) concurrently. If it is not greater than one, the layers are
+	// processed sequentially.
+	Workers int
+}
+
+// Normalize rewrites the image so that it only depends on the contents of the
+// image rather than on when or how it was built, which makes images from
+// different sources (such as mirrors which recompressed the layers)
+// comparable. No history entry is appended, since it would make the image
+// depend on when it was normalized.
+//
+// Every layer is recompressed with the compressor in the options (which must
+// be deterministic, as GzipCompressor is), and all creation times later than
+// the ClampTime in the options are clamped. If RewriteLayers is set, the tar
+// archive of each layer is also rewritten: modification times are clamped,
+// access and change times are removed, and user and group names (which are
+// only looked up on the host which built the layer) are removed. Layers with
+// URLs are left unmodified, since the URLs would no longer refer to the layer
+// blob. The manifest and configuration are always re-encoded when the image
+// is committed, which also sorts the keys of annotations and labels.
+func (m *Mutator) Normalize(ctx context.Context, opt NormalizeOptions) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(m.manifest.Layers) > 0 {
+		if err := m.checkLayerRange(0, len(m.manifest.Layers)-1); err != nil {
+			return err
+		}
+	}
+
+	clamp := func(t *time.Time) *time.Time {
+		if t != nil && t.After(opt.ClampTime) {
+			return timePtr(opt.ClampTime)
+		}
+		return t
+	}
+	m.config.Created = clamp(m.config.Created)
+	var history []ispec.History
+	for _, entry := range m.config.History {
+		entry.Created = clamp(entry.Created)
+		history = append(history, entry)
+	}
+	m.config.History = history
+	if value, ok := m.manifest.Annotations[ispec.AnnotationCreated]; ok {
+		if created, err := time.Parse(time.RFC3339Nano, value); err == nil && created.After(opt.ClampTime) {
+			annotations := copyAnnotations(m.manifest.Annotations)
+			annotations[ispec.AnnotationCreated] = opt.ClampTime.UTC().Format(time.RFC3339Nano)
+			m.manifest.Annotations = annotations
+		}
+	}
+
+	var indices []int
+	for idx, layer := range m.manifest.Layers {
+		if len(layer.URLs) > 0 {
+			log.Warnf("normalize: skipping layer %s: layer has urls", layer.Digest)
+			continue
+		}
+		indices = append(indices, idx)
+	}
+	return m.replaceLayers(indices, opt.Workers, func(index int) (ispec.Descriptor, digest.Digest, error) {
+		if !opt.RewriteLayers {
+			layerDescriptor, diffID, err := m.recompressedLayer(ctx, index, opt.Compressor)
+			return layerDescriptor, diffID, errors.Wrapf(err, "recompress layer %d", index)
+		}
+		layerDescriptor, diffID, err := m.rewrittenLayer(ctx, index, opt)
+		return layerDescriptor, diffID, errors.Wrapf(err, "rewrite layer %d", index)
+	})
+}
+
+// rewrittenLayer writes a copy of the layer with the given index whose tar
+// headers have been normalized by normalizeLayerHeader, and returns its
+// descriptor and DiffID. The mutator is not modified.
+func (m *Mutator) rewrittenLayer(ctx context.Context, index int, opt NormalizeOptions) (ispec.Descriptor, digest.Digest, error) {
+	layer := m.manifest.Layers[index]
+	reader, err := openLayer(ctx, m.engine, layer)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "open layer %s", layer.Digest)
+	}
+	defer reader.Close()
+
+	oldDiffIDDigester := cas.BlobAlgorithm.Digester()
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		pipeWriter.CloseWithError(normalizeLayer(pipeWriter, io.TeeReader(reader, oldDiffIDDigester.Hash()), opt.ClampTime))
+	}()
+
+	layerDescriptor, diffID, err := PutLayer(ctx, m.engine, pipeReader, opt.Compressor)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "put normalized layer")
+	}
+	if err := reader.Verify(); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "verify layer %s", layer.Digest)
+	}
+	if oldDiffID, expected := oldDiffIDDigester.Digest(), m.config.RootFS.DiffIDs[index]; oldDiffID != expected {
+		return ispec.Descriptor{}, "", errors.Errorf("layer %s has diff_id %s but image configuration claims %s", layer.Digest, oldDiffID, expected)
+	}
+
+	if strings.HasPrefix(layer.MediaType, ispec.MediaTypeImageLayerNonDistributable) {
+		layerDescriptor.MediaType = nonDistributableMediaType(layerDescriptor.MediaType)
+	}
+	log.Debugf("normalize: replacing layer %s with %s", layer.Digest, layerDescriptor.Digest)
+	return layerDescriptor, diffID, nil
+}
+
+// normalizeLayer copies the uncompressed layer from r to w, normalizing each
+// tar header with normalizeLayerHeader. The contents of the entries are not
+// modified.
+func normalizeLayer(w io.Writer, r io.Reader, clampTime time.Time) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		normalizeLayerHeader(hdr, clampTime)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header for %s", hdr.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "copy %s", hdr.Name)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
+
+// normalizeLayerHeader removes the nondeterministic metadata from the given
+// tar header, clamping its modification time to clampTime.
+func normalizeLayerHeader(hdr *tar.Header, clampTime time.Time) {
+	// The user and group names are looked up on the host.
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if hdr.ModTime.After(clampTime) {
+		hdr.ModTime = clampTime
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	delete(hdr.PAXRecords, "atime")
+	delete(hdr.PAXRecords, "ctime")
+	delete(hdr.PAXRecords, "uname")
+	delete(hdr.PAXRecords, "gname")
+	delete(hdr.PAXRecords, "mtime")
+
+	// Let the writer pick the most compatible format which can store the
+	// remaining fields.
+	hdr.Format = tar.FormatUnknown
+}
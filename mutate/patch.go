@@ -0,0 +1,165 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ConfigPatch is a strongly-typed patch of an image configuration, with the
+// same structure as the configuration itself. Fields which are nil are not
+// modified. Lists are replaced as a whole, while the entries of sets and maps
+// are merged with the existing entries (with nil entries being removed). The
+// JSON encoding of a ConfigPatch is a JSON merge patch (see MergePatchConfig)
+// with the same effect.
+type ConfigPatch struct {
+	Created      *time.Time        `json:"created,omitempty"`
+	Author       *string           `json:"author,omitempty"`
+	Architecture *string           `json:"architecture,omitempty"`
+	OS           *string           `json:"os,omitempty"`
+	Config       *ImageConfigPatch `json:"config,omitempty"`
+}
+
+// ImageConfigPatch is a patch of the "config" section of an image
+// configuration, including the DockerConfig fields. See ConfigPatch.
+type ImageConfigPatch struct {
+	User         *string              `json:"User,omitempty"`
+	ExposedPorts map[string]*struct{} `json:"ExposedPorts,omitempty"`
+	Env          *[]string            `json:"Env,omitempty"`
+	Entrypoint   *[]string            `json:"Entrypoint,omitempty"`
+	Cmd          *[]string            `json:"Cmd,omitempty"`
+	Volumes      map[string]*struct{} `json:"Volumes,omitempty"`
+	WorkingDir   *string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]*string   `json:"Labels,omitempty"`
+	StopSignal   *string              `json:"StopSignal,omitempty"`
+	Healthcheck  *HealthConfig        `json:"Healthcheck,omitempty"`
+	Shell        *[]string            `json:"Shell,omitempty"`
+	OnBuild      *[]string            `json:"OnBuild,omitempty"`
+}
+
+// mergePatch applies a JSON merge patch (as defined in RFC 7386) to a target
+// value, where both values are JSON values decoded into an interface{}.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// PatchConfig applies a JSON merge patch (as defined in RFC 7386) to the
+// given image configuration and Docker-specific configuration (which are
+// patched as a single image configuration document), returning the patched
+// configurations. The patch must be a valid JSON encoding of a ConfigPatch,
+// so it cannot contain unknown fields or modify the rootfs or history of the
+// image. Applying the same patch more than once has no further effect.
+func PatchConfig(image ispec.Image, docker DockerConfig, patch []byte) (ispec.Image, DockerConfig, error) {
+	// Validate the patch, so that typos are not silently ignored.
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&ConfigPatch{}); err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "invalid config patch")
+	}
+	var patchValue interface{}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "parse config patch")
+	}
+	if _, ok := patchValue.(map[string]interface{}); !ok {
+		return ispec.Image{}, DockerConfig{}, errors.Errorf("config patch must be a JSON object")
+	}
+
+	original, err := json.Marshal(dockerImage{
+		Image: image,
+		Config: dockerImageConfig{
+			ImageConfig:  image.Config,
+			DockerConfig: docker,
+		},
+	})
+	if err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "encode config")
+	}
+	var document interface{}
+	if err := json.Unmarshal(original, &document); err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "parse config")
+	}
+	patched, err := json.Marshal(mergePatch(document, patchValue))
+	if err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "encode patched config")
+	}
+
+	var result dockerImage
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return ispec.Image{}, DockerConfig{}, errors.Wrap(err, "parse patched config")
+	}
+	newImage := result.Image
+	newImage.Config = result.Config.ImageConfig
+	newImage.RootFS = image.RootFS
+	newImage.History = image.History
+	return newImage, result.Config.DockerConfig, nil
+}
+
+// MergePatch applies a JSON merge patch to the image configuration (see
+// PatchConfig). The provided ispec.History entry is appended to the image's
+// history and should correspond to the patch. If history is nil, no history
+// entry is appended.
+func (m *Mutator) MergePatch(ctx context.Context, patch []byte, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	image, docker, err := PatchConfig(*m.config, m.docker, patch)
+	if err != nil {
+		return err
+	}
+	m.config = &image
+	m.docker = docker
+
+	if history != nil {
+		entry := *history
+		entry.EmptyLayer = true
+		m.config.History = append(m.config.History, entry)
+	}
+	return nil
+}
+
+// Patch applies a strongly-typed patch to the image configuration, in the
+// same way as MergePatch.
+func (m *Mutator) Patch(ctx context.Context, patch ConfigPatch, history *ispec.History) error {
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return errors.Wrap(err, "encode config patch")
+	}
+	return m.MergePatch(ctx, encoded, history)
+}
@@ -0,0 +1,126 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/parallel"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RecompressLayer replaces the blob of the layer with the given index
+// (counting from zero) with a new blob containing the same layer, compressed
+// with the given compressor (or GzipCompressor if nil). The layer is streamed
+// from the old blob to the new one, so it is never extracted, and the old blob
+// is verified against the DiffID in the image configuration along the way.
+//
+// The uncompressed contents are passed to the compressor unchanged, so the
+// DiffID of the layer is preserved unless the compressor itself modifies the
+// layer (such as eStargz, which adds a table of contents to the layer). The
+// history entry of the layer is kept as-is. Whether the layer is
+// non-distributable is also preserved, but layers with URLs cannot be
+// recompressed because the URLs would no longer refer to the layer blob.
+func (m *Mutator) RecompressLayer(ctx context.Context, index int, compressor Compressor) error {
+	return m.RecompressLayers(ctx, []int{index}, compressor, 1)
+}
+
+// RecompressLayers is the same as RecompressLayer, except that each of the
+// layers with the given indices is recompressed, with up to workers layers
+// being recompressed concurrently. The layers are only replaced if all of
+// them were recompressed successfully.
+func (m *Mutator) RecompressLayers(ctx context.Context, indices []int, compressor Compressor, workers int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	for _, index := range indices {
+		if err := m.checkLayerRange(index, index); err != nil {
+			return err
+		}
+		if layer := m.manifest.Layers[index]; len(layer.URLs) > 0 {
+			return errors.Errorf("cannot recompress layer %s: layer has urls", layer.Digest)
+		}
+	}
+
+	return m.replaceLayers(indices, workers, func(index int) (ispec.Descriptor, digest.Digest, error) {
+		layerDescriptor, diffID, err := m.recompressedLayer(ctx, index, compressor)
+		if err != nil && len(indices) > 1 {
+			err = errors.Wrapf(err, "recompress layer %d", index)
+		}
+		return layerDescriptor, diffID, err
+	})
+}
+
+// recompressedLayer writes a copy of the layer with the given index,
+// compressed with the given compressor, and returns its descriptor and
+// DiffID. The mutator is not modified.
+func (m *Mutator) recompressedLayer(ctx context.Context, index int, compressor Compressor) (ispec.Descriptor, digest.Digest, error) {
+	layer := m.manifest.Layers[index]
+	reader, err := openLayer(ctx, m.engine, layer)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "open layer %s", layer.Digest)
+	}
+	defer reader.Close()
+
+	oldDiffIDDigester := cas.BlobAlgorithm.Digester()
+	layerDescriptor, diffID, err := PutLayer(ctx, m.engine, io.TeeReader(reader, oldDiffIDDigester.Hash()), compressor)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "put recompressed layer")
+	}
+	if err := reader.Verify(); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "verify layer %s", layer.Digest)
+	}
+	if oldDiffID, expected := oldDiffIDDigester.Digest(), m.config.RootFS.DiffIDs[index]; oldDiffID != expected {
+		return ispec.Descriptor{}, "", errors.Errorf("layer %s has diff_id %s but image configuration claims %s", layer.Digest, oldDiffID, expected)
+	}
+
+	if strings.HasPrefix(layer.MediaType, ispec.MediaTypeImageLayerNonDistributable) {
+		layerDescriptor.MediaType = nonDistributableMediaType(layerDescriptor.MediaType)
+	}
+	log.Debugf("recompress: replacing layer %s with %s", layer.Digest, layerDescriptor.Digest)
+	return layerDescriptor, diffID, nil
+}
+
+// replaceLayers replaces each of the layers with the given indices with the
+// new layer blob returned by fn, which is called for up to workers layers
+// concurrently (and so must not modify the mutator). The layers are only
+// replaced once every call to fn has succeeded.
+func (m *Mutator) replaceLayers(indices []int, workers int, fn func(index int) (ispec.Descriptor, digest.Digest, error)) error {
+	layers := make([]ispec.Descriptor, len(indices))
+	diffIDs := make([]digest.Digest, len(indices))
+	if err := parallel.Do(len(indices), workers, func(idx int) error {
+		var err error
+		layers[idx], diffIDs[idx], err = fn(indices[idx])
+		return err
+	}); err != nil {
+		return err
+	}
+
+	for idx, index := range indices {
+		if err := m.splice(index, index, &layers[idx], diffIDs[idx], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
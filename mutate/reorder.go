@@ -0,0 +1,89 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReorderLayers moves the layers of the image into the given order, where
+// order[i] is the current index (counting from zero) of the layer which
+// becomes the i-th layer, so order must contain every index exactly once.
+// This is useful for (for instance) moving a rarely-changing layer below
+// frequently-changing layers, so that it can be cached. The DiffIDs are
+// reordered to match, and the history entry of each layer moves with it
+// (empty-layer entries are left as-is). The given history entry (if not nil)
+// is appended to the image's history as an empty-layer entry describing the
+// reordering.
+//
+// No layer blobs are modified, so if several layers modify the same path the
+// reordering changes the contents of the flattened root filesystem. Use
+// layer.FindOverlaps to check for this beforehand.
+func (m *Mutator) ReorderLayers(ctx context.Context, order []int, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(order) != len(m.manifest.Layers) {
+		return errors.Errorf("invalid layer order: got %d layers but the image has %d layers", len(order), len(m.manifest.Layers))
+	}
+	seen := map[int]bool{}
+	for _, idx := range order {
+		if idx < 0 || idx >= len(m.manifest.Layers) {
+			return errors.Errorf("invalid layer order: no layer %d (image has %d layers)", idx, len(m.manifest.Layers))
+		}
+		if seen[idx] {
+			return errors.Errorf("invalid layer order: layer %d is included more than once", idx)
+		}
+		seen[idx] = true
+	}
+	if len(order) > 0 {
+		if err := m.checkLayerRange(0, len(order)-1); err != nil {
+			return err
+		}
+	}
+	historyIndices, err := m.layerHistory()
+	if err != nil {
+		return err
+	}
+
+	var layers []ispec.Descriptor
+	var diffIDs []digest.Digest
+	for _, idx := range order {
+		layers = append(layers, m.manifest.Layers[idx])
+		diffIDs = append(diffIDs, m.config.RootFS.DiffIDs[idx])
+	}
+	m.manifest.Layers = layers
+	m.config.RootFS.DiffIDs = diffIDs
+
+	if historyIndices != nil {
+		entries := append([]ispec.History{}, m.config.History...)
+		for newIdx, oldIdx := range order {
+			entries[historyIndices[newIdx]] = m.config.History[historyIndices[oldIdx]]
+		}
+		m.config.History = entries
+	}
+	if history != nil {
+		entry := *history
+		entry.EmptyLayer = true
+		m.config.History = append(m.config.History, entry)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Rollback restores the reference with the given name to the entry it had
+// before it was last updated (such as by committing a Mutator and updating
+// the reference to the new image), as recorded by casext.UpdateReference. The
+// blobs of the previous image are not referenced by the layout after the
+// update, so this is only possible until they are garbage collected. The
+// restored descriptor is returned.
+//
+// Restoring the reference is itself an update, so rolling back a reference
+// twice restores the entry it had before the first rollback.
+func Rollback(ctx context.Context, engine cas.Engine, refname string) (ispec.Descriptor, error) {
+	engineExt := casext.NewEngine(engine)
+
+	previous, err := engineExt.PreviousReference(ctx, refname)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get previous reference")
+	}
+
+	// Make sure that every blob of the previous image is still present, so
+	// that the reference isn't pointed at a broken image.
+	if err := engineExt.Walk(ctx, previous, func(descriptorPath casext.DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		if len(descriptor.URLs) > 0 {
+			// Blobs with URLs need not be stored in the layout.
+			return nil
+		}
+		blob, err := engine.GetBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return err
+		}
+		return blob.Close()
+	}); err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return ispec.Descriptor{}, errors.Errorf("previous image %s of %s is no longer in the layout (it may have been garbage collected)", previous.Digest, refname)
+		}
+		return ispec.Descriptor{}, errors.Wrap(err, "check previous image")
+	}
+
+	log.Debugf("rollback: restoring %s to %s", refname, previous.Digest)
+	if err := engineExt.UpdateReference(ctx, refname, previous); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "update reference")
+	}
+	return previous, nil
+}
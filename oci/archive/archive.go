@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package archive implements conversion between OCI images and single-file
+// image archives: "docker-archive" tarballs (as produced by "docker save" and
+// consumed by "docker load") and "oci-archive" tarballs (a tar archive of an
+// OCI image layout).
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Format is the format of an image archive.
+type Format string
+
+const (
+	// DockerArchive is the format of the tarballs produced by "docker save".
+	DockerArchive Format = "docker-archive"
+
+	// OCIArchive is a tar archive of an OCI image layout.
+	OCIArchive Format = "oci-archive"
+)
+
+// ParseFormat parses the name of an archive format.
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(value); format {
+	case DockerArchive, OCIArchive:
+		return format, nil
+	}
+	return "", errors.Errorf("unknown archive format: %s", value)
+}
+
+// archiveTime is the modification time of every entry in the archives
+// written by this package, so that exporting the same image always produces
+// the same archive.
+var archiveTime = time.Unix(0, 0)
+
+// addDir adds a directory entry to the archive.
+func addDir(tw *tar.Writer, name string) error {
+	return errors.Wrapf(tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  archiveTime,
+	}), "write %s", name)
+}
+
+// addFile adds a regular file with the given size and contents to the
+// archive.
+func addFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  archiveTime,
+	}); err != nil {
+		return errors.Wrapf(err, "write %s header", name)
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	if n != size {
+		return errors.Errorf("write %s: expected %d bytes, got %d", name, size, n)
+	}
+	return nil
+}
+
+// verifiedReader reads the contents of a blob, returning an error at EOF if
+// the contents do not match the expected digest and size.
+type verifiedReader struct {
+	r        io.Reader
+	digester digest.Digester
+	expected digest.Digest
+	size     int64
+	n        int64
+}
+
+func newVerifiedReader(r io.Reader, expected digest.Digest, size int64) *verifiedReader {
+	return &verifiedReader{
+		r:        r,
+		digester: expected.Algorithm().Digester(),
+		expected: expected,
+		size:     size,
+	}
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	_, _ = v.digester.Hash().Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF && (v.n != v.size || v.digester.Digest() != v.expected) {
+		return n, errors.Errorf("blob is %s (%d bytes) but descriptor is %s (%d bytes)", v.digester.Digest(), v.n, v.expected, v.size)
+	}
+	return n, err
+}
@@ -0,0 +1,248 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// archiveTestImage stores an image with a single gzip-compressed layer in a
+// new image layout, returning the engine and the descriptor of the manifest as
+// well as the uncompressed layer.
+func archiveTestImage(t *testing.T, ctx context.Context, root string) (casext.Engine, ispec.Descriptor, []byte) {
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	if err := tw.WriteHeader(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("umoci\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.SHA256.FromBytes(raw.Bytes())},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Config:    ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+		Layers:    []ispec.Descriptor{{MediaType: ispec.MediaTypeImageLayerGzip, Digest: layerDigest, Size: layerSize}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+	return engineExt, manifest, raw.Bytes()
+}
+
+// readArchive returns the contents of every regular file in a tar archive,
+// and the names of its directories.
+func readArchive(t *testing.T, r io.Reader) (map[string][]byte, []string) {
+	files := map[string][]byte{}
+	var dirs []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading archive: %+v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, hdr.Name)
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+			}
+			files[hdr.Name] = data
+		default:
+			t.Errorf("unexpected entry type %q for %s", hdr.Typeflag, hdr.Name)
+		}
+	}
+	return files, dirs
+}
+
+func TestWriteDockerArchive(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestWriteDockerArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifestDescriptor, layerData := archiveTestImage(t, ctx, root)
+	defer engineExt.Close()
+
+	// The same image twice must only include its blobs once.
+	var output bytes.Buffer
+	if err := WriteDockerArchive(ctx, engineExt, &output, []DockerImage{
+		{Manifest: manifestDescriptor, RepoTags: []string{"example.com/image:latest"}},
+		{Manifest: manifestDescriptor},
+	}); err != nil {
+		t.Fatalf("unexpected error writing archive: %+v", err)
+	}
+	files, dirs := readArchive(t, &output)
+
+	manifest, err := engineExt.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := manifest.Data.(ispec.Manifest).Config.Digest
+	diffID := digest.SHA256.FromBytes(layerData)
+
+	configName := configDigest.Hex() + ".json"
+	layerName := diffID.Hex() + "/layer.tar"
+	if len(files) != 3 {
+		t.Errorf("expected 3 files in archive, got %d", len(files))
+	}
+	if got := digest.SHA256.FromBytes(files[configName]); got != configDigest {
+		t.Errorf("expected %s to have digest %s, got %s", configName, configDigest, got)
+	}
+	if !bytes.Equal(files[layerName], layerData) {
+		t.Errorf("expected %s to be the uncompressed layer", layerName)
+	}
+	if !reflect.DeepEqual(dirs, []string{diffID.Hex() + "/"}) {
+		t.Errorf("unexpected directories in archive: %v", dirs)
+	}
+
+	var manifests []dockerManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifests); err != nil {
+		t.Fatalf("unexpected error parsing manifest.json: %+v", err)
+	}
+	expected := []dockerManifest{
+		{Config: configName, RepoTags: []string{"example.com/image:latest"}, Layers: []string{layerName}},
+		{Config: configName, RepoTags: []string{}, Layers: []string{layerName}},
+	}
+	if !reflect.DeepEqual(manifests, expected) {
+		t.Errorf("unexpected manifest.json: expected %#v, got %#v", expected, manifests)
+	}
+
+	// Only image manifests can be exported.
+	bogus := manifestDescriptor
+	bogus.MediaType = ispec.MediaTypeImageIndex
+	if err := WriteDockerArchive(ctx, engineExt, ioutil.Discard, []DockerImage{{Manifest: bogus}}); err == nil {
+		t.Errorf("expected an error exporting an index")
+	}
+}
+
+func TestWriteOCIArchive(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestWriteOCIArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifestDescriptor, _ := archiveTestImage(t, ctx, root)
+	defer engineExt.Close()
+
+	var output bytes.Buffer
+	if err := WriteOCIArchive(ctx, engineExt, &output, manifestDescriptor, "latest"); err != nil {
+		t.Fatalf("unexpected error writing archive: %+v", err)
+	}
+	files, dirs := readArchive(t, &output)
+
+	if !reflect.DeepEqual(dirs, []string{"blobs/", "blobs/sha256/"}) {
+		t.Errorf("unexpected directories in archive: %v", dirs)
+	}
+
+	// Every blob must be included, and stored under its digest.
+	blobs := 0
+	for name, data := range files {
+		if filepath.Dir(name) != "blobs/sha256" {
+			continue
+		}
+		blobs++
+		if got := digest.SHA256.FromBytes(data).Hex(); got != filepath.Base(name) {
+			t.Errorf("blob %s has digest %s", name, got)
+		}
+	}
+	if blobs != 3 {
+		t.Errorf("expected 3 blobs in archive, got %d", blobs)
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatalf("unexpected error parsing index.json: %+v", err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("expected 1 entry in index.json, got %d", len(index.Manifests))
+	}
+	if got := index.Manifests[0]; got.Digest != manifestDescriptor.Digest || got.Annotations[ispec.AnnotationRefName] != "latest" {
+		t.Errorf("unexpected entry in index.json: %#v", got)
+	}
+	if _, ok := files["oci-layout"]; !ok {
+		t.Errorf("expected oci-layout in archive")
+	}
+}
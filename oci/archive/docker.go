@@ -0,0 +1,176 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// dockerManifestName is the name of the file describing the images in a
+// docker-archive.
+const dockerManifestName = "manifest.json"
+
+// dockerManifest is an entry in the manifest.json of a docker-archive. The
+// paths are relative to the root of the archive.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// DockerImage is an image to be written to a docker-archive.
+type DockerImage struct {
+	// Manifest is the descriptor of the image manifest.
+	Manifest ispec.Descriptor
+
+	// RepoTags are the names (of the form "repository:tag") the image is
+	// given when it is loaded. If empty, the image is loaded untagged.
+	RepoTags []string
+}
+
+// dockerLayerName returns the path of the layer with the given DiffID in a
+// docker-archive.
+func dockerLayerName(diffID digest.Digest) string {
+	return path.Join(diffID.Hex(), "layer.tar")
+}
+
+// writeDockerLayer adds the uncompressed contents of the given layer to the
+// archive, verifying that they match the DiffID. The layer has to be staged in
+// a temporary file, because the size of the uncompressed layer must be known
+// before it is added to the archive.
+func writeDockerLayer(ctx context.Context, engine cas.Engine, tw *tar.Writer, descriptor ispec.Descriptor, diffID digest.Digest) error {
+	staged, err := ioutil.TempFile("", "umoci-export-layer-")
+	if err != nil {
+		return errors.Wrap(err, "create staged layer")
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	if err := layer.ReadLayer(ctx, engine, descriptor, diffID, func(r io.Reader) error {
+		_, err := io.Copy(staged, r)
+		return errors.Wrap(err, "write staged layer")
+	}); err != nil {
+		return err
+	}
+	size, err := staged.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "get staged layer size")
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "rewind staged layer")
+	}
+
+	if err := addDir(tw, diffID.Hex()); err != nil {
+		return err
+	}
+	return addFile(tw, dockerLayerName(diffID), size, staged)
+}
+
+// WriteDockerArchive writes the given images to w as a docker-archive, which
+// can be loaded with "docker load" (or "podman load"). The layers are stored
+// uncompressed (as "<diffid>/layer.tar"), and the configuration of each image
+// is stored as "<digest>.json".
+func WriteDockerArchive(ctx context.Context, engine cas.Engine, w io.Writer, images []DockerImage) error {
+	engineExt := casext.NewEngine(engine)
+	tw := tar.NewWriter(w)
+
+	var (
+		manifests     []dockerManifest
+		writtenBlobs  = map[digest.Digest]struct{}{}
+		writtenLayers = map[digest.Digest]struct{}{}
+	)
+	for _, image := range images {
+		if image.Manifest.MediaType != ispec.MediaTypeImageManifest {
+			return errors.Errorf("cannot export %s to a docker-archive: not an image manifest: %s", image.Manifest.Digest, image.Manifest.MediaType)
+		}
+		manifestBlob, err := engineExt.FromDescriptor(ctx, image.Manifest)
+		if err != nil {
+			return errors.Wrap(err, "get manifest")
+		}
+		manifest, ok := manifestBlob.Data.(ispec.Manifest)
+		manifestBlob.Close()
+		if !ok {
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.MediaType)
+		}
+
+		// The configuration is copied verbatim, so that the image ID (the
+		// digest of the configuration) is the same after it is loaded.
+		reader, err := engine.GetBlob(ctx, manifest.Config.Digest)
+		if err != nil {
+			return errors.Wrap(err, "get config blob")
+		}
+		configData, err := ioutil.ReadAll(newVerifiedReader(reader, manifest.Config.Digest, manifest.Config.Size))
+		reader.Close()
+		if err != nil {
+			return errors.Wrap(err, "read config blob")
+		}
+		var config ispec.Image
+		if err := json.Unmarshal(configData, &config); err != nil {
+			return errors.Wrap(err, "parse config blob")
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			return errors.Errorf("config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+		}
+
+		entry := dockerManifest{
+			Config:   manifest.Config.Digest.Hex() + ".json",
+			RepoTags: append([]string{}, image.RepoTags...),
+		}
+		if _, ok := writtenBlobs[manifest.Config.Digest]; !ok {
+			if err := addFile(tw, entry.Config, int64(len(configData)), bytes.NewReader(configData)); err != nil {
+				return err
+			}
+			writtenBlobs[manifest.Config.Digest] = struct{}{}
+		}
+		for idx, layerDescriptor := range manifest.Layers {
+			diffID := config.RootFS.DiffIDs[idx]
+			if _, ok := writtenLayers[diffID]; !ok {
+				if err := writeDockerLayer(ctx, engine, tw, layerDescriptor, diffID); err != nil {
+					return errors.Wrapf(err, "write layer %s", layerDescriptor.Digest)
+				}
+				writtenLayers[diffID] = struct{}{}
+			}
+			entry.Layers = append(entry.Layers, dockerLayerName(diffID))
+		}
+		manifests = append(manifests, entry)
+	}
+
+	manifestData, err := json.Marshal(manifests)
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest.json")
+	}
+	if err := addFile(tw, dockerManifestName, int64(len(manifestData)), bytes.NewReader(manifestData)); err != nil {
+		return err
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
@@ -0,0 +1,321 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// annotationContainerdName is the annotation used by containerd (and "docker
+// save" since Docker 25) to store the full name of an image in the index of
+// an oci-archive.
+const annotationContainerdName = "io.containerd.image.name"
+
+// Image is an image read from an archive.
+type Image struct {
+	// Descriptor is the descriptor of the image in the engine the archive was
+	// read into.
+	Descriptor ispec.Descriptor
+
+	// Names are the names of the image in the archive (the RepoTags of a
+	// docker-archive, or the reference names of an oci-archive).
+	Names []string
+}
+
+// detectFormat returns the format of a staged archive. Archives produced by
+// "docker save" since Docker 25 are both a docker-archive and an OCI image
+// layout, in which case they are treated as a docker-archive (so that the
+// RepoTags are used as the names of the images).
+func (a *stagedArchive) detectFormat() (Format, error) {
+	if a.Has(dockerManifestName) {
+		return DockerArchive, nil
+	}
+	if a.Has(ociLayoutName) && a.Has(ociIndexName) {
+		return OCIArchive, nil
+	}
+	return "", errors.Errorf("unknown archive format: archive contains neither %s nor %s", dockerManifestName, ociLayoutName)
+}
+
+// ReadArchive reads an archive of the given format (or, if format is empty,
+// of the format detected from its contents) from r, and adds every image in
+// it to the engine. The images are not added to the index of the engine, so
+// they must be tagged (or will be removed by the next garbage collection).
+//
+// The layers of a docker-archive are compressed, and each image is given an
+// OCI manifest. Images in an oci-archive which use Docker media types are
+// converted to use OCI media types. The configuration of each image is kept
+// verbatim. Every blob is verified while it is read.
+func ReadArchive(ctx context.Context, engine cas.Engine, r io.Reader, format Format) ([]Image, error) {
+	archive, err := stageArchive(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read archive")
+	}
+	defer archive.Close()
+
+	if format == "" {
+		format, err = archive.detectFormat()
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case DockerArchive:
+		return readDockerArchive(ctx, engine, archive)
+	case OCIArchive:
+		return readOCIArchive(ctx, engine, archive)
+	}
+	return nil, errors.Errorf("unknown archive format: %s", format)
+}
+
+// isGzip returns whether the stream starts with the gzip magic number.
+func isGzip(r *bufio.Reader) bool {
+	magic, _ := r.Peek(2)
+	return bytes.Equal(magic, []byte{0x1f, 0x8b})
+}
+
+// readDockerLayer adds the layer with the given name in a docker-archive to
+// the engine, returning the descriptor of the compressed layer and its
+// DiffID. Layers are usually stored uncompressed, but "docker save" keeps the
+// compressed layers pulled from a registry since Docker 25.
+func readDockerLayer(ctx context.Context, engine cas.Engine, archive *stagedArchive, name string) (ispec.Descriptor, digest.Digest, error) {
+	fh, err := archive.Open(name)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer fh.Close()
+
+	if !isGzip(bufio.NewReader(fh)) {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return ispec.Descriptor{}, "", errors.Wrap(err, "rewind layer")
+		}
+		return mutate.PutLayer(ctx, engine, fh, mutate.GzipCompressor)
+	}
+
+	// The layer is already compressed, so it is added as-is and only
+	// decompressed to compute its DiffID.
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "rewind layer")
+	}
+	descriptor, err := mutate.PutBlob(ctx, engine, ispec.MediaTypeImageLayerGzip, fh)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "rewind layer")
+	}
+	gzr, err := gzip.NewReader(fh)
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "decompress layer")
+	}
+	defer gzr.Close()
+	diffIDDigester := cas.BlobAlgorithm.Digester()
+	if _, err := io.Copy(diffIDDigester.Hash(), gzr); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "decompress layer")
+	}
+	return descriptor, diffIDDigester.Digest(), nil
+}
+
+// readDockerArchive adds every image listed in the manifest.json of a
+// docker-archive to the engine.
+func readDockerArchive(ctx context.Context, engine cas.Engine, archive *stagedArchive) ([]Image, error) {
+	engineExt := casext.NewEngine(engine)
+
+	manifestData, err := archive.ReadFile(dockerManifestName)
+	if err != nil {
+		return nil, errors.Wrap(err, "read docker-archive")
+	}
+	var manifests []dockerManifest
+	if err := json.Unmarshal(manifestData, &manifests); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", dockerManifestName)
+	}
+
+	// Layers shared between images are only added once.
+	type layerBlob struct {
+		descriptor ispec.Descriptor
+		diffID     digest.Digest
+	}
+	layers := map[string]layerBlob{}
+
+	var images []Image
+	for _, entry := range manifests {
+		configData, err := archive.ReadFile(entry.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "read config")
+		}
+		var config ispec.Image
+		if err := json.Unmarshal(configData, &config); err != nil {
+			return nil, errors.Wrapf(err, "parse config %s", entry.Config)
+		}
+		if len(config.RootFS.DiffIDs) != len(entry.Layers) {
+			return nil, errors.Errorf("config %s: rootfs.diff_ids has %d entries but the image has %d layers", entry.Config, len(config.RootFS.DiffIDs), len(entry.Layers))
+		}
+		configDescriptor, err := mutate.PutBlob(ctx, engine, ispec.MediaTypeImageConfig, bytes.NewReader(configData))
+		if err != nil {
+			return nil, errors.Wrap(err, "put config")
+		}
+
+		manifest := ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			Config:    configDescriptor,
+		}
+		for idx, name := range entry.Layers {
+			name = cleanName(name)
+			layer, ok := layers[name]
+			if !ok {
+				layer.descriptor, layer.diffID, err = readDockerLayer(ctx, engine, archive, name)
+				if err != nil {
+					return nil, errors.Wrapf(err, "read layer %s", name)
+				}
+				layers[name] = layer
+			}
+			if layer.diffID != config.RootFS.DiffIDs[idx] {
+				return nil, errors.Errorf("layer %s has diff_id %s but config %s expects %s", name, layer.diffID, entry.Config, config.RootFS.DiffIDs[idx])
+			}
+			manifest.Layers = append(manifest.Layers, layer.descriptor)
+		}
+
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			return nil, errors.Wrap(err, "put manifest")
+		}
+		images = append(images, Image{
+			Descriptor: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageManifest,
+				Digest:    manifestDigest,
+				Size:      manifestSize,
+			},
+			Names: entry.RepoTags,
+		})
+	}
+	return images, nil
+}
+
+// readOCIArchive adds every blob in an oci-archive to the engine, and returns
+// the images in its index.
+func readOCIArchive(ctx context.Context, engine cas.Engine, archive *stagedArchive) ([]Image, error) {
+	engineExt := casext.NewEngine(engine)
+
+	var layout ispec.ImageLayout
+	layoutData, err := archive.ReadFile(ociLayoutName)
+	if err != nil {
+		return nil, errors.Wrap(err, "read oci-archive")
+	}
+	if err := json.Unmarshal(layoutData, &layout); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", ociLayoutName)
+	}
+	if layout.Version != ispec.ImageLayoutVersion {
+		return nil, errors.Errorf("unsupported image layout version: %s", layout.Version)
+	}
+
+	var index ispec.Index
+	indexData, err := archive.ReadFile(ociIndexName)
+	if err != nil {
+		return nil, errors.Wrap(err, "read oci-archive")
+	}
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", ociIndexName)
+	}
+
+	// Add every blob (even those not reachable from the index, which will be
+	// removed by the next garbage collection), verifying their digests.
+	for name := range archive.files {
+		if !strings.HasPrefix(name, ociBlobsDir+"/") {
+			continue
+		}
+		expected, err := digest.Parse(path.Base(path.Dir(name)) + ":" + path.Base(name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid blob name %s", name)
+		}
+		if ociBlobName(expected) != name {
+			return nil, errors.Errorf("invalid blob name %s", name)
+		}
+		if err := putVerifiedBlob(ctx, engine, archive, name, expected); err != nil {
+			return nil, err
+		}
+	}
+
+	var images []Image
+	for _, descriptor := range index.Manifests {
+		// Make sure the whole image is in the archive.
+		if err := engineExt.Walk(ctx, descriptor, func(casext.DescriptorPath) error {
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "image %s is incomplete", descriptor.Digest)
+		}
+
+		var names []string
+		for _, annotation := range []string{ispec.AnnotationRefName, annotationContainerdName} {
+			if name, ok := descriptor.Annotations[annotation]; ok {
+				names = append(names, name)
+			}
+		}
+		descriptor.Annotations = nil
+
+		switch descriptor.MediaType {
+		case casext.MediaTypeDockerManifest, casext.MediaTypeDockerManifestList:
+			converted, err := mutate.Convert(ctx, engine, descriptor, mutate.FormatOCI)
+			if err != nil {
+				return nil, errors.Wrapf(err, "convert image %s", descriptor.Digest)
+			}
+			descriptor = converted
+		}
+		images = append(images, Image{
+			Descriptor: descriptor,
+			Names:      names,
+		})
+	}
+	return images, nil
+}
+
+// putVerifiedBlob adds the file with the given name in the archive to the
+// engine, checking that it has the expected digest.
+func putVerifiedBlob(ctx context.Context, engine cas.Engine, archive *stagedArchive, name string, expected digest.Digest) error {
+	fh, err := archive.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat %s", name)
+	}
+	blobDigest, _, err := engine.PutBlob(ctx, newVerifiedReader(fh, expected, fi.Size()))
+	if err != nil {
+		return errors.Wrapf(err, "put blob %s", name)
+	}
+	if blobDigest != expected {
+		return errors.Errorf("blob %s has digest %s", name, blobDigest)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// openTestLayout creates and opens a new image layout.
+func openTestLayout(t *testing.T, root, name string) casext.Engine {
+	image := filepath.Join(root, name)
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	return casext.NewEngine(engine)
+}
+
+// imageConfig returns the digest of the configuration and the DiffIDs of the
+// image with the given manifest.
+func imageConfig(t *testing.T, ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) (digest.Digest, []digest.Digest) {
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		t.Fatalf("unexpected error reading manifest: %+v", err)
+	}
+	manifest := manifestBlob.Data.(ispec.Manifest)
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatalf("unexpected error reading config: %+v", err)
+	}
+	return manifest.Config.Digest, configBlob.Data.(ispec.Image).RootFS.DiffIDs
+}
+
+func TestReadArchiveDocker(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReadArchiveDocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcEngine, manifestDescriptor, _ := archiveTestImage(t, ctx, root)
+	defer srcEngine.Close()
+
+	var archive bytes.Buffer
+	if err := WriteDockerArchive(ctx, srcEngine, &archive, []DockerImage{
+		{Manifest: manifestDescriptor, RepoTags: []string{"example.com/image:latest"}},
+	}); err != nil {
+		t.Fatalf("unexpected error writing archive: %+v", err)
+	}
+
+	dstEngine := openTestLayout(t, root, "imported")
+	defer dstEngine.Close()
+
+	images, err := ReadArchive(ctx, dstEngine, bytes.NewReader(archive.Bytes()), "")
+	if err != nil {
+		t.Fatalf("unexpected error reading archive: %+v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("expected 1 image, got %d", len(images))
+	}
+	if !reflect.DeepEqual(images[0].Names, []string{"example.com/image:latest"}) {
+		t.Errorf("unexpected image names: %v", images[0].Names)
+	}
+	if images[0].Descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected image media type: %s", images[0].Descriptor.MediaType)
+	}
+
+	// The configuration must be unchanged, and every blob must be valid.
+	srcConfig, srcDiffIDs := imageConfig(t, ctx, srcEngine, manifestDescriptor)
+	dstConfig, dstDiffIDs := imageConfig(t, ctx, dstEngine, images[0].Descriptor)
+	if srcConfig != dstConfig {
+		t.Errorf("expected config %s, got %s", srcConfig, dstConfig)
+	}
+	if !reflect.DeepEqual(srcDiffIDs, dstDiffIDs) {
+		t.Errorf("expected diff_ids %v, got %v", srcDiffIDs, dstDiffIDs)
+	}
+	issues, err := dstEngine.Verify(ctx, []ispec.Descriptor{images[0].Descriptor})
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("imported image has issues: %v", issues)
+	}
+}
+
+func TestReadArchiveOCI(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReadArchiveOCI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	srcEngine, manifestDescriptor, _ := archiveTestImage(t, ctx, root)
+	defer srcEngine.Close()
+
+	var archive bytes.Buffer
+	if err := WriteOCIArchive(ctx, srcEngine, &archive, manifestDescriptor, "latest"); err != nil {
+		t.Fatalf("unexpected error writing archive: %+v", err)
+	}
+
+	dstEngine := openTestLayout(t, root, "imported")
+	defer dstEngine.Close()
+
+	images, err := ReadArchive(ctx, dstEngine, bytes.NewReader(archive.Bytes()), OCIArchive)
+	if err != nil {
+		t.Fatalf("unexpected error reading archive: %+v", err)
+	}
+	expected := []Image{{Descriptor: manifestDescriptor, Names: []string{"latest"}}}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected images %#v, got %#v", expected, images)
+	}
+
+	// Corrupted blobs must be rejected.
+	files, _ := readArchive(t, bytes.NewReader(archive.Bytes()))
+	var corrupted bytes.Buffer
+	tw := tar.NewWriter(&corrupted)
+	for name, data := range files {
+		if name == ociBlobName(manifestDescriptor.Digest) {
+			data = append(data, '\n')
+		}
+		if err := addFile(tw, name, int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadArchive(ctx, dstEngine, &corrupted, OCIArchive); err == nil {
+		t.Errorf("expected an error reading a corrupted archive")
+	}
+}
+
+func TestStageArchive(t *testing.T) {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, hdr := range []tar.Header{
+		{Name: "../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "./dir/file", Typeflag: tar.TypeReg},
+		{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "file"},
+		{Name: "abs-symlink", Typeflag: tar.TypeSymlink, Linkname: "/dir/symlink"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+		{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"},
+	} {
+		hdr := hdr
+		data := []byte(hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := stageArchive(&raw)
+	if err != nil {
+		t.Fatalf("unexpected error staging archive: %+v", err)
+	}
+	defer archive.Close()
+
+	for name, expected := range map[string]string{
+		"etc/passwd":  "../../etc/passwd",
+		"dir/file":    "./dir/file",
+		"dir/symlink": "./dir/file",
+		"abs-symlink": "./dir/file",
+		"hardlink":    "./dir/file",
+	} {
+		data, err := archive.ReadFile(name)
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", name, err)
+			continue
+		}
+		if string(data) != expected {
+			t.Errorf("expected %s to contain %q, got %q", name, expected, data)
+		}
+	}
+	for _, name := range []string{"loop", "nonexistent", "dir"} {
+		if archive.Has(name) {
+			t.Errorf("expected %s to not be readable", name)
+		}
+	}
+}
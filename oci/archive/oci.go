@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The names of the files in an OCI image layout.
+const (
+	ociLayoutName = "oci-layout"
+	ociIndexName  = "index.json"
+	ociBlobsDir   = "blobs"
+)
+
+// ociBlobName returns the path of the blob with the given digest in an OCI
+// image layout.
+func ociBlobName(blobDigest digest.Digest) string {
+	return path.Join(ociBlobsDir, blobDigest.Algorithm().String(), blobDigest.Hex())
+}
+
+// WriteOCIArchive writes an oci-archive to w, which contains an OCI image
+// layout with every blob reachable from the given descriptor (which can be a
+// manifest or an index). The descriptor is the only entry in the index of the
+// layout, with the given reference name.
+func WriteOCIArchive(ctx context.Context, engine cas.Engine, w io.Writer, root ispec.Descriptor, name string) error {
+	engineExt := casext.NewEngine(engine)
+	tw := tar.NewWriter(w)
+
+	layoutData, err := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "marshal oci-layout")
+	}
+	if err := addFile(tw, ociLayoutName, int64(len(layoutData)), bytes.NewReader(layoutData)); err != nil {
+		return err
+	}
+
+	root.Annotations = map[string]string{ispec.AnnotationRefName: name}
+	indexData, err := json.Marshal(ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{root},
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal index.json")
+	}
+	if err := addFile(tw, ociIndexName, int64(len(indexData)), bytes.NewReader(indexData)); err != nil {
+		return err
+	}
+
+	// Collect the blobs before writing any of them, so that the directories
+	// for each digest algorithm can be added first.
+	var (
+		blobs      []ispec.Descriptor
+		algorithms = map[digest.Algorithm]struct{}{}
+		seen       = map[digest.Digest]struct{}{}
+	)
+	if err := engineExt.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		if _, ok := seen[descriptor.Digest]; ok {
+			return casext.ErrSkipDescriptor
+		}
+		seen[descriptor.Digest] = struct{}{}
+		blobs = append(blobs, descriptor)
+		algorithms[descriptor.Digest.Algorithm()] = struct{}{}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk image")
+	}
+
+	if err := addDir(tw, ociBlobsDir); err != nil {
+		return err
+	}
+	for algorithm := range algorithms {
+		if err := addDir(tw, path.Join(ociBlobsDir, algorithm.String())); err != nil {
+			return err
+		}
+	}
+	for _, descriptor := range blobs {
+		reader, err := engine.GetBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", descriptor.Digest)
+		}
+		err = addFile(tw, ociBlobName(descriptor.Digest), descriptor.Size, newVerifiedReader(reader, descriptor.Digest, descriptor.Size))
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
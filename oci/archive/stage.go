@@ -0,0 +1,164 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// maxLinkDepth is the maximum number of symlinks followed when opening a file
+// in a stagedArchive.
+const maxLinkDepth = 32
+
+// stagedArchive is a tar archive whose regular files have been copied to a
+// temporary directory, so that they can be read in any order (archives can be
+// read from a pipe, and the files describing the images need not come before
+// the blobs they reference). Nothing is extracted using the names from the
+// archive, so a malicious archive cannot write outside of the temporary
+// directory.
+type stagedArchive struct {
+	dir string
+
+	// files maps the cleaned names of the regular files in the archive to the
+	// paths of their staged copies.
+	files map[string]string
+
+	// links maps the cleaned names of the symlinks and hardlinks in the
+	// archive to the cleaned names of their targets.
+	links map[string]string
+}
+
+// cleanName returns the name of an archive entry, relative to the root of the
+// archive.
+func cleanName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// stageArchive reads a tar archive from r and stages every regular file. The
+// caller must Close the returned archive.
+func stageArchive(r io.Reader) (_ *stagedArchive, Err error) {
+	dir, err := ioutil.TempDir("", "umoci-import-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create staging directory")
+	}
+	archive := &stagedArchive{
+		dir:   dir,
+		files: map[string]string{},
+		links: map[string]string{},
+	}
+	defer func() {
+		if Err != nil {
+			archive.Close()
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+
+		name := cleanName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			staged := filepath.Join(dir, strconv.Itoa(len(archive.files)))
+			fh, err := os.OpenFile(staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return nil, errors.Wrapf(err, "stage %s", name)
+			}
+			_, err = io.Copy(fh, tr)
+			fh.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "stage %s", name)
+			}
+			archive.files[name] = staged
+			delete(archive.links, name)
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			archive.links[name] = cleanName(target)
+			delete(archive.files, name)
+		case tar.TypeLink:
+			archive.links[name] = cleanName(hdr.Linkname)
+			delete(archive.files, name)
+		}
+	}
+	return archive, nil
+}
+
+// resolve returns the path of the staged copy of the file with the given name,
+// following any links.
+func (a *stagedArchive) resolve(name string) (string, error) {
+	name = cleanName(name)
+	for i := 0; i < maxLinkDepth; i++ {
+		if staged, ok := a.files[name]; ok {
+			return staged, nil
+		}
+		target, ok := a.links[name]
+		if !ok {
+			return "", errors.Errorf("%s: no such file in archive", name)
+		}
+		name = target
+	}
+	return "", errors.Errorf("%s: too many levels of links in archive", name)
+}
+
+// Has returns whether the archive contains a file with the given name.
+func (a *stagedArchive) Has(name string) bool {
+	_, err := a.resolve(name)
+	return err == nil
+}
+
+// Open opens the file with the given name in the archive.
+func (a *stagedArchive) Open(name string) (*os.File, error) {
+	staged, err := a.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(staged)
+}
+
+// ReadFile returns the contents of the file with the given name in the
+// archive.
+func (a *stagedArchive) ReadFile(name string) ([]byte, error) {
+	fh, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ioutil.ReadAll(fh)
+}
+
+// Close removes the staged copies of the files in the archive.
+func (a *stagedArchive) Close() error {
+	return errors.Wrap(os.RemoveAll(a.dir), "remove staging directory")
+}
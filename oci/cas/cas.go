@@ -20,6 +20,7 @@ package cas
 import (
 	"fmt"
 	"io"
+	"time"
 
 	// We need to include sha256 in order for go-digest to properly handle such
 	// hashes, since Go's crypto library like to lazy-load cryptographic
@@ -102,3 +103,12 @@ type Engine interface {
 	// may fail.
 	Close() (err error)
 }
+
+// BlobModTimer is an optional interface which can be implemented by a
+// cas.Engine that is able to report when a blob was last written to the image.
+type BlobModTimer interface {
+	// BlobModTime returns the time at which the blob with the given digest
+	// was last written to the image. Returns ErrNotExist if the digest is not
+	// found.
+	BlobModTime(ctx context.Context, digest digest.Digest) (modTime time.Time, err error)
+}
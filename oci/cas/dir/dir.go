@@ -23,6 +23,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/opencontainers/go-digest"
@@ -70,12 +72,19 @@ func blobPath(digest digest.Digest) (string, error) {
 }
 
 type dirEngine struct {
-	path     string
+	path string
+
+	// tempLock protects temp and tempFile, so that blobs can be added
+	// concurrently.
+	tempLock sync.Mutex
 	temp     string
 	tempFile *os.File
 }
 
 func (e *dirEngine) ensureTempDir() error {
+	e.tempLock.Lock()
+	defer e.tempLock.Unlock()
+
 	if e.temp == "" {
 		tempDir, err := ioutil.TempDir(e.path, "tmp-")
 		if err != nil {
@@ -197,6 +206,21 @@ func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadC
 	return fh, errors.Wrap(err, "open blob")
 }
 
+// BlobModTime returns the time at which the blob with the given digest was
+// last written to the image. Returns os.ErrNotExist if the digest is not
+// found.
+func (e *dirEngine) BlobModTime(ctx context.Context, digest digest.Digest) (time.Time, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "compute blob path")
+	}
+	fi, err := os.Stat(filepath.Join(e.path, path))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "stat blob")
+	}
+	return fi.ModTime(), nil
+}
+
 // PutIndex sets the index of the OCI image to the given index, replacing the
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
@@ -50,7 +50,16 @@ type Blob struct {
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
+	// MediaTypeImageLayer{,NonDistributable}Zstd => io.ReadCloser
 	// ispec.MediaTypeImageConfig => ispec.Image
+	//
+	// The Docker schema2 media types are mapped to the corresponding types.
+	//
+	// MediaTypeDockerManifest => ispec.Manifest
+	// MediaTypeDockerManifestList => ispec.Index
+	// MediaTypeDockerLayer{,Gzip} => io.ReadCloser
+	// MediaTypeDockerForeignLayer{,Gzip} => io.ReadCloser
+	// MediaTypeDockerConfig => ispec.Image
 	Data interface{}
 }
 
@@ -62,13 +71,14 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 	// The layer media types are special, we don't want to do any parsing (or
 	// close the blob reference).
-	switch b.MediaType {
+	//
 	// ispec.MediaTypeImageLayer => io.ReadCloser
 	// ispec.MediaTypeImageLayerGzip => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributable => io.ReadCloser
 	// ispec.MediaTypeImageLayerNonDistributableGzip => io.ReadCloser
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+	// MediaTypeImageLayer{,NonDistributable}Zstd => io.ReadCloser
+	// MediaTypeDocker{,Foreign}Layer{,Gzip} => io.ReadCloser
+	if isLayerMediaType(b.MediaType) {
 		// There isn't anything else we can practically do here.
 		b.Data = reader
 		return nil
@@ -89,26 +99,29 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 		b.Data = parsed
 
 	// ispec.MediaTypeImageManifest => ispec.Manifest
-	case ispec.MediaTypeImageManifest:
+	// MediaTypeDockerManifest => ispec.Manifest
+	case ispec.MediaTypeImageManifest, MediaTypeDockerManifest:
 		parsed := ispec.Manifest{}
 		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
-			return errors.Wrap(err, "parse MediaTypeImageManifest")
+			return errors.Wrapf(err, "parse %s", b.MediaType)
 		}
 		b.Data = parsed
 
 	// ispec.MediaTypeImageIndex => ispec.Index
-	case ispec.MediaTypeImageIndex:
+	// MediaTypeDockerManifestList => ispec.Index
+	case ispec.MediaTypeImageIndex, MediaTypeDockerManifestList:
 		parsed := ispec.Index{}
 		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
-			return errors.Wrap(err, "parse MediaTypeImageIndex")
+			return errors.Wrapf(err, "parse %s", b.MediaType)
 		}
 		b.Data = parsed
 
 	// ispec.MediaTypeImageConfig => ispec.Image
-	case ispec.MediaTypeImageConfig:
+	// MediaTypeDockerConfig => ispec.Image
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
 		parsed := ispec.Image{}
 		if err := json.NewDecoder(reader).Decode(&parsed); err != nil {
-			return errors.Wrap(err, "parse MediaTypeImageConfig")
+			return errors.Wrapf(err, "parse %s", b.MediaType)
 		}
 		b.Data = parsed
 
@@ -125,12 +138,8 @@ func (b *Blob) load(ctx context.Context, engine cas.Engine) error {
 
 // Close cleans up all of the resources for the opened blob.
 func (b *Blob) Close() {
-	switch b.MediaType {
-	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
-		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
-		if b.Data != nil {
-			b.Data.(io.Closer).Close()
-		}
+	if isLayerMediaType(b.MediaType) && b.Data != nil {
+		b.Data.(io.Closer).Close()
 	}
 }
 
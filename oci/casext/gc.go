@@ -18,53 +18,144 @@
 package casext
 
 import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/parallel"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// GCOptions describes the retention policy used by GCWithOptions, in
+// addition to keeping every blob reachable from the references in the image.
+type GCOptions struct {
+	// KeepNewerThan, if non-zero, causes blobs which were written to the image
+	// less than the given duration ago to be kept. The underlying cas.Engine
+	// must implement cas.BlobModTimer.
+	KeepNewerThan time.Duration
+
+	// KeepHistory is the number of previous entries of each reference (as
+	// recorded by UpdateReference in the AnnotationPreviousReference
+	// annotation) whose blobs are kept, so that they can still be restored.
+	KeepHistory int
+
+	// DryRun causes no blobs to be removed. The blobs which would have been
+	// removed are still returned.
+	DryRun bool
+
+	// Workers is the maximum number of roots which are marked (and blobs
+	// which are removed) concurrently. If it is not greater than one, the
+	// garbage collection is done sequentially.
+	Workers int
+}
+
 // GC will perform a mark-and-sweep garbage collection of the OCI image
 // referenced by the given CAS engine. The root set is taken to be the set of
 // references stored in the image, and all blobs not reachable by following a
-// descriptor path from the root set will be removed.
+// descriptor path from the root set will be removed. Referrers (see
+// Referrers) are kept as long as their subject is reachable, and are removed
+// from the top-level index otherwise.
 //
-// GC will only call ListBlobs and ListReferences once, and assumes that there
+// GC will only call ListBlobs and GetIndex once, and assumes that there
 // is no change in the set of references or blobs after calling those
 // functions. In other words, it assumes it is the only user of the image that
 // is making modifications. Things will not go well if this assumption is
 // challenged.
 func (e Engine) GC(ctx context.Context) error {
+	_, err := e.GCWithOptions(ctx, nil)
+	return err
+}
+
+// previousEntries returns up to n of the previous entries recorded for the
+// given entry of the top-level index, most recent first.
+func previousEntries(descriptor ispec.Descriptor, n int) ([]ispec.Descriptor, error) {
+	var previous []ispec.Descriptor
+	for len(previous) < n {
+		encoded, ok := descriptor.Annotations[AnnotationPreviousReference]
+		if !ok {
+			break
+		}
+		descriptor = ispec.Descriptor{}
+		if err := json.Unmarshal([]byte(encoded), &descriptor); err != nil {
+			return nil, errors.Wrap(err, "decode previous entry")
+		}
+		previous = append(previous, descriptor)
+	}
+	return previous, nil
+}
+
+// GCWithOptions is the same as GC, except that blobs are also kept if they
+// match the retention policy described by opt (a nil opt is equivalent to the
+// zero value of GCOptions). It returns the set of blobs which were removed (or
+// would have been removed if opt.DryRun is set).
+func (e Engine) GCWithOptions(ctx context.Context, opt *GCOptions) ([]digest.Digest, error) {
+	var options GCOptions
+	if opt != nil {
+		options = *opt
+	}
+
+	var modTimer cas.BlobModTimer
+	if options.KeepNewerThan != 0 {
+		var ok bool
+		modTimer, ok = e.Engine.(cas.BlobModTimer)
+		if !ok {
+			return nil, errors.Wrap(cas.ErrNotImplemented, "get blob modification time")
+		}
+	}
+
 	// Generate the root set of descriptors.
-	var root []ispec.Descriptor
+	var root, history []ispec.Descriptor
+	var referrers []Referrer
 
-	names, err := e.ListReferences(ctx)
+	// Every descriptor in the top-level index is a root, so that the blobs of
+	// indexes (and every manifest they reference) are kept. The exception are
+	// referrers, which are only kept while their subject is.
+	index, err := e.GetIndex(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get roots")
+		return nil, errors.Wrap(err, "get roots")
 	}
 
-	for _, name := range names {
-		// TODO: This code is no longer necessary once we have index.json.
-		descriptorPaths, err := e.ResolveReference(ctx, name)
-		if err != nil {
-			return errors.Wrapf(err, "get root %s", name)
-		}
-		if len(descriptorPaths) != 1 {
-			// TODO: Handle this more nicely.
-			return errors.Errorf("tag is ambiguous: %s", name)
+	for _, descriptor := range index.Manifests {
+		if isReferrer(descriptor) {
+			referrer, err := e.readReferrer(ctx, descriptor)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read referrer %s", descriptor.Digest)
+			}
+			if referrer != nil {
+				log.WithFields(log.Fields{
+					"digest":  descriptor.Digest,
+					"subject": referrer.Subject.Digest,
+				}).Debugf("GC: got referrer")
+				referrers = append(referrers, *referrer)
+				continue
+			}
 		}
-		descriptor := descriptorPaths[0].Descriptor()
+
 		log.WithFields(log.Fields{
-			"name":   name,
+			"name":   descriptor.Annotations[ispec.AnnotationRefName],
 			"digest": descriptor.Digest,
 		}).Debugf("GC: got reference")
 		root = append(root, descriptor)
+
+		previous, err := previousEntries(descriptor, options.KeepHistory)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get history of %s", descriptor.Annotations[ispec.AnnotationRefName])
+		}
+		history = append(history, previous...)
 	}
 
-	// Mark from the root sets.
+	// Mark from the root sets. Each root is walked independently, and the
+	// results are merged afterwards.
 	black := map[digest.Digest]struct{}{}
-	for idx, descriptor := range root {
+	var blackMu sync.Mutex
+	if err := parallel.Do(len(root), options.Workers, func(idx int) error {
+		descriptor := root[idx]
 		log.WithFields(log.Fields{
 			"digest": descriptor.Digest,
 		}).Debugf("GC: marking from root")
@@ -73,36 +164,145 @@ func (e Engine) GC(ctx context.Context) error {
 		if err != nil {
 			return errors.Wrapf(err, "getting reachables from root %d", idx)
 		}
+		blackMu.Lock()
+		defer blackMu.Unlock()
 		for _, reachable := range reachables {
 			black[reachable] = struct{}{}
 		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Previous entries may have already been partially garbage collected, in
+	// which case they can no longer be restored and are not worth keeping.
+	if err := parallel.Do(len(history), options.Workers, func(idx int) error {
+		descriptor := history[idx]
+		log.WithFields(log.Fields{
+			"digest": descriptor.Digest,
+		}).Debugf("GC: marking from previous reference")
+
+		reachables, err := e.Reachable(ctx, descriptor)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				log.Debugf("GC: previous reference %s is incomplete, not keeping it", descriptor.Digest)
+				return nil
+			}
+			return errors.Wrapf(err, "getting reachables from previous reference %s", descriptor.Digest)
+		}
+		blackMu.Lock()
+		defer blackMu.Unlock()
+		for _, reachable := range reachables {
+			black[reachable] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Mark from the referrers whose subject has been marked. Since referrers
+	// can themselves be the subject of other referrers (such as a signature of
+	// an SBOM), this is repeated until no more referrers are kept.
+	for {
+		var pending []Referrer
+		for _, referrer := range referrers {
+			if _, ok := black[referrer.Subject.Digest]; !ok {
+				pending = append(pending, referrer)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"digest":  referrer.Descriptor.Digest,
+				"subject": referrer.Subject.Digest,
+			}).Debugf("GC: marking from referrer")
+
+			reachables, err := e.Reachable(ctx, referrer.Descriptor)
+			if err != nil {
+				return nil, errors.Wrapf(err, "getting reachables from referrer %s", referrer.Descriptor.Digest)
+			}
+			for _, reachable := range reachables {
+				black[reachable] = struct{}{}
+			}
+		}
+		if len(pending) == len(referrers) {
+			break
+		}
+		referrers = pending
+	}
+
+	// Any remaining referrers refer to a manifest which is no longer in the
+	// image, so their entries are removed from the top-level index.
+	if len(referrers) > 0 && options.DryRun {
+		for _, referrer := range referrers {
+			log.Infof("would remove referrer %s of missing subject %s", referrer.Descriptor.Digest, referrer.Subject.Digest)
+		}
+	} else if len(referrers) > 0 {
+		orphans := map[digest.Digest]struct{}{}
+		for _, referrer := range referrers {
+			log.Infof("removing referrer %s of missing subject %s", referrer.Descriptor.Digest, referrer.Subject.Digest)
+			orphans[referrer.Descriptor.Digest] = struct{}{}
+		}
+		manifests := []ispec.Descriptor{}
+		for _, descriptor := range index.Manifests {
+			if _, ok := orphans[descriptor.Digest]; ok && isReferrer(descriptor) {
+				continue
+			}
+			manifests = append(manifests, descriptor)
+		}
+		index.Manifests = manifests
+		if err := e.PutIndex(ctx, index); err != nil {
+			return nil, errors.Wrap(err, "remove orphaned referrers")
+		}
 	}
 
 	// Sweep all blobs in the white set.
 	blobs, err := e.ListBlobs(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get blob list")
+		return nil, errors.Wrap(err, "get blob list")
 	}
 
-	n := 0
+	var removed []digest.Digest
+	now := time.Now()
 	for _, digest := range blobs {
 		if _, ok := black[digest]; ok {
 			// Digest is in the black set.
 			continue
 		}
+		if modTimer != nil {
+			modTime, err := modTimer.BlobModTime(ctx, digest)
+			if err != nil {
+				return nil, errors.Wrapf(err, "get modification time of blob %s", digest)
+			}
+			if now.Sub(modTime) < options.KeepNewerThan {
+				log.Debugf("GC: keeping recent blob %s", digest)
+				continue
+			}
+		}
+		removed = append(removed, digest)
+	}
+	if options.DryRun {
+		for _, digest := range removed {
+			log.Infof("would garbage collect blob: %s", digest)
+		}
+		return removed, nil
+	}
+
+	if err := parallel.Do(len(removed), options.Workers, func(idx int) error {
+		digest := removed[idx]
 		log.Infof("garbage collecting blob: %s", digest)
 
 		if err := e.DeleteBlob(ctx, digest); err != nil {
 			return errors.Wrapf(err, "remove unmarked blob %s", digest)
 		}
-		n++
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	// Finally, tell CAS to GC it.
 	if err := e.Clean(ctx); err != nil {
-		return errors.Wrapf(err, "clean engine")
+		return nil, errors.Wrapf(err, "clean engine")
 	}
 
-	log.Debugf("garbage collected %d blobs", n)
-	return nil
+	log.Debugf("garbage collected %d blobs", len(removed))
+	return removed, nil
 }
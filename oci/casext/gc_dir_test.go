@@ -0,0 +1,301 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func hasBlob(t *testing.T, ctx context.Context, engineExt Engine, want digest.Digest) bool {
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing blobs: %+v", err)
+	}
+	for _, blob := range blobs {
+		if blob == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEngineGCWithOptions(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineGCWithOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Point the tag at two different images, so that the first is only
+	// recorded as the previous entry of the tag.
+	first, firstConfig, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.Author = "first"
+	})
+	second, _, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.Author = "second"
+	})
+	if err := engineExt.UpdateReference(ctx, "tag", first); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "tag", second); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Make all of the blobs old, so that only the new blob is recent.
+	old := time.Now().Add(-2 * time.Hour)
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		path := filepath.Join(image, "blobs", blob.Algorithm().String(), blob.Hex())
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent, _, err := engineExt.PutBlobJSON(ctx, map[string]string{"unreferenced": "blob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry-run reports the blobs without removing them.
+	removed, err := engineExt.GCWithOptions(ctx, &GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("GCWithOptions: unexpected error: %+v", err)
+	}
+	if len(removed) != 3 {
+		t.Errorf("GCWithOptions: expected 3 blobs to be collected, got %v", removed)
+	}
+	for _, blob := range []digest.Digest{first.Digest, firstConfig.Digest, recent} {
+		if !hasBlob(t, ctx, engineExt, blob) {
+			t.Errorf("GCWithOptions: dry-run removed blob %s", blob)
+		}
+	}
+
+	// Keeping the history and recent blobs removes nothing.
+	removed, err = engineExt.GCWithOptions(ctx, &GCOptions{
+		KeepNewerThan: time.Hour,
+		KeepHistory:   1,
+	})
+	if err != nil {
+		t.Fatalf("GCWithOptions: unexpected error: %+v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("GCWithOptions: expected no blobs to be collected, got %v", removed)
+	}
+
+	// Keeping only the history removes the recent blob (the result is the
+	// same with concurrent workers).
+	removed, err = engineExt.GCWithOptions(ctx, &GCOptions{
+		KeepHistory: 1,
+		Workers:     4,
+	})
+	if err != nil {
+		t.Fatalf("GCWithOptions: unexpected error: %+v", err)
+	}
+	if len(removed) != 1 || removed[0] != recent {
+		t.Errorf("GCWithOptions: expected only %s to be collected, got %v", recent, removed)
+	}
+	if _, err := engineExt.PreviousReference(ctx, "tag"); err != nil {
+		t.Errorf("PreviousReference: unexpected error: %+v", err)
+	}
+
+	// A plain GC removes the previous image.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	for _, blob := range []digest.Digest{first.Digest, firstConfig.Digest} {
+		if hasBlob(t, ctx, engineExt, blob) {
+			t.Errorf("GC: blob %s of previous image was not removed", blob)
+		}
+	}
+	if !hasBlob(t, ctx, engineExt, second.Digest) {
+		t.Errorf("GC: blob %s of tagged image was removed", second.Digest)
+	}
+}
+
+// gcTestReferrer adds an artifact manifest (with a single blob with the given
+// contents) whose subject is the given descriptor, and adds it to the
+// top-level index. The descriptors of the manifest and its blob are returned.
+func gcTestReferrer(t *testing.T, ctx context.Context, engineExt Engine, subject ispec.Descriptor, contents string) (ispec.Descriptor, ispec.Descriptor) {
+	blobDigest, blobSize, err := engineExt.PutBlob(ctx, strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := ispec.Descriptor{MediaType: "text/plain", Digest: blobDigest, Size: blobSize}
+	configDigest, configSize, err := engineExt.PutBlob(ctx, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ispec.MediaTypeImageManifest,
+		"artifactType":  "application/vnd.umoci.test",
+		"config":        ispec.Descriptor{MediaType: MediaTypeEmptyJSON, Digest: configDigest, Size: configSize},
+		"layers":        []ispec.Descriptor{blob},
+		"subject":       subject,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Manifests = append(index.Manifests, manifest)
+	if err := engineExt.PutIndex(ctx, index); err != nil {
+		t.Fatal(err)
+	}
+	return manifest, blob
+}
+
+func TestEngineGCReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineGCReferrers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	tagged, _, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.Author = "tagged"
+	})
+	untagged, untaggedConfig, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.Author = "untagged"
+	})
+	if err := engineExt.UpdateReference(ctx, "tag", tagged); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// A referrer of the tagged image, a referrer of that referrer, and a
+	// referrer of an image which is not in the index.
+	sbom, sbomBlob := gcTestReferrer(t, ctx, engineExt, tagged, "sbom")
+	sig, sigBlob := gcTestReferrer(t, ctx, engineExt, sbom, "signature")
+	orphan, orphanBlob := gcTestReferrer(t, ctx, engineExt, untagged, "orphan")
+
+	referrers, err := engineExt.Referrers(ctx, tagged.Digest)
+	if err != nil {
+		t.Fatalf("Referrers: unexpected error: %+v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Descriptor.Digest != sbom.Digest || referrers[0].ArtifactType != "application/vnd.umoci.test" {
+		t.Errorf("Referrers: expected only %s, got %#v", sbom.Digest, referrers)
+	}
+	referrers, err = engineExt.Referrers(ctx, "")
+	if err != nil {
+		t.Fatalf("Referrers: unexpected error: %+v", err)
+	}
+	if len(referrers) != 3 {
+		t.Errorf("Referrers: expected 3 referrers, got %#v", referrers)
+	}
+
+	// A dry-run doesn't modify the index.
+	if _, err := engineExt.GCWithOptions(ctx, &GCOptions{DryRun: true}); err != nil {
+		t.Fatalf("GCWithOptions: unexpected error: %+v", err)
+	}
+	if !hasBlob(t, ctx, engineExt, orphan.Digest) {
+		t.Errorf("GCWithOptions: dry-run removed orphaned referrer %s", orphan.Digest)
+	}
+	referrers, err = engineExt.Referrers(ctx, "")
+	if err != nil {
+		t.Fatalf("Referrers: unexpected error: %+v", err)
+	}
+	if len(referrers) != 3 {
+		t.Errorf("GCWithOptions: dry-run removed referrers from the index: %#v", referrers)
+	}
+
+	// The referrers of the tagged image are kept, while the orphaned referrer
+	// is removed along with its subject.
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	for _, blob := range []digest.Digest{sbom.Digest, sbomBlob.Digest, sig.Digest, sigBlob.Digest} {
+		if !hasBlob(t, ctx, engineExt, blob) {
+			t.Errorf("GC: blob %s of referrer was removed", blob)
+		}
+	}
+	for _, blob := range []digest.Digest{orphan.Digest, orphanBlob.Digest, untagged.Digest, untaggedConfig.Digest} {
+		if hasBlob(t, ctx, engineExt, blob) {
+			t.Errorf("GC: blob %s of orphaned referrer was not removed", blob)
+		}
+	}
+	referrers, err = engineExt.Referrers(ctx, "")
+	if err != nil {
+		t.Fatalf("Referrers: unexpected error: %+v", err)
+	}
+	if len(referrers) != 2 {
+		t.Errorf("GC: expected 2 referrers to be kept, got %#v", referrers)
+	}
+
+	// Removing the tag removes every referrer.
+	if err := engineExt.DeleteReference(ctx, "tag"); err != nil {
+		t.Fatalf("DeleteReference: unexpected error: %+v", err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC: unexpected error: %+v", err)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if len(index.Manifests) != 0 {
+		t.Errorf("GC: expected an empty index, got %#v", index.Manifests)
+	}
+	if hasBlob(t, ctx, engineExt, sigBlob.Digest) {
+		t.Errorf("GC: blob %s of referrer of referrer was not removed", sigBlob.Digest)
+	}
+}
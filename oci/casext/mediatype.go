@@ -0,0 +1,102 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import ispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+// The media types used by Docker's image manifest schema version 2. The
+// structure of these blobs is compatible with the corresponding OCI blobs, so
+// they are parsed into the same types (an ispec.Manifest for a manifest, an
+// ispec.Index for a manifest list and an ispec.Image for a configuration).
+const (
+	// MediaTypeDockerManifest is the media type of a Docker image manifest.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeDockerManifestList is the media type of a Docker manifest
+	// list, the equivalent of an OCI image index.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeDockerConfig is the media type of a Docker image configuration.
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	// MediaTypeDockerLayer is the media type of an uncompressed Docker layer.
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeDockerLayerGzip is the media type of a gzip-compressed Docker
+	// layer.
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeDockerForeignLayer is the media type of an uncompressed Docker
+	// foreign layer, the equivalent of an OCI non-distributable layer.
+	MediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar"
+
+	// MediaTypeDockerForeignLayerGzip is the media type of a gzip-compressed
+	// Docker foreign layer.
+	MediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// The media types added in version 1.1 of the OCI image-spec, which are not
+// defined by the vendored image-spec.
+const (
+	// MediaTypeEmptyJSON is the media type of the empty JSON object ("{}"),
+	// which is used as the configuration of artifact manifests.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// MediaTypeImageLayerZstd is the media type of a zstd-compressed layer.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type of a
+	// zstd-compressed non-distributable layer.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// hasChildren returns whether blobs of the media type can contain descriptors
+// referencing other blobs.
+func hasChildren(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeDescriptor, ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex,
+		MediaTypeDockerManifest, MediaTypeDockerManifestList:
+		return true
+	}
+	return false
+}
+
+// isLayerMediaType returns whether the media type is one of the (OCI or
+// Docker) layer media types, whose blobs are not parsed.
+func isLayerMediaType(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip,
+		MediaTypeImageLayerZstd, MediaTypeImageLayerNonDistributableZstd,
+		MediaTypeDockerLayer, MediaTypeDockerLayerGzip,
+		MediaTypeDockerForeignLayer, MediaTypeDockerForeignLayerGzip:
+		return true
+	}
+	return false
+}
+
+// IsImageConfig returns whether the media type is one of the (OCI or Docker)
+// image configuration media types. Manifests with any other configuration are
+// artifacts (such as Helm charts or SBOMs), whose blobs are not layers.
+func IsImageConfig(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxReferrerSize is the largest manifest which is read when looking for
+// referrers.
+const maxReferrerSize = 4 << 20
+
+// Referrer is a manifest which refers to another manifest (its subject), such
+// as an SBOM, signature or attestation of an image, following version 1.1 of
+// the OCI image-spec. In an OCI image layout, referrers are stored in the
+// top-level index without a reference name.
+type Referrer struct {
+	// Descriptor is the entry for the referrer in the top-level index.
+	Descriptor ispec.Descriptor
+
+	// ArtifactType is the type of the referrer, which is the media type of
+	// its config if the manifest doesn't specify an artifactType.
+	ArtifactType string
+
+	// Subject is the descriptor of the manifest the referrer refers to.
+	Subject ispec.Descriptor
+}
+
+// referrerFields are the fields of a manifest which are not part of the
+// vendored image-spec, but are needed to identify referrers.
+type referrerFields struct {
+	ArtifactType string            `json:"artifactType"`
+	Config       ispec.Descriptor  `json:"config"`
+	Subject      *ispec.Descriptor `json:"subject"`
+}
+
+// isReferrer returns whether an entry of the top-level index may be a
+// referrer, which is the case for untagged manifests.
+func isReferrer(descriptor ispec.Descriptor) bool {
+	if _, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+		return false
+	}
+	return descriptor.MediaType == ispec.MediaTypeImageManifest
+}
+
+// readReferrer returns the referrer for the given untagged entry of the
+// top-level index, or nil if the manifest has no subject.
+func (e Engine) readReferrer(ctx context.Context, descriptor ispec.Descriptor) (*Referrer, error) {
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get manifest")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxReferrerSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	var fields referrerFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrap(err, "parse manifest")
+	}
+	if fields.Subject == nil {
+		return nil, nil
+	}
+	artifactType := fields.ArtifactType
+	if artifactType == "" {
+		artifactType = fields.Config.MediaType
+	}
+	return &Referrer{
+		Descriptor:   descriptor,
+		ArtifactType: artifactType,
+		Subject:      *fields.Subject,
+	}, nil
+}
+
+// Referrers returns the referrers stored in the top-level index whose subject
+// is the manifest with the given digest, in the order of the index. If subject
+// is empty, every referrer is returned.
+func (e Engine) Referrers(ctx context.Context, subject digest.Digest) ([]Referrer, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var referrers []Referrer
+	for _, descriptor := range index.Manifests {
+		if !isReferrer(descriptor) {
+			continue
+		}
+		referrer, err := e.readReferrer(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read referrer %s", descriptor.Digest)
+		}
+		if referrer == nil || (subject != "" && referrer.Subject.Digest != subject) {
+			continue
+		}
+		referrers = append(referrers, *referrer)
+	}
+	return referrers, nil
+}
@@ -18,12 +18,21 @@
 package casext
 
 import (
+	"encoding/json"
+
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// AnnotationPreviousReference is the annotation of an entry in the top-level
+// index which records (as a JSON-encoded descriptor) the entry it replaced
+// when the reference was last updated with UpdateReference. It does not keep
+// the blobs of the previous entry alive, so they can only be restored (see
+// PreviousReference) until they are garbage collected.
+const AnnotationPreviousReference = "org.opensuse.umoci.ref.previous"
+
 // isKnownMediaType returns whether a media type is known by the spec. This
 // probably should be moved somewhere else to avoid going out of date.
 func isKnownMediaType(mediaType string) bool {
@@ -34,7 +43,18 @@ func isKnownMediaType(mediaType string) bool {
 		mediaType == ispec.MediaTypeImageLayerGzip ||
 		mediaType == ispec.MediaTypeImageLayerNonDistributable ||
 		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
-		mediaType == ispec.MediaTypeImageConfig
+		mediaType == ispec.MediaTypeImageConfig ||
+		mediaType == MediaTypeDockerManifest ||
+		mediaType == MediaTypeDockerManifestList ||
+		mediaType == MediaTypeDockerConfig ||
+		isLayerMediaType(mediaType)
+}
+
+// isManifestMediaType returns whether a media type is one of the (OCI or
+// Docker) image manifest media types.
+func isManifestMediaType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageManifest ||
+		mediaType == MediaTypeDockerManifest
 }
 
 // ResolveReference will attempt to resolve all possible descriptor paths to
@@ -71,24 +91,11 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	// The resolved set of descriptors.
 	var resolutions []DescriptorPath
 	for _, root := range roots {
-		// Find all manifests or other blobs that are reachable from the given
-		// descriptor.
-		if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
-			descriptor := descriptorPath.Descriptor()
-
-			// It is very important that we do not ignore unknown media types
-			// here. We only recurse into mediaTypes that are *known* and are
-			// also not ispec.MediaTypeImageManifest.
-			if isKnownMediaType(descriptor.MediaType) && descriptor.MediaType != ispec.MediaTypeImageManifest {
-				return nil
-			}
-
-			// Add the resolution and do not recurse any deeper.
-			resolutions = append(resolutions, descriptorPath)
-			return ErrSkipDescriptor
-		}); err != nil {
-			return nil, errors.Wrapf(err, "walk %s", root.Digest)
+		rootResolutions, err := e.ResolveDescriptor(ctx, root)
+		if err != nil {
+			return nil, err
 		}
+		resolutions = append(resolutions, rootResolutions...)
 	}
 
 	log.WithFields(log.Fields{
@@ -97,6 +104,32 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 	return resolutions, nil
 }
 
+// ResolveDescriptor returns all of the descriptor paths to Manifests (or any
+// unknown blobs) that are reachable from the given root descriptor, in the
+// same way as ResolveReference. The paths are returned in the order they are
+// walked, which is stable as long as the blobs along each path are only
+// modified by replacing descriptors (as is done by mutate.Mutator.Commit).
+func (e Engine) ResolveDescriptor(ctx context.Context, root ispec.Descriptor) ([]DescriptorPath, error) {
+	var resolutions []DescriptorPath
+	if err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+
+		// It is very important that we do not ignore unknown media types
+		// here. We only recurse into mediaTypes that are *known* and are
+		// also not image manifests.
+		if isKnownMediaType(descriptor.MediaType) && !isManifestMediaType(descriptor.MediaType) {
+			return nil
+		}
+
+		// Add the resolution and do not recurse any deeper.
+		resolutions = append(resolutions, descriptorPath)
+		return ErrSkipDescriptor
+	}); err != nil {
+		return nil, errors.Wrapf(err, "walk %s", root.Digest)
+	}
+	return resolutions, nil
+}
+
 // XXX: Should the *Reference set of interfaces support DescriptorPath? While
 //      it might seem like it doesn't make sense, a DescriptorPath entirely
 //      removes ambiguity with regards to which root needs to be operated on.
@@ -104,7 +137,9 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 
 // UpdateReference replaces an existing entry for refname with the given
 // descriptor. If there are multiple descriptors that match the refname they
-// are all replaced with the given descriptor.
+// are all replaced with the given descriptor. If there was exactly one such
+// descriptor, it is recorded in the AnnotationPreviousReference annotation
+// of the new entry so that the update can be undone.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
 	// Get index to modify.
 	index, err := e.GetIndex(ctx)
@@ -113,10 +148,12 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 	}
 
 	// TODO: Handle refname = "".
-	var newIndex []ispec.Descriptor
+	var newIndex, oldEntries []ispec.Descriptor
 	for _, descriptor := range index.Manifests {
 		if descriptor.Annotations[ispec.AnnotationRefName] != refname {
 			newIndex = append(newIndex, descriptor)
+		} else {
+			oldEntries = append(oldEntries, descriptor)
 		}
 	}
 	if len(newIndex)-len(index.Manifests) > 1 {
@@ -124,11 +161,29 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 		log.Warn("multiple references match the given reference name -- all of them have been replaced due to this ambiguity")
 	}
 
-	// Append the descriptor.
+	// Append the descriptor. Any previous entry recorded in the given
+	// descriptor (such as when it was copied from another entry) is stale.
 	if descriptor.Annotations == nil {
 		descriptor.Annotations = map[string]string{}
 	}
-	descriptor.Annotations[ispec.AnnotationRefName] = refname
+	annotations := descriptor.Annotations
+	delete(annotations, AnnotationPreviousReference)
+	annotations[ispec.AnnotationRefName] = refname
+	if len(oldEntries) == 1 {
+		old := oldEntries[0]
+		if old.Digest == descriptor.Digest {
+			// The reference is unchanged, so keep the existing record.
+			if previous, ok := old.Annotations[AnnotationPreviousReference]; ok {
+				annotations[AnnotationPreviousReference] = previous
+			}
+		} else {
+			previous, err := encodePreviousReference(old)
+			if err != nil {
+				return errors.Wrap(err, "record previous reference")
+			}
+			annotations[AnnotationPreviousReference] = previous
+		}
+	}
 	newIndex = append(newIndex, descriptor)
 
 	// Commit to image.
@@ -139,6 +194,67 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 	return nil
 }
 
+// encodePreviousReference encodes the given entry of the top-level index as
+// the value of an AnnotationPreviousReference annotation. Only a single
+// previous entry is recorded, so its own record is dropped.
+func encodePreviousReference(descriptor ispec.Descriptor) (string, error) {
+	annotations := map[string]string{}
+	for key, value := range descriptor.Annotations {
+		annotations[key] = value
+	}
+	delete(annotations, AnnotationPreviousReference)
+	delete(annotations, ispec.AnnotationRefName)
+	descriptor.Annotations = annotations
+	if len(annotations) == 0 {
+		descriptor.Annotations = nil
+	}
+
+	encoded, err := json.Marshal(descriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "encode descriptor")
+	}
+	return string(encoded), nil
+}
+
+// PreviousReference returns the descriptor which the entry for refname
+// replaced when it was last updated with UpdateReference. An error is
+// returned if refname is ambiguous or if no previous entry was recorded. Note
+// that the blobs referenced by the returned descriptor might have been
+// garbage collected.
+func (e Engine) PreviousReference(ctx context.Context, refname string) (ispec.Descriptor, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get top-level index")
+	}
+
+	var entries []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == refname {
+			entries = append(entries, descriptor)
+		}
+	}
+	switch len(entries) {
+	case 0:
+		return ispec.Descriptor{}, errors.Errorf("reference %s not found", refname)
+	case 1:
+	default:
+		return ispec.Descriptor{}, errors.Errorf("reference %s is ambiguous", refname)
+	}
+
+	encoded, ok := entries[0].Annotations[AnnotationPreviousReference]
+	if !ok {
+		return ispec.Descriptor{}, errors.Errorf("no previous entry recorded for reference %s", refname)
+	}
+	var previous ispec.Descriptor
+	if err := json.Unmarshal([]byte(encoded), &previous); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "decode previous entry for reference %s", refname)
+	}
+	if err := previous.Digest.Validate(); err != nil {
+		return ispec.Descriptor{}, errors.Wrapf(err, "invalid previous entry for reference %s", refname)
+	}
+	return previous, nil
+}
+
 // AddReferences adds entries for refname with the given descriptors, without
 // modifying the existing entries.
 //
@@ -209,6 +325,72 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 	return nil
 }
 
+// RenameReferences renames the entries in the index which match each key of
+// renames to the corresponding value, replacing the index only once so that
+// either all or none of the references are renamed. Any recorded
+// AnnotationPreviousReference is kept. An error is returned if one of the
+// references doesn't exist, or if a new name is already used by a reference
+// which isn't being renamed (or is the new name of several references).
+func (e Engine) RenameReferences(ctx context.Context, renames map[string]string) error {
+	if len(renames) == 0 {
+		// Nothing to do.
+		return nil
+	}
+
+	// Get index to modify.
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get top-level index")
+	}
+
+	targets := map[string]string{}
+	for from, to := range renames {
+		if other, ok := targets[to]; ok {
+			return errors.Errorf("references %s and %s would both be renamed to %s", other, from, to)
+		}
+		targets[to] = from
+	}
+
+	found := map[string]bool{}
+	var newIndex []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		refname, ok := descriptor.Annotations[ispec.AnnotationRefName]
+		if !ok {
+			newIndex = append(newIndex, descriptor)
+			continue
+		}
+		to, rename := renames[refname]
+		if !rename {
+			if from, ok := targets[refname]; ok {
+				return errors.Errorf("cannot rename reference %s to %s: reference already exists", from, refname)
+			}
+			newIndex = append(newIndex, descriptor)
+			continue
+		}
+		found[refname] = true
+
+		annotations := map[string]string{}
+		for key, value := range descriptor.Annotations {
+			annotations[key] = value
+		}
+		annotations[ispec.AnnotationRefName] = to
+		descriptor.Annotations = annotations
+		newIndex = append(newIndex, descriptor)
+	}
+	for from := range renames {
+		if !found[from] {
+			return errors.Errorf("reference %s not found", from)
+		}
+	}
+
+	// Commit to image.
+	index.Manifests = newIndex
+	if err := e.PutIndex(ctx, index); err != nil {
+		return errors.Wrap(err, "replace index")
+	}
+	return nil
+}
+
 // ListReferences returns all of the ref.name entries that are specified in the
 // top-level index. Note that the list may contain duplicates, due to the
 // nature of references in the image-spec.
@@ -21,6 +21,7 @@ import (
 	"archive/tar"
 	"bytes"
 	crand "crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -300,6 +301,172 @@ func TestEngineReference(t *testing.T) {
 	}
 }
 
+func TestEngineReferencePrevious(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineReferencePrevious")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine returned %d descriptors", len(descMap))
+	}
+	first, second := descMap[0].index, descMap[1].index
+	first.Annotations = map[string]string{"key": "value"}
+	expected := first
+	expected.Annotations = map[string]string{"key": "value"}
+
+	if err := engineExt.UpdateReference(ctx, "tag", first); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if _, err := engineExt.PreviousReference(ctx, "tag"); err == nil {
+		t.Errorf("PreviousReference: expected error for a new reference")
+	}
+
+	// Updating the reference records the previous entry, while updating it
+	// to the same descriptor keeps the existing record.
+	for i := 0; i < 2; i++ {
+		if err := engineExt.UpdateReference(ctx, "tag", second); err != nil {
+			t.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+		previous, err := engineExt.PreviousReference(ctx, "tag")
+		if err != nil {
+			t.Fatalf("PreviousReference: unexpected error: %+v", err)
+		}
+		if !reflect.DeepEqual(previous, expected) {
+			t.Errorf("PreviousReference: got %v expected %v", previous, expected)
+		}
+	}
+
+	// Only a single previous entry is recorded, and copying an entry with a
+	// record to a new reference doesn't copy the record.
+	if err := engineExt.UpdateReference(ctx, "tag", first); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := index.Manifests[len(index.Manifests)-1]
+	var recorded ispec.Descriptor
+	if err := json.Unmarshal([]byte(entry.Annotations[AnnotationPreviousReference]), &recorded); err != nil {
+		t.Fatalf("unexpected error decoding previous entry: %+v", err)
+	}
+	if recorded.Digest != second.Digest || recorded.Annotations != nil {
+		t.Errorf("unexpected previous entry: %v", recorded)
+	}
+	if err := engineExt.UpdateReference(ctx, "copy", entry); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if _, err := engineExt.PreviousReference(ctx, "copy"); err == nil {
+		t.Errorf("PreviousReference: expected error for a copied reference")
+	}
+}
+
+func TestEngineRenameReferences(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineRenameReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 3 {
+		t.Fatalf("fakeSetupEngine returned %d descriptors", len(descMap))
+	}
+	for idx, name := range []string{"a", "b", "c"} {
+		if err := engineExt.UpdateReference(ctx, name, descMap[idx].index); err != nil {
+			t.Fatalf("UpdateReference: unexpected error: %+v", err)
+		}
+	}
+	if err := engineExt.UpdateReference(ctx, "a", descMap[1].index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+
+	// Invalid renames must not modify the index.
+	for _, renames := range []map[string]string{
+		{"a": "c"},
+		{"a": "d", "b": "d"},
+		{"a": "d", "missing": "e"},
+	} {
+		if err := engineExt.RenameReferences(ctx, renames); err == nil {
+			t.Errorf("RenameReferences: expected error for %v", renames)
+		}
+	}
+	names, err := engineExt.ListReferences(ctx)
+	if err != nil {
+		t.Fatalf("ListReferences: unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"b", "c", "a"}) {
+		t.Errorf("ListReferences: unexpected references after failed renames: %v", names)
+	}
+
+	// Swapping references is allowed, and the previous entries are kept.
+	if err := engineExt.RenameReferences(ctx, map[string]string{"a": "b", "b": "a", "c": "d"}); err != nil {
+		t.Fatalf("RenameReferences: unexpected error: %+v", err)
+	}
+	for name, idx := range map[string]int{"a": 1, "b": 1, "d": 2} {
+		gotDescriptorPaths, err := engineExt.ResolveReference(ctx, name)
+		if err != nil {
+			t.Fatalf("ResolveReference: unexpected error: %+v", err)
+		}
+		if len(gotDescriptorPaths) != 1 {
+			t.Errorf("ResolveReference: expected %q to get %d descriptors, got %d", name, 1, len(gotDescriptorPaths))
+			continue
+		}
+		if got := gotDescriptorPaths[0].Descriptor(); !reflect.DeepEqual(descMap[idx].result, got) {
+			t.Errorf("ResolveReference: %q got unexpected descriptor: expected=%v got=%v", name, descMap[idx].result, got)
+		}
+	}
+	previous, err := engineExt.PreviousReference(ctx, "b")
+	if err != nil {
+		t.Fatalf("PreviousReference: unexpected error: %+v", err)
+	}
+	if previous.Digest != descMap[0].index.Digest {
+		t.Errorf("PreviousReference: got %v expected %v", previous.Digest, descMap[0].index.Digest)
+	}
+	if gotDescriptorPaths, err := engineExt.ResolveReference(ctx, "c"); err != nil {
+		t.Errorf("ResolveReference: unexpected error: %+v", err)
+	} else if len(gotDescriptorPaths) > 0 {
+		t.Errorf("ResolveReference: still got reference descriptors after RenameReferences!")
+	}
+}
+
 func TestEngineReferenceReadonly(t *testing.T) {
 	ctx := context.Background()
 
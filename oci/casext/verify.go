@@ -0,0 +1,349 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// VerifyIssue is a problem with a blob found by Verify.
+type VerifyIssue struct {
+	// Path is the descriptor path used to reach the blob with the problem.
+	Path DescriptorPath `json:"path"`
+
+	// Problem is a human-readable description of the problem.
+	Problem string `json:"problem"`
+}
+
+// String returns a human-readable description of the issue.
+func (i VerifyIssue) String() string {
+	return fmt.Sprintf("%s (%s): %s", i.Path.Descriptor().Digest, i.Path.Descriptor().MediaType, i.Problem)
+}
+
+// verifiedBlob is the result of reading a blob for Verify.
+type verifiedBlob struct {
+	// missing is whether the blob does not exist.
+	missing bool
+
+	// digest and size are the digest and size of the blob contents.
+	digest digest.Digest
+	size   int64
+
+	// diffID is the digest of the uncompressed contents of a layer blob, if
+	// it could be computed.
+	diffID digest.Digest
+
+	// data is the contents of blobs which need to be parsed.
+	data []byte
+}
+
+// gzipMagic is the header of a gzip stream, and zstdMagic is the header of a
+// zstd frame.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// needsParsing returns whether blobs of the media type are parsed by Verify.
+func needsParsing(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+		return true
+	}
+	return hasChildren(mediaType)
+}
+
+// readBlob reads the blob referenced by the descriptor, computing its digest
+// (with the algorithm of the descriptor digest) and, for layers, the digest of
+// its uncompressed contents.
+func (e Engine) readBlob(ctx context.Context, descriptor ispec.Descriptor) (*verifiedBlob, error) {
+	reader, err := e.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return &verifiedBlob{missing: true}, nil
+		}
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	digester := descriptor.Digest.Algorithm().Digester()
+	counter := &countingWriter{}
+	raw := io.TeeReader(reader, io.MultiWriter(digester.Hash(), counter))
+	blob := &verifiedBlob{}
+
+	switch {
+	case needsParsing(descriptor.MediaType):
+		if blob.data, err = ioutil.ReadAll(raw); err != nil {
+			return nil, errors.Wrap(err, "read blob")
+		}
+	case isLayerMediaType(descriptor.MediaType):
+		buffered := bufio.NewReader(raw)
+		header, _ := buffered.Peek(len(zstdMagic))
+		var layer io.Reader = buffered
+		switch {
+		case bytes.HasPrefix(header, gzipMagic):
+			gzr, err := gzip.NewReader(buffered)
+			if err != nil {
+				return nil, errors.Wrap(err, "create gzip reader")
+			}
+			layer = gzr
+		case bytes.HasPrefix(header, zstdMagic):
+			zr, err := zstd.NewReader(buffered)
+			if err != nil {
+				return nil, errors.Wrap(err, "create zstd reader")
+			}
+			defer zr.Close()
+			layer = zr
+		}
+		diffIDDigester := digest.SHA256.Digester()
+		if _, err := io.Copy(diffIDDigester.Hash(), layer); err != nil {
+			// A corrupted compressed stream is still hashed in full below, so
+			// that the blob digest mismatch is reported.
+			log.Debugf("verify: could not decompress layer %s: %v", descriptor.Digest, err)
+		} else {
+			blob.diffID = diffIDDigester.Digest()
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return nil, errors.Wrap(err, "read blob")
+	}
+
+	blob.digest = digester.Digest()
+	blob.size = counter.n
+	return blob, nil
+}
+
+// countingWriter counts the number of bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// verifyState stores state information about a Verify.
+type verifyState struct {
+	engine Engine
+	issues []VerifyIssue
+
+	// blobs are the blobs which have been read, keyed by their digest.
+	blobs map[digest.Digest]*verifiedBlob
+
+	// visited are the blobs whose contents have already been checked.
+	visited map[digest.Digest]struct{}
+}
+
+func (vs *verifyState) addIssue(descriptorPath DescriptorPath, format string, args ...interface{}) {
+	vs.issues = append(vs.issues, VerifyIssue{
+		Path:    DescriptorPath{Walk: append([]ispec.Descriptor{}, descriptorPath.Walk...)},
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkDescriptor checks that the fields of a descriptor are well-formed.
+func (vs *verifyState) checkDescriptor(descriptorPath DescriptorPath) bool {
+	descriptor := descriptorPath.Descriptor()
+	if descriptor.MediaType == "" {
+		vs.addIssue(descriptorPath, "descriptor has no mediaType")
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		vs.addIssue(descriptorPath, "descriptor has invalid digest: %v", err)
+		return false
+	}
+	if descriptor.Size < 0 {
+		vs.addIssue(descriptorPath, "descriptor has negative size %d", descriptor.Size)
+	}
+	return true
+}
+
+func (vs *verifyState) recurse(ctx context.Context, descriptorPath DescriptorPath) error {
+	descriptor := descriptorPath.Descriptor()
+	if !vs.checkDescriptor(descriptorPath) {
+		return nil
+	}
+
+	blob, ok := vs.blobs[descriptor.Digest]
+	if !ok {
+		var err error
+		blob, err = vs.engine.readBlob(ctx, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "verify blob %s", descriptor.Digest)
+		}
+		vs.blobs[descriptor.Digest] = blob
+	}
+	if blob.missing {
+		vs.addIssue(descriptorPath, "blob is missing")
+		return nil
+	}
+	if blob.digest != descriptor.Digest {
+		vs.addIssue(descriptorPath, "blob is corrupted: contents have digest %s", blob.digest)
+		return nil
+	}
+	if blob.size != descriptor.Size {
+		vs.addIssue(descriptorPath, "descriptor size %d does not match blob size %d", descriptor.Size, blob.size)
+	}
+
+	// The size of every descriptor is checked, but the contents of each blob
+	// only need to be checked once.
+	if _, ok := vs.visited[descriptor.Digest]; ok {
+		return nil
+	}
+	vs.visited[descriptor.Digest] = struct{}{}
+
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, MediaTypeDockerManifest:
+		return vs.verifyManifest(ctx, descriptorPath, blob.data)
+	case ispec.MediaTypeImageIndex, MediaTypeDockerManifestList:
+		return vs.verifyIndex(ctx, descriptorPath, blob.data)
+	case ispec.MediaTypeDescriptor:
+		var child ispec.Descriptor
+		if err := json.Unmarshal(blob.data, &child); err != nil {
+			vs.addIssue(descriptorPath, "invalid descriptor: %v", err)
+			return nil
+		}
+		return vs.recurse(ctx, DescriptorPath{Walk: append(descriptorPath.Walk, child)})
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+		var config ispec.Image
+		if err := json.Unmarshal(blob.data, &config); err != nil {
+			vs.addIssue(descriptorPath, "invalid image configuration: %v", err)
+			return nil
+		}
+		if config.OS == "" || config.Architecture == "" {
+			vs.addIssue(descriptorPath, "image configuration is missing os or architecture")
+		}
+		if config.RootFS.Type != "layers" {
+			vs.addIssue(descriptorPath, "image configuration has unknown rootfs.type %q", config.RootFS.Type)
+		}
+	}
+	return nil
+}
+
+func (vs *verifyState) verifyIndex(ctx context.Context, descriptorPath DescriptorPath, data []byte) error {
+	var index ispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		vs.addIssue(descriptorPath, "invalid index: %v", err)
+		return nil
+	}
+	if index.SchemaVersion != 2 {
+		vs.addIssue(descriptorPath, "index has unsupported schemaVersion %d", index.SchemaVersion)
+	}
+	for _, child := range index.Manifests {
+		if err := vs.recurse(ctx, DescriptorPath{Walk: append(descriptorPath.Walk, child)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vs *verifyState) verifyManifest(ctx context.Context, descriptorPath DescriptorPath, data []byte) error {
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		vs.addIssue(descriptorPath, "invalid manifest: %v", err)
+		return nil
+	}
+	if manifest.SchemaVersion != 2 {
+		vs.addIssue(descriptorPath, "manifest has unsupported schemaVersion %d", manifest.SchemaVersion)
+	}
+
+	configPath := DescriptorPath{Walk: append(descriptorPath.Walk, manifest.Config)}
+	if err := vs.recurse(ctx, configPath); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		layerPath := DescriptorPath{Walk: append(descriptorPath.Walk, layer)}
+		if !isLayerMediaType(layer.MediaType) && IsImageConfig(manifest.Config.MediaType) {
+			vs.addIssue(layerPath, "layer has unknown mediaType")
+		}
+		if err := vs.recurse(ctx, layerPath); err != nil {
+			return err
+		}
+	}
+
+	// Check the diff_ids of the layers, if the configuration is intact.
+	switch manifest.Config.MediaType {
+	case ispec.MediaTypeImageConfig, MediaTypeDockerConfig:
+	default:
+		return nil
+	}
+	configBlob := vs.blobs[manifest.Config.Digest]
+	if configBlob == nil || configBlob.missing || configBlob.digest != manifest.Config.Digest {
+		return nil
+	}
+	var config ispec.Image
+	if err := json.Unmarshal(configBlob.data, &config); err != nil {
+		return nil
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		vs.addIssue(descriptorPath, "manifest has %d layers but rootfs.diff_ids has %d entries", len(manifest.Layers), len(config.RootFS.DiffIDs))
+		return nil
+	}
+	for idx, layer := range manifest.Layers {
+		layerBlob := vs.blobs[layer.Digest]
+		if layerBlob == nil || layerBlob.missing || layerBlob.digest != layer.Digest {
+			continue
+		}
+		layerPath := DescriptorPath{Walk: append(descriptorPath.Walk, layer)}
+		if layerBlob.diffID == "" {
+			vs.addIssue(layerPath, "layer could not be decompressed to check its diff_id")
+			continue
+		}
+		if layerBlob.diffID != config.RootFS.DiffIDs[idx] {
+			vs.addIssue(layerPath, "layer does not match rootfs.diff_ids[%d]: uncompressed contents have digest %s, expected %s", idx, layerBlob.diffID, config.RootFS.DiffIDs[idx])
+		}
+	}
+	return nil
+}
+
+// Verify checks the integrity of every blob reachable from the given root
+// descriptors. Every blob is re-hashed and compared against the digest and
+// size of each descriptor referencing it, the uncompressed contents of every
+// layer are compared against the rootfs.diff_ids of the image configuration,
+// and manifests, indexes and image configurations are checked against the
+// image-spec. Blobs which are missing or corrupted are not recursed into.
+//
+// The problems found are returned as a list of issues; an error is only
+// returned if the image could not be read.
+func (e Engine) Verify(ctx context.Context, roots []ispec.Descriptor) ([]VerifyIssue, error) {
+	vs := &verifyState{
+		engine:  e,
+		blobs:   map[digest.Digest]*verifiedBlob{},
+		visited: map[digest.Digest]struct{}{},
+	}
+	for _, root := range roots {
+		if err := vs.recurse(ctx, DescriptorPath{Walk: []ispec.Descriptor{root}}); err != nil {
+			return nil, err
+		}
+	}
+	return vs.issues, nil
+}
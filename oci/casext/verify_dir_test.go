@@ -0,0 +1,203 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// verifyTestImage stores an image with a single gzip-compressed layer,
+// returning the descriptor of its manifest as well as the descriptors of the
+// config and layer. mutateConfig is applied to the configuration before it is
+// stored.
+func verifyTestImage(t *testing.T, ctx context.Context, engineExt Engine, mutateConfig func(*ispec.Image)) (ispec.Descriptor, ispec.Descriptor, ispec.Descriptor) {
+	raw := []byte(strings.Repeat("umoci layer contents\n", 64))
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: layerDigest, Size: layerSize}
+
+	config := ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.SHA256.FromBytes(raw)},
+		},
+	}
+	if mutateConfig != nil {
+		mutateConfig(&config)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDescriptor := ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize}
+
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Config:    configDescriptor,
+		Layers:    []ispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+	return manifest, configDescriptor, layer
+}
+
+func TestEngineVerify(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineVerify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	blobFile := func(descriptor ispec.Descriptor) string {
+		return filepath.Join(image, "blobs", descriptor.Digest.Algorithm().String(), descriptor.Digest.Hex())
+	}
+	expectIssues := func(name string, roots []ispec.Descriptor, problems ...string) {
+		issues, err := engineExt.Verify(ctx, roots)
+		if err != nil {
+			t.Fatalf("%s: unexpected error verifying image: %+v", name, err)
+		}
+		if len(issues) != len(problems) {
+			t.Fatalf("%s: expected %d issues, got %v", name, len(problems), issues)
+		}
+		for idx, issue := range issues {
+			if !strings.Contains(issue.Problem, problems[idx]) {
+				t.Errorf("%s: expected issue %d to contain %q, got %q", name, idx, problems[idx], issue.Problem)
+			}
+		}
+	}
+
+	// An intact image (reachable through an index) has no issues.
+	manifest, config, layer := verifyTestImage(t, ctx, engineExt, nil)
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{manifest, manifest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := ispec.Descriptor{MediaType: ispec.MediaTypeImageIndex, Digest: indexDigest, Size: indexSize}
+	expectIssues("intact", []ispec.Descriptor{index, manifest})
+
+	// Descriptors must have the right size.
+	wrongSize := manifest
+	wrongSize.Size++
+	expectIssues("wrong size", []ispec.Descriptor{wrongSize}, "does not match blob size")
+
+	// The layer diff_ids must match the layers.
+	badDiffID, _, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.RootFS.DiffIDs[0] = digest.SHA256.FromString("not the layer")
+	})
+	expectIssues("bad diff_id", []ispec.Descriptor{badDiffID}, "does not match rootfs.diff_ids[0]")
+	extraDiffID, _, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, config.RootFS.DiffIDs[0])
+	})
+	expectIssues("extra diff_id", []ispec.Descriptor{extraDiffID}, "manifest has 1 layers but rootfs.diff_ids has 2 entries")
+	noOS, _, _ := verifyTestImage(t, ctx, engineExt, func(config *ispec.Image) {
+		config.OS = ""
+	})
+	expectIssues("no os", []ispec.Descriptor{noOS}, "missing os or architecture")
+
+	// Artifacts (manifests without an image configuration) can have blobs of
+	// any media type, but images can only have layers.
+	blobDigest, blobSize, err := engineExt.PutBlob(ctx, strings.NewReader("artifact contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := ispec.Descriptor{MediaType: "application/octet-stream", Digest: blobDigest, Size: blobSize}
+	artifactConfigDigest, artifactConfigSize, err := engineExt.PutBlobJSON(ctx, map[string]string{"name": "chart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		config ispec.Descriptor
+		issues []string
+	}{
+		{"artifact", ispec.Descriptor{MediaType: "application/vnd.cncf.helm.config.v1+json", Digest: artifactConfigDigest, Size: artifactConfigSize}, nil},
+		{"image with unknown layer", config, []string{"layer has unknown mediaType", "could not be decompressed"}},
+	} {
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: ispecs.Versioned{SchemaVersion: 2},
+			Config:    test.config,
+			Layers:    []ispec.Descriptor{blob},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIssues(test.name, []ispec.Descriptor{{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}}, test.issues...)
+	}
+
+	// Corrupted layers are detected (only once, even if they are reachable
+	// from several manifests).
+	if err := os.Chmod(blobFile(layer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobFile(layer), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectIssues("corrupted layer", []ispec.Descriptor{index}, "blob is corrupted")
+
+	// Missing blobs are detected.
+	if err := os.Remove(blobFile(config)); err != nil {
+		t.Fatal(err)
+	}
+	expectIssues("missing config", []ispec.Descriptor{manifest}, "blob is missing", "blob is corrupted")
+
+	// Invalid descriptors are detected.
+	invalid := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: "sha256:invalid", Size: 1}
+	expectIssues("invalid digest", []ispec.Descriptor{invalid}, "invalid digest")
+}
@@ -116,6 +116,12 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 		return err
 	}
 
+	// Only blobs which can reference other blobs need to be parsed. All other
+	// blobs (including blobs with media types we don't know) are leaves.
+	if !hasChildren(descriptorPath.Descriptor().MediaType) {
+		return nil
+	}
+
 	// Get blob to recurse into.
 	blob, err := ws.engine.FromDescriptor(ctx, descriptorPath.Descriptor())
 	if err != nil {
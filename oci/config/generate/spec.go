@@ -19,6 +19,7 @@ package generate
 
 import (
 	"fmt"
+	"path"
 	"sort"
 	"strings"
 	"time"
@@ -159,6 +160,23 @@ func (g *Generator) AddConfigEnv(name, value string) {
 	g.image.Config.Env = append(g.image.Config.Env, env)
 }
 
+// RemoveConfigEnv removes the environment variables whose names match the given pattern (using the syntax of path.Match) from the list of environment variables to be used in a container.
+func (g *Generator) RemoveConfigEnv(pattern string) error {
+	// Make sure the pattern is valid even if there is nothing to match.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	env := []string{}
+	for _, v := range g.image.Config.Env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if matched, _ := path.Match(pattern, name); !matched {
+			env = append(env, v)
+		}
+	}
+	g.image.Config.Env = env
+	return nil
+}
+
 // ConfigEnv returns the list of environment variables to be used in a container.
 func (g *Generator) ConfigEnv() []string {
 	copy := []string{}
@@ -182,6 +200,11 @@ func (g *Generator) SetConfigEntrypoint(entrypoint []string) {
 	g.image.Config.Entrypoint = copy
 }
 
+// AppendConfigEntrypoint appends to the list of arguments to use as the command to execute when the container starts.
+func (g *Generator) AppendConfigEntrypoint(entrypoint []string) {
+	g.image.Config.Entrypoint = append(g.ConfigEntrypoint(), entrypoint...)
+}
+
 // ConfigEntrypoint returns the list of arguments to use as the command to execute when the container starts.
 func (g *Generator) ConfigEntrypoint() []string {
 	// We have to make a copy to preserve the privacy of g.image.Config.
@@ -206,6 +229,11 @@ func (g *Generator) SetConfigCmd(cmd []string) {
 	g.image.Config.Cmd = copy
 }
 
+// AppendConfigCmd appends to the list of default arguments to the entrypoint of the container.
+func (g *Generator) AppendConfigCmd(cmd []string) {
+	g.image.Config.Cmd = append(g.ConfigCmd(), cmd...)
+}
+
 // ConfigCmd returns the list of default arguments to the entrypoint of the container.
 func (g *Generator) ConfigCmd() []string {
 	// We have to make a copy to preserve the privacy of g.image.Config.
@@ -256,6 +284,20 @@ func (g *Generator) RemoveConfigLabel(label string) {
 	delete(g.image.Config.Labels, label)
 }
 
+// RemoveConfigLabels removes the labels whose names match the given pattern (using the syntax of path.Match) from the set of arbitrary metadata for the container.
+func (g *Generator) RemoveConfigLabels(pattern string) error {
+	// Make sure the pattern is valid even if there is nothing to match.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	for label := range g.image.Config.Labels {
+		if matched, _ := path.Match(pattern, label); matched {
+			delete(g.image.Config.Labels, label)
+		}
+	}
+	return nil
+}
+
 // ConfigLabels returns the set of arbitrary metadata for the container.
 func (g *Generator) ConfigLabels() map[string]string {
 	// We have to make a copy to preserve the privacy of g.image.Config.
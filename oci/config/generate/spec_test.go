@@ -160,6 +160,14 @@ func TestConfigEntrypoint(t *testing.T) {
 	if !reflect.DeepEqual(entrypoint, got) {
 		t.Errorf("ConfigEntrypoint doesn't match: expected %v, got %v", entrypoint, got)
 	}
+
+	entrypoint = append(entrypoint, "d", "e")
+	g.AppendConfigEntrypoint([]string{"d", "e"})
+	got = g.ConfigEntrypoint()
+
+	if !reflect.DeepEqual(entrypoint, got) {
+		t.Errorf("ConfigEntrypoint doesn't match: expected %v, got %v", entrypoint, got)
+	}
 }
 
 func TestConfigCmd(t *testing.T) {
@@ -172,6 +180,14 @@ func TestConfigCmd(t *testing.T) {
 	if !reflect.DeepEqual(entrypoint, got) {
 		t.Errorf("ConfigCmd doesn't match: expected %v, got %v", entrypoint, got)
 	}
+
+	entrypoint = append(entrypoint, "d")
+	g.AppendConfigCmd([]string{"d"})
+	got = g.ConfigCmd()
+
+	if !reflect.DeepEqual(entrypoint, got) {
+		t.Errorf("ConfigCmd doesn't match: expected %v, got %v", entrypoint, got)
+	}
 }
 
 func TestConfigExposedPorts(t *testing.T) {
@@ -255,6 +271,30 @@ func TestConfigEnv(t *testing.T) {
 	if !reflect.DeepEqual(env, got) {
 		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
 	}
+
+	env = []string{"HOME=a,b,c", "ANOTHER="}
+	if err := g.RemoveConfigEnv("TEST"); err != nil {
+		t.Errorf("unexpected error removing env: %v", err)
+	}
+
+	got = g.ConfigEnv()
+	if !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
+
+	env = []string{"HOME=a,b,c"}
+	if err := g.RemoveConfigEnv("AN*"); err != nil {
+		t.Errorf("unexpected error removing env: %v", err)
+	}
+
+	got = g.ConfigEnv()
+	if !reflect.DeepEqual(env, got) {
+		t.Errorf("ConfigEnv doesn't match: expected %v, got %v", env, got)
+	}
+
+	if err := g.RemoveConfigEnv("[bad"); err == nil {
+		t.Errorf("expected an error removing env with a bad pattern")
+	}
 }
 
 func TestConfigLabels(t *testing.T) {
@@ -291,6 +331,21 @@ func TestConfigLabels(t *testing.T) {
 	if !reflect.DeepEqual(labels, got) {
 		t.Errorf("ConfigLabels doesn't match: expected %v, got %v", labels, got)
 	}
+
+	g.AddConfigLabel("org.example.a", "1")
+	g.AddConfigLabel("org.example.b", "2")
+	if err := g.RemoveConfigLabels("org.example.*"); err != nil {
+		t.Errorf("unexpected error removing labels: %v", err)
+	}
+
+	got = g.ConfigLabels()
+	if !reflect.DeepEqual(labels, got) {
+		t.Errorf("ConfigLabels doesn't match: expected %v, got %v", labels, got)
+	}
+
+	if err := g.RemoveConfigLabels("[bad"); err == nil {
+		t.Errorf("expected an error removing labels with a bad pattern")
+	}
 }
 
 func TestConfigStopSignal(t *testing.T) {
@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016, 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// exposedPortRegexp matches the form of an exposed port: a port or range of
+// ports, optionally followed by a protocol.
+var exposedPortRegexp = regexp.MustCompile(`^([0-9]+)(?:-([0-9]+))?(?:/([A-Za-z]+))?$`)
+
+// NormalizeExposedPort validates an exposed port of the form
+// <port>[-<port>][/<protocol>] (where the protocol is one of tcp, udp or
+// sctp), and returns it in its canonical form (without leading zeroes and
+// with a lower-case protocol). As in the image-spec, a port without a protocol
+// is a tcp port.
+func NormalizeExposedPort(port string) (string, error) {
+	match := exposedPortRegexp.FindStringSubmatch(port)
+	if match == nil {
+		return "", errors.Errorf("exposed port must be of the form <port>[-<port>][/<protocol>]: %q", port)
+	}
+
+	parsePort := func(value string) (int, error) {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 || number > 65535 {
+			return 0, errors.Errorf("invalid port number %q in exposed port %q", value, port)
+		}
+		return number, nil
+	}
+	start, err := parsePort(match[1])
+	if err != nil {
+		return "", err
+	}
+	normalized := strconv.Itoa(start)
+	if match[2] != "" {
+		end, err := parsePort(match[2])
+		if err != nil {
+			return "", err
+		}
+		if end < start {
+			return "", errors.Errorf("invalid port range in exposed port %q", port)
+		}
+		if end != start {
+			normalized += "-" + strconv.Itoa(end)
+		}
+	}
+
+	if match[3] == "" {
+		return normalized, nil
+	}
+	protocol := strings.ToLower(match[3])
+	switch protocol {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", errors.Errorf("unsupported protocol %q in exposed port %q", match[3], port)
+	}
+	return normalized + "/" + protocol, nil
+}
+
+// NormalizeVolume validates a volume path for an image for the given
+// operating system, and returns it in its canonical form. Volumes of Windows
+// images are returned as-is, while volumes of other images must be absolute
+// paths and are cleaned.
+func NormalizeVolume(volume, os string) (string, error) {
+	if volume == "" {
+		return "", errors.Errorf("volume cannot be empty")
+	}
+	if os == "windows" {
+		return volume, nil
+	}
+	if !path.IsAbs(volume) {
+		return "", errors.Errorf("volume must be an absolute path: %q", volume)
+	}
+	return path.Clean(volume), nil
+}
+
+// linuxSignals are the names (without the SIG prefix) and numbers of the
+// signals on Linux, other than the real-time signals.
+var linuxSignals = map[string]int{
+	"HUP":    1,
+	"INT":    2,
+	"QUIT":   3,
+	"ILL":    4,
+	"TRAP":   5,
+	"ABRT":   6,
+	"IOT":    6,
+	"BUS":    7,
+	"FPE":    8,
+	"KILL":   9,
+	"USR1":   10,
+	"SEGV":   11,
+	"USR2":   12,
+	"PIPE":   13,
+	"ALRM":   14,
+	"TERM":   15,
+	"STKFLT": 16,
+	"CHLD":   17,
+	"CLD":    17,
+	"CONT":   18,
+	"STOP":   19,
+	"TSTP":   20,
+	"TTIN":   21,
+	"TTOU":   22,
+	"URG":    23,
+	"XCPU":   24,
+	"XFSZ":   25,
+	"VTALRM": 26,
+	"PROF":   27,
+	"WINCH":  28,
+	"IO":     29,
+	"POLL":   29,
+	"PWR":    30,
+	"SYS":    31,
+}
+
+// The range of real-time signals on Linux.
+const (
+	linuxSigRtmin = 34
+	linuxSigRtmax = 64
+)
+
+// linuxRealtimeSignal returns whether the given signal name (without the SIG
+// prefix) is a valid Linux real-time signal, of the form RTMIN[+<n>] or
+// RTMAX[-<n>].
+func linuxRealtimeSignal(name string) bool {
+	var number int
+	switch {
+	case name == "RTMIN":
+		number = linuxSigRtmin
+	case name == "RTMAX":
+		number = linuxSigRtmax
+	case strings.HasPrefix(name, "RTMIN+"):
+		offset, err := strconv.Atoi(strings.TrimPrefix(name, "RTMIN+"))
+		if err != nil {
+			return false
+		}
+		number = linuxSigRtmin + offset
+	case strings.HasPrefix(name, "RTMAX-"):
+		offset, err := strconv.Atoi(strings.TrimPrefix(name, "RTMAX-"))
+		if err != nil {
+			return false
+		}
+		number = linuxSigRtmax - offset
+	default:
+		return false
+	}
+	return number >= linuxSigRtmin && number <= linuxSigRtmax
+}
+
+// windowsSignals are the only signals which can be used to stop a container
+// on Windows.
+var windowsSignals = map[string]int{
+	"KILL": 9,
+	"TERM": 15,
+}
+
+// signalNameRegexp matches the form of a signal name (without the SIG prefix).
+var signalNameRegexp = regexp.MustCompile(`^[A-Z][A-Z0-9]*([+-][0-9]+)?$`)
+
+// NormalizeStopSignal validates a stop signal (either a signal name, with or
+// without the SIG prefix, or a signal number) for an image for the given
+// operating system (which defaults to linux), and returns it in its canonical
+// form (names are upper-case and have the SIG prefix). The signals supported
+// by Linux and Windows are known, while for other operating systems only the
+// form of the signal is checked.
+func NormalizeStopSignal(signal, os string) (string, error) {
+	if os == "" {
+		os = "linux"
+	}
+
+	// Signal numbers are kept as-is.
+	if number, err := strconv.Atoi(signal); err == nil {
+		var valid bool
+		switch os {
+		case "linux":
+			valid = number >= 1 && number <= linuxSigRtmax
+		case "windows":
+			for _, known := range windowsSignals {
+				valid = valid || number == known
+			}
+		default:
+			valid = number >= 1
+		}
+		if !valid {
+			return "", errors.Errorf("invalid signal number %d for %s", number, os)
+		}
+		return strconv.Itoa(number), nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if !signalNameRegexp.MatchString(name) {
+		return "", errors.Errorf("invalid signal %q", signal)
+	}
+	var valid bool
+	switch os {
+	case "linux":
+		_, valid = linuxSignals[name]
+		valid = valid || linuxRealtimeSignal(name)
+	case "windows":
+		_, valid = windowsSignals[name]
+	default:
+		valid = true
+	}
+	if !valid {
+		return "", errors.Errorf("unknown signal %q for %s", signal, os)
+	}
+	return "SIG" + name, nil
+}
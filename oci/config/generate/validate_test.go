@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package generate
+
+import (
+	"testing"
+)
+
+func TestNormalizeExposedPort(t *testing.T) {
+	for _, test := range []struct {
+		port     string
+		expected string
+	}{
+		{"80", "80"},
+		{"80/tcp", "80/tcp"},
+		{"53/UDP", "53/udp"},
+		{"9000/sctp", "9000/sctp"},
+		{"8000-8010", "8000-8010"},
+		{"8000-8000/udp", "8000/udp"},
+		{"065535", "65535"},
+	} {
+		normalized, err := NormalizeExposedPort(test.port)
+		if err != nil {
+			t.Errorf("unexpected error normalizing %q: %+v", test.port, err)
+			continue
+		}
+		if normalized != test.expected {
+			t.Errorf("normalizing %q: got %q expected %q", test.port, normalized, test.expected)
+		}
+	}
+
+	for _, port := range []string{"", "0", "65536", "http", "80/", "80/icmp", "8010-8000", "-80", "80-", "80:80", " 80"} {
+		if normalized, err := NormalizeExposedPort(port); err == nil {
+			t.Errorf("expected error normalizing %q, got %q", port, normalized)
+		}
+	}
+}
+
+func TestNormalizeVolume(t *testing.T) {
+	for _, test := range []struct {
+		volume   string
+		os       string
+		expected string
+	}{
+		{"/data", "linux", "/data"},
+		{"/data/", "linux", "/data"},
+		{"//var/../var/lib/./db", "", "/var/lib/db"},
+		{"/", "freebsd", "/"},
+		{`C:\data`, "windows", `C:\data`},
+	} {
+		normalized, err := NormalizeVolume(test.volume, test.os)
+		if err != nil {
+			t.Errorf("unexpected error normalizing %q: %+v", test.volume, err)
+			continue
+		}
+		if normalized != test.expected {
+			t.Errorf("normalizing %q: got %q expected %q", test.volume, normalized, test.expected)
+		}
+	}
+
+	for _, volume := range []string{"", "data", "./data", `C:\data`} {
+		if normalized, err := NormalizeVolume(volume, "linux"); err == nil {
+			t.Errorf("expected error normalizing %q, got %q", volume, normalized)
+		}
+	}
+}
+
+func TestNormalizeStopSignal(t *testing.T) {
+	for _, test := range []struct {
+		signal   string
+		os       string
+		expected string
+	}{
+		{"SIGTERM", "linux", "SIGTERM"},
+		{"term", "linux", "SIGTERM"},
+		{"sigusr1", "", "SIGUSR1"},
+		{"SIGRTMIN+3", "linux", "SIGRTMIN+3"},
+		{"RTMAX-30", "linux", "SIGRTMAX-30"},
+		{"9", "linux", "9"},
+		{"64", "linux", "64"},
+		{"SIGKILL", "windows", "SIGKILL"},
+		{"15", "windows", "15"},
+		{"SIGINFO", "freebsd", "SIGINFO"},
+	} {
+		normalized, err := NormalizeStopSignal(test.signal, test.os)
+		if err != nil {
+			t.Errorf("unexpected error normalizing %q for %s: %+v", test.signal, test.os, err)
+			continue
+		}
+		if normalized != test.expected {
+			t.Errorf("normalizing %q for %s: got %q expected %q", test.signal, test.os, normalized, test.expected)
+		}
+	}
+
+	for _, test := range []struct {
+		signal string
+		os     string
+	}{
+		{"", "linux"},
+		{"SIG", "linux"},
+		{"SIGFOO", "linux"},
+		{"SIGINFO", "linux"},
+		{"SIGRTMIN+31", "linux"},
+		{"SIGRTMAX-1x", "linux"},
+		{"0", "linux"},
+		{"65", "linux"},
+		{"-1", "linux"},
+		{"SIGHUP", "windows"},
+		{"1", "windows"},
+		{"SIG TERM", "freebsd"},
+	} {
+		if normalized, err := NormalizeStopSignal(test.signal, test.os); err == nil {
+			t.Errorf("expected error normalizing %q for %s, got %q", test.signal, test.os, normalized)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// Layers generated by Docker's AUFS storage driver can contain some of the
+// AUFS metadata directories (as top-level entries whose names start with
+// aufsMetaPrefix). These are not part of the root filesystem, but hardlinks
+// in the layer may refer to files inside aufsLinkDir.
+const (
+	aufsMetaPrefix = whPrefix + whPrefix
+	aufsLinkDir    = aufsMetaPrefix + "plnk"
+)
+
+// aufsLink is a regular file stored in aufsLinkDir, which is the target of
+// hardlinks in the layer.
+type aufsLink struct {
+	// hdr is the header of the file.
+	hdr *tar.Header
+
+	// stash is the path of the temporary copy of the file's contents.
+	stash string
+
+	// name is the name of the first path which was extracted as a copy of
+	// the file (later hardlinks are linked to that path), or empty if no
+	// paths have been extracted yet.
+	name string
+}
+
+// aufsName returns the name of hdr relative to the root of the layer.
+func aufsName(name string) string {
+	return strings.TrimPrefix(CleanPath(name), "/")
+}
+
+// isAUFSMeta returns whether the given (cleaned) entry name is inside one of
+// the AUFS metadata directories. The opaque whiteout of the root directory is
+// not metadata.
+func isAUFSMeta(name string) bool {
+	top := strings.SplitN(name, "/", 2)[0]
+	return strings.HasPrefix(top, aufsMetaPrefix) && name != whOpaque
+}
+
+// aufsEntry handles the AUFS-specific conventions for the given entry, if the
+// extractor is in AUFS compatibility mode. Entries inside the AUFS metadata
+// directories are skipped (though the contents of files in aufsLinkDir are
+// kept aside) and hardlinks to files in aufsLinkDir are converted to a copy of
+// the file (or a hardlink to an earlier copy). If handled is set, the entry
+// has been dealt with and must not be extracted.
+func (te *tarExtractor) aufsEntry(root string, hdr *tar.Header, r io.Reader) (handled bool, Err error) {
+	name := aufsName(hdr.Name)
+	if isAUFSMeta(name) {
+		if strings.HasPrefix(name, aufsLinkDir+"/") && hdr.Typeflag == tar.TypeReg {
+			return true, te.aufsStashLink(hdr, r)
+		}
+		log.Debugf("unpack entry: skipping aufs metadata entry %s", hdr.Name)
+		return true, nil
+	}
+
+	if hdr.Typeflag != tar.TypeLink {
+		return false, nil
+	}
+	linkname := aufsName(hdr.Linkname)
+	if !strings.HasPrefix(linkname, aufsLinkDir+"/") {
+		return false, nil
+	}
+	link, ok := te.aufsLinks[filepath.Base(linkname)]
+	if !ok {
+		return false, errors.Errorf("invalid aufs hardlink to %s: target not in layer", hdr.Linkname)
+	}
+
+	// Later links are hardlinks to the first copy.
+	if link.name != "" {
+		log.Debugf("unpack entry: retargeting aufs hardlink %s to %s", hdr.Name, link.name)
+		hdr.Linkname = link.name
+		return false, nil
+	}
+
+	// The first link is extracted as a copy of the file.
+	log.Debugf("unpack entry: extracting aufs hardlink %s as a copy of %s", hdr.Name, hdr.Linkname)
+	fh, err := os.Open(link.stash)
+	if err != nil {
+		return true, errors.Wrap(err, "open aufs hardlink target")
+	}
+	defer fh.Close()
+
+	copyHdr := *link.hdr
+	copyHdr.Name = hdr.Name
+	if err := te.unpackEntry(root, &copyHdr, fh); err != nil {
+		return true, err
+	}
+	link.name = name
+	return true, nil
+}
+
+// aufsStashLink keeps aside the contents of the file in aufsLinkDir described
+// by hdr, so that hardlinks to it can be resolved.
+func (te *tarExtractor) aufsStashLink(hdr *tar.Header, r io.Reader) error {
+	if te.aufsTempDir == "" {
+		tempDir, err := ioutil.TempDir("", "umoci-aufs-plnk")
+		if err != nil {
+			return errors.Wrap(err, "create aufs hardlink directory")
+		}
+		te.aufsTempDir = tempDir
+	}
+
+	base := filepath.Base(aufsName(hdr.Name))
+	stash := filepath.Join(te.aufsTempDir, base)
+	fh, err := os.OpenFile(stash, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "create aufs hardlink target")
+	}
+	defer fh.Close()
+	if _, err := io.Copy(fh, r); err != nil {
+		return errors.Wrap(err, "copy aufs hardlink target")
+	}
+
+	hdrCopy := *hdr
+	te.aufsLinks[base] = &aufsLink{
+		hdr:   &hdrCopy,
+		stash: stash,
+	}
+	return nil
+}
+
+// aufsUpperWhiteout handles a whiteout of path (inside root) which has already
+// been extracted from the current layer, in AUFS compatibility mode. Such
+// whiteouts only apply to the lower layers, so if path is a directory it is
+// treated as an opaque whiteout of the directory (some AUFS layers replace
+// directories this way, rather than with an opaque whiteout), and otherwise
+// the whiteout is ignored.
+func (te *tarExtractor) aufsUpperWhiteout(root, path string) error {
+	fi, err := te.fsEval.Lstat(path)
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return errors.Wrap(err, "convert directory to header")
+	}
+	if err := te.opaqueWhiteout(root, path); err != nil {
+		return err
+	}
+	return errors.Wrap(te.fsEval.Lutimes(path, hdr.AccessTime, hdr.ModTime), "restore directory times")
+}
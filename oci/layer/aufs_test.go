@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// aufsTestLayer returns a tar archive containing the given entries (regular
+// files have their name as their contents).
+func aufsTestLayer(t *testing.T, hdrs []tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte(hdr.Name)
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUnpackLayerAUFSCompat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerAUFSCompat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := &UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+		AUFSCompat: true,
+	}
+
+	// The lower layer.
+	if err := UnpackLayer(dir, aufsTestLayer(t, []tar.Header{
+		{Name: "kept/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "kept/old", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "replaced/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "replaced/old", Typeflag: tar.TypeReg, Mode: 0644},
+	}), opt); err != nil {
+		t.Fatalf("unexpected error unpacking lower layer: %+v", err)
+	}
+
+	// A layer in the style of Docker's AUFS driver.
+	plnk := ".wh..wh.plnk/1234.5678"
+	if err := UnpackLayer(dir, aufsTestLayer(t, []tar.Header{
+		{Name: ".wh..wh.aufs", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: ".wh..wh.orph/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: ".wh..wh.plnk/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: plnk, Typeflag: tar.TypeReg, Mode: 0640},
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/a", Typeflag: tar.TypeLink, Linkname: "/" + plnk},
+		{Name: "bin/b", Typeflag: tar.TypeLink, Linkname: plnk},
+		{Name: "replaced/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "replaced/new", Typeflag: tar.TypeReg, Mode: 0644},
+		// The whiteout comes after the directory was replaced.
+		{Name: ".wh.replaced", Typeflag: tar.TypeReg, Mode: 0600},
+	}), opt); err != nil {
+		t.Fatalf("unexpected error unpacking aufs layer: %+v", err)
+	}
+
+	for _, path := range []string{".wh..wh.aufs", ".wh..wh.orph", ".wh..wh.plnk", "replaced/old"} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist: %v", path, err)
+		}
+	}
+	for _, path := range []string{"kept/old", "replaced/new"} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+		}
+	}
+
+	// The hardlinks have the contents and mode of the file they linked to,
+	// and are still linked to each other.
+	var stats []unix.Stat_t
+	for _, path := range []string{"bin/a", "bin/b"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %s", path, err)
+		}
+		if string(data) != plnk {
+			t.Errorf("%s: unexpected contents: %q", path, string(data))
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(dir, path), &st); err != nil {
+			t.Fatalf("unexpected error stating %s: %s", path, err)
+		}
+		if st.Mode&0777 != 0640 {
+			t.Errorf("%s: unexpected mode: %o", path, st.Mode&0777)
+		}
+		stats = append(stats, st)
+	}
+	if stats[0].Ino != stats[1].Ino {
+		t.Errorf("bin/a and bin/b are not hardlinks")
+	}
+
+	// Hardlinks to files which aren't in the layer are invalid.
+	if err := UnpackLayer(dir, aufsTestLayer(t, []tar.Header{
+		{Name: "bad", Typeflag: tar.TypeLink, Linkname: ".wh..wh.plnk/missing"},
+	}), opt); err == nil {
+		t.Errorf("expected an error unpacking an invalid aufs hardlink")
+	}
+}
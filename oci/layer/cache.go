@@ -0,0 +1,600 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// LayerCacheMode describes how files are cloned between a layer cache and the
+// rootfs of a bundle.
+type LayerCacheMode string
+
+const (
+	// LayerCacheReflink clones files using reflinks (falling back to copying
+	// the file contents if the filesystem doesn't support reflinks), so the
+	// rootfs and the layer cache never share any inodes.
+	LayerCacheReflink LayerCacheMode = "reflink"
+
+	// LayerCacheHardlink clones regular files by hardlinking them. This is
+	// much faster than LayerCacheReflink on filesystems without reflink
+	// support, but files in the rootfs must not be modified in-place (since
+	// that would also modify the cached snapshot).
+	LayerCacheHardlink LayerCacheMode = "hardlink"
+)
+
+// layerCacheVersion is the version of the layer cache format. Snapshots with
+// a different version are ignored.
+const layerCacheVersion = 1
+
+const (
+	// snapshotRootfs is the name of the snapshot's copy of the rootfs.
+	snapshotRootfs = "rootfs"
+
+	// snapshotMetaName is the name of the snapshot metadata file. Its mtime is
+	// updated whenever the snapshot is used.
+	snapshotMetaName = "snapshot.json"
+
+	// snapshotMtreeName is the name of the mtree manifest used to validate
+	// the snapshot before it is re-used.
+	snapshotMtreeName = "snapshot.mtree"
+)
+
+// snapshotKeywords are the mtree keywords used to detect whether a snapshot
+// has been modified since it was stored. They are deliberately cheap to
+// compute (no file contents are hashed), and do not include "nlink" because
+// the link count changes whenever LayerCacheHardlink is used.
+var snapshotKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"tar_time",
+}
+
+// ficlone is the FICLONE ioctl(2), which is not defined by x/sys/unix.
+const ficlone = 0x40049409
+
+// snapshotMeta is the metadata stored with each snapshot in the layer cache.
+type snapshotMeta struct {
+	// Version is the layerCacheVersion the snapshot was stored with.
+	Version int `json:"version"`
+
+	// ChainID is the ChainID of the layers applied to the snapshot.
+	ChainID digest.Digest `json:"chain_id"`
+
+	// Size is the (approximate) disk usage of the snapshot in bytes.
+	Size int64 `json:"size"`
+
+	// Devices are the devices which could not be created in the snapshot
+	// (see UnpackOptions.Devices).
+	Devices []Device `json:"devices,omitempty"`
+}
+
+// ChainIDs returns the ChainIDs of each of the layers with the given DiffIDs,
+// as defined in the OCI image-spec. The ChainID of a layer uniquely identifies
+// the filesystem which results from applying it and all of its parent layers.
+func ChainIDs(diffIDs []digest.Digest) []digest.Digest {
+	var chainIDs []digest.Digest
+	for idx, diffID := range diffIDs {
+		chainID := diffID
+		if idx > 0 {
+			chainID = digest.SHA256.FromString(chainIDs[idx-1].String() + " " + diffID.String())
+		}
+		chainIDs = append(chainIDs, chainID)
+	}
+	return chainIDs
+}
+
+// layerCache is a directory containing snapshots of the rootfs after each
+// layer was applied, keyed by the ChainID of the applied layers (as well as
+// any options which affect extraction). This allows unpacks of images sharing
+// the same base layers to skip extracting those layers.
+type layerCache struct {
+	// root is the path to the cache directory.
+	root string
+
+	// mode is how files are cloned to and from the cache.
+	mode LayerCacheMode
+
+	// maxSize is the maximum total size of the cache (or 0 if unlimited).
+	maxSize int64
+
+	// keyOptions is the JSON encoding of the options which affect how layers
+	// are extracted, which is included in every cache key.
+	keyOptions []byte
+
+	// mapOptions are the mapping options used for extraction.
+	mapOptions MapOptions
+
+	// fsEval is an fseval.FsEval used for accessing the cache.
+	fsEval fseval.FsEval
+}
+
+// openLayerCache opens (creating it if necessary) the layer cache described
+// by the given options.
+func openLayerCache(opt UnpackOptions) (*layerCache, error) {
+	mode := opt.LayerCacheMode
+	switch mode {
+	case "":
+		mode = LayerCacheReflink
+	case LayerCacheReflink, LayerCacheHardlink:
+	default:
+		return nil, errors.Errorf("open layer cache: unknown layer cache mode: %s", mode)
+	}
+
+	if err := os.MkdirAll(opt.LayerCache, 0700); err != nil {
+		return nil, errors.Wrap(err, "mkdir layer cache")
+	}
+
+	// Snapshots extracted with different options will be different, so the
+	// options need to be part of the key. The default device and dirlink
+	// policies are left out of the key, so that existing snapshots are still
+	// used.
+	devicePolicy := opt.DevicePolicy
+	if devicePolicy == DevicePlaceholder {
+		devicePolicy = ""
+	}
+	dirlinkPolicy := opt.DirlinkPolicy
+	if dirlinkPolicy == DirlinkReplace {
+		dirlinkPolicy = ""
+	}
+	keyOptions, err := json.Marshal(struct {
+		MapOptions       MapOptions    `json:"map_options"`
+		XattrFilter      []string      `json:"xattr_filter"`
+		EmulateXattrs    bool          `json:"emulate_xattrs"`
+		EmulateOwnership bool          `json:"emulate_ownership,omitempty"`
+		DevicePolicy     DevicePolicy  `json:"device_policy,omitempty"`
+		Strictness       Strictness    `json:"strictness,omitempty"`
+		DirlinkPolicy    DirlinkPolicy `json:"dirlink_policy,omitempty"`
+		AUFSCompat       bool          `json:"aufs_compat,omitempty"`
+	}{
+		MapOptions:       opt.MapOptions,
+		XattrFilter:      xattrFilterOrDefault(opt.XattrFilter).Rules(),
+		EmulateXattrs:    opt.EmulateXattrs,
+		EmulateOwnership: opt.EmulateOwnership,
+		DevicePolicy:     devicePolicy,
+		Strictness:       opt.Strictness,
+		DirlinkPolicy:    dirlinkPolicy,
+		AUFSCompat:       opt.AUFSCompat,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal layer cache key options")
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if opt.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	return &layerCache{
+		root:       opt.LayerCache,
+		mode:       mode,
+		maxSize:    opt.LayerCacheSize,
+		keyOptions: keyOptions,
+		mapOptions: opt.MapOptions,
+		fsEval:     fsEval,
+	}, nil
+}
+
+// snapshotPath returns the path of the snapshot for the given ChainID.
+func (c *layerCache) snapshotPath(chainID digest.Digest) string {
+	key := digest.SHA256.FromString(chainID.String() + "\n" + string(c.keyOptions))
+	return filepath.Join(c.root, key.Hex())
+}
+
+// Restore clones the most recent valid snapshot of the given chain into
+// rootfs (which must be empty). It returns the number of layers in the chain
+// which were restored (0 if there was no usable snapshot), and the devices
+// which were recorded when the snapshot was stored.
+func (c *layerCache) Restore(rootfs string, chainIDs []digest.Digest) (int, []Device, error) {
+	for idx := len(chainIDs) - 1; idx >= 0; idx-- {
+		chainID := chainIDs[idx]
+		path := c.snapshotPath(chainID)
+		meta, err := c.validate(path, chainID)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				// Invalid snapshots are removed, so that they can be
+				// replaced with a valid one by this unpack.
+				log.Warnf("layer cache: removing invalid snapshot %s: %v", chainID, err)
+				if err := c.remove(path); err != nil {
+					return 0, nil, errors.Wrap(err, "remove invalid snapshot")
+				}
+			}
+			continue
+		}
+
+		log.Infof("layer cache: restoring snapshot %s", chainID)
+		if _, err := c.clone(filepath.Join(path, snapshotRootfs), rootfs); err != nil {
+			return 0, nil, errors.Wrap(err, "restore snapshot")
+		}
+		// Mark the snapshot as recently used.
+		now := time.Now()
+		if err := os.Chtimes(filepath.Join(path, snapshotMetaName), now, now); err != nil {
+			return 0, nil, errors.Wrap(err, "touch snapshot")
+		}
+		// The cache size limit may have changed since the last store.
+		if err := c.evict(); err != nil {
+			return 0, nil, err
+		}
+		return idx + 1, meta.Devices, nil
+	}
+	return 0, nil, nil
+}
+
+// validate checks whether the snapshot at the given path is a valid snapshot
+// of the given chain, and that it hasn't been modified since it was stored.
+// The snapshot's metadata is returned if it is valid.
+func (c *layerCache) validate(path string, chainID digest.Digest) (*snapshotMeta, error) {
+	metaFile, err := os.Open(filepath.Join(path, snapshotMetaName))
+	if err != nil {
+		return nil, errors.Wrap(err, "open snapshot metadata")
+	}
+	defer metaFile.Close()
+
+	var meta snapshotMeta
+	if err := json.NewDecoder(metaFile).Decode(&meta); err != nil {
+		return nil, errors.Wrap(err, "parse snapshot metadata")
+	}
+	if meta.Version != layerCacheVersion {
+		return nil, errors.Errorf("unsupported snapshot version %d", meta.Version)
+	}
+	if meta.ChainID != chainID {
+		return nil, errors.Errorf("snapshot has chain id %s", meta.ChainID)
+	}
+
+	mtreeFile, err := os.Open(filepath.Join(path, snapshotMtreeName))
+	if err != nil {
+		return nil, errors.Wrap(err, "open snapshot mtree")
+	}
+	defer mtreeFile.Close()
+
+	spec, err := mtree.ParseSpec(mtreeFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse snapshot mtree")
+	}
+	diffs, err := mtree.Check(filepath.Join(path, snapshotRootfs), spec, snapshotKeywords, c.fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "check snapshot mtree")
+	}
+	if len(diffs) > 0 {
+		return nil, errors.Errorf("snapshot has been modified (%d changes, including %s)", len(diffs), diffs[0].Path())
+	}
+	return &meta, nil
+}
+
+// Store stores a snapshot of rootfs (which must be the result of applying the
+// chain with the given ChainID, recording the given devices), and then
+// removes the least-recently used snapshots if the cache is larger than its
+// maximum size.
+func (c *layerCache) Store(rootfs string, chainID digest.Digest, devices []Device) (Err error) {
+	path := c.snapshotPath(chainID)
+	if _, err := os.Lstat(path); err == nil {
+		// Someone else has already stored this snapshot.
+		return nil
+	}
+
+	log.Infof("layer cache: storing snapshot %s", chainID)
+
+	// The snapshot is built in a temporary directory and then atomically
+	// renamed, so that the cache never contains partial snapshots.
+	tempPath, err := ioutil.TempDir(c.root, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary snapshot")
+	}
+	defer func() {
+		if Err != nil {
+			_ = c.fsEval.RemoveAll(tempPath)
+		}
+	}()
+
+	snapshotRoot := filepath.Join(tempPath, snapshotRootfs)
+	if err := os.Mkdir(snapshotRoot, 0755); err != nil {
+		return errors.Wrap(err, "mkdir snapshot rootfs")
+	}
+	size, err := c.clone(rootfs, snapshotRoot)
+	if err != nil {
+		return errors.Wrap(err, "clone rootfs")
+	}
+
+	dh, err := mtree.Walk(snapshotRoot, nil, snapshotKeywords, c.fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate snapshot mtree")
+	}
+	mtreeFile, err := os.Create(filepath.Join(tempPath, snapshotMtreeName))
+	if err != nil {
+		return errors.Wrap(err, "create snapshot mtree")
+	}
+	defer mtreeFile.Close()
+	if _, err := dh.WriteTo(mtreeFile); err != nil {
+		return errors.Wrap(err, "write snapshot mtree")
+	}
+
+	metaFile, err := os.Create(filepath.Join(tempPath, snapshotMetaName))
+	if err != nil {
+		return errors.Wrap(err, "create snapshot metadata")
+	}
+	defer metaFile.Close()
+	if err := json.NewEncoder(metaFile).Encode(snapshotMeta{
+		Version: layerCacheVersion,
+		ChainID: chainID,
+		Size:    size,
+		Devices: devices,
+	}); err != nil {
+		return errors.Wrap(err, "write snapshot metadata")
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		// Someone else may have raced with us to store the same snapshot, in
+		// which case we just use theirs.
+		if _, err2 := os.Lstat(path); err2 != nil {
+			return errors.Wrap(err, "rename temporary snapshot")
+		}
+		_ = c.fsEval.RemoveAll(tempPath)
+	}
+	return c.evict()
+}
+
+// remove removes the snapshot at the given path. The snapshot is first
+// renamed so that it is never visible in a partially-removed state.
+func (c *layerCache) remove(path string) error {
+	tempPath := filepath.Join(c.root, ".rm-"+filepath.Base(path))
+	if err := os.Rename(path, tempPath); err != nil {
+		return errors.Wrap(err, "rename snapshot")
+	}
+	return errors.Wrap(c.fsEval.RemoveAll(tempPath), "remove snapshot")
+}
+
+// evict removes the least-recently used snapshots until the total size of
+// the cache is no larger than its maximum size.
+func (c *layerCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+
+	type snapshot struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var (
+		snapshots []snapshot
+		total     int64
+	)
+	names, err := ioutil.ReadDir(c.root)
+	if err != nil {
+		return errors.Wrap(err, "read layer cache")
+	}
+	for _, fi := range names {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(c.root, fi.Name())
+		metaPath := filepath.Join(path, snapshotMetaName)
+		metaFi, err := os.Stat(metaPath)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var meta snapshotMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{
+			path:     path,
+			size:     meta.Size,
+			lastUsed: metaFi.ModTime(),
+		})
+		total += meta.Size
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].lastUsed.Before(snapshots[j].lastUsed)
+	})
+	for _, snapshot := range snapshots {
+		if total <= c.maxSize {
+			break
+		}
+		log.Infof("layer cache: evicting snapshot %s", filepath.Base(snapshot.path))
+		if err := c.remove(snapshot.path); err != nil {
+			return errors.Wrap(err, "evict snapshot")
+		}
+		total -= snapshot.size
+	}
+	return nil
+}
+
+// clone clones the tree at src into dst (which must already exist as a
+// directory), preserving all metadata and hardlinks. The (approximate) disk
+// usage of the cloned tree is returned.
+func (c *layerCache) clone(src, dst string) (int64, error) {
+	cl := &cloner{
+		layerCache: c,
+		inodes:     map[inodeKey]string{},
+	}
+	if err := cl.clone(src, dst); err != nil {
+		return 0, err
+	}
+	return cl.size, nil
+}
+
+// cloner holds the state of a single layerCache.clone operation.
+type cloner struct {
+	*layerCache
+
+	// inodes maps the inodes of regular files with more than one link to the
+	// first path they were cloned to, so that hardlinks are preserved.
+	inodes map[inodeKey]string
+
+	// size is the disk usage of the files cloned so far.
+	size int64
+}
+
+func (cl *cloner) clone(src, dst string) error {
+	fi, err := cl.fsEval.Lstat(src)
+	if err != nil {
+		return errors.Wrap(err, "lstat source")
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unexpected stat type for %s", src)
+	}
+
+	switch {
+	case fi.IsDir():
+		if _, err := cl.fsEval.Lstat(dst); os.IsNotExist(errors.Cause(err)) {
+			if err := cl.fsEval.Mkdir(dst, 0700); err != nil {
+				return errors.Wrap(err, "mkdir")
+			}
+		}
+		children, err := cl.fsEval.Readdir(src)
+		if err != nil {
+			return errors.Wrap(err, "readdir")
+		}
+		for _, child := range children {
+			if err := cl.clone(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name())); err != nil {
+				return err
+			}
+		}
+
+	case fi.Mode().IsRegular():
+		key := inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if path, ok := cl.inodes[key]; ok {
+			return errors.Wrap(cl.fsEval.Link(path, dst), "link hardlink")
+		}
+		if st.Nlink > 1 {
+			cl.inodes[key] = dst
+		}
+		cl.size += st.Blocks * 512
+
+		// Hardlinked files share all of their metadata with the source.
+		if cl.mode == LayerCacheHardlink {
+			return errors.Wrap(cl.fsEval.Link(src, dst), "link")
+		}
+		if err := cl.copyFile(src, dst); err != nil {
+			return errors.Wrap(err, "copy file")
+		}
+
+	case fi.Mode()&os.ModeSymlink == os.ModeSymlink:
+		linkname, err := cl.fsEval.Readlink(src)
+		if err != nil {
+			return errors.Wrap(err, "readlink")
+		}
+		if err := cl.fsEval.Symlink(linkname, dst); err != nil {
+			return errors.Wrap(err, "symlink")
+		}
+
+	case fi.Mode()&os.ModeSocket == os.ModeSocket:
+		// Sockets cannot be part of a layer, so they cannot be part of a
+		// snapshot either.
+		return nil
+
+	default:
+		if err := cl.fsEval.Mknod(dst, os.FileMode(st.Mode), system.Dev_t(st.Rdev)); err != nil {
+			return errors.Wrap(err, "mknod")
+		}
+	}
+
+	return errors.Wrap(cl.copyMetadata(src, dst, fi, st), "copy metadata")
+}
+
+// copyFile copies the contents of the regular file src to dst, using a
+// reflink if possible.
+func (cl *cloner) copyFile(src, dst string) error {
+	srcFile, err := cl.fsEval.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer srcFile.Close()
+
+	dstFile, err := cl.fsEval.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	defer dstFile.Close()
+
+	if err := unix.IoctlSetInt(int(dstFile.Fd()), ficlone, int(srcFile.Fd())); err == nil {
+		return nil
+	}
+	// Reflinks are not supported, so fall back to copying (while keeping any
+	// holes in the file).
+	_, err = copySparse(dstFile, srcFile)
+	return err
+}
+
+// copyMetadata applies the owner, mode, xattrs and timestamps of src
+// (described by fi and st) to path.
+func (cl *cloner) copyMetadata(src, path string, fi os.FileInfo, st *syscall.Stat_t) error {
+	isSymlink := fi.Mode()&os.ModeSymlink == os.ModeSymlink
+
+	// In rootless mode every file is owned by us, so there's nothing to do.
+	if !cl.mapOptions.Rootless {
+		if err := os.Lchown(path, int(st.Uid), int(st.Gid)); err != nil {
+			return errors.Wrap(err, "lchown")
+		}
+	}
+	if !isSymlink {
+		if err := cl.fsEval.Chmod(path, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return errors.Wrap(err, "chmod")
+		}
+	}
+
+	xattrs, err := cl.fsEval.Llistxattr(src)
+	if err != nil {
+		return errors.Wrap(err, "llistxattr")
+	}
+	for _, name := range xattrs {
+		value, err := cl.fsEval.Lgetxattr(src, name)
+		if err != nil {
+			return errors.Wrap(err, "lgetxattr")
+		}
+		if err := cl.fsEval.Lsetxattr(path, name, value, 0); err != nil {
+			// In rootless mode some xattrs cannot be set, but they wouldn't
+			// have been set when extracting the layer either.
+			if cl.mapOptions.Rootless && os.IsPermission(errors.Cause(err)) {
+				continue
+			}
+			return errors.Wrapf(err, "lsetxattr %s", name)
+		}
+	}
+
+	atime := time.Unix(st.Atim.Unix())
+	mtime := time.Unix(st.Mtim.Unix())
+	return errors.Wrap(cl.fsEval.Lutimes(path, atime, mtime), "lutimes")
+}
@@ -0,0 +1,315 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/vbatts/go-mtree"
+)
+
+func TestChainIDs(t *testing.T) {
+	diffIDs := []digest.Digest{
+		digest.SHA256.FromString("layer1"),
+		digest.SHA256.FromString("layer2"),
+		digest.SHA256.FromString("layer3"),
+	}
+	chainIDs := ChainIDs(diffIDs)
+	if len(chainIDs) != len(diffIDs) {
+		t.Fatalf("unexpected number of chain ids: got %d expected %d", len(chainIDs), len(diffIDs))
+	}
+	if chainIDs[0] != diffIDs[0] {
+		t.Errorf("chain id of base layer should be its diff id: got %s expected %s", chainIDs[0], diffIDs[0])
+	}
+	for idx := 1; idx < len(diffIDs); idx++ {
+		expected := digest.SHA256.FromString(chainIDs[idx-1].String() + " " + diffIDs[idx].String())
+		if chainIDs[idx] != expected {
+			t.Errorf("chain id %d mismatch: got %s expected %s", idx, chainIDs[idx], expected)
+		}
+	}
+}
+
+// makeCacheTestRootfs creates a small rootfs with a variety of file types.
+func makeCacheTestRootfs(t *testing.T, root string) {
+	if err := os.MkdirAll(filepath.Join(root, "etc", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "etc", "passwd"), filepath.Join(root, "etc", "sub", "passwd-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../passwd", filepath.Join(root, "etc", "sub", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "setuid"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "setuid"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "etc", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Unix(123456789, 0)
+	for _, path := range []string{"setuid", "etc/passwd", "etc/sub", "etc"} {
+		if err := os.Chtimes(filepath.Join(root, path), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLayerCacheRoundTrip(t *testing.T) {
+	for _, mode := range []LayerCacheMode{LayerCacheReflink, LayerCacheHardlink} {
+		dir, err := ioutil.TempDir("", "umoci-TestLayerCacheRoundTrip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		rootfs := filepath.Join(dir, "rootfs")
+		if err := os.Mkdir(rootfs, 0755); err != nil {
+			t.Fatal(err)
+		}
+		makeCacheTestRootfs(t, rootfs)
+
+		cache, err := openLayerCache(UnpackOptions{
+			MapOptions:     MapOptions{Rootless: os.Geteuid() != 0},
+			LayerCache:     filepath.Join(dir, "cache"),
+			LayerCacheMode: mode,
+		})
+		if err != nil {
+			t.Fatalf("mode=%s: unexpected error opening cache: %v", mode, err)
+		}
+
+		chainIDs := ChainIDs([]digest.Digest{
+			digest.SHA256.FromString("layer1"),
+			digest.SHA256.FromString("layer2"),
+		})
+		devices := []Device{{Path: "dev/null", Type: "char", Major: 1, Minor: 3, Placeholder: true}}
+		if err := cache.Store(rootfs, chainIDs[0], devices); err != nil {
+			t.Fatalf("mode=%s: unexpected error storing snapshot: %v", mode, err)
+		}
+
+		restored := filepath.Join(dir, "restored")
+		if err := os.Mkdir(restored, 0755); err != nil {
+			t.Fatal(err)
+		}
+		n, restoredDevices, err := cache.Restore(restored, chainIDs)
+		if err != nil {
+			t.Fatalf("mode=%s: unexpected error restoring snapshot: %v", mode, err)
+		}
+		if n != 1 {
+			t.Errorf("mode=%s: unexpected number of layers restored: got %d expected 1", mode, n)
+		}
+		if !reflect.DeepEqual(restoredDevices, devices) {
+			t.Errorf("mode=%s: unexpected devices restored: got %v expected %v", mode, restoredDevices, devices)
+		}
+
+		// The restored rootfs must match the original.
+		keywords := append(snapshotKeywords, "sha256digest")
+		dh, err := mtree.Walk(rootfs, nil, keywords, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffs, err := mtree.Check(restored, dh, keywords, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, diff := range diffs {
+			t.Errorf("mode=%s: restored rootfs differs from original: %s", mode, diff)
+		}
+
+		// Hardlinks must be preserved.
+		fi1, err := os.Stat(filepath.Join(restored, "etc", "passwd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi2, err := os.Stat(filepath.Join(restored, "etc", "sub", "passwd-link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi1, fi2) {
+			t.Errorf("mode=%s: hardlink was not preserved", mode)
+		}
+	}
+}
+
+// TestLayerCacheRootless makes sure that snapshots can be stored and restored
+// with RootlessFsEval, even when running as root.
+func TestLayerCacheRootless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLayerCacheRootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	makeCacheTestRootfs(t, rootfs)
+
+	cache, err := openLayerCache(UnpackOptions{
+		MapOptions:     MapOptions{Rootless: true},
+		LayerCache:     filepath.Join(dir, "cache"),
+		LayerCacheMode: LayerCacheReflink,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainIDs := ChainIDs([]digest.Digest{digest.SHA256.FromString("layer1")})
+	if err := cache.Store(rootfs, chainIDs[0], nil); err != nil {
+		t.Fatalf("unexpected error storing snapshot: %v", err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := os.Mkdir(restored, 0755); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := cache.Restore(restored, chainIDs)
+	if err != nil {
+		t.Fatalf("unexpected error restoring snapshot: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("unexpected number of layers restored: got %d expected 1", n)
+	}
+	for _, path := range []string{"etc/passwd", "etc/sub/passwd-link", "etc/sub/symlink", "setuid"} {
+		if _, err := os.Lstat(filepath.Join(restored, path)); err != nil {
+			t.Errorf("restored rootfs is missing %s: %v", path, err)
+		}
+	}
+}
+
+func TestLayerCacheInvalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLayerCacheInvalidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	makeCacheTestRootfs(t, rootfs)
+
+	cache, err := openLayerCache(UnpackOptions{
+		MapOptions:     MapOptions{Rootless: os.Geteuid() != 0},
+		LayerCache:     filepath.Join(dir, "cache"),
+		LayerCacheMode: LayerCacheHardlink,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainIDs := ChainIDs([]digest.Digest{digest.SHA256.FromString("layer1")})
+	if err := cache.Store(rootfs, chainIDs[0], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modifying the rootfs in-place modifies the (hardlinked) snapshot, which
+	// must then be detected and discarded.
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "setuid"), []byte("modified binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := os.Mkdir(restored, 0755); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := cache.Restore(restored, chainIDs)
+	if err != nil {
+		t.Fatalf("unexpected error restoring snapshot: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("modified snapshot was used")
+	}
+	if _, err := os.Lstat(cache.snapshotPath(chainIDs[0])); !os.IsNotExist(err) {
+		t.Errorf("modified snapshot was not removed: %v", err)
+	}
+
+	// Snapshots with different extraction options are not shared.
+	if err := cache.Store(rootfs, chainIDs[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	otherCache, err := openLayerCache(UnpackOptions{
+		MapOptions:    MapOptions{Rootless: os.Geteuid() != 0},
+		LayerCache:    filepath.Join(dir, "cache"),
+		EmulateXattrs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := otherCache.Restore(restored, chainIDs); err != nil || n != 0 {
+		t.Errorf("snapshot with different options was used: %d %v", n, err)
+	}
+}
+
+func TestLayerCacheEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLayerCacheEvict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), make([]byte, 64*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one snapshot fits in the cache.
+	cache, err := openLayerCache(UnpackOptions{
+		MapOptions:     MapOptions{Rootless: os.Geteuid() != 0},
+		LayerCache:     filepath.Join(dir, "cache"),
+		LayerCacheSize: 100 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chainIDs := ChainIDs([]digest.Digest{
+		digest.SHA256.FromString("layer1"),
+		digest.SHA256.FromString("layer2"),
+	})
+	for _, chainID := range chainIDs {
+		if err := cache.Store(rootfs, chainID, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the snapshots have different last-used times.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := os.Lstat(cache.snapshotPath(chainIDs[0])); !os.IsNotExist(err) {
+		t.Errorf("least-recently used snapshot was not evicted: %v", err)
+	}
+	if _, err := os.Lstat(cache.snapshotPath(chainIDs[1])); err != nil {
+		t.Errorf("most-recently used snapshot was evicted: %v", err)
+	}
+}
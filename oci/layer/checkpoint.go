@@ -0,0 +1,46 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint records the progress of an UnpackManifest using DirRootfs, so
+// that an interrupted unpack can be resumed (see UnpackOptions.Resume).
+type Checkpoint struct {
+	// Layers are the DiffIDs of the layers which have been completely applied
+	// to the rootfs, in order.
+	Layers []digest.Digest `json:"layers"`
+}
+
+// verify checks that the checkpoint is consistent with an image with the
+// given DiffIDs, meaning that the layers recorded in the checkpoint are the
+// first layers of the image.
+func (c Checkpoint) verify(diffIDs []digest.Digest) error {
+	if len(c.Layers) > len(diffIDs) {
+		return errors.Errorf("checkpoint has %d layers but the image only has %d layers", len(c.Layers), len(diffIDs))
+	}
+	for idx, diffID := range c.Layers {
+		if diffID != diffIDs[idx] {
+			return errors.Errorf("checkpoint layer %d does not match image: got %s expected %s", idx, diffID, diffIDs[idx])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DevicePolicy describes how character and block device entries in a layer
+// are handled when unpacking in rootless mode, where device nodes cannot be
+// created.
+type DevicePolicy string
+
+const (
+	// DevicePlaceholder replaces each device with an empty regular file
+	// (with the mode and owner of the device).
+	DevicePlaceholder DevicePolicy = "placeholder"
+
+	// DeviceSkip silently skips device entries, so that nothing is created
+	// at their paths.
+	DeviceSkip DevicePolicy = "skip"
+
+	// DeviceError causes the unpack to fail if the layer contains any
+	// devices.
+	DeviceError DevicePolicy = "error"
+)
+
+// validate returns an error if the policy is not a known DevicePolicy. An
+// empty policy is equivalent to DevicePlaceholder.
+func (p DevicePolicy) validate() error {
+	switch p {
+	case "", DevicePlaceholder, DeviceSkip, DeviceError:
+		return nil
+	}
+	return errors.Errorf("unknown device policy: %s", p)
+}
+
+// Device is a device entry from a layer which could not be created when
+// unpacking in rootless mode.
+type Device struct {
+	// Path is the path of the device, relative to the root filesystem.
+	Path string `json:"path"`
+
+	// Type is the type of device, either "char" or "block".
+	Type string `json:"type"`
+
+	// Major and Minor are the device numbers of the device.
+	Major int64 `json:"major"`
+	Minor int64 `json:"minor"`
+
+	// Placeholder is whether an empty regular file was created at Path in
+	// place of the device (rather than it being skipped).
+	Placeholder bool `json:"placeholder,omitempty"`
+}
+
+// typeflag returns the tar typeflag for the device.
+func (d Device) typeflag() byte {
+	if d.Type == "block" {
+		return tar.TypeBlock
+	}
+	return tar.TypeChar
+}
+
+// DeviceRecord records the devices which could not be created when unpacking
+// layers in rootless mode. Devices which are later removed or replaced by
+// another layer are removed from the record, so after unpacking an image it
+// describes the devices in the final root filesystem. A DeviceRecord must not
+// be used concurrently.
+type DeviceRecord struct {
+	devices map[string]Device
+}
+
+// NewDeviceRecord creates a new DeviceRecord containing the given devices.
+func NewDeviceRecord(devices []Device) *DeviceRecord {
+	r := &DeviceRecord{}
+	r.reset(devices)
+	return r
+}
+
+// Devices returns the recorded devices, sorted by path.
+func (r *DeviceRecord) Devices() []Device {
+	if r == nil {
+		return nil
+	}
+	var devices []Device
+	for _, dev := range r.devices {
+		devices = append(devices, dev)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Path < devices[j].Path
+	})
+	return devices
+}
+
+// reset replaces the contents of the record with the given devices.
+func (r *DeviceRecord) reset(devices []Device) {
+	r.devices = map[string]Device{}
+	for _, dev := range devices {
+		r.add(dev)
+	}
+}
+
+// add records a device, replacing any device previously recorded at the
+// same path.
+func (r *DeviceRecord) add(dev Device) {
+	dev.Path = CleanPath(dev.Path)
+	r.devices[dev.Path] = dev
+}
+
+// forget removes the device recorded at path (if any). If recursive is set,
+// any devices recorded underneath path are also removed.
+func (r *DeviceRecord) forget(path string, recursive bool) {
+	path = CleanPath(path)
+	delete(r.devices, path)
+	if !recursive {
+		return
+	}
+	prefix := path + "/"
+	if path == "." {
+		prefix = ""
+	}
+	for devPath := range r.devices {
+		if strings.HasPrefix(devPath, prefix) {
+			delete(r.devices, devPath)
+		}
+	}
+}
+
+// deviceFromHeader returns the Device described by a character or block
+// device header, whose path is relative to root.
+func deviceFromHeader(root, path string, hdr *tar.Header, placeholder bool) (Device, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return Device{}, errors.Wrap(err, "get relative device path")
+	}
+	dev := Device{
+		Path:        rel,
+		Type:        "char",
+		Major:       hdr.Devmajor,
+		Minor:       hdr.Devminor,
+		Placeholder: placeholder,
+	}
+	if hdr.Typeflag == tar.TypeBlock {
+		dev.Type = "block"
+	}
+	return dev, nil
+}
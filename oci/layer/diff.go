@@ -0,0 +1,323 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// FileInfo is the metadata of a path in a root filesystem which is compared
+// by DiffTrees. Modification times are deliberately not included, as they
+// change with every rebuild of an image.
+type FileInfo struct {
+	// Type is the type of the path ("file", "dir", "symlink", "hardlink",
+	// "char", "block" or "fifo").
+	Type string `json:"type"`
+
+	// Mode is the set of permission bits (including the setuid, setgid and
+	// sticky bits) of the path.
+	Mode int64 `json:"mode"`
+
+	// UID and GID are the owner of the path.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+
+	// Size is the size of the contents of a regular file (or the file a
+	// hardlink refers to).
+	Size int64 `json:"size"`
+
+	// Linkname is the target of a symlink or hardlink.
+	Linkname string `json:"linkname,omitempty"`
+
+	// Digest is the digest of the contents of a regular file (or the file a
+	// hardlink refers to).
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Devmajor and Devminor are the device numbers of a device.
+	Devmajor int64 `json:"devmajor,omitempty"`
+	Devminor int64 `json:"devminor,omitempty"`
+}
+
+// fileType returns the FileInfo.Type of the given tar typeflag.
+func fileType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return string(typeflag)
+}
+
+// FileTree is the set of paths in a root filesystem, keyed by their cleaned
+// path relative to the root.
+type FileTree map[string]FileInfo
+
+// ReadTree reads the FileTree of a (flattened) tar archive containing a root
+// filesystem, such as the output of FlattenManifest. The contents of every
+// regular file are hashed, and hardlinks are given the size and digest of the
+// file they refer to.
+func ReadTree(r io.Reader) (FileTree, error) {
+	tree := FileTree{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read next entry")
+		}
+		path := CleanPath(hdr.Name)
+		if path == "." {
+			continue
+		}
+
+		info := FileInfo{
+			Type: fileType(hdr.Typeflag),
+			Mode: hdr.Mode & 07777,
+			UID:  hdr.Uid,
+			GID:  hdr.Gid,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			digester := digest.SHA256.Digester()
+			size, err := io.Copy(digester.Hash(), tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "hash %s", path)
+			}
+			info.Size = size
+			info.Digest = digester.Digest()
+		case tar.TypeSymlink:
+			info.Linkname = hdr.Linkname
+		case tar.TypeLink:
+			info.Linkname = CleanPath(hdr.Linkname)
+		case tar.TypeChar, tar.TypeBlock:
+			info.Devmajor = hdr.Devmajor
+			info.Devminor = hdr.Devminor
+		}
+		tree[path] = info
+	}
+
+	// Hardlinks may refer to paths later in the archive, so they are only
+	// resolved once everything has been read.
+	for path, info := range tree {
+		if info.Type != "hardlink" {
+			continue
+		}
+		target, ok := tree[info.Linkname]
+		if !ok {
+			return nil, errors.Errorf("hardlink %s refers to missing path %s", path, info.Linkname)
+		}
+		info.Size = target.Size
+		info.Digest = target.Digest
+		tree[path] = info
+	}
+	return tree, nil
+}
+
+// ManifestTree returns the FileTree of the root filesystem described by the
+// given manifest, without extracting the image.
+func ManifestTree(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, opt *FlattenOptions) (FileTree, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(FlattenManifest(ctx, engine, writer, manifest, opt))
+	}()
+	defer reader.Close()
+
+	tree, err := ReadTree(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read flattened image")
+	}
+	return tree, nil
+}
+
+// RootfsTree returns the FileTree of the root filesystem at the given path.
+// The metadata of each path is the same as it would be in a layer generated
+// by GenerateLayer with the given options, so that an unpacked root
+// filesystem can be compared against an image.
+func RootfsTree(root string, opt *RepackOptions) (FileTree, error) {
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+	if err := repackOptions.SocketPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err := repackOptions.SetuidPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() (Err error) {
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate archive"))
+		}()
+
+		tg := newTarGenerator(writer, repackOptions)
+		var walk func(name string) error
+		walk = func(name string) error {
+			fullPath := filepath.Join(root, name)
+			if name != "." {
+				if err := tg.AddFile(name, fullPath); err != nil {
+					return errors.Wrapf(err, "add %s", name)
+				}
+			}
+			fi, err := tg.fsEval.Lstat(fullPath)
+			if err != nil {
+				return errors.Wrap(err, "lstat")
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			children, err := tg.fsEval.Readdir(fullPath)
+			if err != nil {
+				return errors.Wrapf(err, "readdir %s", name)
+			}
+			sort.Slice(children, func(i, j int) bool {
+				return children[i].Name() < children[j].Name()
+			})
+			for _, child := range children {
+				if err := walk(filepath.Join(name, child.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk("."); err != nil {
+			return err
+		}
+		return errors.Wrap(tg.tw.Close(), "close tar writer")
+	}()
+	defer reader.Close()
+
+	tree, err := ReadTree(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read root filesystem")
+	}
+	return tree, nil
+}
+
+// ChangeType is the kind of change made to a path.
+type ChangeType string
+
+const (
+	// ChangeAdded indicates that the path only exists in the new tree.
+	ChangeAdded ChangeType = "added"
+
+	// ChangeModified indicates that the metadata or contents of the path
+	// differ between the trees.
+	ChangeModified ChangeType = "modified"
+
+	// ChangeDeleted indicates that the path only exists in the old tree.
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// FileChange is a change to a path between two FileTrees.
+type FileChange struct {
+	// Path is the path which was changed, relative to the root.
+	Path string `json:"path"`
+
+	// Type is the kind of change.
+	Type ChangeType `json:"type"`
+
+	// Old is the path in the old tree (nil if the path was added).
+	Old *FileInfo `json:"old,omitempty"`
+
+	// New is the path in the new tree (nil if the path was deleted).
+	New *FileInfo `json:"new,omitempty"`
+}
+
+// Fields returns the names of the FileInfo fields which differ between the
+// old and new path of a ChangeModified change ("type", "mode", "owner",
+// "size", "linkname", "contents" or "device").
+func (c FileChange) Fields() []string {
+	if c.Old == nil || c.New == nil {
+		return nil
+	}
+	var fields []string
+	if c.Old.Type != c.New.Type {
+		fields = append(fields, "type")
+	}
+	if c.Old.Mode != c.New.Mode {
+		fields = append(fields, "mode")
+	}
+	if c.Old.UID != c.New.UID || c.Old.GID != c.New.GID {
+		fields = append(fields, "owner")
+	}
+	if c.Old.Size != c.New.Size {
+		fields = append(fields, "size")
+	}
+	if c.Old.Linkname != c.New.Linkname {
+		fields = append(fields, "linkname")
+	}
+	if c.Old.Digest != c.New.Digest && c.Old.Size == c.New.Size {
+		fields = append(fields, "contents")
+	}
+	if c.Old.Devmajor != c.New.Devmajor || c.Old.Devminor != c.New.Devminor {
+		fields = append(fields, "device")
+	}
+	return fields
+}
+
+// DiffTrees returns the set of changes needed to turn oldTree into newTree,
+// sorted by path.
+func DiffTrees(oldTree, newTree FileTree) []FileChange {
+	var changes []FileChange
+	for path, oldInfo := range oldTree {
+		oldInfo := oldInfo
+		newInfo, ok := newTree[path]
+		if !ok {
+			changes = append(changes, FileChange{Path: path, Type: ChangeDeleted, Old: &oldInfo})
+			continue
+		}
+		if oldInfo != newInfo {
+			newInfo := newInfo
+			changes = append(changes, FileChange{Path: path, Type: ChangeModified, Old: &oldInfo, New: &newInfo})
+		}
+	}
+	for path, newInfo := range newTree {
+		newInfo := newInfo
+		if _, ok := oldTree[path]; !ok {
+			changes = append(changes, FileChange{Path: path, Type: ChangeAdded, New: &newInfo})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
@@ -0,0 +1,184 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// diffTestArchive returns a tar archive containing the given headers, with
+// the contents of regular files taken from data.
+func diffTestArchive(t *testing.T, hdrs []tar.Header, data map[string]string) []byte {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		hdr.Size = int64(len(data[hdr.Name]))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return raw.Bytes()
+}
+
+func TestReadTree(t *testing.T) {
+	raw := diffTestArchive(t, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/link", Typeflag: tar.TypeLink, Linkname: "etc/passwd", Mode: 0644},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 100},
+		{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", Mode: 0777},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{Name: "sbin/su", Typeflag: tar.TypeReg, Mode: 04755},
+	}, map[string]string{
+		"etc/passwd": "root:x:0:0::/root:/bin/sh\n",
+	})
+
+	tree, err := ReadTree(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error reading tree: %+v", err)
+	}
+
+	passwd := digest.SHA256.FromString("root:x:0:0::/root:/bin/sh\n")
+	expected := FileTree{
+		"etc":        {Type: "dir", Mode: 0755},
+		"etc/link":   {Type: "hardlink", Mode: 0644, Linkname: "etc/passwd", Size: 26, Digest: passwd},
+		"etc/passwd": {Type: "file", Mode: 0644, UID: 1000, GID: 100, Size: 26, Digest: passwd},
+		"bin":        {Type: "symlink", Mode: 0777, Linkname: "usr/bin"},
+		"dev/null":   {Type: "char", Mode: 0666, Devmajor: 1, Devminor: 3},
+		"sbin/su":    {Type: "file", Mode: 04755, Digest: digest.SHA256.FromString("")},
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("unexpected tree: expected %#v, got %#v", expected, tree)
+	}
+
+	// A hardlink to a missing path is an error.
+	raw = diffTestArchive(t, []tar.Header{
+		{Name: "link", Typeflag: tar.TypeLink, Linkname: "missing"},
+	}, nil)
+	if _, err := ReadTree(bytes.NewReader(raw)); err == nil {
+		t.Errorf("expected an error reading a hardlink to a missing path")
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	old := FileTree{
+		"etc":        {Type: "dir", Mode: 0755},
+		"etc/passwd": {Type: "file", Mode: 0644, Size: 10, Digest: digest.SHA256.FromString("old")},
+		"etc/shadow": {Type: "file", Mode: 0600, Size: 10, Digest: digest.SHA256.FromString("shadow")},
+		"usr/bin/su": {Type: "file", Mode: 0755, Size: 5, Digest: digest.SHA256.FromString("su")},
+		"var/run":    {Type: "dir", Mode: 0755},
+	}
+	newTree := FileTree{
+		"etc":        {Type: "dir", Mode: 0755},
+		"etc/passwd": {Type: "file", Mode: 0644, Size: 10, Digest: digest.SHA256.FromString("new")},
+		"etc/group":  {Type: "file", Mode: 0644, Size: 3, Digest: digest.SHA256.FromString("grp")},
+		"usr/bin/su": {Type: "file", Mode: 04755, UID: 0, GID: 10, Size: 5, Digest: digest.SHA256.FromString("su")},
+		"var/run":    {Type: "symlink", Mode: 0777, Linkname: "../run"},
+	}
+
+	changes := DiffTrees(old, newTree)
+	var (
+		paths  []string
+		types  []ChangeType
+		fields [][]string
+	)
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+		types = append(types, change.Type)
+		fields = append(fields, change.Fields())
+	}
+
+	if expected := []string{"etc/group", "etc/passwd", "etc/shadow", "usr/bin/su", "var/run"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected changed paths: expected %v, got %v", expected, paths)
+	}
+	if expected := []ChangeType{ChangeAdded, ChangeModified, ChangeDeleted, ChangeModified, ChangeModified}; !reflect.DeepEqual(types, expected) {
+		t.Errorf("unexpected change types: expected %v, got %v", expected, types)
+	}
+	if expected := [][]string{nil, {"contents"}, nil, {"mode", "owner"}, {"type", "mode", "linkname"}}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("unexpected changed fields: expected %v, got %v", expected, fields)
+	}
+	if changes[0].Old != nil || changes[0].New == nil || changes[2].Old == nil || changes[2].New != nil {
+		t.Errorf("added and deleted changes should only have the new and old info respectively")
+	}
+
+	if changes := DiffTrees(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes between identical trees, got %v", changes)
+	}
+}
+
+func TestRootfsTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRootfsTree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("umoci\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "etc", "hostname"), filepath.Join(root, "etc", "name")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/hostname", filepath.Join(root, "hostname")); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := RootfsTree(root, &RepackOptions{MapOptions: MapOptions{Rootless: os.Geteuid() != 0}})
+	if err != nil {
+		t.Fatalf("unexpected error reading rootfs tree: %+v", err)
+	}
+
+	var paths []string
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	if len(tree) != 4 {
+		t.Fatalf("expected 4 paths in tree, got %v", paths)
+	}
+	hostname := digest.SHA256.FromString("umoci\n")
+	if info := tree["etc/hostname"]; info.Type != "file" || info.Size != 6 || info.Digest != hostname {
+		t.Errorf("unexpected info for etc/hostname: %#v", info)
+	}
+	if info := tree["etc/name"]; info.Type != "hardlink" || info.Linkname != "etc/hostname" || info.Digest != hostname {
+		t.Errorf("unexpected info for etc/name: %#v", info)
+	}
+	if info := tree["hostname"]; info.Type != "symlink" || info.Linkname != "/etc/hostname" {
+		t.Errorf("unexpected info for hostname: %#v", info)
+	}
+	if info := tree["etc"]; info.Type != "dir" || info.Mode != 0755 {
+		t.Errorf("unexpected info for etc: %#v", info)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+)
+
+// DirlinkPolicy describes how a directory entry in a layer is handled when
+// the path is a symlink in the root filesystem (for instance, when a base
+// image has a merged /usr where /lib is a symlink to /usr/lib, and a later
+// layer contains a /lib directory).
+type DirlinkPolicy string
+
+const (
+	// DirlinkReplace replaces the symlink with the directory.
+	DirlinkReplace DirlinkPolicy = "replace"
+
+	// DirlinkFollow keeps symlinks which resolve to a directory (inside the
+	// root filesystem), and applies the directory entry to the directory the
+	// symlink points to, like rsync's --keep-dirlinks. Other symlinks are
+	// replaced.
+	DirlinkFollow DirlinkPolicy = "follow"
+
+	// DirlinkError causes the unpack to fail if a layer would replace a
+	// symlink with a directory.
+	DirlinkError DirlinkPolicy = "error"
+)
+
+// validate returns an error if the policy is not a known DirlinkPolicy. An
+// empty policy is equivalent to DirlinkReplace.
+func (p DirlinkPolicy) validate() error {
+	switch p {
+	case "", DirlinkReplace, DirlinkFollow, DirlinkError:
+		return nil
+	}
+	return errors.Errorf("unknown dirlink policy: %s", p)
+}
+
+// dirlink applies the dirlink policy to the symlink at path (inside root),
+// which is about to be replaced by the directory described by name (the name
+// of the entry). It returns the path the directory should be extracted to.
+func (te *tarExtractor) dirlink(root, name, path string) (string, error) {
+	switch te.dirlinkPolicy {
+	case DirlinkError:
+		return "", errors.Errorf("layer replaces symlink %s with a directory", name)
+	case DirlinkFollow:
+		target, err := securejoin.SecureJoinVFS(root, name, te.fsEval)
+		if err != nil {
+			return "", errors.Wrap(err, "resolve dirlink")
+		}
+		if fi, err := te.fsEval.Lstat(target); err == nil && fi.IsDir() {
+			log.Debugf("unpack entry: following dirlink %s", name)
+			return target, nil
+		} else if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return "", errors.Wrap(err, "lstat dirlink target")
+		}
+		log.Debugf("unpack entry: replacing dirlink %s which doesn't point to a directory", name)
+	}
+	return path, nil
+}
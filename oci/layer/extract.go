@@ -0,0 +1,134 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ExtractPath extracts the given path (and everything underneath it, if it is
+// a directory) from the root filesystem described by the given manifest to
+// dest, which must not already exist. The rest of the image is not extracted:
+// the layers are read as with FlattenManifest, and only the visible entries
+// inside path are written to disk. If path does not exist in the image, an
+// error satisfying os.IsNotExist is returned.
+//
+// Hardlinks to files outside of path cannot be preserved, and are skipped
+// (with a warning). Symlinks are not followed, so path must not contain any.
+func ExtractPath(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path, dest string, opt *UnpackOptions) error {
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	if err := unpackOptions.DevicePolicy.validate(); err != nil {
+		return errors.Wrap(err, "extract path")
+	}
+	if err := unpackOptions.Strictness.validate(); err != nil {
+		return errors.Wrap(err, "extract path")
+	}
+	if err := unpackOptions.DirlinkPolicy.validate(); err != nil {
+		return errors.Wrap(err, "extract path")
+	}
+
+	// Paths in layers are relative to the root.
+	target := CleanPath(strings.TrimLeft(path, "/"))
+	dest = filepath.Clean(dest)
+	if _, err := os.Lstat(dest); err == nil {
+		return errors.Errorf("extract path: destination already exists: %s", dest)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "extract path: lstat destination")
+	}
+
+	// rebase returns the name of the given entry relative to the parent of
+	// dest (which is the root we extract into), and whether it is inside the
+	// target at all.
+	root, base := filepath.Dir(dest), filepath.Base(dest)
+	rebase := func(name string) (string, bool) {
+		name = CleanPath(name)
+		switch {
+		case target == ".":
+			return filepath.Join(base, name), true
+		case name == target:
+			return base, true
+		case strings.HasPrefix(name, target+"/"):
+			return filepath.Join(base, strings.TrimPrefix(name, target+"/")), true
+		}
+		return "", false
+	}
+
+	te := newTarExtractor(unpackOptions)
+	defer te.close()
+	if err := te.confine(root); err != nil {
+		return errors.Wrap(err, "extract path")
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(FlattenManifest(ctx, engine, writer, manifest, &FlattenOptions{
+			XattrFilter: unpackOptions.XattrFilter,
+		}))
+	}()
+	defer reader.Close()
+
+	found := false
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read flattened image")
+		}
+		name, ok := rebase(hdr.Name)
+		if !ok {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			linkname, ok := rebase(hdr.Linkname)
+			if !ok {
+				log.Warnf("extract path: skipping hardlink to %s outside of %s: %s", hdr.Linkname, path, hdr.Name)
+				continue
+			}
+			hdr.Linkname = linkname
+		}
+		hdr.Name = name
+		found = true
+
+		if err := readPAXXattrs(hdr); err != nil {
+			return errors.Wrapf(err, "read xattrs: %s", hdr.Name)
+		}
+		if err := te.unpackEntry(root, hdr, tr); err != nil {
+			return errors.Wrapf(err, "extract entry: %s", hdr.Name)
+		}
+	}
+	if !found {
+		return &os.PathError{Op: "extract", Path: path, Err: os.ErrNotExist}
+	}
+	return nil
+}
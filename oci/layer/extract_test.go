@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestExtractPath(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestExtractPath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "old passwd"},
+			{"etc/group", tar.TypeReg, 0644, "group"},
+			{"etc/removed", tar.TypeReg, 0644, "removed"},
+			{"etc/sub/", tar.TypeDir, 0755, ""},
+			{"etc/sub/file", tar.TypeReg, 0600, "sub file"},
+			{"usr/", tar.TypeDir, 0755, ""},
+			{"usr/bin", tar.TypeReg, 0755, "not extracted"},
+		},
+		{
+			{"etc/", tar.TypeDir, 0700, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "new passwd"},
+			{"etc/.wh.removed", tar.TypeReg, 0644, ""},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+	opt := &UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+	}
+
+	// Extract a directory.
+	etc := filepath.Join(root, "etc-copy")
+	if err := ExtractPath(ctx, engine, manifest, "/etc", etc, opt); err != nil {
+		t.Fatalf("unexpected error extracting /etc: %+v", err)
+	}
+	for path, contents := range map[string]string{
+		"passwd":   "new passwd",
+		"group":    "group",
+		"sub/file": "sub file",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(etc, path))
+		if err != nil {
+			t.Errorf("unexpected error reading extracted %s: %v", path, err)
+			continue
+		}
+		if string(data) != contents {
+			t.Errorf("unexpected contents of extracted %s: got %q expected %q", path, data, contents)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(etc, "removed")); !os.IsNotExist(err) {
+		t.Errorf("expected whiteout path to not be extracted, got %v", err)
+	}
+	if fi, err := os.Stat(etc); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf("unexpected mode of extracted directory: got %o expected %o", fi.Mode().Perm(), 0700)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "usr")); !os.IsNotExist(err) {
+		t.Errorf("expected paths outside of /etc to not be extracted, got %v", err)
+	}
+
+	// Extract a single file.
+	passwd := filepath.Join(root, "passwd-copy")
+	if err := ExtractPath(ctx, engine, manifest, "etc/passwd", passwd, opt); err != nil {
+		t.Fatalf("unexpected error extracting /etc/passwd: %+v", err)
+	}
+	if data, err := ioutil.ReadFile(passwd); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "new passwd" {
+		t.Errorf("unexpected contents of extracted file: got %q expected %q", data, "new passwd")
+	}
+
+	// The destination must not exist.
+	if err := ExtractPath(ctx, engine, manifest, "/etc/group", passwd, opt); err == nil {
+		t.Errorf("expected an error extracting to an existing path")
+	}
+
+	for _, path := range []string{"/etc/removed", "/nonexistent"} {
+		if err := ExtractPath(ctx, engine, manifest, path, filepath.Join(root, "missing"), opt); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist, got %v", path, err)
+		}
+	}
+}
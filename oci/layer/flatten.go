@@ -0,0 +1,391 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// FlattenOptions describes the behaviour of FlattenManifest.
+type FlattenOptions struct {
+	// XattrFilter decides which xattrs in the layers are included in the
+	// flattened archive. If nil, xattrfilter.Default() is used.
+	XattrFilter *xattrfilter.Filter
+
+	// NoVerify specifies that a mismatch between the digest of an
+	// uncompressed layer and its DiffID in the image configuration should
+	// only result in a warning, rather than an error.
+	NoVerify bool
+}
+
+// flattenEntry identifies an entry in one of the layers being flattened.
+type flattenEntry struct {
+	// layer is the index of the layer containing the entry.
+	layer int
+
+	// index is the index of the entry within the layer.
+	index int
+
+	// isDir is whether the entry is a directory.
+	isDir bool
+}
+
+// flattenIndex tracks which layer entries are visible in the flattened root
+// filesystem, keyed by their cleaned path.
+type flattenIndex map[string]flattenEntry
+
+// remove removes path and everything underneath it from the index. If
+// keepLayer is not negative, entries from that layer are kept (this is used
+// for opaque whiteouts, which only hide entries from lower layers).
+func (fi flattenIndex) remove(path string, self bool, keepLayer int) {
+	if self {
+		delete(fi, path)
+	}
+	prefix := path + "/"
+	if path == "." {
+		prefix = ""
+	}
+	for entryPath, entry := range fi {
+		if entryPath != "." && strings.HasPrefix(entryPath, prefix) && entry.layer != keepLayer {
+			delete(fi, entryPath)
+		}
+	}
+}
+
+// add applies the entry with the given header to the index, with the same
+// semantics as UnpackLayer.
+func (fi flattenIndex) add(hdr *tar.Header, entry flattenEntry) {
+	path := CleanPath(hdr.Name)
+	dir, file := filepath.Split(path)
+	dir = filepath.Clean(dir)
+
+	if strings.HasPrefix(file, whPrefix) {
+		// An opaque whiteout hides everything in the directory from lower
+		// layers.
+		if file == whOpaque {
+			fi.remove(dir, false, entry.layer)
+			return
+		}
+		fi.remove(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), true, -1)
+		return
+	}
+
+	// Unless an existing directory is being updated, an entry replaces the
+	// path and everything underneath it.
+	if old, ok := fi[path]; !ok || !old.isDir || !entry.isDir {
+		fi.remove(path, true, -1)
+	}
+	fi[path] = entry
+}
+
+// squashWhiteouts tracks the whiteouts a squashed layer needs in order to
+// have the same effect on the layers below it as the layers it replaces.
+type squashWhiteouts struct {
+	// removed are the paths whose lower-layer contents were removed, either
+	// by a whiteout or by being replaced with a non-directory.
+	removed map[string]bool
+
+	// opaque are the directories whose lower-layer contents were hidden.
+	opaque map[string]bool
+}
+
+// forget removes any whiteouts underneath path (and for path itself if self
+// is set), because they are superseded by a whiteout of path.
+func (sw squashWhiteouts) forget(path string, self bool) {
+	prefix := path + "/"
+	if path == "." {
+		prefix = ""
+	}
+	for _, set := range []map[string]bool{sw.removed, sw.opaque} {
+		for whPath := range set {
+			if (self && whPath == path) || strings.HasPrefix(whPath, prefix) {
+				delete(set, whPath)
+			}
+		}
+	}
+}
+
+// add updates the whiteouts for the entry with the given header, which has
+// already been applied to the flattenIndex.
+func (sw squashWhiteouts) add(hdr *tar.Header) {
+	path := CleanPath(hdr.Name)
+	dir, file := filepath.Split(path)
+	dir = filepath.Clean(dir)
+
+	if strings.HasPrefix(file, whPrefix) {
+		if file == whOpaque {
+			sw.forget(dir, false)
+			sw.opaque[dir] = true
+			return
+		}
+		path = filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+		sw.forget(path, true)
+		sw.removed[path] = true
+		return
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		sw.forget(path, true)
+		sw.removed[path] = true
+	} else if sw.removed[path] {
+		// A directory created in place of a removed path must not be merged
+		// with the lower-layer directory.
+		delete(sw.removed, path)
+		sw.opaque[path] = true
+	}
+}
+
+// write writes the whiteout entries to the archive. Whiteouts for paths
+// which are replaced by a visible entry are not needed.
+func (sw squashWhiteouts) write(tw *tar.Writer, index flattenIndex) error {
+	var whiteouts []string
+	for path := range sw.removed {
+		if _, ok := index[path]; !ok && path != "." {
+			dir, file := filepath.Split(path)
+			whiteouts = append(whiteouts, filepath.Join(dir, whPrefix+file))
+		}
+	}
+	for dir := range sw.opaque {
+		whiteouts = append(whiteouts, filepath.Join(dir, whOpaque))
+	}
+	sort.Strings(whiteouts)
+
+	// The timestamp of a whiteout is meaningless, so make sure it doesn't
+	// depend on when the layer was squashed.
+	timestamp := time.Unix(0, 0)
+	for _, whiteout := range whiteouts {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:       whiteout,
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			ModTime:    timestamp,
+			AccessTime: timestamp,
+			ChangeTime: timestamp,
+		}); err != nil {
+			return errors.Wrap(err, "write whiteout header")
+		}
+	}
+	return nil
+}
+
+// FlattenManifest writes the root filesystem described by the given manifest
+// to w as a single (uncompressed) tar archive, with all of the layers applied
+// and their whiteouts removed. Nothing is written to disk: the layers are read
+// twice, first to compute which entries are visible in the final root
+// filesystem, and then to copy those entries into the archive in layer order.
+//
+// The ownership of entries is left as-is (no mappings are applied). Note that
+// hardlinks are copied verbatim, so a hardlink to a path which was replaced
+// by a later layer will refer to the replacement.
+func FlattenManifest(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest, opt *FlattenOptions) error {
+	return flattenLayers(ctx, engine, w, manifest, 0, len(manifest.Layers)-1, false, opt)
+}
+
+// SquashLayers writes a single (uncompressed) layer to w which is equivalent
+// to the layers first through last (inclusive, counting from zero) of the
+// given manifest, such that replacing those layers with the squashed layer
+// does not change the root filesystem of the image. This works in the same
+// way as FlattenManifest, except that whiteouts which affect the layers below
+// first are kept (or generated, for paths replaced by a non-directory and then
+// re-created as a directory), and are written before the other entries.
+func SquashLayers(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest, first, last int, opt *FlattenOptions) error {
+	if first < 0 || last >= len(manifest.Layers) || first > last {
+		return errors.Errorf("squash layers: invalid layer range %d..%d (image has %d layers)", first, last, len(manifest.Layers))
+	}
+	return flattenLayers(ctx, engine, w, manifest, first, last, true, opt)
+}
+
+// flattenLayers implements FlattenManifest and SquashLayers, for the layers
+// first through last of the manifest. If squash is set, the whiteouts needed
+// to apply the result on top of the lower layers are included.
+func flattenLayers(ctx context.Context, engine cas.Engine, w io.Writer, manifest ispec.Manifest, first, last int, squash bool, opt *FlattenOptions) error {
+	engineExt := casext.NewEngine(engine)
+
+	var flattenOptions FlattenOptions
+	if opt != nil {
+		flattenOptions = *opt
+	}
+	xattrFilter := xattrFilterOrDefault(flattenOptions.XattrFilter)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	if configBlob.MediaType != ispec.MediaTypeImageConfig {
+		return errors.Errorf("flatten manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.MediaType)
+	}
+	if config.RootFS.Type != "layers" {
+		return errors.Errorf("flatten manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("flatten manifest: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	// forEachEntry calls fn for every (non-metadata) entry in the given
+	// layer, along with the index of the entry.
+	forEachEntry := func(idx int, fn func(hdr *tar.Header, entryIdx int, r io.Reader) error) error {
+		layerDescriptor := manifest.Layers[idx]
+		layerDiffID := config.RootFS.DiffIDs[idx]
+		return readLayerBlob(ctx, engineExt, layerDescriptor, layerDiffID, "", flattenOptions.NoVerify, func(layer io.Reader) error {
+			tr := tar.NewReader(layer)
+			for entryIdx := 0; ; entryIdx++ {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+				if estargz.IsMetadataEntry(hdr.Name) {
+					continue
+				}
+				if err := fn(hdr, entryIdx, tr); err != nil {
+					return errors.Wrapf(err, "flatten entry: %s", hdr.Name)
+				}
+			}
+		})
+	}
+
+	// Figure out which entries are visible (and which whiteouts are needed).
+	index := flattenIndex{}
+	whiteouts := squashWhiteouts{
+		removed: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+	layers := manifest.Layers[:last+1]
+	for idx := first; idx < len(layers); idx++ {
+		log.Infof("flatten: indexing layer %s", layers[idx].Digest)
+		if err := forEachEntry(idx, func(hdr *tar.Header, entryIdx int, _ io.Reader) error {
+			index.add(hdr, flattenEntry{
+				layer: idx,
+				index: entryIdx,
+				isDir: hdr.Typeflag == tar.TypeDir,
+			})
+			if squash {
+				whiteouts.add(hdr)
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "index layer")
+		}
+	}
+	visible := map[flattenEntry]bool{}
+	for _, entry := range index {
+		visible[entry] = true
+	}
+
+	// Copy the visible entries.
+	tw := tar.NewWriter(w)
+	if squash {
+		if err := whiteouts.write(tw, index); err != nil {
+			return err
+		}
+	}
+	for idx := first; idx < len(layers); idx++ {
+		log.Infof("flatten: copying layer %s", layers[idx].Digest)
+		if err := forEachEntry(idx, func(hdr *tar.Header, entryIdx int, r io.Reader) error {
+			entry := flattenEntry{
+				layer: idx,
+				index: entryIdx,
+				isDir: hdr.Typeflag == tar.TypeDir,
+			}
+			if !visible[entry] {
+				return nil
+			}
+			if err := flattenHeader(hdr, xattrFilter); err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrap(err, "write header")
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, r); err != nil {
+					return errors.Wrap(err, "copy entry")
+				}
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "copy layer")
+		}
+	}
+	return errors.Wrap(tw.Close(), "close flattened archive")
+}
+
+// flattenHeader cleans up a header read from a layer so that it can be
+// written to the flattened archive.
+func flattenHeader(hdr *tar.Header, xattrFilter xattrfilter.Filter) error {
+	if err := readPAXXattrs(hdr); err != nil {
+		return errors.Wrap(err, "read xattrs")
+	}
+	// Sparse files are expanded by tar.Reader, so they are copied as regular
+	// files.
+	if isSparseHeader(hdr) {
+		hdr.Typeflag = tar.TypeReg
+	}
+	// The xattrs are written from hdr.Xattrs, so any xattr records must not
+	// be copied (otherwise the filter would be bypassed), and the sparse
+	// records no longer apply.
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") || strings.HasPrefix(key, paxLibarchiveXattr) || strings.HasPrefix(key, "GNU.sparse.") {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+	for name := range hdr.Xattrs {
+		if !xattrFilter.Allowed(name) {
+			log.Debugf("flatten: skipping filtered xattr %s: %s", name, hdr.Name)
+			delete(hdr.Xattrs, name)
+		}
+	}
+
+	name := CleanPath(hdr.Name)
+	if hdr.Typeflag == tar.TypeDir && name != "." {
+		name += "/"
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = CleanPath(hdr.Linkname)
+	}
+
+	// Let the writer pick the format, unless we need PAX to keep sub-second
+	// timestamps.
+	hdr.Format = tar.FormatUnknown
+	if hdr.ModTime.Nanosecond() != 0 {
+		hdr.Format = tar.FormatPAX
+	}
+	return nil
+}
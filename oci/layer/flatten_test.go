@@ -0,0 +1,344 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// flattenTestEntry is an entry in a layer used by TestFlattenManifest.
+type flattenTestEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	data     string
+}
+
+// flattenTestArchive returns an uncompressed layer containing the given
+// entries.
+func flattenTestArchive(t *testing.T, entries []flattenTestEntry) []byte {
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     entry.mode,
+			Size:     int64(len(entry.data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return raw.Bytes()
+}
+
+// putFlattenTestLayer stores a gzip-compressed layer containing the given
+// entries, returning its descriptor and DiffID.
+func putFlattenTestLayer(t *testing.T, ctx context.Context, engineExt casext.Engine, entries []flattenTestEntry) (ispec.Descriptor, digest.Digest) {
+	raw := flattenTestArchive(t, entries)
+	diffID := digest.SHA256.FromBytes(raw)
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}, diffID
+}
+
+func TestFlattenManifest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFlattenManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"a/", tar.TypeDir, 0755, ""},
+			{"a/file", tar.TypeReg, 0644, "file"},
+			{"a/removed", tar.TypeReg, 0644, "removed"},
+			{"b/", tar.TypeDir, 0755, ""},
+			{"b/old", tar.TypeReg, 0644, "old"},
+			{"c", tar.TypeReg, 0644, "old c"},
+			{"d/", tar.TypeDir, 0755, ""},
+			{"d/file", tar.TypeReg, 0644, "replaced"},
+		},
+		{
+			{"a/", tar.TypeDir, 0700, ""},
+			{"a/.wh.removed", tar.TypeReg, 0644, ""},
+			{"b/.wh..wh..opq", tar.TypeReg, 0644, ""},
+			{"b/new", tar.TypeReg, 0644, "new"},
+			{"c", tar.TypeReg, 0644, "new c"},
+			{"d", tar.TypeSymlink, 0777, ""},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	var buf bytes.Buffer
+	if err := FlattenManifest(ctx, engineExt, &buf, manifest, nil); err != nil {
+		t.Fatalf("unexpected error in FlattenManifest: %+v", err)
+	}
+
+	var got []flattenTestEntry
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, flattenTestEntry{hdr.Name, hdr.Typeflag, hdr.Mode, string(data)})
+	}
+
+	// Entries are in layer order, and only the visible entries are included.
+	expected := []flattenTestEntry{
+		{"a/file", tar.TypeReg, 0644, "file"},
+		{"b/", tar.TypeDir, 0755, ""},
+		{"a/", tar.TypeDir, 0700, ""},
+		{"b/new", tar.TypeReg, 0644, "new"},
+		{"c", tar.TypeReg, 0644, "new c"},
+		{"d", tar.TypeSymlink, 0777, ""},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected flattened archive:\n got: %v\n expected: %v", got, expected)
+	}
+
+	// Layers must still be verified.
+	manifest.Layers = []ispec.Descriptor{layerDescriptors[1], layerDescriptors[0]}
+	if err := FlattenManifest(ctx, engineExt, ioutil.Discard, manifest, nil); err == nil {
+		t.Errorf("expected an error flattening layers which don't match their diff_ids")
+	}
+}
+
+func TestSquashLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSquashLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	layers := [][]flattenTestEntry{
+		// The base layer, which is not squashed.
+		{
+			{"a/", tar.TypeDir, 0755, ""},
+			{"a/old", tar.TypeReg, 0644, "old"},
+			{"b/", tar.TypeDir, 0755, ""},
+			{"b/old", tar.TypeReg, 0644, "old"},
+			{"c/", tar.TypeDir, 0755, ""},
+			{"c/old", tar.TypeReg, 0644, "old"},
+			{"e", tar.TypeReg, 0644, "file e"},
+			{"f/", tar.TypeDir, 0755, ""},
+			{"f/old", tar.TypeReg, 0644, "old"},
+		},
+		// The squashed layers.
+		{
+			{".wh.a", tar.TypeReg, 0644, ""},
+			{"b/.wh..wh..opq", tar.TypeReg, 0644, ""},
+			{"b/new", tar.TypeReg, 0644, "new"},
+			{"c/.wh.old", tar.TypeReg, 0644, ""},
+			{"e/", tar.TypeDir, 0700, ""},
+			{"e/new", tar.TypeReg, 0644, "new"},
+			{"f", tar.TypeReg, 0644, "file f"},
+			{"g/", tar.TypeDir, 0755, ""},
+			{"g/tmp", tar.TypeReg, 0644, "tmp"},
+		},
+		{
+			{"a/", tar.TypeDir, 0750, ""},
+			{"a/new", tar.TypeReg, 0644, "new"},
+			{"f/", tar.TypeDir, 0755, ""},
+			{"f/new", tar.TypeReg, 0644, "new"},
+			{"g/.wh.tmp", tar.TypeReg, 0644, ""},
+		},
+		// A layer above the squashed layers.
+		{
+			{"b/top", tar.TypeReg, 0644, "top"},
+		},
+	}
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range layers {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	var squashed bytes.Buffer
+	if err := SquashLayers(ctx, engineExt, &squashed, manifest, 1, 2, nil); err != nil {
+		t.Fatalf("unexpected error in SquashLayers: %+v", err)
+	}
+
+	// Applying the squashed layer in place of the layers it replaces must
+	// result in the same root filesystem.
+	opt := &UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+	}
+	original := filepath.Join(root, "original")
+	for _, entries := range layers {
+		if err := UnpackLayer(original, bytes.NewReader(flattenTestArchive(t, entries)), opt); err != nil {
+			t.Fatalf("unexpected error unpacking original layer: %+v", err)
+		}
+	}
+	result := filepath.Join(root, "squashed")
+	for _, layer := range [][]byte{
+		flattenTestArchive(t, layers[0]),
+		squashed.Bytes(),
+		flattenTestArchive(t, layers[3]),
+	} {
+		if err := UnpackLayer(result, bytes.NewReader(layer), opt); err != nil {
+			t.Fatalf("unexpected error unpacking squashed layer: %+v", err)
+		}
+	}
+
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest"}
+	originalDh, err := mtree.Walk(original, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Check(result, originalDh, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("squashed layer results in a different rootfs: %v", diffs)
+	}
+	for _, path := range []string{"a/old", "b/old", "c/old", "f/old", "g/tmp"} {
+		if _, err := os.Lstat(filepath.Join(result, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist: %v", path, err)
+		}
+	}
+
+	// Invalid ranges are rejected.
+	for _, bounds := range [][2]int{{-1, 1}, {2, 1}, {0, 4}} {
+		if err := SquashLayers(ctx, engineExt, ioutil.Discard, manifest, bounds[0], bounds[1], nil); err == nil {
+			t.Errorf("expected an error squashing layers %d..%d", bounds[0], bounds[1])
+		}
+	}
+}
@@ -19,12 +19,15 @@ package layer
 
 import (
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
 )
 
 // NOTE: This currently requires a version of go-mtree which has my Compare()
@@ -40,15 +43,94 @@ func (ids inodeDeltas) Len() int           { return len(ids) }
 func (ids inodeDeltas) Less(i, j int) bool { return ids[i].Path() < ids[j].Path() }
 func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 
+// opaqueDirs returns the set of directories (relative to path) whose contents
+// have been entirely replaced -- at least one of their children is missing and
+// every path currently inside them is new. Such directories can be represented
+// by a single opaque whiteout rather than a whiteout for every removed path.
+func opaqueDirs(path string, deltas []mtree.InodeDelta, fsEval fseval.FsEval) (map[string]bool, error) {
+	var (
+		extra   = map[string]bool{}
+		missing = map[string]bool{}
+		parents = map[string]bool{}
+	)
+	for _, delta := range deltas {
+		name := filepath.Clean(delta.Path())
+		switch delta.Type() {
+		case mtree.Extra:
+			extra[name] = true
+		case mtree.Missing:
+			missing[name] = true
+			parents[filepath.Dir(name)] = true
+		}
+	}
+
+	opaque := map[string]bool{}
+	for dir := range parents {
+		// We don't generate opaque whiteouts for the root, nor for directories
+		// which were removed entirely (they just get a regular whiteout).
+		if dir == "." || missing[dir] {
+			continue
+		}
+		fi, err := fsEval.Lstat(filepath.Join(path, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "lstat whiteout parent")
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		children, err := fsEval.Readdir(filepath.Join(path, dir))
+		if err != nil {
+			return nil, errors.Wrap(err, "readdir whiteout parent")
+		}
+		replaced := true
+		for _, child := range children {
+			if !extra[filepath.Join(dir, child.Name())] {
+				replaced = false
+				break
+			}
+		}
+		if replaced {
+			opaque[dir] = true
+		}
+	}
+	return opaque, nil
+}
+
+// underOpaqueDir returns whether any of the parent directories of name is in
+// the given set of opaque directories.
+func underOpaqueDir(name string, opaque map[string]bool) bool {
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if opaque[dir] {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateLayer creates a new OCI diff layer based on the mtree diff provided.
 // All of the mtree.Modified and mtree.Extra blobs are read relative to the
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
-// to gzip it.
-func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
-	var mapOptions MapOptions
+// to gzip it. If the entire contents of a directory have been replaced (or
+// removed), a single opaque whiteout is generated for the directory rather
+// than a whiteout for each removed path.
+func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
 	if opt != nil {
-		mapOptions = *opt
+		repackOptions = *opt
+	}
+	if err := repackOptions.SocketPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err := repackOptions.SetuidPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err := repackOptions.MetadataOnly.validate(); err != nil {
+		return nil, err
 	}
 
 	reader, writer := io.Pipe()
@@ -62,7 +144,7 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		// We can't just dump all of the file contents into a tar file. We need
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
-		tg := newTarGenerator(writer, mapOptions)
+		tg := newTarGenerator(writer, repackOptions)
 
 		// Sort the delta paths.
 		// FIXME: We need to add whiteouts first, otherwise we might end up
@@ -70,20 +152,61 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
 
+		opaque, err := opaqueDirs(path, deltas, tg.fsEval)
+		if err != nil {
+			return errors.Wrap(err, "find opaque directories")
+		}
+		// addOpaque adds the opaque whiteout for dir (if it is opaque and we
+		// haven't already done so). The whiteout is placed directly after the
+		// directory's own entry, before any of the new contents.
+		addedOpaque := map[string]bool{}
+		addOpaque := func(dir string) error {
+			if !opaque[dir] || addedOpaque[dir] {
+				return nil
+			}
+			addedOpaque[dir] = true
+			if err := tg.AddOpaqueWhiteout(dir); err != nil {
+				log.Warnf("generate layer: could not add opaque whiteout '%s': %s", dir, err)
+				return errors.Wrap(err, "generate opaque whiteout layer file")
+			}
+			return nil
+		}
+
 		for _, delta := range deltas {
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
+			// If the directory itself wasn't changed, we still need to add its
+			// opaque whiteout before its contents.
+			if err := addOpaque(filepath.Dir(filepath.Clean(name))); err != nil {
+				return err
+			}
+			// Any removed paths inside an opaque directory are already covered
+			// by its opaque whiteout.
+			if delta.Type() == mtree.Missing && underOpaqueDir(filepath.Clean(name), opaque) {
+				continue
+			}
+
 			// XXX: It's possible that if we unlink a hardlink, we're going to
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
 
 			switch delta.Type() {
 			case mtree.Modified, mtree.Extra:
+				skip, err := tg.skipMetadataOnly(delta, fullPath)
+				if err != nil {
+					return errors.Wrap(err, "generate layer file")
+				}
+				if skip {
+					continue
+				}
 				if err := tg.AddFile(name, fullPath); err != nil {
 					log.Warnf("generate layer: could not add file '%s': %s", name, err)
 					return errors.Wrap(err, "generate layer file")
 				}
+				if err := addOpaque(filepath.Clean(name)); err != nil {
+					return err
+				}
 			case mtree.Missing:
 				if err := tg.AddWhiteout(name); err != nil {
 					log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
@@ -102,3 +225,103 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 
 	return reader, nil
 }
+
+// DiffRootfs computes the set of deltas (as passed to GenerateLayer) needed to
+// turn the root filesystem at oldPath into the one at newPath, comparing the
+// given mtree keywords. The deltas are relative to newPath, so the resulting
+// layer must be generated from newPath. Both root filesystems must have been
+// unpacked with the same MapOptions.
+func DiffRootfs(oldPath, newPath string, keywords []mtree.Keyword, opt *MapOptions) ([]mtree.InodeDelta, error) {
+	fsEval := fseval.DefaultFsEval
+	if opt != nil && opt.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	dh, err := mtree.Walk(oldPath, nil, keywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk old rootfs")
+	}
+	deltas, err := mtree.Check(newPath, dh, keywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "check new rootfs")
+	}
+	return deltas, nil
+}
+
+// SplitDeltas splits the set of deltas (as passed to GenerateLayer) into
+// groups, such that the contents of the files added by each group are roughly
+// targetSize bytes in total. Deltas are only split at file boundaries, so a
+// single file larger than targetSize will result in a larger group. The
+// deltas are sorted by path, and whiteouts are always placed in the first
+// group. Every path linked to the same inode is placed in the group of the
+// first such path, so that hardlinks are preserved. Each group can be passed
+// to GenerateLayer to produce a set of layers which (when applied in order)
+// are equivalent to a single layer. If targetSize is not positive, a single
+// group is returned.
+func SplitDeltas(path string, deltas []mtree.InodeDelta, targetSize int64, opt *MapOptions) ([][]mtree.InodeDelta, error) {
+	fsEval := fseval.DefaultFsEval
+	if opt != nil && opt.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	sorted := append(inodeDeltas{}, deltas...)
+	sort.Sort(sorted)
+	if targetSize <= 0 {
+		return [][]mtree.InodeDelta{sorted}, nil
+	}
+
+	var (
+		groups    [][]mtree.InodeDelta
+		whiteouts []mtree.InodeDelta
+		current   []mtree.InodeDelta
+		size      int64
+		// The index of the group containing each hardlinked inode.
+		linkGroups = map[inodeKey]int{}
+	)
+	for _, delta := range sorted {
+		if delta.Type() == mtree.Missing {
+			whiteouts = append(whiteouts, delta)
+			continue
+		}
+
+		statx, err := fsEval.Lstatx(filepath.Join(path, delta.Path()))
+		if err != nil {
+			return nil, errors.Wrap(err, "lstat delta path")
+		}
+		// Hardlinks can only be generated within a single layer, so extra
+		// links are added to the group of the first link (which doesn't
+		// affect the sort order of that group).
+		var key inodeKey
+		linked := statx.Mode&unix.S_IFMT != unix.S_IFDIR && statx.Nlink > 1
+		if linked {
+			key = inodeKey{dev: uint64(statx.Dev), ino: uint64(statx.Ino)}
+			if idx, ok := linkGroups[key]; ok {
+				if idx < len(groups) {
+					groups[idx] = append(groups[idx], delta)
+				} else {
+					current = append(current, delta)
+				}
+				continue
+			}
+		}
+		var fileSize int64
+		if statx.Mode&unix.S_IFMT == unix.S_IFREG {
+			fileSize = statx.Size
+		}
+
+		if len(current) > 0 && size+fileSize > targetSize {
+			groups = append(groups, current)
+			current, size = nil, 0
+		}
+		current = append(current, delta)
+		size += fileSize
+		if linked {
+			linkGroups[key] = len(groups)
+		}
+	}
+	if len(current) > 0 || len(groups) == 0 {
+		groups = append(groups, current)
+	}
+	groups[0] = append(whiteouts, groups[0]...)
+	return groups, nil
+}
@@ -24,7 +24,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/vbatts/go-mtree"
 )
@@ -74,7 +76,7 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,6 +138,95 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+// TestGenerateOpaqueWhiteout checks that a directory whose contents have been
+// entirely replaced results in an opaque whiteout rather than a whiteout for
+// each removed path.
+func TestGenerateOpaqueWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOpaqueWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a directory to be replaced and one which is only partly changed.
+	for _, path := range []string{
+		"replaced/old1",
+		"replaced/old2",
+		"replaced/olddir/old3",
+		"partial/kept",
+		"partial/deleted",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the contents of "replaced", and delete one file in "partial".
+	if err := os.RemoveAll(filepath.Join(dir, "replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "replaced", "newdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "replaced", "newdir", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "partial", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The root directory is modified too, which we don't care about.
+		if hdr.Name != "." {
+			names = append(names, hdr.Name)
+		}
+	}
+
+	expected := []string{
+		"partial/",
+		"partial/.wh.deleted",
+		"replaced/",
+		"replaced/" + whOpaque,
+		"replaced/newdir/",
+		"replaced/newdir/new",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: got %v, expected %v", names, expected)
+	}
+}
+
 // Make sure that openSUSE/umoci#33 doesn't regress.
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
@@ -188,7 +279,7 @@ func TestGenerateMissingFileError(t *testing.T) {
 	}
 
 	// Generate a layer where the changed file is missing after the diff.
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,7 +344,7 @@ func TestGenerateWrongRootError(t *testing.T) {
 	}
 
 	// Generate a layer with the wrong root directory.
-	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &MapOptions{})
+	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &RepackOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -270,3 +361,450 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+// TestGenerateReproducible checks that generating a layer from the same diff
+// with RepackOptions.Reproducible and RepackOptions.ClampTime set results in
+// an identical layer.
+func TestGenerateReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "some", "new"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "some", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clampTime := time.Unix(1234, 0)
+	var layers [][]byte
+	for i := 0; i < 2; i++ {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+			Reproducible: true,
+			ClampTime:    &clampTime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %s", err)
+		}
+		layers = append(layers, layer)
+
+		// Make sure the time of generation can't affect the output.
+		time.Sleep(1100 * time.Millisecond)
+	}
+	if !bytes.Equal(layers[0], layers[1]) {
+		t.Errorf("generated layers are not identical")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(layers[0]))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.ModTime.After(clampTime) {
+			t.Errorf("%s: mtime was not clamped: %s", hdr.Name, hdr.ModTime)
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s: uname and gname were not cleared: %q %q", hdr.Name, hdr.Uname, hdr.Gname)
+		}
+	}
+}
+
+func TestGenerateRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateRewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]string{
+		"config":  "password=hunter2\n",
+		"script":  "#!/bin/sh\r\necho hello\r\n",
+		"regular": "unmodified",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+		Rewrite: func(hdr *tar.Header, path string) (io.ReadCloser, error) {
+			switch hdr.Name {
+			case "config":
+				// Redact the contents entirely.
+				hdr.Size = 0
+				return ioutil.NopCloser(bytes.NewReader(nil)), nil
+			case "script":
+				// Normalise line endings.
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, err
+				}
+				data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+				hdr.Size = int64(len(data))
+				hdr.Mode = 0755
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Name == "script" && hdr.Mode != 0755 {
+			t.Errorf("script: mode was not rewritten: %o", hdr.Mode)
+		}
+		got[hdr.Name] = string(data)
+	}
+	expected := map[string]string{
+		"config":  "",
+		"script":  "#!/bin/sh\necho hello\n",
+		"regular": "unmodified",
+	}
+	for name, data := range expected {
+		if got[name] != data {
+			t.Errorf("%s: unexpected contents: expected %q, got %q", name, data, got[name])
+		}
+	}
+
+	// Errors from the hook (and inconsistent sizes) cause generation to fail.
+	for _, rewrite := range []RewriteFunc{
+		func(hdr *tar.Header, path string) (io.ReadCloser, error) {
+			return nil, io.ErrUnexpectedEOF
+		},
+		func(hdr *tar.Header, path string) (io.ReadCloser, error) {
+			if hdr.Typeflag != tar.TypeReg {
+				return nil, nil
+			}
+			// hdr.Size is not updated to match the new contents.
+			return ioutil.NopCloser(bytes.NewReader([]byte("short"))), nil
+		},
+	} {
+		reader, err := GenerateLayer(dir, diffs, &RepackOptions{Rewrite: rewrite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, reader)
+		reader.Close()
+		if err == nil {
+			t.Errorf("expected an error from a failing rewrite hook")
+		}
+	}
+}
+
+func TestGenerateMetadataOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateMetadataOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, size := range map[string]int{
+		"big":     64 * 1024,
+		"small":   16,
+		"changed": 64 * 1024,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		keywords []mtree.Keyword
+		policy   MetadataOnlyPolicy
+		expected []string
+	}{
+		{"Include", append(mtree.DefaultKeywords, "sha256digest"), MetadataOnlyInclude, []string{"big", "changed", "small"}},
+		{"Warn", append(mtree.DefaultKeywords, "sha256digest"), MetadataOnlyWarn, []string{"big", "changed", "small"}},
+		{"Skip", append(mtree.DefaultKeywords, "sha256digest"), MetadataOnlySkip, []string{"changed", "small"}},
+		// Without a digest the contents might have changed.
+		{"SkipNoDigest", mtree.DefaultKeywords, MetadataOnlySkip, []string{"big", "changed", "small"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"big", "small", "changed"} {
+				if err := os.Chmod(filepath.Join(dir, name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			initDh, err := mtree.Walk(dir, nil, test.keywords, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the metadata of big and small changes.
+			for _, name := range []string{"big", "small", "changed"} {
+				if err := os.Chmod(filepath.Join(dir, name), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "changed"), bytes.Repeat([]byte("y"), 64*1024), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, err := GenerateLayer(dir, diffs, &RepackOptions{
+				MetadataOnly:        test.policy,
+				MetadataOnlyMinSize: 1024,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			var got []string
+			tr := tar.NewReader(reader)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("reading tar archive: %s", err)
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					got = append(got, hdr.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("unexpected layer entries: expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := GenerateLayer(dir, nil, &RepackOptions{MetadataOnly: "invalid"}); err == nil {
+		t.Errorf("expected an error with an invalid policy")
+	}
+}
+
+func TestSplitDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestSplitDeltas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "deleted"), []byte("deleted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		targetSize int64
+		expected   [][]string
+	}{
+		{0, [][]string{{".", "a", "b", "c", "d", "deleted"}}},
+		{1000, [][]string{{"deleted", ".", "a"}, {"b"}, {"c"}, {"d"}}},
+		{2500, [][]string{{"deleted", ".", "a", "b"}, {"c", "d"}}},
+		{1 << 20, [][]string{{"deleted", ".", "a", "b", "c", "d"}}},
+	} {
+		groups, err := SplitDeltas(dir, diffs, test.targetSize, nil)
+		if err != nil {
+			t.Fatalf("unexpected error splitting deltas: %s", err)
+		}
+
+		var got [][]string
+		for _, group := range groups {
+			var names []string
+			for _, delta := range group {
+				names = append(names, delta.Path())
+			}
+			got = append(got, names)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("SplitDeltas(%d): got %v expected %v", test.targetSize, got, test.expected)
+		}
+	}
+
+	// Hardlinks must end up in the same group as the first link, even if the
+	// group has already been filled.
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "e")); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err = mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := SplitDeltas(dir, diffs, 1000, nil)
+	if err != nil {
+		t.Fatalf("unexpected error splitting deltas: %s", err)
+	}
+	var got [][]string
+	for _, group := range groups {
+		var names []string
+		for _, delta := range group {
+			names = append(names, delta.Path())
+		}
+		got = append(got, names)
+	}
+	if expected := [][]string{{"deleted", ".", "a", "e"}, {"b"}, {"c"}, {"d"}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("SplitDeltas(1000) with hardlinks: got %v expected %v", got, expected)
+	}
+}
+
+func TestDiffRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDiffRootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRoot := filepath.Join(dir, "old")
+	newRoot := filepath.Join(dir, "new")
+	for root, files := range map[string]map[string]string{
+		oldRoot: {
+			"same":        "same",
+			"modified":    "old contents",
+			"deleted":     "deleted",
+			"dir/deleted": "deleted",
+			"dir/same":    "same",
+		},
+		newRoot: {
+			"same":        "same",
+			"modified":    "new contents",
+			"added":       "added",
+			"dir/same":    "same",
+			"newdir/file": "new",
+		},
+	} {
+		for path, data := range files {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, path), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Timestamps differ between the two trees, so only compare contents.
+	keywords := []mtree.Keyword{"type", "mode", "size", "link", "sha256digest"}
+	deltas, err := DiffRootfs(oldRoot, newRoot, keywords, nil)
+	if err != nil {
+		t.Fatalf("unexpected DiffRootfs error: %+v", err)
+	}
+
+	reader, err := GenerateLayer(newRoot, deltas, &RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{
+		"added",
+		".wh.deleted",
+		"dir/.wh.deleted",
+		"modified",
+		"newdir/",
+		"newdir/file",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: got %v, expected %v", names, expected)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Syscall numbers and flags for the mount API, which our copy of
+// golang.org/x/sys/unix doesn't provide. These syscall numbers are the same
+// on all architectures.
+const (
+	sysOpenTree     = 428
+	sysMoveMount    = 429
+	sysMountSetattr = 442
+
+	atEmptyPath         = 0x1000
+	openTreeClone       = 0x1
+	moveMountFEmptyPath = 0x4
+	mountAttrIDMap      = 0x100000
+)
+
+// mountAttr is equivalent to struct mount_attr.
+type mountAttr struct {
+	attrSet     uint64
+	attrClr     uint64
+	propagation uint64
+	usernsFd    uint64
+}
+
+// useIDMappedMount returns whether an idmapped mount should be attempted to
+// apply the given mapping when extracting layers. Idmapped mounts require
+// CAP_SYS_ADMIN, and are only useful if the mapping is not the identity.
+func useIDMappedMount(opt MapOptions) bool {
+	if opt.Rootless || os.Geteuid() != 0 {
+		return false
+	}
+	for _, idMap := range append(opt.UIDMappings, opt.GIDMappings...) {
+		if idMap.ContainerID != idMap.HostID {
+			return true
+		}
+	}
+	return false
+}
+
+// openUserns returns a file referencing a new user namespace which maps each
+// host ID in the given mapping to its container ID. This is the inverse of the
+// usual mapping, because an idmapped mount maps IDs written through the mount
+// "up" into the user namespace.
+func openUserns(opt MapOptions) (*os.File, error) {
+	var uidMap, gidMap []syscall.SysProcIDMap
+	for _, idMap := range opt.UIDMappings {
+		uidMap = append(uidMap, syscall.SysProcIDMap{
+			ContainerID: int(idMap.HostID),
+			HostID:      int(idMap.ContainerID),
+			Size:        int(idMap.Size),
+		})
+	}
+	for _, idMap := range opt.GIDMappings {
+		gidMap = append(gidMap, syscall.SysProcIDMap{
+			ContainerID: int(idMap.HostID),
+			HostID:      int(idMap.ContainerID),
+			Size:        int(idMap.Size),
+		})
+	}
+
+	// We need a process in the new user namespace so that we can open it. By
+	// tracing the process it stops as soon as it is executed, so it doesn't
+	// matter what it would have run. Tracing requires the thread to be locked.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  unix.CLONE_NEWUSER,
+		UidMappings: uidMap,
+		GidMappings: gidMap,
+		Ptrace:      true,
+		Pdeathsig:   unix.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "start userns process")
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	userns, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+	return userns, errors.Wrap(err, "open userns")
+}
+
+// idmappedMount is an idmapped mount of a directory, through which files can
+// be created with their unmapped owners.
+type idmappedMount struct {
+	// path is the path of the mount.
+	path string
+}
+
+// newIDMappedMount creates an idmapped mount of source (at a new directory
+// inside dir) which applies the given mapping to the owners of paths written
+// through the mount. An error is returned if idmapped mounts are not
+// supported (by the kernel or the filesystem).
+func newIDMappedMount(dir, source string, opt MapOptions) (_ *idmappedMount, Err error) {
+	userns, err := openUserns(opt)
+	if err != nil {
+		return nil, err
+	}
+	defer userns.Close()
+
+	sourcePtr, err := unix.BytePtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	emptyPtr, err := unix.BytePtrFromString("")
+	if err != nil {
+		return nil, err
+	}
+
+	// AT_FDCWD is negative, so it can't be converted to a uintptr constant.
+	cwd := unix.AT_FDCWD
+
+	// Create a detached copy of the source mount, and idmap it.
+	fd, _, errno := unix.Syscall(sysOpenTree, uintptr(cwd), uintptr(unsafe.Pointer(sourcePtr)), uintptr(openTreeClone|unix.O_CLOEXEC))
+	if errno != 0 {
+		return nil, errors.Wrap(os.NewSyscallError("open_tree", errno), "clone source mount")
+	}
+	tree := os.NewFile(fd, "open_tree:"+source)
+	defer tree.Close()
+
+	attr := mountAttr{
+		attrSet:  mountAttrIDMap,
+		usernsFd: uint64(userns.Fd()),
+	}
+	if _, _, errno := unix.Syscall6(sysMountSetattr, tree.Fd(), uintptr(unsafe.Pointer(emptyPtr)), atEmptyPath, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0); errno != 0 {
+		return nil, errors.Wrap(os.NewSyscallError("mount_setattr", errno), "idmap mount")
+	}
+
+	// Attach the mount.
+	path, err := ioutil.TempDir(dir, ".idmapped-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create idmapped mountpoint")
+	}
+	defer func() {
+		if Err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+	pathPtr, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := unix.Syscall6(sysMoveMount, tree.Fd(), uintptr(unsafe.Pointer(emptyPtr)), uintptr(cwd), uintptr(unsafe.Pointer(pathPtr)), moveMountFEmptyPath, 0); errno != 0 {
+		return nil, errors.Wrap(os.NewSyscallError("move_mount", errno), "attach idmapped mount")
+	}
+	return &idmappedMount{path: path}, nil
+}
+
+// Close unmounts the idmapped mount and removes its mountpoint.
+func (m *idmappedMount) Close() error {
+	if err := unix.Unmount(m.path, unix.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "unmount idmapped mount")
+	}
+	return errors.Wrap(os.Remove(m.path), "remove idmapped mountpoint")
+}
@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestUseIDMappedMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("idmapped mounts require root")
+	}
+
+	for _, test := range []struct {
+		name     string
+		opt      MapOptions
+		expected bool
+	}{
+		{"NoMapping", MapOptions{}, false},
+		{"Identity", MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 65536}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: 0, ContainerID: 0, Size: 65536}},
+		}, false},
+		{"UIDMapping", MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		}, true},
+		{"GIDMapping", MapOptions{
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		}, true},
+		{"Rootless", MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+			Rootless:    true,
+		}, false},
+	} {
+		if got := useIDMappedMount(test.opt); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestIDMappedMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("idmapped mounts require root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestIDMappedMount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	if err := os.Mkdir(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// As with the rootfs, the source must be owned by the mapped root.
+	if err := os.Lchown(source, 100000, 200000); err != nil {
+		t.Fatal(err)
+	}
+
+	mnt, err := newIDMappedMount(dir, source, MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: 200000, ContainerID: 0, Size: 65536}},
+	})
+	if err != nil {
+		t.Skipf("idmapped mounts not supported: %v", err)
+	}
+
+	// Files created through the mount have their owners mapped.
+	if err := ioutil.WriteFile(filepath.Join(mnt.path, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error creating file through mount: %v", err)
+	}
+	if err := os.Lchown(filepath.Join(mnt.path, "file"), 1000, 100); err != nil {
+		t.Fatalf("unexpected error chowning file through mount: %v", err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		uid, gid uint32
+	}{
+		{filepath.Join(mnt.path, "file"), 1000, 100},
+		{filepath.Join(source, "file"), 101000, 200100},
+	} {
+		fi, err := os.Lstat(test.path)
+		if err != nil {
+			t.Fatalf("unexpected error in lstat: %v", err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != test.uid || st.Gid != test.gid {
+			t.Errorf("%s: expected owner %d:%d, got %d:%d", test.path, test.uid, test.gid, st.Uid, st.Gid)
+		}
+	}
+
+	if err := mnt.Close(); err != nil {
+		t.Fatalf("unexpected error closing mount: %v", err)
+	}
+	if _, err := os.Lstat(mnt.path); !os.IsNotExist(err) {
+		t.Errorf("idmapped mountpoint was not removed: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// insertTarget returns the (cleaned, relative) name in a layer of the given
+// target path of an inserted layer.
+func insertTarget(target string) string {
+	return CleanPath(filepath.Join(".", CleanPath(target)))
+}
+
+// GenerateInsertLayer generates a layer which inserts the file or directory at
+// root into the root filesystem at target. If root is a directory, its
+// contents are merged with any existing contents of target unless opaque is
+// set, in which case an opaque whiteout is generated so that target only
+// contains the contents of root. The returned reader is for the *raw* tar
+// data, it is the caller's responsibility to gzip it.
+func GenerateInsertLayer(root, target string, opaque bool, opt *RepackOptions) (io.ReadCloser, error) {
+	var repackOptions RepackOptions
+	if opt != nil {
+		repackOptions = *opt
+	}
+	if err := repackOptions.SocketPolicy.validate(); err != nil {
+		return nil, err
+	}
+	if err := repackOptions.SetuidPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	target = insertTarget(target)
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "lstat insert source")
+	}
+	if !fi.IsDir() && target == "." {
+		return nil, errors.Errorf("cannot insert non-directory %s as the root directory", root)
+	}
+	if opaque && !fi.IsDir() {
+		return nil, errors.Errorf("cannot insert non-directory %s with an opaque whiteout", root)
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
+		}()
+
+		tg := newTarGenerator(writer, repackOptions)
+
+		// The opaque whiteout comes before any of the new contents, which are
+		// never removed by whiteouts in the same layer.
+		if opaque {
+			if err := tg.AddOpaqueWhiteout(target); err != nil {
+				return errors.Wrap(err, "generate opaque whiteout")
+			}
+		}
+
+		if err := filepath.Walk(root, func(curPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, curPath)
+			if err != nil {
+				return errors.Wrap(err, "compute path in source")
+			}
+			name := filepath.Join(target, rel)
+			if err := tg.AddFile(name, curPath); err != nil {
+				log.Warnf("generate insert layer: could not add file '%s': %s", name, err)
+				return errors.Wrap(err, "generate layer file")
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := tg.tw.Close(); err != nil {
+			log.Warnf("generate insert layer: could not close tar.Writer: %s", err)
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
+
+// GenerateInsertTarLayer generates a layer which inserts the contents of the
+// (uncompressed) tar archive read from r into the root filesystem at target,
+// by moving every entry of the archive underneath target. Whiteouts in the
+// archive are kept (and so only apply underneath target), as are the
+// ownership and modes of the entries. If opaque is set, an opaque whiteout is
+// generated so that target only contains the contents of the archive. The
+// returned reader is for the *raw* tar data, it is the caller's
+// responsibility to gzip it.
+func GenerateInsertTarLayer(r io.Reader, target string, opaque bool) (io.ReadCloser, error) {
+	target = insertTarget(target)
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			writer.CloseWithError(errors.Wrap(Err, "generate insert layer"))
+		}()
+
+		tr := tar.NewReader(r)
+		tw := tar.NewWriter(writer)
+
+		// The opaque whiteout comes before any of the new contents, which are
+		// never removed by whiteouts in the same layer.
+		if opaque {
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     filepath.Join(target, whOpaque),
+				Typeflag: tar.TypeReg,
+			}); err != nil {
+				return errors.Wrap(err, "write opaque whiteout")
+			}
+		}
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+
+			// Sparse files are expanded by tar.Reader, so they are copied as
+			// regular files.
+			if isSparseHeader(hdr) {
+				hdr.Typeflag = tar.TypeReg
+				for key := range hdr.PAXRecords {
+					if strings.HasPrefix(key, "GNU.sparse.") {
+						delete(hdr.PAXRecords, key)
+					}
+				}
+			}
+
+			// Entries (and hardlink targets) are moved underneath the target.
+			// CleanPath ensures that they cannot escape from it.
+			hdr.Name = filepath.Join(target, CleanPath(hdr.Name))
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = filepath.Join(target, CleanPath(hdr.Linkname))
+			}
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return errors.Wrapf(err, "write header for %s", hdr.Name)
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return errors.Wrapf(err, "copy contents of %s", hdr.Name)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
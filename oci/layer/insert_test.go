@@ -0,0 +1,147 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readInsertLayer returns the names (and hardlink targets) of the entries in
+// the given layer.
+func readInsertLayer(t *testing.T, reader io.Reader) ([]string, map[string]string) {
+	var names []string
+	links := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			links[hdr.Name] = hdr.Linkname
+		}
+	}
+	return names, links
+}
+
+func TestGenerateInsertLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	if err := os.MkdirAll(filepath.Join(source, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "sub", "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, source, target string
+		opaque               bool
+		expected             []string
+	}{
+		{"Directory", source, "/opt/app", false, []string{"opt/app/", "opt/app/sub/", "opt/app/sub/file"}},
+		{"DirectoryOpaque", source, "opt/app", true, []string{"opt/app/.wh..wh..opq", "opt/app/", "opt/app/sub/", "opt/app/sub/file"}},
+		{"File", filepath.Join(source, "sub", "file"), "/etc/../etc/file", false, []string{"etc/file"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := GenerateInsertLayer(test.source, test.target, test.opaque, &RepackOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			defer reader.Close()
+			names, _ := readInsertLayer(t, reader)
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("unexpected entries: expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+
+	// Files cannot be inserted as the root, or with an opaque whiteout.
+	if _, err := GenerateInsertLayer(filepath.Join(source, "sub", "file"), "/", false, nil); err == nil {
+		t.Errorf("expected an error inserting a file as the root")
+	}
+	if _, err := GenerateInsertLayer(filepath.Join(source, "sub", "file"), "/file", true, nil); err == nil {
+		t.Errorf("expected an error inserting a file with an opaque whiteout")
+	}
+}
+
+func TestGenerateInsertTarLayer(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755, Size: 4},
+		{Name: "bin/alias", Typeflag: tar.TypeLink, Linkname: "./bin/tool"},
+		{Name: "bin/abs", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/tool"},
+		{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "share/.wh.old", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("tool")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateInsertTarLayer(bytes.NewReader(archive.Bytes()), "/opt/tool", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	defer reader.Close()
+	names, links := readInsertLayer(t, reader)
+
+	expected := []string{
+		"opt/tool/.wh..wh..opq",
+		"opt/tool/",
+		"opt/tool/bin/",
+		"opt/tool/bin/tool",
+		"opt/tool/bin/alias",
+		"opt/tool/bin/abs",
+		"opt/tool/escape",
+		"opt/tool/share/.wh.old",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected entries: expected %v, got %v", expected, names)
+	}
+	if link := links["opt/tool/bin/alias"]; link != "opt/tool/bin/tool" {
+		t.Errorf("unexpected hardlink target: %s", link)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ListEntry is a path in the root filesystem described by a manifest, as
+// returned by ListManifest.
+type ListEntry struct {
+	// Path is the cleaned path relative to the root.
+	Path string `json:"path"`
+
+	// FileInfo is the metadata of the path. Because the contents of files
+	// are not read, Digest is never set.
+	FileInfo
+
+	// Layer is the index of the layer the path comes from (the topmost layer
+	// which contains the path).
+	Layer int `json:"layer"`
+
+	// LayerDigest is the digest of the layer the path comes from.
+	LayerDigest digest.Digest `json:"layer_digest"`
+}
+
+// ListManifest returns the set of paths in the root filesystem described by
+// the given manifest (sorted by path), without extracting the image or
+// reading the contents of any files. Whiteouts are applied in the same way as
+// FlattenManifest, and each path is annotated with the layer it comes from.
+// Hardlinks are given the size of the file they refer to.
+func ListManifest(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, opt *FlattenOptions) ([]ListEntry, error) {
+	engineExt := casext.NewEngine(engine)
+
+	var flattenOptions FlattenOptions
+	if opt != nil {
+		flattenOptions = *opt
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("list manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("list manifest: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	index := flattenIndex{}
+	infos := map[flattenEntry]FileInfo{}
+	for idx, layerDescriptor := range manifest.Layers {
+		log.Infof("list: reading layer %s", layerDescriptor.Digest)
+		if err := readLayerBlob(ctx, engineExt, layerDescriptor, config.RootFS.DiffIDs[idx], "", flattenOptions.NoVerify, func(layer io.Reader) error {
+			tr := tar.NewReader(layer)
+			for entryIdx := 0; ; entryIdx++ {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+				if estargz.IsMetadataEntry(hdr.Name) {
+					continue
+				}
+				entry := flattenEntry{
+					layer: idx,
+					index: entryIdx,
+					isDir: hdr.Typeflag == tar.TypeDir,
+				}
+				index.add(hdr, entry)
+				if index[CleanPath(hdr.Name)] != entry {
+					// Whiteouts are not part of the root filesystem.
+					continue
+				}
+
+				info := FileInfo{
+					Type: fileType(hdr.Typeflag),
+					Mode: hdr.Mode & 07777,
+					UID:  hdr.Uid,
+					GID:  hdr.Gid,
+				}
+				switch hdr.Typeflag {
+				case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+					// Sparse files are regular files with holes.
+					info.Type = fileType(tar.TypeReg)
+					info.Size = hdr.Size
+				case tar.TypeSymlink:
+					info.Linkname = hdr.Linkname
+				case tar.TypeLink:
+					info.Linkname = CleanPath(hdr.Linkname)
+				case tar.TypeChar, tar.TypeBlock:
+					info.Devmajor = hdr.Devmajor
+					info.Devminor = hdr.Devminor
+				}
+				infos[entry] = info
+			}
+		}); err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", layerDescriptor.Digest)
+		}
+
+		// Forget about the entries which have been hidden by this layer, so
+		// that we only keep track of the visible ones.
+		visible := map[flattenEntry]bool{}
+		for _, entry := range index {
+			visible[entry] = true
+		}
+		for entry := range infos {
+			if !visible[entry] {
+				delete(infos, entry)
+			}
+		}
+	}
+
+	var entries []ListEntry
+	for path, entry := range index {
+		if path == "." {
+			continue
+		}
+		info, ok := infos[entry]
+		if !ok {
+			// Should _never_ be reached.
+			return nil, errors.Errorf("[internal error] missing metadata for %s", path)
+		}
+		entries = append(entries, ListEntry{
+			Path:        path,
+			FileInfo:    info,
+			Layer:       entry.layer,
+			LayerDigest: manifest.Layers[entry.layer].Digest,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	// Hardlinks share the contents of the file they refer to.
+	sizes := map[string]int64{}
+	for _, entry := range entries {
+		if entry.Type == "file" {
+			sizes[entry.Path] = entry.Size
+		}
+	}
+	for i, entry := range entries {
+		if entry.Type == "hardlink" {
+			entries[i].Size = sizes[entry.Linkname]
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestListManifest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestListManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "old passwd"},
+			{"etc/group", tar.TypeReg, 0644, "group"},
+			{"etc/removed", tar.TypeReg, 0644, "removed"},
+			{"opaque/", tar.TypeDir, 0755, ""},
+			{"opaque/file", tar.TypeReg, 0644, "hidden"},
+			{"replaced/", tar.TypeDir, 0755, ""},
+			{"replaced/file", tar.TypeReg, 0644, "hidden"},
+		},
+		{
+			{"etc/", tar.TypeDir, 0700, ""},
+			{"etc/passwd", tar.TypeReg, 0600, "new passwd"},
+			{"etc/.wh.removed", tar.TypeReg, 0644, ""},
+			{"opaque/.wh..wh..opq", tar.TypeReg, 0644, ""},
+			{"opaque/new", tar.TypeReg, 0644, "new"},
+			{"replaced", tar.TypeSymlink, 0777, ""},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	entries, err := ListManifest(ctx, engine, manifest, nil)
+	if err != nil {
+		t.Fatalf("unexpected error listing manifest: %+v", err)
+	}
+
+	expected := []struct {
+		path  string
+		typ   string
+		mode  int64
+		size  int64
+		layer int
+	}{
+		{"etc", "dir", 0700, 0, 1},
+		{"etc/group", "file", 0644, 5, 0},
+		{"etc/passwd", "file", 0600, 10, 1},
+		{"opaque", "dir", 0755, 0, 0},
+		{"opaque/new", "file", 0644, 3, 1},
+		{"replaced", "symlink", 0777, 0, 1},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected number of entries: got %d expected %d: %v", len(entries), len(expected), entries)
+	}
+	for i, want := range expected {
+		got := entries[i]
+		if got.Path != want.path || got.Type != want.typ || got.Mode != want.mode || got.Size != want.size || got.Layer != want.layer {
+			t.Errorf("unexpected entry %d: got {%s %s %o %d %d} expected %v", i, got.Path, got.Type, got.Mode, got.Size, got.Layer, want)
+		}
+		if got.LayerDigest != layerDescriptors[want.layer].Digest {
+			t.Errorf("unexpected layer digest for %s: got %s expected %s", got.Path, got.LayerDigest, layerDescriptors[want.layer].Digest)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// MetadataOnlyPolicy describes how regular files whose contents are unchanged
+// but whose owner, mode or xattrs have been modified are handled when
+// generating a layer. Layers cannot represent such a change without including
+// the entire file again (even a hardlink to the old path would be broken by
+// the extractor removing the old path before creating the link), so for large
+// files this can make incremental layers much larger than expected.
+type MetadataOnlyPolicy string
+
+const (
+	// MetadataOnlyInclude adds the entire file to the layer.
+	MetadataOnlyInclude MetadataOnlyPolicy = "include"
+
+	// MetadataOnlyWarn adds the entire file to the layer, but logs a warning
+	// (so that unintended changes, such as a recursive chown, can be found).
+	MetadataOnlyWarn MetadataOnlyPolicy = "warn"
+
+	// MetadataOnlySkip omits the file from the layer (with a warning). The
+	// metadata change is lost, and is not visible in the image.
+	MetadataOnlySkip MetadataOnlyPolicy = "skip"
+)
+
+// validate returns an error if the policy is not a known MetadataOnlyPolicy.
+// An empty policy is equivalent to MetadataOnlyInclude.
+func (p MetadataOnlyPolicy) validate() error {
+	switch p {
+	case "", MetadataOnlyInclude, MetadataOnlyWarn, MetadataOnlySkip:
+		return nil
+	}
+	return errors.Errorf("unknown metadata-only policy: %s", p)
+}
+
+// metadataKeywords are the mtree keywords which only describe the metadata of
+// a path. Time keywords are not included, because modifying a file's contents
+// also changes its modification time.
+var metadataKeywords = map[mtree.Keyword]bool{
+	"uid":   true,
+	"gid":   true,
+	"uname": true,
+	"gname": true,
+	"mode":  true,
+	"xattr": true,
+}
+
+// isMetadataOnly returns whether the given delta only modifies the metadata of
+// a regular file. The contents are only known to be unchanged if a digest of
+// the file was recorded.
+func isMetadataOnly(delta mtree.InodeDelta) bool {
+	if delta.Type() != mtree.Modified || delta.Old() == nil || len(delta.Diff()) == 0 {
+		return false
+	}
+	hasDigest := false
+	for _, kv := range delta.Old().AllKeys() {
+		switch kw := kv.Keyword().Prefix(); {
+		case kw == "type" && kv.Value() != "file":
+			return false
+		case strings.HasSuffix(string(kw), "digest"):
+			hasDigest = true
+		}
+	}
+	if !hasDigest {
+		return false
+	}
+	for _, kd := range delta.Diff() {
+		if !metadataKeywords[kd.Name().Prefix()] {
+			return false
+		}
+	}
+	return true
+}
+
+// skipMetadataOnly applies the metadata-only policy to the given delta (whose
+// path on the host is path), and returns whether it should be omitted from
+// the layer.
+func (tg *tarGenerator) skipMetadataOnly(delta mtree.InodeDelta, path string) (bool, error) {
+	if tg.metadataOnly == "" || tg.metadataOnly == MetadataOnlyInclude || !isMetadataOnly(delta) {
+		return false, nil
+	}
+	fi, err := tg.fsEval.Lstat(path)
+	if err != nil {
+		return false, errors.Wrap(err, "lstat metadata-only change")
+	}
+	if !fi.Mode().IsRegular() || fi.Size() < tg.metadataOnlyMinSize {
+		return false, nil
+	}
+
+	size := units.HumanSize(float64(fi.Size()))
+	if tg.metadataOnly == MetadataOnlySkip {
+		log.Warnf("generate layer: omitting metadata-only change to %s (%s)", delta.Path(), size)
+		return true, nil
+	}
+	log.Warnf("generate layer: only the metadata of %s changed, but it must be added to the layer again (%s)", delta.Path(), size)
+	return false, nil
+}
@@ -0,0 +1,87 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// SetuidPolicy describes how setuid and setgid bits of paths in a root
+// filesystem are handled when generating a layer.
+type SetuidPolicy string
+
+const (
+	// SetuidKeep stores setuid and setgid bits in the layer unmodified.
+	SetuidKeep SetuidPolicy = "keep"
+
+	// SetuidStrip clears any setuid and setgid bits (with a warning).
+	SetuidStrip SetuidPolicy = "strip"
+
+	// SetuidError causes layer generation to fail if any path added to the
+	// layer has the setuid or setgid bit set.
+	SetuidError SetuidPolicy = "error"
+)
+
+// validate returns an error if the policy is not a known SetuidPolicy. An
+// empty policy is equivalent to SetuidKeep.
+func (p SetuidPolicy) validate() error {
+	switch p {
+	case "", SetuidKeep, SetuidStrip, SetuidError:
+		return nil
+	}
+	return errors.Errorf("unknown setuid policy: %s", p)
+}
+
+// Mode bits of a tar.Header (these are the same on all platforms).
+const (
+	modeSetuid int64 = 04000
+	modeSetgid int64 = 02000
+	modePerm   int64 = 0777
+)
+
+// applyModePolicy modifies the mode of hdr according to the setuid policy and
+// permission mask of the tarGenerator. Symlinks and hardlinks are left alone,
+// because they don't have modes of their own.
+func (tg *tarGenerator) applyModePolicy(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		return nil
+	}
+
+	if hdr.Mode&(modeSetuid|modeSetgid) != 0 {
+		switch tg.setuidPolicy {
+		case SetuidError:
+			return errors.Errorf("path has setuid or setgid bit set: %s", hdr.Name)
+		case SetuidStrip:
+			log.Warnf("generate layer: stripping setuid and setgid bits: %s", hdr.Name)
+			hdr.Mode &^= modeSetuid | modeSetgid
+		}
+	}
+
+	if tg.modeMask != nil {
+		mask := int64(*tg.modeMask & os.ModePerm)
+		if hdr.Mode&modePerm&^mask != 0 {
+			log.Debugf("generate layer: masking mode %o with %o: %s", hdr.Mode, mask, hdr.Name)
+			hdr.Mode &^= modePerm &^ mask
+		}
+	}
+	return nil
+}
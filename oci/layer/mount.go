@@ -0,0 +1,176 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// mountEmptyName is the name of the empty directory inside a layer store
+// which is used as the bottom-most lowerdir of read-only mounts. overlayfs
+// requires at least two lowerdirs when there is no upperdir.
+const mountEmptyName = ".empty"
+
+// FuseOverlayfsPath is the name (or path) of the fuse-overlayfs binary used
+// by MountManifest in rootless mode.
+var FuseOverlayfsPath = "fuse-overlayfs"
+
+// MountManifest extracts each of the layers in the given manifest into the
+// layer store opt.LayerStore (re-using any layers that were already extracted
+// into the store, exactly like the OverlayfsMount on-disk format) and mounts
+// a read-only overlayfs of the layers at target, which must be an existing
+// directory. No runtime configuration is generated, and nothing is written
+// outside of the layer store.
+//
+// In rootless mode, the overlayfs is mounted using fuse-overlayfs (since
+// unprivileged users cannot mount an overlayfs outside of a user namespace).
+// The mount must be removed with Unmount.
+func MountManifest(ctx context.Context, engine cas.Engine, target string, manifest ispec.Manifest, opt *UnpackOptions) error {
+	engineExt := casext.NewEngine(engine)
+
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
+	if unpackOptions.LayerStore == "" {
+		return errors.Errorf("mount manifest: layer store must be provided")
+	}
+	if unpackOptions.NoVerify {
+		return errors.Errorf("mount manifest: layers must be verified when using a layer store")
+	}
+	if unpackOptions.TarSplit {
+		return errors.Errorf("mount manifest: tar-split metadata cannot be stored when using a layer store")
+	}
+	if err := unpackOptions.DevicePolicy.validate(); err != nil {
+		return errors.Wrap(err, "mount manifest")
+	}
+	if err := unpackOptions.Strictness.validate(); err != nil {
+		return errors.Wrap(err, "mount manifest")
+	}
+	// The layers are stored with overlayfs whiteouts regardless of the
+	// requested format.
+	unpackOptions.OnDiskFormat = OverlayfsMount
+
+	if fi, err := os.Stat(target); err != nil {
+		return errors.Wrap(err, "stat mountpoint")
+	} else if !fi.IsDir() {
+		return errors.Errorf("mount manifest: mountpoint %s is not a directory", target)
+	}
+
+	// The overlayfs mount options need absolute paths.
+	layersPath, err := filepath.Abs(unpackOptions.LayerStore)
+	if err != nil {
+		return errors.Wrap(err, "get absolute layer store path")
+	}
+	if err := os.MkdirAll(layersPath, 0700); err != nil {
+		return errors.Wrap(err, "mkdir layer store")
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	// Make sure that the owner is correct.
+	rootUID, err := idtools.ToHost(0, mapOptions.UIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootuid has mapping")
+	}
+	rootGID, err := idtools.ToHost(0, mapOptions.GIDMappings)
+	if err != nil {
+		return errors.Wrap(err, "ensure rootgid has mapping")
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok || configBlob.MediaType != ispec.MediaTypeImageConfig {
+		return errors.Errorf("mount manifest: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if config.RootFS.Type != "layers" {
+		return errors.Errorf("mount manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("mount manifest: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	lowerDirs, err := extractLayerStore(ctx, engineExt, "", layersPath, manifest.Layers, config.RootFS.DiffIDs, rootUID, rootGID, fsEval, &unpackOptions)
+	if err != nil {
+		return err
+	}
+
+	emptyPath := filepath.Join(layersPath, mountEmptyName)
+	if err := os.Mkdir(emptyPath, 0755); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "mkdir empty lowerdir")
+	}
+	if err := prepareLayerRoot(emptyPath, rootUID, rootGID); err != nil {
+		return errors.Wrap(err, "prepare empty lowerdir")
+	}
+	lowerDirs = append(lowerDirs, emptyPath)
+
+	data := "lowerdir=" + strings.Join(lowerDirs, ":")
+	if mapOptions.Rootless {
+		log.Infof("mounting fuse-overlayfs: %s", target)
+		cmd := exec.Command(FuseOverlayfsPath, "-o", data, target)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "mount fuse-overlayfs: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	log.Infof("mounting overlay: %s", target)
+	return errors.Wrap(unix.Mount("overlay", target, "overlay", unix.MS_RDONLY, data), "mount overlay")
+}
+
+// Unmount removes a mount created by MountManifest. If the mount cannot be
+// removed directly (as is the case for fuse-overlayfs mounts created by an
+// unprivileged user), fusermount is used instead. The layer store is left
+// untouched.
+func Unmount(target string) error {
+	err := unix.Unmount(target, 0)
+	if err != unix.EPERM {
+		return errors.Wrap(err, "unmount")
+	}
+	for _, fusermount := range []string{"fusermount3", "fusermount"} {
+		output, execErr := exec.Command(fusermount, "-u", target).CombinedOutput()
+		if execErr == nil {
+			return nil
+		}
+		if _, ok := execErr.(*exec.Error); !ok {
+			return errors.Wrapf(execErr, "%s: %s", fusermount, strings.TrimSpace(string(output)))
+		}
+	}
+	return errors.Wrap(err, "unmount")
+}
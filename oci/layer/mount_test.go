@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// listTree returns the relative paths of every entry under root.
+func listTree(t *testing.T, root string) []string {
+	var paths []string
+	if err := filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error walking %s: %+v", root, err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestMountManifest(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting an overlayfs requires root")
+	}
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestMountManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+	manifest := putCustomLayersManifest(t, ctx, engineExt)
+
+	// The mount must have the same contents as a flattened unpack.
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{MapOptions: customLayersMapOptions()}); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+	expected := listTree(t, filepath.Join(bundle, RootfsName))
+
+	store := filepath.Join(root, "store")
+	for _, name := range []string{"mnt1", "mnt2"} {
+		target := filepath.Join(root, name)
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := MountManifest(ctx, engineExt, target, manifest, &UnpackOptions{
+			MapOptions: customLayersMapOptions(),
+			LayerStore: store,
+		})
+		if errno, ok := errors.Cause(err).(syscall.Errno); ok && (errno == unix.EPERM || errno == unix.ENODEV) {
+			t.Skipf("overlayfs is not supported: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("unexpected MountManifest error: %+v", err)
+		}
+		defer Unmount(target)
+
+		if got := listTree(t, target); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected contents %v, got %v", name, expected, got)
+		}
+		// The mount is read-only.
+		if err := ioutil.WriteFile(filepath.Join(target, "new"), nil, 0644); err == nil {
+			t.Errorf("%s: expected mount to be read-only", name)
+		}
+	}
+
+	// Both mounts share the layers in the store.
+	layers, err := filepath.Glob(filepath.Join(store, "sha256_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != len(manifest.Layers) {
+		t.Errorf("expected %d layers in store, got %v", len(manifest.Layers), layers)
+	}
+
+	target := filepath.Join(root, "mnt1")
+	if err := Unmount(target); err != nil {
+		t.Fatalf("unexpected Unmount error: %+v", err)
+	}
+	if got := listTree(t, target); !reflect.DeepEqual(got, []string{"."}) {
+		t.Errorf("expected empty mountpoint after unmount, got %v", got)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Overlap is a path which is modified by more than one layer of an image, so
+// that the contents of the flattened root filesystem depend on the order of
+// those layers.
+type Overlap struct {
+	// Path is the overlapping path (relative to the root). If one of the
+	// layers removes or replaces a directory, this is the path of the
+	// directory.
+	Path string `json:"path"`
+
+	// Layers are the indices (counting from zero at the base of the image) of
+	// the layers which modify the path, in ascending order.
+	Layers []int `json:"layers"`
+}
+
+// Reordered returns whether moving the layers of the image into the given
+// order (where order[i] is the current index of the layer which becomes the
+// i-th layer) changes the relative order of any of the overlapping layers,
+// which would change the contents of the path in the flattened root
+// filesystem.
+func (o Overlap) Reordered(order []int) bool {
+	position := map[int]int{}
+	for newIdx, oldIdx := range order {
+		position[oldIdx] = newIdx
+	}
+	for idx := 1; idx < len(o.Layers); idx++ {
+		if position[o.Layers[idx-1]] > position[o.Layers[idx]] {
+			return true
+		}
+	}
+	return false
+}
+
+// layerEntry is the effect of a layer on a single path.
+type layerEntry struct {
+	typeflag byte
+	mode     int64
+	uid, gid int
+
+	// whiteout is set if the path is removed by the layer.
+	whiteout bool
+	// link is set if the path is only the target of a hardlink in the layer,
+	// whose contents depend on the lower layers.
+	link bool
+}
+
+// subtree returns whether the entry affects everything beneath the path, by
+// removing it or replacing it with a non-directory.
+func (e layerEntry) subtree() bool {
+	return !e.link && (e.whiteout || e.typeflag != tar.TypeDir)
+}
+
+// conflicts returns whether the order of the two entries for the same path
+// matters. Identical directories and hardlinks to the same file do not
+// conflict.
+func (e layerEntry) conflicts(other layerEntry) bool {
+	if e.link || other.link {
+		return !(e.link && other.link)
+	}
+	if e.whiteout || other.whiteout || e.typeflag != tar.TypeDir || other.typeflag != tar.TypeDir {
+		return true
+	}
+	return e.mode != other.mode || e.uid != other.uid || e.gid != other.gid
+}
+
+// layerChanges are the paths modified by a layer.
+type layerChanges struct {
+	entries map[string]layerEntry
+	// opaque are the directories whose lower-layer contents are removed by
+	// an opaque whiteout.
+	opaque []string
+	// paths are the keys of entries, sorted.
+	paths []string
+}
+
+// under returns the paths modified by the layer which are beneath the given
+// directory.
+func (c layerChanges) under(dir string) []string {
+	if dir == "." {
+		return c.paths
+	}
+	prefix := dir + "/"
+	start := sort.SearchStrings(c.paths, prefix)
+	end := start
+	for end < len(c.paths) && strings.HasPrefix(c.paths[end], prefix) {
+		end++
+	}
+	return c.paths[start:end]
+}
+
+// readLayerChanges reads the paths modified by the given layer.
+func readLayerChanges(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, diffID digest.Digest) (layerChanges, error) {
+	changes := layerChanges{entries: map[string]layerEntry{}}
+	err := readLayerBlob(ctx, engine, layerDescriptor, diffID, "", false, func(layer io.Reader) error {
+		tr := tar.NewReader(layer)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "read next entry")
+			}
+			if estargz.IsMetadataEntry(hdr.Name) {
+				continue
+			}
+			name := CleanPath(strings.TrimLeft(hdr.Name, "/"))
+			dir, file := filepath.Split(name)
+			dir = filepath.Clean(dir)
+			switch {
+			case file == whOpaque:
+				changes.opaque = append(changes.opaque, dir)
+			case strings.HasPrefix(file, whPrefix):
+				changes.entries[filepath.Join(dir, strings.TrimPrefix(file, whPrefix))] = layerEntry{whiteout: true}
+			default:
+				// The last entry for the path in the layer takes effect.
+				changes.entries[name] = layerEntry{
+					typeflag: hdr.Typeflag,
+					mode:     hdr.Mode,
+					uid:      hdr.Uid,
+					gid:      hdr.Gid,
+				}
+				if hdr.Typeflag == tar.TypeLink {
+					target := CleanPath(strings.TrimLeft(hdr.Linkname, "/"))
+					if _, ok := changes.entries[target]; !ok {
+						changes.entries[target] = layerEntry{link: true}
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		return layerChanges{}, err
+	}
+	for path := range changes.entries {
+		changes.paths = append(changes.paths, path)
+	}
+	sort.Strings(changes.paths)
+	return changes, nil
+}
+
+// FindOverlaps reads every layer of the image described by the given manifest
+// and returns the paths which are modified by more than one layer (sorted by
+// path), such as a file which is modified by a later layer or a directory
+// which is removed by a whiteout in a later layer. Directories which are
+// included in several layers with the same mode and owner are not considered
+// to overlap (though their modification times may still differ).
+//
+// This is useful to check whether the layers of an image can be reordered
+// (see Overlap.Reordered) without changing the contents of the flattened root
+// filesystem. Only the tar headers of each layer are compared, so a later
+// layer which contains an identical copy of a file is still reported.
+func FindOverlaps(ctx context.Context, engine cas.Engine, manifest ispec.Manifest) ([]Overlap, error) {
+	engineExt := casext.NewEngine(engine)
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("find overlaps: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("find overlaps: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	var layers []layerChanges
+	for idx, layerDescriptor := range manifest.Layers {
+		changes, err := readLayerChanges(ctx, engineExt, layerDescriptor, config.RootFS.DiffIDs[idx])
+		if err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", layerDescriptor.Digest)
+		}
+		layers = append(layers, changes)
+	}
+
+	overlapping := map[string]map[int]struct{}{}
+	overlap := func(path string, a, b int) {
+		if overlapping[path] == nil {
+			overlapping[path] = map[int]struct{}{}
+		}
+		overlapping[path][a] = struct{}{}
+		overlapping[path][b] = struct{}{}
+	}
+	for a := range layers {
+		for b := range layers {
+			if a == b {
+				continue
+			}
+			// Each pair is compared in both directions, so only the paths
+			// of a which affect b are checked here.
+			for _, path := range layers[a].paths {
+				entry := layers[a].entries[path]
+				if a < b {
+					if other, ok := layers[b].entries[path]; ok && entry.conflicts(other) {
+						overlap(path, a, b)
+					}
+				}
+				if entry.subtree() && len(layers[b].under(path)) > 0 {
+					overlap(path, a, b)
+				}
+			}
+			for _, dir := range layers[a].opaque {
+				if len(layers[b].under(dir)) > 0 {
+					overlap(dir, a, b)
+				}
+			}
+		}
+	}
+
+	overlaps := []Overlap{}
+	for path, indices := range overlapping {
+		o := Overlap{Path: path}
+		for idx := range indices {
+			o.Layers = append(o.Layers, idx)
+		}
+		sort.Ints(o.Layers)
+		overlaps = append(overlaps, o)
+	}
+	sort.Slice(overlaps, func(i, j int) bool {
+		return overlaps[i].Path < overlaps[j].Path
+	})
+	return overlaps, nil
+}
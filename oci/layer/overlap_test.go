@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestFindOverlaps(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFindOverlaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "passwd"},
+			{"opaque/", tar.TypeDir, 0755, ""},
+			{"opaque/file", tar.TypeReg, 0644, "file"},
+			{"removed/", tar.TypeDir, 0755, ""},
+			{"removed/file", tar.TypeReg, 0644, "file"},
+		},
+		{
+			// Identical directories do not overlap.
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/group", tar.TypeReg, 0644, "group"},
+			{"data/", tar.TypeDir, 0755, ""},
+			{"data/file", tar.TypeReg, 0644, "data"},
+		},
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "new passwd"},
+			{"opaque/.wh..wh..opq", tar.TypeReg, 0644, ""},
+			{".wh.removed", tar.TypeReg, 0644, ""},
+			{"data/", tar.TypeDir, 0700, ""},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	overlaps, err := FindOverlaps(ctx, engine, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error finding overlaps: %+v", err)
+	}
+	expected := []Overlap{
+		{Path: "data", Layers: []int{1, 2}},
+		{Path: "etc/passwd", Layers: []int{0, 2}},
+		{Path: "opaque", Layers: []int{0, 2}},
+		{Path: "removed", Layers: []int{0, 2}},
+	}
+	if !reflect.DeepEqual(overlaps, expected) {
+		t.Errorf("unexpected overlaps: got %+v expected %+v", overlaps, expected)
+	}
+
+	for _, test := range []struct {
+		order     []int
+		reordered []string
+	}{
+		{[]int{0, 1, 2}, nil},
+		{[]int{1, 0, 2}, nil},
+		{[]int{0, 2, 1}, []string{"data"}},
+		{[]int{2, 0, 1}, []string{"data", "etc/passwd", "opaque", "removed"}},
+	} {
+		var reordered []string
+		for _, overlap := range overlaps {
+			if overlap.Reordered(test.order) {
+				reordered = append(reordered, overlap.Path)
+			}
+		}
+		if !reflect.DeepEqual(reordered, test.reordered) {
+			t.Errorf("unexpected overlaps reordered by %v: got %v expected %v", test.order, reordered, test.reordered)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// These are the names of the xattrs used by Linux to store POSIX ACLs.
+const (
+	// posixACLAccess is the xattr storing the access ACL of an inode.
+	posixACLAccess = "system.posix_acl_access"
+
+	// posixACLDefault is the xattr storing the default ACL of a directory.
+	posixACLDefault = "system.posix_acl_default"
+)
+
+// PosixACLXattrs is the set of xattr names used to store POSIX ACLs.
+var PosixACLXattrs = []string{posixACLAccess, posixACLDefault}
+
+// The following constants describe the on-disk format of POSIX ACL xattrs (as
+// defined in <linux/posix_acl_xattr.h>). All values are little-endian.
+const (
+	posixACLVersion    = 0x0002
+	posixACLHeaderSize = 4
+	posixACLEntrySize  = 8
+
+	// Only ACL_USER and ACL_GROUP entries contain an ID.
+	posixACLTagUser  = 0x02
+	posixACLTagGroup = 0x08
+)
+
+// mapPosixACL maps the IDs of all ACL_USER and ACL_GROUP entries in the given
+// POSIX ACL xattr value using the provided mapping functions. If skip is set,
+// entries which cannot be mapped are removed from the ACL (otherwise an error
+// is returned).
+func mapPosixACL(value []byte, mapUID, mapGID func(int) (int, error), skip bool) ([]byte, error) {
+	if len(value) < posixACLHeaderSize || (len(value)-posixACLHeaderSize)%posixACLEntrySize != 0 {
+		return nil, errors.Errorf("invalid posix acl: bad length %d", len(value))
+	}
+	if version := binary.LittleEndian.Uint32(value); version != posixACLVersion {
+		return nil, errors.Errorf("invalid posix acl: unsupported version %d", version)
+	}
+
+	mapped := append([]byte{}, value[:posixACLHeaderSize]...)
+	for entry := value[posixACLHeaderSize:]; len(entry) > 0; entry = entry[posixACLEntrySize:] {
+		tag := binary.LittleEndian.Uint16(entry[0:2])
+
+		var mapFn func(int) (int, error)
+		switch tag {
+		case posixACLTagUser:
+			mapFn = mapUID
+		case posixACLTagGroup:
+			mapFn = mapGID
+		}
+
+		newEntry := append([]byte{}, entry[:posixACLEntrySize]...)
+		if mapFn != nil {
+			id := binary.LittleEndian.Uint32(entry[4:8])
+			newID, err := mapFn(int(id))
+			if err != nil {
+				if skip {
+					log.Warnf("ignoring posix acl entry (tag=%#x id=%d) which cannot be mapped: %v", tag, id, err)
+					continue
+				}
+				return nil, errors.Wrapf(err, "map posix acl entry (tag=%#x id=%d)", tag, id)
+			}
+			binary.LittleEndian.PutUint32(newEntry[4:8], uint32(newID))
+		}
+		mapped = append(mapped, newEntry...)
+	}
+	return mapped, nil
+}
+
+// mapPosixACLXattrs applies mapPosixACL to all of the POSIX ACL xattrs in the
+// given set of xattrs, modifying it in-place.
+func mapPosixACLXattrs(xattrs map[string]string, mapUID, mapGID func(int) (int, error), skip bool) error {
+	for _, name := range PosixACLXattrs {
+		value, ok := xattrs[name]
+		if !ok {
+			continue
+		}
+		mapped, err := mapPosixACL([]byte(value), mapUID, mapGID, skip)
+		if err != nil {
+			return errors.Wrapf(err, "map %s", name)
+		}
+		xattrs[name] = string(mapped)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// makePosixACL creates a POSIX ACL xattr value from a set of (tag, perm, id)
+// entries.
+func makePosixACL(entries ...[3]uint32) []byte {
+	buf := make([]byte, posixACLHeaderSize, posixACLHeaderSize+len(entries)*posixACLEntrySize)
+	binary.LittleEndian.PutUint32(buf, posixACLVersion)
+	for _, entry := range entries {
+		var raw [posixACLEntrySize]byte
+		binary.LittleEndian.PutUint16(raw[0:2], uint16(entry[0]))
+		binary.LittleEndian.PutUint16(raw[2:4], uint16(entry[1]))
+		binary.LittleEndian.PutUint32(raw[4:8], entry[2])
+		buf = append(buf, raw[:]...)
+	}
+	return buf
+}
+
+const aclUndefinedID = 0xffffffff
+
+func TestMapPosixACL(t *testing.T) {
+	addOffset := func(id int) (int, error) {
+		if id >= 1000 {
+			return -1, errors.Errorf("unmapped id %d", id)
+		}
+		return id + 100000, nil
+	}
+
+	acl := makePosixACL(
+		[3]uint32{0x01, 7, aclUndefinedID},
+		[3]uint32{posixACLTagUser, 5, 42},
+		[3]uint32{posixACLTagUser, 5, 1234},
+		[3]uint32{0x04, 5, aclUndefinedID},
+		[3]uint32{posixACLTagGroup, 4, 100},
+		[3]uint32{0x10, 7, aclUndefinedID},
+		[3]uint32{0x20, 0, aclUndefinedID},
+	)
+
+	if _, err := mapPosixACL(acl, addOffset, addOffset, false); err == nil {
+		t.Errorf("expected error mapping acl with unmappable entry")
+	}
+
+	mapped, err := mapPosixACL(acl, addOffset, addOffset, true)
+	if err != nil {
+		t.Fatalf("unexpected error mapping acl: %v", err)
+	}
+	expected := makePosixACL(
+		[3]uint32{0x01, 7, aclUndefinedID},
+		[3]uint32{posixACLTagUser, 5, 100042},
+		[3]uint32{0x04, 5, aclUndefinedID},
+		[3]uint32{posixACLTagGroup, 4, 100100},
+		[3]uint32{0x10, 7, aclUndefinedID},
+		[3]uint32{0x20, 0, aclUndefinedID},
+	)
+	if !bytes.Equal(mapped, expected) {
+		t.Errorf("unexpected mapped acl: got %v expected %v", mapped, expected)
+	}
+}
+
+func TestMapPosixACLInvalid(t *testing.T) {
+	identity := func(id int) (int, error) { return id, nil }
+
+	for _, acl := range [][]byte{
+		nil,
+		{0x02, 0x00},
+		{0x01, 0x00, 0x00, 0x00},
+		append(makePosixACL(), 0x01, 0x00),
+	} {
+		if _, err := mapPosixACL(acl, identity, identity, false); err == nil {
+			t.Errorf("expected error mapping invalid acl %v", acl)
+		}
+	}
+}
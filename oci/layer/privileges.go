@@ -0,0 +1,188 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/gocapability/capability"
+)
+
+// minimumMappedIDs is the number of ids (starting from 0) which must be
+// mapped into the current user namespace for privileged extraction to be
+// considered possible. Most images only use ids below this limit.
+const minimumMappedIDs = 65536
+
+// requiredCapabilities are the capabilities used when extracting and
+// generating layers without MapOptions.Rootless.
+var requiredCapabilities = []capability.Cap{
+	capability.CAP_CHOWN,
+	capability.CAP_DAC_OVERRIDE,
+	capability.CAP_FOWNER,
+	capability.CAP_MKNOD,
+}
+
+// Privileges describes whether the current process is able to do the
+// privileged operations used by umoci when MapOptions.Rootless is not set,
+// as detected by DetectPrivileges.
+type Privileges struct {
+	// EUID is the effective uid of the process.
+	EUID int `json:"euid"`
+
+	// UserNamespace is whether the process is in a user namespace other than
+	// the initial one.
+	UserNamespace bool `json:"user_namespace"`
+
+	// MappedIDs is whether at least the first 65536 uids and gids are mapped
+	// into the user namespace of the process (which is always the case in
+	// the initial user namespace).
+	MappedIDs bool `json:"mapped_ids"`
+
+	// MissingCapabilities are the names of the capabilities required for
+	// privileged extraction which the process does not have.
+	MissingCapabilities []string `json:"missing_capabilities"`
+}
+
+// Rootless returns whether MapOptions.Rootless should be used, because some
+// of the privileged operations are not possible.
+func (p Privileges) Rootless() bool {
+	return len(p.Reasons()) > 0
+}
+
+// Reasons returns a human-readable description of each reason why
+// MapOptions.Rootless should be used. If no reasons are returned, privileged
+// operations are possible.
+func (p Privileges) Reasons() []string {
+	var reasons []string
+	if !p.MappedIDs {
+		reasons = append(reasons, fmt.Sprintf("fewer than %d ids are mapped into the user namespace", minimumMappedIDs))
+	}
+	for _, name := range p.MissingCapabilities {
+		reasons = append(reasons, fmt.Sprintf("missing capability %s", name))
+	}
+	if p.UserNamespace {
+		// The kernel doesn't permit creating device nodes inside a user
+		// namespace, regardless of capabilities.
+		reasons = append(reasons, "device nodes cannot be created inside a user namespace")
+	}
+	return reasons
+}
+
+// idMapRange is a single line of a /proc/<pid>/[ug]id_map file.
+type idMapRange struct {
+	inside, outside, size uint64
+}
+
+// parseIDMap parses the contents of a /proc/<pid>/[ug]id_map file.
+func parseIDMap(r io.Reader) ([]idMapRange, error) {
+	var ranges []idMapRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.Errorf("invalid id map line: %q", scanner.Text())
+		}
+		var values [3]uint64
+		for idx, field := range fields {
+			value, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid id map line: %q", scanner.Text())
+			}
+			values[idx] = value
+		}
+		ranges = append(ranges, idMapRange{inside: values[0], outside: values[1], size: values[2]})
+	}
+	return ranges, errors.Wrap(scanner.Err(), "read id map")
+}
+
+// isInitialIDMap returns whether the id map is the one of the initial user
+// namespace, which maps every id to itself.
+func isInitialIDMap(ranges []idMapRange) bool {
+	return len(ranges) == 1 && ranges[0] == idMapRange{inside: 0, outside: 0, size: 4294967295}
+}
+
+// mapsIDs returns whether every id below limit is mapped by the id map.
+func mapsIDs(ranges []idMapRange, limit uint64) bool {
+	for next := uint64(0); next < limit; {
+		found := false
+		for _, r := range ranges {
+			if r.inside <= next && next < r.inside+r.size {
+				next = r.inside + r.size
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// readIDMap reads and parses the given id map file.
+func readIDMap(path string) ([]idMapRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open id map")
+	}
+	defer file.Close()
+	return parseIDMap(file)
+}
+
+// DetectPrivileges detects whether the current process is able to do the
+// privileged operations used by umoci when MapOptions.Rootless is not set.
+// This is based on the effective capabilities of the process and the user
+// namespace it is in (the effective uid is only informative, as a non-root
+// user may have the required capabilities and root may lack them).
+func DetectPrivileges() (Privileges, error) {
+	privileges := Privileges{
+		EUID:                os.Geteuid(),
+		MissingCapabilities: []string{},
+	}
+
+	uidMap, err := readIDMap("/proc/self/uid_map")
+	if err != nil {
+		return privileges, errors.Wrap(err, "read uid map")
+	}
+	gidMap, err := readIDMap("/proc/self/gid_map")
+	if err != nil {
+		return privileges, errors.Wrap(err, "read gid map")
+	}
+	privileges.UserNamespace = !isInitialIDMap(uidMap) || !isInitialIDMap(gidMap)
+	privileges.MappedIDs = mapsIDs(uidMap, minimumMappedIDs) && mapsIDs(gidMap, minimumMappedIDs)
+
+	caps, err := capability.NewPid(0)
+	if err != nil {
+		return privileges, errors.Wrap(err, "get capabilities")
+	}
+	for _, cap := range requiredCapabilities {
+		if !caps.Get(capability.EFFECTIVE, cap) {
+			privileges.MissingCapabilities = append(privileges.MissingCapabilities, "CAP_"+strings.ToUpper(cap.String()))
+		}
+	}
+	return privileges, nil
+}
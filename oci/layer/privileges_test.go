@@ -0,0 +1,94 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected []idMapRange
+		initial  bool
+		mapped   bool
+	}{
+		{"         0          0 4294967295\n", []idMapRange{{0, 0, 4294967295}}, true, true},
+		{"         0       1000          1\n", []idMapRange{{0, 1000, 1}}, false, false},
+		{"0 1000 1\n1 100000 65536\n", []idMapRange{{0, 1000, 1}, {1, 100000, 65536}}, false, true},
+		{"1 100000 65536\n0 1000 1\n", []idMapRange{{1, 100000, 65536}, {0, 1000, 1}}, false, true},
+		{"0 100000 1000\n2000 200000 65536\n", []idMapRange{{0, 100000, 1000}, {2000, 200000, 65536}}, false, false},
+		{"", nil, false, false},
+	} {
+		ranges, err := parseIDMap(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("parseIDMap(%q): unexpected error: %+v", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("parseIDMap(%q): expected %v, got %v", test.input, test.expected, ranges)
+		}
+		if got := isInitialIDMap(ranges); got != test.initial {
+			t.Errorf("isInitialIDMap(%q): expected %v, got %v", test.input, test.initial, got)
+		}
+		if got := mapsIDs(ranges, minimumMappedIDs); got != test.mapped {
+			t.Errorf("mapsIDs(%q): expected %v, got %v", test.input, test.mapped, got)
+		}
+	}
+
+	for _, input := range []string{"0 0\n", "0 0 abc\n", "0 0 4294967296\n"} {
+		if _, err := parseIDMap(strings.NewReader(input)); err == nil {
+			t.Errorf("parseIDMap(%q): expected error", input)
+		}
+	}
+}
+
+func TestPrivilegesRootless(t *testing.T) {
+	for _, test := range []struct {
+		privileges Privileges
+		reasons    int
+	}{
+		{Privileges{EUID: 0, MappedIDs: true}, 0},
+		{Privileges{EUID: 1000, MappedIDs: true}, 0},
+		{Privileges{EUID: 0, MappedIDs: true, UserNamespace: true}, 1},
+		{Privileges{EUID: 1000, MappedIDs: false, MissingCapabilities: []string{"CAP_CHOWN", "CAP_MKNOD"}}, 3},
+	} {
+		reasons := test.privileges.Reasons()
+		if len(reasons) != test.reasons {
+			t.Errorf("%+v: expected %d reasons, got %v", test.privileges, test.reasons, reasons)
+		}
+		if got := test.privileges.Rootless(); got != (test.reasons > 0) {
+			t.Errorf("%+v: unexpected Rootless: %v", test.privileges, got)
+		}
+	}
+}
+
+func TestDetectPrivileges(t *testing.T) {
+	privileges, err := DetectPrivileges()
+	if err != nil {
+		t.Fatalf("unexpected error detecting privileges: %+v", err)
+	}
+	if !privileges.UserNamespace && !privileges.MappedIDs {
+		t.Errorf("ids must be mapped in the initial user namespace: %+v", privileges)
+	}
+	if privileges.UserNamespace && !privileges.Rootless() {
+		t.Errorf("device nodes cannot be created in a user namespace: %+v", privileges)
+	}
+}
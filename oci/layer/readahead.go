@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// readaheadBlockSize is the size of each block read ahead of the consumer
+	// by a readahead.
+	readaheadBlockSize = 1 << 20
+
+	// readaheadBlocks is the number of blocks which a readahead will read
+	// ahead of the consumer.
+	readaheadBlocks = 4
+
+	// copyBufferSize is the size of the buffers used by pooledCopy.
+	copyBufferSize = 128 << 10
+)
+
+// Buffers are pooled so that applying a layer doesn't allocate (and then
+// garbage-collect) new buffers for every block and every file.
+var (
+	readaheadPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, readaheadBlockSize)
+			return &buf
+		},
+	}
+	copyBufferPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		},
+	}
+)
+
+// pooledCopy is equivalent to io.Copy, except that it uses a buffer from
+// copyBufferPool rather than allocating a new buffer for each copy.
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	// io.CopyBuffer ignores the buffer if dst implements io.ReaderFrom, and
+	// *os.File.ReadFrom falls back to io.Copy (which allocates) for readers
+	// that aren't files. So hide any ReadFrom method.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *bufp)
+}
+
+// readaheadBlock is a block of data read by a readahead.
+type readaheadBlock struct {
+	bufp *[]byte
+	data []byte
+	err  error
+}
+
+// readahead is an io.ReadCloser which reads from an underlying reader in a
+// separate goroutine, up to readaheadBlocks blocks ahead of the consumer. This
+// allows the (CPU-bound) work done by the underlying reader, such as gzip
+// decompression or hashing, to run in parallel with the consumer.
+type readahead struct {
+	blocks chan readaheadBlock
+	done   chan struct{}
+	cur    *readaheadBlock
+	closed bool
+}
+
+// newReadahead returns a readahead for the given reader, and starts reading
+// from it. The returned readahead must be closed, and r must not be used
+// until it has been closed.
+func newReadahead(r io.Reader) *readahead {
+	ra := &readahead{
+		blocks: make(chan readaheadBlock, readaheadBlocks),
+		done:   make(chan struct{}),
+	}
+	go ra.fill(r)
+	return ra
+}
+
+// fill reads blocks from r until it returns an error (including io.EOF) or
+// the readahead is closed.
+func (ra *readahead) fill(r io.Reader) {
+	defer close(ra.blocks)
+	for {
+		bufp := readaheadPool.Get().(*[]byte)
+		buf := *bufp
+
+		// We can't use io.ReadFull because it would mask an
+		// io.ErrUnexpectedEOF returned by r (such as from a truncated gzip
+		// stream).
+		var n int
+		var err error
+		for n < len(buf) && err == nil {
+			var m int
+			m, err = r.Read(buf[n:])
+			n += m
+		}
+
+		select {
+		case ra.blocks <- readaheadBlock{bufp: bufp, data: buf[:n], err: err}:
+		case <-ra.done:
+			readaheadPool.Put(bufp)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads data which has already been read from the underlying reader, and
+// returns the error returned by the underlying reader once all of the data
+// before it has been read.
+func (ra *readahead) Read(p []byte) (int, error) {
+	for ra.cur == nil || len(ra.cur.data) == 0 {
+		if ra.cur != nil {
+			if ra.cur.err != nil {
+				return 0, ra.cur.err
+			}
+			readaheadPool.Put(ra.cur.bufp)
+			ra.cur = nil
+		}
+		block, ok := <-ra.blocks
+		if !ok {
+			// Only possible if Read is called after Close.
+			return 0, io.ErrClosedPipe
+		}
+		ra.cur = &block
+	}
+	n := copy(p, ra.cur.data)
+	ra.cur.data = ra.cur.data[n:]
+	return n, nil
+}
+
+// Close stops reading from the underlying reader, and waits until the
+// underlying reader is no longer in use.
+func (ra *readahead) Close() error {
+	if ra.closed {
+		return nil
+	}
+	ra.closed = true
+	close(ra.done)
+	for block := range ra.blocks {
+		readaheadPool.Put(block.bufp)
+	}
+	if ra.cur != nil {
+		readaheadPool.Put(ra.cur.bufp)
+		ra.cur = nil
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadahead(t *testing.T) {
+	data := make([]byte, 3*readaheadBlockSize+1234)
+	rand.Read(data)
+
+	for _, test := range []struct {
+		name   string
+		reader func(io.Reader) io.Reader
+	}{
+		{"Plain", func(r io.Reader) io.Reader { return r }},
+		{"OneByte", iotest.OneByteReader},
+		{"HalfReader", iotest.HalfReader},
+		{"DataErr", iotest.DataErrReader},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ra := newReadahead(test.reader(bytes.NewReader(data)))
+			defer ra.Close()
+
+			got, err := ioutil.ReadAll(ra)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %+v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("readahead returned different data (%d bytes, expected %d)", len(got), len(data))
+			}
+			// EOF must be sticky.
+			if n, err := ra.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("expected (0, EOF) after EOF, got (%d, %v)", n, err)
+			}
+		})
+	}
+}
+
+func TestReadaheadError(t *testing.T) {
+	data := make([]byte, readaheadBlockSize+42)
+	rand.Read(data)
+
+	// The error must be returned only after all of the preceding data, and
+	// must not be converted to io.EOF.
+	errTest := errors.New("test error")
+	ra := newReadahead(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errTest)))
+	defer ra.Close()
+
+	got, err := ioutil.ReadAll(ra)
+	if err != errTest {
+		t.Errorf("expected %v, got %v", errTest, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("readahead returned different data before error (%d bytes, expected %d)", len(got), len(data))
+	}
+
+	ra = newReadahead(iotest.ErrReader(io.ErrUnexpectedEOF))
+	defer ra.Close()
+	if _, err := ioutil.ReadAll(ra); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+// infiniteReader is an io.Reader which never returns an error.
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestReadaheadClose(t *testing.T) {
+	// Closing before all of the data has been read must stop the reader
+	// (rather than blocking forever).
+	ra := newReadahead(infiniteReader{})
+	if _, err := io.ReadFull(ra, make([]byte, 10)); err != nil {
+		t.Fatalf("unexpected error reading: %+v", err)
+	}
+	if err := ra.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %+v", err)
+	}
+	if err := ra.Close(); err != nil {
+		t.Fatalf("unexpected error closing twice: %+v", err)
+	}
+	if _, err := ra.Read(make([]byte, 10)); err == nil {
+		t.Errorf("expected error reading after close")
+	}
+}
+
+func TestPooledCopy(t *testing.T) {
+	data := make([]byte, 3*copyBufferSize+17)
+	rand.Read(data)
+
+	var buf bytes.Buffer
+	n, err := pooledCopy(&buf, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error copying: %+v", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("pooledCopy copied different data (%d bytes, expected %d)", n, len(data))
+	}
+
+	errTest := errors.New("test error")
+	if _, err := pooledCopy(&buf, iotest.ErrReader(errTest)); err != errTest {
+		t.Errorf("expected %v, got %v", errTest, err)
+	}
+}
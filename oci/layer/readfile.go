@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ReadFile returns the contents of the regular file with the given path in
+// the root filesystem described by the given manifest, without extracting the
+// image. The layers are read from the top down, so only the layers above the
+// topmost layer containing the file are read (and verified). If the file does
+// not exist (or is hidden by a whiteout), an error satisfying os.IsNotExist is
+// returned. Symlinks are not followed, so the path must not contain any.
+func ReadFile(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string) ([]byte, error) {
+	engineExt := casext.NewEngine(engine)
+	// Paths in layers are relative to the root.
+	target := CleanPath(strings.TrimLeft(path, "/"))
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "get config blob")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return nil, errors.Errorf("read file: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("read file: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	// hides returns whether the given path (which is not the target) removes
+	// the target from lower layers, if it has the given type.
+	hides := func(name string, typeflag byte) bool {
+		dir, file := filepath.Split(name)
+		dir = filepath.Clean(dir)
+		if strings.HasPrefix(file, whPrefix) {
+			if file == whOpaque {
+				return dir == "." || strings.HasPrefix(target, dir+"/")
+			}
+			removed := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+			return removed == target || strings.HasPrefix(target, removed+"/")
+		}
+		// Replacing a parent directory with a non-directory removes the file.
+		return typeflag != tar.TypeDir && strings.HasPrefix(target, name+"/")
+	}
+
+	for idx := len(manifest.Layers) - 1; idx >= 0; idx-- {
+		var (
+			contents []byte
+			found    bool
+			hidden   bool
+			typeflag byte
+		)
+		if err := readLayerBlob(ctx, engineExt, manifest.Layers[idx], config.RootFS.DiffIDs[idx], "", false, func(layer io.Reader) error {
+			tr := tar.NewReader(layer)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+				if estargz.IsMetadataEntry(hdr.Name) {
+					continue
+				}
+				name := CleanPath(hdr.Name)
+				if name != target {
+					hidden = hidden || hides(name, hdr.Typeflag)
+					continue
+				}
+				// The last entry for the path in the layer takes effect.
+				found, typeflag, contents = true, hdr.Typeflag, nil
+				if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+					if contents, err = ioutil.ReadAll(tr); err != nil {
+						return errors.Wrapf(err, "read %s", hdr.Name)
+					}
+				}
+			}
+		}); err != nil {
+			return nil, errors.Wrapf(err, "read layer %s", manifest.Layers[idx].Digest)
+		}
+
+		if found {
+			if typeflag != tar.TypeReg && typeflag != tar.TypeRegA {
+				return nil, errors.Errorf("read file: %s is not a regular file", path)
+			}
+			return contents, nil
+		}
+		if hidden {
+			break
+		}
+	}
+	return nil, &os.PathError{Op: "read", Path: path, Err: os.ErrNotExist}
+}
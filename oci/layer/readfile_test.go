@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestReadFile(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReadFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "old passwd"},
+			{"etc/group", tar.TypeReg, 0644, "group"},
+			{"etc/removed", tar.TypeReg, 0644, "removed"},
+			{"opaque/", tar.TypeDir, 0755, ""},
+			{"opaque/file", tar.TypeReg, 0644, "hidden"},
+			{"link", tar.TypeSymlink, 0777, ""},
+		},
+		{
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "new passwd"},
+			{"etc/.wh.removed", tar.TypeReg, 0644, ""},
+			{"opaque/.wh..wh..opq", tar.TypeReg, 0644, ""},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	for _, test := range []struct {
+		path     string
+		contents string
+	}{
+		{"/etc/passwd", "new passwd"},
+		{"etc/group", "group"},
+		{"/etc/../etc/passwd", "new passwd"},
+	} {
+		contents, err := ReadFile(ctx, engine, manifest, test.path)
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %+v", test.path, err)
+			continue
+		}
+		if string(contents) != test.contents {
+			t.Errorf("unexpected contents of %s: got %q expected %q", test.path, contents, test.contents)
+		}
+	}
+
+	for _, path := range []string{"/etc/removed", "/opaque/file", "/nonexistent", "/etc/passwd/child"} {
+		if _, err := ReadFile(ctx, engine, manifest, path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to not exist, got %v", path, err)
+		}
+	}
+	if _, err := ReadFile(ctx, engine, manifest, "/link"); err == nil || os.IsNotExist(err) {
+		t.Errorf("expected an error reading a symlink, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// SocketPolicy describes how sockets in a root filesystem are handled when
+// generating a layer. Sockets cannot be represented in a tar archive, so they
+// can never be stored in a layer as-is.
+type SocketPolicy string
+
+const (
+	// SocketSkip omits sockets from the layer (with a warning).
+	SocketSkip SocketPolicy = "skip"
+
+	// SocketPlaceholder stores each socket as an empty regular file (with
+	// the mode and owner of the socket).
+	SocketPlaceholder SocketPolicy = "placeholder"
+
+	// SocketError causes layer generation to fail if any sockets have been
+	// added to the root filesystem.
+	SocketError SocketPolicy = "error"
+)
+
+// validate returns an error if the policy is not a known SocketPolicy. An
+// empty policy is equivalent to SocketSkip.
+func (p SocketPolicy) validate() error {
+	switch p {
+	case "", SocketSkip, SocketPlaceholder, SocketError:
+		return nil
+	}
+	return errors.Errorf("unknown socket policy: %s", p)
+}
+
+// socketPlaceholderInfo is an os.FileInfo for a socket which describes it as
+// an empty regular file, so that it can be stored in a layer.
+type socketPlaceholderInfo struct {
+	os.FileInfo
+}
+
+// Mode returns the mode of the socket without the socket type bit.
+func (fi socketPlaceholderInfo) Mode() os.FileMode {
+	return fi.FileInfo.Mode() &^ os.ModeSocket
+}
+
+// Size returns zero, because the placeholder has no contents.
+func (fi socketPlaceholderInfo) Size() int64 {
+	return 0
+}
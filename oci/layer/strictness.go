@@ -0,0 +1,301 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// Strictness describes how malformed entries in a layer are handled when
+// extracting it.
+type Strictness string
+
+const (
+	// StrictnessError causes extraction to fail if the layer contains any
+	// malformed entries.
+	StrictnessError Strictness = "error"
+
+	// StrictnessSkip skips malformed entries (with a warning).
+	StrictnessSkip Strictness = "skip"
+
+	// StrictnessCorrect corrects malformed entries where possible (entries
+	// which cannot be corrected are skipped).
+	StrictnessCorrect Strictness = "correct"
+)
+
+// validate returns an error if the strictness is not a known Strictness. An
+// empty strictness keeps the historical behaviour, where paths are silently
+// scoped to the root, later duplicate entries replace earlier ones, and
+// unknown entry types cause extraction to fail.
+func (s Strictness) validate() error {
+	switch s {
+	case "", StrictnessError, StrictnessSkip, StrictnessCorrect:
+		return nil
+	}
+	return errors.Errorf("unknown strictness: %s", s)
+}
+
+// IssueKind is the kind of problem found with a malformed layer entry.
+type IssueKind string
+
+const (
+	// IssueEscape is an entry whose path (or link target) refers to a path
+	// outside of the root filesystem.
+	IssueEscape IssueKind = "escape"
+
+	// IssueDuplicate is an entry with the same path as an earlier entry in
+	// the same layer.
+	IssueDuplicate IssueKind = "duplicate"
+
+	// IssueMode is an entry whose mode contains bits other than the
+	// permission and file type bits.
+	IssueMode IssueKind = "mode"
+
+	// IssueType is an entry with an unknown type.
+	IssueType IssueKind = "type"
+)
+
+// Actions taken for tolerated malformed entries.
+const (
+	// ActionSkipped means that the entry was not extracted.
+	ActionSkipped = "skipped"
+
+	// ActionCorrected means that the entry was corrected before it was
+	// extracted.
+	ActionCorrected = "corrected"
+)
+
+// ExtractionIssue describes a malformed layer entry which was tolerated.
+type ExtractionIssue struct {
+	// Path is the name of the entry in the layer.
+	Path string `json:"path"`
+
+	// Kind is what was wrong with the entry.
+	Kind IssueKind `json:"kind"`
+
+	// Action is what was done with the entry (ActionSkipped or
+	// ActionCorrected).
+	Action string `json:"action"`
+
+	// Detail is a human-readable description of the problem.
+	Detail string `json:"detail"`
+}
+
+// ExtractionReport records the malformed entries which were tolerated while
+// extracting layers. It is safe for concurrent use.
+type ExtractionReport struct {
+	mu     sync.Mutex
+	issues []ExtractionIssue
+}
+
+// NewExtractionReport creates a new empty ExtractionReport.
+func NewExtractionReport() *ExtractionReport {
+	return &ExtractionReport{}
+}
+
+// Issues returns the recorded issues, in the order they were found.
+func (r *ExtractionReport) Issues() []ExtractionIssue {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ExtractionIssue(nil), r.issues...)
+}
+
+// add records an issue.
+func (r *ExtractionReport) add(issue ExtractionIssue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.issues = append(r.issues, issue)
+}
+
+// escapeDepth walks the components of path starting from the given depth
+// below the root, and returns whether any ".." component would refer to a
+// path above the root.
+func escapeDepth(path string, depth int) bool {
+	for _, part := range strings.Split(path, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return true
+			}
+			depth--
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// pathEscapes returns whether the (root-relative) path refers to a path above
+// the root.
+func pathEscapes(path string) bool {
+	return escapeDepth(path, 0)
+}
+
+// symlinkEscapes returns whether the target of the symlink with the given
+// (cleaned) name refers to a path above the root. If it does, the equivalent
+// target inside the root is also returned.
+func symlinkEscapes(name, target string) (bool, string) {
+	dir := filepath.Dir(name)
+	if filepath.IsAbs(target) {
+		if !escapeDepth(target, 0) {
+			return false, ""
+		}
+		return true, filepath.Clean(target)
+	}
+
+	depth := 0
+	if dir != "." {
+		depth = len(strings.Split(dir, "/"))
+	}
+	if !escapeDepth(target, depth) {
+		return false, ""
+	}
+	// Lexically, ".." of the root is the root itself.
+	abs := filepath.Join("/", dir, target)
+	corrected, err := filepath.Rel(filepath.Join("/", dir), abs)
+	if err != nil {
+		return true, abs
+	}
+	return true, corrected
+}
+
+// knownTypeflag returns whether the entry type is one which can be extracted.
+func knownTypeflag(typeflag byte) bool {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse, tar.TypeDir, tar.TypeLink,
+		tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// checkEntry checks hdr for malformations, and handles them according to the
+// strictness of the extractor. If the entry should not be extracted, skip is
+// set. hdr may be modified to correct the entry.
+func (te *tarExtractor) checkEntry(hdr *tar.Header) (skip bool, Err error) {
+	if te.strictness == "" {
+		return false, nil
+	}
+
+	name := CleanPath(hdr.Name)
+	origName := hdr.Name
+
+	// tolerate handles an issue, returning whether the entry must be
+	// skipped. If the issue can be corrected, correct is called (it may be
+	// nil if the issue cannot be corrected).
+	tolerate := func(kind IssueKind, detail string, correct func()) (bool, error) {
+		switch te.strictness {
+		case StrictnessError:
+			return false, errors.Errorf("malformed entry: %s", detail)
+		case StrictnessCorrect:
+			if correct != nil {
+				correct()
+				log.Warnf("unpack layer: correcting malformed entry %s: %s", origName, detail)
+				te.reportIssue(origName, kind, ActionCorrected, detail)
+				return false, nil
+			}
+		}
+		log.Warnf("unpack layer: skipping malformed entry %s: %s", origName, detail)
+		te.reportIssue(origName, kind, ActionSkipped, detail)
+		return true, nil
+	}
+
+	checks := []func() (bool, error){
+		func() (bool, error) {
+			if !pathEscapes(hdr.Name) {
+				return false, nil
+			}
+			return tolerate(IssueEscape, fmt.Sprintf("path escapes root: %s", hdr.Name), func() {
+				hdr.Name = name
+			})
+		},
+		func() (bool, error) {
+			if hdr.Typeflag != tar.TypeLink || !pathEscapes(hdr.Linkname) {
+				return false, nil
+			}
+			return tolerate(IssueEscape, fmt.Sprintf("hardlink target escapes root: %s", hdr.Linkname), func() {
+				hdr.Linkname = CleanPath(hdr.Linkname)
+			})
+		},
+		func() (bool, error) {
+			if hdr.Typeflag != tar.TypeSymlink {
+				return false, nil
+			}
+			escapes, target := symlinkEscapes(name, hdr.Linkname)
+			if !escapes {
+				return false, nil
+			}
+			return tolerate(IssueEscape, fmt.Sprintf("symlink target escapes root: %s", hdr.Linkname), func() {
+				hdr.Linkname = target
+			})
+		},
+		func() (bool, error) {
+			if hdr.Mode >= 0 && hdr.Mode&^0177777 == 0 {
+				return false, nil
+			}
+			return tolerate(IssueMode, fmt.Sprintf("invalid mode: %#o", hdr.Mode), func() {
+				hdr.Mode &= 07777
+			})
+		},
+		func() (bool, error) {
+			// Whiteouts only use the path of the entry.
+			if strings.HasPrefix(filepath.Base(name), whPrefix) || knownTypeflag(hdr.Typeflag) {
+				return false, nil
+			}
+			return tolerate(IssueType, fmt.Sprintf("unknown typeflag '\\x%x'", hdr.Typeflag), nil)
+		},
+		func() (bool, error) {
+			if !te.seenPaths[name] {
+				te.seenPaths[name] = true
+				return false, nil
+			}
+			// Later entries replace earlier ones, just like later layers.
+			return tolerate(IssueDuplicate, "duplicate entry", func() {})
+		},
+	}
+	for _, check := range checks {
+		if skip, err := check(); skip || err != nil {
+			return skip, err
+		}
+	}
+	return false, nil
+}
+
+// reportIssue records a tolerated issue in the extraction report (if any).
+func (te *tarExtractor) reportIssue(path string, kind IssueKind, action, detail string) {
+	if te.report == nil {
+		return
+	}
+	te.report.add(ExtractionIssue{
+		Path:   path,
+		Kind:   kind,
+		Action: action,
+		Detail: detail,
+	})
+}
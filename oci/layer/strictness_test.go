@@ -0,0 +1,181 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkEscapes(t *testing.T) {
+	for _, test := range []struct {
+		name, target string
+		escapes      bool
+		corrected    string
+	}{
+		{"a/link", "target", false, ""},
+		{"a/link", "../target", false, ""},
+		{"a/b/link", "../../etc/passwd", false, ""},
+		{"a/link", "../../etc/passwd", true, "../etc/passwd"},
+		{"link", "../../../etc/shadow", true, "etc/shadow"},
+		{"a/link", "/etc/passwd", false, ""},
+		{"a/link", "/../../etc/passwd", true, "/etc/passwd"},
+		{"a/link", "b/../../../etc", true, "../etc"},
+	} {
+		escapes, corrected := symlinkEscapes(test.name, test.target)
+		if escapes != test.escapes || corrected != test.corrected {
+			t.Errorf("symlinkEscapes(%q, %q): expected (%v, %q), got (%v, %q)", test.name, test.target, test.escapes, test.corrected, escapes, corrected)
+		}
+	}
+}
+
+func TestUnpackEntryStrictness(t *testing.T) {
+	// Each of these entries is malformed in some way. They are extracted in
+	// order, after a regular file at "file".
+	file := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644}
+	malformed := []*tar.Header{
+		{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../../file"},
+		{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/passwd"},
+		{Name: "mode", Typeflag: tar.TypeReg, Mode: 01000644},
+		{Name: "unknown", Typeflag: 'Z', Mode: 0644},
+		{Name: "file", Typeflag: tar.TypeReg, Mode: 0600},
+	}
+
+	for _, test := range []struct {
+		strictness Strictness
+		err        bool
+		issues     []ExtractionIssue
+		exists     []string
+		missing    []string
+	}{
+		{
+			strictness: StrictnessError,
+			err:        true,
+		},
+		{
+			strictness: StrictnessSkip,
+			issues: []ExtractionIssue{
+				{Path: "../../escape", Kind: IssueEscape, Action: ActionSkipped},
+				{Path: "hardlink", Kind: IssueEscape, Action: ActionSkipped},
+				{Path: "dir/symlink", Kind: IssueEscape, Action: ActionSkipped},
+				{Path: "mode", Kind: IssueMode, Action: ActionSkipped},
+				{Path: "unknown", Kind: IssueType, Action: ActionSkipped},
+				{Path: "file", Kind: IssueDuplicate, Action: ActionSkipped},
+			},
+			missing: []string{"escape", "hardlink", "dir/symlink", "mode", "unknown"},
+		},
+		{
+			strictness: StrictnessCorrect,
+			issues: []ExtractionIssue{
+				{Path: "../../escape", Kind: IssueEscape, Action: ActionCorrected},
+				{Path: "hardlink", Kind: IssueEscape, Action: ActionCorrected},
+				{Path: "dir/symlink", Kind: IssueEscape, Action: ActionCorrected},
+				{Path: "mode", Kind: IssueMode, Action: ActionCorrected},
+				{Path: "unknown", Kind: IssueType, Action: ActionSkipped},
+				{Path: "file", Kind: IssueDuplicate, Action: ActionCorrected},
+			},
+			exists:  []string{"escape", "hardlink", "dir/symlink", "mode"},
+			missing: []string{"unknown"},
+		},
+	} {
+		dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryStrictness")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		report := NewExtractionReport()
+		te := newTarExtractor(UnpackOptions{
+			MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+			Strictness: test.strictness,
+			Report:     report,
+		})
+
+		for _, hdr := range append([]*tar.Header{file}, malformed...) {
+			// Copy the header, since it may be corrected.
+			hdr := *hdr
+			err = te.unpackEntry(dir, &hdr, bytes.NewBuffer(nil))
+			if err != nil {
+				break
+			}
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error unpacking malformed entries", test.strictness)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error in unpackEntry: %s", test.strictness, err)
+		}
+
+		issues := report.Issues()
+		if len(issues) != len(test.issues) {
+			t.Fatalf("%s: unexpected issues: expected %d, got %v", test.strictness, len(test.issues), issues)
+		}
+		for idx, issue := range issues {
+			expected := test.issues[idx]
+			if issue.Path != expected.Path || issue.Kind != expected.Kind || issue.Action != expected.Action {
+				t.Errorf("%s: unexpected issue %d: expected %v, got %v", test.strictness, idx, expected, issue)
+			}
+		}
+
+		for _, path := range test.exists {
+			if _, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+				t.Errorf("%s: %s should exist: %v", test.strictness, path, err)
+			}
+		}
+		for _, path := range test.missing {
+			if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+				t.Errorf("%s: %s should not exist: %v", test.strictness, path, err)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dir), "escape")); !os.IsNotExist(err) {
+			t.Errorf("%s: entry escaped the root: %v", test.strictness, err)
+		}
+	}
+
+	// The corrected entries must have been fixed.
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryStrictness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	te := newTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+		Strictness: StrictnessCorrect,
+	})
+	for _, hdr := range append([]*tar.Header{file}, malformed...) {
+		hdr := *hdr
+		if err := te.unpackEntry(dir, &hdr, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("unexpected error in unpackEntry: %s", err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "dir/symlink")); err != nil || target != "../etc/passwd" {
+		t.Errorf("symlink target was not corrected: %q %v", target, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "mode")); err != nil || fi.Mode() != 0644 {
+		t.Errorf("mode was not corrected: %v %v", fi.Mode(), err)
+	}
+}
@@ -29,29 +29,238 @@ import (
 	"github.com/apex/log"
 	"github.com/cyphar/filepath-securejoin"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
 	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 type tarExtractor struct {
 	// mapOptions is the set of mapping options to use when extracting filesystem layers.
 	mapOptions MapOptions
 
+	// onDiskFormat is the on-disk format the layer is being extracted into,
+	// which affects how whiteouts are handled.
+	onDiskFormat OnDiskFormat
+
+	// xattrFilter decides which xattrs from the layer are restored.
+	xattrFilter xattrfilter.Filter
+
+	// emulateXattrs is whether xattrs which cannot be set in rootless mode
+	// should be emulated using EmulatedXattrPrefix.
+	emulateXattrs bool
+
+	// emulateOwnership is whether the owner of each path should be recorded
+	// in the rootlesscontainers.Keyname xattr.
+	emulateOwnership bool
+
+	// devicePolicy is how devices are handled in rootless mode.
+	devicePolicy DevicePolicy
+
+	// devices records the devices which could not be created in rootless
+	// mode (if non-nil).
+	devices *DeviceRecord
+
+	// strictness is how malformed entries are handled.
+	strictness Strictness
+
+	// report records the malformed entries which were tolerated (if
+	// non-nil).
+	report *ExtractionReport
+
+	// seenPaths is the set of (cleaned) entry names in the current layer,
+	// used to detect duplicate entries.
+	seenPaths map[string]bool
+
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
+
+	// upperPaths is the set of paths (and their parent directories) which
+	// have been extracted from the current layer, which must not be removed
+	// by opaque whiteouts.
+	upperPaths map[string]bool
+
+	// dirlinkPolicy is how directories replacing symlinks are handled.
+	dirlinkPolicy DirlinkPolicy
+
+	// aufsCompat is whether AUFS-specific layer conventions are handled.
+	aufsCompat bool
+
+	// aufsLinks are the files in the AUFS hardlink directory of the current
+	// layer, keyed by their base name. Their contents are stored in
+	// aufsTempDir (which is created lazily).
+	aufsLinks   map[string]*aufsLink
+	aufsTempDir string
+
+	// inRoot is the fsEval used if extraction has been confined to the root
+	// with confine (if non-nil).
+	inRoot *fseval.InRootFsEval
 }
 
 // newTarExtractor creates a new tarExtractor.
-func newTarExtractor(opt MapOptions) *tarExtractor {
+func newTarExtractor(opt UnpackOptions) *tarExtractor {
 	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
+	if opt.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
 
+	onDiskFormat := opt.OnDiskFormat
+	if onDiskFormat == "" {
+		onDiskFormat = DirRootfs
+	}
+
+	// Device paths are only meaningful relative to the final rootfs.
+	var devices *DeviceRecord
+	if onDiskFormat == DirRootfs {
+		devices = opt.Devices
+	}
+
 	return &tarExtractor{
-		mapOptions: opt,
-		fsEval:     fsEval,
+		mapOptions:    opt.MapOptions,
+		onDiskFormat:  onDiskFormat,
+		xattrFilter:   xattrFilterOrDefault(opt.XattrFilter),
+		emulateXattrs: opt.EmulateXattrs,
+
+		emulateOwnership: opt.EmulateOwnership,
+		fsEval:           fsEval,
+		upperPaths:       map[string]bool{},
+
+		devicePolicy: opt.DevicePolicy,
+		devices:      devices,
+
+		strictness: opt.Strictness,
+		report:     opt.Report,
+		seenPaths:  map[string]bool{},
+
+		dirlinkPolicy: opt.DirlinkPolicy,
+
+		aufsCompat: opt.AUFSCompat,
+		aufsLinks:  map[string]*aufsLink{},
+	}
+}
+
+// confine makes the kernel enforce that extraction cannot escape root (using
+// fseval.InRootFsEval), so that symlinks which are swapped in during
+// extraction cannot be used to redirect writes outside of root. Rootless
+// extraction, and extraction on kernels without openat2(2), instead rely on
+// the lexical path sanitisation done by unpackEntry.
+func (te *tarExtractor) confine(root string) error {
+	if te.mapOptions.Rootless {
+		return nil
+	}
+	// The root would otherwise be created by the first entry.
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return errors.Wrap(err, "create root")
+	}
+	inRoot, err := fseval.NewInRootFsEval(root)
+	if err == fseval.ErrInRootUnsupported {
+		log.Debugf("unpack layer: %v, falling back to lexical path sanitisation", err)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "confine extraction to root")
+	}
+	te.fsEval = inRoot
+	te.inRoot = inRoot
+	return nil
+}
+
+// close releases the resources held by the extractor, and removes any
+// temporary files it created.
+func (te *tarExtractor) close() error {
+	if te.inRoot != nil {
+		te.inRoot.Close()
+	}
+	if te.aufsTempDir == "" {
+		return nil
+	}
+	return errors.Wrap(os.RemoveAll(te.aufsTempDir), "remove aufs hardlink directory")
+}
+
+// markUpper records that path (inside root) was extracted from the current
+// layer, along with all of its parent directories.
+func (te *tarExtractor) markUpper(root, path string) {
+	for ; path != root && path != "/" && path != "."; path = filepath.Dir(path) {
+		if te.upperPaths[path] {
+			break
+		}
+		te.upperPaths[path] = true
+	}
+}
+
+// recordDevice adds the device described by hdr (extracted to path inside
+// root) to the device record.
+func (te *tarExtractor) recordDevice(root, path string, hdr *tar.Header, placeholder bool) error {
+	if te.devices == nil {
+		return nil
+	}
+	dev, err := deviceFromHeader(root, path, hdr, placeholder)
+	if err != nil {
+		return err
+	}
+	te.devices.add(dev)
+	return nil
+}
+
+// forgetDevices removes path (inside root) from the device record, along with
+// any devices underneath it if recursive is set.
+func (te *tarExtractor) forgetDevices(root, path string, recursive bool) {
+	if te.devices == nil {
+		return
+	}
+	if rel, err := filepath.Rel(root, path); err == nil {
+		te.devices.forget(rel, recursive)
+	}
+}
+
+// opaqueWhiteout removes all of the contents of dir (inside root) which were
+// not extracted from the current layer, which is the effect of an opaque
+// whiteout. The timestamps of any directories inside dir are restored after
+// their contents are removed.
+func (te *tarExtractor) opaqueWhiteout(root, dir string) error {
+	children, err := te.fsEval.Readdir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "read opaque directory")
+	}
+	for _, child := range children {
+		path := filepath.Join(dir, child.Name())
+		if !te.upperPaths[path] {
+			if err := te.fsEval.RemoveAll(path); err != nil {
+				return errors.Wrap(err, "opaque whiteout remove all")
+			}
+			te.forgetDevices(root, path, true)
+			continue
+		}
+		if !child.IsDir() {
+			continue
+		}
+
+		childHdr, err := tar.FileInfoHeader(child, "")
+		if err != nil {
+			return errors.Wrap(err, "convert child to header")
+		}
+		if err := te.opaqueWhiteout(root, path); err != nil {
+			return err
+		}
+		if err := te.fsEval.Lutimes(path, childHdr.AccessTime, childHdr.ModTime); err != nil {
+			return errors.Wrap(err, "restore opaque subdirectory times")
+		}
 	}
+	return nil
+}
+
+// overlayOpaqueXattr returns the name of the xattr used by overlayfs to mark a
+// directory as opaque. Unprivileged overlayfs mounts (with the "userxattr"
+// option) use the user.* namespace because trusted.* requires CAP_SYS_ADMIN.
+func (te *tarExtractor) overlayOpaqueXattr() string {
+	if te.mapOptions.Rootless {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
 }
 
 // restoreMetadata applies the state described in tar.Header to the filesystem
@@ -69,9 +278,7 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Apply owner (only used in non-rootless case).
 	if !te.mapOptions.Rootless {
-		// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
-		//      should _probably_ be put inside FsEval.
-		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		if err := te.fsEval.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
 			return errors.Wrapf(err, "restore chown metadata: %s", path)
 		}
 	}
@@ -112,6 +319,15 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 			// This is _fine_ as long as we're not running as root (in which
 			// case we shouldn't be ignoring xattrs that we were told to set).
 			if te.mapOptions.Rootless && os.IsPermission(errors.Cause(err)) {
+				// If requested, we store the xattr in the user.* namespace so
+				// that it can be restored by GenerateLayer.
+				if te.emulateXattrs && !strings.HasPrefix(name, "user.") {
+					emulatedName := EmulatedXattrPrefix + name
+					if err := te.fsEval.Lsetxattr(path, emulatedName, []byte(value), 0); err == nil {
+						log.Debugf("restoreMetadata: emulating xattr %s as %s: %s", name, emulatedName, path)
+						continue
+					}
+				}
 				log.Warnf("restoreMetadata: ignoring EPERM on setxattr: %s: %v", name, err)
 				continue
 			}
@@ -132,20 +348,108 @@ func (te *tarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 // (not from the filesystem). No sanity checking is done of the tar.Header's
 // pathname or other information.
 func (te *tarExtractor) applyMetadata(path string, hdr *tar.Header) error {
+	// Drop any xattrs which the xattr filter doesn't permit us to restore.
+	for name := range hdr.Xattrs {
+		if !te.xattrFilter.Allowed(name) {
+			log.Debugf("unpack layer: skipping filtered xattr %s: %s", name, hdr.Name)
+			delete(hdr.Xattrs, name)
+		}
+	}
+
+	// In rootless mode every path will be owned by us, so (if requested) we
+	// record the real owner in an xattr before the header is modified. Any
+	// copy of the xattr in the layer is replaced.
+	if te.emulateOwnership {
+		delete(hdr.Xattrs, rootlesscontainers.Keyname)
+		owner := rootlesscontainers.Resource{UID: uint32(hdr.Uid), GID: uint32(hdr.Gid)}
+		if owner.UID == 0 {
+			owner.UID = rootlesscontainers.NoopID
+		}
+		if owner.GID == 0 {
+			owner.GID = rootlesscontainers.NoopID
+		}
+		if owner.UID != rootlesscontainers.NoopID || owner.GID != rootlesscontainers.NoopID {
+			if hdr.Xattrs == nil {
+				hdr.Xattrs = map[string]string{}
+			}
+			hdr.Xattrs[rootlesscontainers.Keyname] = string(rootlesscontainers.Marshal(owner))
+		}
+	}
+
 	// Modify the header.
 	if err := unmapHeader(hdr, te.mapOptions); err != nil {
 		return errors.Wrap(err, "unmap header")
 	}
 
+	// If an opaque whiteout for this directory was already extracted we must
+	// make sure that restoreMetadata doesn't clear the overlay xattr.
+	if te.onDiskFormat.overlayWhiteouts() && hdr.Typeflag == tar.TypeDir {
+		opaqueXattr := te.overlayOpaqueXattr()
+		if value, err := te.fsEval.Lgetxattr(path, opaqueXattr); err == nil {
+			if hdr.Xattrs == nil {
+				hdr.Xattrs = map[string]string{}
+			}
+			hdr.Xattrs[opaqueXattr] = string(value)
+		}
+	}
+
 	// Restore it on the filesystme.
 	return te.restoreMetadata(path, hdr)
 }
 
+// overlayWhiteout converts the whiteout entry (named file inside dir) to the
+// overlayfs representation of the same whiteout. Regular whiteouts become 0:0
+// character devices, while opaque whiteouts are converted to the overlayfs
+// opaque xattr on the parent directory. dirHdr is the header which will be
+// used to restore the metadata of dir (it may be nil).
+func (te *tarExtractor) overlayWhiteout(dir, file string, dirHdr *tar.Header) error {
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdir whiteout parent")
+	}
+
+	if file == whOpaque {
+		opaqueXattr := te.overlayOpaqueXattr()
+		if err := te.fsEval.Lsetxattr(dir, opaqueXattr, []byte("y"), 0); err != nil {
+			return errors.Wrap(err, "set overlay opaque xattr")
+		}
+		// Make sure the parent directory restore doesn't clear the xattr.
+		if dirHdr != nil {
+			if dirHdr.Xattrs == nil {
+				dirHdr.Xattrs = map[string]string{}
+			}
+			dirHdr.Xattrs[opaqueXattr] = "y"
+		}
+		return nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "remove overlay whiteout old")
+	}
+	if err := te.fsEval.Mknod(path, os.FileMode(unix.S_IFCHR), system.Makedev(0, 0)); err != nil {
+		return errors.Wrap(err, "mknod overlay whiteout")
+	}
+	return nil
+}
+
 // unpackEntry extracts the given tar.Header to the provided root, ensuring
 // that the layer state is consistent with the layer state that produced the
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
 // that represents a whiteout will result in the path being removed.
 func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (Err error) {
+	// AUFS metadata is not part of the root filesystem, and hardlinks to it
+	// have to be resolved before the entry is checked.
+	if te.aufsCompat {
+		if handled, err := te.aufsEntry(root, hdr, r); err != nil || handled {
+			return err
+		}
+	}
+
+	// Deal with any malformed entries before we touch the filesystem.
+	if skip, err := te.checkEntry(hdr); err != nil || skip {
+		return err
+	}
+
 	// Make the paths safe.
 	hdr.Name = CleanPath(hdr.Name)
 	root = filepath.Clean(root)
@@ -177,10 +481,11 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// (because we only apply state that we find in the archive we're iterating
 	// over). We can safely ignore an error here, because a non-existent
 	// directory will be fixed by later archive entries.
+	var dirHdr *tar.Header
 	if dirFi, err := te.fsEval.Lstat(dir); err == nil && path != dir {
 		// FIXME: This is really stupid.
 		link, _ := te.fsEval.Readlink(dir)
-		dirHdr, err := tar.FileInfoHeader(dirFi, link)
+		dirHdr, err = tar.FileInfoHeader(dirFi, link)
 		if err != nil {
 			return errors.Wrap(err, "convert dirFi to dirHdr")
 		}
@@ -225,9 +530,28 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// Typeflag, expecting that the path is the only thing that matters in a
 	// whiteout entry.
 	if strings.HasPrefix(file, whPrefix) {
+		// With overlayfs layers we don't remove anything, we instead convert
+		// the whiteout to the overlayfs equivalent.
+		if te.onDiskFormat.overlayWhiteouts() {
+			return te.overlayWhiteout(dir, file, dirHdr)
+		}
+
+		// An opaque whiteout removes everything in the directory which didn't
+		// come from this layer. The defer will reapply the correct parent
+		// metadata.
+		if file == whOpaque {
+			return te.opaqueWhiteout(root, dir)
+		}
+
 		file = strings.TrimPrefix(file, whPrefix)
 		path = filepath.Join(dir, file)
 
+		// AUFS layers don't order whiteouts before the paths which replace
+		// them, so whiteouts must not remove anything from the current layer.
+		if te.aufsCompat && te.upperPaths[path] {
+			return te.aufsUpperWhiteout(root, path)
+		}
+
 		// Unfortunately we can't just stat the file here, because if we hit a
 		// parent directory whiteout earlier than this one then stating here
 		// would fail. The best solution would be to keep a list of whiteouts
@@ -239,9 +563,17 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		if err := te.fsEval.RemoveAll(path); err != nil {
 			return errors.Wrap(err, "whiteout remove all")
 		}
+		te.forgetDevices(root, path, true)
 		return nil
 	}
 
+	// Later opaque whiteouts in this layer must not remove this path.
+	defer func() {
+		if Err == nil {
+			te.markUpper(root, path)
+		}
+	}()
+
 	// Get information about the path. This has to be done after we've dealt
 	// with whiteouts because it turns out that lstat(2) will return EPERM if
 	// you try to stat a whiteout on AUFS.
@@ -252,6 +584,21 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		fi = hdr.FileInfo()
 	}
 
+	// A directory replacing a symlink might instead have to be extracted to
+	// the directory the symlink points to.
+	if hdr.Typeflag == tar.TypeDir && fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		target, err := te.dirlink(root, hdr.Name, path)
+		if err != nil {
+			return err
+		}
+		if target != path {
+			path = target
+			if fi, err = te.fsEval.Lstat(path); err != nil {
+				return errors.Wrap(err, "lstat dirlink target")
+			}
+		}
+	}
+
 	// If the type of the file has changed, there's nothing we can do other
 	// than just remove the old path and replace it.
 	// XXX: Is this actually valid according to the spec? Do you need to have a
@@ -263,6 +610,10 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		}
 	}
 
+	// This entry replaces any device recorded at this path (and everything
+	// underneath it, unless an existing directory is being updated).
+	te.forgetDevices(root, path, !(hdrFi.IsDir() && fi.IsDir()))
+
 	// Attempt to create the parent directory of the path we're unpacking.
 	// We do a MkdirAll here because even though you need to have a tar entry
 	// for every component of a new path, applyMetadata will correct any
@@ -281,16 +632,32 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 	// will fix all of that for us.
 	switch hdr.Typeflag {
 	// regular file
-	case tar.TypeReg, tar.TypeRegA:
-		// Truncate file, then just copy the data.
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		// We never modify an existing file in-place, because it might be
+		// hardlinked to other paths (or to a layer cache snapshot) which
+		// must not be affected by this entry.
+		if err := te.fsEval.RemoveAll(path); err != nil {
+			return errors.Wrap(err, "remove regular old")
+		}
+
+		// Create the file, then just copy the data.
 		fh, err := te.fsEval.Create(path)
 		if err != nil {
 			return errors.Wrap(err, "create regular")
 		}
 		defer fh.Close()
 
+		// Sparse files in the archive are extracted as sparse files, by
+		// leaving holes where the file is zeroed.
+		copyFn := func(fh *os.File, r io.Reader) (int64, error) {
+			return pooledCopy(fh, r)
+		}
+		if isSparseHeader(hdr) {
+			copyFn = copySparse
+		}
+
 		// We need to make sure that we copy all of the bytes.
-		if n, err := io.Copy(fh, r); err != nil {
+		if n, err := copyFn(fh, r); err != nil {
 			return err
 		} else if int64(n) != hdr.Size {
 			return errors.Wrap(io.ErrShortWrite, "unpack to regular file")
@@ -351,8 +718,23 @@ func (te *tarExtractor) unpackEntry(root string, hdr *tar.Header, r io.Reader) (
 
 	// character device node, block device node
 	case tar.TypeChar, tar.TypeBlock:
-		// In rootless mode we have to fake this.
+		// In rootless mode we can't create devices, so we have to either fake
+		// them or skip them (depending on the device policy).
 		if te.mapOptions.Rootless {
+			switch te.devicePolicy {
+			case DeviceError:
+				return errors.Errorf("cannot create device in rootless mode")
+			case DeviceSkip:
+				log.Debugf("unpack entry: skipping device in rootless mode: %s", hdr.Name)
+				if err := te.fsEval.RemoveAll(path); err != nil {
+					return errors.Wrap(err, "remove skipped device old")
+				}
+				return te.recordDevice(root, path, hdr, false)
+			}
+
+			if err := te.recordDevice(root, path, hdr, true); err != nil {
+				return err
+			}
 			fh, err := te.fsEval.Create(path)
 			if err != nil {
 				return errors.Wrap(err, "create rootless block")
@@ -23,9 +23,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 )
@@ -64,7 +67,7 @@ func testUnpackEntrySanitiseHelper(t *testing.T, dir, file, prefix string) func(
 			ChangeTime: time.Now(),
 		}
 
-		te := newTarExtractor(MapOptions{})
+		te := newTarExtractor(UnpackOptions{})
 		if err := te.unpackEntry(rootfs, hdr, bytes.NewBuffer(ctrValue)); err != nil {
 			t.Fatalf("unexpected unpackEntry error: %s", err)
 		}
@@ -187,7 +190,7 @@ func TestUnpackEntryParentDir(t *testing.T) {
 		ChangeTime: time.Now(),
 	}
 
-	te := newTarExtractor(MapOptions{})
+	te := newTarExtractor(UnpackOptions{})
 	if err := te.unpackEntry(rootfs, hdr, bytes.NewBuffer(ctrValue)); err != nil {
 		t.Fatalf("unexpected unpackEntry error: %s", err)
 	}
@@ -202,6 +205,70 @@ func TestUnpackEntryParentDir(t *testing.T) {
 	}
 }
 
+// TestUnpackEntryNanosecondTimes makes sure that extraction keeps the full
+// (sub-second) precision of timestamps, and that a directory's timestamps are
+// not clobbered by extracting its children.
+func TestUnpackEntryNanosecondTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryNanosecondTimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := time.Unix(1500000000, 123456789)
+	entries := []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: base.Add(1), AccessTime: base.Add(2)}, ""},
+		{tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: base.Add(3), AccessTime: base.Add(4)}, "contents"},
+		{tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", ModTime: base.Add(5), AccessTime: base.Add(6)}, ""},
+		{tar.Header{Name: "dir/sub/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: base.Add(7), AccessTime: base.Add(8)}, ""},
+		{tar.Header{Name: "dir/sub/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: base.Add(9), AccessTime: base.Add(10)}, "sub"},
+		// Hardlinks don't have timestamps of their own, so this must not
+		// change the timestamps of dir/file.
+		{tar.Header{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file", ModTime: base.Add(11), AccessTime: base.Add(12)}, ""},
+	}
+
+	te := newTarExtractor(UnpackOptions{})
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Uid = os.Getuid()
+		hdr.Gid = os.Getgid()
+		hdr.Size = int64(len(entry.data))
+		if err := te.unpackEntry(dir, &hdr, bytes.NewBufferString(entry.data)); err != nil {
+			t.Fatalf("unexpected unpackEntry error with %s: %+v", hdr.Name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		path         string
+		atime, mtime time.Time
+	}{
+		{"dir", base.Add(2), base.Add(1)},
+		{"dir/file", base.Add(4), base.Add(3)},
+		{"dir/link", base.Add(6), base.Add(5)},
+		{"dir/sub", base.Add(8), base.Add(7)},
+		{"dir/sub/file", base.Add(10), base.Add(9)},
+		{"dir/hardlink", base.Add(4), base.Add(3)},
+	} {
+		fi, err := os.Lstat(filepath.Join(dir, test.path))
+		if err != nil {
+			t.Fatalf("unexpected lstat error: %s", err)
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			t.Fatalf("unexpected error converting fileinfo: %s", err)
+		}
+		if !hdr.ModTime.Equal(test.mtime) {
+			t.Errorf("mtime of %s not preserved: got='%s' expected='%s'", test.path, hdr.ModTime, test.mtime)
+		}
+		if !hdr.AccessTime.Equal(test.atime) {
+			t.Errorf("atime of %s not preserved: got='%s' expected='%s'", test.path, hdr.AccessTime, test.atime)
+		}
+	}
+}
+
 // TestUnpackEntryWhiteout checks whether whiteout handling is done correctly,
 // as well as ensuring that the metadata of the parent is maintained.
 func TestUnpackEntryWhiteout(t *testing.T) {
@@ -274,7 +341,7 @@ func TestUnpackEntryWhiteout(t *testing.T) {
 				Typeflag: tar.TypeReg,
 			}
 
-			te := newTarExtractor(MapOptions{})
+			te := newTarExtractor(UnpackOptions{})
 			if err := te.unpackEntry(dir, hdr, nil); err != nil {
 				t.Fatalf("unexpected error in unpackEntry: %s", err)
 			}
@@ -307,6 +374,225 @@ func TestUnpackEntryWhiteout(t *testing.T) {
 	}(t)
 }
 
+// TestUnpackEntryOpaqueWhiteout checks that an opaque whiteout removes all of
+// the lower-layer contents of a directory, but keeps the contents extracted
+// from the same layer (regardless of the order of the entries).
+func TestUnpackEntryOpaqueWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryOpaqueWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create the lower-layer contents.
+	for _, path := range []string{"opaque/old", "opaque/sub/old", "opaque/sub/deep/old", "other/kept"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("lower"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	te := newTarExtractor(UnpackOptions{})
+	for _, hdr := range []*tar.Header{
+		{Name: "opaque/sub/new", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "opaque/" + whOpaque, Typeflag: tar.TypeReg},
+		{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0755},
+	} {
+		if err := te.unpackEntry(dir, hdr, bytes.NewReader(nil)); err != nil {
+			t.Fatalf("unexpected error in unpackEntry(%s): %s", hdr.Name, err)
+		}
+	}
+
+	for _, path := range []string{"opaque/old", "opaque/sub/old", "opaque/sub/deep", "opaque/" + whOpaque} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("lower path was not removed by opaque whiteout: %s", path)
+		}
+	}
+	for _, path := range []string{"opaque/sub/new", "other/kept"} {
+		if _, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("path was removed by opaque whiteout: %s: %s", path, err)
+		}
+	}
+}
+
+// TestUnpackEntryOverlayWhiteout checks that whiteouts are converted to their
+// overlayfs equivalents when extracting with OverlayfsLayers.
+func TestUnpackEntryOverlayWhiteout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("overlayfs whiteouts require root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryOverlayWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	te := newTarExtractor(UnpackOptions{OnDiskFormat: OverlayfsLayers})
+
+	// A regular whiteout should become a 0:0 character device.
+	if err := te.unpackEntry(dir, &tar.Header{
+		Name:     "some/path/" + whPrefix + "file",
+		Typeflag: tar.TypeReg,
+	}, nil); err != nil {
+		t.Fatalf("unexpected error in unpackEntry: %s", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dir, "some/path/file"), &st); err != nil {
+		t.Fatalf("whiteout was not created: %s", err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout is not a 0:0 character device: mode=%o rdev=%d", st.Mode, st.Rdev)
+	}
+
+	// An opaque whiteout should set the opaque xattr on the directory, and it
+	// must survive the directory entry being extracted afterwards.
+	if err := te.unpackEntry(dir, &tar.Header{
+		Name:     "opaque/" + whOpaque,
+		Typeflag: tar.TypeReg,
+	}, nil); err != nil {
+		t.Fatalf("unexpected error in unpackEntry: %s", err)
+	}
+	if err := te.unpackEntry(dir, &tar.Header{
+		Name:     "opaque/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}, nil); err != nil {
+		t.Fatalf("unexpected error in unpackEntry: %s", err)
+	}
+
+	value, err := te.fsEval.Lgetxattr(filepath.Join(dir, "opaque"), "trusted.overlay.opaque")
+	if err != nil {
+		t.Fatalf("opaque xattr was not set: %s", err)
+	}
+	if string(value) != "y" {
+		t.Errorf("unexpected opaque xattr value: %q", string(value))
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "opaque", whOpaque)); !os.IsNotExist(err) {
+		t.Errorf("opaque whiteout was extracted as a file")
+	}
+}
+
+// TestUnpackEntryXattrFilter checks that only the xattrs permitted by the
+// xattr filter are restored when extracting an entry.
+func TestUnpackEntryXattrFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryXattrFilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unix.Lsetxattr(dir, "user.umoci-test", []byte("test"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+
+	filter, err := xattrfilter.Parse([]string{"-user.*", "+user.keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	te := newTarExtractor(UnpackOptions{XattrFilter: &filter})
+
+	if err := te.unpackEntry(dir, &tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Xattrs: map[string]string{
+			"user.keep": "kept",
+			"user.drop": "dropped",
+		},
+	}, bytes.NewBuffer(nil)); err != nil {
+		t.Fatalf("unexpected error in unpackEntry: %s", err)
+	}
+
+	path := filepath.Join(dir, "file")
+	if value, err := te.fsEval.Lgetxattr(path, "user.keep"); err != nil {
+		t.Errorf("allowed xattr was not restored: %s", err)
+	} else if string(value) != "kept" {
+		t.Errorf("unexpected xattr value: %q", string(value))
+	}
+	if _, err := te.fsEval.Lgetxattr(path, "user.drop"); err == nil {
+		t.Errorf("filtered xattr was restored")
+	}
+
+	// Without a filter, security.selinux (and only it) is dropped.
+	defaultFilter := newTarExtractor(UnpackOptions{}).xattrFilter
+	if got := defaultFilter.Rules(); !reflect.DeepEqual(got, []string{"-security.selinux"}) {
+		t.Errorf("unexpected default extraction rules: %v", got)
+	}
+	if defaultFilter.Allowed("security.selinux") {
+		t.Errorf("security.selinux is restored by default")
+	}
+	for _, name := range []string{"security.capability", "user.keep", "trusted.overlay.opaque", "system.posix_acl_access"} {
+		if !defaultFilter.Allowed(name) {
+			t.Errorf("%s is dropped by default", name)
+		}
+	}
+}
+
+// TestUnpackEntryEmulateOwnership checks that the owner of each entry is
+// recorded in the rootlesscontainers xattr when emulating ownership.
+func TestUnpackEntryEmulateOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryEmulateOwnership")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unix.Lsetxattr(dir, "user.umoci-test", []byte("test"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+
+	te := newTarExtractor(UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    true,
+		},
+		EmulateOwnership: true,
+	})
+
+	for _, test := range []struct {
+		name     string
+		uid, gid int
+		expected []byte
+	}{
+		{"root", 0, 0, nil},
+		{"user", 1000, 0, rootlesscontainers.Marshal(rootlesscontainers.Resource{UID: 1000, GID: rootlesscontainers.NoopID})},
+		{"group", 0, 100, rootlesscontainers.Marshal(rootlesscontainers.Resource{UID: rootlesscontainers.NoopID, GID: 100})},
+		{"both", 1000, 100, rootlesscontainers.Marshal(rootlesscontainers.Resource{UID: 1000, GID: 100})},
+	} {
+		if err := te.unpackEntry(dir, &tar.Header{
+			Name:     test.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Uid:      test.uid,
+			Gid:      test.gid,
+			// Any copy of the xattr in the layer must be replaced.
+			Xattrs: map[string]string{
+				rootlesscontainers.Keyname: "bogus",
+			},
+		}, bytes.NewBuffer(nil)); err != nil {
+			t.Fatalf("%s: unexpected error in unpackEntry: %s", test.name, err)
+		}
+
+		value, err := te.fsEval.Lgetxattr(filepath.Join(dir, test.name), rootlesscontainers.Keyname)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: unexpected emulated owner xattr: %x", test.name, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: emulated owner xattr not set: %s", test.name, err)
+		} else if !bytes.Equal(value, test.expected) {
+			t.Errorf("%s: unexpected emulated owner xattr: expected %x, got %x", test.name, test.expected, value)
+		}
+	}
+}
+
 // TestUnpackHardlink makes sure that hardlinks are correctly unpacked in all
 // cases. In particular when it comes to hardlinks to symlinks.
 func TestUnpackHardlink(t *testing.T) {
@@ -327,7 +613,7 @@ func TestUnpackHardlink(t *testing.T) {
 		hardFileB = "hard link to symlink"
 	)
 
-	te := newTarExtractor(MapOptions{})
+	te := newTarExtractor(UnpackOptions{})
 
 	// Regular file.
 	hdr = &tar.Header{
@@ -489,9 +775,11 @@ func TestUnpackEntryMap(t *testing.T) {
 				symDir   = "link-dir"
 			)
 
-			te := newTarExtractor(MapOptions{
-				UIDMappings: []rspec.LinuxIDMapping{test.uidMap},
-				GIDMappings: []rspec.LinuxIDMapping{test.gidMap},
+			te := newTarExtractor(UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{test.uidMap},
+					GIDMappings: []rspec.LinuxIDMapping{test.gidMap},
+				},
 			})
 
 			// Regular file.
@@ -613,3 +901,277 @@ func TestUnpackEntryMap(t *testing.T) {
 		}
 	}(t)
 }
+
+func TestUnpackEntryDevicePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy      DevicePolicy
+		placeholder bool
+	}{
+		{"", true},
+		{DevicePlaceholder, true},
+		{DeviceSkip, false},
+		{DeviceError, false},
+	} {
+		dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryDevicePolicy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		devices := NewDeviceRecord(nil)
+		te := newTarExtractor(UnpackOptions{
+			MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+				GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+				Rootless:    true,
+			},
+			DevicePolicy: test.policy,
+			Devices:      devices,
+		})
+
+		err = te.unpackEntry(dir, &tar.Header{
+			Name:     "dev/null",
+			Typeflag: tar.TypeChar,
+			Mode:     0666,
+			Devmajor: 1,
+			Devminor: 3,
+		}, bytes.NewBuffer(nil))
+		if test.policy == DeviceError {
+			if err == nil {
+				t.Errorf("%s: expected error unpacking device", test.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error in unpackEntry: %s", test.policy, err)
+		}
+
+		fi, err := os.Lstat(filepath.Join(dir, "dev/null"))
+		if test.placeholder {
+			if err != nil {
+				t.Errorf("%s: placeholder not created: %s", test.policy, err)
+			} else if !fi.Mode().IsRegular() || fi.Size() != 0 || fi.Mode().Perm() != 0666 {
+				t.Errorf("%s: unexpected placeholder: mode=%s size=%d", test.policy, fi.Mode(), fi.Size())
+			}
+		} else if !os.IsNotExist(err) {
+			t.Errorf("%s: skipped device should not exist: %v", test.policy, err)
+		}
+
+		expected := []Device{{Path: "dev/null", Type: "char", Major: 1, Minor: 3, Placeholder: test.placeholder}}
+		if got := devices.Devices(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: unexpected device record: expected %v, got %v", test.policy, expected, got)
+		}
+	}
+}
+
+func TestUnpackEntryDeviceRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryDeviceRecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+	devices := NewDeviceRecord(nil)
+
+	// Each layer is extracted with a new extractor, but the record is shared
+	// between them.
+	for idx, layer := range [][]*tar.Header{
+		{
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "a/char", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 1, Devminor: 3},
+			{Name: "a/block", Typeflag: tar.TypeBlock, Mode: 0644, Devmajor: 8, Devminor: 0},
+			{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "b/char", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 5, Devminor: 1},
+			{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "c/char", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 4, Devminor: 0},
+			{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "d/char", Typeflag: tar.TypeChar, Mode: 0644, Devmajor: 4, Devminor: 1},
+		},
+		{
+			// Updating a directory keeps the devices inside it.
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0700},
+			{Name: "a/.wh.block", Typeflag: tar.TypeReg},
+			{Name: "b/.wh..wh..opq", Typeflag: tar.TypeReg},
+			{Name: "c/char", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: ".wh.d", Typeflag: tar.TypeReg},
+		},
+	} {
+		te := newTarExtractor(UnpackOptions{
+			MapOptions: mapOptions,
+			Devices:    devices,
+		})
+		for _, hdr := range layer {
+			if err := te.unpackEntry(dir, hdr, bytes.NewBuffer(nil)); err != nil {
+				t.Fatalf("layer %d: unexpected error unpacking %s: %s", idx, hdr.Name, err)
+			}
+		}
+	}
+
+	expected := []Device{{Path: "a/char", Type: "char", Major: 1, Minor: 3, Placeholder: true}}
+	if got := devices.Devices(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected device record: expected %v, got %v", expected, got)
+	}
+}
+
+// TestUnpackEntryConfined makes sure that extraction cannot be redirected
+// outside of the root by swapping a directory for a symlink after the path has
+// been sanitised.
+func TestUnpackEntryConfined(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("confined extraction requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryConfined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	te := newTarExtractor(UnpackOptions{})
+	defer te.close()
+	if err := te.confine(root); err != nil {
+		t.Fatalf("unexpected error confining extractor: %+v", err)
+	}
+	if te.inRoot == nil {
+		t.Skip("openat2 not supported")
+	}
+
+	if err := te.unpackEntry(root, &tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755}, bytes.NewBuffer(nil)); err != nil {
+		t.Fatalf("unexpected error unpacking sub/: %+v", err)
+	}
+
+	// Swap the directory for a symlink to outside of the root (which also
+	// exists inside the root).
+	if err := os.Remove(filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, outside), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The symlink must be resolved inside the root.
+	fh, err := te.fsEval.Create(filepath.Join(root, "sub", "file"))
+	if err != nil {
+		t.Fatalf("unexpected error in Create: %+v", err)
+	}
+	fh.Close()
+	if err := te.fsEval.MkdirAll(filepath.Join(root, "sub", "a", "b"), 0755); err != nil {
+		t.Errorf("unexpected error in MkdirAll: %+v", err)
+	}
+	for _, path := range []string{"file", "a"} {
+		if _, err := os.Lstat(filepath.Join(outside, path)); !os.IsNotExist(err) {
+			t.Errorf("path escaped root: %s", path)
+		}
+		if _, err := os.Lstat(filepath.Join(root, outside, path)); err != nil {
+			t.Errorf("path wasn't created inside root: %s", path)
+		}
+	}
+
+	// Paths outside the root are rejected outright.
+	if err := te.fsEval.Mkdir(filepath.Join(outside, "c"), 0755); err == nil {
+		t.Errorf("expected an error creating a path outside of root")
+	}
+}
+
+func TestUnpackEntryDirlinkPolicy(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    true,
+	}
+
+	for _, test := range []struct {
+		policy DirlinkPolicy
+		fail   bool
+		// Whether the symlinks are still symlinks after extraction.
+		relLink, absLink, danglingLink bool
+	}{
+		{"", false, false, false, false},
+		{DirlinkReplace, false, false, false, false},
+		{DirlinkFollow, false, true, true, false},
+		{DirlinkError, true, false, false, false},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestUnpackEntryDirlinkPolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := os.MkdirAll(filepath.Join(dir, "usr", "lib"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("usr/lib", filepath.Join(dir, "lib")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("/usr/lib", filepath.Join(dir, "lib64")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("nonexistent", filepath.Join(dir, "dangling")); err != nil {
+				t.Fatal(err)
+			}
+
+			te := newTarExtractor(UnpackOptions{
+				MapOptions:    mapOptions,
+				DirlinkPolicy: test.policy,
+			})
+			var unpackErr error
+			for _, hdr := range []*tar.Header{
+				{Name: "lib/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "lib/a", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "lib64/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "lib64/b", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "dangling/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "dangling/c", Typeflag: tar.TypeReg, Mode: 0644},
+			} {
+				if unpackErr = te.unpackEntry(dir, hdr, bytes.NewBuffer(nil)); unpackErr != nil {
+					break
+				}
+			}
+			if test.fail {
+				if unpackErr == nil {
+					t.Fatalf("expected an error replacing a symlink")
+				}
+				return
+			}
+			if unpackErr != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", unpackErr)
+			}
+
+			for _, link := range []struct {
+				name, child, target string
+				isLink              bool
+			}{
+				{"lib", "a", "usr/lib", test.relLink},
+				{"lib64", "b", "usr/lib", test.absLink},
+				{"dangling", "c", "nonexistent", test.danglingLink},
+			} {
+				fi, err := os.Lstat(filepath.Join(dir, link.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isLink := fi.Mode()&os.ModeSymlink == os.ModeSymlink; isLink != link.isLink {
+					t.Errorf("%s: expected symlink=%v, got mode %s", link.name, link.isLink, fi.Mode())
+				}
+				_, err = os.Lstat(filepath.Join(dir, link.target, link.child))
+				if exists := err == nil; exists != link.isLink {
+					t.Errorf("%s: expected %s to exist=%v", link.name, link.child, link.isLink)
+				}
+			}
+		})
+	}
+}
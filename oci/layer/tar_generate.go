@@ -22,23 +22,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
 	"github.com/pkg/errors"
 )
 
-// ignoreXattrList is a list of xattr names that should be ignored when
-// creating a new image layer, because they are host-specific and/or would be a
-// bad idea to unpack.
-// XXX: Maybe we should make this configurable so users can manually blacklist
-//      (or even whitelist) xattrs that they actually want included? Like how
-//      GNU tar's xattr setup works.
-var ignoreXattrList = map[string]struct{}{
-	// SELinux doesn't allow you to set SELinux policies generically. They're
-	// also host-specific. So just ignore them during extraction.
-	"security.selinux": {},
+// inodeKey uniquely identifies an inode on the host.
+type inodeKey struct {
+	dev, ino uint64
 }
 
 // tarGenerator is a helper for generating layer diff tars. It should be noted
@@ -47,12 +43,58 @@ var ignoreXattrList = map[string]struct{}{
 type tarGenerator struct {
 	tw *tar.Writer
 
+	// w is the underlying writer of tw.
+	w io.Writer
+
 	// mapOptions is the set of mapping options for modifying entries before
 	// they're added to the layer.
 	mapOptions MapOptions
 
-	// Hardlink mapping.
-	inodes map[uint64]string
+	// xattrFilter decides which xattrs are included in the layer.
+	xattrFilter xattrfilter.Filter
+
+	// emulateXattrs is whether xattrs emulated with EmulatedXattrPrefix
+	// should be included in the layer as their real xattr names.
+	emulateXattrs bool
+
+	// emulateOwnership is whether the owner of each path should be taken from
+	// its rootlesscontainers.Keyname xattr.
+	emulateOwnership bool
+
+	// sparse is whether files with holes should be stored as sparse files.
+	sparse bool
+
+	// reproducible is whether host-specific header fields should be omitted.
+	reproducible bool
+
+	// clampTime is the latest timestamp permitted in the layer (if non-nil).
+	clampTime *time.Time
+
+	// socketPolicy is how sockets are handled.
+	socketPolicy SocketPolicy
+
+	// setuidPolicy is how setuid and setgid bits are handled.
+	setuidPolicy SetuidPolicy
+
+	// modeMask is the set of permission bits permitted in the layer (if
+	// non-nil).
+	modeMask *os.FileMode
+
+	// rewrite is called for each path added to the layer (if non-nil).
+	rewrite RewriteFunc
+
+	// metadataOnly is how metadata-only changes of files at least
+	// metadataOnlyMinSize bytes large are handled.
+	metadataOnly        MetadataOnlyPolicy
+	metadataOnlyMinSize int64
+
+	// devices is the set of devices recorded by a rootless unpack, keyed by
+	// their cleaned path.
+	devices map[string]Device
+
+	// Hardlink mapping, from the (device, inode) of a file with more than one
+	// link to the first name it was added to the archive with.
+	inodes map[inodeKey]string
 
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
@@ -63,17 +105,38 @@ type tarGenerator struct {
 
 // newTarGenerator creates a new tarGenerator using the provided writer as the
 // output writer.
-func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
+func newTarGenerator(w io.Writer, opt RepackOptions) *tarGenerator {
 	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
+	if opt.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
 
+	devices := map[string]Device{}
+	for _, dev := range opt.Devices {
+		devices[CleanPath(dev.Path)] = dev
+	}
+
 	return &tarGenerator{
-		tw:         tar.NewWriter(w),
-		mapOptions: opt,
-		inodes:     map[uint64]string{},
-		fsEval:     fsEval,
+		tw:            tar.NewWriter(w),
+		w:             w,
+		mapOptions:    opt.MapOptions,
+		xattrFilter:   xattrFilterOrDefault(opt.XattrFilter),
+		emulateXattrs: opt.EmulateXattrs,
+		sparse:        opt.Sparse,
+		reproducible:  opt.Reproducible,
+		clampTime:     opt.ClampTime,
+		socketPolicy:  opt.SocketPolicy,
+		setuidPolicy:  opt.SetuidPolicy,
+		modeMask:      opt.ModeMask,
+		rewrite:       opt.Rewrite,
+		inodes:        map[inodeKey]string{},
+		fsEval:        fsEval,
+
+		metadataOnly:        opt.MetadataOnly,
+		metadataOnlyMinSize: opt.MetadataOnlyMinSize,
+
+		emulateOwnership: opt.EmulateOwnership,
+		devices:          devices,
 	}
 }
 
@@ -115,6 +178,22 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 		return errors.Wrap(err, "add file lstat")
 	}
 
+	// Sockets cannot be stored in a tar archive, so they are handled
+	// according to the socket policy.
+	isSocket := fi.Mode()&os.ModeSocket == os.ModeSocket
+	if isSocket {
+		switch tg.socketPolicy {
+		case SocketError:
+			return errors.Errorf("cannot add socket to layer: %s", name)
+		case SocketPlaceholder:
+			log.Debugf("generate layer: adding placeholder for socket: %s", name)
+			fi = socketPlaceholderInfo{fi}
+		default:
+			log.Warnf("generate layer: skipping socket: %s", name)
+			return nil
+		}
+	}
+
 	linkname := ""
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		if linkname, err = tg.fsEval.Readlink(path); err != nil {
@@ -158,27 +237,45 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	if err != nil {
 		return errors.Wrap(err, "get xattr list")
 	}
-	for _, name := range names {
+	for _, rawName := range names {
+		// The emulated owner is applied to the header below.
+		if tg.emulateOwnership && rawName == rootlesscontainers.Keyname {
+			continue
+		}
+
+		// If we are emulating xattrs, the emulated copy of an xattr is
+		// included under its real name (unless the real xattr is also set, in
+		// which case the real xattr takes precedence).
+		name := rawName
+		if tg.emulateXattrs && strings.HasPrefix(name, EmulatedXattrPrefix) {
+			name = strings.TrimPrefix(name, EmulatedXattrPrefix)
+			if containsString(names, name) {
+				continue
+			}
+		}
+
 		// Some xattrs need to be skipped for sanity reasons, such as
 		// security.selinux, because they are very much host-specific and
-		// carrying them to other hosts would be a really bad idea.
-		if _, ignore := ignoreXattrList[name]; ignore {
+		// carrying them to other hosts would be a really bad idea. Which
+		// xattrs are skipped is decided by the configured xattr filter.
+		if !tg.xattrFilter.Allowed(name) {
+			log.Debugf("generate layer: skipping filtered xattr %s: %s", name, hdr.Name)
 			continue
 		}
 
-		value, err := tg.fsEval.Lgetxattr(path, name)
+		value, err := tg.fsEval.Lgetxattr(path, rawName)
 		if err != nil {
 			// XXX: I'm not sure if we're unprivileged whether Lgetxattr can
 			//      fail with EPERM. If it can, we should ignore it (like when
 			//      we try to clear xattrs).
-			return errors.Wrapf(err, "get xattr: %s", name)
+			return errors.Wrapf(err, "get xattr: %s", rawName)
 		}
 		// https://golang.org/issues/20698 -- We don't just error out here
 		// because it's not _really_ a fatal error. Currently it's unclear
 		// whether the stdlib will correctly handle reading or disable writing
 		// of these PAX headers so we have to track this ourselves.
 		if len(value) <= 0 {
-			log.Warnf("ignoring empty-valued xattr %s: disallowed by PAX standard", name)
+			log.Warnf("ignoring empty-valued xattr %s: disallowed by PAX standard", rawName)
 			continue
 		}
 		hdr.Xattrs[name] = string(value)
@@ -186,33 +283,109 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 
 	// Not all systems have the concept of an inode, but I'm not in the mood to
 	// handle this in a way that makes anything other than GNU/Linux happy
-	// right now. Handle hardlinks.
-	if oldpath, ok := tg.inodes[statx.Ino]; ok {
-		// We just hit a hardlink, so we just have to change the header.
-		hdr.Typeflag = tar.TypeLink
-		hdr.Linkname = oldpath
-		hdr.Size = 0
-	} else {
-		tg.inodes[statx.Ino] = name
+	// right now. Handle hardlinks. Directories cannot be hardlinked, and
+	// inodes with only one link cannot have been added before.
+	if !fi.IsDir() && statx.Nlink > 1 {
+		key := inodeKey{dev: uint64(statx.Dev), ino: uint64(statx.Ino)}
+		if oldpath, ok := tg.inodes[key]; ok {
+			// We just hit a hardlink, so we just have to change the header.
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = oldpath
+			hdr.Size = 0
+		} else {
+			tg.inodes[key] = name
+		}
+	}
+
+	// Placeholders for devices which couldn't be created by a rootless unpack
+	// are converted back into the recorded devices, as long as they are still
+	// empty regular files.
+	if dev, ok := tg.devices[CleanPath(name)]; ok && dev.Placeholder && hdr.Typeflag == tar.TypeReg && hdr.Size == 0 {
+		hdr.Typeflag = dev.typeflag()
+		hdr.Devmajor, hdr.Devminor = dev.Major, dev.Minor
 	}
 
 	// Apply any header mappings.
 	if err := mapHeader(hdr, tg.mapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
+
+	// If we are emulating ownership, the owner recorded in the xattr takes
+	// precedence over the (already mapped) owner of the path.
+	if tg.emulateOwnership && containsString(names, rootlesscontainers.Keyname) {
+		value, err := tg.fsEval.Lgetxattr(path, rootlesscontainers.Keyname)
+		if err != nil {
+			return errors.Wrapf(err, "get xattr: %s", rootlesscontainers.Keyname)
+		}
+		owner, err := rootlesscontainers.Unmarshal(value)
+		if err != nil {
+			return errors.Wrapf(err, "parse emulated owner: %s", path)
+		}
+		if owner.UID != rootlesscontainers.NoopID {
+			hdr.Uid = int(owner.UID)
+			hdr.Uname = ""
+		}
+		if owner.GID != rootlesscontainers.NoopID {
+			hdr.Gid = int(owner.GID)
+			hdr.Gname = ""
+		}
+	}
+
+	// Give the rewrite hook a chance to modify the entry. This is done before
+	// the header is normalised so that the hook cannot bypass any of the
+	// policies applied to the layer.
+	var content io.ReadCloser
+	if tg.rewrite != nil {
+		content, err = tg.rewrite(hdr, path)
+		if err != nil {
+			return errors.Wrapf(err, "rewrite %s", name)
+		}
+		if content != nil {
+			defer content.Close()
+			if hdr.Typeflag != tar.TypeReg {
+				return errors.Errorf("rewrite %s: cannot substitute the content of a non-regular file", name)
+			}
+		}
+	}
+
+	tg.normaliseHeader(hdr)
+	if err := tg.applyModePolicy(hdr); err != nil {
+		return err
+	}
+
+	// Regular files with holes are stored as sparse files (if requested).
+	if tg.sparse && hdr.Typeflag == tar.TypeReg && !isSocket && content == nil {
+		fh, err := tg.fsEval.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open file")
+		}
+		defer fh.Close()
+
+		regions, err := sparseDataRegions(fh, hdr.Size)
+		if err != nil {
+			return errors.Wrap(err, "find sparse regions")
+		}
+		if regions != nil {
+			return tg.writeSparseFile(hdr, fh, regions)
+		}
+	}
+
 	if err := tg.tw.WriteHeader(hdr); err != nil {
 		return errors.Wrap(err, "write header")
 	}
 
-	// Write the contents of regular files.
-	if hdr.Typeflag == tar.TypeReg {
+	// Write the contents of regular files (socket placeholders are empty, and
+	// sockets cannot be opened anyway), unless they were substituted.
+	if content == nil && hdr.Typeflag == tar.TypeReg && !isSocket {
 		fh, err := tg.fsEval.Open(path)
 		if err != nil {
 			return errors.Wrap(err, "open file")
 		}
 		defer fh.Close()
-
-		n, err := io.Copy(tg.tw, fh)
+		content = fh
+	}
+	if content != nil {
+		n, err := io.Copy(tg.tw, content)
 		if err != nil {
 			return errors.Wrap(err, "copy to layer")
 		}
@@ -224,8 +397,40 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	return nil
 }
 
+// normaliseHeader modifies the header to remove any information which would
+// make the generated layer depend on the host or the time it was generated
+// (as configured for the tarGenerator), and makes sure that the format of the
+// header can store the rest of the information.
+func (tg *tarGenerator) normaliseHeader(hdr *tar.Header) {
+	if tg.reproducible {
+		// The user and group names are looked up on the host.
+		hdr.Uname = ""
+		hdr.Gname = ""
+	}
+	if tg.clampTime != nil && hdr.ModTime.After(*tg.clampTime) {
+		hdr.ModTime = *tg.clampTime
+	}
+
+	// The atime and ctime are changed by merely reading the rootfs (and the
+	// ctime cannot be restored), so they are never included in the layer.
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+
+	// Unless the format is explicitly PAX, the stdlib rounds the mtime to the
+	// nearest second. Sub-second mtimes can only be stored in a PAX header, so
+	// we only request one if it is needed (the stdlib still picks the most
+	// compatible format for everything else, such as long names).
+	if hdr.ModTime.Nanosecond() != 0 {
+		hdr.Format = tar.FormatPAX
+	}
+}
+
 const whPrefix = ".wh."
 
+// whOpaque is the name of an opaque whiteout, which indicates that all of the
+// lower-layer contents of the directory it is placed in should be removed.
+const whOpaque = whPrefix + whPrefix + ".opq"
+
 // AddWhiteout adds a whiteout file for the given name inside the tar archive.
 // It's not recommended to add a file with AddFile and then white it out.
 func (tg *tarGenerator) AddWhiteout(name string) error {
@@ -236,8 +441,32 @@ func (tg *tarGenerator) AddWhiteout(name string) error {
 
 	// Create the explicit whiteout for the file.
 	dir, file := filepath.Split(name)
-	whiteout := filepath.Join(dir, whPrefix+file)
+	return tg.addWhiteoutEntry(filepath.Join(dir, whPrefix+file))
+}
+
+// AddOpaqueWhiteout adds an opaque whiteout inside the given directory in the
+// tar archive, which removes all of the lower-layer contents of the directory.
+// Any paths inside the directory added with AddFile are retained.
+func (tg *tarGenerator) AddOpaqueWhiteout(dir string) error {
+	dir, err := normalise(dir, false)
+	if err != nil {
+		return errors.Wrap(err, "normalise path")
+	}
+	return tg.addWhiteoutEntry(filepath.Join(dir, whOpaque))
+}
+
+// addWhiteoutEntry adds an empty whiteout entry with the given (already
+// normalised) name to the tar archive.
+func (tg *tarGenerator) addWhiteoutEntry(whiteout string) error {
 	timestamp := time.Now()
+	if tg.reproducible {
+		// The timestamp of a whiteout is meaningless, so make sure it doesn't
+		// depend on when the layer was generated.
+		timestamp = time.Unix(0, 0)
+	}
+	if tg.clampTime != nil && timestamp.After(*tg.clampTime) {
+		timestamp = *tg.clampTime
+	}
 
 	// Add a dummy header for the whiteout file.
 	if err := tg.tw.WriteHeader(&tar.Header{
@@ -28,6 +28,10 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/openSUSE/umoci/pkg/rootlesscontainers"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 func TestTarGenerateAddFileNormal(t *testing.T) {
@@ -54,7 +58,7 @@ func TestTarGenerateAddFileNormal(t *testing.T) {
 		Size:       int64(len(data)),
 	}
 
-	te := newTarExtractor(MapOptions{})
+	te := newTarExtractor(UnpackOptions{})
 	if err := ioutil.WriteFile(path, data, 0777); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
@@ -62,7 +66,7 @@ func TestTarGenerateAddFileNormal(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, RepackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -148,7 +152,7 @@ func TestTarGenerateAddFileDirectory(t *testing.T) {
 		Size:       0,
 	}
 
-	te := newTarExtractor(MapOptions{})
+	te := newTarExtractor(UnpackOptions{})
 	if err := os.Mkdir(path, 0777); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
@@ -156,7 +160,7 @@ func TestTarGenerateAddFileDirectory(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, RepackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -235,7 +239,7 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 		Size:       0,
 	}
 
-	te := newTarExtractor(MapOptions{})
+	te := newTarExtractor(UnpackOptions{})
 	if err := os.Symlink(linkname, path); err != nil {
 		t.Fatalf("unexpected error creating file to add: %s", err)
 	}
@@ -243,7 +247,7 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, RepackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -327,7 +331,7 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		"dir/.",
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, RepackOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the whiteout entries in a goroutine so we can parse the
@@ -377,3 +381,404 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+// TestTarGenerateEmulatedXattrs checks that xattrs emulated with
+// EmulatedXattrPrefix are included in the layer using their real names.
+func TestTarGenerateEmulatedXattrs(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateEmulatedXattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error creating file to add: %s", err)
+	}
+	if err := unix.Lsetxattr(path, EmulatedXattrPrefix+"security.capability", []byte("emulated"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+
+	tg := newTarGenerator(writer, RepackOptions{EmulateXattrs: true})
+	tr := tar.NewReader(reader)
+
+	go func() {
+		if err := tg.AddFile("file", path); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", path, err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if value, ok := hdr.Xattrs["security.capability"]; !ok || value != "emulated" {
+		t.Errorf("emulated xattr not included as security.capability: %v", hdr.Xattrs)
+	}
+	if _, ok := hdr.Xattrs[EmulatedXattrPrefix+"security.capability"]; ok {
+		t.Errorf("emulated xattr included under its emulated name: %v", hdr.Xattrs)
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		t.Errorf("read all: unexpected error: %s", err)
+	}
+}
+
+// TestTarGenerateHardlink checks that hardlinked files are added to the layer
+// as hardlinks, and that extracting the layer recreates the hardlinks.
+func TestTarGenerateHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("some hardlinked data")
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "a"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(rootfs, "a"), filepath.Join(rootfs, "dir", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "c"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, RepackOptions{})
+	for _, name := range []string{"a", "c", "dir", "dir/b"} {
+		if err := tg.AddFile(name, filepath.Join(rootfs, name)); err != nil {
+			t.Fatalf("AddFile: %s: unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	extractDir := filepath.Join(dir, "extract")
+	te := newTarExtractor(UnpackOptions{})
+	tr := tar.NewReader(&layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+
+		switch hdr.Name {
+		case "dir/b":
+			if hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a" {
+				t.Errorf("expected dir/b to be a hardlink to a: got typeflag=%c linkname=%q", hdr.Typeflag, hdr.Linkname)
+			}
+		case "a", "c":
+			if hdr.Typeflag != tar.TypeReg {
+				t.Errorf("expected %s to be a regular file: got typeflag=%c", hdr.Name, hdr.Typeflag)
+			}
+		}
+
+		if err := te.unpackEntry(extractDir, hdr, tr); err != nil {
+			t.Fatalf("unexpected error in unpackEntry: %s", err)
+		}
+	}
+
+	var stA, stB, stC unix.Stat_t
+	if err := unix.Lstat(filepath.Join(extractDir, "a"), &stA); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lstat(filepath.Join(extractDir, "dir", "b"), &stB); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lstat(filepath.Join(extractDir, "c"), &stC); err != nil {
+		t.Fatal(err)
+	}
+	if stA.Ino != stB.Ino || stA.Nlink != 2 {
+		t.Errorf("hardlink was not recreated: a=%d (nlink=%d) dir/b=%d", stA.Ino, stA.Nlink, stB.Ino)
+	}
+	if stA.Ino == stC.Ino || stC.Nlink != 1 {
+		t.Errorf("unrelated file was hardlinked: a=%d c=%d (nlink=%d)", stA.Ino, stC.Ino, stC.Nlink)
+	}
+}
+
+// TestTarGenerateEmulatedOwnership checks that the owner recorded in the
+// rootlesscontainers xattr is used when emulating ownership.
+func TestTarGenerateEmulatedOwnership(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateEmulatedOwnership")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("unexpected error creating file to add: %s", err)
+	}
+	owner := rootlesscontainers.Resource{UID: 1000, GID: rootlesscontainers.NoopID}
+	if err := unix.Lsetxattr(path, rootlesscontainers.Keyname, rootlesscontainers.Marshal(owner), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+
+	tg := newTarGenerator(writer, RepackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    true,
+		},
+		EmulateOwnership: true,
+	})
+	tr := tar.NewReader(reader)
+
+	go func() {
+		if err := tg.AddFile("file", path); err != nil {
+			t.Errorf("AddFile: %s: unexpected error: %s", path, err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if hdr.Uid != 1000 || hdr.Gid != 0 {
+		t.Errorf("emulated owner not used: expected 1000:0, got %d:%d", hdr.Uid, hdr.Gid)
+	}
+	if _, ok := hdr.Xattrs[rootlesscontainers.Keyname]; ok {
+		t.Errorf("emulated owner xattr included in layer: %v", hdr.Xattrs)
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		t.Errorf("read all: unexpected error: %s", err)
+	}
+}
+
+func TestTarGenerateDevicePlaceholder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateDevicePlaceholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"char":     "",
+		"block":    "",
+		"modified": "data",
+		"regular":  "",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("unexpected error creating file to add: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, RepackOptions{
+		Devices: []Device{
+			{Path: "char", Type: "char", Major: 1, Minor: 3, Placeholder: true},
+			{Path: "block", Type: "block", Major: 8, Minor: 1, Placeholder: true},
+			{Path: "modified", Type: "char", Major: 1, Minor: 5, Placeholder: true},
+			{Path: "regular", Type: "char", Major: 1, Minor: 7},
+		},
+	})
+	for _, name := range []string{"block", "char", "modified", "regular"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("AddFile: %s: unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+	tr := tar.NewReader(&buf)
+
+	for _, expected := range []tar.Header{
+		{Name: "block", Typeflag: tar.TypeBlock, Devmajor: 8, Devminor: 1},
+		{Name: "char", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+		// Placeholders which have been modified are left as regular files.
+		{Name: "modified", Typeflag: tar.TypeReg},
+		// Skipped devices don't have a placeholder.
+		{Name: "regular", Typeflag: tar.TypeReg},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Name != expected.Name || hdr.Typeflag != expected.Typeflag || hdr.Devmajor != expected.Devmajor || hdr.Devminor != expected.Devminor {
+			t.Errorf("unexpected header: expected %s (%c %d:%d), got %s (%c %d:%d)", expected.Name, expected.Typeflag, expected.Devmajor, expected.Devminor, hdr.Name, hdr.Typeflag, hdr.Devmajor, hdr.Devminor)
+		}
+		if hdr.Mode&0777 != 0600 {
+			t.Errorf("%s: unexpected mode: %o", hdr.Name, hdr.Mode)
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			t.Errorf("read all: unexpected error: %s", err)
+		}
+	}
+}
+
+func TestTarGenerateSocketPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateSocketPolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "socket")
+	if err := unix.Mknod(socket, unix.S_IFSOCK|0600, 0); err != nil {
+		t.Fatalf("unexpected error creating socket: %s", err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0640); err != nil {
+		t.Fatalf("unexpected error creating fifo: %s", err)
+	}
+
+	for _, test := range []struct {
+		policy   SocketPolicy
+		fail     bool
+		expected []tar.Header
+	}{
+		{"", false, []tar.Header{{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0640}}},
+		{SocketSkip, false, []tar.Header{{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0640}}},
+		{SocketPlaceholder, false, []tar.Header{
+			{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0640},
+			{Name: "socket", Typeflag: tar.TypeReg, Mode: 0600},
+		}},
+		{SocketError, true, nil},
+	} {
+		t.Run(string(test.policy), func(t *testing.T) {
+			var buf bytes.Buffer
+			tg := newTarGenerator(&buf, RepackOptions{SocketPolicy: test.policy})
+			if err := tg.AddFile("fifo", fifo); err != nil {
+				t.Fatalf("AddFile: fifo: unexpected error: %s", err)
+			}
+			err := tg.AddFile("socket", socket)
+			if test.fail {
+				if err == nil {
+					t.Errorf("AddFile: socket: expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddFile: socket: unexpected error: %s", err)
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %s", err)
+			}
+
+			var got []tar.Header
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("reading tar archive: %s", err)
+				}
+				if hdr.Size != 0 {
+					t.Errorf("%s: unexpected size: %d", hdr.Name, hdr.Size)
+				}
+				got = append(got, tar.Header{Name: hdr.Name, Typeflag: hdr.Typeflag, Mode: hdr.Mode & 0777})
+			}
+			if len(got) != len(test.expected) {
+				t.Fatalf("unexpected entries: expected %v, got %v", test.expected, got)
+			}
+			for idx, hdr := range got {
+				expected := test.expected[idx]
+				if hdr.Name != expected.Name || hdr.Typeflag != expected.Typeflag || hdr.Mode != expected.Mode {
+					t.Errorf("unexpected header: expected %s (%c %o), got %s (%c %o)", expected.Name, expected.Typeflag, expected.Mode, hdr.Name, hdr.Typeflag, hdr.Mode)
+				}
+			}
+		})
+	}
+}
+
+func TestTarGenerateModePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateModePolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, mode := range map[string]os.FileMode{
+		"setuid":  0755 | os.ModeSetuid,
+		"setgid":  0750 | os.ModeSetgid,
+		"regular": 0777,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("unexpected error creating file to add: %s", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("unexpected error chmoding file to add: %s", err)
+		}
+	}
+	if err := os.Symlink("regular", filepath.Join(dir, "symlink")); err != nil {
+		t.Fatalf("unexpected error creating symlink to add: %s", err)
+	}
+	names := []string{"regular", "setgid", "setuid", "symlink"}
+
+	mask := os.FileMode(0755)
+	for _, test := range []struct {
+		name     string
+		policy   SetuidPolicy
+		mask     *os.FileMode
+		fail     bool
+		expected []int64
+	}{
+		{"Default", "", nil, false, []int64{0777, 02750, 04755, 0777}},
+		{"Keep", SetuidKeep, nil, false, []int64{0777, 02750, 04755, 0777}},
+		{"Strip", SetuidStrip, nil, false, []int64{0777, 0750, 0755, 0777}},
+		{"Error", SetuidError, nil, true, nil},
+		{"Mask", "", &mask, false, []int64{0755, 02750, 04755, 0777}},
+		{"StripMask", SetuidStrip, &mask, false, []int64{0755, 0750, 0755, 0777}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tg := newTarGenerator(&buf, RepackOptions{
+				SetuidPolicy: test.policy,
+				ModeMask:     test.mask,
+			})
+			for _, name := range names {
+				if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+					if test.fail {
+						return
+					}
+					t.Fatalf("AddFile: %s: unexpected error: %s", name, err)
+				}
+			}
+			if test.fail {
+				t.Fatalf("expected an error adding setuid files")
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %s", err)
+			}
+
+			tr := tar.NewReader(&buf)
+			for idx, name := range names {
+				hdr, err := tr.Next()
+				if err != nil {
+					t.Fatalf("reading tar archive: %s", err)
+				}
+				if hdr.Name != name {
+					t.Errorf("unexpected entry: expected %s, got %s", name, hdr.Name)
+				}
+				if hdr.Mode != test.expected[idx] {
+					t.Errorf("%s: unexpected mode: expected %o, got %o", hdr.Name, test.expected[idx], hdr.Mode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// paxLibarchiveXattr is the prefix of the PAX records used to store xattrs by
+// libarchive (bsdtar). The rest of the key is the percent-encoded xattr name,
+// and the value is base64-encoded (usually without padding). The stdlib only
+// understands the SCHILY.xattr.* records used by GNU tar (among others).
+const paxLibarchiveXattr = "LIBARCHIVE.xattr."
+
+// readPAXXattrs fills hdr.Xattrs with all of the xattrs stored in the PAX
+// extended header of the entry. The stdlib only understands the SCHILY.xattr.*
+// records, so any LIBARCHIVE.xattr.* records are decoded here. libarchive
+// writes each xattr in both forms (using the same percent-encoded name for
+// both records), in which case the LIBARCHIVE.xattr.* record is used because
+// its name and value are unambiguous.
+func readPAXXattrs(hdr *tar.Header) error {
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxLibarchiveXattr) {
+			continue
+		}
+		encodedName := strings.TrimPrefix(key, paxLibarchiveXattr)
+		name, err := url.PathUnescape(encodedName)
+		if err != nil {
+			return errors.Wrapf(err, "decode pax record %s name", key)
+		}
+		decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return errors.Wrapf(err, "decode pax record %s value", key)
+		}
+
+		if hdr.Xattrs == nil {
+			hdr.Xattrs = map[string]string{}
+		}
+		// The stdlib has already added the SCHILY.xattr.* copy (if any).
+		delete(hdr.Xattrs, encodedName)
+		hdr.Xattrs[name] = string(decoded)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadPAXXattrs(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		records  map[string]string
+		expected map[string]string
+		failure  bool
+	}{
+		{"None", map[string]string{"comment": "no xattrs"}, nil, false},
+		{"Schily", map[string]string{
+			"SCHILY.xattr.user.test": "value",
+		}, map[string]string{"user.test": "value"}, false},
+		{"Libarchive", map[string]string{
+			"LIBARCHIVE.xattr.user.test":           "dmFsdWU",
+			"LIBARCHIVE.xattr.user.with%20spa":     "c3BhY2U=",
+			"LIBARCHIVE.xattr.security.capability": "AQAAAgAgAAAAAAAAAAAAAAAAAAA",
+		}, map[string]string{
+			"user.test":           "value",
+			"user.with spa":       "space",
+			"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		}, false},
+		// This is what bsdtar generates.
+		{"Both", map[string]string{
+			"SCHILY.xattr.user.foo":              "bar baz",
+			"LIBARCHIVE.xattr.user.foo":          "YmFyIGJheg",
+			"SCHILY.xattr.user.with%20space":     "\x00\x01",
+			"LIBARCHIVE.xattr.user.with%20space": "AAE",
+			"SCHILY.xattr.user.schily":           "only",
+		}, map[string]string{
+			"user.foo":        "bar baz",
+			"user.with space": "\x00\x01",
+			"user.schily":     "only",
+		}, false},
+		{"BadName", map[string]string{"LIBARCHIVE.xattr.user.%zz": "dmFsdWU"}, nil, true},
+		{"BadValue", map[string]string{"LIBARCHIVE.xattr.user.test": "!!!"}, nil, true},
+	} {
+		// Round-trip the records through the stdlib, so that hdr.Xattrs is
+		// filled as it would be when reading a layer.
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:       "file",
+			Typeflag:   tar.TypeReg,
+			Format:     tar.FormatPAX,
+			PAXRecords: test.records,
+		}); err != nil {
+			t.Fatalf("%s: write header: %v", test.name, err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("%s: read header: %v", test.name, err)
+		}
+
+		err = readPAXXattrs(hdr)
+		if test.failure {
+			if err == nil {
+				t.Errorf("%s: expected an error, got xattrs %v", test.name, hdr.Xattrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(hdr.Xattrs, test.expected) {
+			t.Errorf("%s: expected xattrs %v, got %v", test.name, test.expected, hdr.Xattrs)
+		}
+	}
+}
+
+// TestUnpackLayerLibarchiveXattrs checks that xattrs stored by libarchive are
+// restored when unpacking a layer.
+func TestUnpackLayerLibarchiveXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerLibarchiveXattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := unix.Lsetxattr(dir, "user.umoci-test", []byte("test"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Uid:      os.Geteuid(),
+		Gid:      os.Getegid(),
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			"LIBARCHIVE.xattr.user.libarchive": "dmFsdWU",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnpackLayer(dir, &layer, nil); err != nil {
+		t.Fatalf("unexpected error in UnpackLayer: %v", err)
+	}
+
+	value, err := unix.Lgetxattr(filepath.Join(dir, "file"), "user.libarchive", make([]byte, 64))
+	if err != nil {
+		t.Errorf("libarchive xattr was not restored: %v", err)
+	} else if value != len("value") {
+		t.Errorf("unexpected libarchive xattr size: %d", value)
+	}
+}
+
+// TestTarGeneratePAXRoundTrip checks that long paths, long link targets and
+// sub-second modification times are preserved when generating a layer and
+// extracting it again.
+func TestTarGeneratePAXRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGeneratePAXRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	longDir := filepath.Join(strings.Repeat("long-directory-name/", 10), strings.Repeat("d", 100))
+	longName := filepath.Join(longDir, strings.Repeat("f", 200))
+	longTarget := strings.Repeat("../", 40) + strings.Repeat("t", 150)
+	mtime := time.Unix(1234567890, 123456789)
+	wholeMtime := time.Unix(1234567890, 0)
+
+	if err := os.MkdirAll(filepath.Join(source, longDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, longName), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(longTarget, filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(source, "whole"), []byte("whole"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(source, longName), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(source, "whole"), wholeMtime, wholeMtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, RepackOptions{})
+	for _, name := range []string{longName, "link", "whole"} {
+		if err := tg.AddFile(name, filepath.Join(source, name)); err != nil {
+			t.Fatalf("AddFile %s: unexpected error: %v", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the headers.
+	tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar archive: %v", err)
+		}
+		switch hdr.Name {
+		case longName:
+			if !hdr.ModTime.Equal(mtime) {
+				t.Errorf("%s: expected mtime %v, got %v", hdr.Name, mtime, hdr.ModTime)
+			}
+		case "link":
+			if hdr.Linkname != longTarget {
+				t.Errorf("%s: expected link target %q, got %q", hdr.Name, longTarget, hdr.Linkname)
+			}
+		case "whole":
+			// Whole-second mtimes don't need a PAX header.
+			if hdr.Format != tar.FormatUSTAR {
+				t.Errorf("%s: unexpected format %v", hdr.Name, hdr.Format)
+			}
+		default:
+			t.Errorf("unexpected entry in layer: %s", hdr.Name)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: atime and ctime should not be included: %v %v", hdr.Name, hdr.AccessTime, hdr.ChangeTime)
+		}
+	}
+
+	// Extract the layer again.
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(target, bytes.NewReader(layer.Bytes()), &UnpackOptions{
+		MapOptions: MapOptions{Rootless: os.Geteuid() != 0},
+	}); err != nil {
+		t.Fatalf("unexpected error in UnpackLayer: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(target, longName))
+	if err != nil {
+		t.Fatalf("long path was not extracted: %v", err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("expected extracted mtime %v, got %v", mtime, fi.ModTime())
+	}
+	if linkname, err := os.Readlink(filepath.Join(target, "link")); err != nil {
+		t.Errorf("long symlink was not extracted: %v", err)
+	} else if linkname != longTarget {
+		t.Errorf("expected extracted link target %q, got %q", longTarget, linkname)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The Go stdlib can read sparse files (in all of the GNU formats), but it has
+// no support for writing them. So we have to generate the PAX headers for the
+// GNU 1.0 sparse format ourselves (see the GNU tar manual, "Storing Sparse
+// Files", for a description of the format).
+
+// sparseEntry describes a Length-sized data region at Offset in a file.
+type sparseEntry struct {
+	Offset, Length int64
+}
+
+const (
+	// tarBlockSize is the size of a tar block.
+	tarBlockSize = 512
+
+	// sparseCopyChunk is the size of chunks checked for holes when extracting
+	// sparse files.
+	sparseCopyChunk = 4096
+
+	// ustarMaxID is the largest uid or gid which can be stored in a USTAR
+	// header (a 7-digit octal number).
+	ustarMaxID = 07777777
+
+	// seekData and seekHole are the whence values for lseek(2) to find data
+	// and holes in a file (the vendored golang.org/x/sys doesn't have them).
+	seekData = 3
+	seekHole = 4
+
+	// ustarMaxName is the longest name which can be stored in a USTAR header
+	// without using the prefix field.
+	ustarMaxName = 100
+)
+
+// sparseDataRegions returns the set of data regions in the given file of the
+// given size, as reported by SEEK_DATA and SEEK_HOLE. If the file has no
+// holes (or the filesystem doesn't support hole detection) nil is returned.
+func sparseDataRegions(fh *os.File, size int64) ([]sparseEntry, error) {
+	// Make sure we always leave the file offset at the start of the file.
+	defer fh.Seek(0, io.SeekStart)
+
+	var (
+		fd       = int(fh.Fd())
+		regions  []sparseEntry
+		dataSize int64
+	)
+	for offset := int64(0); offset < size; {
+		dataStart, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			// The rest of the file is a hole.
+			break
+		} else if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			// SEEK_DATA is not supported.
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "seek data")
+		}
+		if dataStart >= size {
+			break
+		}
+		dataEnd, err := unix.Seek(fd, dataStart, seekHole)
+		if err != nil {
+			return nil, errors.Wrap(err, "seek hole")
+		}
+		if dataEnd > size {
+			dataEnd = size
+		}
+		regions = append(regions, sparseEntry{Offset: dataStart, Length: dataEnd - dataStart})
+		dataSize += dataEnd - dataStart
+		offset = dataEnd
+	}
+
+	// Not a sparse file.
+	if dataSize == size {
+		return nil, nil
+	}
+	// The GNU format requires the map to describe the whole file, so if the
+	// file ends in a hole we need to add an empty region at the end.
+	if len(regions) == 0 || regions[len(regions)-1].Offset+regions[len(regions)-1].Length != size {
+		regions = append(regions, sparseEntry{Offset: size, Length: 0})
+	}
+	return regions, nil
+}
+
+// formatPAXRecord formats a single PAX record ("%d %s=%s\n").
+func formatPAXRecord(key, value string) string {
+	size := len(key) + len(value) + 3
+	size += len(strconv.Itoa(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, key, value)
+	if len(record) != size {
+		// Adding the size field increased the size of the record.
+		record = fmt.Sprintf("%d %s=%s\n", len(record), key, value)
+	}
+	return record
+}
+
+// isASCII returns whether the string is made up of only printable ASCII.
+func isASCII(s string) bool {
+	for _, c := range s {
+		if c < 0x20 || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// rawPAXHeader returns the raw tar blocks for a PAX extended header containing
+// the given (already formatted) records.
+func rawPAXHeader(records string) []byte {
+	var blk [tarBlockSize]byte
+	copy(blk[0:100], "././@PaxHeader")
+	copy(blk[100:108], "0000644\x00")
+	copy(blk[108:116], "0000000\x00")
+	copy(blk[116:124], "0000000\x00")
+	copy(blk[124:136], fmt.Sprintf("%011o\x00", len(records)))
+	copy(blk[136:148], "00000000000\x00")
+	blk[156] = tar.TypeXHeader
+	copy(blk[257:263], "ustar\x00")
+	copy(blk[263:265], "00")
+
+	// The checksum is computed with the checksum field filled with spaces.
+	copy(blk[148:156], "        ")
+	var chksum int64
+	for _, c := range blk {
+		chksum += int64(c)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", chksum))
+
+	buf := append(blk[:], records...)
+	if pad := len(records) % tarBlockSize; pad != 0 {
+		buf = append(buf, make([]byte, tarBlockSize-pad)...)
+	}
+	return buf
+}
+
+// writeSparseFile writes hdr (which must be a regular file) and the contents
+// of fh to the archive using the GNU 1.0 sparse format, only storing the given
+// data regions of the file.
+func (tg *tarGenerator) writeSparseFile(hdr *tar.Header, fh *os.File, regions []sparseEntry) error {
+	// Generate the sparse map, which is stored at the start of the data.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	var dataSize int64
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.Offset, region.Length)
+		dataSize += region.Length
+	}
+	if pad := sparseMap.Len() % tarBlockSize; pad != 0 {
+		sparseMap.Write(make([]byte, tarBlockSize-pad))
+	}
+
+	// Everything that doesn't fit into a USTAR header must be stored in the
+	// extended header, because the stdlib would otherwise generate a second
+	// extended header (which would override ours).
+	records := []string{
+		formatPAXRecord("GNU.sparse.major", "1"),
+		formatPAXRecord("GNU.sparse.minor", "0"),
+		formatPAXRecord("GNU.sparse.name", hdr.Name),
+		formatPAXRecord("GNU.sparse.realsize", strconv.FormatInt(hdr.Size, 10)),
+	}
+	realHdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		ModTime:  hdr.ModTime.Truncate(time.Second),
+		Size:     int64(sparseMap.Len()) + dataSize,
+		Format:   tar.FormatUSTAR,
+	}
+	if hdr.Uid > ustarMaxID {
+		records = append(records, formatPAXRecord("uid", strconv.Itoa(hdr.Uid)))
+		realHdr.Uid = 0
+	}
+	if hdr.Gid > ustarMaxID {
+		records = append(records, formatPAXRecord("gid", strconv.Itoa(hdr.Gid)))
+		realHdr.Gid = 0
+	}
+	if len(hdr.Uname) > 32 || !isASCII(hdr.Uname) {
+		records = append(records, formatPAXRecord("uname", hdr.Uname))
+		realHdr.Uname = ""
+	}
+	if len(hdr.Gname) > 32 || !isASCII(hdr.Gname) {
+		records = append(records, formatPAXRecord("gname", hdr.Gname))
+		realHdr.Gname = ""
+	}
+	if hdr.ModTime.Nanosecond() != 0 {
+		records = append(records, formatPAXRecord("mtime", fmt.Sprintf("%d.%09d", hdr.ModTime.Unix(), hdr.ModTime.Nanosecond())))
+	}
+	for name, value := range hdr.Xattrs {
+		records = append(records, formatPAXRecord("SCHILY.xattr."+name, value))
+	}
+	// Make the output deterministic.
+	sort.Strings(records[4:])
+
+	// The name in the USTAR header is only used by implementations which
+	// don't support the sparse format (GNU.sparse.name contains the real
+	// name), so it just needs to be a valid USTAR name.
+	dir, file := path.Split(hdr.Name)
+	realHdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+	if len(realHdr.Name) > ustarMaxName || !isASCII(realHdr.Name) {
+		realHdr.Name = "GNUSparseFile.0/sparse"
+	}
+
+	// Write our extended header directly to the output (making sure that
+	// anything buffered by tar.Writer has been written first).
+	if err := tg.tw.Flush(); err != nil {
+		return errors.Wrap(err, "flush tar writer")
+	}
+	if _, err := tg.w.Write(rawPAXHeader(strings.Join(records, ""))); err != nil {
+		return errors.Wrap(err, "write sparse pax header")
+	}
+	if err := tg.tw.WriteHeader(realHdr); err != nil {
+		return errors.Wrap(err, "write sparse header")
+	}
+
+	// Write the sparse map followed by the data regions.
+	if _, err := tg.tw.Write(sparseMap.Bytes()); err != nil {
+		return errors.Wrap(err, "write sparse map")
+	}
+	for _, region := range regions {
+		if _, err := fh.Seek(region.Offset, io.SeekStart); err != nil {
+			return errors.Wrap(err, "seek to data region")
+		}
+		n, err := io.CopyN(tg.tw, fh, region.Length)
+		if err != nil {
+			return errors.Wrap(err, "copy data region to layer")
+		}
+		if n != region.Length {
+			return errors.Wrap(io.ErrShortWrite, "copy data region to layer")
+		}
+	}
+	return nil
+}
+
+// isSparseHeader returns whether the given header (as read by tar.Reader)
+// described a sparse file in the archive.
+func isSparseHeader(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// copySparse copies the contents of r to fh, creating holes in fh rather than
+// writing any chunks which are entirely zero. Returns the number of bytes
+// copied (including holes).
+func copySparse(fh *os.File, r io.Reader) (int64, error) {
+	var (
+		n    int64
+		buf  = make([]byte, sparseCopyChunk)
+		zero = make([]byte, sparseCopyChunk)
+	)
+	for {
+		m, err := io.ReadFull(r, buf)
+		if m > 0 {
+			if bytes.Equal(buf[:m], zero[:m]) {
+				if _, err := fh.Seek(int64(m), io.SeekCurrent); err != nil {
+					return n, errors.Wrap(err, "seek over hole")
+				}
+			} else if _, err := fh.Write(buf[:m]); err != nil {
+				return n, errors.Wrap(err, "write data")
+			}
+			n += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+	}
+	// If the file ends with a hole, we need to extend it to its full size.
+	if err := fh.Truncate(n); err != nil {
+		return n, errors.Wrap(err, "truncate to size")
+	}
+	return n, nil
+}
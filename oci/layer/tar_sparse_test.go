@@ -0,0 +1,119 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTarGenerateSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateSparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 4 << 20
+	data := []byte("some data in the middle of a sparse file")
+
+	// Create a file which is a hole except for some data in the middle.
+	path := filepath.Join(dir, "sparse")
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteAt(data, size/2); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	regions, err := sparseDataRegions(fh, size)
+	fh.Close()
+	if err != nil {
+		t.Fatalf("unexpected error finding sparse regions: %s", err)
+	}
+	if regions == nil {
+		t.Skip("filesystem doesn't support SEEK_DATA and SEEK_HOLE")
+	}
+
+	var layer bytes.Buffer
+	tg := newTarGenerator(&layer, RepackOptions{Sparse: true})
+	if err := tg.AddFile("some/sparse", path); err != nil {
+		t.Fatalf("AddFile: unexpected error: %s", err)
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+	if layer.Len() >= size {
+		t.Errorf("sparse file was not stored sparsely: layer is %d bytes", layer.Len())
+	}
+
+	// Make sure that the stdlib reads the file correctly.
+	tr := tar.NewReader(bytes.NewReader(layer.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if hdr.Name != "some/sparse" {
+		t.Errorf("unexpected name: expected %s, got %s", "some/sparse", hdr.Name)
+	}
+	if hdr.Size != size {
+		t.Errorf("unexpected size: expected %d, got %d", size, hdr.Size)
+	}
+	if !isSparseHeader(hdr) {
+		t.Errorf("header was not detected as sparse")
+	}
+
+	// Extract it and make sure the contents and sparseness are preserved.
+	extractDir := filepath.Join(dir, "extract")
+	te := newTarExtractor(UnpackOptions{})
+	if err := te.unpackEntry(extractDir, hdr, tr); err != nil {
+		t.Fatalf("unexpected error in unpackEntry: %s", err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected only one entry in archive: %v", err)
+	}
+
+	extractPath := filepath.Join(extractDir, "some/sparse")
+	got, err := ioutil.ReadFile(extractPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, size)
+	copy(expected[size/2:], data)
+	if !bytes.Equal(got, expected) {
+		t.Errorf("extracted sparse file has incorrect contents")
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(extractPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= size {
+		t.Errorf("extracted file is not sparse: %d blocks allocated", st.Blocks)
+	}
+}
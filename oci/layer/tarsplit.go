@@ -0,0 +1,300 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/pkg/estargz"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// TarSplitName is the name of the directory inside the bundle path which
+// contains the tar-split metadata of each layer, when unpacking with
+// UnpackOptions.TarSplit.
+const TarSplitName = "tar-split"
+
+// TarSplitPath returns the path of the tar-split metadata for the layer with
+// the given DiffID inside the bundle.
+func TarSplitPath(bundle string, diffID digest.Digest) string {
+	return filepath.Join(bundle, TarSplitName, LayerDirName(diffID)+".json.gz")
+}
+
+// tarSplitEntry is a single entry in the tar-split metadata of a layer. The
+// metadata is a (gzip-compressed) stream of JSON entries which, when
+// concatenated, reproduce the uncompressed layer byte-for-byte. Each entry is
+// either a segment of the raw archive (headers, padding, trailing data and
+// the contents of any entries which are not plain regular files) or a
+// reference to the contents of a regular file, which are read from the
+// extracted root filesystem.
+type tarSplitEntry struct {
+	// Segment is raw data from the archive.
+	Segment []byte `json:"segment,omitempty"`
+
+	// Name is the name of the regular file (as given in the archive) whose
+	// contents are referenced by this entry.
+	Name string `json:"name,omitempty"`
+
+	// Size is the size of the file contents.
+	Size int64 `json:"size,omitempty"`
+
+	// Digest is the digest of the file contents.
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+// recordReader is an io.Reader which records all of the data read through it
+// while record is set.
+type recordReader struct {
+	r      io.Reader
+	record bool
+	buf    []byte
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if rr.record {
+		rr.buf = append(rr.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// writeTarSplit reads the uncompressed layer from r and writes its tar-split
+// metadata to w.
+func writeTarSplit(w io.Writer, r io.Reader) error {
+	rr := &recordReader{r: r, record: true}
+	enc := json.NewEncoder(w)
+	flush := func() error {
+		if len(rr.buf) == 0 {
+			return nil
+		}
+		segment := rr.buf
+		rr.buf = nil
+		return errors.Wrap(enc.Encode(tarSplitEntry{Segment: segment}), "write segment")
+	}
+
+	tr := tar.NewReader(rr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		// Only the contents of plain regular files are stored in the root
+		// filesystem exactly as they are in the archive. Anything else (such
+		// as sparse files or eStargz metadata) is included in the next
+		// segment when tar.Reader skips over it.
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) || hdr.Size == 0 ||
+			isSparseHeader(hdr) || estargz.IsMetadataEntry(hdr.Name) {
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		rr.record = false
+		digester := digest.SHA256.Digester()
+		size, err := io.Copy(digester.Hash(), tr)
+		if err != nil {
+			return errors.Wrapf(err, "read file contents: %s", hdr.Name)
+		}
+		rr.record = true
+
+		if err := enc.Encode(tarSplitEntry{
+			Name:   hdr.Name,
+			Size:   size,
+			Digest: digester.Digest(),
+		}); err != nil {
+			return errors.Wrap(err, "write file entry")
+		}
+	}
+	// Include any trailing data after the end of the archive.
+	if _, err := io.Copy(ioutil.Discard, rr); err != nil {
+		return errors.Wrap(err, "read trailing data")
+	}
+	return flush()
+}
+
+// tarSplitWriter is an io.WriteCloser which generates the tar-split metadata
+// of the uncompressed layer written to it.
+type tarSplitWriter struct {
+	pipe  *io.PipeWriter
+	done  chan error
+	close func() error
+}
+
+// newTarSplitWriter returns a tarSplitWriter which writes the tar-split
+// metadata to w. Writes to the tarSplitWriter never fail because of an
+// invalid archive, instead the error is returned by Close.
+func newTarSplitWriter(w io.Writer) *tarSplitWriter {
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := writeTarSplit(w, pipeReader)
+		// Consume the rest of the layer if we hit an error.
+		_, _ = io.Copy(ioutil.Discard, pipeReader)
+		done <- err
+	}()
+	return &tarSplitWriter{pipe: pipeWriter, done: done}
+}
+
+// createTarSplit returns a tarSplitWriter which writes the (gzip-compressed)
+// tar-split metadata to a new file at the given path.
+func createTarSplit(path string) (*tarSplitWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "mkdir tar-split")
+	}
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "create tar-split metadata")
+	}
+	gzw := gzip.NewWriter(fh)
+	tw := newTarSplitWriter(gzw)
+	tw.close = func() error {
+		if err := gzw.Close(); err != nil {
+			fh.Close()
+			return err
+		}
+		return fh.Close()
+	}
+	return tw, nil
+}
+
+func (tw *tarSplitWriter) Write(p []byte) (int, error) {
+	return tw.pipe.Write(p)
+}
+
+// Close finishes generating the tar-split metadata, returning any error which
+// occurred while generating it.
+func (tw *tarSplitWriter) Close() error {
+	tw.pipe.Close()
+	err := <-tw.done
+	if tw.close != nil {
+		if closeErr := tw.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReassembleLayer regenerates the uncompressed layer with the given DiffID,
+// which was extracted to the given bundle by UnpackManifest with
+// UnpackOptions.TarSplit, and writes it to w. The layer is reassembled from
+// its tar-split metadata and the contents of the files in the bundle, so the
+// result is byte-for-byte identical to the original layer (this is verified
+// against the DiffID). An error is returned if any of the files in the layer
+// have since been modified or removed.
+//
+// Note that only the uncompressed layer is reproduced. Whether compressing it
+// results in the original layer blob depends on the compressor used.
+func ReassembleLayer(w io.Writer, bundle string, diffID digest.Digest, opt *MapOptions) error {
+	var mapOptions MapOptions
+	if opt != nil {
+		mapOptions = *opt
+	}
+	fsEval := fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	metadataFile, err := os.Open(TarSplitPath(bundle, diffID))
+	if err != nil {
+		return errors.Wrap(err, "open tar-split metadata")
+	}
+	defer metadataFile.Close()
+	metadata, err := gzip.NewReader(metadataFile)
+	if err != nil {
+		return errors.Wrap(err, "create gzip reader")
+	}
+	defer metadata.Close()
+
+	// With OverlayfsLayers the layer has its own directory, otherwise its
+	// files are in the rootfs.
+	root := filepath.Join(bundle, LayersName, LayerDirName(diffID))
+	if _, err := os.Lstat(root); err != nil {
+		root = filepath.Join(bundle, RootfsName)
+	}
+
+	layerDigester := digest.SHA256.Digester()
+	w = io.MultiWriter(w, layerDigester.Hash())
+
+	dec := json.NewDecoder(metadata)
+	for {
+		var entry tarSplitEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "read tar-split metadata")
+		}
+
+		if entry.Name == "" {
+			if _, err := w.Write(entry.Segment); err != nil {
+				return errors.Wrap(err, "write segment")
+			}
+			continue
+		}
+		if err := reassembleFile(w, fsEval, root, entry); err != nil {
+			return errors.Wrapf(err, "reassemble file: %s", entry.Name)
+		}
+	}
+
+	if layerDigest := layerDigester.Digest(); layerDigest != diffID {
+		return errors.Errorf("reassembled layer diffid mismatch: got %s expected %s", layerDigest, diffID)
+	}
+	log.Debugf("reassembled layer %s", diffID)
+	return nil
+}
+
+// reassembleFile writes the contents of the file referenced by the given
+// tar-split entry to w, verifying that they have not changed.
+func reassembleFile(w io.Writer, fsEval fseval.FsEval, root string, entry tarSplitEntry) error {
+	if err := entry.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "invalid digest")
+	}
+	path, err := securejoin.SecureJoinVFS(root, CleanPath(entry.Name), fsEval)
+	if err != nil {
+		return errors.Wrap(err, "sanitise path")
+	}
+	fh, err := fsEval.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+	defer fh.Close()
+
+	digester := entry.Digest.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(w, digester.Hash()), io.LimitReader(fh, entry.Size))
+	if err != nil {
+		return errors.Wrap(err, "copy file contents")
+	}
+	// The file must not have grown either.
+	if n, _ := fh.Read(make([]byte, 1)); n != 0 || size != entry.Size || digester.Digest() != entry.Digest {
+		return errors.Errorf("file has changed since the layer was extracted")
+	}
+	return nil
+}
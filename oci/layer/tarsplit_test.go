@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+func TestReassembleLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestReassembleLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{
+			{"a/", tar.TypeDir, 0755, ""},
+			{"a/file", tar.TypeReg, 0644, "file"},
+			{"a/empty", tar.TypeReg, 0644, ""},
+			{"b", tar.TypeReg, 0600, "old b"},
+		},
+		{
+			{"b", tar.TypeReg, 0644, "new b"},
+			{"c", tar.TypeReg, 0644, "c"},
+		},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+		GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+		Rootless:    os.Geteuid() != 0,
+	}
+
+	for _, format := range []OnDiskFormat{DirRootfs, OverlayfsLayers} {
+		bundle := filepath.Join(root, "bundle-"+string(format))
+		if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{
+			MapOptions:   mapOptions,
+			OnDiskFormat: format,
+			Workers:      2,
+			TarSplit:     true,
+		}); err != nil {
+			t.Errorf("unexpected UnpackManifest error (format=%s): %+v", format, err)
+			continue
+		}
+
+		// The top layer can always be reassembled.
+		var buf bytes.Buffer
+		if err := ReassembleLayer(&buf, bundle, diffIDs[1], &mapOptions); err != nil {
+			t.Errorf("unexpected ReassembleLayer error (format=%s): %+v", format, err)
+		} else if got := digest.SHA256.FromBytes(buf.Bytes()); got != diffIDs[1] {
+			t.Errorf("reassembled layer has the wrong digest (format=%s): got %s expected %s", format, got, diffIDs[1])
+		}
+
+		// The lower layer only if its files weren't replaced.
+		err := ReassembleLayer(ioutil.Discard, bundle, diffIDs[0], &mapOptions)
+		if format == OverlayfsLayers && err != nil {
+			t.Errorf("unexpected ReassembleLayer error (format=%s): %+v", format, err)
+		} else if format == DirRootfs && err == nil {
+			t.Errorf("expected an error reassembling a layer with replaced files (format=%s)", format)
+		}
+
+		// Modified files are detected.
+		rootfs := filepath.Join(bundle, RootfsName)
+		if format == OverlayfsLayers {
+			rootfs = filepath.Join(bundle, LayersName, LayerDirName(diffIDs[1]))
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "c"), []byte("c and more"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ReassembleLayer(ioutil.Discard, bundle, diffIDs[1], &mapOptions); err == nil {
+			t.Errorf("expected an error reassembling a layer with modified files (format=%s)", format)
+		}
+	}
+
+	// Layers which aren't read cannot have their metadata stored.
+	if err := UnpackManifest(ctx, engineExt, filepath.Join(root, "bundle-cache"), manifest, &UnpackOptions{
+		MapOptions: mapOptions,
+		LayerCache: filepath.Join(root, "cache"),
+		TarSplit:   true,
+	}); err == nil {
+		t.Errorf("expected an error using TarSplit with a layer cache")
+	}
+}
+
+func TestWriteTarSplitTrailingData(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Some tar implementations add extra padding.
+	layer.Write(make([]byte, 4096))
+
+	var metadata bytes.Buffer
+	if err := writeTarSplit(&metadata, bytes.NewReader(layer.Bytes())); err != nil {
+		t.Fatalf("unexpected writeTarSplit error: %+v", err)
+	}
+
+	// Reassemble the layer by hand.
+	var (
+		got     bytes.Buffer
+		entries []tarSplitEntry
+	)
+	dec := json.NewDecoder(&metadata)
+	for dec.More() {
+		var entry tarSplitEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+		if entry.Name != "" {
+			got.WriteString("file")
+		}
+		got.Write(entry.Segment)
+	}
+	if len(entries) != 3 || entries[1].Name != "file" || entries[1].Size != 4 || entries[1].Digest != digest.SHA256.FromString("file") {
+		t.Errorf("unexpected tar-split entries: %+v", entries)
+	}
+	if !bytes.Equal(got.Bytes(), layer.Bytes()) {
+		t.Errorf("reassembled layer does not match the original")
+	}
+}
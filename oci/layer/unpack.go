@@ -19,7 +19,6 @@ package layer
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	// Import is necessary for go-digest.
 	_ "crypto/sha256"
 	"fmt"
@@ -28,14 +27,19 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/pkg/estargz"
 	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/parallel"
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -43,18 +47,32 @@ import (
 	rgen "github.com/opencontainers/runtime-tools/generate"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 )
 
 // UnpackLayer unpacks the tar stream representing an OCI layer at the given
 // root. It ensures that the state of the root is as close as possible to the
 // state used to create the layer. If an error is returned, the state of root
 // is undefined (unpacking is not guaranteed to be atomic).
-func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
-	var mapOptions MapOptions
+func UnpackLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	var unpackOptions UnpackOptions
 	if opt != nil {
-		mapOptions = *opt
+		unpackOptions = *opt
+	}
+	if err := unpackOptions.DevicePolicy.validate(); err != nil {
+		return errors.Wrap(err, "unpack layer")
+	}
+	if err := unpackOptions.Strictness.validate(); err != nil {
+		return errors.Wrap(err, "unpack layer")
+	}
+	if err := unpackOptions.DirlinkPolicy.validate(); err != nil {
+		return errors.Wrap(err, "unpack layer")
+	}
+	te := newTarExtractor(unpackOptions)
+	defer te.close()
+	if err := te.confine(root); err != nil {
+		return errors.Wrap(err, "unpack layer")
 	}
-	te := newTarExtractor(mapOptions)
 	tr := tar.NewReader(layer)
 	for {
 		hdr, err := tr.Next()
@@ -64,6 +82,15 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "read next entry")
 		}
+		// eStargz layers contain some extra metadata entries which are not
+		// part of the root filesystem.
+		if estargz.IsMetadataEntry(hdr.Name) {
+			log.Debugf("unpack layer: skipping estargz metadata entry %s", hdr.Name)
+			continue
+		}
+		if err := readPAXXattrs(hdr); err != nil {
+			return errors.Wrapf(err, "read xattrs: %s", hdr.Name)
+		}
 		if err := te.unpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
@@ -75,11 +102,54 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 // generated.
 const RootfsName = "rootfs"
 
+// LayersName is the name of the directory inside the bundle path which
+// contains the extracted layers when using the OverlayfsLayers on-disk format.
+const LayersName = "layers"
+
+// OverlayUpperName and OverlayWorkName are the names of the overlayfs upperdir
+// and workdir inside the bundle path when using the OverlayfsMount on-disk
+// format.
+const (
+	OverlayUpperName = "upper"
+	OverlayWorkName  = "work"
+)
+
+// LayerDirName returns the name of the directory (inside <bundle>/LayersName)
+// that the layer with the given DiffID is extracted to when using the
+// OverlayfsLayers on-disk format.
+func LayerDirName(diffID digest.Digest) string {
+	return strings.Replace(diffID.String(), ":", "_", 1)
+}
+
 // isLayerType returns if the given MediaType is the media type of an image
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == casext.MediaTypeImageLayerZstd || mediaType == casext.MediaTypeImageLayerNonDistributableZstd
+}
+
+// decompressLayer returns a reader for the uncompressed contents of a layer
+// blob with the given media type (which must be accepted by isLayerType).
+func decompressLayer(mediaType string, blob io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		// pgzip decompresses in a separate goroutine (and uses a faster
+		// inflate implementation than compress/gzip), reading up to
+		// readaheadBlocks blocks ahead of the consumer.
+		gzr, err := pgzip.NewReaderN(blob, readaheadBlockSize, readaheadBlocks)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	case casext.MediaTypeImageLayerZstd, casext.MediaTypeImageLayerNonDistributableZstd:
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd reader")
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(blob), nil
 }
 
 // UnpackManifest extracts all of the layers in the given manifest, as well as
@@ -87,10 +157,60 @@ func isLayerType(mediaType string) bool {
 // <bundle>/<layer.RootfsName>. Some verification is done during image
 // extraction.
 //
+// If the OverlayfsLayers on-disk format is requested, each layer is instead
+// extracted to <bundle>/<layer.LayersName>/<layer.LayerDirName(diffid)> and
+// <bundle>/<layer.RootfsName> is left empty (so that it can be used as the
+// mountpoint for an overlayfs mount of the layers).
+//
+// If the OverlayfsMount on-disk format is requested, each layer is extracted
+// to <opt.LayerStore>/<layer.LayerDirName(diffid)> (unless it was already
+// extracted by a previous unpack) and the layers are then mounted as an
+// overlayfs at <bundle>/<layer.RootfsName>, with the upperdir and workdir
+// stored inside the bundle.
+//
+// When running as root with a non-identity mapping, the layers are extracted
+// through an idmapped mount of the rootfs if the kernel supports it, so that
+// the paths are created with their original owners and the kernel applies the
+// mapping. Otherwise the owner of each path is mapped manually.
+//
 // FIXME: This interface is ugly.
-func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions) (err error) {
+func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
 	engineExt := casext.NewEngine(engine)
 
+	var unpackOptions UnpackOptions
+	if opt != nil {
+		unpackOptions = *opt
+	}
+	mapOptions := unpackOptions.MapOptions
+
+	// Extracted layers are re-used based on their DiffIDs (or ChainIDs), so
+	// we cannot store unverified layers in a layer store or layer cache.
+	if unpackOptions.NoVerify && (unpackOptions.OnDiskFormat == OverlayfsMount || unpackOptions.LayerCache != "") {
+		return errors.Errorf("unpack manifest: layers must be verified when using a layer store or layer cache")
+	}
+
+	if unpackOptions.TarSplit && (unpackOptions.OnDiskFormat == OverlayfsMount || unpackOptions.LayerCache != "") {
+		return errors.Errorf("unpack manifest: tar-split metadata cannot be stored when using a layer store or layer cache")
+	}
+
+	if err := unpackOptions.DevicePolicy.validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+	if err := unpackOptions.Strictness.validate(); err != nil {
+		return errors.Wrap(err, "unpack manifest")
+	}
+
+	// Only a single rootfs has a well-defined state between layers.
+	if unpackOptions.Checkpoint != nil || unpackOptions.Resume != nil {
+		if unpackOptions.OnDiskFormat != "" && unpackOptions.OnDiskFormat != DirRootfs {
+			return errors.Errorf("unpack manifest: checkpoints can only be used with %s", DirRootfs)
+		}
+	}
+	if unpackOptions.Resume != nil && unpackOptions.LayerCache != "" {
+		return errors.Errorf("unpack manifest: cannot resume an unpack when using a layer cache")
+	}
+	resume := unpackOptions.Resume != nil
+
 	// Create the bundle directory. We only error out if config.json or rootfs/
 	// already exists, because we cannot be sure that the user intended us to
 	// extract over an existing bundle.
@@ -107,60 +227,102 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 
 	configPath := filepath.Join(bundle, "config.json")
 	rootfsPath := filepath.Join(bundle, RootfsName)
+	layersPath := filepath.Join(bundle, LayersName)
+	if unpackOptions.OnDiskFormat == OverlayfsMount {
+		if unpackOptions.LayerStore == "" {
+			return errors.Errorf("unpack manifest: layer store must be provided for %s", OverlayfsMount)
+		}
+		// The overlayfs mount options need absolute paths.
+		layersPath, err = filepath.Abs(unpackOptions.LayerStore)
+		if err != nil {
+			return errors.Wrap(err, "get absolute layer store path")
+		}
+	}
 
-	if _, err := os.Lstat(configPath); !os.IsNotExist(err) {
+	// An interrupted unpack might have already generated config.json (which
+	// is regenerated when resuming).
+	if _, err := os.Lstat(configPath); !resume && !os.IsNotExist(err) {
 		if err == nil {
 			err = fmt.Errorf("config.json already exists")
 		}
 		return errors.Wrap(err, "bundle path empty")
 	}
 
-	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
+	// When resuming, the rootfs of the interrupted unpack must still exist.
+	if resume {
+		if fi, err := os.Lstat(rootfsPath); err != nil {
+			return errors.Wrap(err, "resume unpack: stat rootfs")
+		} else if !fi.IsDir() {
+			return errors.Errorf("resume unpack: %s is not a directory", RootfsName)
+		}
+	} else if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) {
 		if err == nil {
 			err = fmt.Errorf("%s already exists", RootfsName)
 		}
 		return errors.Wrap(err, "bundle path empty")
 	}
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil {
-		return errors.Wrap(err, "mkdir rootfs")
+	if unpackOptions.OnDiskFormat == OverlayfsLayers {
+		if _, err := os.Lstat(layersPath); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", LayersName)
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+	}
+
+	if !resume {
+		if err := os.Mkdir(rootfsPath, 0755); err != nil {
+			return errors.Wrap(err, "mkdir rootfs")
+		}
+	}
+
+	fsEval := fseval.DefaultFsEval
+	if mapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
 	}
 
 	// In order to avoid having a broken bundle in the case of an error, we
 	// remove the bundle. In the case of rootless this is particularly
-	// important (`rm -rf` won't work on most distro rootfs's).
+	// important (`rm -rf` won't work on most distro rootfs's). If we mounted
+	// an overlay rootfs we have to unmount it first, otherwise we'd be
+	// removing the files through the overlay. A resumed unpack leaves the
+	// bundle alone, since it wasn't created by us (and it can be resumed
+	// again).
+	var mounted bool
 	defer func() {
-		if err != nil {
-			fsEval := fseval.DefaultFsEval
-			if opt != nil && opt.Rootless {
-				fsEval = fseval.RootlessFsEval
-			}
+		if err != nil && !resume {
 			// It's too late to care about errors.
+			if mounted {
+				_ = unix.Unmount(rootfsPath, unix.MNT_DETACH)
+			}
 			_ = fsEval.RemoveAll(bundle)
 		}
 	}()
 
 	// Make sure that the owner is correct.
-	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
+	rootUID, err := idtools.ToHost(0, mapOptions.UIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootuid has mapping")
 	}
-	rootGID, err := idtools.ToHost(0, opt.GIDMappings)
+	rootGID, err := idtools.ToHost(0, mapOptions.GIDMappings)
 	if err != nil {
 		return errors.Wrap(err, "ensure rootgid has mapping")
 	}
-	if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
-		return errors.Wrap(err, "chown rootfs")
-	}
+	if !resume {
+		if err := os.Lchown(rootfsPath, rootUID, rootGID); err != nil {
+			return errors.Wrap(err, "chown rootfs")
+		}
 
-	// Currently, many different images in the wild don't specify what the
-	// atime/mtime of the root directory is. This is a huge pain because it
-	// means that we can't ensure consistent unpacking. In order to get around
-	// this, we first set the mtime of the root directory to the Unix epoch
-	// (which is as good of an arbitrary choice as any).
-	epoch := time.Unix(0, 0)
-	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
-		return errors.Wrap(err, "set initial root time")
+		// Currently, many different images in the wild don't specify what the
+		// atime/mtime of the root directory is. This is a huge pain because it
+		// means that we can't ensure consistent unpacking. In order to get
+		// around this, we first set the mtime of the root directory to the
+		// Unix epoch (which is as good of an arbitrary choice as any).
+		epoch := time.Unix(0, 0)
+		if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
+			return errors.Wrap(err, "set initial root time")
+		}
 	}
 
 	// In order to verify the DiffIDs as we extract layers, we have to get the
@@ -184,54 +346,172 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	if config.RootFS.Type != "layers" {
 		return errors.Errorf("unpack manifest: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
+	// Every layer must have a corresponding DiffID, otherwise we cannot
+	// verify the layers (and the config doesn't describe this image).
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("unpack manifest: config: rootfs.diff_ids has %d entries but the manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+
+	switch unpackOptions.OnDiskFormat {
+	case OverlayfsLayers:
+		if err := os.Mkdir(layersPath, 0700); err != nil {
+			return errors.Wrap(err, "mkdir layers")
+		}
+	case OverlayfsMount:
+		if err := os.MkdirAll(layersPath, 0700); err != nil {
+			return errors.Wrap(err, "mkdir layer store")
+		}
+	}
 
 	// Layer extraction.
-	for idx, layerDescriptor := range manifest.Layers {
-		layerDiffID := config.RootFS.DiffIDs[idx]
-		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+	var lowerDirs []string
+	switch unpackOptions.OnDiskFormat {
+	case OverlayfsLayers:
+		// Each overlayfs layer is extracted into its own (initially empty)
+		// directory, which must have the same owner as the rootfs. Since the
+		// layers are independent, they can be extracted in parallel. Layers
+		// with the same DiffID share a directory, so are only extracted once.
+		layerIdxs := uniqueLayers(config.RootFS.DiffIDs[:len(manifest.Layers)])
+		err := parallel.Do(len(layerIdxs), unpackOptions.Workers, func(i int) error {
+			idx := layerIdxs[i]
+			layerRoot := filepath.Join(layersPath, LayerDirName(config.RootFS.DiffIDs[idx]))
+			if err := os.Mkdir(layerRoot, 0755); err != nil {
+				return errors.Wrap(err, "mkdir layer root")
+			}
+			if err := prepareLayerRoot(layerRoot, rootUID, rootGID); err != nil {
+				return errors.Wrap(err, "prepare layer root")
+			}
+			if err := unpackLayerBlob(ctx, engineExt, bundle, layerRoot, manifest.Layers[idx], config.RootFS.DiffIDs[idx], &unpackOptions); err != nil {
+				return errors.Wrap(err, "unpack layer")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+	case OverlayfsMount:
+		lowerDirs, err = extractLayerStore(ctx, engineExt, bundle, layersPath, manifest.Layers, config.RootFS.DiffIDs[:len(manifest.Layers)], rootUID, rootGID, fsEval, &unpackOptions)
 		if err != nil {
-			return errors.Wrap(err, "get layer blob")
+			return err
 		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.MediaType) {
-			return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+
+	default:
+		layerDescriptors := manifest.Layers
+		layerDiffIDs := config.RootFS.DiffIDs[:len(manifest.Layers)]
+
+		// Skip the layers which were already applied before the unpack was
+		// interrupted.
+		if resume {
+			if err := unpackOptions.Resume.verify(layerDiffIDs); err != nil {
+				return errors.Wrap(err, "resume unpack")
+			}
+			done := len(unpackOptions.Resume.Layers)
+			log.Infof("resuming unpack after %d of %d layers", done, len(layerDiffIDs))
+			layerDescriptors = layerDescriptors[done:]
+			layerDiffIDs = layerDiffIDs[done:]
 		}
-		layerGzip, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+
+		// If we have a layer cache, start from the most recent snapshot of
+		// our layers and then store a snapshot after each new layer.
+		var applied func(idx int) error
+		if unpackOptions.LayerCache != "" {
+			cache, err := openLayerCache(unpackOptions)
+			if err != nil {
+				return errors.Wrap(err, "open layer cache")
+			}
+			chainIDs := ChainIDs(layerDiffIDs)
+			restored, devices, err := cache.Restore(rootfsPath, chainIDs)
+			if err != nil {
+				return errors.Wrap(err, "restore from layer cache")
+			}
+			if unpackOptions.Devices != nil {
+				unpackOptions.Devices.reset(devices)
+			}
+			layerDescriptors = layerDescriptors[restored:]
+			layerDiffIDs = layerDiffIDs[restored:]
+			chainIDs = chainIDs[restored:]
+			applied = func(idx int) error {
+				return errors.Wrap(cache.Store(rootfsPath, chainIDs[idx], unpackOptions.Devices.Devices()), "store in layer cache")
+			}
 		}
 
-		// We have to extract a gzip'd version of the above layer. Also note
-		// that we have to check the DiffID we're extracting (which is the
-		// sha256 sum of the *uncompressed* layer).
-		layerRaw, err := gzip.NewReader(layerGzip)
-		if err != nil {
-			return errors.Wrap(err, "create gzip reader")
+		// Record each layer once it has been applied, so that the unpack can
+		// be resumed if it is interrupted.
+		if unpackOptions.Checkpoint != nil {
+			allDiffIDs := config.RootFS.DiffIDs[:len(manifest.Layers)]
+			checkpoint := Checkpoint{
+				Layers: append([]digest.Digest{}, allDiffIDs[:len(allDiffIDs)-len(layerDiffIDs)]...),
+			}
+			if err := unpackOptions.Checkpoint(checkpoint); err != nil {
+				return errors.Wrap(err, "checkpoint")
+			}
+			cacheApplied := applied
+			applied = func(idx int) error {
+				if cacheApplied != nil {
+					if err := cacheApplied(idx); err != nil {
+						return err
+					}
+				}
+				checkpoint.Layers = append(checkpoint.Layers, layerDiffIDs[idx])
+				return errors.Wrap(unpackOptions.Checkpoint(checkpoint), "checkpoint")
+			}
 		}
-		layerDigester := digest.SHA256.Digester()
-		layer := io.TeeReader(layerRaw, layerDigester.Hash())
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
-			return errors.Wrap(err, "unpack layer")
+		// If we can, extract the layers through an idmapped mount of the
+		// rootfs so that the kernel applies the mapping (rather than us
+		// having to map the owner of every path). The layer cache still sees
+		// the rootfs itself, so it uses the original options.
+		extractRoot, extractOptions := rootfsPath, unpackOptions
+		if len(layerDescriptors) > 0 && useIDMappedMount(mapOptions) {
+			mnt, mntErr := newIDMappedMount(bundle, rootfsPath, mapOptions)
+			if mntErr != nil {
+				log.Debugf("idmapped mounts not supported, mapping owners manually: %v", mntErr)
+			} else {
+				log.Infof("extracting layers through idmapped mount: %s", mnt.path)
+				defer func() {
+					if closeErr := mnt.Close(); closeErr != nil && err == nil {
+						err = errors.Wrap(closeErr, "close idmapped mount")
+					}
+				}()
+				extractRoot = mnt.path
+				extractOptions.MapOptions.UIDMappings = nil
+				extractOptions.MapOptions.GIDMappings = nil
+			}
+		}
+
+		if err := unpackLayerBlobs(ctx, engineExt, bundle, extractRoot, layerDescriptors, layerDiffIDs, applied, &extractOptions); err != nil {
+			return err
+		}
+	}
+
+	// Assemble the rootfs from the stored layers, with the upperdir inside
+	// the bundle so that all changes are confined to the bundle.
+	if unpackOptions.OnDiskFormat == OverlayfsMount && len(lowerDirs) > 0 {
+		absBundle, err := filepath.Abs(bundle)
+		if err != nil {
+			return errors.Wrap(err, "get absolute bundle path")
+		}
+		upperPath := filepath.Join(absBundle, OverlayUpperName)
+		workPath := filepath.Join(absBundle, OverlayWorkName)
+		for _, path := range []string{upperPath, workPath} {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return errors.Wrap(err, "mkdir overlay dir")
+			}
+			if err := prepareLayerRoot(path, rootUID, rootGID); err != nil {
+				return errors.Wrap(err, "prepare overlay dir")
+			}
 		}
-		// Different tar implementations can have different levels of redundant
-		// padding and other similar weird behaviours. While on paper they are
-		// all entirely valid archives, Go's tar.Reader implementation doesn't
-		// guarantee that the entire stream will be consumed (which can result
-		// in the later diff_id check failing because the digester didn't get
-		// the whole uncompressed stream). Just blindly consume anything left
-		// in the layer.
-		_, _ = io.Copy(ioutil.Discard, layer)
-		// XXX: Is it possible this breaks in the error path?
-		layerGzip.Close()
 
-		layerDigest := layerDigester.Digest()
-		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+		data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), upperPath, workPath)
+		if mapOptions.Rootless {
+			data += ",userxattr"
+		}
+		log.Infof("mounting overlay rootfs: %s", rootfsPath)
+		if err := unix.Mount("overlay", rootfsPath, "overlay", 0, data); err != nil {
+			return errors.Wrap(err, "mount overlay rootfs")
 		}
+		mounted = true
 	}
 
 	// Generate a runtime configuration file from ispec.Image.
@@ -242,12 +522,351 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 	defer configFile.Close()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
+	// With overlayfs layers the rootfs is empty, so we have to source the
+	// user information from the top-most layer that contains it.
+	sourceRoot := rootfsPath
+	if unpackOptions.OnDiskFormat == OverlayfsLayers {
+		sourceRoot = ""
+		for idx := len(config.RootFS.DiffIDs) - 1; idx >= 0; idx-- {
+			layerRoot := filepath.Join(layersPath, LayerDirName(config.RootFS.DiffIDs[idx]))
+			if _, err := os.Lstat(filepath.Join(layerRoot, "etc", "passwd")); err == nil {
+				sourceRoot = layerRoot
+				break
+			}
+		}
+	}
+
+	if err := unpackRuntimeJSON(ctx, engine, configFile, rootfsPath, sourceRoot, manifest, &mapOptions); err != nil {
 		return errors.Wrap(err, "unpack config.json")
 	}
 	return nil
 }
 
+// uniqueLayers returns the indices of the layers with the given DiffIDs,
+// skipping any layer with the same DiffID as an earlier layer. Such layers
+// have identical contents, and so are only extracted once when each layer has
+// its own directory.
+func uniqueLayers(diffIDs []digest.Digest) []int {
+	var idxs []int
+	seen := map[digest.Digest]bool{}
+	for idx, diffID := range diffIDs {
+		if !seen[diffID] {
+			seen[diffID] = true
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
+// prepareLayerRoot sets the owner and times of a freshly-created directory
+// which will be used as the root of an extracted layer (or overlayfs
+// upperdir), so that it matches the rootfs.
+func prepareLayerRoot(path string, uid, gid int) error {
+	if err := os.Chmod(path, 0755); err != nil {
+		return errors.Wrap(err, "chmod layer root")
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return errors.Wrap(err, "chown layer root")
+	}
+	epoch := time.Unix(0, 0)
+	if err := system.Lutimes(path, epoch, epoch); err != nil {
+		return errors.Wrap(err, "set initial layer root time")
+	}
+	return nil
+}
+
+// extractLayerStore extracts each of the given layers into its own directory
+// inside the layer store at layersPath (using the OverlayfsMount conventions),
+// and returns the directories of the layers in the order used for the
+// overlayfs lowerdir option (the top-most layer first).
+//
+// Layers which have already been extracted into the store are re-used as-is.
+// Other layers are extracted to a temporary directory inside the store and
+// then atomically renamed, so that the store never contains
+// partially-extracted layers. As with OverlayfsLayers, the layers can be
+// extracted in parallel.
+func extractLayerStore(ctx context.Context, engineExt casext.Engine, bundle, layersPath string, layers []ispec.Descriptor, diffIDs []digest.Digest, rootUID, rootGID int, fsEval fseval.FsEval, opt *UnpackOptions) ([]string, error) {
+	// overlayfs doesn't allow the same lowerdir to be used more than once, so
+	// a layer which is repeated is only included as its top-most copy. This
+	// results in the same rootfs, because anything the lower copies provide
+	// is also provided by the top-most copy.
+	var lowerDirs []string
+	seen := map[digest.Digest]bool{}
+	for idx := len(diffIDs) - 1; idx >= 0; idx-- {
+		if seen[diffIDs[idx]] {
+			continue
+		}
+		seen[diffIDs[idx]] = true
+		lowerDirs = append(lowerDirs, filepath.Join(layersPath, LayerDirName(diffIDs[idx])))
+	}
+
+	layerIdxs := uniqueLayers(diffIDs)
+	err := parallel.Do(len(layerIdxs), opt.Workers, func(i int) error {
+		idx := layerIdxs[i]
+		layerDescriptor := layers[idx]
+		layerRoot := filepath.Join(layersPath, LayerDirName(diffIDs[idx]))
+		if _, err := os.Lstat(layerRoot); err == nil {
+			log.Infof("reusing extracted layer: %s", layerDescriptor.Digest)
+			return nil
+		}
+
+		tempRoot, err := ioutil.TempDir(layersPath, ".tmp-")
+		if err != nil {
+			return errors.Wrap(err, "create temporary layer root")
+		}
+		if err := prepareLayerRoot(tempRoot, rootUID, rootGID); err != nil {
+			_ = fsEval.RemoveAll(tempRoot)
+			return errors.Wrap(err, "prepare layer root")
+		}
+		if err := unpackLayerBlob(ctx, engineExt, bundle, tempRoot, layerDescriptor, diffIDs[idx], opt); err != nil {
+			_ = fsEval.RemoveAll(tempRoot)
+			return errors.Wrap(err, "unpack layer")
+		}
+		if err := os.Rename(tempRoot, layerRoot); err != nil {
+			// Someone else may have raced with us to extract the same
+			// layer, in which case we just use theirs.
+			_ = fsEval.RemoveAll(tempRoot)
+			if _, err := os.Lstat(layerRoot); err != nil {
+				return errors.Wrap(err, "rename temporary layer root")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lowerDirs, nil
+}
+
+// unpackLayerBlob extracts the layer blob referenced by the given descriptor
+// to root, and verifies that the uncompressed layer matches the given DiffID.
+// If opt.TarSplit is set, the tar-split metadata of the layer is stored in the
+// bundle.
+func unpackLayerBlob(ctx context.Context, engine casext.Engine, bundle, root string, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, opt *UnpackOptions) error {
+	log.Infof("unpack layer: %s", layerDescriptor.Digest)
+
+	return readLayerBlob(ctx, engine, layerDescriptor, layerDiffID, tarSplitPath(bundle, layerDiffID, opt), opt.NoVerify, func(layer io.Reader) error {
+		return errors.Wrap(UnpackLayer(root, layer, opt), "unpack layer")
+	})
+}
+
+// stageLayerBlob decompresses the layer blob referenced by the given
+// descriptor into a new file inside dir (verifying that the uncompressed layer
+// matches the given DiffID), so that it can be applied with UnpackLayer
+// later. The path of the staged layer is returned. If noVerify is set, a
+// mismatched DiffID only results in a warning. If splitPath is not empty, the
+// tar-split metadata of the layer is written to it.
+func stageLayerBlob(ctx context.Context, engine casext.Engine, dir string, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, splitPath string, noVerify bool) (string, error) {
+	log.Debugf("stage layer: %s", layerDescriptor.Digest)
+
+	stagedFile, err := ioutil.TempFile(dir, "layer-")
+	if err != nil {
+		return "", errors.Wrap(err, "create staged layer")
+	}
+	defer stagedFile.Close()
+
+	if err := readLayerBlob(ctx, engine, layerDescriptor, layerDiffID, splitPath, noVerify, func(layer io.Reader) error {
+		_, err := io.Copy(stagedFile, layer)
+		return errors.Wrap(err, "write staged layer")
+	}); err != nil {
+		_ = os.Remove(stagedFile.Name())
+		return "", err
+	}
+	return stagedFile.Name(), nil
+}
+
+// readLayerBlob calls fn with the uncompressed contents of the layer blob
+// referenced by the given descriptor, and verifies that the uncompressed layer
+// matches the given DiffID. If noVerify is set, a mismatched DiffID only
+// results in a warning. If splitPath is not empty, the tar-split metadata of
+// the layer is written to it.
+func readLayerBlob(ctx context.Context, engine casext.Engine, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, splitPath string, noVerify bool, fn func(io.Reader) error) (Err error) {
+	layerBlob, err := engine.FromDescriptor(ctx, layerDescriptor)
+	if err != nil {
+		return errors.Wrap(err, "get layer blob")
+	}
+	defer layerBlob.Close()
+	if !isLayerType(layerBlob.MediaType) {
+		return errors.Errorf("unpack manifest: layer %s: blob is not correct mediatype: %s", layerBlob.Digest, layerBlob.MediaType)
+	}
+	layerCompressed, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	// We have to extract a decompressed version of the above layer. Also
+	// note that we have to check the DiffID we're extracting (which is the
+	// sha256 sum of the *uncompressed* layer).
+	layerRaw, err := decompressLayer(layerBlob.MediaType, layerCompressed)
+	if err != nil {
+		return err
+	}
+	defer layerRaw.Close()
+	layerDigester := digest.SHA256.Digester()
+
+	// Decompression, hashing and extraction of the layer are each done in a
+	// separate goroutine (the decompressors read ahead by themselves, and
+	// hashing is connected to extraction by a readahead), so that applying a
+	// layer isn't limited by the speed of a single core.
+	hashReadahead := newReadahead(io.TeeReader(layerRaw, layerDigester.Hash()))
+	defer hashReadahead.Close()
+	var layer io.Reader = hashReadahead
+
+	if splitPath != "" {
+		splitWriter, err := createTarSplit(splitPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := splitWriter.Close(); err != nil && Err == nil {
+				Err = errors.Wrap(err, "write tar-split metadata")
+			}
+			if Err != nil {
+				_ = os.Remove(splitPath)
+			}
+		}()
+		layer = io.TeeReader(layer, splitWriter)
+	}
+
+	if err := fn(layer); err != nil {
+		return err
+	}
+	// Different tar implementations can have different levels of redundant
+	// padding and other similar weird behaviours. While on paper they are
+	// all entirely valid archives, Go's tar.Reader implementation doesn't
+	// guarantee that the entire stream will be consumed (which can result
+	// in the later diff_id check failing because the digester didn't get
+	// the whole uncompressed stream). Just blindly consume anything left
+	// in the layer.
+	_, _ = io.Copy(ioutil.Discard, layer)
+	// XXX: Is it possible this breaks in the error path?
+	layerCompressed.Close()
+
+	layerDigest := layerDigester.Digest()
+	if layerDigest != layerDiffID {
+		if noVerify {
+			log.Warnf("unpack manifest: layer %s: ignoring diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+			return nil
+		}
+		return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+	}
+	return nil
+}
+
+// ReadLayer calls fn with the uncompressed contents of the layer blob
+// referenced by the given descriptor, and returns an error if the uncompressed
+// layer does not match the given DiffID.
+func ReadLayer(ctx context.Context, engine cas.Engine, layerDescriptor ispec.Descriptor, diffID digest.Digest, fn func(io.Reader) error) error {
+	return readLayerBlob(ctx, casext.NewEngine(engine), layerDescriptor, diffID, "", false, fn)
+}
+
+// unpackLayerBlobs applies the given layers (in order) on top of root. If
+// opt.Workers is greater than one, up to opt.Workers of the following layers
+// are decompressed and verified (staged inside bundle) concurrently while the
+// current layer is being applied. If applied is not nil, it is called after
+// each layer has been applied.
+func unpackLayerBlobs(ctx context.Context, engine casext.Engine, bundle, root string, layerDescriptors []ispec.Descriptor, layerDiffIDs []digest.Digest, applied func(idx int) error, opt *UnpackOptions) error {
+	if applied == nil {
+		applied = func(int) error { return nil }
+	}
+
+	if opt.Workers <= 1 || len(layerDescriptors) <= 1 {
+		for idx, layerDescriptor := range layerDescriptors {
+			if err := unpackLayerBlob(ctx, engine, bundle, root, layerDescriptor, layerDiffIDs[idx], opt); err != nil {
+				return errors.Wrap(err, "unpack layer")
+			}
+			if err := applied(idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	stagingDir, err := ioutil.TempDir(bundle, ".staging-")
+	if err != nil {
+		return errors.Wrap(err, "create layer staging directory")
+	}
+	defer os.RemoveAll(stagingDir)
+
+	type stagedLayer struct {
+		path string
+		err  error
+	}
+	var (
+		wg      sync.WaitGroup
+		slots   = make(chan struct{}, opt.Workers)
+		done    = make(chan struct{})
+		results = make([]chan stagedLayer, len(layerDescriptors))
+	)
+	for idx := range results {
+		results[idx] = make(chan stagedLayer, 1)
+	}
+	// Any layers still being staged must be finished before we can remove
+	// the staging directory.
+	defer wg.Wait()
+	defer close(done)
+
+	// Layers are staged in order, and each staged layer holds a slot until it
+	// has been applied, which bounds the amount of staged data on disk.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for idx := range layerDescriptors {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				path, err := stageLayerBlob(ctx, engine, stagingDir, layerDescriptors[idx], layerDiffIDs[idx], tarSplitPath(bundle, layerDiffIDs[idx], opt), opt.NoVerify)
+				results[idx] <- stagedLayer{path: path, err: err}
+			}(idx)
+		}
+	}()
+
+	for idx, layerDescriptor := range layerDescriptors {
+		staged := <-results[idx]
+		if staged.err != nil {
+			return errors.Wrap(staged.err, "stage layer")
+		}
+
+		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+		err := applyStagedLayer(root, staged.path, opt)
+		_ = os.Remove(staged.path)
+		<-slots
+		if err != nil {
+			return errors.Wrap(err, "unpack layer")
+		}
+		if err := applied(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarSplitPath returns the path the tar-split metadata of the layer with the
+// given DiffID should be written to, or "" if opt.TarSplit is not set.
+func tarSplitPath(bundle string, diffID digest.Digest, opt *UnpackOptions) string {
+	if !opt.TarSplit {
+		return ""
+	}
+	return TarSplitPath(bundle, diffID)
+}
+
+// applyStagedLayer applies the layer staged (by stageLayerBlob) at the given
+// path on top of root.
+func applyStagedLayer(root, path string, opt *UnpackOptions) error {
+	layer, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open staged layer")
+	}
+	defer layer.Close()
+	return UnpackLayer(root, layer, opt)
+}
+
 // UnpackRuntimeJSON converts a given manifest's configuration to a runtime
 // configuration and writes it to the given writer. If rootfs is specified, it
 // is sourced during the configuration generation (for conversion of
@@ -258,6 +877,13 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 //
 // XXX: I don't like this API. It has way too many arguments.
 func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs string, manifest ispec.Manifest, opt *MapOptions) error {
+	return unpackRuntimeJSON(ctx, engine, configFile, rootfs, rootfs, manifest, opt)
+}
+
+// unpackRuntimeJSON is the same as UnpackRuntimeJSON, except that the
+// filesystem sourced during configuration generation (sourceRoot) can differ
+// from the rootfs path used in the generated configuration.
+func unpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Writer, rootfs, sourceRoot string, manifest ispec.Manifest, opt *MapOptions) error {
 	engineExt := casext.NewEngine(engine)
 
 	var mapOptions MapOptions
@@ -283,9 +909,12 @@ func UnpackRuntimeJSON(ctx context.Context, engine cas.Engine, configFile io.Wri
 	}
 
 	g := rgen.New()
-	if err := iconv.MutateRuntimeSpec(g, rootfs, config); err != nil {
+	if err := iconv.MutateRuntimeSpec(g, sourceRoot, config); err != nil {
 		return errors.Wrap(err, "generate config.json")
 	}
+	if sourceRoot != rootfs {
+		g.SetRootPath(filepath.Base(rootfs))
+	}
 
 	// Add UIDMapping / GIDMapping options.
 	if len(mapOptions.UIDMappings) > 0 || len(mapOptions.GIDMappings) > 0 {
@@ -18,16 +18,24 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -43,21 +51,14 @@ func mustDecodeString(s string) []byte {
 	return b
 }
 
-// Ensure that "custom layers" generated by other programs (such as a manual
-// tar+gzip) are still correctly handled by us (this used to not work because
-// that "archive/tar" parser doesn't consume the whole tar stream if it detects
-// that there is no more metadata it is interested in in the tar stream).
-func TestUnpackManifestCustomLayer(t *testing.T) {
-	ctx := context.Background()
-
-	// These layers were manually generated using GNU tar + GNU gzip.
-	// XXX: In future we should also add libarchive tar archives.
-	var layers = []struct {
-		base64 string
-		digest digest.Digest
-	}{
-		{
-			base64: `
+// These layers were manually generated using GNU tar + GNU gzip.
+// XXX: In future we should also add libarchive tar archives.
+var customLayers = []struct {
+	base64 string
+	digest digest.Digest
+}{
+	{
+		base64: `
 H4sIAAsoz1kAA+3XvW7CMBAH8Mx9Cj+Bcz7bZxjYO3brWEXBCCS+lBiJvn2dVColAUpUEop6v8UR
 jrGj6P7RyfQl2z/7bOqLUloNJpXJrUFExtRj1BxBaUyUVqQJtSWVgAJnVSL2Nz/JCbsyZEU8yhB7
 /UEaxCosVn6iLJAzI3RaIhEhGjJPcTZrzhLUs85Vs/n5tfd+MnYNmfa/R1XjztpqVM5+1r065EGd
@@ -65,10 +66,10 @@ Bcf1rxxSImz/RzvUf/6+nceLC/fFhLzwP81wexCylf/Bl+Fttlj6m+3RKf+1ju8freP8H0Qr/62S
 qA2hInCt/NcAcgRYvyfbzv+jtfd+MnYN2UO9N32r/5P5r9A16j9exfwfpCb/ef6/zjci36xDsVmW
 Isy92GZlOP5ltgu7wkvRvrXwpV+H9nrJxf8oznz/p4sLpdBV9/4Pjebv/yC69X8/fP9HJMdYrR2P
 LUfAQ5Bf9d5fI1j3f+A69H/aGuD+jzHGGGOMMcYYY4wxxn7jA5XNY6oAKAAA`,
-			digest: digest.NewDigestFromHex(digest.SHA256.String(), "e489a16a8ca0d682394867ad8a8183f0a47cbad80b3134a83412a6796ad9242a"),
-		},
-		{
-			base64: `
+		digest: digest.NewDigestFromHex(digest.SHA256.String(), "e489a16a8ca0d682394867ad8a8183f0a47cbad80b3134a83412a6796ad9242a"),
+	},
+	{
+		base64: `
 H4sIAJ4oz1kAA+3Wu27CMBQG4Mw8xSldK8d3p0OHbu3WN6hCYhELCMh2Bbx9HTogwkWtBLSo51uM
 dBLsSPl/heRv5erFlrX1gWimHnOSnRtNtJSbNemvlAmeMcG00FxyajLKqNE0g9XZT3LAR4ilT0e5
 xl5/kKAwi25mn5ii2shCKUaKgmshBOWDNC13p5xIvply0U2r4/f+9pOh7yD55ffoMm6U6lZm1Ffu
@@ -76,31 +77,17 @@ xl5/kKAwi25mn5ii2shCKUaKgmshBOWDNC13p5xIvply0U2r4/f+9pOh7yD55ffoMm6U6lZm1Ffu
 4WD/m+JY/2tBKOumRqj9/teUCCXTVAvs/9tALpD3vhRxear/mZC9/Kd3KH3/XSWT/7z/7+/ykWvz
 0AwGtmrmMHyNsCwDlDDybtxEqObTGupyDa6F54V30wco2xpiY6GazqtJgKX1FkL0buLacRo4H61t
 yRAbACGEEEIIIYQQQgghhBBCCKEr+wTE0sQyACgAAA==`,
-			digest: digest.NewDigestFromHex(digest.SHA256.String(), "39f100ed000b187ba74b3132cc207c63ad1765adaeb783aa7f242f1f7b6f5ea2"),
-		},
-	}
-
-	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestCustomLayer")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(root)
-
-	// Create our image.
-	image := filepath.Join(root, "image")
-	if err := dir.Create(image); err != nil {
-		t.Fatal(err)
-	}
-	engine, err := dir.Open(image)
-	if err != nil {
-		t.Fatal(err)
-	}
-	engineExt := casext.NewEngine(engine)
+		digest: digest.NewDigestFromHex(digest.SHA256.String(), "39f100ed000b187ba74b3132cc207c63ad1765adaeb783aa7f242f1f7b6f5ea2"),
+	},
+}
 
+// putCustomLayersManifest stores an image made of customLayers in the given
+// CAS, returning its manifest.
+func putCustomLayersManifest(t *testing.T, ctx context.Context, engineExt casext.Engine) ispec.Manifest {
 	// Set up the CAS and an image from the above layers.
 	var layerDigests []digest.Digest
 	var layerDescriptors []ispec.Descriptor
-	for _, layer := range layers {
+	for _, layer := range customLayers {
 		var layerReader io.Reader
 
 		// Since we already have the digests we don't need to jump through the
@@ -139,22 +126,212 @@ yRAbACGEEEIIIYQQQgghhBBCCKEr+wTE0sQyACgAAA==`,
 	}
 
 	// Create the manifest.
-	manifest := ispec.Manifest{
+	return ispec.Manifest{
 		Versioned: specs.Versioned{
 			SchemaVersion: 2,
 		},
 		Config: configDescriptor,
 		Layers: layerDescriptors,
 	}
+}
 
-	bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestCustomLayer_bundle")
+// customLayersMapOptions maps both root and the uid/gid in customLayers to
+// the current user.
+func customLayersMapOptions() MapOptions {
+	return MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+		},
+		Rootless: os.Geteuid() != 0,
+	}
+}
+
+// Ensure that "custom layers" generated by other programs (such as a manual
+// tar+gzip) are still correctly handled by us (this used to not work because
+// that "archive/tar" parser doesn't consume the whole tar stream if it detects
+// that there is no more metadata it is interested in in the tar stream).
+func TestUnpackManifestCustomLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestCustomLayer")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(bundle)
+	defer os.RemoveAll(root)
+
+	// Create our image.
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	manifest := putCustomLayersManifest(t, ctx, engineExt)
+
+	// Unpack both sequentially and with several workers.
+	for _, workers := range []int{0, 4} {
+		for _, format := range []OnDiskFormat{DirRootfs, OverlayfsLayers} {
+			bundle, err := ioutil.TempDir("", "umoci-TestUnpackManifestCustomLayer_bundle")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(bundle)
+
+			// Unpack (we map both root and the uid/gid in the archives to the current user).
+			unpackOptions := &UnpackOptions{
+				MapOptions:   customLayersMapOptions(),
+				OnDiskFormat: format,
+				Workers:      workers,
+			}
+			if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+				t.Errorf("unexpected UnpackManifest error (format=%s workers=%d): %+v\n", format, workers, err)
+				continue
+			}
+
+			// The staging directory must have been cleaned up.
+			if matches, _ := filepath.Glob(filepath.Join(bundle, ".staging-*")); len(matches) > 0 {
+				t.Errorf("staging directories left in bundle (format=%s workers=%d): %v", format, workers, matches)
+			}
+		}
+	}
+}
+
+// TestUnpackManifestZstdLayer checks that zstd-compressed and uncompressed
+// layers are decompressed according to their media type.
+func TestUnpackManifestZstdLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestZstdLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	manifest := putCustomLayersManifest(t, ctx, engineExt)
+
+	// Store the first layer uncompressed and the second with zstd.
+	for idx, mediaType := range []string{ispec.MediaTypeImageLayer, casext.MediaTypeImageLayerZstd} {
+		gzr, err := gzip.NewReader(bytes.NewReader(mustDecodeString(customLayers[idx].base64)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blob bytes.Buffer
+		var w io.WriteCloser = nopWriteCloser{&blob}
+		if mediaType == casext.MediaTypeImageLayerZstd {
+			if w, err = zstd.NewWriter(&blob); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := io.Copy(w, gzr); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, &blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers[idx] = ispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	unpackOptions := &UnpackOptions{MapOptions: customLayersMapOptions()}
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestUnpackManifestDiffIDMismatch checks that layers which don't match the
+// DiffIDs in the image configuration are rejected (unless NoVerify is set).
+func TestUnpackManifestDiffIDMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestDiffIDMismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var layerDescriptors []ispec.Descriptor
+	for _, layer := range customLayers {
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBuffer(mustDecodeString(layer.base64)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerDescriptors = append(layerDescriptors, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayerGzip,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	// newManifest creates a manifest for the layers using the given DiffIDs.
+	newManifest := func(diffIDs []digest.Digest) ispec.Manifest {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+			OS: "linux",
+			RootFS: ispec.RootFS{
+				Type:    "layers",
+				DiffIDs: diffIDs,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: layerDescriptors,
+		}
+	}
 
-	// Unpack (we map both root and the uid/gid in the archives to the current user).
-	mapOptions := &MapOptions{
+	// The DiffIDs of the layers have been swapped.
+	swapped := newManifest([]digest.Digest{customLayers[1].digest, customLayers[0].digest})
+	// There is no DiffID for the second layer.
+	missing := newManifest([]digest.Digest{customLayers[0].digest})
+
+	mapOptions := MapOptions{
 		UIDMappings: []rspec.LinuxIDMapping{
 			{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
 			{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
@@ -165,7 +342,318 @@ yRAbACGEEEIIIYQQQgghhBBCCKEr+wTE0sQyACgAAA==`,
 		},
 		Rootless: os.Geteuid() != 0,
 	}
-	if err := UnpackManifest(ctx, engineExt, bundle, manifest, mapOptions); err != nil {
-		t.Errorf("unexpected UnpackManifest error: %+v\n", err)
+
+	for _, test := range []struct {
+		name     string
+		manifest ispec.Manifest
+		opt      UnpackOptions
+		success  bool
+	}{
+		{"Swapped", swapped, UnpackOptions{}, false},
+		{"SwappedWorkers", swapped, UnpackOptions{Workers: 4}, false},
+		{"SwappedOverlay", swapped, UnpackOptions{OnDiskFormat: OverlayfsLayers}, false},
+		{"SwappedNoVerify", swapped, UnpackOptions{NoVerify: true}, true},
+		{"SwappedNoVerifyWorkers", swapped, UnpackOptions{NoVerify: true, Workers: 4}, true},
+		{"SwappedNoVerifyCache", swapped, UnpackOptions{NoVerify: true, LayerCache: filepath.Join(root, "cache")}, false},
+		{"Missing", missing, UnpackOptions{}, false},
+		{"MissingNoVerify", missing, UnpackOptions{NoVerify: true}, false},
+	} {
+		bundle := filepath.Join(root, "bundle-"+test.name)
+		test.opt.MapOptions = mapOptions
+
+		err := UnpackManifest(ctx, engineExt, bundle, test.manifest, &test.opt)
+		if test.success && err != nil {
+			t.Errorf("%s: unexpected UnpackManifest error: %+v", test.name, err)
+		} else if !test.success {
+			if err == nil {
+				t.Errorf("%s: expected UnpackManifest to fail", test.name)
+			}
+			// A failed unpack must not leave a bundle behind.
+			if _, err := os.Lstat(bundle); !os.IsNotExist(err) {
+				t.Errorf("%s: bundle was not removed after failed unpack: %v", test.name, err)
+			}
+		}
+	}
+}
+
+// TestUnpackManifestResume checks that each applied layer is checkpointed, and
+// that an unpack can be resumed from a checkpoint.
+func TestUnpackManifestResume(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestResume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	manifest := putCustomLayersManifest(t, ctx, engineExt)
+	diffIDs := []digest.Digest{customLayers[0].digest, customLayers[1].digest}
+
+	// A checkpoint is recorded before the first layer and after each layer.
+	bundle := filepath.Join(root, "bundle")
+	var checkpoints []Checkpoint
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{
+		MapOptions: customLayersMapOptions(),
+		Checkpoint: func(checkpoint Checkpoint) error {
+			checkpoint.Layers = append([]digest.Digest{}, checkpoint.Layers...)
+			checkpoints = append(checkpoints, checkpoint)
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected UnpackManifest error: %+v", err)
+	}
+	expected := []Checkpoint{
+		{Layers: []digest.Digest{}},
+		{Layers: diffIDs[:1]},
+		{Layers: diffIDs},
+	}
+	if !reflect.DeepEqual(checkpoints, expected) {
+		t.Errorf("unexpected checkpoints: expected %v, got %v", expected, checkpoints)
+	}
+
+	// Pretend the unpack was interrupted while applying the second layer.
+	if err := os.Remove(filepath.Join(bundle, "config.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checkpoints which don't match the image are rejected, but the bundle
+	// is left alone.
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{
+		MapOptions: customLayersMapOptions(),
+		Resume:     &Checkpoint{Layers: []digest.Digest{diffIDs[1]}},
+	}); err == nil {
+		t.Errorf("expected an error resuming from a mismatched checkpoint")
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, RootfsName)); err != nil {
+		t.Fatalf("rootfs removed by failed resume: %v", err)
+	}
+
+	// Resuming only applies the remaining layers.
+	checkpoints = nil
+	if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{
+		MapOptions: customLayersMapOptions(),
+		Resume:     &Checkpoint{Layers: diffIDs[:1]},
+		Checkpoint: func(checkpoint Checkpoint) error {
+			checkpoint.Layers = append([]digest.Digest{}, checkpoint.Layers...)
+			checkpoints = append(checkpoints, checkpoint)
+			return nil
+		},
+	}); err != nil {
+		t.Fatalf("unexpected UnpackManifest error resuming: %+v", err)
+	}
+	if !reflect.DeepEqual(checkpoints, expected[1:]) {
+		t.Errorf("unexpected checkpoints: expected %v, got %v", expected[1:], checkpoints)
+	}
+	if _, err := os.Lstat(filepath.Join(bundle, "config.json")); err != nil {
+		t.Errorf("config.json not generated by resumed unpack: %v", err)
+	}
+
+	// A bundle without a rootfs cannot be resumed.
+	if err := UnpackManifest(ctx, engineExt, filepath.Join(root, "empty"), manifest, &UnpackOptions{
+		MapOptions: customLayersMapOptions(),
+		Resume:     &Checkpoint{},
+	}); err == nil {
+		t.Errorf("expected an error resuming an empty bundle")
+	}
+}
+
+// TestUnpackManifestRepeatedLayer checks that images which contain the same
+// layer more than once (such as several empty layers) can be unpacked with
+// each layer in its own directory.
+func TestUnpackManifestRepeatedLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackManifestRepeatedLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var (
+		layerDescriptors []ispec.Descriptor
+		diffIDs          []digest.Digest
+	)
+	for _, entries := range [][]flattenTestEntry{
+		{{"base", tar.TypeReg, 0644, "base"}},
+		{},
+		{{"top", tar.TypeReg, 0644, "top"}},
+		{},
+	} {
+		descriptor, diffID := putFlattenTestLayer(t, ctx, engineExt, entries)
+		layerDescriptors = append(layerDescriptors, descriptor)
+		diffIDs = append(diffIDs, diffID)
+	}
+	if diffIDs[1] != diffIDs[3] {
+		t.Fatalf("empty layers have different diffids: %s != %s", diffIDs[1], diffIDs[3])
+	}
+
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS: "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layerDescriptors,
+	}
+
+	// The repeated layer shares a single directory.
+	expectedDirs := []string{LayerDirName(diffIDs[0]), LayerDirName(diffIDs[1]), LayerDirName(diffIDs[2])}
+	sort.Strings(expectedDirs)
+	for _, workers := range []int{0, 4} {
+		bundle := filepath.Join(root, fmt.Sprintf("bundle-%d", workers))
+		if err := UnpackManifest(ctx, engineExt, bundle, manifest, &UnpackOptions{
+			MapOptions:   customLayersMapOptions(),
+			OnDiskFormat: OverlayfsLayers,
+			Workers:      workers,
+		}); err != nil {
+			t.Errorf("unexpected UnpackManifest error (workers=%d): %+v", workers, err)
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(filepath.Join(bundle, LayersName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotDirs []string
+		for _, info := range infos {
+			gotDirs = append(gotDirs, info.Name())
+		}
+		if !reflect.DeepEqual(gotDirs, expectedDirs) {
+			t.Errorf("unexpected layer directories (workers=%d): expected %v, got %v", workers, expectedDirs, gotDirs)
+		}
+	}
+
+	// The repeated layer is only used once (as its top-most copy) in the
+	// overlayfs lowerdirs.
+	store := filepath.Join(root, "store")
+	if err := os.Mkdir(store, 0700); err != nil {
+		t.Fatal(err)
+	}
+	unpackOptions := &UnpackOptions{
+		MapOptions: customLayersMapOptions(),
+		Workers:    4,
+	}
+	fsEval := fseval.DefaultFsEval
+	if unpackOptions.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+	lowerDirs, err := extractLayerStore(ctx, engineExt, filepath.Join(root, "store-bundle"), store, layerDescriptors, diffIDs, os.Geteuid(), os.Getegid(), fsEval, unpackOptions)
+	if err != nil {
+		t.Fatalf("unexpected extractLayerStore error: %+v", err)
+	}
+	expectedLowerDirs := []string{
+		filepath.Join(store, LayerDirName(diffIDs[3])),
+		filepath.Join(store, LayerDirName(diffIDs[2])),
+		filepath.Join(store, LayerDirName(diffIDs[0])),
+	}
+	if !reflect.DeepEqual(lowerDirs, expectedLowerDirs) {
+		t.Errorf("unexpected lowerdirs: expected %v, got %v", expectedLowerDirs, lowerDirs)
+	}
+	for _, lowerDir := range lowerDirs {
+		if _, err := os.Lstat(lowerDir); err != nil {
+			t.Errorf("layer not extracted to store: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadLayer measures how quickly a (moderately compressible) gzip
+// layer is decompressed and verified by ReadLayer.
+func BenchmarkReadLayer(b *testing.B) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-BenchmarkReadLayer")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		b.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer engine.Close()
+
+	// A single 64MiB file of random words, so that the layer compresses
+	// roughly as well as typical binaries do.
+	words := []string{"umoci", "layer", "image", "blob", "gzip", "\x00\x01\x02\x03", "tar", "\n"}
+	rng := rand.New(rand.NewSource(0))
+	var contents bytes.Buffer
+	for contents.Len() < 64<<20 {
+		contents.WriteString(words[rng.Intn(len(words))])
+		contents.WriteByte(byte(rng.Intn(256)))
+	}
+
+	var blob bytes.Buffer
+	diffIDDigester := digest.SHA256.Digester()
+	gzw := gzip.NewWriter(&blob)
+	tw := tar.NewWriter(io.MultiWriter(gzw, diffIDDigester.Hash()))
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(contents.Len()), Typeflag: tar.TypeReg}); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := tw.Write(contents.Bytes()); err != nil {
+		b.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	layerDigest, layerSize, err := engine.PutBlob(ctx, &blob)
+	if err != nil {
+		b.Fatal(err)
+	}
+	layerDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	b.SetBytes(int64(contents.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ReadLayer(ctx, engine, layerDescriptor, diffIDDigester.Digest(), func(r io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		}); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
@@ -19,10 +19,13 @@ package layer
 
 import (
 	"archive/tar"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/xattrfilter"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
@@ -39,6 +42,251 @@ type MapOptions struct {
 	Rootless bool `json:"rootless"`
 }
 
+// OnDiskFormat describes how the layers of an image are stored on the
+// filesystem once they have been extracted.
+type OnDiskFormat string
+
+const (
+	// DirRootfs is the default on-disk format, where each layer is applied on
+	// top of the previous layers to produce a single flattened rootfs.
+	DirRootfs OnDiskFormat = "dir"
+
+	// OverlayfsLayers extracts each layer into its own directory, without
+	// applying it to any other layer. Whiteouts are converted to their
+	// overlayfs equivalents (0:0 character devices and the overlay "opaque"
+	// xattr), so the directories can be used directly as overlayfs lowerdirs.
+	OverlayfsLayers OnDiskFormat = "overlayfs-layers"
+
+	// OverlayfsMount extracts each layer into its own directory inside a
+	// layer store (using the same conventions as OverlayfsLayers), re-using
+	// any layers that were already extracted into the store. The rootfs is
+	// then assembled by mounting an overlayfs with the layers as lowerdirs.
+	OverlayfsMount OnDiskFormat = "overlayfs-mount"
+)
+
+// overlayWhiteouts returns whether layers extracted using this on-disk format
+// use overlayfs whiteout conventions.
+func (f OnDiskFormat) overlayWhiteouts() bool {
+	return f == OverlayfsLayers || f == OverlayfsMount
+}
+
+// UnpackOptions describes the behaviour of the various unpack operations.
+type UnpackOptions struct {
+	// MapOptions are the UID and GID mappings used when unpacking the image.
+	MapOptions MapOptions
+
+	// OnDiskFormat is the format used to store the extracted layers. If
+	// unset, DirRootfs is used.
+	OnDiskFormat OnDiskFormat
+
+	// LayerStore is the directory in which extracted layers are stored (and
+	// re-used between unpacks) when using OverlayfsMount. A layer store must
+	// only be shared between unpacks which use the same MapOptions,
+	// Strictness, DirlinkPolicy and AUFSCompat.
+	LayerStore string
+
+	// XattrFilter decides which xattrs in the layer are restored when
+	// extracting it. If nil, xattrfilter.Default() is used.
+	XattrFilter *xattrfilter.Filter
+
+	// EmulateXattrs specifies whether xattrs which cannot be set in rootless
+	// mode (such as security.capability) should instead be stored with
+	// EmulatedXattrPrefix, so that they are not lost when repacking.
+	EmulateXattrs bool
+
+	// EmulateOwnership specifies whether the owner of each path in the layer
+	// should be recorded in the rootlesscontainers.Keyname xattr (in the
+	// format used by PRoot), since in rootless mode every path is owned by
+	// the unprivileged user. Paths owned by root in the container don't have
+	// the xattr set.
+	EmulateOwnership bool
+
+	// DevicePolicy is how character and block devices in the layer are
+	// handled in rootless mode, where they cannot be created. If unset,
+	// DevicePlaceholder is used. It has no effect outside of rootless mode.
+	DevicePolicy DevicePolicy
+
+	// Devices, if non-nil, is filled with the devices which could not be
+	// created in rootless mode (so that they can be restored when
+	// repacking). It is only filled when using DirRootfs.
+	Devices *DeviceRecord
+
+	// Strictness is how malformed entries in the layer (such as paths which
+	// escape the root, duplicate entries, invalid modes or unknown entry
+	// types) are handled. If unset, paths are scoped to the root and later
+	// duplicate entries replace earlier ones without any warnings, while
+	// unknown entry types cause an error.
+	Strictness Strictness
+
+	// DirlinkPolicy is how directory entries are handled when the path is a
+	// symlink in the rootfs. If unset, DirlinkReplace is used.
+	DirlinkPolicy DirlinkPolicy
+
+	// AUFSCompat specifies whether layers generated by AUFS-based tools (such
+	// as old Docker exports) should be normalised. The AUFS metadata
+	// directories (.wh..wh.plnk and friends) are not extracted, hardlinks to
+	// files in .wh..wh.plnk are resolved, and whiteouts of paths which were
+	// already extracted from the same layer only apply to the lower layers.
+	AUFSCompat bool
+
+	// Checkpoint, if non-nil, is called by UnpackManifest with the progress of
+	// the unpack once the rootfs has been created and again after each layer
+	// has been completely applied to the rootfs. The last Checkpoint can be
+	// passed as Resume to continue an unpack which was interrupted (such as
+	// by the process being killed). It can only be used with DirRootfs.
+	Checkpoint func(Checkpoint) error
+
+	// Resume, if non-nil, is the last Checkpoint of an interrupted unpack of
+	// the same manifest (with the same options) into the bundle. Rather than
+	// requiring an empty bundle, UnpackManifest re-uses the existing rootfs
+	// and continues from the first layer which was not completely applied
+	// (any partially-applied layer is extracted again). The layers recorded
+	// in the checkpoint must match the DiffIDs of the image. It can only be
+	// used with DirRootfs, and cannot be used with LayerCache.
+	Resume *Checkpoint
+
+	// Report, if non-nil, is filled with the malformed entries which were
+	// skipped or corrected (due to Strictness). Layers which are re-used
+	// from a layer store or layer cache are not checked again.
+	Report *ExtractionReport
+
+	// NoVerify specifies that a mismatch between the digest of an
+	// uncompressed layer and its DiffID in the image configuration should
+	// only result in a warning, rather than an error. It cannot be used with
+	// OverlayfsMount or LayerCache.
+	NoVerify bool
+
+	// TarSplit specifies whether the tar-split metadata of each layer should
+	// be stored in the bundle (see TarSplitPath), so that layers can later be
+	// regenerated byte-for-byte from the bundle with ReassembleLayer. It
+	// cannot be used with OverlayfsMount or LayerCache, since layers which
+	// are re-used from a layer store or layer cache are not read.
+	TarSplit bool
+
+	// Workers is the maximum number of layers which are processed
+	// concurrently. With DirRootfs, layers are still applied in order but up
+	// to Workers of the following layers are decompressed and verified ahead
+	// of time. With the overlayfs formats, layers are extracted in parallel.
+	// If not greater than one, layers are processed sequentially.
+	Workers int
+
+	// LayerCache is the directory in which snapshots of the rootfs (after
+	// each layer is applied) are stored and re-used between unpacks when
+	// using DirRootfs, so that layers shared between images are not extracted
+	// repeatedly. If empty, no layer cache is used.
+	LayerCache string
+
+	// LayerCacheMode is how files are cloned between the layer cache and the
+	// rootfs. If unset, LayerCacheReflink is used.
+	LayerCacheMode LayerCacheMode
+
+	// LayerCacheSize is the maximum total size (in bytes) of the snapshots in
+	// the layer cache. Least-recently used snapshots are removed once the
+	// limit is exceeded. If not positive, the cache size is unlimited.
+	LayerCacheSize int64
+}
+
+// RepackOptions describes the behaviour of the various repack operations.
+type RepackOptions struct {
+	// MapOptions are the UID and GID mappings used when generating the layer.
+	MapOptions MapOptions
+
+	// XattrFilter decides which xattrs are included in the generated layer.
+	// If nil, xattrfilter.Default() is used.
+	XattrFilter *xattrfilter.Filter
+
+	// EmulateXattrs specifies whether xattrs stored with EmulatedXattrPrefix
+	// (by an unpack with EmulateXattrs set) should be included in the layer
+	// under their real names.
+	EmulateXattrs bool
+
+	// EmulateOwnership specifies whether the owner of each path should be
+	// taken from its rootlesscontainers.Keyname xattr (if set), rather than
+	// from the filesystem. The xattr itself is not included in the layer.
+	EmulateOwnership bool
+
+	// Devices are the devices recorded by a rootless unpack (see
+	// UnpackOptions.Devices). Any placeholders for these devices which are
+	// included in the layer (and are still empty regular files) are stored as
+	// the original devices.
+	Devices []Device
+
+	// Sparse specifies whether regular files containing holes should be
+	// stored in the layer as (GNU 1.0 format) sparse files.
+	Sparse bool
+
+	// Reproducible specifies whether host-specific information (user and
+	// group names, access and change times, and the generation time of
+	// whiteouts) should be omitted from the layer, so that generating a layer
+	// from the same inputs always results in the same layer.
+	Reproducible bool
+
+	// ClampTime, if non-nil, is the latest modification time permitted in the
+	// layer. Any later timestamps are replaced with ClampTime.
+	ClampTime *time.Time
+
+	// SocketPolicy is how sockets in the root filesystem are handled. If
+	// empty, SocketSkip is used.
+	SocketPolicy SocketPolicy
+
+	// SetuidPolicy is how setuid and setgid bits of paths in the root
+	// filesystem are handled. If empty, SetuidKeep is used.
+	SetuidPolicy SetuidPolicy
+
+	// ModeMask, if non-nil, is the set of permission bits (os.ModePerm)
+	// permitted in the layer. Any other permission bits are cleared.
+	ModeMask *os.FileMode
+
+	// Rewrite, if non-nil, is called for each path added to the layer (see
+	// RewriteFunc).
+	Rewrite RewriteFunc
+
+	// MetadataOnly is how regular files whose contents are unchanged but
+	// whose metadata has been modified are handled. If empty,
+	// MetadataOnlyInclude is used.
+	MetadataOnly MetadataOnlyPolicy
+
+	// MetadataOnlyMinSize is the smallest file size to which MetadataOnly is
+	// applied. Smaller files are always included in the layer.
+	MetadataOnlyMinSize int64
+}
+
+// RewriteFunc is a hook called by GenerateLayer for each path added to the
+// layer, before the header is written. hdr is the header generated for the
+// path (with all mappings applied), and path is the path on the host. The
+// hook may modify hdr (except for hdr.Name and hdr.Typeflag), and in the case
+// of regular files may also substitute the contents of the entry by returning
+// a non-nil io.ReadCloser, in which case hdr.Size must be set to the length of
+// the new contents. Returning nil keeps the original contents. The setuid
+// policy, mode mask and time clamping of the layer are applied after the hook
+// is called.
+type RewriteFunc func(hdr *tar.Header, path string) (io.ReadCloser, error)
+
+// EmulatedXattrPrefix is the prefix of the user.* xattrs used to store xattrs
+// which could not be set in rootless mode, when using EmulateXattrs. For
+// example, security.capability is stored as
+// user.rootlesscontainers.security.capability.
+const EmulatedXattrPrefix = "user.rootlesscontainers."
+
+// containsString returns whether the given string is in the slice.
+func containsString(slice []string, str string) bool {
+	for _, elem := range slice {
+		if elem == str {
+			return true
+		}
+	}
+	return false
+}
+
+// xattrFilterOrDefault returns the given filter, or the default filter if it
+// is nil.
+func xattrFilterOrDefault(filter *xattrfilter.Filter) xattrfilter.Filter {
+	if filter == nil {
+		return xattrfilter.Default()
+	}
+	return *filter
+}
+
 // mapHeader maps a tar.Header generated from the filesystem so that it
 // describes the inode as it would be observed by a container process. In
 // particular this involves apply an ID mapping from the host filesystem to the
@@ -63,6 +311,16 @@ func mapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
+
+	// POSIX ACLs also contain IDs which need to be mapped. In rootless mode we
+	// can only map a single user, so any other entries have to be dropped.
+	if err := mapPosixACLXattrs(hdr.Xattrs, func(uid int) (int, error) {
+		return idtools.ToContainer(uid, mapOptions.UIDMappings)
+	}, func(gid int) (int, error) {
+		return idtools.ToContainer(gid, mapOptions.GIDMappings)
+	}, mapOptions.Rootless); err != nil {
+		return errors.Wrap(err, "map posix acls to container")
+	}
 	return nil
 }
 
@@ -90,6 +348,17 @@ func unmapHeader(hdr *tar.Header, mapOptions MapOptions) error {
 
 	hdr.Uid = newUID
 	hdr.Gid = newGID
+
+	// POSIX ACLs also contain IDs which need to be mapped. In rootless mode we
+	// cannot set ACL entries for users other than the one we are mapped to, so
+	// restoring them is best-effort.
+	if err := mapPosixACLXattrs(hdr.Xattrs, func(uid int) (int, error) {
+		return idtools.ToHost(uid, mapOptions.UIDMappings)
+	}, func(gid int) (int, error) {
+		return idtools.ToHost(gid, mapOptions.GIDMappings)
+	}, mapOptions.Rootless); err != nil {
+		return errors.Wrap(err, "map posix acls to host")
+	}
 	return nil
 }
 
@@ -0,0 +1,74 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestMapHeaderMultipleRanges(t *testing.T) {
+	mapOptions := MapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 65534},
+			{ContainerID: 65534, HostID: 65534, Size: 1},
+		},
+		GIDMappings: []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 200000, Size: 1000},
+			{ContainerID: 1000, HostID: 1000, Size: 1},
+			{ContainerID: 1001, HostID: 201001, Size: 64535},
+		},
+	}
+
+	for _, test := range []struct {
+		uid, gid         int
+		hostUID, hostGID int
+	}{
+		{0, 0, 100000, 200000},
+		{1000, 1000, 101000, 1000},
+		{65533, 1001, 165533, 201001},
+		{65534, 65534, 65534, 265534},
+	} {
+		hdr := &tar.Header{Uid: test.uid, Gid: test.gid}
+		if err := unmapHeader(hdr, mapOptions); err != nil {
+			t.Errorf("%d:%d: unexpected error in unmapHeader: %v", test.uid, test.gid, err)
+			continue
+		}
+		if hdr.Uid != test.hostUID || hdr.Gid != test.hostGID {
+			t.Errorf("%d:%d: expected host owner %d:%d, got %d:%d", test.uid, test.gid, test.hostUID, test.hostGID, hdr.Uid, hdr.Gid)
+		}
+
+		if err := mapHeader(hdr, mapOptions); err != nil {
+			t.Errorf("%d:%d: unexpected error in mapHeader: %v", test.uid, test.gid, err)
+			continue
+		}
+		if hdr.Uid != test.uid || hdr.Gid != test.gid {
+			t.Errorf("%d:%d: owner did not round-trip, got %d:%d", test.uid, test.gid, hdr.Uid, hdr.Gid)
+		}
+	}
+
+	// IDs outside of every range cannot be mapped.
+	if err := unmapHeader(&tar.Header{Uid: 65535}, mapOptions); err == nil {
+		t.Errorf("expected an error unmapping an unmapped uid")
+	}
+	if err := mapHeader(&tar.Header{Uid: 0, Gid: 200000}, mapOptions); err == nil {
+		t.Errorf("expected an error mapping an unmapped host uid")
+	}
+}
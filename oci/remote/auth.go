@@ -0,0 +1,320 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Credentials are used to authenticate with a registry.
+type Credentials struct {
+	// Username and Password are the credentials of the user.
+	Username string
+	Password string
+
+	// IdentityToken is an OAuth2 refresh token (as stored by "docker login"
+	// for some registries), which is used instead of the password if it is
+	// set.
+	IdentityToken string
+}
+
+// StaticCredentials returns a function (suitable for Options.Credentials)
+// which returns the given credentials for every registry.
+func StaticCredentials(creds Credentials) func(registry string) (Credentials, bool) {
+	return func(string) (Credentials, bool) {
+		return creds, true
+	}
+}
+
+// Authenticator authenticates requests to registries. Custom implementations
+// can be used to support sources of credentials (or authentication schemes)
+// which are not supported by CredentialsAuthenticator.
+type Authenticator interface {
+	// Authorization returns the value of the Authorization header which
+	// satisfies the given challenge (the WWW-Authenticate header of the
+	// response) from the registry, for requests needing the given
+	// (space-separated) token scopes. The given HTTP client is configured
+	// for the registry, and should be used to contact token servers.
+	Authorization(ctx context.Context, client *http.Client, registry, challenge, scope string) (string, error)
+}
+
+// CredentialsAuthenticator returns an Authenticator which supports HTTP
+// basic authentication and the bearer token flow used by Docker registries,
+// using the credentials returned by the given function. If the function is
+// nil (or there are no credentials for a registry), tokens are requested
+// anonymously. This is the Authenticator used by default.
+func CredentialsAuthenticator(credentials func(registry string) (Credentials, bool)) Authenticator {
+	return credentialsAuthenticator(credentials)
+}
+
+// credentialsAuthenticator is the Authenticator returned by
+// CredentialsAuthenticator.
+type credentialsAuthenticator func(registry string) (Credentials, bool)
+
+// Authorization implements Authenticator.
+func (a credentialsAuthenticator) Authorization(ctx context.Context, client *http.Client, registry, challenge, scope string) (string, error) {
+	var creds *Credentials
+	if a != nil {
+		if value, ok := a(registry); ok {
+			creds = &value
+		}
+	}
+
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "bearer":
+		token, err := fetchToken(ctx, client, params, scope, creds)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	case "basic":
+		if creds == nil {
+			return "", errors.Errorf("registry requires credentials")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	}
+	return "", errors.Errorf("unsupported authentication challenge: %q", challenge)
+}
+
+// dockerAuth is an entry of the "auths" section of a DockerConfig.
+type dockerAuth struct {
+	// Auth is the base64 encoding of "username:password".
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DockerConfig is the subset of the Docker client configuration
+// (config.json) which contains the credentials created by "docker login"
+// (and "podman login --authfile"). Credential helpers and credential stores
+// are not supported.
+type DockerConfig struct {
+	Auths map[string]dockerAuth `json:"auths"`
+}
+
+// DefaultDockerConfigPath returns the path of the Docker client
+// configuration, which is $DOCKER_CONFIG/config.json (or
+// ~/.docker/config.json if $DOCKER_CONFIG is not set).
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// LoadDockerConfig reads the Docker client configuration at the given path.
+// If the file doesn't exist, the returned error satisfies os.IsNotExist
+// (after errors.Cause).
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open docker config")
+	}
+	defer fh.Close()
+
+	var config DockerConfig
+	if err := json.NewDecoder(fh).Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "parse docker config %s", path)
+	}
+	return &config, nil
+}
+
+// normaliseRegistry converts a key of the "auths" section of a DockerConfig
+// (which may be a URL) to the registry it refers to.
+func normaliseRegistry(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.SplitN(key, "/", 2)[0]
+	switch key {
+	case "index.docker.io", defaultRegistryHost:
+		return DefaultRegistry
+	}
+	return key
+}
+
+// Credentials returns the credentials for the given registry, and whether
+// there are any.
+func (c *DockerConfig) Credentials(registry string) (Credentials, bool) {
+	if c == nil {
+		return Credentials{}, false
+	}
+	registry = normaliseRegistry(registry)
+	for key, auth := range c.Auths {
+		if normaliseRegistry(key) != registry {
+			continue
+		}
+		creds := Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				continue
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			creds.Username, creds.Password = parts[0], parts[1]
+		}
+		return creds, true
+	}
+	return Credentials{}, false
+}
+
+// parseChallenge parses the WWW-Authenticate header of a response, returning
+// the (lowercase) authentication scheme and its parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	header = strings.TrimSpace(header)
+	sep := strings.IndexByte(header, ' ')
+	if sep == -1 {
+		return strings.ToLower(header), nil
+	}
+	scheme, rest := strings.ToLower(header[:sep]), header[sep+1:]
+
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		sep := strings.IndexByte(rest, '=')
+		if sep == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:sep]))
+		rest = rest[sep+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted values can contain commas, and escaped quotes.
+			var buf strings.Builder
+			idx := 1
+			for ; idx < len(rest) && rest[idx] != '"'; idx++ {
+				if rest[idx] == '\\' && idx+1 < len(rest) {
+					idx++
+				}
+				buf.WriteByte(rest[idx])
+			}
+			value = buf.String()
+			if idx < len(rest) {
+				idx++
+			}
+			rest = rest[idx:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// tokenResponse is the response of a token server.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// fetchToken fetches a bearer token with the given (space-separated) scopes
+// from the token server described by the parameters of a "Bearer" challenge,
+// as described by the Docker registry token authentication specification.
+func fetchToken(ctx context.Context, client *http.Client, params map[string]string, scope string, creds *Credentials) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", errors.Errorf("bearer challenge has no realm")
+	}
+	realmURL, err := url.Parse(realm)
+	if err != nil {
+		return "", errors.Wrap(err, "parse token realm")
+	}
+
+	var req *http.Request
+	if creds != nil && creds.IdentityToken != "" {
+		// Identity tokens are exchanged using the OAuth2 refresh token flow.
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", creds.IdentityToken)
+		form.Set("client_id", "umoci")
+		form.Set("service", params["service"])
+		form.Set("scope", scope)
+		req, err = http.NewRequest("POST", realmURL.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", errors.Wrap(err, "create token request")
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realmURL.Query()
+		if service := params["service"]; service != "" {
+			query.Set("service", service)
+		}
+		// Several scopes can be requested at once (such as when mounting a
+		// blob from another repository).
+		for _, s := range strings.Fields(scope) {
+			query.Add("scope", s)
+		}
+		realmURL.RawQuery = query.Encode()
+		req, err = http.NewRequest("GET", realmURL.String(), nil)
+		if err != nil {
+			return "", errors.Wrap(err, "create token request")
+		}
+		if creds != nil {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "request token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Wrap(responseError(resp), "request token")
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "parse token response")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.Errorf("token server returned no token")
+	}
+	return token.Token, nil
+}
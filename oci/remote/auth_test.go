@@ -0,0 +1,107 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{`Basic realm="Registry Realm"`, "basic", map[string]string{"realm": "Registry Realm"}},
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull,push"`,
+			"bearer",
+			map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/busybox:pull,push",
+			},
+		},
+		{`bearer Realm=https://example.com/token, error="insufficient \"scope\""`, "bearer", map[string]string{
+			"realm": "https://example.com/token",
+			"error": `insufficient "scope"`,
+		}},
+	} {
+		scheme, params := parseChallenge(test.header)
+		if scheme != test.scheme || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("parsing %q: got %q %v expected %q %v", test.header, scheme, params, test.scheme, test.params)
+		}
+	}
+}
+
+func TestDockerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestDockerConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	if _, err := LoadDockerConfig(path); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected a non-existent error loading missing config: %+v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+basicAuth("user", "pass:word")+`"},
+		"registry.example.com:5000": {"username": "other", "password": "secret"},
+		"https://token.example.com": {"identitytoken": "refresh"}
+	},
+	"credsStore": "desktop"
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadDockerConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %+v", err)
+	}
+
+	for registry, expected := range map[string]Credentials{
+		"docker.io":                 {Username: "user", Password: "pass:word"},
+		"registry-1.docker.io":      {Username: "user", Password: "pass:word"},
+		"registry.example.com:5000": {Username: "other", Password: "secret"},
+		"token.example.com":         {IdentityToken: "refresh"},
+	} {
+		creds, ok := config.Credentials(registry)
+		if !ok || creds != expected {
+			t.Errorf("credentials for %s: got %+v (%v) expected %+v", registry, creds, ok, expected)
+		}
+	}
+	for _, registry := range []string{"registry.example.com", "quay.io"} {
+		if creds, ok := config.Credentials(registry); ok {
+			t.Errorf("unexpected credentials for %s: %+v", registry, creds)
+		}
+	}
+
+	// A missing config has no credentials.
+	var missing *DockerConfig
+	if _, ok := missing.Credentials("docker.io"); ok {
+		t.Errorf("unexpected credentials in nil config")
+	}
+}
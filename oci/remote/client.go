@@ -0,0 +1,414 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxManifestSize is the largest manifest which will be read from a registry.
+const maxManifestSize = 4 << 20
+
+// manifestMediaTypes are the media types of manifests and indexes which are
+// accepted from registries.
+var manifestMediaTypes = []string{
+	ispec.MediaTypeImageManifest,
+	ispec.MediaTypeImageIndex,
+	casext.MediaTypeDockerManifest,
+	casext.MediaTypeDockerManifestList,
+}
+
+// Options configure how a Client connects to registries.
+type Options struct {
+	// Credentials returns the credentials for the given registry, and whether
+	// there are any. If it is nil (or there are no credentials for a
+	// registry) requests to the registry are made anonymously.
+	// DockerConfig.Credentials is suitable.
+	Credentials func(registry string) (Credentials, bool)
+
+	// Authenticator authenticates requests to registries which require it.
+	// If it is nil, CredentialsAuthenticator(Credentials) is used.
+	Authenticator Authenticator
+
+	// Proxy returns the URL of the proxy to use for the given request, as
+	// with http.Transport.Proxy. If it is nil, the proxy is configured by
+	// $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY (see
+	// http.ProxyFromEnvironment).
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// InsecureSkipVerify disables the verification of the TLS certificates
+	// of registries.
+	InsecureSkipVerify bool
+
+	// PlainHTTP connects to registries using HTTP rather than HTTPS.
+	PlainHTTP bool
+
+	// Registries are the settings of individual registries, keyed by the
+	// host of the registry (including the port). They are applied in
+	// addition to the settings for every registry.
+	Registries map[string]RegistryOptions
+
+	// Mirrors returns the references from which the image referred to by
+	// the given reference is pulled, in the order in which they are tried
+	// (usually mirrors of the registry followed by the reference itself). It
+	// can return an error to forbid pulling the reference. If it is nil,
+	// images are only pulled from the registry of the reference.
+	// RegistriesConfig.Mirrors is suitable.
+	Mirrors func(ref Reference) ([]Reference, error)
+
+	// CertDir is a directory containing a subdirectory for each registry
+	// (named after the host of the registry, including the port) containing
+	// CA certificates (*.crt) and client certificates (*.cert with a
+	// corresponding *.key) to use for that registry, following the layout of
+	// /etc/containers/certs.d. Registries without a subdirectory use the
+	// system CA certificates.
+	CertDir string
+}
+
+// RegistryOptions configure how a Client connects to a particular registry.
+type RegistryOptions struct {
+	// InsecureSkipVerify disables the verification of the TLS certificates
+	// of the registry.
+	InsecureSkipVerify bool
+
+	// PlainHTTP connects to the registry using HTTP rather than HTTPS.
+	PlainHTTP bool
+
+	// Insecure disables the verification of the TLS certificates of the
+	// registry, and falls back to HTTP if the registry doesn't support
+	// HTTPS.
+	Insecure bool
+}
+
+// registry returns the settings used for the given registry.
+func (o Options) registry(registry string) RegistryOptions {
+	options := o.Registries[registry]
+	options.InsecureSkipVerify = options.InsecureSkipVerify || options.Insecure || o.InsecureSkipVerify
+	options.PlainHTTP = options.PlainHTTP || o.PlainHTTP
+	return options
+}
+
+// Client is a client for registries implementing the OCI distribution
+// specification. It is safe for concurrent use.
+type Client struct {
+	options Options
+
+	lock sync.Mutex
+	// clients are the HTTP clients for each registry.
+	clients map[string]*http.Client
+	// authorization are the values of the Authorization header used for each
+	// registry and scope.
+	authorization map[string]string
+	// plainHTTP are the insecure registries which have been found to only
+	// support HTTP.
+	plainHTTP map[string]bool
+}
+
+// NewClient creates a new client with the given options.
+func NewClient(options Options) *Client {
+	return &Client{
+		options:       options,
+		clients:       map[string]*http.Client{},
+		authorization: map[string]string{},
+		plainHTTP:     map[string]bool{},
+	}
+}
+
+// httpClient returns the HTTP client used to connect to the given registry.
+func (c *Client) httpClient(registry string) (*http.Client, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client, ok := c.clients[registry]; ok {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.options.registry(registry).InsecureSkipVerify,
+	}
+	if c.options.CertDir != "" {
+		if err := loadCertDir(tlsConfig, filepath.Join(c.options.CertDir, registry)); err != nil {
+			return nil, errors.Wrapf(err, "load certificates for %s", registry)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.options.Proxy != nil {
+		transport.Proxy = c.options.Proxy
+	}
+	client := &http.Client{Transport: transport}
+	c.clients[registry] = client
+	return client, nil
+}
+
+// loadCertDir adds the CA certificates and client certificates in the given
+// directory (if it exists) to the TLS configuration.
+func loadCertDir(tlsConfig *tls.Config, dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read certificate directory")
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch filepath.Ext(entry.Name()) {
+		case ".crt":
+			if tlsConfig.RootCAs == nil {
+				pool, err := x509.SystemCertPool()
+				if err != nil {
+					pool = x509.NewCertPool()
+				}
+				tlsConfig.RootCAs = pool
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return errors.Wrap(err, "read CA certificate")
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+				return errors.Errorf("no certificates found in %s", path)
+			}
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return errors.Wrapf(err, "load client certificate %s", path)
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+	}
+	return nil
+}
+
+// url returns the URL of the given path of the API of the registry.
+func (c *Client) url(ref Reference, format string, args ...interface{}) string {
+	c.lock.Lock()
+	plainHTTP := c.plainHTTP[ref.Registry]
+	c.lock.Unlock()
+
+	scheme := "https"
+	if plainHTTP || c.options.registry(ref.Registry).PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.host(), ref.Repository, fmt.Sprintf(format, args...))
+}
+
+// scope returns the scope of a token granting the given actions (such as
+// "pull" or "pull,push") on the repository of the reference.
+func scope(ref Reference, actions string) string {
+	return fmt.Sprintf("repository:%s:%s", ref.Repository, actions)
+}
+
+// do makes a request to the registry of the reference, authenticating with
+// the registry (and retrying the request) if it is required. Requests to
+// insecure registries (see RegistryOptions.Insecure) which fail using HTTPS
+// are retried using HTTP. newRequest is called for each attempt, so that the
+// request body can be sent again.
+func (c *Client) do(ctx context.Context, ref Reference, scope string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	client, err := c.httpClient(ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	key := ref.Registry + " " + scope
+
+	authenticated, fallback := false, false
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		c.lock.Lock()
+		authorization := c.authorization[key]
+		c.lock.Unlock()
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			if !fallback && req.URL.Scheme == "https" && ctx.Err() == nil && c.options.registry(ref.Registry).Insecure {
+				c.lock.Lock()
+				c.plainHTTP[ref.Registry] = true
+				c.lock.Unlock()
+				fallback = true
+				continue
+			}
+			return nil, errors.Wrap(err, "send request")
+		}
+		if resp.StatusCode != http.StatusUnauthorized || authenticated {
+			return resp, nil
+		}
+		authenticated = true
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		authenticator := c.options.Authenticator
+		if authenticator == nil {
+			authenticator = CredentialsAuthenticator(c.options.Credentials)
+		}
+		authorization, err = authenticator.Authorization(ctx, client, ref.Registry, challenge, scope)
+		if err != nil {
+			return nil, errors.Wrapf(err, "authenticate with %s", ref.Registry)
+		}
+		c.lock.Lock()
+		c.authorization[key] = authorization
+		c.lock.Unlock()
+	}
+}
+
+// registryErrors is the body of an error response from a registry.
+type registryErrors struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// responseError returns an error describing an unexpected response, including
+// the errors returned by the registry (if any).
+func responseError(resp *http.Response) error {
+	var body registryErrors
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &body); err != nil || len(body.Errors) == 0 {
+		return errors.Errorf("unexpected response: %s", resp.Status)
+	}
+	var messages []string
+	for _, e := range body.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return errors.Errorf("unexpected response: %s (%s)", resp.Status, strings.Join(messages, "; "))
+}
+
+// GetManifest fetches the manifest (or index) referred to by the reference,
+// returning its descriptor and contents. If the reference has a digest, the
+// contents are verified against it.
+func (c *Client) GetManifest(ctx context.Context, ref Reference) (ispec.Descriptor, []byte, error) {
+	resp, err := c.do(ctx, ref, scope(ref, "pull"), func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", c.url(ref, "manifests/%s", ref.Reference()), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "get manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ispec.Descriptor{}, nil, errors.Wrapf(responseError(resp), "get manifest %s", ref)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "read manifest")
+	}
+	if len(data) > maxManifestSize {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest %s is larger than %d bytes", ref, maxManifestSize)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "parse manifest content type")
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if ref.Digest != "" {
+		if ref.Digest.Algorithm() != descriptor.Digest.Algorithm() {
+			descriptor.Digest = ref.Digest.Algorithm().FromBytes(data)
+		}
+		if descriptor.Digest != ref.Digest {
+			return ispec.Descriptor{}, nil, errors.Errorf("manifest %s has the wrong digest: %s", ref, descriptor.Digest)
+		}
+	}
+	return descriptor, data, nil
+}
+
+// GetBlob fetches the blob with the given descriptor from the repository of
+// the reference. The contents of the blob are verified against the
+// descriptor as they are read, so reading the blob fails (rather than
+// returning io.EOF) if they do not match.
+func (c *Client) GetBlob(ctx context.Context, ref Reference, descriptor ispec.Descriptor) (io.ReadCloser, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid blob digest")
+	}
+	resp, err := c.do(ctx, ref, scope(ref, "pull"), func() (*http.Request, error) {
+		return http.NewRequest("GET", c.url(ref, "blobs/%s", descriptor.Digest), nil)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, errors.Wrapf(responseError(resp), "get blob %s", descriptor.Digest)
+	}
+	return &verifiedReader{
+		ReadCloser: resp.Body,
+		verifier:   descriptor.Digest.Verifier(),
+		descriptor: descriptor,
+	}, nil
+}
+
+// verifiedReader verifies the contents of a blob as they are read.
+type verifiedReader struct {
+	io.ReadCloser
+	verifier   digest.Verifier
+	descriptor ispec.Descriptor
+	size       int64
+}
+
+// Read reads from the blob, returning an error instead of io.EOF if the
+// contents of the blob do not match its descriptor.
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.size += int64(n)
+	r.verifier.Write(p[:n])
+	if r.size > r.descriptor.Size {
+		return n, errors.Errorf("blob %s is larger than %d bytes", r.descriptor.Digest, r.descriptor.Size)
+	}
+	if err == io.EOF {
+		if r.size != r.descriptor.Size {
+			return n, errors.Errorf("blob %s has the wrong size: %d (expected %d)", r.descriptor.Digest, r.size, r.descriptor.Size)
+		}
+		if !r.verifier.Verified() {
+			return n, errors.Errorf("blob %s has the wrong digest", r.descriptor.Digest)
+		}
+	}
+	return n, err
+}
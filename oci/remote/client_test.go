@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// countingAuthenticator is an Authenticator which counts the challenges it
+// is given, and delegates to another Authenticator.
+type countingAuthenticator struct {
+	Authenticator
+
+	lock       sync.Mutex
+	challenges int
+}
+
+// Authorization implements Authenticator.
+func (a *countingAuthenticator) Authorization(ctx context.Context, client *http.Client, registry, challenge, scope string) (string, error) {
+	a.lock.Lock()
+	a.challenges++
+	a.lock.Unlock()
+	return a.Authenticator.Authorization(ctx, client, registry, challenge, scope)
+}
+
+func TestClientAuthenticator(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestClientAuthenticator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	registry.username, registry.password = "user", "password"
+	index, _ := fakeImage(registry, "private", "latest")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	// The Authenticator takes precedence over the Credentials.
+	authenticator := &countingAuthenticator{
+		Authenticator: CredentialsAuthenticator(StaticCredentials(Credentials{Username: "user", Password: "password"})),
+	}
+	client := NewClient(Options{
+		PlainHTTP:     true,
+		Credentials:   StaticCredentials(Credentials{Username: "user", Password: "wrong"}),
+		Authenticator: authenticator,
+	})
+	descriptor, err := client.Pull(ctx, registry.ref("private", "latest"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling with authenticator: %+v", err)
+	}
+	if descriptor.Digest != index.Digest {
+		t.Errorf("unexpected digest: got %s expected %s", descriptor.Digest, index.Digest)
+	}
+	if authenticator.challenges == 0 {
+		t.Errorf("authenticator was not used")
+	}
+
+	// Authenticator errors are reported.
+	client = NewClient(Options{
+		PlainHTTP:     true,
+		Authenticator: CredentialsAuthenticator(nil),
+	})
+	if _, err := client.Pull(ctx, registry.ref("private", "latest"), engine, PullOptions{}); err == nil {
+		t.Errorf("expected error pulling anonymously")
+	}
+}
+
+func TestClientRegistries(t *testing.T) {
+	ctx := context.Background()
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	index, _ := fakeImage(registry, "test/image", "latest")
+
+	// The registry only supports HTTP.
+	client := NewClient(Options{})
+	if _, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest")); err == nil {
+		t.Errorf("expected error connecting to plain HTTP registry using HTTPS")
+	}
+
+	// Settings of other registries don't apply.
+	client = NewClient(Options{Registries: map[string]RegistryOptions{
+		"other.example.com": {PlainHTTP: true},
+	}})
+	if _, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest")); err == nil {
+		t.Errorf("expected error using the settings of another registry")
+	}
+
+	client = NewClient(Options{Registries: map[string]RegistryOptions{
+		registry.host(): {PlainHTTP: true},
+	}})
+	descriptor, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest"))
+	if err != nil {
+		t.Fatalf("unexpected error using per-registry settings: %+v", err)
+	}
+	if descriptor.Digest != index.Digest {
+		t.Errorf("unexpected digest: got %s expected %s", descriptor.Digest, index.Digest)
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	ctx := context.Background()
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	fakeImage(registry, "test/image", "latest")
+
+	var lock sync.Mutex
+	var hosts []string
+	client := NewClient(Options{
+		PlainHTTP: true,
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			hosts = append(hosts, req.URL.Host)
+			// Connect directly.
+			return nil, nil
+		},
+	})
+	if _, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest")); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(hosts) == 0 {
+		t.Fatalf("proxy function was not used")
+	}
+	for _, host := range hosts {
+		if host != registry.host() {
+			t.Errorf("unexpected proxied host: %s", host)
+		}
+	}
+
+	// Proxy errors are reported.
+	client = NewClient(Options{
+		PlainHTTP: true,
+		Proxy:     http.ProxyURL(&url.URL{Scheme: "http", Host: "localhost:1"}),
+	})
+	if _, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest")); err == nil {
+		t.Errorf("expected error using unreachable proxy")
+	}
+}
+
+func TestClientInsecure(t *testing.T) {
+	ctx := context.Background()
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	index, _ := fakeImage(registry, "test/image", "latest")
+
+	// Insecure registries fall back to HTTP.
+	client := NewClient(Options{Registries: map[string]RegistryOptions{
+		registry.host(): {Insecure: true},
+	}})
+	for i := 0; i < 2; i++ {
+		descriptor, _, err := client.GetManifest(ctx, registry.ref("test/image", "latest"))
+		if err != nil {
+			t.Fatalf("unexpected error connecting to insecure registry: %+v", err)
+		}
+		if descriptor.Digest != index.Digest {
+			t.Errorf("unexpected digest: got %s expected %s", descriptor.Digest, index.Digest)
+		}
+	}
+	if url := client.url(registry.ref("test/image", "latest"), "tags/list"); !strings.HasPrefix(url, "http://") {
+		t.Errorf("fallback to HTTP was not remembered: %s", url)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultWorkers is the number of blobs which are copied concurrently if no
+// other value is given.
+const DefaultWorkers = 4
+
+// PullOptions configure Client.Pull.
+type PullOptions struct {
+	// Workers is the maximum number of blobs downloaded concurrently. If it is
+	// zero, DefaultWorkers is used.
+	Workers int
+
+	// Platform selects a single platform of the image if the reference
+	// refers to an image index (or a Docker manifest list), in which case
+	// only the manifest for the platform (see mutate.MatchPlatform) is
+	// pulled and its descriptor is returned. References to a single manifest
+	// are pulled as-is.
+	Platform *ispec.Platform
+}
+
+// pullState is the set of blobs found while walking the manifests of an
+// image being pulled.
+type pullState struct {
+	// manifests are the manifests (and indexes) of the image, ordered so
+	// that every manifest comes after the manifests it refers to.
+	manifests []ispec.Descriptor
+	// contents are the contents of the manifests.
+	contents map[digest.Digest][]byte
+	// blobs are the other blobs (configurations and layers) of the image.
+	blobs []ispec.Descriptor
+	// seen are the digests of the blobs which have already been found.
+	seen map[digest.Digest]bool
+}
+
+// Pull downloads the image referred to by the reference (and every blob it
+// refers to, including every manifest of an index) into the CAS, and returns
+// the descriptor of the image. Blobs which are already in the CAS are not
+// downloaded again, and every blob is verified against its descriptor. The
+// descriptor is not added to the top-level index, which is left to the
+// caller (see casext.Engine.UpdateReference).
+//
+// The media types of the image are left as-is, so images which use the
+// Docker media types must be converted (see mutate.Convert) if they should be
+// modified as OCI images.
+//
+// If Options.Mirrors is set, the image is pulled from the first of the
+// references it returns from which it can be pulled.
+func (c *Client) Pull(ctx context.Context, ref Reference, engine cas.Engine, opt PullOptions) (ispec.Descriptor, error) {
+	sources := []Reference{ref}
+	if c.options.Mirrors != nil {
+		var err error
+		if sources, err = c.options.Mirrors(ref); err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "find mirrors")
+		}
+		if len(sources) == 0 {
+			return ispec.Descriptor{}, errors.Errorf("no sources to pull %s from", ref)
+		}
+	}
+
+	var err error
+	for idx, source := range sources {
+		var root ispec.Descriptor
+		root, err = c.pull(ctx, source, engine, opt)
+		if err == nil {
+			return root, nil
+		}
+		if ctx.Err() != nil || idx == len(sources)-1 {
+			break
+		}
+		log.Warnf("pull: failed to pull %s, trying %s: %v", source, sources[idx+1], err)
+	}
+	if len(sources) > 1 {
+		err = errors.Wrapf(err, "tried %d sources", len(sources))
+	}
+	return ispec.Descriptor{}, err
+}
+
+// pull downloads the image referred to by the reference, as with Pull
+// (ignoring Options.Mirrors).
+func (c *Client) pull(ctx context.Context, ref Reference, engine cas.Engine, opt PullOptions) (ispec.Descriptor, error) {
+	root, data, err := c.GetManifest(ctx, ref)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if opt.Platform != nil {
+		if root, data, err = c.selectPlatform(ctx, ref, root, data, *opt.Platform); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+
+	state := &pullState{
+		contents: map[digest.Digest][]byte{},
+		seen:     map[digest.Digest]bool{},
+	}
+	if err := c.walkManifest(ctx, ref, state, root, data); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := c.pullBlobs(ctx, ref, engine, state.blobs, opt.Workers); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	for _, manifest := range state.manifests {
+		if err := putBlob(ctx, engine, manifest, bytes.NewReader(state.contents[manifest.Digest])); err != nil {
+			return ispec.Descriptor{}, errors.Wrapf(err, "put manifest %s", manifest.Digest)
+		}
+	}
+	return root, nil
+}
+
+// selectPlatform returns the descriptor and contents of the manifest for the
+// given platform, if the given manifest is an index (or a manifest list).
+// Otherwise, the given manifest is returned.
+func (c *Client) selectPlatform(ctx context.Context, ref Reference, descriptor ispec.Descriptor, data []byte, platform ispec.Platform) (ispec.Descriptor, []byte, error) {
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList:
+	default:
+		return descriptor, data, nil
+	}
+
+	var index ispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrapf(err, "parse index %s", descriptor.Digest)
+	}
+	var (
+		matches   []ispec.Descriptor
+		platforms []string
+	)
+	for _, entry := range index.Manifests {
+		if mutate.MatchPlatform(entry, platform) {
+			matches = append(matches, entry)
+		}
+		if entry.Platform != nil {
+			platforms = append(platforms, formatPlatform(*entry.Platform))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return ispec.Descriptor{}, nil, errors.Errorf("%s has no manifest for platform %s (available platforms: %s)", ref, formatPlatform(platform), strings.Join(platforms, ", "))
+	case 1:
+	default:
+		return ispec.Descriptor{}, nil, errors.Errorf("%s has %d manifests for platform %s", ref, len(matches), formatPlatform(platform))
+	}
+	entry := matches[0]
+	if err := entry.Digest.Validate(); err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrapf(err, "invalid descriptor in %s", descriptor.Digest)
+	}
+
+	childRef := ref
+	childRef.Tag, childRef.Digest = "", entry.Digest
+	childDescriptor, childData, err := c.GetManifest(ctx, childRef)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+	if childDescriptor.Size != entry.Size {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest %s has the wrong size: %d (expected %d)", entry.Digest, childDescriptor.Size, entry.Size)
+	}
+	// The entry of the index takes precedence over the Content-Type returned
+	// by the registry, and describes the platform of the manifest.
+	childDescriptor.MediaType = entry.MediaType
+	childDescriptor.Platform = entry.Platform
+	return childDescriptor, childData, nil
+}
+
+// formatPlatform returns the os/architecture[/variant] form of the platform.
+func formatPlatform(platform ispec.Platform) string {
+	value := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		value += "/" + platform.Variant
+	}
+	return value
+}
+
+// walkManifest finds the blobs referred to by the given manifest (fetching
+// the manifests it refers to) and adds them to the state.
+func (c *Client) walkManifest(ctx context.Context, ref Reference, state *pullState, descriptor ispec.Descriptor, data []byte) error {
+	state.seen[descriptor.Digest] = true
+
+	var children []ispec.Descriptor
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList:
+		var index ispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return errors.Wrapf(err, "parse index %s", descriptor.Digest)
+		}
+		children = index.Manifests
+	case ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest:
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return errors.Wrapf(err, "parse manifest %s", descriptor.Digest)
+		}
+		children = append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+	default:
+		return errors.Errorf("unsupported manifest media type %s: %s", descriptor.MediaType, descriptor.Digest)
+	}
+
+	for _, child := range children {
+		if state.seen[child.Digest] {
+			continue
+		}
+		if err := child.Digest.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid descriptor in %s", descriptor.Digest)
+		}
+		switch child.MediaType {
+		case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList,
+			ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest:
+			childRef := ref
+			childRef.Tag, childRef.Digest = "", child.Digest
+			childDescriptor, childData, err := c.GetManifest(ctx, childRef)
+			if err != nil {
+				return err
+			}
+			if childDescriptor.Size != child.Size {
+				return errors.Errorf("manifest %s has the wrong size: %d (expected %d)", child.Digest, childDescriptor.Size, child.Size)
+			}
+			// The media type of the descriptor takes precedence over the
+			// Content-Type returned by the registry.
+			childDescriptor.MediaType = child.MediaType
+			if err := c.walkManifest(ctx, ref, state, childDescriptor, childData); err != nil {
+				return err
+			}
+		default:
+			state.seen[child.Digest] = true
+			state.blobs = append(state.blobs, child)
+		}
+	}
+
+	state.manifests = append(state.manifests, descriptor)
+	state.contents[descriptor.Digest] = data
+	return nil
+}
+
+// pullBlobs downloads the given blobs into the CAS (skipping blobs which are
+// already in the CAS), using up to the given number of concurrent workers.
+func (c *Client) pullBlobs(ctx context.Context, ref Reference, engine cas.Engine, blobs []ispec.Descriptor, workers int) error {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan ispec.Descriptor)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range jobs {
+				if err := c.pullBlob(ctx, ref, engine, blob); err != nil {
+					errOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "pull blob %s", blob.Digest)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, blob := range blobs {
+		select {
+		case jobs <- blob:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// pullBlob downloads a single blob into the CAS, unless it is already in the
+// CAS.
+func (c *Client) pullBlob(ctx context.Context, ref Reference, engine cas.Engine, blob ispec.Descriptor) error {
+	if reader, err := engine.GetBlob(ctx, blob.Digest); err == nil {
+		reader.Close()
+		log.Debugf("pull: blob %s already exists", blob.Digest)
+		return nil
+	}
+
+	log.Infof("pull: downloading blob %s (%d bytes)", blob.Digest, blob.Size)
+	reader, err := c.GetBlob(ctx, ref, blob)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return putBlob(ctx, engine, blob, reader)
+}
+
+// putBlob adds the contents of the reader to the CAS, and checks that they
+// match the descriptor.
+func putBlob(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor, reader io.Reader) error {
+	blobDigest, blobSize, err := engine.PutBlob(ctx, reader)
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if blobDigest != descriptor.Digest || blobSize != descriptor.Size {
+		// The blob is stored under its actual digest, so it is removed to
+		// avoid leaving a useless blob in the CAS.
+		if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+			log.Warnf("pull: failed to delete mismatched blob %s: %v", blobDigest, err)
+		}
+		return errors.Errorf("blob has the wrong digest: %s (expected %s)", blobDigest, descriptor.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// fakeImage adds a multi-platform image to the repository of the registry,
+// returning the descriptor of the index and the descriptors of every blob.
+func fakeImage(r *fakeRegistry, repository, tag string) (ispec.Descriptor, []ispec.Descriptor) {
+	shared := r.putBlob(repository, ispec.MediaTypeImageLayerGzip, []byte("shared layer"))
+	blobs := []ispec.Descriptor{shared}
+
+	var manifests []ispec.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := r.putBlob(repository, ispec.MediaTypeImageConfig, []byte(`{"architecture":"`+arch+`","os":"linux"}`))
+		layer := r.putBlob(repository, ispec.MediaTypeImageLayerGzip, []byte("layer for "+arch))
+		manifest := r.putManifest(repository, ispec.MediaTypeImageManifest, ispec.Manifest{
+			Versioned: imeta.Versioned{SchemaVersion: 2},
+			Config:    config,
+			Layers:    []ispec.Descriptor{shared, layer},
+		})
+		manifest.Platform = &ispec.Platform{OS: "linux", Architecture: arch}
+		manifests = append(manifests, manifest)
+		blobs = append(blobs, config, layer, manifest)
+	}
+	index := r.putManifest(repository, ispec.MediaTypeImageIndex, ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	}, tag)
+	return index, append(blobs, index)
+}
+
+// newEngine creates a new OCI image layout in the directory.
+func newEngine(t *testing.T, root string) cas.Engine {
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	index, blobs := fakeImage(registry, "test/image", "v1")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	descriptor, err := client.Pull(ctx, registry.ref("test/image", "v1"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling image: %+v", err)
+	}
+	if descriptor.Digest != index.Digest || descriptor.Size != index.Size || descriptor.MediaType != index.MediaType {
+		t.Errorf("unexpected descriptor: got %+v expected %+v", descriptor, index)
+	}
+	for _, blob := range blobs {
+		reader, err := engine.GetBlob(ctx, blob.Digest)
+		if err != nil {
+			t.Errorf("blob %s was not pulled: %+v", blob.Digest, err)
+			continue
+		}
+		reader.Close()
+	}
+	// The layer shared by both manifests is only downloaded once.
+	if count := registry.requests["GET /v2/test/image/blobs/"+blobs[0].Digest.String()]; count != 1 {
+		t.Errorf("shared layer was requested %d times", count)
+	}
+
+	// Pulling again (by digest) doesn't download any blobs.
+	ref := registry.ref("test/image", "")
+	ref.Digest = index.Digest
+	registry.requests = map[string]int{}
+	if _, err := client.Pull(ctx, ref, engine, PullOptions{Workers: 1}); err != nil {
+		t.Fatalf("unexpected error pulling image again: %+v", err)
+	}
+	for path := range registry.requests {
+		if filepath.Base(filepath.Dir(path)) == "blobs" {
+			t.Errorf("unexpected blob request when pulling again: %s", path)
+		}
+	}
+
+	// Missing images are reported.
+	if _, err := client.Pull(ctx, registry.ref("test/image", "missing"), engine, PullOptions{}); err == nil {
+		t.Errorf("expected error pulling missing image")
+	}
+}
+
+func TestPullCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPullCredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	registry.username, registry.password = "user", "password"
+	index, _ := fakeImage(registry, "private", "latest")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	// Anonymous and incorrect credentials are rejected.
+	for _, creds := range []*Credentials{nil, {Username: "user", Password: "wrong"}} {
+		options := Options{PlainHTTP: true}
+		if creds != nil {
+			value := *creds
+			options.Credentials = func(string) (Credentials, bool) { return value, true }
+		}
+		if _, err := NewClient(options).Pull(ctx, registry.ref("private", "latest"), engine, PullOptions{}); err == nil {
+			t.Errorf("expected error pulling with credentials %+v", creds)
+		}
+	}
+
+	config := &DockerConfig{Auths: map[string]dockerAuth{
+		registry.host(): {Auth: basicAuth("user", "password")},
+	}}
+	client := NewClient(Options{PlainHTTP: true, Credentials: config.Credentials})
+	descriptor, err := client.Pull(ctx, registry.ref("private", "latest"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling with credentials: %+v", err)
+	}
+	if descriptor.Digest != index.Digest {
+		t.Errorf("unexpected digest: got %s expected %s", descriptor.Digest, index.Digest)
+	}
+}
+
+func TestPullCorrupted(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPullCorrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	_, blobs := fakeImage(registry, "test/image", "latest")
+
+	// Replace the contents of the shared layer.
+	registry.blobs["test/image"][blobs[0].Digest] = []byte("corrupted layer")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	if _, err := client.Pull(ctx, registry.ref("test/image", "latest"), engine, PullOptions{}); err == nil {
+		t.Fatalf("expected error pulling corrupted image")
+	}
+	if _, err := engine.GetBlob(ctx, blobs[0].Digest); err == nil {
+		t.Errorf("corrupted blob was added to the image")
+	}
+	if _, err := engine.GetBlob(ctx, digest.FromString("corrupted layer")); err == nil {
+		t.Errorf("corrupted contents were added to the image")
+	}
+}
+
+func TestPullPlatform(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPullPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	_, blobs := fakeImage(registry, "test/image", "latest")
+	// The blobs of each platform are (config, layer, manifest).
+	amd64, arm64 := blobs[1:4], blobs[4:7]
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	descriptor, err := client.Pull(ctx, registry.ref("test/image", "latest"), engine, PullOptions{
+		Platform: &ispec.Platform{OS: "linux", Architecture: "arm64"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error pulling platform: %+v", err)
+	}
+	if descriptor.Digest != arm64[2].Digest || descriptor.MediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("unexpected descriptor: %v (expected %s)", descriptor, arm64[2].Digest)
+	}
+	if descriptor.Platform == nil || descriptor.Platform.Architecture != "arm64" {
+		t.Errorf("descriptor has the wrong platform: %v", descriptor.Platform)
+	}
+
+	// Only the blobs of the selected platform are pulled.
+	for _, blob := range append([]ispec.Descriptor{blobs[0]}, arm64...) {
+		if _, err := engine.GetBlob(ctx, blob.Digest); err != nil {
+			t.Errorf("blob %s was not pulled: %v", blob.Digest, err)
+		}
+	}
+	for _, blob := range append([]ispec.Descriptor{blobs[7]}, amd64...) {
+		if _, err := engine.GetBlob(ctx, blob.Digest); err == nil {
+			t.Errorf("blob %s of another platform was pulled", blob.Digest)
+		}
+	}
+
+	// Missing platforms are reported.
+	if _, err := client.Pull(ctx, registry.ref("test/image", "latest"), engine, PullOptions{
+		Platform: &ispec.Platform{OS: "linux", Architecture: "s390x"},
+	}); err == nil {
+		t.Errorf("expected error pulling missing platform")
+	}
+
+	// Single manifests are pulled as-is.
+	manifestRef := registry.ref("test/image", "")
+	manifestRef.Digest = amd64[2].Digest
+	descriptor, err = client.Pull(ctx, manifestRef, engine, PullOptions{
+		Platform: &ispec.Platform{OS: "linux", Architecture: "arm64"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error pulling manifest: %+v", err)
+	}
+	if descriptor.Digest != amd64[2].Digest {
+		t.Errorf("unexpected digest: got %s expected %s", descriptor.Digest, amd64[2].Digest)
+	}
+}
+
+func TestPullMirrors(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPullMirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	upstream := newFakeRegistry(t)
+	defer upstream.Close()
+	empty := newFakeRegistry(t)
+	defer empty.Close()
+	mirror := newFakeRegistry(t)
+	defer mirror.Close()
+
+	index, _ := fakeImage(upstream, "test/image", "latest")
+	fakeImage(mirror, "mirrored/test/image", "latest")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	config := &RegistriesConfig{Registries: []RegistryConfig{{
+		Prefix: upstream.host() + "/test",
+		Mirrors: []MirrorConfig{
+			{Location: empty.host() + "/test"},
+			{Location: mirror.host() + "/mirrored/test"},
+		},
+	}}}
+	client := NewClient(Options{PlainHTTP: true, Mirrors: config.Mirrors})
+
+	// The image is pulled from the first mirror which has it.
+	descriptor, err := client.Pull(ctx, upstream.ref("test/image", "latest"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling from mirror: %+v", err)
+	}
+	if descriptor.Digest != index.Digest {
+		t.Errorf("unexpected descriptor: got %s expected %s", descriptor.Digest, index.Digest)
+	}
+	if empty.requests["GET /v2/test/image/manifests/latest"] == 0 {
+		t.Errorf("first mirror was not tried")
+	}
+	if mirror.requests["GET /v2/mirrored/test/image/manifests/latest"] == 0 {
+		t.Errorf("second mirror was not tried")
+	}
+	if len(upstream.requests) != 0 {
+		t.Errorf("unexpected requests to upstream registry: %v", upstream.requests)
+	}
+
+	// Images which aren't mirrored are pulled from the registry itself.
+	other, _ := fakeImage(upstream, "test/other", "latest")
+	descriptor, err = client.Pull(ctx, upstream.ref("test/other", "latest"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error falling back to upstream: %+v", err)
+	}
+	if descriptor.Digest != other.Digest {
+		t.Errorf("unexpected descriptor: got %s expected %s", descriptor.Digest, other.Digest)
+	}
+
+	// Blocked registries cannot be pulled from.
+	config.Registries[0].Blocked = true
+	if _, err := client.Pull(ctx, upstream.ref("test/image", "latest"), engine, PullOptions{}); err == nil {
+		t.Errorf("expected error pulling from blocked registry")
+	}
+}
@@ -0,0 +1,573 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// BlobStatus describes the progress of a blob being pushed.
+type BlobStatus string
+
+const (
+	// BlobExists means the blob was already in the repository.
+	BlobExists BlobStatus = "exists"
+
+	// BlobMounted means the blob was mounted from another repository of the
+	// registry, without uploading it.
+	BlobMounted BlobStatus = "mounted"
+
+	// BlobUploading means part of the blob has been uploaded.
+	BlobUploading BlobStatus = "uploading"
+
+	// BlobUploaded means the whole blob has been uploaded.
+	BlobUploaded BlobStatus = "uploaded"
+)
+
+// PushOptions configure Client.Push.
+type PushOptions struct {
+	// Workers is the maximum number of blobs uploaded concurrently. If it is
+	// zero, DefaultWorkers is used.
+	Workers int
+
+	// ChunkSize is the size of the chunks that blobs are uploaded in. Blobs
+	// which are not larger than ChunkSize are uploaded in a single request.
+	// If it is zero, every blob is uploaded in a single request.
+	ChunkSize int64
+
+	// Sessions stores the upload sessions of blobs uploaded in chunks, so
+	// that uploads interrupted by an earlier Push are resumed from the data
+	// the registry has already received (if the upload session is still
+	// valid). If it is nil, every upload starts from the beginning.
+	Sessions UploadSessions
+
+	// Retries is the number of times the upload of a chunk is retried if it
+	// fails, resuming the upload from the data the registry has received.
+	Retries int
+
+	// MountFrom are other repositories in the registry which may contain the
+	// blobs of the image (such as the repository of the base image). Blobs
+	// which are in one of these repositories are mounted rather than
+	// uploaded, if the registry (and the credentials) allow it.
+	MountFrom []string
+
+	// Progress is called (possibly concurrently) whenever the status of a
+	// blob (other than a manifest) changes, with the number of bytes which
+	// have been uploaded.
+	Progress func(descriptor ispec.Descriptor, status BlobStatus, uploaded int64)
+}
+
+// progress calls opt.Progress, if it is set.
+func (opt PushOptions) progress(descriptor ispec.Descriptor, status BlobStatus, uploaded int64) {
+	if opt.Progress != nil {
+		opt.Progress(descriptor, status, uploaded)
+	}
+}
+
+// Push uploads the image with the given descriptor (and every blob it refers
+// to, including every manifest of an index) from the CAS to the registry, and
+// tags it with the tag of the reference. If the reference has a digest
+// instead, it must be the digest of the descriptor. Blobs which are already
+// in the repository are not uploaded again.
+func (c *Client) Push(ctx context.Context, engine cas.Engine, descriptor ispec.Descriptor, ref Reference, opt PushOptions) error {
+	if ref.Digest != "" && ref.Digest != descriptor.Digest {
+		return errors.Errorf("cannot push %s as %s: digests do not match", descriptor.Digest, ref)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	// Find every blob of the image. The manifests are pushed after the blobs
+	// they refer to, so that registries can validate them.
+	var manifests, blobs []ispec.Descriptor
+	seen := map[digest.Digest]bool{}
+	if err := engineExt.Walk(ctx, descriptor, func(descriptorPath casext.DescriptorPath) error {
+		blob := descriptorPath.Descriptor()
+		if seen[blob.Digest] {
+			return casext.ErrSkipDescriptor
+		}
+		seen[blob.Digest] = true
+		switch blob.MediaType {
+		case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList,
+			ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest:
+			manifests = append([]ispec.Descriptor{blob}, manifests...)
+		default:
+			blobs = append(blobs, blob)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk image")
+	}
+	if len(manifests) == 0 || manifests[len(manifests)-1].Digest != descriptor.Digest {
+		return errors.Errorf("cannot push %s: not a manifest or index: %s", descriptor.Digest, descriptor.MediaType)
+	}
+
+	if err := c.pushBlobs(ctx, engine, ref, blobs, opt); err != nil {
+		return err
+	}
+
+	for idx, manifest := range manifests {
+		// Only the image itself is tagged.
+		target := manifest.Digest.String()
+		if idx == len(manifests)-1 {
+			target = ref.Reference()
+		}
+		if err := c.putManifest(ctx, engine, ref, manifest, target); err != nil {
+			return errors.Wrapf(err, "push manifest %s", manifest.Digest)
+		}
+	}
+	return nil
+}
+
+// pushBlobs uploads the given blobs, using up to opt.Workers concurrent
+// workers.
+func (c *Client) pushBlobs(ctx context.Context, engine cas.Engine, ref Reference, blobs []ispec.Descriptor, opt PushOptions) error {
+	workers := opt.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	jobs := make(chan ispec.Descriptor)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range jobs {
+				if err := c.pushBlob(ctx, engine, ref, blob, opt); err != nil {
+					errOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "push blob %s", blob.Digest)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, blob := range blobs {
+		select {
+		case jobs <- blob:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// setSession stores the location of the upload session of the blob in
+// opt.Sessions, if it is set. Failing to store the upload session only means
+// the upload cannot be resumed, so it is not an error.
+func (opt PushOptions) setSession(ref Reference, blob digest.Digest, location string) {
+	if opt.Sessions == nil {
+		return
+	}
+	if err := opt.Sessions.Set(ref, blob, location); err != nil {
+		log.Warnf("push: failed to store upload session of blob %s: %v", blob, err)
+	}
+}
+
+// pushBlob uploads a single blob, unless it is already in the repository or
+// can be mounted from another repository.
+func (c *Client) pushBlob(ctx context.Context, engine cas.Engine, ref Reference, blob ispec.Descriptor, opt PushOptions) error {
+	exists, err := c.blobExists(ctx, ref, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debugf("push: blob %s already exists", blob.Digest)
+		opt.progress(blob, BlobExists, 0)
+		opt.setSession(ref, blob.Digest, "")
+		return nil
+	}
+
+	// Resume the upload session of an earlier push, if the registry still
+	// knows about it.
+	chunked := opt.ChunkSize > 0 && blob.Size > opt.ChunkSize
+	var (
+		location string
+		offset   int64
+	)
+	if chunked && opt.Sessions != nil {
+		if saved, ok := opt.Sessions.Get(ref, blob.Digest); ok {
+			savedOffset, savedLocation, err := c.uploadStatus(ctx, ref, saved)
+			if err == nil && savedOffset <= blob.Size {
+				log.Infof("push: resuming upload of blob %s at offset %d", blob.Digest, savedOffset)
+				location, offset = savedLocation, savedOffset
+			} else {
+				log.Debugf("push: cannot resume upload of blob %s: %v", blob.Digest, err)
+				opt.setSession(ref, blob.Digest, "")
+			}
+		}
+	}
+	if location != "" {
+		return c.pushChunks(ctx, engine, ref, location, offset, blob, opt)
+	}
+
+	// Try to mount the blob, which also starts an upload session if the
+	// mount fails.
+	for _, from := range opt.MountFrom {
+		if from == ref.Repository {
+			continue
+		}
+		mounted, uploadLocation, err := c.mountBlob(ctx, ref, from, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			log.Infof("push: mounted blob %s from %s", blob.Digest, from)
+			opt.progress(blob, BlobMounted, 0)
+			return nil
+		}
+		location = uploadLocation
+		break
+	}
+	if location == "" {
+		location, err = c.startUpload(ctx, ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("push: uploading blob %s (%d bytes)", blob.Digest, blob.Size)
+	if chunked {
+		return c.pushChunks(ctx, engine, ref, location, 0, blob, opt)
+	}
+	return c.finishUpload(ctx, ref, location, blob, func() (io.ReadCloser, error) {
+		return engine.GetBlob(ctx, blob.Digest)
+	}, blob.Size, opt)
+}
+
+// blobExists returns whether the blob is in the repository of the reference.
+func (c *Client) blobExists(ctx context.Context, ref Reference, blobDigest digest.Digest) (bool, error) {
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		return http.NewRequest("HEAD", c.url(ref, "blobs/%s", blobDigest), nil)
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "check blob")
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, errors.Wrapf(responseError(resp), "check blob %s", blobDigest)
+}
+
+// mountBlob tries to mount the blob from another repository of the registry.
+// If the blob could not be mounted, the registry starts an upload session
+// instead, whose location is returned.
+func (c *Client) mountBlob(ctx context.Context, ref Reference, from string, blobDigest digest.Digest) (bool, string, error) {
+	query := url.Values{}
+	query.Set("mount", blobDigest.String())
+	query.Set("from", from)
+	mountScope := scope(ref, "pull,push") + " " + scope(Reference{Repository: from}, "pull")
+	resp, err := c.do(ctx, ref, mountScope, func() (*http.Request, error) {
+		return http.NewRequest("POST", c.url(ref, "blobs/uploads/?%s", query.Encode()), nil)
+	})
+	if err != nil {
+		// The credentials may not allow pulling from the other repository,
+		// in which case the blob is uploaded instead.
+		log.Debugf("push: could not mount blob %s from %s: %v", blobDigest, from, err)
+		return false, "", nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		location, err := uploadLocation(resp)
+		return false, location, err
+	}
+	// Registries which don't support mounting (or which refuse to mount the
+	// blob) can still accept an upload.
+	log.Debugf("push: could not mount blob %s from %s: %v", blobDigest, from, responseError(resp))
+	return false, "", nil
+}
+
+// startUpload starts an upload session, returning its location.
+func (c *Client) startUpload(ctx context.Context, ref Reference) (string, error) {
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		return http.NewRequest("POST", c.url(ref, "blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "start upload")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", errors.Wrap(responseError(resp), "start upload")
+	}
+	return uploadLocation(resp)
+}
+
+// uploadLocation returns the (absolute) location of the upload session
+// returned in the response.
+func uploadLocation(resp *http.Response) (string, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return "", errors.Wrap(err, "get upload location")
+	}
+	return location.String(), nil
+}
+
+// uploadStatus returns the number of bytes of the blob the registry has
+// received in the upload session, and the location of the upload session.
+func (c *Client) uploadStatus(ctx context.Context, ref Reference, location string) (int64, string, error) {
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		return http.NewRequest("GET", location, nil)
+	})
+	if err != nil {
+		return 0, "", errors.Wrap(err, "get upload status")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, "", errors.Wrap(responseError(resp), "get upload status")
+	}
+	if resp.Header.Get("Location") != "" {
+		if location, err = uploadLocation(resp); err != nil {
+			return 0, "", err
+		}
+	}
+
+	// The range is inclusive, but registries also return "0-0" for empty
+	// upload sessions (which is far more likely than a single byte).
+	var offset int64
+	if value := resp.Header.Get("Range"); value != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(value, "%d-%d", &start, &end); err != nil || start != 0 || end < 0 {
+			return 0, "", errors.Errorf("invalid upload range: %q", value)
+		}
+		if end > 0 {
+			offset = end + 1
+		}
+	}
+	return offset, location, nil
+}
+
+// openBlobAt returns a reader for the contents of the blob, starting at the
+// given offset.
+func openBlobAt(ctx context.Context, engine cas.Engine, blobDigest digest.Digest, offset int64) (io.ReadCloser, error) {
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, reader, offset)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, errors.Wrapf(err, "skip to offset %d", offset)
+	}
+	return reader, nil
+}
+
+// pushChunks uploads the contents of the blob (starting at the given offset)
+// to the upload session in chunks of opt.ChunkSize, and then completes the
+// upload. The location of the upload session is stored in opt.Sessions
+// until the upload is complete.
+func (c *Client) pushChunks(ctx context.Context, engine cas.Engine, ref Reference, location string, offset int64, blob ispec.Descriptor, opt PushOptions) error {
+	opt.setSession(ref, blob.Digest, location)
+	location, err := c.uploadChunks(ctx, engine, ref, location, offset, blob, opt)
+	if err != nil {
+		return err
+	}
+	if err := c.finishUpload(ctx, ref, location, blob, nil, 0, opt); err != nil {
+		return err
+	}
+	opt.setSession(ref, blob.Digest, "")
+	return nil
+}
+
+// uploadChunks uploads the contents of the blob (starting at the given
+// offset) to the upload session in chunks of opt.ChunkSize, returning the
+// location of the upload session after the last chunk. Failed chunks are
+// retried up to opt.Retries times.
+func (c *Client) uploadChunks(ctx context.Context, engine cas.Engine, ref Reference, location string, offset int64, blob ispec.Descriptor, opt PushOptions) (string, error) {
+	reader, err := openBlobAt(ctx, engine, blob.Digest, offset)
+	if err != nil {
+		return "", err
+	}
+	// The reader is replaced when a chunk is retried.
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+
+	chunk := make([]byte, opt.ChunkSize)
+	retries := opt.Retries
+	for offset < blob.Size {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", errors.Wrap(err, "read blob")
+		}
+		newLocation, err := c.uploadChunk(ctx, ref, location, chunk[:n], offset)
+		if err != nil {
+			if retries <= 0 || ctx.Err() != nil {
+				return "", err
+			}
+			retries--
+
+			// Resume from whatever the registry has received.
+			newOffset, statusLocation, statusErr := c.uploadStatus(ctx, ref, location)
+			if statusErr != nil || newOffset > blob.Size {
+				return "", errors.Wrapf(err, "cannot resume upload (%v)", statusErr)
+			}
+			log.Warnf("push: retrying upload of blob %s at offset %d: %v", blob.Digest, newOffset, err)
+			reader.Close()
+			if reader, err = openBlobAt(ctx, engine, blob.Digest, newOffset); err != nil {
+				return "", err
+			}
+			offset, location = newOffset, statusLocation
+			opt.setSession(ref, blob.Digest, location)
+			continue
+		}
+		location = newLocation
+		offset += int64(n)
+		opt.setSession(ref, blob.Digest, location)
+		opt.progress(blob, BlobUploading, offset)
+	}
+	return location, nil
+}
+
+// uploadChunk uploads a single chunk of a blob (starting at the given
+// offset) to the upload session, returning the new location of the upload
+// session.
+func (c *Client) uploadChunk(ctx context.Context, ref Reference, location string, data []byte, offset int64) (string, error) {
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		req, err := http.NewRequest("PATCH", location, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+int64(len(data))-1, 10))
+		return req, nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "upload chunk")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", errors.Wrapf(responseError(resp), "upload chunk at offset %d", offset)
+	}
+	return uploadLocation(resp)
+}
+
+// finishUpload completes the upload session with the remaining contents of
+// the blob (returned by open, and size bytes long). If open is nil, there are
+// no remaining contents.
+func (c *Client) finishUpload(ctx context.Context, ref Reference, location string, blob ispec.Descriptor, open func() (io.ReadCloser, error), size int64, opt PushOptions) error {
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrap(err, "parse upload location")
+	}
+	query := locationURL.Query()
+	query.Set("digest", blob.Digest.String())
+	locationURL.RawQuery = query.Encode()
+
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		var body io.ReadCloser = http.NoBody
+		if open != nil {
+			var err error
+			if body, err = open(); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequest("PUT", locationURL.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "finish upload")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Wrap(responseError(resp), "finish upload")
+	}
+	opt.progress(blob, BlobUploaded, blob.Size)
+	return nil
+}
+
+// putManifest uploads the manifest (or index) with the given descriptor from
+// the CAS, as the given tag or digest.
+func (c *Client) putManifest(ctx context.Context, engine cas.Engine, ref Reference, descriptor ispec.Descriptor, target string) error {
+	reader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get manifest blob")
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return errors.Wrap(err, "read manifest blob")
+	}
+
+	resp, err := c.do(ctx, ref, scope(ref, "pull,push"), func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", c.url(ref, "manifests/%s", target), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", descriptor.MediaType)
+		return req, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "put manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Wrap(responseError(resp), "put manifest")
+	}
+	if returned := resp.Header.Get("Docker-Content-Digest"); returned != "" && returned != descriptor.Digest.String() {
+		return errors.Errorf("registry computed a different digest for the manifest: %s", returned)
+	}
+	log.Infof("push: pushed manifest %s as %s", descriptor.Digest, target)
+	return nil
+}
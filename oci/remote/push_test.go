@@ -0,0 +1,248 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// progressRecorder records the final status of each blob reported to
+// PushOptions.Progress.
+type progressRecorder struct {
+	lock   sync.Mutex
+	status map[digest.Digest]BlobStatus
+}
+
+func (p *progressRecorder) record(descriptor ispec.Descriptor, status BlobStatus, uploaded int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.status == nil {
+		p.status = map[digest.Digest]BlobStatus{}
+	}
+	p.status[descriptor.Digest] = status
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	_, blobs := fakeImage(registry, "source", "v1")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	index, err := client.Pull(ctx, registry.ref("source", "v1"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling image: %+v", err)
+	}
+	isManifest := func(blob ispec.Descriptor) bool {
+		return blob.MediaType == ispec.MediaTypeImageManifest || blob.MediaType == ispec.MediaTypeImageIndex
+	}
+
+	for _, test := range []struct {
+		name       string
+		repository string
+		opt        PushOptions
+		expected   BlobStatus
+	}{
+		{"monolithic", "copy", PushOptions{}, BlobUploaded},
+		{"existing", "copy", PushOptions{}, BlobExists},
+		{"chunked", "chunked", PushOptions{ChunkSize: 4, Workers: 1}, BlobUploaded},
+		{"mounted", "mounted", PushOptions{MountFrom: []string{"mounted", "source"}}, BlobMounted},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			progress := &progressRecorder{}
+			test.opt.Progress = progress.record
+			if err := client.Push(ctx, engine, index, registry.ref(test.repository, "pushed"), test.opt); err != nil {
+				t.Fatalf("unexpected error pushing image: %+v", err)
+			}
+
+			// The whole image must be in the repository, and tagged.
+			if manifest := registry.manifests[test.repository]["pushed"]; manifest.mediaType != index.MediaType || digest.FromBytes(manifest.data) != index.Digest {
+				t.Errorf("image was not tagged: got %s", digest.FromBytes(manifest.data))
+			}
+			for _, blob := range blobs {
+				if isManifest(blob) {
+					if _, ok := registry.manifests[test.repository][blob.Digest.String()]; !ok {
+						t.Errorf("manifest %s was not pushed", blob.Digest)
+					}
+					continue
+				}
+				if data := registry.blobs[test.repository][blob.Digest]; digest.FromBytes(data) != blob.Digest {
+					t.Errorf("blob %s was not pushed", blob.Digest)
+				}
+				if status := progress.status[blob.Digest]; status != test.expected {
+					t.Errorf("blob %s: got status %q expected %q", blob.Digest, status, test.expected)
+				}
+			}
+		})
+	}
+
+	// The chunked upload must have used several chunks.
+	var patches int
+	for request, count := range registry.requests {
+		if strings.HasPrefix(request, "PATCH /v2/chunked/") {
+			patches += count
+		}
+	}
+	if patches <= len(blobs) {
+		t.Errorf("expected blobs to be uploaded in several chunks: got %d chunks", patches)
+	}
+
+	// Registries which don't mount blobs still accept the upload.
+	registry.noMount = true
+	progress := &progressRecorder{}
+	if err := client.Push(ctx, engine, index, registry.ref("unmounted", "pushed"), PushOptions{MountFrom: []string{"source"}, Progress: progress.record}); err != nil {
+		t.Fatalf("unexpected error pushing image without mounting: %+v", err)
+	}
+	for blob, status := range progress.status {
+		if status != BlobUploaded {
+			t.Errorf("blob %s: got status %q expected %q", blob, status, BlobUploaded)
+		}
+	}
+
+	// The reference cannot have a different digest.
+	ref := registry.ref("copy", "")
+	ref.Digest = blobs[0].Digest
+	if err := client.Push(ctx, engine, index, ref, PushOptions{}); err == nil {
+		t.Errorf("expected error pushing with the wrong digest")
+	}
+	// Only manifests and indexes can be pushed.
+	if err := client.Push(ctx, engine, blobs[0], registry.ref("copy", "layer"), PushOptions{}); err == nil {
+		t.Errorf("expected error pushing a layer")
+	}
+}
+
+func TestPushResume(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPushResume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	_, blobs := fakeImage(registry, "source", "v1")
+
+	engine := newEngine(t, root)
+	defer engine.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	index, err := client.Pull(ctx, registry.ref("source", "v1"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling image: %+v", err)
+	}
+	countPatches := func(repository string) int {
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		var patches int
+		for request, count := range registry.requests {
+			if strings.HasPrefix(request, "PATCH /v2/"+repository+"/") {
+				patches += count
+			}
+		}
+		return patches
+	}
+
+	if err := client.Push(ctx, engine, index, registry.ref("full", "pushed"), PushOptions{ChunkSize: 4, Workers: 1}); err != nil {
+		t.Fatalf("unexpected error pushing image: %+v", err)
+	}
+	fullPatches := countPatches("full")
+
+	// Failed chunks are retried from the data the registry received.
+	registry.failPatches = 2
+	if err := client.Push(ctx, engine, index, registry.ref("retried", "pushed"), PushOptions{ChunkSize: 4, Workers: 1, Retries: 2}); err != nil {
+		t.Fatalf("unexpected error pushing with retries: %+v", err)
+	}
+	for _, blob := range blobs {
+		if blob.MediaType == ispec.MediaTypeImageManifest || blob.MediaType == ispec.MediaTypeImageIndex {
+			continue
+		}
+		if data := registry.blobs["retried"][blob.Digest]; digest.FromBytes(data) != blob.Digest {
+			t.Errorf("blob %s was not pushed correctly", blob.Digest)
+		}
+	}
+
+	// Without retries, the upload session is stored so it can be resumed.
+	sessionPath := filepath.Join(root, "sessions.json")
+	sessions := NewUploadSessionFile(sessionPath)
+	registry.failPatches = 1
+	opt := PushOptions{ChunkSize: 4, Workers: 1, Sessions: sessions}
+	if err := client.Push(ctx, engine, index, registry.ref("resumed", "pushed"), opt); err == nil {
+		t.Fatalf("expected error pushing with a failed chunk")
+	}
+	failedPatches := countPatches("resumed")
+	var failed []digest.Digest
+	for _, blob := range blobs {
+		if _, ok := sessions.Get(registry.ref("resumed", ""), blob.Digest); ok {
+			failed = append(failed, blob.Digest)
+		}
+	}
+	if len(failed) != 1 {
+		t.Fatalf("expected the upload session of the failed blob to be stored: got %v", failed)
+	}
+
+	if err := client.Push(ctx, engine, index, registry.ref("resumed", "pushed"), opt); err != nil {
+		t.Fatalf("unexpected error resuming push: %+v", err)
+	}
+	for _, blob := range blobs {
+		if blob.MediaType == ispec.MediaTypeImageManifest || blob.MediaType == ispec.MediaTypeImageIndex {
+			continue
+		}
+		if data := registry.blobs["resumed"][blob.Digest]; digest.FromBytes(data) != blob.Digest {
+			t.Errorf("blob %s was not pushed correctly", blob.Digest)
+		}
+	}
+	// The failed blob must not have been uploaded from the beginning again.
+	if resumedPatches := countPatches("resumed") - failedPatches; resumedPatches >= fullPatches {
+		t.Errorf("resumed push uploaded %d chunks (a full push uploads %d)", resumedPatches, fullPatches)
+	}
+	if _, err := os.Stat(sessionPath); !os.IsNotExist(err) {
+		t.Errorf("upload sessions were not removed after the push: %v", err)
+	}
+
+	// Unknown upload sessions are ignored.
+	if err := sessions.Set(registry.ref("unknown", ""), failed[0], registry.server.URL+"/v2/unknown/blobs/uploads/missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Push(ctx, engine, index, registry.ref("unknown", "pushed"), opt); err != nil {
+		t.Fatalf("unexpected error pushing with an unknown upload session: %+v", err)
+	}
+	if _, ok := sessions.Get(registry.ref("unknown", ""), failed[0]); ok {
+		t.Errorf("unknown upload session was not removed")
+	}
+}
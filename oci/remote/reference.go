@@ -0,0 +1,155 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package remote implements a client for registries implementing the OCI
+// distribution specification (or the Docker registry HTTP API V2, which it
+// is based on), which can be used to copy images between a registry and an
+// OCI image layout. The Client supports anonymous access, HTTP basic
+// authentication and the bearer token flow used by Docker registries (with
+// credentials from the Docker client configuration, or a custom
+// Authenticator), HTTP(S) proxies, per-registry TLS settings and pulling
+// through mirrors (configured by containers-registries.conf(5)).
+package remote
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Transport is the prefix of references to images in a registry, as used
+	// by skopeo(1).
+	Transport = "docker://"
+
+	// DefaultRegistry is the registry used for references which do not
+	// include a registry (such as "opensuse/leap").
+	DefaultRegistry = "docker.io"
+
+	// defaultRegistryHost is the host serving the API of DefaultRegistry.
+	defaultRegistryHost = "registry-1.docker.io"
+
+	// DefaultTag is the tag used for references which include neither a tag
+	// nor a digest.
+	DefaultTag = "latest"
+)
+
+var (
+	// repositoryRegexp defines the regexp that a repository name must obey.
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*)*$`)
+
+	// tagRegexp defines the regexp that a tag must obey.
+	tagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+)
+
+// Reference refers to an image (a manifest or an index) in a repository of a
+// registry, either by tag or by digest.
+type Reference struct {
+	// Registry is the host (and optionally the port) of the registry.
+	Registry string
+
+	// Repository is the name of the repository in the registry.
+	Repository string
+
+	// Tag is the tag of the image, which is empty if the image is referred
+	// to by digest.
+	Tag string
+
+	// Digest is the digest of the image, which is empty if the image is
+	// referred to by tag.
+	Digest digest.Digest
+}
+
+// ParseReference parses a reference of the form
+// [docker://][registry/]repository[:tag|@digest], following the conventions
+// of Docker. If no registry is given (the first component of the reference
+// is not a host) the reference refers to DefaultRegistry, where repositories
+// with a single component are in the "library" namespace. If neither a tag
+// nor a digest is given, the reference refers to DefaultTag.
+func ParseReference(value string) (Reference, error) {
+	name := strings.TrimPrefix(value, Transport)
+
+	var ref Reference
+	if sep := strings.Index(name, "@"); sep != -1 {
+		dgst, err := digest.Parse(name[sep+1:])
+		if err != nil {
+			return Reference{}, errors.Wrapf(err, "invalid reference %q: parse digest", value)
+		}
+		ref.Digest = dgst
+		name = name[:sep]
+	}
+	if sep := strings.LastIndex(name, ":"); sep != -1 && !strings.Contains(name[sep+1:], "/") {
+		if ref.Digest != "" {
+			return Reference{}, errors.Errorf("invalid reference %q: reference cannot have both a tag and a digest", value)
+		}
+		ref.Tag = name[sep+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, errors.Errorf("invalid reference %q: tag contains invalid characters: '%s'", value, ref.Tag)
+		}
+		name = name[:sep]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+
+	// The first component is only a registry if it looks like a host.
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry, ref.Repository = parts[0], parts[1]
+	} else {
+		ref.Registry, ref.Repository = DefaultRegistry, name
+	}
+	if ref.Registry == "index.docker.io" {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if !repositoryRegexp.MatchString(ref.Repository) {
+		return Reference{}, errors.Errorf("invalid reference %q: repository name must be lowercase and contain only [a-z0-9._/-]: '%s'", value, ref.Repository)
+	}
+	return ref, nil
+}
+
+// Reference returns the part of the reference which identifies the image in
+// the repository, which is the digest (if the reference has one) or the tag.
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// String returns the reference in the form accepted by ParseReference
+// (without the Transport prefix).
+func (r Reference) String() string {
+	if r.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", r.Registry, r.Repository, r.Digest)
+	}
+	return fmt.Sprintf("%s/%s:%s", r.Registry, r.Repository, r.Tag)
+}
+
+// host returns the host serving the API of the registry.
+func (r Reference) host() string {
+	if r.Registry == DefaultRegistry {
+		return defaultRegistryHost
+	}
+	return r.Registry
+}
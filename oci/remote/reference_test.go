@@ -0,0 +1,68 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseReference(t *testing.T) {
+	dgst := digest.FromString("manifest")
+
+	for _, test := range []struct {
+		value    string
+		expected Reference
+	}{
+		{"opensuse", Reference{Registry: "docker.io", Repository: "library/opensuse", Tag: "latest"}},
+		{"docker://opensuse/leap:15.0", Reference{Registry: "docker.io", Repository: "opensuse/leap", Tag: "15.0"}},
+		{"docker://index.docker.io/busybox", Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "latest"}},
+		{"registry.opensuse.org/opensuse/tumbleweed:latest", Reference{Registry: "registry.opensuse.org", Repository: "opensuse/tumbleweed", Tag: "latest"}},
+		{"localhost/image", Reference{Registry: "localhost", Repository: "image", Tag: "latest"}},
+		{"localhost:5000/a/b/c:v1", Reference{Registry: "localhost:5000", Repository: "a/b/c", Tag: "v1"}},
+		{"localhost:5000/image@" + dgst.String(), Reference{Registry: "localhost:5000", Repository: "image", Digest: dgst}},
+	} {
+		ref, err := ParseReference(test.value)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %+v", test.value, err)
+			continue
+		}
+		if ref != test.expected {
+			t.Errorf("parsing %q: got %+v expected %+v", test.value, ref, test.expected)
+		}
+		// The parsed reference must round-trip.
+		if reparsed, err := ParseReference(ref.String()); err != nil || reparsed != ref {
+			t.Errorf("reference %q does not round-trip: got %+v (%v)", ref, reparsed, err)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"docker://",
+		"UPPERCASE/image",
+		"image:-tag",
+		"image:tag@" + dgst.String(),
+		"image@sha256:invalid",
+		"localhost:5000/image:",
+	} {
+		if ref, err := ParseReference(value); err == nil {
+			t.Errorf("expected error parsing %q: got %+v", value, ref)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Pull policies of mirrors (see MirrorConfig.PullFromMirror).
+const (
+	// PullFromMirrorAll uses the mirror for every pull.
+	PullFromMirrorAll = "all"
+
+	// PullFromMirrorDigestOnly only uses the mirror for references with a
+	// digest.
+	PullFromMirrorDigestOnly = "digest-only"
+
+	// PullFromMirrorTagOnly only uses the mirror for references without a
+	// digest.
+	PullFromMirrorTagOnly = "tag-only"
+)
+
+// RegistriesConfig is the configuration of registries and their mirrors, in
+// the format of containers-registries.conf(5). Only the [[registry]] tables
+// (and their [[registry.mirror]] tables) are used, every other setting is
+// ignored.
+type RegistriesConfig struct {
+	Registries []RegistryConfig
+}
+
+// RegistryConfig is a [[registry]] table of a RegistriesConfig, which
+// configures the registries (or namespaces of registries) matching Prefix.
+type RegistryConfig struct {
+	// Prefix is the prefix of the references the table applies to, of the
+	// form registry[/repository], or "*.domain" to match every registry in
+	// the domain. If it is empty, Location is used.
+	Prefix string
+
+	// Location replaces Prefix when pulling a matching reference. If it is
+	// empty, Prefix is used.
+	Location string
+
+	// Insecure allows connecting to Location without verifying its TLS
+	// certificates, or using HTTP if it doesn't support HTTPS.
+	Insecure bool
+
+	// Blocked forbids pulling matching references.
+	Blocked bool
+
+	// MirrorByDigestOnly only uses the mirrors for references with a digest,
+	// unless a mirror sets PullFromMirror.
+	MirrorByDigestOnly bool
+
+	// Mirrors are tried in order before Location.
+	Mirrors []MirrorConfig
+}
+
+// MirrorConfig is a [[registry.mirror]] table of a RegistryConfig.
+type MirrorConfig struct {
+	// Location replaces the prefix of the registry when pulling a matching
+	// reference from the mirror.
+	Location string
+
+	// Insecure allows connecting to the mirror without verifying its TLS
+	// certificates, or using HTTP if it doesn't support HTTPS.
+	Insecure bool
+
+	// PullFromMirror is the PullFromMirror* policy of the mirror. If it is
+	// empty, the mirror follows MirrorByDigestOnly of the registry.
+	PullFromMirror string
+}
+
+// DefaultRegistriesConfigPath returns the path of the registries
+// configuration, which is $CONTAINERS_REGISTRIES_CONF (or
+// ~/.config/containers/registries.conf if it exists, or
+// /etc/containers/registries.conf otherwise).
+func DefaultRegistriesConfigPath() string {
+	if path := os.Getenv("CONTAINERS_REGISTRIES_CONF"); path != "" {
+		return path
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, ".config", "containers", "registries.conf")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "/etc/containers/registries.conf"
+}
+
+// LoadRegistriesConfig reads the registries configuration at the given path.
+// If the file doesn't exist, the returned error satisfies os.IsNotExist
+// (after errors.Cause).
+func LoadRegistriesConfig(path string) (*RegistriesConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open registries config")
+	}
+	config, err := ParseRegistriesConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse registries config %s", path)
+	}
+	return config, nil
+}
+
+// ParseRegistriesConfig parses a registries configuration. Only the subset of
+// TOML used by containers-registries.conf(5) is supported.
+func ParseRegistriesConfig(data []byte) (*RegistriesConfig, error) {
+	config := &RegistriesConfig{}
+	var (
+		table  string
+		lineNo int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		// Arrays may span several lines.
+		for strings.Count(line, "[") > strings.Count(line, "]") && scanner.Scan() {
+			lineNo++
+			line += " " + strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		}
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, errors.Errorf("line %d: invalid table header", lineNo)
+			}
+			table = strings.TrimSpace(line[2 : len(line)-2])
+			switch table {
+			case "registry":
+				config.Registries = append(config.Registries, RegistryConfig{})
+			case "registry.mirror":
+				if len(config.Registries) == 0 {
+					return nil, errors.Errorf("line %d: [[registry.mirror]] outside of [[registry]]", lineNo)
+				}
+				registry := &config.Registries[len(config.Registries)-1]
+				registry.Mirrors = append(registry.Mirrors, MirrorConfig{})
+			}
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.Errorf("line %d: invalid table header", lineNo)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		sep := strings.Index(line, "=")
+		if sep == -1 {
+			return nil, errors.Errorf("line %d: expected key = value", lineNo)
+		}
+		key, value := strings.TrimSpace(line[:sep]), strings.TrimSpace(line[sep+1:])
+		if unquoted, err := parseTOMLString(key); err == nil {
+			key = unquoted
+		}
+		if err := config.set(table, key, value); err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read registries config")
+	}
+
+	for idx, registry := range config.Registries {
+		if registry.Prefix == "" && registry.Location == "" {
+			return nil, errors.Errorf("[[registry]] %d has neither a prefix nor a location", idx+1)
+		}
+		if strings.HasPrefix(registry.Prefix, "*.") && registry.Location != "" {
+			return nil, errors.Errorf("[[registry]] %d has a wildcard prefix and a location", idx+1)
+		}
+		for _, mirror := range registry.Mirrors {
+			if mirror.Location == "" {
+				return nil, errors.Errorf("[[registry]] %d has a mirror without a location", idx+1)
+			}
+		}
+	}
+	return config, nil
+}
+
+// set sets the key of the given table (of the most recent [[registry]] or
+// [[registry.mirror]]) to the TOML value. Unknown tables and keys are
+// ignored.
+func (c *RegistriesConfig) set(table, key, value string) error {
+	var registry *RegistryConfig
+	if len(c.Registries) > 0 {
+		registry = &c.Registries[len(c.Registries)-1]
+	}
+
+	switch {
+	case table == "registry" && registry == nil,
+		table == "registry.mirror" && (registry == nil || len(registry.Mirrors) == 0):
+		return errors.Errorf("[%s] must be an array of tables", table)
+	}
+
+	var (
+		str     *string
+		boolean *bool
+	)
+	switch table {
+	case "registry":
+		switch key {
+		case "prefix":
+			str = &registry.Prefix
+		case "location":
+			str = &registry.Location
+		case "insecure":
+			boolean = &registry.Insecure
+		case "blocked":
+			boolean = &registry.Blocked
+		case "mirror-by-digest-only":
+			boolean = &registry.MirrorByDigestOnly
+		}
+	case "registry.mirror":
+		mirror := &registry.Mirrors[len(registry.Mirrors)-1]
+		switch key {
+		case "location":
+			str = &mirror.Location
+		case "insecure":
+			boolean = &mirror.Insecure
+		case "pull-from-mirror":
+			str = &mirror.PullFromMirror
+		}
+	}
+
+	switch {
+	case str != nil:
+		parsed, err := parseTOMLString(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", key)
+		}
+		*str = parsed
+	case boolean != nil:
+		switch value {
+		case "true":
+			*boolean = true
+		case "false":
+			*boolean = false
+		default:
+			return errors.Errorf("invalid %s: expected a boolean: %s", key, value)
+		}
+	}
+	if table == "registry.mirror" && key == "pull-from-mirror" {
+		switch registry.Mirrors[len(registry.Mirrors)-1].PullFromMirror {
+		case PullFromMirrorAll, PullFromMirrorDigestOnly, PullFromMirrorTagOnly:
+		default:
+			return errors.Errorf("invalid pull-from-mirror: %s", value)
+		}
+	}
+	return nil
+}
+
+// stripTOMLComment removes the comment (if any) from the line.
+func stripTOMLComment(line string) string {
+	var quote rune
+	escaped := false
+	for idx, ch := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '#':
+			return line[:idx]
+		}
+	}
+	return line
+}
+
+// parseTOMLString parses a basic ("...") or literal ('...') TOML string.
+func parseTOMLString(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	if len(value) >= 2 && value[0] == '"' {
+		return strconv.Unquote(value)
+	}
+	return "", errors.Errorf("expected a string: %s", value)
+}
+
+// match returns the prefix of the reference matched by the registry, or ""
+// if the registry doesn't apply to the reference.
+func (r RegistryConfig) match(ref Reference) string {
+	prefix := r.Prefix
+	if prefix == "" {
+		prefix = r.Location
+	}
+	if strings.HasPrefix(prefix, "*.") {
+		if strings.HasSuffix(ref.Registry, prefix[1:]) {
+			return ref.Registry
+		}
+		return ""
+	}
+	name := ref.Registry + "/" + ref.Repository
+	if name == prefix || strings.HasPrefix(name, strings.TrimSuffix(prefix, "/")+"/") {
+		return prefix
+	}
+	return ""
+}
+
+// rewrite replaces the matched prefix of the reference with the location.
+func rewrite(ref Reference, matched, location string) (Reference, error) {
+	name := location + strings.TrimPrefix(ref.Registry+"/"+ref.Repository, matched)
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return Reference{}, errors.Errorf("invalid location %q for %s", location, ref)
+	}
+	rewritten := ref
+	rewritten.Registry, rewritten.Repository = parts[0], strings.Trim(parts[1], "/")
+	if !repositoryRegexp.MatchString(rewritten.Repository) {
+		return Reference{}, errors.Errorf("invalid location %q for %s: invalid repository name '%s'", location, ref, rewritten.Repository)
+	}
+	return rewritten, nil
+}
+
+// lookup returns the registry configuration with the longest prefix matching
+// the reference (and the matched prefix), or nil if there is none.
+func (c *RegistriesConfig) lookup(ref Reference) (*RegistryConfig, string) {
+	var (
+		best    *RegistryConfig
+		matched string
+	)
+	for idx := range c.Registries {
+		registry := &c.Registries[idx]
+		prefix := registry.match(ref)
+		if prefix == "" {
+			continue
+		}
+		// Non-wildcard prefixes take precedence over wildcard prefixes.
+		wildcard := strings.HasPrefix(registry.Prefix, "*.")
+		if best == nil || (strings.HasPrefix(best.Prefix, "*.") && !wildcard) ||
+			(strings.HasPrefix(best.Prefix, "*.") == wildcard && len(prefix) > len(matched)) {
+			best, matched = registry, prefix
+		}
+	}
+	return best, matched
+}
+
+// Mirrors returns the references from which the image referred to by the
+// given reference is pulled, which are the mirrors of the matching
+// [[registry]] table (if they apply to the reference) followed by its
+// location. It is suitable for Options.Mirrors.
+func (c *RegistriesConfig) Mirrors(ref Reference) ([]Reference, error) {
+	registry, matched := c.lookup(ref)
+	if registry == nil {
+		return []Reference{ref}, nil
+	}
+	if registry.Blocked {
+		return nil, errors.Errorf("registry %s is blocked", matched)
+	}
+
+	var refs []Reference
+	for _, mirror := range registry.Mirrors {
+		policy := mirror.PullFromMirror
+		if policy == "" {
+			policy = PullFromMirrorAll
+			if registry.MirrorByDigestOnly {
+				policy = PullFromMirrorDigestOnly
+			}
+		}
+		if (policy == PullFromMirrorDigestOnly && ref.Digest == "") ||
+			(policy == PullFromMirrorTagOnly && ref.Digest != "") {
+			continue
+		}
+		mirrored, err := rewrite(ref, matched, mirror.Location)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, mirrored)
+	}
+	location := ref
+	if registry.Location != "" {
+		var err error
+		if location, err = rewrite(ref, matched, registry.Location); err != nil {
+			return nil, err
+		}
+	}
+	return append(refs, location), nil
+}
+
+// RegistryOptions returns the settings of the registries and mirrors which
+// are insecure, for use as Options.Registries.
+func (c *RegistriesConfig) RegistryOptions() map[string]RegistryOptions {
+	options := map[string]RegistryOptions{}
+	insecure := func(location string) {
+		host := strings.SplitN(location, "/", 2)[0]
+		options[host] = RegistryOptions{Insecure: true}
+	}
+	for _, registry := range c.Registries {
+		if !registry.Insecure {
+			continue
+		}
+		if registry.Location != "" {
+			insecure(registry.Location)
+		} else if !strings.HasPrefix(registry.Prefix, "*.") {
+			insecure(registry.Prefix)
+		}
+	}
+	for _, registry := range c.Registries {
+		for _, mirror := range registry.Mirrors {
+			if mirror.Insecure {
+				insecure(mirror.Location)
+			}
+		}
+	}
+	return options
+}
@@ -0,0 +1,175 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const testRegistriesConfig = `
+# Settings which don't apply to mirrors are ignored.
+unqualified-search-registries = [
+	"registry.opensuse.org", # comment
+	"docker.io",
+]
+short-name-mode = "enforcing"
+
+[aliases]
+"leap" = "registry.opensuse.org/opensuse/leap"
+
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry.mirror]]
+location = "mirror.example.com:5000/docker.io"
+insecure = true
+
+[[registry.mirror]]
+location = 'digests.example.com'
+pull-from-mirror = "digest-only"
+
+[[registry]]
+prefix = "docker.io/library/busybox"
+location = "registry.example.com/busybox"
+mirror-by-digest-only = true
+
+[[registry.mirror]]
+location = "mirror.example.com:5000/busybox"
+
+[[registry]]
+prefix = "*.internal.example.com"
+insecure = true
+
+[[registry.mirror]]
+location = "cache.example.com"
+
+[[registry]]
+location = "blocked.example.com"
+blocked = true
+`
+
+func TestParseRegistriesConfig(t *testing.T) {
+	config, err := ParseRegistriesConfig([]byte(testRegistriesConfig))
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %+v", err)
+	}
+	expected := []RegistryConfig{
+		{Prefix: "docker.io", Location: "docker.io", Mirrors: []MirrorConfig{
+			{Location: "mirror.example.com:5000/docker.io", Insecure: true},
+			{Location: "digests.example.com", PullFromMirror: PullFromMirrorDigestOnly},
+		}},
+		{Prefix: "docker.io/library/busybox", Location: "registry.example.com/busybox", MirrorByDigestOnly: true, Mirrors: []MirrorConfig{
+			{Location: "mirror.example.com:5000/busybox"},
+		}},
+		{Prefix: "*.internal.example.com", Insecure: true, Mirrors: []MirrorConfig{
+			{Location: "cache.example.com"},
+		}},
+		{Location: "blocked.example.com", Blocked: true},
+	}
+	if !reflect.DeepEqual(config.Registries, expected) {
+		t.Errorf("unexpected registries:\n got %+v\nexpected %+v", config.Registries, expected)
+	}
+
+	options := config.RegistryOptions()
+	expectedOptions := map[string]RegistryOptions{
+		"mirror.example.com:5000": {Insecure: true},
+	}
+	if !reflect.DeepEqual(options, expectedOptions) {
+		t.Errorf("unexpected registry options: got %+v expected %+v", options, expectedOptions)
+	}
+
+	for _, invalid := range []string{
+		"[[registry.mirror]]\nlocation = \"mirror.example.com\"",
+		"[[registry]]\ninsecure = true",
+		"[[registry]]\nlocation = \"example.com\"\ninsecure = \"yes\"",
+		"[[registry]]\nlocation = \"example.com\"\n[[registry.mirror]]\nlocation = \"mirror.example.com\"\npull-from-mirror = \"never\"",
+		"[[registry]]\nprefix = \"*.example.com\"\nlocation = \"example.com\"",
+		"[registry]\nlocation = \"example.com\"",
+		"[[registry]]\nlocation",
+	} {
+		if _, err := ParseRegistriesConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error parsing invalid config %q", invalid)
+		}
+	}
+}
+
+func TestRegistriesConfigMirrors(t *testing.T) {
+	config, err := ParseRegistriesConfig([]byte(testRegistriesConfig))
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %+v", err)
+	}
+	dgst := digest.FromString("image")
+
+	for _, test := range []struct {
+		ref      string
+		expected []string
+	}{
+		{"opensuse/leap:15", []string{
+			"mirror.example.com:5000/docker.io/opensuse/leap:15",
+			"docker.io/opensuse/leap:15",
+		}},
+		{"opensuse/leap@" + dgst.String(), []string{
+			"mirror.example.com:5000/docker.io/opensuse/leap@" + dgst.String(),
+			"digests.example.com/opensuse/leap@" + dgst.String(),
+			"docker.io/opensuse/leap@" + dgst.String(),
+		}},
+		{"busybox", []string{
+			"registry.example.com/busybox:latest",
+		}},
+		{"busybox@" + dgst.String(), []string{
+			"mirror.example.com:5000/busybox@" + dgst.String(),
+			"registry.example.com/busybox@" + dgst.String(),
+		}},
+		{"foo.internal.example.com/image:1", []string{
+			"cache.example.com/image:1",
+			"foo.internal.example.com/image:1",
+		}},
+		{"example.com/image:1", []string{
+			"example.com/image:1",
+		}},
+	} {
+		ref, err := ParseReference(test.ref)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %+v", test.ref, err)
+		}
+		refs, err := config.Mirrors(ref)
+		if err != nil {
+			t.Errorf("unexpected error getting mirrors of %s: %+v", test.ref, err)
+			continue
+		}
+		var got []string
+		for _, ref := range refs {
+			got = append(got, ref.String())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("unexpected mirrors of %s: got %v expected %v", test.ref, got, test.expected)
+		}
+	}
+
+	ref, err := ParseReference("blocked.example.com/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Mirrors(ref); err == nil {
+		t.Errorf("expected error getting mirrors of blocked registry")
+	}
+}
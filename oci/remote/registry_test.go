@@ -0,0 +1,411 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry is a minimal in-memory registry, which requires bearer tokens
+// issued by its own token server.
+type fakeRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+
+	lock sync.Mutex
+	// manifests are the manifests of each repository, by tag or digest.
+	manifests map[string]map[string]fakeManifest
+	// blobs are the blobs of each repository.
+	blobs map[string]map[digest.Digest][]byte
+	// username and password are the credentials required to get a token. If
+	// they are empty, anonymous tokens are issued.
+	username, password string
+	// tokens are the scopes granted by each issued token.
+	tokens map[string][]string
+	// uploads are the contents of each upload session.
+	uploads  map[string][]byte
+	uploadID int
+	// noMount disables mounting blobs from other repositories.
+	noMount bool
+	// failPatches is the number of chunk uploads which will fail, after
+	// storing half of the chunk.
+	failPatches int
+	// requests counts the requests made with each method for each path.
+	requests map[string]int
+}
+
+// fakeManifest is a manifest stored in a fakeRegistry.
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+var (
+	fakeRegistryPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/([^/]+)$`)
+	fakeUploadPath   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+)
+
+// newFakeRegistry starts a new fakeRegistry, which must be stopped with
+// Close.
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		t:         t,
+		manifests: map[string]map[string]fakeManifest{},
+		blobs:     map[string]map[digest.Digest][]byte{},
+		tokens:    map[string][]string{},
+		uploads:   map[string][]byte{},
+		requests:  map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", r.serveToken)
+	mux.HandleFunc("/v2/", r.serveAPI)
+	r.server = httptest.NewServer(mux)
+	return r
+}
+
+// Close stops the registry.
+func (r *fakeRegistry) Close() {
+	r.server.Close()
+}
+
+// host returns the host of the registry, for use in references.
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// ref returns a reference to the given repository and tag in the registry.
+func (r *fakeRegistry) ref(repository, tag string) Reference {
+	return Reference{Registry: r.host(), Repository: repository, Tag: tag}
+}
+
+// putBlob adds a blob to the repository, returning its descriptor.
+func (r *fakeRegistry) putBlob(repository, mediaType string, data []byte) ispec.Descriptor {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[digest.Digest][]byte{}
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	r.blobs[repository][descriptor.Digest] = data
+	return descriptor
+}
+
+// putManifest adds a manifest to the repository (by digest, and by the given
+// tags), returning its descriptor.
+func (r *fakeRegistry) putManifest(repository, mediaType string, manifest interface{}, tags ...string) ispec.Descriptor {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]fakeManifest{}
+	}
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	for _, name := range append(tags, descriptor.Digest.String()) {
+		r.manifests[repository][name] = fakeManifest{mediaType: mediaType, data: data}
+	}
+	return descriptor
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != r.username || password != r.password {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.URL.Query().Get("service") != "fake-registry" {
+		http.Error(w, "invalid service", http.StatusBadRequest)
+		return
+	}
+	r.lock.Lock()
+	token := fmt.Sprintf("token-%d", len(r.tokens))
+	r.tokens[token] = req.URL.Query()["scope"]
+	r.lock.Unlock()
+	json.NewEncoder(w).Encode(tokenResponse{Token: token})
+}
+
+// authorized returns whether the request has a token granting the given
+// action on each of the repositories, and otherwise sends a challenge.
+func (r *fakeRegistry) authorized(w http.ResponseWriter, req *http.Request, action string, repositories ...string) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	r.lock.Lock()
+	scopes, ok := r.tokens[token]
+	r.lock.Unlock()
+
+	granted := map[string]bool{}
+	for _, scope := range scopes {
+		parts := strings.Split(scope, ":")
+		if len(parts) != 3 || parts[0] != "repository" {
+			continue
+		}
+		for _, grantedAction := range strings.Split(parts[2], ",") {
+			granted[parts[1]+":"+grantedAction] = true
+		}
+	}
+	for _, repository := range repositories {
+		if !ok || !granted[repository+":"+action] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake-registry",scope="repository:%s:%s"`, r.server.URL, repository, action))
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return false
+		}
+	}
+	return true
+}
+
+func (r *fakeRegistry) serveAPI(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	r.requests[req.Method+" "+req.URL.Path]++
+	r.lock.Unlock()
+
+	if match := fakeUploadPath.FindStringSubmatch(req.URL.Path); match != nil {
+		r.serveUpload(w, req, match[1], match[2])
+		return
+	}
+	match := fakeRegistryPath.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "unknown path")
+		return
+	}
+	repository, kind, name := match[1], match[2], match[3]
+	action := "pull"
+	if req.Method != "GET" && req.Method != "HEAD" {
+		action = "push"
+	}
+	if !r.authorized(w, req, action, repository) {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case kind == "manifests" && req.Method == "PUT":
+		r.putManifestRequest(w, req, repository, name)
+	case kind == "manifests":
+		manifest, ok := r.manifests[repository][name]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		if accept := req.Header.Get("Accept"); !strings.Contains(accept, manifest.mediaType) {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not acceptable")
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest.data).String())
+		w.Write(manifest.data)
+	case kind == "blobs":
+		data, ok := r.blobs[repository][digest.Digest(name)]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	}
+}
+
+// putManifestRequest stores a manifest uploaded by the client, checking
+// that every blob it refers to is already in the repository.
+func (r *fakeRegistry) putManifestRequest(w http.ResponseWriter, req *http.Request, repository, name string) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	dgst := digest.FromBytes(data)
+	if strings.HasPrefix(name, "sha256:") && name != dgst.String() {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "manifest digest does not match")
+		return
+	}
+
+	var children []ispec.Descriptor
+	mediaType := req.Header.Get("Content-Type")
+	switch mediaType {
+	case ispec.MediaTypeImageManifest:
+		var manifest ispec.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		children = append([]ispec.Descriptor{manifest.Config}, manifest.Layers...)
+	case ispec.MediaTypeImageIndex:
+		var index ispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		for _, child := range index.Manifests {
+			if _, ok := r.manifests[repository][child.Digest.String()]; !ok {
+				writeRegistryError(w, http.StatusBadRequest, "MANIFEST_UNKNOWN", "unknown manifest "+child.Digest.String())
+				return
+			}
+		}
+	default:
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unsupported media type "+mediaType)
+		return
+	}
+	for _, child := range children {
+		if _, ok := r.blobs[repository][child.Digest]; !ok {
+			writeRegistryError(w, http.StatusBadRequest, "BLOB_UNKNOWN", "unknown blob "+child.Digest.String())
+			return
+		}
+	}
+
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = map[string]fakeManifest{}
+	}
+	for _, target := range []string{name, dgst.String()} {
+		r.manifests[repository][target] = fakeManifest{mediaType: mediaType, data: data}
+	}
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveUpload implements the blob upload (and mount) endpoints.
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	query := req.URL.Query()
+	if from := query.Get("from"); from != "" && req.Method == "POST" {
+		if !r.authorized(w, req, "pull", from) {
+			return
+		}
+	}
+	if !r.authorized(w, req, "push", repository) {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.blobs[repository] == nil {
+		r.blobs[repository] = map[digest.Digest][]byte{}
+	}
+
+	switch req.Method {
+	case "POST":
+		if from := query.Get("from"); from != "" && !r.noMount {
+			if data, ok := r.blobs[from][digest.Digest(query.Get("mount"))]; ok {
+				r.blobs[repository][digest.Digest(query.Get("mount"))] = data
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.uploadID++
+		id := fmt.Sprintf("upload-%d", r.uploadID)
+		r.uploads[id] = []byte{}
+		// Relative locations must be supported.
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+		w.WriteHeader(http.StatusAccepted)
+	case "PATCH":
+		data, ok := r.uploads[id]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		if expected := fmt.Sprintf("%d-", len(data)); !strings.HasPrefix(req.Header.Get("Content-Range"), expected) {
+			writeRegistryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "invalid range")
+			return
+		}
+		chunk, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		if r.failPatches > 0 {
+			r.failPatches--
+			r.uploads[id] = append(data, chunk[:len(chunk)/2]...)
+			writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "connection lost")
+			return
+		}
+		r.uploads[id] = append(data, chunk...)
+		w.Header().Set("Location", fmt.Sprintf("%s/v2/%s/blobs/uploads/%s", r.server.URL, repository, id))
+		w.WriteHeader(http.StatusAccepted)
+	case "GET":
+		data, ok := r.uploads[id]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		end := len(data) - 1
+		if end < 0 {
+			end = 0
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT":
+		data, ok := r.uploads[id]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		chunk, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		data = append(data, chunk...)
+		if digest.FromBytes(data).String() != query.Get("digest") {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest does not match")
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[repository][digest.FromBytes(data)] = data
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+// writeRegistryError writes an error response in the format used by
+// registries.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
+
+// basicAuth returns the value of the "auth" field of a docker config.
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
@@ -0,0 +1,724 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	// serverBlobPath matches the paths of manifests and blobs.
+	serverBlobPath = regexp.MustCompile(`^/v2/(.+)/(manifests|blobs)/([^/]+)$`)
+
+	// serverUploadPath matches the paths of upload sessions.
+	serverUploadPath = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+
+	// serverTagsPath matches the path of the tag list.
+	serverTagsPath = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+)
+
+// ServerOptions configure how a Server serves an OCI image layout.
+type ServerOptions struct {
+	// Repository is the name of the repository the layout is served as. If it
+	// is empty, the layout is served as every repository.
+	Repository string
+
+	// ReadWrite allows clients to push blobs and manifests (and to delete
+	// tags). Otherwise, the layout is served read-only.
+	ReadWrite bool
+}
+
+// Server serves an OCI image layout using the OCI distribution specification
+// (the registry HTTP API V2), so that it can be pulled from (and optionally
+// pushed to) by any registry client. The tags of the layout are the tags of
+// the repository. Server does not implement authentication.
+type Server struct {
+	engine  casext.Engine
+	options ServerOptions
+
+	// lock serialises modifications of the index.
+	lock sync.Mutex
+
+	// uploadLock protects the fields below.
+	uploadLock sync.Mutex
+	uploads    map[string]*serverUpload
+	uploadID   int
+}
+
+// serverUpload is an upload session, whose contents are stored in a
+// temporary file until the upload is completed.
+type serverUpload struct {
+	// lock serialises requests to the upload session.
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewServer creates a new Server for the given CAS, which must be closed
+// with Close once it is no longer being used.
+func NewServer(engine cas.Engine, options ServerOptions) *Server {
+	return &Server{
+		engine:  casext.NewEngine(engine),
+		options: options,
+		uploads: map[string]*serverUpload{},
+	}
+}
+
+// Close removes any incomplete upload sessions.
+func (s *Server) Close() error {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	for id, upload := range s.uploads {
+		upload.file.Close()
+		os.Remove(upload.file.Name())
+		delete(s.uploads, id)
+	}
+	return nil
+}
+
+// serveError writes an error response in the format used by the registry API.
+func serveError(w http.ResponseWriter, status int, code, format string, args ...interface{}) {
+	var body registryErrors
+	body.Errors = append(body.Errors, struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{Code: code, Message: fmt.Sprintf(format, args...)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveInternalError logs an unexpected error and writes an error response.
+func serveInternalError(w http.ResponseWriter, req *http.Request, err error) {
+	log.Warnf("serve: %s %s: %v", req.Method, req.URL.Path, err)
+	serveError(w, http.StatusInternalServerError, "UNKNOWN", "%v", err)
+}
+
+// ServeHTTP handles a request to the registry API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log.Debugf("serve: %s %s", req.Method, req.URL)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	if req.URL.Path == "/v2/" || req.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+	if req.URL.Path == "/v2/_catalog" {
+		s.serveCatalog(w, req)
+		return
+	}
+
+	var repository string
+	var handler func()
+	if match := serverUploadPath.FindStringSubmatch(req.URL.Path); match != nil {
+		repository = match[1]
+		handler = func() { s.serveUpload(w, req, match[1], match[2]) }
+	} else if match := serverTagsPath.FindStringSubmatch(req.URL.Path); match != nil {
+		repository = match[1]
+		handler = func() { s.serveTags(w, req, match[1]) }
+	} else if match := serverBlobPath.FindStringSubmatch(req.URL.Path); match != nil {
+		repository = match[1]
+		if match[2] == "manifests" {
+			handler = func() { s.serveManifest(w, req, match[1], match[3]) }
+		} else {
+			handler = func() { s.serveBlob(w, req, match[3]) }
+		}
+	} else {
+		serveError(w, http.StatusNotFound, "NOT_FOUND", "unknown path %s", req.URL.Path)
+		return
+	}
+
+	if !repositoryRegexp.MatchString(repository) {
+		serveError(w, http.StatusBadRequest, "NAME_INVALID", "invalid repository name %q", repository)
+		return
+	}
+	if s.options.Repository != "" && repository != s.options.Repository {
+		serveError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown repository %q", repository)
+		return
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+	default:
+		if !s.options.ReadWrite {
+			serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the image layout is served read-only")
+			return
+		}
+	}
+	handler()
+}
+
+// serveCatalog lists the repository the layout is served as.
+func (s *Server) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method %s", req.Method)
+		return
+	}
+	repositories := []string{}
+	if s.options.Repository != "" {
+		repositories = append(repositories, s.options.Repository)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Repositories []string `json:"repositories"`
+	}{repositories})
+}
+
+// serveTags lists the tags of the layout, supporting the "n" and "last"
+// pagination parameters.
+func (s *Server) serveTags(w http.ResponseWriter, req *http.Request, repository string) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method %s", req.Method)
+		return
+	}
+	names, err := s.engine.ListReferences(req.Context())
+	if err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	tags := []string{}
+	for _, name := range names {
+		if tagRegexp.MatchString(name) {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+
+	query := req.URL.Query()
+	if last := query.Get("last"); last != "" {
+		idx := sort.SearchStrings(tags, last)
+		if idx < len(tags) && tags[idx] == last {
+			idx++
+		}
+		tags = tags[idx:]
+	}
+	if n := query.Get("n"); n != "" {
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			serveError(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", "invalid number of results %q", n)
+			return
+		}
+		if limit < len(tags) {
+			tags = tags[:limit]
+			if limit > 0 {
+				w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, repository, limit, tags[limit-1]))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{repository, tags})
+}
+
+// taggedDescriptors returns the descriptors in the top-level index with the
+// given tag. Unlike casext.Engine.ResolveReference, indexes are not resolved
+// to the manifests they contain.
+func (s *Server) taggedDescriptors(ctx context.Context, tag string) ([]ispec.Descriptor, error) {
+	index, err := s.engine.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	var descriptors []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == tag {
+			descriptors = append(descriptors, descriptor)
+		}
+	}
+	return descriptors, nil
+}
+
+// readServedBlob reads the entire blob with the given digest, returning nil
+// if it does not exist.
+func (s *Server) readServedBlob(ctx context.Context, blobDigest digest.Digest) ([]byte, error) {
+	reader, err := s.engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, maxManifestSize+1))
+}
+
+// detectManifestMediaType returns the media type of a manifest (or index)
+// referred to by digest, which does not have a descriptor giving its media
+// type. The mediaType field is used if it is set, otherwise the media type is
+// guessed from the fields of the manifest. An empty string is returned if the
+// blob is not a manifest or index.
+func detectManifestMediaType(data []byte) string {
+	var fields struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+		Config    json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	switch {
+	case fields.MediaType != "":
+		for _, mediaType := range manifestMediaTypes {
+			if fields.MediaType == mediaType {
+				return mediaType
+			}
+		}
+		return ""
+	case fields.Manifests != nil:
+		return ispec.MediaTypeImageIndex
+	case fields.Config != nil:
+		return ispec.MediaTypeImageManifest
+	}
+	return ""
+}
+
+// serveManifest serves (or stores, or deletes) the manifest referred to by
+// the given tag or digest.
+func (s *Server) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	switch req.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		s.putManifest(w, req, repository, reference)
+		return
+	case "DELETE":
+		s.deleteManifest(w, req, reference)
+		return
+	default:
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method %s", req.Method)
+		return
+	}
+
+	var descriptor ispec.Descriptor
+	if manifestDigest, err := digest.Parse(reference); err == nil {
+		descriptor.Digest = manifestDigest
+	} else if tagRegexp.MatchString(reference) {
+		descriptors, err := s.taggedDescriptors(req.Context(), reference)
+		if err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		switch len(descriptors) {
+		case 0:
+			serveError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "unknown tag %q", reference)
+			return
+		case 1:
+			descriptor = descriptors[0]
+		default:
+			serveError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "tag %q refers to %d descriptors", reference, len(descriptors))
+			return
+		}
+	} else {
+		serveError(w, http.StatusBadRequest, "MANIFEST_INVALID", "invalid reference %q", reference)
+		return
+	}
+
+	data, err := s.readServedBlob(req.Context(), descriptor.Digest)
+	if err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if descriptor.MediaType == "" {
+		descriptor.MediaType = detectManifestMediaType(data)
+	}
+	if data == nil || descriptor.MediaType == "" || len(data) > maxManifestSize {
+		serveError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "unknown manifest %s", reference)
+		return
+	}
+
+	w.Header().Set("Content-Type", descriptor.MediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", descriptor.Digest.String())
+	if req.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+// putManifest stores a manifest pushed by a client, and tags it if it was
+// pushed by tag. The blobs referenced by the manifest must already exist.
+func (s *Server) putManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !strings.HasSuffix(mediaType, "+json") {
+		serveError(w, http.StatusBadRequest, "MANIFEST_INVALID", "invalid manifest content type %q", req.Header.Get("Content-Type"))
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxManifestSize+1))
+	if err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if len(data) > maxManifestSize {
+		serveError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest is larger than %d bytes", maxManifestSize)
+		return
+	}
+
+	descriptor := ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	var tag string
+	if manifestDigest, err := digest.Parse(reference); err == nil {
+		if manifestDigest.Algorithm() != descriptor.Digest.Algorithm() {
+			descriptor.Digest = manifestDigest.Algorithm().FromBytes(data)
+		}
+		if descriptor.Digest != manifestDigest {
+			serveError(w, http.StatusBadRequest, "DIGEST_INVALID", "manifest has digest %s", descriptor.Digest)
+			return
+		}
+	} else if tagRegexp.MatchString(reference) {
+		tag = reference
+	} else {
+		serveError(w, http.StatusBadRequest, "TAG_INVALID", "invalid tag %q", reference)
+		return
+	}
+
+	// All of the blobs referenced by the manifest must have been pushed.
+	var parsed struct {
+		Config    *ispec.Descriptor  `json:"config"`
+		Layers    []ispec.Descriptor `json:"layers"`
+		Manifests []ispec.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		serveError(w, http.StatusBadRequest, "MANIFEST_INVALID", "invalid manifest: %v", err)
+		return
+	}
+	children := append(parsed.Layers, parsed.Manifests...)
+	if parsed.Config != nil {
+		children = append(children, *parsed.Config)
+	}
+	for _, child := range children {
+		exists, err := s.blobExists(req.Context(), child.Digest)
+		if err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		if !exists {
+			serveError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "unknown blob %s", child.Digest)
+			return
+		}
+	}
+
+	if _, _, err := s.engine.PutBlob(req.Context(), bytes.NewReader(data)); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if tag != "" {
+		s.lock.Lock()
+		err := s.engine.UpdateReference(req.Context(), tag, descriptor)
+		s.lock.Unlock()
+		if err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		log.Infof("serve: tagged %s as %s", descriptor.Digest, tag)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repository, descriptor.Digest))
+	w.Header().Set("Docker-Content-Digest", descriptor.Digest.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// deleteManifest removes a tag. Manifests cannot be deleted by digest, as
+// blobs are only removed by umoci-gc(1).
+func (s *Server) deleteManifest(w http.ResponseWriter, req *http.Request, reference string) {
+	if !tagRegexp.MatchString(reference) {
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "manifests can only be deleted by tag")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	descriptors, err := s.taggedDescriptors(req.Context(), reference)
+	if err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if len(descriptors) == 0 {
+		serveError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "unknown tag %q", reference)
+		return
+	}
+	if err := s.engine.DeleteReference(req.Context(), reference); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	log.Infof("serve: deleted tag %s", reference)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// blobExists returns whether the blob with the given digest exists.
+func (s *Server) blobExists(ctx context.Context, blobDigest digest.Digest) (bool, error) {
+	reader, err := s.engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return false, nil
+		}
+		return false, err
+	}
+	reader.Close()
+	return true, nil
+}
+
+// serveBlob serves the blob with the given digest. Range requests are
+// supported if the CAS supports seeking in blobs.
+func (s *Server) serveBlob(w http.ResponseWriter, req *http.Request, reference string) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "blobs are only removed by umoci-gc(1)")
+		return
+	}
+	blobDigest, err := digest.Parse(reference)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest %q", reference)
+		return
+	}
+	reader, err := s.engine.GetBlob(req.Context(), blobDigest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			serveError(w, http.StatusNotFound, "BLOB_UNKNOWN", "unknown blob %s", blobDigest)
+			return
+		}
+		serveInternalError(w, req, err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, req, "", time.Time{}, seeker)
+		return
+	}
+	if req.Method == "HEAD" {
+		size, err := io.Copy(ioutil.Discard, reader)
+		if err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Debugf("serve: copy blob %s: %v", blobDigest, err)
+	}
+}
+
+// uploadRange returns the value of the Range header of an upload session with
+// the given size.
+func uploadRange(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
+
+// startUpload creates a new upload session, returning its ID.
+func (s *Server) startUpload() (string, *serverUpload, error) {
+	fh, err := ioutil.TempFile("", "umoci-serve-upload.")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "create upload file")
+	}
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+	s.uploadID++
+	id := fmt.Sprintf("upload-%d", s.uploadID)
+	upload := &serverUpload{file: fh}
+	s.uploads[id] = upload
+	return id, upload, nil
+}
+
+// removeUpload removes the upload session with the given ID.
+func (s *Server) removeUpload(id string) {
+	s.uploadLock.Lock()
+	upload, ok := s.uploads[id]
+	delete(s.uploads, id)
+	s.uploadLock.Unlock()
+	if ok {
+		upload.file.Close()
+		os.Remove(upload.file.Name())
+	}
+}
+
+// append appends the contents of the reader to the upload session.
+func (upload *serverUpload) append(reader io.Reader) error {
+	if _, err := upload.file.Seek(upload.size, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek upload file")
+	}
+	n, err := io.Copy(upload.file, reader)
+	upload.size += n
+	return errors.Wrap(err, "write upload file")
+}
+
+// finishUpload stores the contents of the upload session as a blob, if they
+// match the expected digest.
+func (s *Server) finishUpload(w http.ResponseWriter, req *http.Request, repository, id string, upload *serverUpload, expected string) {
+	defer s.removeUpload(id)
+
+	blobDigest, err := digest.Parse(expected)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest %q", expected)
+		return
+	}
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	verifier := blobDigest.Verifier()
+	if _, err := io.Copy(verifier, upload.file); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if !verifier.Verified() {
+		serveError(w, http.StatusBadRequest, "DIGEST_INVALID", "upload does not match digest %s", blobDigest)
+		return
+	}
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	if _, _, err := s.engine.PutBlob(req.Context(), upload.file); err != nil {
+		serveInternalError(w, req, err)
+		return
+	}
+	log.Debugf("serve: stored blob %s (%d bytes)", blobDigest, upload.size)
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, blobDigest))
+	w.Header().Set("Docker-Content-Digest", blobDigest.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveUpload handles the requests used to push blobs: starting an upload
+// session (or mounting a blob, which always succeeds if the blob is in the
+// layout), uploading chunks, checking the status of the session, and
+// completing or cancelling it.
+func (s *Server) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	query := req.URL.Query()
+	if id == "" {
+		if req.Method != "POST" {
+			serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method %s", req.Method)
+			return
+		}
+		if mount, err := digest.Parse(query.Get("mount")); err == nil {
+			exists, err := s.blobExists(req.Context(), mount)
+			if err != nil {
+				serveInternalError(w, req, err)
+				return
+			}
+			if exists {
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, mount))
+				w.Header().Set("Docker-Content-Digest", mount.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+
+		id, upload, err := s.startUpload()
+		if err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		// A monolithic upload completes the session immediately.
+		if expected := query.Get("digest"); expected != "" {
+			upload.lock.Lock()
+			defer upload.lock.Unlock()
+			if err := upload.append(req.Body); err != nil {
+				s.removeUpload(id)
+				serveInternalError(w, req, err)
+				return
+			}
+			s.finishUpload(w, req, repository, id, upload, expected)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id))
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", uploadRange(0))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	s.uploadLock.Lock()
+	upload, ok := s.uploads[id]
+	s.uploadLock.Unlock()
+	if !ok {
+		serveError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "unknown upload %q", id)
+		return
+	}
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+
+	location := fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, id)
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Location", location)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", uploadRange(upload.size))
+		w.WriteHeader(http.StatusNoContent)
+	case "PATCH":
+		// Chunks must be uploaded in order.
+		if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+			var start, end int64
+			if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil || start != upload.size {
+				w.Header().Set("Location", location)
+				w.Header().Set("Range", uploadRange(upload.size))
+				serveError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "invalid content range %q", contentRange)
+				return
+			}
+		}
+		if err := upload.append(req.Body); err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		w.Header().Set("Location", location)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", uploadRange(upload.size))
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		if err := upload.append(req.Body); err != nil {
+			serveInternalError(w, req, err)
+			return
+		}
+		s.finishUpload(w, req, repository, id, upload, query.Get("digest"))
+	case "DELETE":
+		s.removeUpload(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		serveError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method %s", req.Method)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// serverImage pulls an image from a fakeRegistry into a new engine (under
+// root), tagged as the given tag, returning the engine and the descriptor of
+// the image.
+func serverImage(t *testing.T, root, tag string) (cas.Engine, ispec.Descriptor) {
+	ctx := context.Background()
+
+	registry := newFakeRegistry(t)
+	defer registry.Close()
+	fakeImage(registry, "source", "v1")
+
+	engine := newEngine(t, root)
+	index, err := NewClient(Options{PlainHTTP: true}).Pull(ctx, registry.ref("source", "v1"), engine, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling image: %+v", err)
+	}
+	if err := casext.NewEngine(engine).UpdateReference(ctx, tag, index); err != nil {
+		t.Fatal(err)
+	}
+	return engine, index
+}
+
+// serverRef returns a reference to the given repository and tag served by the
+// test server.
+func serverRef(server *httptest.Server, repository, tag string) Reference {
+	return Reference{Registry: strings.TrimPrefix(server.URL, "http://"), Repository: repository, Tag: tag}
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestServer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine, index := serverImage(t, filepath.Join(root, "source"), "v1")
+	defer engine.Close()
+	handler := NewServer(engine, ServerOptions{Repository: "served"})
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// The image can be pulled from the server.
+	if err := os.MkdirAll(filepath.Join(root, "pulled"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pulled := newEngine(t, filepath.Join(root, "pulled"))
+	defer pulled.Close()
+	client := NewClient(Options{PlainHTTP: true})
+	descriptor, err := client.Pull(ctx, serverRef(server, "served", "v1"), pulled, PullOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pulling from server: %+v", err)
+	}
+	if descriptor.Digest != index.Digest || descriptor.MediaType != index.MediaType {
+		t.Errorf("pulled the wrong image: got %v expected %v", descriptor, index)
+	}
+
+	// Manifests can also be pulled by digest.
+	byDigest := Reference{Registry: serverRef(server, "", "").Registry, Repository: "served", Digest: index.Digest}
+	if descriptor, _, err := client.GetManifest(ctx, byDigest); err != nil {
+		t.Errorf("unexpected error getting manifest by digest: %+v", err)
+	} else if descriptor.MediaType != index.MediaType {
+		t.Errorf("manifest by digest has the wrong media type: %s", descriptor.MediaType)
+	}
+
+	// Unknown tags, blobs and repositories are not found.
+	if _, _, err := client.GetManifest(ctx, serverRef(server, "served", "unknown")); err == nil {
+		t.Errorf("expected an error getting an unknown tag")
+	}
+	if _, err := client.GetBlob(ctx, serverRef(server, "served", "v1"), ispec.Descriptor{Digest: digest.FromString("unknown")}); err == nil {
+		t.Errorf("expected an error getting an unknown blob")
+	}
+	if _, _, err := client.GetManifest(ctx, serverRef(server, "other", "v1")); err == nil {
+		t.Errorf("expected an error getting an image from an unknown repository")
+	}
+
+	// The tags are listed.
+	resp, err := http.Get(server.URL + "/v2/served/tags/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tags)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags.Name != "served" || len(tags.Tags) != 1 || tags.Tags[0] != "v1" {
+		t.Errorf("unexpected tag list: %#v", tags)
+	}
+
+	// The layout is read-only.
+	if err := client.Push(ctx, pulled, index, serverRef(server, "served", "pushed"), PushOptions{}); err == nil {
+		t.Errorf("expected an error pushing to a read-only server")
+	}
+}
+
+func TestServerReadWrite(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestServerReadWrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	source, index := serverImage(t, filepath.Join(root, "source"), "v1")
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Join(root, "served"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	engine := newEngine(t, filepath.Join(root, "served"))
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+	handler := NewServer(engine, ServerOptions{ReadWrite: true})
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewClient(Options{PlainHTTP: true})
+	for _, test := range []struct {
+		tag string
+		opt PushOptions
+	}{
+		{"monolithic", PushOptions{}},
+		{"chunked", PushOptions{ChunkSize: 4, Workers: 1}},
+	} {
+		if err := client.Push(ctx, source, index, serverRef(server, "any/name", test.tag), test.opt); err != nil {
+			t.Fatalf("%s: unexpected error pushing to server: %+v", test.tag, err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(ctx, test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) == 0 || descriptorPaths[0].Root().Digest != index.Digest {
+			t.Errorf("%s: pushed image was not tagged: %v", test.tag, descriptorPaths)
+		}
+	}
+
+	// Every blob of the image must have been stored.
+	blobs, err := casext.NewEngine(source).Reachable(ctx, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		reader, err := engine.GetBlob(ctx, blob)
+		if err != nil {
+			t.Errorf("blob %s was not pushed: %v", blob, err)
+			continue
+		}
+		reader.Close()
+	}
+
+	// Tags can be deleted.
+	req, err := http.NewRequest("DELETE", server.URL+"/v2/any/name/manifests/chunked", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status deleting tag: %s", resp.Status)
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(ctx, "chunked"); err != nil || len(descriptorPaths) != 0 {
+		t.Errorf("tag was not deleted: %v %v", descriptorPaths, err)
+	}
+
+	// Manifests referencing unknown blobs are rejected.
+	req, err = http.NewRequest("PUT", server.URL+"/v2/any/name/manifests/broken", strings.NewReader(`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"`+digest.FromString("unknown").String()+`","size":7},"layers":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ispec.MediaTypeImageManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status pushing manifest with unknown blobs: %s", resp.Status)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// UploadSessions stores the locations of the upload sessions of blobs which
+// are being pushed in chunks, so that uploads which were interrupted (for
+// instance by a failed Push) can be resumed. Implementations must be safe for
+// concurrent use.
+type UploadSessions interface {
+	// Get returns the location of the upload session of the blob in the
+	// repository of the reference, if there is one.
+	Get(ref Reference, blob digest.Digest) (string, bool)
+
+	// Set stores the location of the upload session of the blob in the
+	// repository of the reference. If location is empty, the upload session
+	// is removed.
+	Set(ref Reference, blob digest.Digest, location string) error
+}
+
+// UploadSessionFile is an UploadSessions stored in a JSON file, so that
+// uploads can be resumed by later processes.
+type UploadSessionFile struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewUploadSessionFile returns an UploadSessions stored in the file at the
+// given path, which is created when the first upload session is stored (and
+// removed once there are no upload sessions left).
+func NewUploadSessionFile(path string) *UploadSessionFile {
+	return &UploadSessionFile{path: path}
+}
+
+// sessionKey returns the key of the upload session of the blob in the
+// repository of the reference.
+func sessionKey(ref Reference, blob digest.Digest) string {
+	return ref.host() + "/" + ref.Repository + "@" + blob.String()
+}
+
+// read returns the upload sessions stored in the file.
+func (f *UploadSessionFile) read() (map[string]string, error) {
+	sessions := map[string]string{}
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read upload sessions")
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, errors.Wrapf(err, "parse upload sessions %s", f.path)
+	}
+	return sessions, nil
+}
+
+// Get implements UploadSessions. Errors reading the file are treated as if
+// there were no upload session.
+func (f *UploadSessionFile) Get(ref Reference, blob digest.Digest) (string, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	sessions, err := f.read()
+	if err != nil {
+		return "", false
+	}
+	location, ok := sessions[sessionKey(ref, blob)]
+	return location, ok
+}
+
+// Set implements UploadSessions.
+func (f *UploadSessionFile) Set(ref Reference, blob digest.Digest, location string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	sessions, err := f.read()
+	if err != nil {
+		return err
+	}
+	key := sessionKey(ref, blob)
+	if location == "" {
+		if _, ok := sessions[key]; !ok {
+			return nil
+		}
+		delete(sessions, key)
+	} else {
+		sessions[key] = location
+	}
+
+	if len(sessions) == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove upload sessions")
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(sessions, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode upload sessions")
+	}
+	// Write the file atomically, so that an interrupted update doesn't lose
+	// every upload session.
+	fh, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".")
+	if err != nil {
+		return errors.Wrap(err, "create upload sessions")
+	}
+	defer os.Remove(fh.Name())
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return errors.Wrap(err, "write upload sessions")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "write upload sessions")
+	}
+	if err := os.Rename(fh.Name(), f.path); err != nil {
+		return errors.Wrap(err, "write upload sessions")
+	}
+	return nil
+}
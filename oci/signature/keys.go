@@ -0,0 +1,181 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signature
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// LoadPrivateKey parses a PEM-encoded (unencrypted) ECDSA, RSA or Ed25519
+// private key, in either PKCS#8 or the legacy EC and PKCS#1 formats.
+// Encrypted keys (including the encrypted keys generated by cosign) are not
+// supported, and must be decrypted first.
+func LoadPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		return nil, errors.Errorf("encrypted private keys are not supported: %s", block.Type)
+	default:
+		return nil, errors.Errorf("unknown private key type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// LoadPublicKey parses a PEM-encoded (PKIX) public key, such as the public
+// keys generated by cosign.
+func LoadPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf("no PEM data found")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, errors.Errorf("unknown public key type: %s", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	return key, errors.Wrap(err, "parse public key")
+}
+
+// KeyVerifier trusts signatures made with the private key corresponding to
+// Key.
+type KeyVerifier struct {
+	Key crypto.PublicKey
+}
+
+// Verify implements Verifier.
+func (v KeyVerifier) Verify(sig Signature) error {
+	return verifyPayload(v.Key, sig.Payload, sig.Signature)
+}
+
+// The object identifiers of the extensions which store the OIDC issuer of the
+// identity in a Fulcio certificate. The first is deprecated (its value is not
+// DER-encoded), but is still used by older certificates.
+var (
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// IdentityVerifier trusts keyless signatures, which are made with a
+// short-lived key whose certificate (issued by a certificate authority such
+// as Fulcio) names the identity of the signer. The certificate must chain up
+// to Roots and have been issued to Identity (an email address or URI) as
+// authenticated by the OIDC provider Issuer.
+//
+// Because the signing certificate has usually expired by the time it is
+// verified, its validity is checked at the time it was issued. Whether the
+// signature was recorded in a transparency log (such as Rekor) is not
+// checked.
+type IdentityVerifier struct {
+	Roots    *x509.CertPool
+	Identity string
+	Issuer   string
+}
+
+// certificateIssuer returns the OIDC issuer recorded in a Fulcio certificate.
+func certificateIssuer(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err != nil {
+				return "", errors.Wrap(err, "parse issuer extension")
+			}
+			return issuer, nil
+		case ext.Id.Equal(oidIssuerV1):
+			return string(ext.Value), nil
+		}
+	}
+	return "", errors.Errorf("certificate has no OIDC issuer")
+}
+
+// Verify implements Verifier.
+func (v IdentityVerifier) Verify(sig Signature) error {
+	if len(sig.Certificate) == 0 {
+		return errors.Errorf("signature has no certificate")
+	}
+	block, _ := pem.Decode(sig.Certificate)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.Errorf("signature certificate is not a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "parse certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM(sig.Chain)
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   cert.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return errors.Wrap(err, "verify certificate")
+	}
+
+	var identities []string
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	found := false
+	for _, identity := range identities {
+		if identity == v.Identity {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("certificate identities %v do not include %s", identities, v.Identity)
+	}
+
+	issuer, err := certificateIssuer(cert)
+	if err != nil {
+		return err
+	}
+	if issuer != v.Issuer {
+		return errors.Errorf("certificate was issued for an identity from %s, not %s", issuer, v.Issuer)
+	}
+
+	return verifyPayload(cert.PublicKey, sig.Payload, sig.Signature)
+}
@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package signature implements signing and verification of images using
+// signatures which are compatible with cosign (part of the sigstore project).
+// A signature is made over a "simple signing" payload which names the digest
+// of the signed manifest, and is stored in the image as an OCI referrer of the
+// signed manifest (or in a separate sidecar file).
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// PayloadType is the type of the simple signing payloads created by Sign.
+const PayloadType = "cosign container image signature"
+
+// Payload is a "simple signing" payload, which is the data that is actually
+// signed. It binds a reference name to the digest of a manifest.
+type Payload struct {
+	Critical PayloadCritical        `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// PayloadCritical is the critical section of a Payload, which must be checked
+// by every verifier.
+type PayloadCritical struct {
+	Identity PayloadIdentity `json:"identity"`
+	Image    PayloadImage    `json:"image"`
+	Type     string          `json:"type"`
+}
+
+// PayloadIdentity is the reference name the signed image was published as.
+type PayloadIdentity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+// PayloadImage identifies the signed manifest.
+type PayloadImage struct {
+	DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+}
+
+// Signature is a signature of a manifest.
+type Signature struct {
+	// Payload is the simple signing payload which was signed.
+	Payload []byte
+
+	// Signature is the raw signature of the payload.
+	Signature []byte
+
+	// Certificate is the PEM-encoded certificate of the signing key, for
+	// signatures made with a short-lived certificate (keyless signatures).
+	Certificate []byte
+
+	// Chain is the PEM-encoded chain of intermediate certificates for
+	// Certificate.
+	Chain []byte
+}
+
+// ParsePayload parses and checks the payload of the signature.
+func (s Signature) ParsePayload() (*Payload, error) {
+	var payload Payload
+	if err := json.Unmarshal(s.Payload, &payload); err != nil {
+		return nil, errors.Wrap(err, "parse payload")
+	}
+	if payload.Critical.Type != PayloadType {
+		return nil, errors.Errorf("payload has unknown type %q", payload.Critical.Type)
+	}
+	if err := payload.Critical.Image.DockerManifestDigest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "payload has invalid manifest digest")
+	}
+	return &payload, nil
+}
+
+// hashPayload returns the SHA-256 digest of the payload, which is what is
+// signed by ECDSA and RSA keys.
+func hashPayload(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+// Sign creates a signature of the manifest with the given digest using the
+// given key. The reference is the name the image is published as, and is
+// included in the signed payload.
+func Sign(signer crypto.Signer, reference string, manifestDigest digest.Digest) (*Signature, error) {
+	if err := manifestDigest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid manifest digest")
+	}
+	payload, err := json.Marshal(Payload{
+		Critical: PayloadCritical{
+			Identity: PayloadIdentity{DockerReference: reference},
+			Image:    PayloadImage{DockerManifestDigest: manifestDigest},
+			Type:     PayloadType,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal payload")
+	}
+
+	var sig []byte
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		// Ed25519 signs the message itself rather than a digest of it.
+		sig, err = signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		sig, err = signer.Sign(rand.Reader, hashPayload(payload), crypto.SHA256)
+	default:
+		return nil, errors.Errorf("unsupported key type %T", signer.Public())
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "sign payload")
+	}
+	return &Signature{Payload: payload, Signature: sig}, nil
+}
+
+// verifyPayload verifies that sig is a signature of the payload made with the
+// private key corresponding to the given public key.
+func verifyPayload(key crypto.PublicKey, payload, sig []byte) error {
+	var ok bool
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, hashPayload(payload), sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashPayload(payload), sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, payload, sig)
+	default:
+		return errors.Errorf("unsupported key type %T", key)
+	}
+	if !ok {
+		return errors.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// Verifier decides whether a signature was made by a trusted signer.
+type Verifier interface {
+	// Verify returns an error if the signature of the payload was not made
+	// by a trusted signer. The contents of the payload are not checked.
+	Verify(sig Signature) error
+}
+
+// VerifyManifest returns the first of the given signatures which was made by
+// a signer trusted by the verifier over a payload naming the given manifest
+// digest. If none of the signatures are valid, an error describing why each
+// one was rejected is returned.
+func VerifyManifest(sigs []Signature, manifestDigest digest.Digest, verifier Verifier) (*Signature, error) {
+	if len(sigs) == 0 {
+		return nil, errors.Errorf("no signatures found for %s", manifestDigest)
+	}
+	var reasons []string
+	for idx, sig := range sigs {
+		payload, err := sig.ParsePayload()
+		if err != nil {
+			reasons = append(reasons, errors.Wrapf(err, "signature %d", idx).Error())
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest != manifestDigest {
+			reasons = append(reasons, errors.Errorf("signature %d: payload is for %s", idx, payload.Critical.Image.DockerManifestDigest).Error())
+			continue
+		}
+		if err := verifier.Verify(sig); err != nil {
+			reasons = append(reasons, errors.Wrapf(err, "signature %d", idx).Error())
+			continue
+		}
+		return &sigs[idx], nil
+	}
+	return nil, errors.Errorf("no valid signatures found for %s: %s", manifestDigest, strings.Join(reasons, "; "))
+}
@@ -0,0 +1,239 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// encodeKeys returns the PEM encoding of the private and public key.
+func encodeKeys(t *testing.T, signer crypto.Signer) ([]byte, []byte) {
+	private, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+}
+
+func TestSignVerify(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestDigest := digest.SHA256.FromString("manifest")
+	otherDigest := digest.SHA256.FromString("other manifest")
+
+	for _, test := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"ecdsa", ecdsaKey},
+		{"rsa", rsaKey},
+		{"ed25519", ed25519Key},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			privatePEM, publicPEM := encodeKeys(t, test.key)
+			signer, err := LoadPrivateKey(privatePEM)
+			if err != nil {
+				t.Fatalf("unexpected error loading private key: %+v", err)
+			}
+			public, err := LoadPublicKey(publicPEM)
+			if err != nil {
+				t.Fatalf("unexpected error loading public key: %+v", err)
+			}
+
+			sig, err := Sign(signer, "registry.example.com/image", manifestDigest)
+			if err != nil {
+				t.Fatalf("unexpected error signing: %+v", err)
+			}
+			payload, err := sig.ParsePayload()
+			if err != nil {
+				t.Fatalf("unexpected error parsing payload: %+v", err)
+			}
+			if payload.Critical.Identity.DockerReference != "registry.example.com/image" {
+				t.Errorf("unexpected reference in payload: %s", payload.Critical.Identity.DockerReference)
+			}
+
+			verified, err := VerifyManifest([]Signature{*sig}, manifestDigest, KeyVerifier{Key: public})
+			if err != nil {
+				t.Fatalf("unexpected error verifying signature: %+v", err)
+			}
+			if string(verified.Payload) != string(sig.Payload) {
+				t.Errorf("unexpected signature returned by VerifyManifest")
+			}
+
+			// The signature must be for the right manifest.
+			if _, err := VerifyManifest([]Signature{*sig}, otherDigest, KeyVerifier{Key: public}); err == nil {
+				t.Errorf("expected signature of a different manifest to be rejected")
+			}
+			// The signature must be made with the right key.
+			if _, err := VerifyManifest([]Signature{*sig}, manifestDigest, KeyVerifier{Key: otherKey.Public()}); err == nil {
+				t.Errorf("expected signature made with a different key to be rejected")
+			}
+			// The signature must match the payload.
+			tampered := *sig
+			tampered.Payload = []byte(strings.Replace(string(sig.Payload), "registry.example.com", "evil.example.com", 1))
+			if _, err := VerifyManifest([]Signature{tampered}, manifestDigest, KeyVerifier{Key: public}); err == nil {
+				t.Errorf("expected signature of a tampered payload to be rejected")
+			}
+			// One valid signature is enough.
+			if _, err := VerifyManifest([]Signature{tampered, *sig}, manifestDigest, KeyVerifier{Key: public}); err != nil {
+				t.Errorf("unexpected error verifying signatures: %+v", err)
+			}
+		})
+	}
+
+	if _, err := VerifyManifest(nil, manifestDigest, KeyVerifier{Key: ecdsaKey.Public()}); err == nil {
+		t.Errorf("expected an error verifying without any signatures")
+	}
+}
+
+func TestLoadPrivateKeyEncrypted(t *testing.T) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: []byte("encrypted")})
+	if _, err := LoadPrivateKey(data); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected encrypted keys to be unsupported, got %v", err)
+	}
+	if _, err := LoadPrivateKey([]byte("not a key")); err == nil {
+		t.Errorf("expected an error loading invalid key")
+	}
+}
+
+// fulcioCertificate returns a certificate (and its signing key) for the given
+// identity, issued by the given CA as if by Fulcio.
+func fulcioCertificate(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, identity, issuer string) ([]byte, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerValue, err := asn1.Marshal(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keyless certificates are only valid for a few minutes.
+	notBefore := time.Now().Add(-time.Hour)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{identity},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuerV2, Value: issuerValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key
+}
+
+func TestIdentityVerifier(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "umoci test fulcio"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	manifestDigest := digest.SHA256.FromString("manifest")
+	certPEM, key := fulcioCertificate(t, ca, caKey, "jane@example.com", "https://accounts.example.com")
+	sig, err := Sign(key, "image", manifestDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Certificate = certPEM
+
+	verifier := IdentityVerifier{Roots: roots, Identity: "jane@example.com", Issuer: "https://accounts.example.com"}
+	if _, err := VerifyManifest([]Signature{*sig}, manifestDigest, verifier); err != nil {
+		t.Errorf("unexpected error verifying keyless signature: %+v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		verifier IdentityVerifier
+		sig      Signature
+	}{
+		{"wrong identity", IdentityVerifier{Roots: roots, Identity: "john@example.com", Issuer: verifier.Issuer}, *sig},
+		{"wrong issuer", IdentityVerifier{Roots: roots, Identity: verifier.Identity, Issuer: "https://evil.example.com"}, *sig},
+		{"untrusted root", IdentityVerifier{Roots: x509.NewCertPool(), Identity: verifier.Identity, Issuer: verifier.Issuer}, *sig},
+		{"no certificate", verifier, Signature{Payload: sig.Payload, Signature: sig.Signature}},
+	} {
+		if _, err := VerifyManifest([]Signature{test.sig}, manifestDigest, test.verifier); err == nil {
+			t.Errorf("%s: expected keyless signature to be rejected", test.name)
+		}
+	}
+
+	// The certificate must be for the key which made the signature.
+	otherPEM, _ := fulcioCertificate(t, ca, caKey, "jane@example.com", "https://accounts.example.com")
+	mismatched := *sig
+	mismatched.Certificate = otherPEM
+	if err := verifier.Verify(mismatched); err == nil || !strings.Contains(errors.Cause(err).Error(), "invalid signature") {
+		t.Errorf("expected signature with mismatched certificate to be rejected, got %v", err)
+	}
+}
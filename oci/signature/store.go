@@ -0,0 +1,208 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signature
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// The media types and annotations used by cosign to store signatures as OCI
+// referrers of the signed manifest.
+const (
+	// ArtifactType is the artifact type of signature artifact manifests.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+	// MediaTypeSimpleSigning is the media type of the blobs containing the
+	// signed payloads.
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// AnnotationSignature is the annotation of a payload blob descriptor
+	// containing the base64-encoded signature of the payload.
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+
+	// AnnotationCertificate is the annotation of a payload blob descriptor
+	// containing the PEM-encoded signing certificate (for keyless
+	// signatures).
+	AnnotationCertificate = "dev.sigstore.cosign/certificate"
+
+	// AnnotationChain is the annotation of a payload blob descriptor
+	// containing the PEM-encoded intermediate certificates of the signing
+	// certificate.
+	AnnotationChain = "dev.sigstore.cosign/chain"
+)
+
+// Attach stores the signature in the image as an artifact manifest whose
+// subject is the given (signed) manifest descriptor, and adds the artifact
+// manifest (without a reference name) to the top-level index so that it can
+// be found by Find. The descriptor of the artifact manifest is returned.
+func Attach(ctx context.Context, engine cas.Engine, subject ispec.Descriptor, sig Signature) (ispec.Descriptor, error) {
+	payload, err := mutate.PutBlob(ctx, engine, MediaTypeSimpleSigning, bytes.NewReader(sig.Payload))
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put payload")
+	}
+	payload.Annotations = map[string]string{
+		AnnotationSignature: base64.StdEncoding.EncodeToString(sig.Signature),
+	}
+	if len(sig.Certificate) > 0 {
+		payload.Annotations[AnnotationCertificate] = string(sig.Certificate)
+	}
+	if len(sig.Chain) > 0 {
+		payload.Annotations[AnnotationChain] = string(sig.Chain)
+	}
+
+	descriptor, err := mutate.AttachArtifact(ctx, engine, subject, mutate.Artifact{
+		ArtifactType: ArtifactType,
+		Blobs:        []ispec.Descriptor{payload},
+	})
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "attach signature artifact")
+	}
+	return descriptor, nil
+}
+
+// referrerManifest contains the fields of an artifact manifest which are not
+// part of the vendored image-spec.
+type referrerManifest struct {
+	ArtifactType string             `json:"artifactType"`
+	Subject      *ispec.Descriptor  `json:"subject"`
+	Layers       []ispec.Descriptor `json:"layers"`
+}
+
+// readBlob reads the blob with the given digest, verifying its contents.
+func readBlob(ctx context.Context, engine cas.Engine, blobDigest digest.Digest) ([]byte, error) {
+	reader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read blob")
+	}
+	if got := blobDigest.Algorithm().FromBytes(data); got != blobDigest {
+		return nil, errors.Errorf("blob %s is corrupted: contents have digest %s", blobDigest, got)
+	}
+	return data, nil
+}
+
+// optionalBytes returns the contents of an optional field, which is nil if
+// the field is empty.
+func optionalBytes(value string) []byte {
+	if value == "" {
+		return nil
+	}
+	return []byte(value)
+}
+
+// Find returns the signatures stored (by Attach, or by cosign) in the image
+// for the manifest with the given digest.
+func Find(ctx context.Context, engine cas.Engine, subject digest.Digest) ([]Signature, error) {
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	var sigs []Signature
+	for _, descriptor := range index.Manifests {
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			continue
+		}
+		data, err := readBlob(ctx, engine, descriptor.Digest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read manifest %s", descriptor.Digest)
+		}
+		var manifest referrerManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "parse manifest %s", descriptor.Digest)
+		}
+		if manifest.ArtifactType != ArtifactType || manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != MediaTypeSimpleSigning {
+				continue
+			}
+			payload, err := readBlob(ctx, engine, layer.Digest)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read signature payload %s", layer.Digest)
+			}
+			sig, err := base64.StdEncoding.DecodeString(layer.Annotations[AnnotationSignature])
+			if err != nil {
+				return nil, errors.Wrapf(err, "decode signature of %s", layer.Digest)
+			}
+			sigs = append(sigs, Signature{
+				Payload:     payload,
+				Signature:   sig,
+				Certificate: optionalBytes(layer.Annotations[AnnotationCertificate]),
+				Chain:       optionalBytes(layer.Annotations[AnnotationChain]),
+			})
+		}
+	}
+	return sigs, nil
+}
+
+// sidecar is the JSON encoding of a Signature stored in a sidecar file. The
+// field names match the signature bundles written by cosign, with the
+// addition of the (base64-encoded) payload.
+type sidecar struct {
+	Payload         []byte `json:"payload"`
+	Base64Signature string `json:"base64Signature"`
+	Cert            string `json:"cert,omitempty"`
+	Chain           string `json:"chain,omitempty"`
+}
+
+// WriteSidecar writes the signature to w as a JSON sidecar document, which can
+// be read with ReadSidecar.
+func WriteSidecar(w io.Writer, sig Signature) error {
+	return errors.Wrap(json.NewEncoder(w).Encode(sidecar{
+		Payload:         sig.Payload,
+		Base64Signature: base64.StdEncoding.EncodeToString(sig.Signature),
+		Cert:            string(sig.Certificate),
+		Chain:           string(sig.Chain),
+	}), "write sidecar")
+}
+
+// ReadSidecar reads a signature written by WriteSidecar.
+func ReadSidecar(r io.Reader) (*Signature, error) {
+	var raw sidecar
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, errors.Wrap(err, "parse sidecar")
+	}
+	sig, err := base64.StdEncoding.DecodeString(raw.Base64Signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode signature")
+	}
+	return &Signature{
+		Payload:     raw.Payload,
+		Signature:   sig,
+		Certificate: optionalBytes(raw.Cert),
+		Chain:       optionalBytes(raw.Chain),
+	}, nil
+}
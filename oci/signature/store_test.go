@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestAttachFind(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestAttachFind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.SHA256.FromString("manifest"),
+		Size:      8,
+	}
+	other := digest.SHA256.FromString("other manifest")
+
+	sig, err := Sign(key, "image", subject.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Certificate = []byte("certificate")
+	if _, err := Attach(ctx, engine, subject, *sig); err != nil {
+		t.Fatalf("unexpected error attaching signature: %+v", err)
+	}
+	otherSig, err := Sign(key, "image", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Attach(ctx, engine, ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: other, Size: 1}, *otherSig); err != nil {
+		t.Fatalf("unexpected error attaching signature: %+v", err)
+	}
+
+	sigs, err := Find(ctx, engine, subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error finding signatures: %+v", err)
+	}
+	if len(sigs) != 1 || !reflect.DeepEqual(sigs[0], *sig) {
+		t.Fatalf("unexpected signatures found: %#v", sigs)
+	}
+	if _, err := VerifyManifest(sigs, subject.Digest, KeyVerifier{Key: key.Public()}); err != nil {
+		t.Errorf("unexpected error verifying found signature: %+v", err)
+	}
+
+	// The artifact manifests are referenced by the index, so they are kept
+	// by a GC.
+	index, err := engine.GetIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Errorf("expected 2 artifact manifests in the index, got %d", len(index.Manifests))
+	}
+
+	sigs, err = Find(ctx, engine, digest.SHA256.FromString("unsigned"))
+	if err != nil {
+		t.Fatalf("unexpected error finding signatures: %+v", err)
+	}
+	if len(sigs) != 0 {
+		t.Errorf("expected no signatures for an unsigned manifest, got %d", len(sigs))
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(key, "image", digest.SHA256.FromString("manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Chain = []byte("chain")
+
+	var buf bytes.Buffer
+	if err := WriteSidecar(&buf, *sig); err != nil {
+		t.Fatalf("unexpected error writing sidecar: %+v", err)
+	}
+	read, err := ReadSidecar(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error reading sidecar: %+v", err)
+	}
+	if !reflect.DeepEqual(read, sig) {
+		t.Errorf("sidecar did not round-trip: expected %#v, got %#v", sig, read)
+	}
+
+	if _, err := ReadSidecar(bytes.NewBufferString(`{"payload": "", "base64Signature": "!!!"}`)); err == nil {
+		t.Errorf("expected an error reading a sidecar with an invalid signature")
+	}
+}
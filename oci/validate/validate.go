@@ -0,0 +1,644 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package validate checks that an OCI image layout is compliant with the OCI
+// image-spec, producing a report of every problem found rather than stopping
+// at the first one.
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Severity is how serious a Finding is.
+type Severity string
+
+const (
+	// SeverityError is used for violations of the image-spec, which will
+	// cause other tools to reject (or misinterpret) the image.
+	SeverityError Severity = "error"
+
+	// SeverityWarning is used for things which are permitted by the
+	// image-spec but are likely to cause problems, such as the use of
+	// non-OCI media types.
+	SeverityWarning Severity = "warning"
+
+	// SeverityInfo is used for things which are worth knowing but are not
+	// problems, such as blobs which are not referenced by the index.
+	SeverityInfo Severity = "info"
+)
+
+// Finding is a single result of validating an image layout.
+type Finding struct {
+	// Severity is how serious the finding is.
+	Severity Severity `json:"severity"`
+
+	// Location is the file in the image layout the finding applies to,
+	// relative to the root of the layout (such as "index.json" or
+	// "blobs/sha256/<hex>").
+	Location string `json:"location"`
+
+	// Path is the descriptor path used to reach the blob the finding applies
+	// to, if the blob is reachable from the index.
+	Path *casext.DescriptorPath `json:"path,omitempty"`
+
+	// Message is a human-readable description of the finding.
+	Message string `json:"message"`
+}
+
+// String returns a human-readable description of the finding.
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Location, f.Message)
+}
+
+// Report is the result of validating an image layout.
+type Report struct {
+	// Findings are the findings, in the order they were found.
+	Findings []Finding `json:"findings"`
+
+	// Errors, Warnings and Infos are the number of findings with each
+	// severity.
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+	Infos    int `json:"infos"`
+}
+
+// Valid returns whether the image layout is compliant with the image-spec,
+// which is the case if there are no findings with SeverityError.
+func (r *Report) Valid() bool {
+	return r.Errors == 0
+}
+
+func (r *Report) add(severity Severity, location string, descriptorPath *casext.DescriptorPath, format string, args ...interface{}) {
+	if descriptorPath != nil {
+		descriptorPath = &casext.DescriptorPath{Walk: append([]ispec.Descriptor{}, descriptorPath.Walk...)}
+	}
+	r.Findings = append(r.Findings, Finding{
+		Severity: severity,
+		Location: location,
+		Path:     descriptorPath,
+		Message:  fmt.Sprintf(format, args...),
+	})
+	switch severity {
+	case SeverityError:
+		r.Errors++
+	case SeverityWarning:
+		r.Warnings++
+	case SeverityInfo:
+		r.Infos++
+	}
+}
+
+const (
+	layoutFile    = "oci-layout"
+	indexFile     = "index.json"
+	blobDirectory = "blobs"
+)
+
+// mediaTypeRegexp is the grammar of media types used by the image-spec JSON
+// schemas (RFC 6838 section 4.2).
+var mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// The fields defined by the image-spec for each JSON document. Fields which
+// are not in these lists are not errors (the image-spec requires unknown
+// fields to be ignored) but are reported in case they are typos.
+var (
+	layoutFields     = []string{"imageLayoutVersion"}
+	indexFields      = []string{"schemaVersion", "mediaType", "artifactType", "manifests", "subject", "annotations"}
+	manifestFields   = []string{"schemaVersion", "mediaType", "artifactType", "config", "layers", "subject", "annotations"}
+	descriptorFields = []string{"mediaType", "digest", "size", "urls", "annotations", "data", "artifactType", "platform"}
+	configFields     = []string{"created", "author", "architecture", "os", "os.version", "os.features", "variant", "config", "rootfs", "history"}
+)
+
+// blobLocation returns the location of the blob with the given digest.
+func blobLocation(blobDigest digest.Digest) string {
+	return filepath.Join(blobDirectory, blobDigest.Algorithm().String(), blobDigest.Hex())
+}
+
+// validateState stores state information about a Layout.
+type validateState struct {
+	path   string
+	engine casext.Engine
+	report *Report
+
+	// visited are the blobs whose contents have already been validated.
+	visited map[digest.Digest]struct{}
+
+	// reachable are the blobs reachable from the index.
+	reachable map[digest.Digest]struct{}
+}
+
+// checkFields reports any fields of the JSON object in data which are not in
+// known.
+func (vs *validateState) checkFields(location string, descriptorPath *casext.DescriptorPath, what string, data []byte, known []string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	knownFields := map[string]struct{}{}
+	for _, field := range known {
+		knownFields[field] = struct{}{}
+	}
+	var unknown []string
+	for field := range fields {
+		if _, ok := knownFields[field]; !ok {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	for _, field := range unknown {
+		vs.report.add(SeverityInfo, location, descriptorPath, "%s has field %q which is not defined by the image-spec", what, field)
+	}
+}
+
+// validateLayoutFile validates the "oci-layout" file, returning whether it is
+// valid enough to continue.
+func (vs *validateState) validateLayoutFile() bool {
+	data, err := ioutil.ReadFile(filepath.Join(vs.path, layoutFile))
+	if err != nil {
+		vs.report.add(SeverityError, layoutFile, nil, "cannot read oci-layout: %v", err)
+		return false
+	}
+	var layout ispec.ImageLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		vs.report.add(SeverityError, layoutFile, nil, "oci-layout is not valid JSON: %v", err)
+		return false
+	}
+	vs.checkFields(layoutFile, nil, "oci-layout", data, layoutFields)
+	if layout.Version != dir.ImageLayoutVersion {
+		vs.report.add(SeverityError, layoutFile, nil, "unsupported imageLayoutVersion %q (expected %q)", layout.Version, dir.ImageLayoutVersion)
+		return false
+	}
+	return true
+}
+
+// validateStructure validates the top-level structure of the image layout,
+// returning whether it is valid enough to continue.
+func (vs *validateState) validateStructure() bool {
+	ok := true
+	if fi, err := os.Stat(filepath.Join(vs.path, blobDirectory)); err != nil {
+		vs.report.add(SeverityError, blobDirectory, nil, "cannot stat blobs directory: %v", err)
+		ok = false
+	} else if !fi.IsDir() {
+		vs.report.add(SeverityError, blobDirectory, nil, "blobs is not a directory")
+		ok = false
+	}
+	if fi, err := os.Stat(filepath.Join(vs.path, indexFile)); err != nil {
+		vs.report.add(SeverityError, indexFile, nil, "cannot stat index.json: %v", err)
+		ok = false
+	} else if !fi.Mode().IsRegular() {
+		vs.report.add(SeverityError, indexFile, nil, "index.json is not a regular file")
+		ok = false
+	}
+	return ok
+}
+
+// validateDescriptor validates the fields of a descriptor.
+func (vs *validateState) validateDescriptor(location string, descriptorPath casext.DescriptorPath, data []byte) {
+	descriptor := descriptorPath.Descriptor()
+	if data != nil {
+		vs.checkFields(location, &descriptorPath, "descriptor", data, descriptorFields)
+	}
+	switch {
+	case descriptor.MediaType == "":
+		vs.report.add(SeverityError, location, &descriptorPath, "descriptor has no mediaType")
+	case !mediaTypeRegexp.MatchString(descriptor.MediaType):
+		vs.report.add(SeverityError, location, &descriptorPath, "descriptor has malformed mediaType %q", descriptor.MediaType)
+	}
+	switch descriptor.MediaType {
+	case casext.MediaTypeDockerManifest, casext.MediaTypeDockerManifestList, casext.MediaTypeDockerConfig,
+		casext.MediaTypeDockerLayer, casext.MediaTypeDockerLayerGzip,
+		casext.MediaTypeDockerForeignLayer, casext.MediaTypeDockerForeignLayerGzip:
+		vs.report.add(SeverityWarning, location, &descriptorPath, "descriptor has non-OCI mediaType %q", descriptor.MediaType)
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		vs.report.add(SeverityError, location, &descriptorPath, "descriptor has invalid digest %q: %v", descriptor.Digest, err)
+	}
+	if descriptor.Size < 0 {
+		vs.report.add(SeverityError, location, &descriptorPath, "descriptor has negative size %d", descriptor.Size)
+	}
+	for _, rawURL := range descriptor.URLs {
+		if u, err := url.Parse(rawURL); err != nil || !u.IsAbs() {
+			vs.report.add(SeverityError, location, &descriptorPath, "descriptor has invalid url %q", rawURL)
+		}
+	}
+	if descriptor.Platform != nil && (descriptor.Platform.OS == "" || descriptor.Platform.Architecture == "") {
+		vs.report.add(SeverityError, location, &descriptorPath, "descriptor platform is missing os or architecture")
+	}
+}
+
+// rawDescriptors returns the raw JSON of each descriptor in the given list
+// field of the JSON object in data, so that their fields can be checked.
+func rawDescriptors(data []byte, field string) []json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	var descriptors []json.RawMessage
+	if err := json.Unmarshal(fields[field], &descriptors); err != nil {
+		return nil
+	}
+	return descriptors
+}
+
+// rawDescriptor returns the raw JSON of the descriptor in the given field of
+// the JSON object in data, so that its fields can be checked.
+func rawDescriptor(data []byte, field string) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	return fields[field]
+}
+
+// checkMediaTypeField checks that the mediaType field of the JSON object in
+// data (if it is set) matches the mediaType of the descriptor referencing it.
+// The vendored image-spec types do not have this field, so it is parsed
+// separately.
+func (vs *validateState) checkMediaTypeField(location string, descriptorPath *casext.DescriptorPath, what string, data []byte, expected string) {
+	var fields struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		vs.report.add(SeverityError, location, descriptorPath, "%s has invalid mediaType: %v", what, err)
+		return
+	}
+	if mediaType := fields.MediaType; mediaType != "" && mediaType != expected {
+		vs.report.add(SeverityError, location, descriptorPath, "%s has mediaType %q which does not match %q", what, mediaType, expected)
+	}
+}
+
+// validateIndex validates the top-level index.json.
+func (vs *validateState) validateIndex() ([]ispec.Descriptor, error) {
+	data, err := ioutil.ReadFile(filepath.Join(vs.path, indexFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read index.json")
+	}
+	var index ispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		vs.report.add(SeverityError, indexFile, nil, "index.json is not a valid index: %v", err)
+		return nil, nil
+	}
+	vs.checkFields(indexFile, nil, "index", data, indexFields)
+	if index.SchemaVersion != 2 {
+		vs.report.add(SeverityError, indexFile, nil, "index has unsupported schemaVersion %d", index.SchemaVersion)
+	}
+	vs.checkMediaTypeField(indexFile, nil, "index", data, ispec.MediaTypeImageIndex)
+
+	rawManifests := rawDescriptors(data, "manifests")
+	refNames := map[string]int{}
+	for idx, descriptor := range index.Manifests {
+		descriptorPath := casext.DescriptorPath{Walk: []ispec.Descriptor{descriptor}}
+		var raw []byte
+		if idx < len(rawManifests) {
+			raw = rawManifests[idx]
+		}
+		vs.validateDescriptor(indexFile, descriptorPath, raw)
+		if name, ok := descriptor.Annotations[ispec.AnnotationRefName]; ok {
+			refNames[name]++
+			if refNames[name] == 2 {
+				vs.report.add(SeverityWarning, indexFile, &descriptorPath, "reference %q is used by more than one descriptor", name)
+			}
+		}
+	}
+	return index.Manifests, nil
+}
+
+// readBlob reads the blob referenced by the descriptor, returning nil if the
+// blob is missing or corrupted (which is reported by casext.Verify).
+func (vs *validateState) readBlob(ctx context.Context, descriptor ispec.Descriptor) ([]byte, error) {
+	if descriptor.Digest.Validate() != nil {
+		return nil, nil
+	}
+	reader, err := vs.engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read blob")
+	}
+	if descriptor.Digest.Algorithm().FromBytes(data) != descriptor.Digest {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// recurse validates the blob referenced by the descriptor path (and any blobs
+// it references).
+func (vs *validateState) recurse(ctx context.Context, descriptorPath casext.DescriptorPath) error {
+	descriptor := descriptorPath.Descriptor()
+	if descriptor.Digest.Validate() != nil {
+		return nil
+	}
+	vs.reachable[descriptor.Digest] = struct{}{}
+
+	var known []string
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest:
+		known = manifestFields
+	case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList:
+		known = indexFields
+	case ispec.MediaTypeImageConfig, casext.MediaTypeDockerConfig:
+		known = configFields
+	case ispec.MediaTypeDescriptor:
+		known = descriptorFields
+	default:
+		// Layers and other blobs are not parsed.
+		return nil
+	}
+	if _, ok := vs.visited[descriptor.Digest]; ok {
+		return nil
+	}
+	vs.visited[descriptor.Digest] = struct{}{}
+
+	data, err := vs.readBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrapf(err, "validate blob %s", descriptor.Digest)
+	}
+	if data == nil {
+		return nil
+	}
+	location := blobLocation(descriptor.Digest)
+
+	// Docker blobs have many fields which are not in the image-spec.
+	switch descriptor.MediaType {
+	case casext.MediaTypeDockerManifest, casext.MediaTypeDockerManifestList, casext.MediaTypeDockerConfig:
+	default:
+		what := "blob"
+		switch descriptor.MediaType {
+		case ispec.MediaTypeImageManifest:
+			what = "manifest"
+		case ispec.MediaTypeImageIndex:
+			what = "index"
+		case ispec.MediaTypeImageConfig:
+			what = "image configuration"
+		case ispec.MediaTypeDescriptor:
+			what = "descriptor"
+		}
+		vs.checkFields(location, &descriptorPath, what, data, known)
+	}
+
+	switch descriptor.MediaType {
+	case ispec.MediaTypeImageManifest, casext.MediaTypeDockerManifest:
+		return vs.validateManifest(ctx, descriptorPath, data)
+	case ispec.MediaTypeImageIndex, casext.MediaTypeDockerManifestList:
+		return vs.validateNestedIndex(ctx, descriptorPath, data)
+	case ispec.MediaTypeImageConfig, casext.MediaTypeDockerConfig:
+		vs.validateConfig(descriptorPath, data)
+	case ispec.MediaTypeDescriptor:
+		var child ispec.Descriptor
+		if err := json.Unmarshal(data, &child); err != nil {
+			return nil
+		}
+		childPath := casext.DescriptorPath{Walk: append(descriptorPath.Walk, child)}
+		vs.validateDescriptor(location, childPath, nil)
+		return vs.recurse(ctx, childPath)
+	}
+	return nil
+}
+
+func (vs *validateState) validateNestedIndex(ctx context.Context, descriptorPath casext.DescriptorPath, data []byte) error {
+	location := blobLocation(descriptorPath.Descriptor().Digest)
+	var index ispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		// Reported by casext.Verify.
+		return nil
+	}
+	vs.checkMediaTypeField(location, &descriptorPath, "index", data, descriptorPath.Descriptor().MediaType)
+
+	rawManifests := rawDescriptors(data, "manifests")
+	for idx, child := range index.Manifests {
+		childPath := casext.DescriptorPath{Walk: append(descriptorPath.Walk, child)}
+		var raw []byte
+		if idx < len(rawManifests) {
+			raw = rawManifests[idx]
+		}
+		vs.validateDescriptor(location, childPath, raw)
+		if err := vs.recurse(ctx, childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vs *validateState) validateManifest(ctx context.Context, descriptorPath casext.DescriptorPath, data []byte) error {
+	location := blobLocation(descriptorPath.Descriptor().Digest)
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		// Reported by casext.Verify.
+		return nil
+	}
+	vs.checkMediaTypeField(location, &descriptorPath, "manifest", data, descriptorPath.Descriptor().MediaType)
+
+	configPath := casext.DescriptorPath{Walk: append(descriptorPath.Walk, manifest.Config)}
+	vs.validateDescriptor(location, configPath, rawDescriptor(data, "config"))
+	switch manifest.Config.MediaType {
+	case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex, ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip:
+		vs.report.add(SeverityError, location, &configPath, "manifest config has mediaType %q which is not a configuration", manifest.Config.MediaType)
+	}
+	if err := vs.recurse(ctx, configPath); err != nil {
+		return err
+	}
+
+	rawLayers := rawDescriptors(data, "layers")
+	for idx, layer := range manifest.Layers {
+		layerPath := casext.DescriptorPath{Walk: append(descriptorPath.Walk, layer)}
+		var raw []byte
+		if idx < len(rawLayers) {
+			raw = rawLayers[idx]
+		}
+		vs.validateDescriptor(location, layerPath, raw)
+		if err := vs.recurse(ctx, layerPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vs *validateState) validateConfig(descriptorPath casext.DescriptorPath, data []byte) {
+	location := blobLocation(descriptorPath.Descriptor().Digest)
+	var config ispec.Image
+	if err := json.Unmarshal(data, &config); err != nil {
+		// Reported by casext.Verify.
+		return
+	}
+
+	// The history must have exactly one non-empty entry per layer, so that
+	// tools can match entries to layers.
+	if len(config.History) > 0 {
+		nonEmpty := 0
+		for _, history := range config.History {
+			if !history.EmptyLayer {
+				nonEmpty++
+			}
+		}
+		if nonEmpty != len(config.RootFS.DiffIDs) {
+			vs.report.add(SeverityWarning, location, &descriptorPath, "image configuration has %d non-empty history entries but %d layers", nonEmpty, len(config.RootFS.DiffIDs))
+		}
+	}
+}
+
+// validateBlobs validates the contents of the blobs directory, reporting
+// malformed entries as well as blobs which are not reachable from the index
+// (whose contents are checked separately, as casext.Verify only checks
+// reachable blobs).
+func (vs *validateState) validateBlobs() error {
+	blobsPath := filepath.Join(vs.path, blobDirectory)
+	algorithms, err := ioutil.ReadDir(blobsPath)
+	if err != nil {
+		return errors.Wrap(err, "read blobs directory")
+	}
+	for _, algorithmFi := range algorithms {
+		algorithm := digest.Algorithm(algorithmFi.Name())
+		algorithmLocation := filepath.Join(blobDirectory, algorithmFi.Name())
+		if !algorithmFi.IsDir() {
+			vs.report.add(SeverityError, algorithmLocation, nil, "blobs directory contains a non-directory entry")
+			continue
+		}
+		if !algorithm.Available() {
+			vs.report.add(SeverityWarning, algorithmLocation, nil, "blobs directory contains unsupported digest algorithm %q", algorithm)
+			continue
+		}
+
+		blobs, err := ioutil.ReadDir(filepath.Join(blobsPath, algorithmFi.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "read blobs directory %s", algorithm)
+		}
+		for _, blobFi := range blobs {
+			location := filepath.Join(algorithmLocation, blobFi.Name())
+			blobDigest := digest.NewDigestFromHex(algorithm.String(), blobFi.Name())
+			if err := blobDigest.Validate(); err != nil {
+				vs.report.add(SeverityError, location, nil, "blob has invalid name: %v", err)
+				continue
+			}
+			if !blobFi.Mode().IsRegular() {
+				vs.report.add(SeverityError, location, nil, "blob is not a regular file")
+				continue
+			}
+			if _, ok := vs.reachable[blobDigest]; ok {
+				continue
+			}
+			vs.report.add(SeverityInfo, location, nil, "blob is not referenced by index.json (it will be removed by umoci-gc(1))")
+
+			fh, err := os.Open(filepath.Join(blobsPath, algorithmFi.Name(), blobFi.Name()))
+			if err != nil {
+				return errors.Wrap(err, "open blob")
+			}
+			contentDigest, err := algorithm.FromReader(fh)
+			fh.Close()
+			if err != nil {
+				return errors.Wrap(err, "hash blob")
+			}
+			if contentDigest != blobDigest {
+				vs.report.add(SeverityError, location, nil, "blob is corrupted: contents have digest %s", contentDigest)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTopLevel reports unexpected entries in the root of the layout.
+func (vs *validateState) validateTopLevel() error {
+	entries, err := ioutil.ReadDir(vs.path)
+	if err != nil {
+		return errors.Wrap(err, "read image layout")
+	}
+	for _, entry := range entries {
+		switch entry.Name() {
+		case layoutFile, indexFile, blobDirectory:
+			continue
+		}
+		vs.report.add(SeverityInfo, entry.Name(), nil, "entry is not defined by the image-spec")
+	}
+	return nil
+}
+
+// Layout validates the OCI image layout at the given path against the
+// image-spec. In addition to the checks done by casext.Verify (the digest and
+// size of every reachable blob, the diff_ids of every layer and the basic
+// structure of manifests, indexes and image configurations), the oci-layout
+// file, the structure of the blobs directory, the fields and media types of
+// every descriptor and the mediaType fields of manifests and indexes are
+// validated, and blobs which are not reachable from the index are reported.
+//
+// The problems found are returned as a Report; an error is only returned if
+// the image layout could not be read.
+func Layout(ctx context.Context, path string) (*Report, error) {
+	vs := &validateState{
+		path:      path,
+		report:    &Report{Findings: []Finding{}},
+		visited:   map[digest.Digest]struct{}{},
+		reachable: map[digest.Digest]struct{}{},
+	}
+
+	if !vs.validateLayoutFile() || !vs.validateStructure() {
+		return vs.report, nil
+	}
+	if err := vs.validateTopLevel(); err != nil {
+		return nil, err
+	}
+	roots, err := vs.validateIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	engine, err := dir.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open CAS")
+	}
+	defer engine.Close()
+	vs.engine = casext.NewEngine(engine)
+
+	// Check the integrity of all reachable blobs.
+	issues, err := vs.engine.Verify(ctx, roots)
+	if err != nil {
+		return nil, errors.Wrap(err, "verify")
+	}
+	for _, issue := range issues {
+		issuePath := issue.Path
+		vs.report.add(SeverityError, blobLocation(issuePath.Descriptor().Digest), &issuePath, "%s", issue.Problem)
+	}
+
+	for _, root := range roots {
+		if err := vs.recurse(ctx, casext.DescriptorPath{Walk: []ispec.Descriptor{root}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := vs.validateBlobs(); err != nil {
+		return nil, err
+	}
+	return vs.report, nil
+}
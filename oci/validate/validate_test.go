@@ -0,0 +1,225 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package validate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// validateTestImage creates an image layout with a single tagged image (with
+// a single uncompressed layer), returning the path to the layout and the
+// descriptor of the manifest.
+func validateTestImage(t *testing.T, root string) (string, ispec.Descriptor) {
+	ctx := context.Background()
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	raw := []byte(strings.Repeat("umoci layer contents\n", 64))
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Config:    ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+		Layers:    []ispec.Descriptor{{MediaType: ispec.MediaTypeImageLayer, Digest: layerDigest, Size: layerSize}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+	if err := engineExt.UpdateReference(ctx, "latest", manifest); err != nil {
+		t.Fatal(err)
+	}
+	return image, manifest
+}
+
+// expectFindings validates the image and checks that the findings with the
+// given severity contain each of the given messages (in order).
+func expectFindings(t *testing.T, name, image string, severity Severity, messages ...string) *Report {
+	report, err := Layout(context.Background(), image)
+	if err != nil {
+		t.Fatalf("%s: unexpected error validating image: %+v", name, err)
+	}
+	var findings []Finding
+	for _, finding := range report.Findings {
+		if finding.Severity == severity {
+			findings = append(findings, finding)
+		}
+	}
+	if len(findings) != len(messages) {
+		t.Fatalf("%s: expected %d %s findings, got %v", name, len(messages), severity, report.Findings)
+	}
+	for idx, finding := range findings {
+		if !strings.Contains(finding.Message, messages[idx]) {
+			t.Errorf("%s: expected finding %d to contain %q, got %q", name, idx, messages[idx], finding.Message)
+		}
+	}
+	return report
+}
+
+func TestLayoutValid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayoutValid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, _ := validateTestImage(t, root)
+	report := expectFindings(t, "valid", image, SeverityError)
+	if !report.Valid() {
+		t.Errorf("expected image to be valid: %v", report.Findings)
+	}
+	if len(report.Findings) != 0 {
+		t.Errorf("expected no findings: %v", report.Findings)
+	}
+}
+
+func TestLayoutLayoutFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayoutLayoutFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, _ := validateTestImage(t, root)
+	layoutPath := filepath.Join(image, "oci-layout")
+
+	if err := ioutil.WriteFile(layoutPath, []byte(`{"imageLayoutVersion": "2.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := expectFindings(t, "bad version", image, SeverityError, "unsupported imageLayoutVersion")
+	if report.Valid() {
+		t.Errorf("expected image with bad version to be invalid")
+	}
+
+	if err := os.Remove(layoutPath); err != nil {
+		t.Fatal(err)
+	}
+	expectFindings(t, "missing", image, SeverityError, "cannot read oci-layout")
+
+	if err := ioutil.WriteFile(layoutPath, []byte(`{"imageLayoutVersion": "1.0.0", "extra": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectFindings(t, "unknown field", image, SeverityInfo, `field "extra"`)
+}
+
+func TestLayoutIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayoutIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, manifest := validateTestImage(t, root)
+	indexPath := filepath.Join(image, "index.json")
+
+	writeIndex := func(index string) {
+		if err := ioutil.WriteFile(indexPath, []byte(index), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	descriptor := func(mediaType string) string {
+		return `{"mediaType": "` + mediaType + `", "digest": "` + manifest.Digest.String() + `", "size": ` + strconv.FormatInt(manifest.Size, 10) + `}`
+	}
+
+	writeIndex(`{"schemaVersion": 1, "manifests": [` + descriptor(ispec.MediaTypeImageManifest) + `]}`)
+	expectFindings(t, "schemaVersion", image, SeverityError, "unsupported schemaVersion 1")
+
+	writeIndex(`{"schemaVersion": 2, "mediaType": "` + ispec.MediaTypeImageManifest + `", "manifests": [` + descriptor(ispec.MediaTypeImageManifest) + `]}`)
+	expectFindings(t, "mediaType", image, SeverityError, "does not match")
+
+	writeIndex(`{"schemaVersion": 2, "manifests": [` + descriptor("not a media type") + `]}`)
+	expectFindings(t, "malformed mediaType", image, SeverityError, "malformed mediaType")
+
+	writeIndex(`{"schemaVersion": 2, "manifests": [` + descriptor(casext.MediaTypeDockerManifest) + `]}`)
+	expectFindings(t, "docker mediaType", image, SeverityWarning, "non-OCI mediaType")
+}
+
+func TestLayoutBlobs(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestLayoutBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image, manifest := validateTestImage(t, root)
+	blobsPath := filepath.Join(image, "blobs", "sha256")
+
+	// Unreferenced blobs are reported, and their contents are checked.
+	unreferenced := digest.SHA256.FromString("unreferenced")
+	if err := ioutil.WriteFile(filepath.Join(blobsPath, unreferenced.Hex()), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectFindings(t, "unreferenced", image, SeverityInfo, "not referenced")
+	expectFindings(t, "unreferenced", image, SeverityError, "blob is corrupted")
+	if err := os.Remove(filepath.Join(blobsPath, unreferenced.Hex())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blobs must have valid names.
+	if err := ioutil.WriteFile(filepath.Join(blobsPath, "invalid"), []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectFindings(t, "invalid name", image, SeverityError, "invalid name")
+	if err := os.Remove(filepath.Join(blobsPath, "invalid")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing blobs are reported by casext.Verify.
+	if err := os.Remove(filepath.Join(blobsPath, manifest.Digest.Hex())); err != nil {
+		t.Fatal(err)
+	}
+	report := expectFindings(t, "missing", image, SeverityError, "blob is missing")
+	if finding := report.Findings[0]; finding.Path == nil || finding.Path.Descriptor().Digest != manifest.Digest {
+		t.Errorf("expected missing blob finding to have the path of the manifest: %v", finding)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package binmtree implements a binary encoding of mtree(8) manifests. Large
+// textual manifests are slow to generate and parse (each keyword has to be
+// formatted and re-tokenised), while the binary encoding stores the already
+// tokenised entries (compressed) and can be decoded in a single pass. The
+// decoded DirectoryHierarchy is equivalent to the one returned by
+// mtree.ParseSpec for the same manifest.
+package binmtree
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// Version is the version of the binary manifest format written by Encode.
+// Decode will refuse to decode manifests with a different version.
+const Version = 1
+
+// magic is the prefix of every binary manifest, which is followed by a single
+// version byte and then the gzip-compressed entries.
+var magic = []byte("umoci-binmtree\x00")
+
+// record is the encoded form of an mtree.Entry. The linkage between entries
+// (Parent, Set and so on) is not stored, and is instead reconstructed by
+// Decode from the order of the entries.
+type record struct {
+	Type     mtree.EntryType
+	Raw      string
+	Name     string
+	Keywords []mtree.KeyVal
+}
+
+// Encode writes the given DirectoryHierarchy to the writer in the binary
+// manifest format. As with DirectoryHierarchy.WriteTo, the entries are sorted
+// by their position.
+func Encode(w io.Writer, dh *mtree.DirectoryHierarchy) error {
+	entries := make([]mtree.Entry, len(dh.Entries))
+	copy(entries, dh.Entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Pos < entries[j].Pos
+	})
+
+	if _, err := w.Write(append(append([]byte{}, magic...), Version)); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	zw := gzip.NewWriter(w)
+	enc := gob.NewEncoder(zw)
+	if err := enc.Encode(len(entries)); err != nil {
+		return errors.Wrap(err, "encode entry count")
+	}
+	for _, e := range entries {
+		rec := record{
+			Type:     e.Type,
+			Raw:      e.Raw,
+			Name:     e.Name,
+			Keywords: e.Keywords,
+		}
+		if err := enc.Encode(rec); err != nil {
+			return errors.Wrapf(err, "encode entry %s", e.Name)
+		}
+	}
+	return errors.Wrap(zw.Close(), "close gzip writer")
+}
+
+// IsBinary returns whether the given manifest header (the first bytes of a
+// manifest) is the header of a binary manifest. At least len(magic) bytes are
+// needed to make a positive determination.
+func IsBinary(header []byte) bool {
+	return bytes.HasPrefix(header, magic)
+}
+
+// Decode reads a binary manifest (as written by Encode) from the reader, and
+// returns the DirectoryHierarchy it describes.
+func Decode(r io.Reader) (*mtree.DirectoryHierarchy, error) {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "read header")
+	}
+	if !IsBinary(header) {
+		return nil, errors.Errorf("not a binary manifest")
+	}
+	if version := header[len(magic)]; version != Version {
+		return nil, errors.Errorf("unsupported binary manifest version %d (expected %d)", version, Version)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "open gzip reader")
+	}
+	defer zr.Close()
+
+	dec := gob.NewDecoder(zr)
+	var count int
+	if err := dec.Decode(&count); err != nil {
+		return nil, errors.Wrap(err, "decode entry count")
+	}
+	if count < 0 {
+		return nil, errors.Errorf("invalid entry count %d", count)
+	}
+
+	// The entry count comes from the (untrusted) manifest, so we only use it
+	// as a hint for the initial allocation.
+	const maxPrealloc = 1 << 16
+	prealloc := count
+	if prealloc > maxPrealloc {
+		prealloc = maxPrealloc
+	}
+
+	dh := &mtree.DirectoryHierarchy{
+		Entries: make([]mtree.Entry, 0, prealloc),
+	}
+	for i := 0; i < count; i++ {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			return nil, errors.Wrapf(err, "decode entry %d", i)
+		}
+		dh.Entries = append(dh.Entries, mtree.Entry{
+			Pos:      i,
+			Type:     rec.Type,
+			Raw:      rec.Raw,
+			Name:     rec.Name,
+			Keywords: rec.Keywords,
+		})
+	}
+
+	// Reconstruct the parent directory and "/set" of each entry, in the same
+	// way as mtree.ParseSpec does. This has to be done after all entries have
+	// been decoded so that the pointers into dh.Entries remain valid.
+	var curDir, curSet *mtree.Entry
+	for i := range dh.Entries {
+		e := &dh.Entries[i]
+		switch e.Type {
+		case mtree.SpecialType:
+			switch e.Name {
+			case "/set":
+				curSet = e
+			case "/unset":
+				curSet = nil
+			}
+		case mtree.DotDotType:
+			if curDir != nil {
+				curDir = curDir.Parent
+			}
+		case mtree.RelativeType, mtree.FullType:
+			e.Parent = curDir
+			e.Set = curSet
+			for _, kv := range e.Keywords {
+				if kv.Keyword() == "type" && kv.Value() == "dir" {
+					curDir = e
+				}
+			}
+		}
+	}
+	return dh, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package binmtree
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestRoundTrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+
+	// Create a tree with some nesting (and some awkward names).
+	for _, path := range []string{"a/b/c", "a/d", "e f/g h"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path, "file"), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../a/d", filepath.Join(dir, "a", "b", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	dh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The textual manifest, which we compare against.
+	var text bytes.Buffer
+	if _, err := dh.WriteTo(&text); err != nil {
+		t.Fatal(err)
+	}
+	textDh, err := mtree.ParseSpec(bytes.NewReader(text.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bin bytes.Buffer
+	if err := Encode(&bin, dh); err != nil {
+		t.Fatalf("unexpected error encoding: %+v", err)
+	}
+	if !IsBinary(bin.Bytes()) {
+		t.Errorf("encoded manifest not detected as binary")
+	}
+	if IsBinary(text.Bytes()) {
+		t.Errorf("textual manifest detected as binary")
+	}
+	binDh, err := Decode(&bin)
+	if err != nil {
+		t.Fatalf("unexpected error decoding: %+v", err)
+	}
+
+	// Both manifests must describe the same tree.
+	diffs, err := mtree.Compare(textDh, binDh, keywords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("decoded manifest differs from textual manifest: %v", diffs)
+	}
+	var binText bytes.Buffer
+	if _, err := binDh.WriteTo(&binText); err != nil {
+		t.Fatal(err)
+	}
+	if binText.String() != text.String() {
+		t.Errorf("decoded manifest has different textual form:\n%s\nexpected:\n%s", binText.String(), text.String())
+	}
+
+	// And it must be usable to check the tree.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "d", "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = mtree.Check(dir, binDh, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Path() != "a/d/file" {
+		t.Errorf("unexpected diffs after modifying a/d/file: %v", diffs)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	var valid bytes.Buffer
+	if err := Encode(&valid, &mtree.DirectoryHierarchy{}); err != nil {
+		t.Fatal(err)
+	}
+
+	badVersion := append([]byte{}, valid.Bytes()...)
+	badVersion[len(magic)] = Version + 1
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Textual", []byte("#mtree v2.0\n")},
+		{"BadVersion", badVersion},
+		{"Truncated", valid.Bytes()[:len(magic)+3]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Decode(bytes.NewReader(test.data)); err == nil {
+				t.Errorf("expected error decoding invalid manifest")
+			}
+		})
+	}
+}
@@ -0,0 +1,450 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package estargz implements generation of eStargz layers, which are gzip
+// layers that can be lazily pulled by snapshotters such as the
+// stargz-snapshotter. An eStargz layer is a valid tar+gzip layer, where every
+// file (and every chunk of large files) is stored in a separate gzip member,
+// and a table of contents (TOC) describing the offsets of each entry is
+// appended to the layer together with a footer pointing to the TOC. See
+// <https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md>.
+package estargz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TOCTarName is the name of the tar entry containing the TOC.
+	TOCTarName = "stargz.index.json"
+
+	// PrefetchLandmark is the name of the landmark entry which separates the
+	// prioritised files (which should be prefetched) from the rest of the
+	// layer.
+	PrefetchLandmark = ".prefetch.landmark"
+
+	// NoPrefetchLandmark is the name of the landmark entry which indicates
+	// that no files in the layer should be prefetched.
+	NoPrefetchLandmark = ".no.prefetch.landmark"
+
+	// TOCDigestAnnotation is the layer descriptor annotation containing the
+	// digest of the TOC JSON.
+	TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// UncompressedSizeAnnotation is the layer descriptor annotation
+	// containing the size of the decompressed layer.
+	UncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+	// DefaultChunkSize is the default size of the chunks large files are
+	// split into.
+	DefaultChunkSize = 4 << 20
+
+	// landmarkContents is the contents of landmark files.
+	landmarkContents = 0xf
+
+	// footerSize is the size of the eStargz footer.
+	footerSize = 51
+)
+
+// TOC is the table of contents of an eStargz layer.
+type TOC struct {
+	// Version is the version of the TOC format (always 1).
+	Version int `json:"version"`
+
+	// Entries are the entries in the layer, in the order they appear.
+	Entries []*TOCEntry `json:"entries"`
+}
+
+// TOCEntry describes a single entry (or a chunk of a regular file) in an
+// eStargz layer.
+type TOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	NumLink     int               `json:"numLink,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+// Compressor is a mutate.Compressor which generates eStargz layers.
+type Compressor struct {
+	// ChunkSize is the size of the chunks large files are split into. If it
+	// is not positive, DefaultChunkSize is used.
+	ChunkSize int64
+}
+
+// MediaType implements mutate.Compressor. eStargz layers are valid gzip
+// layers.
+func (Compressor) MediaType() string {
+	return ispec.MediaTypeImageLayerGzip
+}
+
+// IsMetadataEntry returns whether the given tar entry name is one of the
+// entries added to eStargz layers (the TOC and landmarks), which must not be
+// extracted into the root filesystem.
+func IsMetadataEntry(name string) bool {
+	switch entryName(name) {
+	case TOCTarName, PrefetchLandmark, NoPrefetchLandmark:
+		return true
+	}
+	return false
+}
+
+// countWriter is an io.Writer which counts the number of bytes written.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// builder holds the state of an eStargz layer being generated.
+type builder struct {
+	// cw is the (counted) output of the compressed layer.
+	cw *countWriter
+
+	// gz is the current gzip member (nil if there is no open member).
+	gz *gzip.Writer
+
+	// diffID is the digester of the uncompressed layer.
+	diffID digest.Digester
+
+	// uncompressedSize is the size of the uncompressed layer.
+	uncompressedSize int64
+
+	// tw writes the uncompressed layer to the current gzip member.
+	tw *tar.Writer
+}
+
+// Write writes the uncompressed data to the current gzip member (which is
+// opened if necessary). This is the io.Writer used by builder.tw.
+func (b *builder) Write(p []byte) (int, error) {
+	if err := b.openGz(); err != nil {
+		return 0, err
+	}
+	n, err := b.gz.Write(p)
+	b.diffID.Hash().Write(p[:n])
+	b.uncompressedSize += int64(n)
+	return n, err
+}
+
+// openGz opens a new gzip member if there isn't one open already.
+func (b *builder) openGz() error {
+	if b.gz != nil {
+		return nil
+	}
+	gz, err := gzip.NewWriterLevel(b.cw, gzip.BestCompression)
+	if err != nil {
+		return errors.Wrap(err, "create gzip writer")
+	}
+	gz.Header = gzip.Header{OS: gz.Header.OS}
+	b.gz = gz
+	return nil
+}
+
+// newGz closes the current gzip member and returns the offset at which the
+// next gzip member will start. Callers must flush tw first if they want any
+// trailing padding of the previous entry to end up in the closed member.
+func (b *builder) newGz() (int64, error) {
+	if b.gz != nil {
+		if err := b.gz.Close(); err != nil {
+			return -1, errors.Wrap(err, "close gzip member")
+		}
+		b.gz = nil
+	}
+	return b.cw.n, nil
+}
+
+// entryName returns the name of a tar entry as stored in the TOC.
+func entryName(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// entryType returns the TOC type of the given tar entry type, or "" if the
+// type cannot be stored in an eStargz layer.
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "reg"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return ""
+}
+
+// addEntry adds the given tar entry (with its contents read from r) to the
+// layer, returning the TOC entries describing it.
+func (b *builder) addEntry(hdr *tar.Header, r io.Reader, chunkSize int64) ([]*TOCEntry, error) {
+	typ := entryType(hdr.Typeflag)
+	if typ == "" {
+		return nil, errors.Errorf("unsupported tar entry type %q: %s", hdr.Typeflag, hdr.Name)
+	}
+
+	entry := &TOCEntry{
+		Name:     entryName(hdr.Name),
+		Type:     typ,
+		LinkName: hdr.Linkname,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		DevMajor: hdr.Devmajor,
+		DevMinor: hdr.Devminor,
+	}
+	if !hdr.ModTime.IsZero() {
+		entry.ModTime3339 = hdr.ModTime.UTC().Format(time.RFC3339)
+	}
+	if typ == "hardlink" {
+		entry.LinkName = entryName(hdr.Linkname)
+	}
+	if len(hdr.Xattrs) > 0 {
+		entry.Xattrs = map[string][]byte{}
+		for name, value := range hdr.Xattrs {
+			entry.Xattrs[name] = []byte(value)
+		}
+	}
+
+	// Every entry starts in a new gzip member.
+	if err := b.tw.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush tar writer")
+	}
+	if _, err := b.newGz(); err != nil {
+		return nil, err
+	}
+
+	// Only regular files have contents. We don't support sparse files, so
+	// make sure the stdlib doesn't try to write the file as one.
+	hdr.Format = tar.FormatPAX
+	hdr.PAXRecords = nil
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return nil, errors.Wrap(err, "write tar header")
+	}
+	if typ != "reg" || hdr.Size == 0 {
+		return []*TOCEntry{entry}, nil
+	}
+	entry.Size = hdr.Size
+
+	// Each chunk of the file is stored in a separate gzip member, so that it
+	// can be fetched independently of the rest of the layer.
+	var (
+		entries        = []*TOCEntry{entry}
+		fileDigester   = cas.BlobAlgorithm.Digester()
+		chunkEntry     = entry
+		chunkOffset    int64
+		remainingBytes = hdr.Size
+	)
+	for remainingBytes > 0 {
+		size := chunkSize
+		if remainingBytes < size {
+			size = remainingBytes
+		}
+
+		offset, err := b.newGz()
+		if err != nil {
+			return nil, err
+		}
+		if chunkOffset > 0 {
+			chunkEntry = &TOCEntry{
+				Name: entry.Name,
+				Type: "chunk",
+			}
+			entries = append(entries, chunkEntry)
+		}
+		chunkEntry.Offset = offset
+		chunkEntry.ChunkOffset = chunkOffset
+		if size != hdr.Size {
+			chunkEntry.ChunkSize = size
+		}
+
+		chunkDigester := cas.BlobAlgorithm.Digester()
+		n, err := io.CopyN(io.MultiWriter(b.tw, fileDigester.Hash(), chunkDigester.Hash()), r, size)
+		if err != nil {
+			return nil, errors.Wrap(err, "copy file chunk")
+		}
+		chunkEntry.ChunkDigest = chunkDigester.Digest().String()
+
+		chunkOffset += n
+		remainingBytes -= n
+	}
+	entry.Digest = fileDigester.Digest().String()
+	return entries, nil
+}
+
+// footer returns the eStargz footer pointing to the TOC at the given offset.
+// The footer is an empty gzip member whose extra field contains the offset.
+// We build it by hand because the footer must be exactly footerSize bytes
+// long, and compress/flate doesn't guarantee how an empty stream is encoded.
+func footer(tocOffset int64) []byte {
+	payload := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	extra := append([]byte{'S', 'G', byte(len(payload)), 0}, payload...)
+
+	buf := []byte{
+		0x1f, 0x8b, // magic
+		0x08,       // CM = deflate
+		0x04,       // FLG = FEXTRA
+		0, 0, 0, 0, // MTIME
+		0x00, // XFL
+		0xff, // OS = unknown
+	}
+	buf = append(buf, byte(len(extra)), byte(len(extra)>>8))
+	buf = append(buf, extra...)
+	// An empty final stored deflate block.
+	buf = append(buf, 0x01, 0x00, 0x00, 0xff, 0xff)
+	// CRC32 and ISIZE of the (empty) uncompressed data.
+	buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	return buf
+}
+
+// Compress implements mutate.Compressor. It converts the uncompressed tar
+// layer read from r into an eStargz layer written to w.
+func (c Compressor) Compress(w io.Writer, r io.Reader) (digest.Digest, map[string]string, error) {
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	b := &builder{
+		cw:     &countWriter{w: w},
+		diffID: cas.BlobAlgorithm.Digester(),
+	}
+	b.tw = tar.NewWriter(b)
+
+	toc := TOC{Version: 1}
+
+	// We don't currently support prioritised files, so we always start the
+	// layer with a landmark indicating that nothing should be prefetched.
+	landmark := &tar.Header{
+		Name:     NoPrefetchLandmark,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     1,
+	}
+	entries, err := b.addEntry(landmark, strings.NewReader(string([]byte{landmarkContents})), chunkSize)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "add landmark")
+	}
+	toc.Entries = append(toc.Entries, entries...)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, errors.Wrap(err, "read next entry")
+		}
+		// The metadata of a layer which already is an eStargz layer is
+		// replaced, rather than being added again.
+		if IsMetadataEntry(hdr.Name) {
+			continue
+		}
+		entries, err := b.addEntry(hdr, tr, chunkSize)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "add entry %s", hdr.Name)
+		}
+		toc.Entries = append(toc.Entries, entries...)
+	}
+	// Consume any trailing padding after the end-of-archive marker, so that
+	// the writer of the layer isn't blocked.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", nil, errors.Wrap(err, "read trailing padding")
+	}
+
+	// The TOC is stored in its own gzip member, which is terminated with the
+	// end-of-archive marker of the tar stream.
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "marshal toc")
+	}
+	if err := b.tw.Flush(); err != nil {
+		return "", nil, errors.Wrap(err, "flush tar writer")
+	}
+	tocOffset, err := b.newGz()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:     TOCTarName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", nil, errors.Wrap(err, "write toc header")
+	}
+	if _, err := b.tw.Write(tocJSON); err != nil {
+		return "", nil, errors.Wrap(err, "write toc")
+	}
+	if err := b.tw.Close(); err != nil {
+		return "", nil, errors.Wrap(err, "close tar writer")
+	}
+	if _, err := b.newGz(); err != nil {
+		return "", nil, err
+	}
+
+	if _, err := b.cw.Write(footer(tocOffset)); err != nil {
+		return "", nil, errors.Wrap(err, "write footer")
+	}
+
+	annotations := map[string]string{
+		TOCDigestAnnotation:        cas.BlobAlgorithm.FromBytes(tocJSON).String(),
+		UncompressedSizeAnnotation: strconv.FormatInt(b.uncompressedSize, 10),
+	}
+	return b.diffID.Digest(), annotations, nil
+}
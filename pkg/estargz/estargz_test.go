@@ -0,0 +1,247 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+)
+
+type testEntry struct {
+	hdr      *tar.Header
+	contents []byte
+}
+
+func makeTar(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			t.Fatalf("write header %s: %v", entry.hdr.Name, err)
+		}
+		if _, err := tw.Write(entry.contents); err != nil {
+			t.Fatalf("write contents %s: %v", entry.hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompress(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	entries := []testEntry{
+		{hdr: &tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: &tar.Header{Name: "etc/small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, contents: []byte("hello")},
+		{hdr: &tar.Header{Name: "etc/large", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(large))}, contents: large},
+		{hdr: &tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "small"}},
+		{hdr: &tar.Header{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0644}},
+	}
+	layer := makeTar(t, entries)
+
+	var out bytes.Buffer
+	diffID, annotations, err := Compressor{ChunkSize: 4096}.Compress(&out, bytes.NewReader(layer))
+	if err != nil {
+		t.Fatalf("unexpected error compressing: %v", err)
+	}
+	blob := out.Bytes()
+
+	// The layer must be a valid tar+gzip layer, whose diffID matches.
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatalf("open gzip reader: %v", err)
+	}
+	uncompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("read layer: %v", err)
+	}
+	if got := cas.BlobAlgorithm.FromBytes(uncompressed); got != diffID {
+		t.Errorf("diffID mismatch: got %s expected %s", got, diffID)
+	}
+	if got := annotations[UncompressedSizeAnnotation]; got != strconv.Itoa(len(uncompressed)) {
+		t.Errorf("uncompressed size annotation mismatch: got %s expected %d", got, len(uncompressed))
+	}
+
+	var names []string
+	var tocJSON []byte
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("read next entry: %v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == TOCTarName {
+			tocJSON, _ = ioutil.ReadAll(tr)
+		}
+	}
+	expectedNames := []string{NoPrefetchLandmark}
+	for _, entry := range entries {
+		expectedNames = append(expectedNames, entry.hdr.Name)
+	}
+	expectedNames = append(expectedNames, TOCTarName)
+	if len(names) != len(expectedNames) {
+		t.Fatalf("entry mismatch: got %v expected %v", names, expectedNames)
+	}
+	for idx := range names {
+		if names[idx] != expectedNames[idx] {
+			t.Errorf("entry %d mismatch: got %s expected %s", idx, names[idx], expectedNames[idx])
+		}
+	}
+	if got := cas.BlobAlgorithm.FromBytes(tocJSON).String(); got != annotations[TOCDigestAnnotation] {
+		t.Errorf("toc digest annotation mismatch: got %s expected %s", annotations[TOCDigestAnnotation], got)
+	}
+
+	// The footer must point to the gzip member containing the TOC.
+	if got := len(footer(0)); got != footerSize {
+		t.Errorf("footer has unexpected size: got %d expected %d", got, footerSize)
+	}
+	if len(blob) < footerSize {
+		t.Fatalf("layer too small: %d", len(blob))
+	}
+	fgz, err := gzip.NewReader(bytes.NewReader(blob[len(blob)-footerSize:]))
+	if err != nil {
+		t.Fatalf("open footer: %v", err)
+	}
+	extra := fgz.Header.Extra
+	if len(extra) != 4+22 || extra[0] != 'S' || extra[1] != 'G' || string(extra[4+16:]) != "STARGZ" {
+		t.Fatalf("invalid footer extra field: %q", extra)
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[4:4+16]), 16, 64)
+	if err != nil {
+		t.Fatalf("parse toc offset: %v", err)
+	}
+	tgz, err := gzip.NewReader(bytes.NewReader(blob[tocOffset:]))
+	if err != nil {
+		t.Fatalf("open toc member: %v", err)
+	}
+	tr = tar.NewReader(tgz)
+	if hdr, err := tr.Next(); err != nil || hdr.Name != TOCTarName {
+		t.Fatalf("toc member does not start with toc: %v %v", hdr, err)
+	}
+
+	var toc TOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		t.Fatalf("unmarshal toc: %v", err)
+	}
+	if toc.Version != 1 {
+		t.Errorf("unexpected toc version: %d", toc.Version)
+	}
+
+	// Every chunk must be independently decompressable from its offset.
+	var chunks int
+	for _, entry := range toc.Entries {
+		if entry.Type != "reg" && entry.Type != "chunk" {
+			continue
+		}
+		if entry.Type == "reg" && entry.Size == 0 {
+			continue
+		}
+		if entry.Name == "etc/large" {
+			chunks++
+		}
+		size := entry.ChunkSize
+		if size == 0 {
+			size = entry.Size
+		}
+		cgz, err := gzip.NewReader(bytes.NewReader(blob[entry.Offset:]))
+		if err != nil {
+			t.Errorf("open chunk %s@%d: %v", entry.Name, entry.ChunkOffset, err)
+			continue
+		}
+		// Only the chunk itself is read -- any trailing tar padding is part
+		// of the same gzip member.
+		cgz.Multistream(false)
+		data := make([]byte, size)
+		if _, err := io.ReadFull(cgz, data); err != nil {
+			t.Errorf("read chunk %s@%d: %v", entry.Name, entry.ChunkOffset, err)
+			continue
+		}
+		if got := cas.BlobAlgorithm.FromBytes(data).String(); got != entry.ChunkDigest {
+			t.Errorf("chunk %s@%d digest mismatch: got %s expected %s", entry.Name, entry.ChunkOffset, got, entry.ChunkDigest)
+		}
+	}
+	if expected := (len(large) + 4095) / 4096; chunks != expected {
+		t.Errorf("unexpected number of chunks for large file: got %d expected %d", chunks, expected)
+	}
+}
+
+func TestCompressEstargz(t *testing.T) {
+	layer := makeTar(t, []testEntry{
+		{hdr: &tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: &tar.Header{Name: "etc/small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, contents: []byte("hello")},
+	})
+
+	var first bytes.Buffer
+	diffID, _, err := Compressor{}.Compress(&first, bytes.NewReader(layer))
+	if err != nil {
+		t.Fatalf("unexpected error compressing: %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatalf("open gzip reader: %v", err)
+	}
+	uncompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("read layer: %v", err)
+	}
+
+	// Compressing an eStargz layer again must replace its metadata, resulting
+	// in the same layer.
+	var second bytes.Buffer
+	secondDiffID, _, err := Compressor{}.Compress(&second, bytes.NewReader(uncompressed))
+	if err != nil {
+		t.Fatalf("unexpected error compressing eStargz layer: %v", err)
+	}
+	if secondDiffID != diffID {
+		t.Errorf("diffID mismatch: got %s expected %s", secondDiffID, diffID)
+	}
+	if !bytes.Equal(second.Bytes(), first.Bytes()) {
+		t.Errorf("compressing an eStargz layer again changed the layer")
+	}
+}
+
+func TestIsMetadataEntry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		metadata bool
+	}{
+		{TOCTarName, true},
+		{"./" + TOCTarName, true},
+		{"/" + NoPrefetchLandmark, true},
+		{PrefetchLandmark, true},
+		{"etc/" + TOCTarName, false},
+		{"etc/passwd", false},
+		{".", false},
+	} {
+		if got := IsMetadataEntry(test.name); got != test.metadata {
+			t.Errorf("IsMetadataEntry(%q): got %v expected %v", test.name, got, test.metadata)
+		}
+	}
+}
@@ -87,6 +87,11 @@ func (fs osFsEval) Chmod(path string, mode os.FileMode) error {
 	return os.Chmod(path, mode)
 }
 
+// Lchown is equivalent to os.Lchown.
+func (fs osFsEval) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to os.Lutimes.
 func (fs osFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return system.Lutimes(path, atime, mtime)
@@ -0,0 +1,424 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fseval
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/sys/unix"
+)
+
+// ErrInRootUnsupported is returned by NewInRootFsEval if the kernel does not
+// support openat2(2) (or /proc is not mounted).
+var ErrInRootUnsupported = errors.New("openat2(RESOLVE_IN_ROOT) is not supported")
+
+// InRootFsEval is an FsEval implementation which confines all operations to
+// a root directory, with the containment being enforced by the kernel rather
+// than by lexical path sanitisation. Every path must be inside the root, and
+// the parent directory of each path is resolved with openat2(2) and
+// RESOLVE_IN_ROOT (so symlinks are resolved as though the root was the
+// filesystem root, even if the directory tree is being modified concurrently).
+// The operation is then done on the final component relative to that
+// directory, which is never followed if it is a symlink.
+//
+// Operations which do not accept a directory file descriptor go through
+// /proc/self/fd/<dirfd>, so /proc must be mounted. Note that unlike the other
+// FsEval implementations, Open and Create do not follow symlinks in the final
+// component of the path.
+type InRootFsEval struct {
+	root   string
+	rootFd *os.File
+}
+
+// NewInRootFsEval creates a new InRootFsEval for the given root, which must
+// exist. If openat2(2) is not supported, ErrInRootUnsupported is returned.
+// The returned InRootFsEval must be closed by the caller.
+func NewInRootFsEval(root string) (*InRootFsEval, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "get absolute root")
+	}
+	rootFd, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "open root")
+	}
+	fs := &InRootFsEval{
+		root:   root,
+		rootFd: rootFd,
+	}
+
+	// Check that openat2(2) and /proc/self/fd both work.
+	dirFd, err := fs.openat2(".", unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		fs.Close()
+		if pathErr, ok := err.(*os.PathError); ok && (pathErr.Err == unix.ENOSYS || pathErr.Err == unix.EPERM) {
+			return nil, ErrInRootUnsupported
+		}
+		return nil, errors.Wrap(err, "open root with openat2")
+	}
+	defer unix.Close(dirFd)
+	if _, err := os.Stat(procFdPath(dirFd)); err != nil {
+		fs.Close()
+		return nil, ErrInRootUnsupported
+	}
+	return fs, nil
+}
+
+// Close releases the reference to the root directory.
+func (fs *InRootFsEval) Close() error {
+	return fs.rootFd.Close()
+}
+
+func procFdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// openat2 opens the given path (relative to the root) with RESOLVE_IN_ROOT.
+func (fs *InRootFsEval) openat2(path string, flags uint64) (int, error) {
+	return system.Openat2(int(fs.rootFd.Fd()), path, &system.OpenHow{
+		Flags:   flags | unix.O_CLOEXEC,
+		Resolve: system.ResolveInRoot | system.ResolveNoMagiclinks,
+	})
+}
+
+// rel returns the path relative to the root, or an error if the path is not
+// inside the root.
+func (fs *InRootFsEval) rel(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrap(err, "get absolute path")
+	}
+	rel, err := filepath.Rel(fs.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("path %s is outside of root %s", path, fs.root)
+	}
+	return rel, nil
+}
+
+// resolveAt resolves the parent directory of the given path inside the root,
+// and returns a file descriptor for it along with the final component of the
+// path. The returned function must be called once the file descriptor is no
+// longer being used.
+func (fs *InRootFsEval) resolveAt(path string) (int, string, func(), error) {
+	rel, err := fs.rel(path)
+	if err != nil {
+		return -1, "", nil, err
+	}
+	// The root itself was chosen by the caller, so it can be used directly.
+	if rel == "." {
+		return unix.AT_FDCWD, fs.root, func() {}, nil
+	}
+	dir, file := filepath.Split(rel)
+	if dir == "" {
+		dir = "."
+	}
+	dirFd, err := fs.openat2(dir, unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return -1, "", nil, err
+	}
+	return dirFd, file, func() { unix.Close(dirFd) }, nil
+}
+
+// resolve is like resolveAt, except that it returns a path which refers to
+// the final component of path through the parent directory's file descriptor.
+func (fs *InRootFsEval) resolve(path string) (string, func(), error) {
+	dirFd, file, release, err := fs.resolveAt(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if dirFd == unix.AT_FDCWD {
+		return file, release, nil
+	}
+	return filepath.Join(procFdPath(dirFd), file), release, nil
+}
+
+// Open is equivalent to os.Open, except that symlinks are not followed.
+func (fs *InRootFsEval) Open(path string) (*os.File, error) {
+	return fs.openFile(path, unix.O_RDONLY, 0)
+}
+
+// Create is equivalent to os.Create, except that symlinks are not followed.
+func (fs *InRootFsEval) Create(path string) (*os.File, error) {
+	return fs.openFile(path, unix.O_RDWR|unix.O_CREAT|unix.O_TRUNC, 0666)
+}
+
+// openFd opens the given path (without following symlinks in the final
+// component) and returns the file descriptor.
+func (fs *InRootFsEval) openFd(path string, flags int, perm os.FileMode) (int, error) {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return -1, err
+	}
+	defer release()
+	fd, err := unix.Open(p, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm))
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return fd, nil
+}
+
+func (fs *InRootFsEval) openFile(path string, flags int, perm os.FileMode) (*os.File, error) {
+	fd, err := fs.openFd(path, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Readdir is equivalent to os.Readdir, except that symlinks are not followed.
+func (fs *InRootFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	fd, err := fs.openFd(path, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// The children are lstat(2)ed relative to the name of the directory, so
+	// it has to refer to the file descriptor.
+	dh := os.NewFile(uintptr(fd), procFdPath(fd))
+	defer dh.Close()
+	return dh.Readdir(-1)
+}
+
+// Lstat is equivalent to os.Lstat.
+func (fs *InRootFsEval) Lstat(path string) (os.FileInfo, error) {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return os.Lstat(p)
+}
+
+// Lstatx is equivalent to unix.Lstat.
+func (fs *InRootFsEval) Lstatx(path string) (unix.Stat_t, error) {
+	var s unix.Stat_t
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return s, err
+	}
+	defer release()
+	err = unix.Lstat(p, &s)
+	return s, err
+}
+
+// Readlink is equivalent to os.Readlink.
+func (fs *InRootFsEval) Readlink(path string) (string, error) {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return os.Readlink(p)
+}
+
+// Symlink is equivalent to os.Symlink.
+func (fs *InRootFsEval) Symlink(linkname, path string) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return os.Symlink(linkname, p)
+}
+
+// Link is equivalent to os.Link. Both paths must be inside the root.
+func (fs *InRootFsEval) Link(linkname, path string) error {
+	l, releaseLink, err := fs.resolve(linkname)
+	if err != nil {
+		return err
+	}
+	defer releaseLink()
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return os.Link(l, p)
+}
+
+// Chmod is equivalent to os.Chmod, except that symlinks are not followed (and
+// changing the mode of a symlink is an error).
+func (fs *InRootFsEval) Chmod(path string, mode os.FileMode) error {
+	fh, err := fs.openFile(path, unix.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var st unix.Stat_t
+	if err := unix.Fstat(int(fh.Fd()), &st); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return &os.PathError{Op: "chmod", Path: path, Err: unix.ELOOP}
+	}
+	return os.Chmod(procFdPath(int(fh.Fd())), mode)
+}
+
+// Lchown is equivalent to os.Lchown.
+func (fs *InRootFsEval) Lchown(path string, uid, gid int) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return os.Lchown(p, uid, gid)
+}
+
+// Lutimes is equivalent to system.Lutimes.
+func (fs *InRootFsEval) Lutimes(path string, atime, mtime time.Time) error {
+	dirFd, file, release, err := fs.resolveAt(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return system.Lutimesat(dirFd, file, atime, mtime)
+}
+
+// Remove is equivalent to os.Remove.
+func (fs *InRootFsEval) Remove(path string) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return os.Remove(p)
+}
+
+// RemoveAll is equivalent to os.RemoveAll.
+func (fs *InRootFsEval) RemoveAll(path string) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		// As with os.RemoveAll, a path which doesn't exist (because its
+		// parent doesn't exist) is not an error.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer release()
+	return os.RemoveAll(p)
+}
+
+// Mkdir is equivalent to os.Mkdir.
+func (fs *InRootFsEval) Mkdir(path string, perm os.FileMode) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return os.Mkdir(p, perm)
+}
+
+// MkdirAll is equivalent to os.MkdirAll. Each component of the path is
+// resolved inside the root.
+func (fs *InRootFsEval) MkdirAll(path string, perm os.FileMode) error {
+	rel, err := fs.rel(path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		subpath := filepath.Join(parts[:i+1]...)
+		dirFd, err := fs.openat2(subpath, unix.O_PATH|unix.O_DIRECTORY)
+		if err == nil {
+			unix.Close(dirFd)
+			continue
+		}
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != unix.ENOENT {
+			return err
+		}
+		if err := fs.Mkdir(filepath.Join(fs.root, subpath), perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mknod is equivalent to system.Mknod.
+func (fs *InRootFsEval) Mknod(path string, mode os.FileMode, dev system.Dev_t) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return system.Mknod(p, mode, dev)
+}
+
+// Llistxattr is equivalent to system.Llistxattr
+func (fs *InRootFsEval) Llistxattr(path string) ([]string, error) {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return system.Llistxattr(p)
+}
+
+// Lremovexattr is equivalent to system.Lremovexattr
+func (fs *InRootFsEval) Lremovexattr(path, name string) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return DefaultFsEval.Lremovexattr(p, name)
+}
+
+// Lsetxattr is equivalent to system.Lsetxattr
+func (fs *InRootFsEval) Lsetxattr(path, name string, value []byte, flags int) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return DefaultFsEval.Lsetxattr(p, name, value, flags)
+}
+
+// Lgetxattr is equivalent to system.Lgetxattr
+func (fs *InRootFsEval) Lgetxattr(path string, name string) ([]byte, error) {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return system.Lgetxattr(p, name)
+}
+
+// Lclearxattrs is equivalent to system.Lclearxattrs
+func (fs *InRootFsEval) Lclearxattrs(path string) error {
+	p, release, err := fs.resolve(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return system.Lclearxattrs(p)
+}
+
+// KeywordFunc returns a wrapper around the given mtree.KeywordFunc.
+func (fs *InRootFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	return fn
+}
@@ -82,6 +82,11 @@ func (fs unprivFsEval) Chmod(path string, mode os.FileMode) error {
 	return unpriv.Chmod(path, mode)
 }
 
+// Lchown is equivalent to unpriv.Lchown.
+func (fs unprivFsEval) Lchown(path string, uid, gid int) error {
+	return unpriv.Lchown(path, uid, gid)
+}
+
 // Lutimes is equivalent to unpriv.Lutimes.
 func (fs unprivFsEval) Lutimes(path string, atime, mtime time.Time) error {
 	return unpriv.Lutimes(path, atime, mtime)
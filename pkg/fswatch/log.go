@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fswatch implements change tracking of a directory tree using
+// inotify(7), so that the set of changed paths can be used to compute the
+// filesystem delta without walking (and hashing) the entire tree.
+package fswatch
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// Record is a single entry in a watch log.
+type Record struct {
+	// Path is the path (relative to the watched root) which was changed.
+	Path string `json:"path,omitempty"`
+
+	// Recursive indicates that the entire tree under Path may have changed.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Incomplete indicates that some changes could not be recorded (such as
+	// when events were lost), and so the log cannot be used to compute the
+	// set of changes.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Log is the set of changes recorded in a watch log.
+type Log struct {
+	// Incomplete is set if some changes could not be recorded.
+	Incomplete bool
+
+	paths     map[string]bool
+	recursive map[string]bool
+	parents   map[string]bool
+}
+
+// cleanPath converts a path to be relative to the root of the watched tree.
+func cleanPath(path string) string {
+	path, _ = filepath.Rel("/", filepath.Join("/", path))
+	return path
+}
+
+// NewLog creates an empty Log.
+func NewLog() *Log {
+	return &Log{
+		paths:     map[string]bool{},
+		recursive: map[string]bool{},
+		parents:   map[string]bool{".": true},
+	}
+}
+
+// Add adds a record to the log.
+func (l *Log) Add(record Record) {
+	if record.Incomplete {
+		l.Incomplete = true
+		return
+	}
+
+	path := cleanPath(record.Path)
+	if record.Recursive {
+		l.recursive[path] = true
+	} else {
+		l.paths[path] = true
+	}
+	for dir := filepath.Dir(path); !l.parents[dir]; dir = filepath.Dir(dir) {
+		l.parents[dir] = true
+	}
+}
+
+// ReadLog reads a watch log (a stream of JSON-encoded Records, as written by
+// Watcher).
+func ReadLog(r io.Reader) (*Log, error) {
+	l := NewLog()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var record Record
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "decode watch log record")
+		}
+		l.Add(record)
+	}
+	return l, nil
+}
+
+// Contains returns whether the given path (relative to the watched root) may
+// have been changed according to the log. The parent directories of changed
+// paths are also considered to be changed. This can be used as a
+// mtreefilter.FilterFunc.
+func (l *Log) Contains(path string) bool {
+	path = cleanPath(path)
+	if l.paths[path] || l.parents[path] {
+		return true
+	}
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if l.recursive[dir] {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// filterFsEval is an mtree.FsEval which hides all paths which are not
+// contained in a Log from Readdir, so that mtree.Walk only walks them.
+type filterFsEval struct {
+	mtree.FsEval
+	root string
+	log  *Log
+}
+
+// Readdir is equivalent to mtree.FsEval.Readdir, but only returns paths which
+// are contained in the log.
+func (fs filterFsEval) Readdir(path string) ([]os.FileInfo, error) {
+	infos, err := fs.FsEval.Readdir(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(fs.root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []os.FileInfo
+	for _, info := range infos {
+		if fs.log.Contains(filepath.Join(rel, info.Name())) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered, nil
+}
+
+// Check is equivalent to mtree.Check, except that only the paths contained in
+// the log are walked and compared (all other paths are assumed to be
+// unchanged). This avoids walking the entire tree, which is significantly
+// faster for large trees with few changes.
+func Check(root string, dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fsEval mtree.FsEval, l *Log) ([]mtree.InodeDelta, error) {
+	if l.Incomplete {
+		return nil, errors.Errorf("watch log is incomplete")
+	}
+	if keywords == nil {
+		keywords = dh.UsedKeywords()
+	}
+	if fsEval == nil {
+		fsEval = mtree.DefaultFsEval{}
+	}
+
+	root = filepath.Clean(root)
+	newDh, err := mtree.Walk(root, nil, keywords, filterFsEval{
+		FsEval: fsEval,
+		root:   root,
+		log:    l,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk changed paths")
+	}
+	diffs, err := mtree.Compare(dh, newDh, keywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compare changed paths")
+	}
+
+	// Paths which weren't walked will show up as missing.
+	var filtered []mtree.InodeDelta
+	for _, diff := range diffs {
+		if l.Contains(diff.Path()) {
+			filtered = append(filtered, diff)
+		}
+	}
+	return filtered, nil
+}
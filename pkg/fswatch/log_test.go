@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fswatch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/go-mtree"
+)
+
+func TestLogContains(t *testing.T) {
+	l, err := ReadLog(strings.NewReader(`{"path":"etc/passwd"}
+{"path":"/usr/lib/","recursive":true}
+{"path":"var/log/messages"}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	if l.Incomplete {
+		t.Errorf("log was unexpectedly incomplete")
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected bool
+	}{
+		{".", true},
+		{"/", true},
+		{"etc", true},
+		{"etc/passwd", true},
+		{"/etc/passwd", true},
+		{"etc/group", false},
+		{"etc/passwd/child", false},
+		{"usr", true},
+		{"usr/bin", false},
+		{"usr/lib", true},
+		{"usr/lib/libc.so", true},
+		{"usr/lib/deep/nested/path", true},
+		{"usr/lib64", false},
+		{"var/log", true},
+		{"var/lib", false},
+		{"home", false},
+	} {
+		if got := l.Contains(test.path); got != test.expected {
+			t.Errorf("Contains(%q): expected %v, got %v", test.path, test.expected, got)
+		}
+	}
+}
+
+func TestReadLogIncomplete(t *testing.T) {
+	l, err := ReadLog(strings.NewReader(`{"path":"etc/passwd"}
+{"incomplete":true}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	if !l.Incomplete {
+		t.Errorf("log should be incomplete")
+	}
+	if _, err := Check(".", &mtree.DirectoryHierarchy{}, nil, nil, l); err == nil {
+		t.Errorf("expected Check to fail with an incomplete log")
+	}
+
+	if _, err := ReadLog(strings.NewReader(`{"path":`)); err == nil {
+		t.Errorf("expected error reading invalid log")
+	}
+}
+
+// deltaPaths returns the sorted set of "<type> <path>" strings for a set of
+// deltas.
+func deltaPaths(deltas []mtree.InodeDelta) []string {
+	var paths []string
+	for _, delta := range deltas {
+		paths = append(paths, string(delta.Type())+" "+delta.Path())
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{"a/file", "a/other", "b/c/file", "d/file"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keywords := append(mtree.DefaultKeywords, "sha256digest")
+	dh, err := mtree.Walk(root, nil, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make some changes, and record them.
+	l := NewLog()
+	if err := ioutil.WriteFile(filepath.Join(root, "a/file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(Record{Path: "a/file"})
+	if err := os.RemoveAll(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(Record{Path: "b", Recursive: true})
+	l.Add(Record{Path: "."})
+	if err := os.MkdirAll(filepath.Join(root, "e/f"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "e/f/file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(Record{Path: "e", Recursive: true})
+
+	got, err := Check(root, dh, keywords, nil, l)
+	if err != nil {
+		t.Fatalf("unexpected error in Check: %v", err)
+	}
+	expected, err := mtree.Check(root, dh, keywords, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotPaths, expectedPaths := deltaPaths(got), deltaPaths(expected)
+	if strings.Join(gotPaths, "\n") != strings.Join(expectedPaths, "\n") {
+		t.Errorf("unexpected deltas:\n got: %v\n expected: %v", gotPaths, expectedPaths)
+	}
+}
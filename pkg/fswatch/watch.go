@@ -0,0 +1,306 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fswatch
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// watchMask is the set of inotify events which indicate that a path inside a
+// watched directory was changed.
+const watchMask = unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+	unix.IN_DELETE | unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// eventBufferSize is the size of the buffer used to read inotify events, which
+// is large enough for several events with the longest possible name.
+const eventBufferSize = 64 * (unix.SizeofInotifyEvent + unix.NAME_MAX + 1)
+
+// Watcher records changes to a directory tree using inotify(7), writing a
+// Record to the log for each changed path. Directories created inside the
+// tree are watched automatically. If a directory cannot be watched, it is
+// recorded as recursively changed (so the log is still correct).
+type Watcher struct {
+	root string
+	fd   int
+	file *os.File
+
+	// changed is signalled (without blocking) whenever events are handled.
+	changed chan struct{}
+
+	// lock protects the fields below.
+	lock    sync.Mutex
+	enc     *json.Encoder
+	seen    map[Record]bool
+	watches map[int]string
+	closed  bool
+}
+
+// NewWatcher creates a new Watcher for the given root, which writes the log
+// to w. All of the directories in the tree are watched before NewWatcher
+// returns, so any changes made after it returns will be recorded once Run is
+// called.
+func NewWatcher(root string, w io.Writer) (*Watcher, error) {
+	// The inotify instance is non-blocking so that it can use the runtime
+	// poller, which allows Close to interrupt a blocked Run.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(os.NewSyscallError("inotify_init1", err), "create inotify instance")
+	}
+
+	watcher := &Watcher{
+		root:    filepath.Clean(root),
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changed: make(chan struct{}, 1),
+		enc:     json.NewEncoder(w),
+		seen:    map[Record]bool{},
+		watches: map[int]string{},
+	}
+	if err := watcher.addWatches("."); err != nil {
+		watcher.file.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// record writes the record to the log, if it hasn't already been written.
+func (w *Watcher) record(record Record) error {
+	if w.seen[record] {
+		return nil
+	}
+	w.seen[record] = true
+
+	log.Debugf("fswatch: recording change: %#v", record)
+	return errors.Wrap(w.enc.Encode(record), "write watch log record")
+}
+
+// addWatches adds a watch for every directory in the tree under the given
+// path (relative to the root).
+func (w *Watcher) addWatches(path string) error {
+	return filepath.Walk(filepath.Join(w.root, path), func(fullPath string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(w.root, fullPath)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			// The path was removed before we could watch it, which will be
+			// recorded by its parent.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			log.Warnf("fswatch: cannot walk %s (recording it as changed): %v", rel, err)
+			return w.record(Record{Path: rel, Recursive: true})
+		}
+		if !info.IsDir() {
+			// Changes to a hardlinked file also change its other paths, so we
+			// always have to check them.
+			if isHardlink(info) {
+				return w.record(Record{Path: rel})
+			}
+			return nil
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, fullPath, watchMask)
+		if err != nil {
+			log.Warnf("fswatch: cannot watch %s (recording it as changed): %v", rel, err)
+			if err := w.record(Record{Path: rel, Recursive: true}); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		w.watches[wd] = rel
+		return nil
+	})
+}
+
+// isHardlink returns whether the given path is a regular file with more than
+// one link.
+func isHardlink(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && st.Nlink > 1
+}
+
+// removeWatches removes the watches for every directory in the tree under
+// the given path (relative to the root).
+func (w *Watcher) removeWatches(path string) {
+	for wd, dir := range w.watches {
+		if dir == path || strings.HasPrefix(dir, path+"/") {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+// handleEvent records the changes indicated by a single inotify event.
+func (w *Watcher) handleEvent(wd int, mask uint32, name string) error {
+	if mask&unix.IN_Q_OVERFLOW == unix.IN_Q_OVERFLOW {
+		log.Warnf("fswatch: inotify queue overflowed, watch log is incomplete")
+		return w.record(Record{Incomplete: true})
+	}
+
+	dir, ok := w.watches[wd]
+	if !ok {
+		return nil
+	}
+	if mask&unix.IN_IGNORED == unix.IN_IGNORED {
+		delete(w.watches, wd)
+		return nil
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&unix.IN_ISDIR == unix.IN_ISDIR
+	switch {
+	case isDir && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		// The new directory might have been populated before we added the
+		// watches, so we have to treat its entire contents as changed.
+		if err := w.record(Record{Path: path, Recursive: true}); err != nil {
+			return err
+		}
+		if err := w.addWatches(path); err != nil {
+			return err
+		}
+	case isDir && mask&unix.IN_MOVED_FROM != 0:
+		// The contents of the directory vanished without any events.
+		w.removeWatches(path)
+		if err := w.record(Record{Path: path, Recursive: true}); err != nil {
+			return err
+		}
+	default:
+		if err := w.record(Record{Path: path}); err != nil {
+			return err
+		}
+		// If a new hardlink to an existing file was created, we can't know
+		// the other paths of the file (which would be changed by any later
+		// modifications of the file).
+		if mask&unix.IN_CREATE != 0 {
+			if info, err := os.Lstat(filepath.Join(w.root, path)); err == nil && isHardlink(info) {
+				log.Warnf("fswatch: hardlink %s was created, watch log is incomplete", path)
+				if err := w.record(Record{Incomplete: true}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Creating or removing a path also modifies its parent directory.
+	if name != "" && mask&(unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+		return w.record(Record{Path: dir})
+	}
+	return nil
+}
+
+// Changed returns a channel which receives a value whenever changes to the
+// tree are seen (after they have been recorded in the log). Changes which are
+// seen while a previous value is still pending are coalesced, and changes to
+// paths which were already recorded are still signalled, so this can be used
+// to wait for the tree to stop changing.
+func (w *Watcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// handleEvents records the changes indicated by a buffer of inotify events.
+func (w *Watcher) handleEvents(buf []byte) error {
+	if len(buf) > 0 {
+		defer func() {
+			select {
+			case w.changed <- struct{}{}:
+			default:
+			}
+		}()
+	}
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+		name := strings.TrimRight(string(nameBytes), "\x00")
+		if err := w.handleEvent(int(event.Wd), event.Mask, name); err != nil {
+			return err
+		}
+		offset += unix.SizeofInotifyEvent + int(event.Len)
+	}
+	return nil
+}
+
+// Run reads inotify events and records them in the log, until the Watcher is
+// closed or an error occurs.
+func (w *Watcher) Run() error {
+	buf := make([]byte, eventBufferSize)
+	for {
+		n, err := w.file.Read(buf)
+
+		// Even if we were closed while reading, the events we read still
+		// need to be recorded.
+		w.lock.Lock()
+		closed := w.closed
+		if err == nil {
+			err = w.handleEvents(buf[:n])
+		} else if closed {
+			err = nil
+		} else {
+			err = errors.Wrap(err, "read inotify events")
+		}
+		w.lock.Unlock()
+		if err != nil || closed {
+			return err
+		}
+	}
+}
+
+// Close stops the Watcher. Any pending events are recorded before the
+// inotify instance is closed.
+func (w *Watcher) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.file.Close()
+
+	// Drain any events which haven't been read by Run yet. The inotify
+	// instance is non-blocking, so we get EAGAIN once there are none left.
+	buf := make([]byte, eventBufferSize)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || (err == nil && n == 0) {
+			break
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(os.NewSyscallError("read", err), "drain inotify events")
+		}
+		if err := w.handleEvents(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
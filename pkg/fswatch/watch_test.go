@@ -0,0 +1,193 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fswatch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWatcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{"a/file", "a/unchanged", "b/c/file", "d/linked", "unchanged/file"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(root, "d/linked"), filepath.Join(root, "unchanged/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	watcher, err := NewWatcher(root, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error creating watcher: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.Run()
+	}()
+
+	// Make some changes.
+	if err := ioutil.WriteFile(filepath.Join(root, "a/file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "b"), filepath.Join(root, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "new/dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "new/dir/file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "moved/c/file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Any pending events are recorded by Close.
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("unexpected error closing watcher: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+
+	l, err := ReadLog(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	if l.Incomplete {
+		t.Errorf("log was unexpectedly incomplete")
+	}
+
+	for _, test := range []struct {
+		path     string
+		expected bool
+	}{
+		{"a/file", true},
+		{"a/unchanged", false},
+		{"b/c/file", true},
+		{"moved/c/file", true},
+		{"new/dir/file", true},
+		{"unchanged/file", false},
+		// Hardlinks are always recorded.
+		{"d/linked", true},
+		{"unchanged/link", true},
+	} {
+		if got := l.Contains(test.path); got != test.expected {
+			t.Errorf("Contains(%q): expected %v, got %v", test.path, test.expected, got)
+		}
+	}
+}
+
+func TestWatcherNewHardlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWatcherNewHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	watcher, err := NewWatcher(root, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error creating watcher: %v", err)
+	}
+
+	// We can't track the other paths of a new hardlink.
+	if err := os.Link(filepath.Join(root, "file"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("unexpected error closing watcher: %v", err)
+	}
+
+	l, err := ReadLog(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	if !l.Incomplete {
+		t.Errorf("log should be incomplete after creating a hardlink")
+	}
+}
+
+func TestWatcherChanged(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWatcherChanged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var buf bytes.Buffer
+	watcher, err := NewWatcher(root, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error creating watcher: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.Run()
+	}()
+
+	select {
+	case <-watcher.Changed():
+		t.Errorf("unexpected change signalled before any changes")
+	default:
+	}
+
+	// Changes to the same path are signalled each time, even though they are
+	// only recorded once.
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-watcher.Changed():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("change %d was not signalled", i)
+		}
+		// Drain any signals from the remaining events of the write.
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-watcher.Changed():
+		default:
+		}
+	}
+
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("unexpected error closing watcher: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+}
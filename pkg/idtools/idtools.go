@@ -25,6 +25,32 @@ import (
 	"github.com/pkg/errors"
 )
 
+// inRange returns whether id is inside the range of size IDs starting at
+// first. The arithmetic is done with 64-bit integers, so that ranges which end
+// at the largest ID don't overflow.
+func inRange(id int, first, size uint32) bool {
+	return id >= 0 && uint64(id) >= uint64(first) && uint64(id) < uint64(first)+uint64(size)
+}
+
+// maxInt is the largest ID which can be stored in an int, which is smaller
+// than the largest ID on 32-bit architectures.
+const maxInt = uint64(^uint(0) >> 1)
+
+// toInt converts an ID to an int, returning an error if it doesn't fit (which
+// is only possible on 32-bit architectures).
+func toInt(id uint32) (int, error) {
+	if uint64(id) > maxInt {
+		return -1, errors.Errorf("id %d is too large for this architecture", id)
+	}
+	return int(id), nil
+}
+
+// rangesOverlap returns whether the ranges of IDs starting at first1 and
+// first2 (of size1 and size2 IDs respectively) overlap.
+func rangesOverlap(first1, first2, size1, size2 uint32) bool {
+	return uint64(first1) < uint64(first2)+uint64(size2) && uint64(first2) < uint64(first1)+uint64(size1)
+}
+
 // ToHost translates a remapped container ID to an unmapped host ID using the
 // provided ID mapping. If no mapping is provided, then the mapping is a no-op.
 // If there is no mapping for the given ID an error is returned.
@@ -34,8 +60,9 @@ func ToHost(contID int, idMap []rspec.LinuxIDMapping) (int, error) {
 	}
 
 	for _, m := range idMap {
-		if uint32(contID) >= m.ContainerID && uint32(contID) < m.ContainerID+m.Size {
-			return int(m.HostID + (uint32(contID) - m.ContainerID)), nil
+		if inRange(contID, m.ContainerID, m.Size) {
+			hostID, err := toInt(m.HostID + (uint32(contID) - m.ContainerID))
+			return hostID, errors.Wrapf(err, "map container id %d", contID)
 		}
 	}
 
@@ -52,8 +79,9 @@ func ToContainer(hostID int, idMap []rspec.LinuxIDMapping) (int, error) {
 	}
 
 	for _, m := range idMap {
-		if uint32(hostID) >= m.HostID && uint32(hostID) < m.HostID+m.Size {
-			return int(m.ContainerID + (uint32(hostID) - m.HostID)), nil
+		if inRange(hostID, m.HostID, m.Size) {
+			contID, err := toInt(m.ContainerID + (uint32(hostID) - m.HostID))
+			return contID, errors.Wrapf(err, "map host id %d", hostID)
 		}
 	}
 
@@ -67,10 +95,10 @@ func ParseMapping(spec string) (rspec.LinuxIDMapping, error) {
 	parts := strings.Split(spec, ":")
 
 	var err error
-	var hostID, contID, size int
+	var hostID, contID, size uint64
 	switch len(parts) {
 	case 3:
-		size, err = strconv.Atoi(parts[2])
+		size, err = strconv.ParseUint(parts[2], 10, 32)
 		if err != nil {
 			return rspec.LinuxIDMapping{}, errors.Wrap(err, "invalid size in mapping")
 		}
@@ -80,12 +108,12 @@ func ParseMapping(spec string) (rspec.LinuxIDMapping, error) {
 		return rspec.LinuxIDMapping{}, errors.Errorf("invalid number of fields in mapping '%s': %d", spec, len(parts))
 	}
 
-	contID, err = strconv.Atoi(parts[0])
+	contID, err = strconv.ParseUint(parts[0], 10, 32)
 	if err != nil {
 		return rspec.LinuxIDMapping{}, errors.Wrap(err, "invalid containerID in mapping")
 	}
 
-	hostID, err = strconv.Atoi(parts[1])
+	hostID, err = strconv.ParseUint(parts[1], 10, 32)
 	if err != nil {
 		return rspec.LinuxIDMapping{}, errors.Wrap(err, "invalid hostID in mapping")
 	}
@@ -96,3 +124,43 @@ func ParseMapping(spec string) (rspec.LinuxIDMapping, error) {
 		Size:        uint32(size),
 	}, nil
 }
+
+// ParseMappings takes a comma-separated list of mapping strings (each of the
+// form accepted by ParseMapping) and returns the corresponding set of
+// rspec.LinuxIDMappings.
+func ParseMappings(spec string) ([]rspec.LinuxIDMapping, error) {
+	var idMap []rspec.LinuxIDMapping
+	for _, part := range strings.Split(spec, ",") {
+		m, err := ParseMapping(part)
+		if err != nil {
+			return nil, err
+		}
+		idMap = append(idMap, m)
+	}
+	return idMap, nil
+}
+
+// ValidateMappings checks that the given set of mappings is valid, using the
+// same rules as the kernel does for user namespace mappings. Every mapping
+// must be non-empty and must not extend beyond the largest ID, and no two
+// mappings may overlap (in either the container or host ID ranges) because
+// then an ID could be mapped in more than one way.
+func ValidateMappings(idMap []rspec.LinuxIDMapping) error {
+	for i, m := range idMap {
+		if m.Size == 0 {
+			return errors.Errorf("mapping %d:%d:%d is empty", m.ContainerID, m.HostID, m.Size)
+		}
+		if uint64(m.ContainerID)+uint64(m.Size) > 1<<32 || uint64(m.HostID)+uint64(m.Size) > 1<<32 {
+			return errors.Errorf("mapping %d:%d:%d is out of range", m.ContainerID, m.HostID, m.Size)
+		}
+		for _, other := range idMap[:i] {
+			if rangesOverlap(m.ContainerID, other.ContainerID, m.Size, other.Size) {
+				return errors.Errorf("mapping %d:%d:%d overlaps container ids of %d:%d:%d", m.ContainerID, m.HostID, m.Size, other.ContainerID, other.HostID, other.Size)
+			}
+			if rangesOverlap(m.HostID, other.HostID, m.Size, other.Size) {
+				return errors.Errorf("mapping %d:%d:%d overlaps host ids of %d:%d:%d", m.ContainerID, m.HostID, m.Size, other.ContainerID, other.HostID, other.Size)
+			}
+		}
+	}
+	return nil
+}
@@ -18,6 +18,7 @@
 package idtools
 
 import (
+	"reflect"
 	"testing"
 
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
@@ -331,3 +332,130 @@ func TestParseIDMapping(t *testing.T) {
 	}
 
 }
+
+func TestToHostFullRange(t *testing.T) {
+	idMap := []rspec.LinuxIDMapping{
+		{
+			HostID:      0,
+			ContainerID: 0,
+			Size:        4294967295,
+		},
+	}
+
+	// The largest IDs can't be stored in an int on 32-bit architectures.
+	ids := []int{0, 1000}
+	if largest := uint32(4294967294); uint64(largest) <= maxInt {
+		ids = append(ids, int(largest))
+	}
+	for _, id := range ids {
+		if got, err := ToHost(id, idMap); err != nil {
+			t.Errorf("unexpected error mapping %d: %+v", id, err)
+		} else if got != id {
+			t.Errorf("expected to get %d, got %d", id, got)
+		}
+		if got, err := ToContainer(id, idMap); err != nil {
+			t.Errorf("unexpected error mapping %d: %+v", id, err)
+		} else if got != id {
+			t.Errorf("expected to get %d, got %d", id, got)
+		}
+	}
+	if id, err := ToHost(-1, idMap); err == nil {
+		t.Errorf("expected an error with container=-1, got %d", id)
+	}
+}
+
+// TestMappedIDOverflow checks that mapping to an ID which doesn't fit in an
+// int (which is only possible on 32-bit architectures) is an error rather than
+// resulting in a negative ID.
+func TestMappedIDOverflow(t *testing.T) {
+	for _, id := range []uint32{1 << 31, 4294967294} {
+		fits := uint64(id) <= maxInt
+
+		toHostMap := []rspec.LinuxIDMapping{{HostID: id, ContainerID: 0, Size: 1}}
+		got, err := ToHost(0, toHostMap)
+		if fits && (err != nil || uint64(got) != uint64(id)) {
+			t.Errorf("expected ToHost to map 0 to %d, got %d (err=%v)", id, got, err)
+		} else if !fits && err == nil {
+			t.Errorf("expected ToHost to fail mapping 0 to %d, got %d", id, got)
+		}
+
+		toContainerMap := []rspec.LinuxIDMapping{{HostID: 0, ContainerID: id, Size: 1}}
+		got, err = ToContainer(0, toContainerMap)
+		if fits && (err != nil || uint64(got) != uint64(id)) {
+			t.Errorf("expected ToContainer to map 0 to %d, got %d (err=%v)", id, got, err)
+		} else if !fits && err == nil {
+			t.Errorf("expected ToContainer to fail mapping 0 to %d, got %d", id, got)
+		}
+	}
+}
+
+func TestParseIDMappings(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected []rspec.LinuxIDMapping
+		failure  bool
+	}{
+		{spec: "0:100000:65534", expected: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65534}}},
+		{spec: "0:100000:65534,65534:65534", expected: []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 65534},
+			{ContainerID: 65534, HostID: 65534, Size: 1},
+		}},
+		{spec: "0:1000,1:100000:65536,65537:2000:10", expected: []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 1000, Size: 1},
+			{ContainerID: 1, HostID: 100000, Size: 65536},
+			{ContainerID: 65537, HostID: 2000, Size: 10},
+		}},
+		{spec: "", failure: true},
+		{spec: "0:1000,", failure: true},
+		{spec: "0:1000,in:va:lid", failure: true},
+		{spec: "-1:1000", failure: true},
+		{spec: "0:4294967296", failure: true},
+	} {
+		idMap, err := ParseMappings(test.spec)
+		if test.failure {
+			if err == nil {
+				t.Errorf("expected an error with spec %q -- got %+v", test.spec, idMap)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %+v", test.spec, err)
+		} else if !reflect.DeepEqual(idMap, test.expected) {
+			t.Errorf("%q: expected to get %+v, got %+v", test.spec, test.expected, idMap)
+		}
+	}
+}
+
+func TestValidateMappings(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		idMap   []rspec.LinuxIDMapping
+		failure bool
+	}{
+		{"Empty", nil, false},
+		{"Single", []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}, false},
+		{"Multiple", []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 65534},
+			{ContainerID: 65534, HostID: 65534, Size: 1},
+			{ContainerID: 65535, HostID: 165535, Size: 1},
+		}, false},
+		{"FullRange", []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 0, Size: 4294967295}}, false},
+		{"ZeroSize", []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 0}}, true},
+		{"Overflow", []rspec.LinuxIDMapping{{ContainerID: 4294967295, HostID: 1000, Size: 2}}, true},
+		{"ContainerOverlap", []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 65536},
+			{ContainerID: 65534, HostID: 65534, Size: 1},
+		}, true},
+		{"HostOverlap", []rspec.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 10},
+			{ContainerID: 100, HostID: 100009, Size: 10},
+		}, true},
+	} {
+		err := ValidateMappings(test.idMap)
+		if test.failure && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		} else if !test.failure && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.name, err)
+		}
+	}
+}
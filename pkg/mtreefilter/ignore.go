@@ -0,0 +1,164 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// ignorePattern is a single parsed pattern from an ignore file.
+type ignorePattern struct {
+	// pattern is the original pattern.
+	pattern string
+
+	// negate is whether the pattern re-includes paths (it started with "!").
+	negate bool
+
+	// parts are the path components of the pattern. A "**" component matches
+	// any number of path components.
+	parts []string
+}
+
+// matchParts returns whether the path components match the pattern
+// components exactly.
+func matchParts(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for idx := 0; idx <= len(path); idx++ {
+			if matchParts(pattern[1:], path[idx:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	// The pattern was already validated by IgnoreFilter.
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchParts(pattern[1:], path[1:])
+}
+
+// match returns whether the pattern matches the path (which has been split
+// into components) or any of its parent directories.
+func (p ignorePattern) match(path []string) bool {
+	for idx := 1; idx <= len(path); idx++ {
+		if matchParts(p.parts, path[:idx]) {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreFilter is a factory for FilterFuncs that will ignore all InodeDelta
+// paths matched by the given set of ignore patterns. The patterns use similar
+// semantics to .gitignore and .dockerignore files:
+//
+//  * Each pattern is a filepath.Match pattern, where "**" matches any number
+//    of path components. Patterns are relative to '/'.
+//  * A pattern which doesn't contain a "/" (other than a trailing one)
+//    matches the name of a path at any depth.
+//  * If a pattern matches a directory, every path inside it is also matched.
+//  * A pattern starting with "!" re-includes paths matched by earlier
+//    patterns, and the last pattern matching a path decides whether it is
+//    ignored.
+//  * Empty patterns and patterns starting with "#" are ignored.
+func IgnoreFilter(patterns []string) (FilterFunc, error) {
+	var parsed []ignorePattern
+	for _, pattern := range patterns {
+		p := ignorePattern{pattern: pattern}
+
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			p.negate = true
+			pattern = pattern[1:]
+		}
+
+		// Patterns without any slashes (other than a trailing one) match at
+		// any depth.
+		anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+		pattern = strings.TrimPrefix(filepath.Clean("/"+pattern), "/")
+		if pattern == "" {
+			return nil, errors.Errorf("invalid ignore pattern %q: matches the root", p.pattern)
+		}
+		if !anchored {
+			pattern = "**/" + pattern
+		}
+
+		p.parts = strings.Split(pattern, "/")
+		for _, part := range p.parts {
+			if _, err := filepath.Match(part, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid ignore pattern %q", p.pattern)
+			}
+		}
+		parsed = append(parsed, p)
+	}
+
+	return func(path string) bool {
+		// Convert the path to be cleaned and relative-to-root.
+		path = strings.TrimPrefix(filepath.Join("/", path), "/")
+		if path == "" {
+			return true
+		}
+		parts := strings.Split(path, "/")
+
+		// The last matching pattern wins.
+		var match *ignorePattern
+		for idx := range parsed {
+			if parsed[idx].match(parts) {
+				match = &parsed[idx]
+			}
+		}
+		if match != nil && !match.negate {
+			log.Debugf("ignorefilter: ignoring path %q matched by pattern %q", path, match.pattern)
+			return false
+		}
+		return true
+	}, nil
+}
+
+// ParseIgnoreFile reads the set of ignore patterns (one per line) from the
+// given ignore file, in the format accepted by IgnoreFilter.
+func ParseIgnoreFile(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read ignore file")
+	}
+	return patterns, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreFilter(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		path     string
+		included bool
+	}{
+		{nil, "/a", true},
+		{[]string{"tmp"}, "/tmp", false},
+		{[]string{"tmp"}, "/tmp/file", false},
+		{[]string{"tmp"}, "/var/tmp/file", false},
+		{[]string{"tmp"}, "/tmpfile", true},
+		{[]string{"/tmp"}, "/var/tmp", true},
+		{[]string{"/tmp/"}, "/tmp/a/b", false},
+		{[]string{"tmp/"}, "/var/tmp/a", false},
+		{[]string{"*.swp"}, "/etc/.passwd.swp", false},
+		{[]string{"*.swp"}, "/etc/passwd", true},
+		{[]string{"*~"}, "/src/main.c~", false},
+		{[]string{"*~"}, "/src/main.c", true},
+		{[]string{"/var/cache/*"}, "/var/cache/apt/archives/foo.deb", false},
+		{[]string{"/var/cache/*"}, "/var/cache", true},
+		{[]string{"/root/**/__pycache__"}, "/root/__pycache__/x.pyc", false},
+		{[]string{"/root/**/__pycache__"}, "/root/a/b/__pycache__/x.pyc", false},
+		{[]string{"/root/**/__pycache__"}, "/usr/__pycache__/x.pyc", true},
+		{[]string{"/build", "!/build/keep"}, "/build/drop", false},
+		{[]string{"/build", "!/build/keep"}, "/build/keep", true},
+		{[]string{"/build", "!/build/keep"}, "/build/keep/child", true},
+		{[]string{"!/build/keep", "/build"}, "/build/keep", false},
+		{[]string{"# comment", "", "/tmp"}, "/tmp", false},
+		{[]string{"/tmp"}, "/", true},
+		{[]string{"tmp"}, "tmp/relative", false},
+	} {
+		filter, err := IgnoreFilter(test.patterns)
+		if err != nil {
+			t.Errorf("unexpected error parsing %v: %v", test.patterns, err)
+			continue
+		}
+		if got := filter(test.path); got != test.included {
+			t.Errorf("IgnoreFilter(%v)(%q): got %v expected %v", test.patterns, test.path, got, test.included)
+		}
+	}
+}
+
+func TestIgnoreFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"/",
+		"!/",
+		"/a/[",
+	} {
+		if _, err := IgnoreFilter([]string{pattern}); err == nil {
+			t.Errorf("expected error parsing %q", pattern)
+		}
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	patterns, err := ParseIgnoreFile(strings.NewReader(`# Build caches.
+/root/.cache
+
+  *.swp  
+!/important.swp
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"/root/.cache", "*.swp", "!/important.swp"}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("got %v expected %v", patterns, expected)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultWorkers is the default number of concurrent workers, which is the
+// number of CPUs available to the process.
+func DefaultWorkers() int {
+	return runtime.NumCPU()
+}
+
+// Do calls fn for each index in [0, n), running up to workers calls
+// concurrently. If workers is not greater than one, fn is called
+// sequentially. The first error returned by fn is returned, after all of the
+// running calls have finished (no new calls are started after an error).
+func Do(n, workers int, fn func(idx int) error) error {
+	if workers <= 1 {
+		for idx := 0; idx < n; idx++ {
+			if err := fn(idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		slots    = make(chan struct{}, workers)
+	)
+	for idx := 0; idx < n; idx++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fn(idx); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(idx)
+	}
+	wg.Wait()
+	return firstErr
+}
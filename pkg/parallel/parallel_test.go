@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package parallel
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	for _, workers := range []int{0, 1, 4} {
+		var (
+			mu   sync.Mutex
+			seen = map[int]int{}
+		)
+		if err := Do(20, workers, func(idx int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[idx]++
+			return nil
+		}); err != nil {
+			t.Errorf("workers=%d: unexpected error: %v", workers, err)
+		}
+		for idx := 0; idx < 20; idx++ {
+			if seen[idx] != 1 {
+				t.Errorf("workers=%d: fn called %d times for index %d", workers, seen[idx], idx)
+			}
+		}
+	}
+}
+
+func TestDoConcurrency(t *testing.T) {
+	const workers = 3
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+	)
+	if err := Do(30, workers, func(idx int) error {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxSeen > workers {
+		t.Errorf("more than %d calls ran concurrently: %d", workers, maxSeen)
+	}
+}
+
+func TestDoError(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		expected := errors.New("failed")
+		var (
+			mu    sync.Mutex
+			calls int
+		)
+		err := Do(100, workers, func(idx int) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			if idx == 2 {
+				return expected
+			}
+			return nil
+		})
+		if err != expected {
+			t.Errorf("workers=%d: expected error %v, got %v", workers, expected, err)
+		}
+		// When run sequentially, no calls are made after the error.
+		if workers == 1 && calls != 3 {
+			t.Errorf("workers=%d: expected 3 calls, got %d", workers, calls)
+		}
+	}
+}
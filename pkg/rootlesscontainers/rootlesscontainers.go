@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rootlesscontainers implements the user.rootlesscontainers xattr
+// format, which is used by PRoot and other rootless container tools to record
+// the intended owner of a path which (because it was created without
+// privileges) is actually owned by the unprivileged user. The xattr value is a
+// serialised protobuf message, described in
+// <https://github.com/rootless-containers/proto>:
+//
+//	message Resource {
+//	  uint32 uid = 1;
+//	  uint32 gid = 2;
+//	}
+//
+// The message is simple enough that we encode it by hand, rather than
+// depending on a protobuf library.
+package rootlesscontainers
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	// Keyname is the name of the xattr containing the serialised Resource.
+	Keyname = "user.rootlesscontainers"
+
+	// NoopID is the special ID value which indicates that the ID of the path
+	// on the filesystem should be used as-is.
+	NoopID uint32 = ^uint32(0)
+)
+
+// Protobuf wire types, see
+// <https://developers.google.com/protocol-buffers/docs/encoding>.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field numbers of the Resource message.
+const (
+	fieldUID = 1
+	fieldGID = 2
+)
+
+// Resource is the intended owner of a path.
+type Resource struct {
+	// UID is the intended owner, or NoopID.
+	UID uint32
+
+	// GID is the intended group, or NoopID.
+	GID uint32
+}
+
+// appendVarint appends the protobuf varint encoding of v to buf.
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// readVarint decodes the protobuf varint at the start of buf, returning the
+// value and the number of bytes consumed.
+func readVarint(buf []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		v |= uint64(buf[i]&0x7f) << (7 * uint(i))
+		if buf[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.Errorf("invalid varint")
+}
+
+// Marshal returns the serialised form of the resource, suitable for storing
+// in the Keyname xattr. As in proto3, fields set to zero are omitted.
+func Marshal(r Resource) []byte {
+	var buf []byte
+	if r.UID != 0 {
+		buf = appendVarint(buf, fieldUID<<3|wireVarint)
+		buf = appendVarint(buf, uint64(r.UID))
+	}
+	if r.GID != 0 {
+		buf = appendVarint(buf, fieldGID<<3|wireVarint)
+		buf = appendVarint(buf, uint64(r.GID))
+	}
+	return buf
+}
+
+// Unmarshal parses the serialised form of a resource (as stored in the Keyname
+// xattr). Unknown fields are ignored, and missing fields are zero.
+func Unmarshal(buf []byte) (Resource, error) {
+	var r Resource
+	for len(buf) > 0 {
+		key, n, err := readVarint(buf)
+		if err != nil {
+			return Resource{}, errors.Wrap(err, "read field key")
+		}
+		buf = buf[n:]
+
+		var value uint64
+		switch wireType := key & 0x7; wireType {
+		case wireVarint:
+			value, n, err = readVarint(buf)
+			if err != nil {
+				return Resource{}, errors.Wrapf(err, "read field %d", key>>3)
+			}
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		case wireBytes:
+			var length uint64
+			length, n, err = readVarint(buf)
+			if err != nil {
+				return Resource{}, errors.Wrapf(err, "read field %d length", key>>3)
+			}
+			if length > uint64(len(buf)-n) {
+				return Resource{}, errors.Errorf("field %d is truncated", key>>3)
+			}
+			n += int(length)
+		default:
+			return Resource{}, errors.Errorf("field %d has unsupported wire type %d", key>>3, wireType)
+		}
+		if n > len(buf) {
+			return Resource{}, errors.Errorf("field %d is truncated", key>>3)
+		}
+		buf = buf[n:]
+
+		// Varint fields of type uint32 are truncated when decoded.
+		if key&0x7 == wireVarint {
+			switch key >> 3 {
+			case fieldUID:
+				r.UID = uint32(value)
+			case fieldGID:
+				r.GID = uint32(value)
+			}
+		}
+	}
+	return r, nil
+}
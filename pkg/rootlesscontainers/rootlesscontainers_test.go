@@ -0,0 +1,82 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rootlesscontainers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	for _, test := range []struct {
+		resource Resource
+		expected []byte
+	}{
+		{Resource{}, nil},
+		{Resource{UID: 1000}, []byte{0x08, 0xe8, 0x07}},
+		{Resource{GID: 100}, []byte{0x10, 0x64}},
+		{Resource{UID: 1, GID: 2}, []byte{0x08, 0x01, 0x10, 0x02}},
+		{Resource{UID: NoopID, GID: 5}, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x10, 0x05}},
+	} {
+		got := Marshal(test.resource)
+		if !bytes.Equal(got, test.expected) {
+			t.Errorf("Marshal(%+v): expected %x, got %x", test.resource, test.expected, got)
+		}
+
+		parsed, err := Unmarshal(got)
+		if err != nil {
+			t.Errorf("Unmarshal(%x): unexpected error: %v", got, err)
+			continue
+		}
+		if parsed != test.resource {
+			t.Errorf("Unmarshal(%x): expected %+v, got %+v", got, test.resource, parsed)
+		}
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	buf := []byte{
+		0x18, 0x2a, // field 3 (varint)
+		0x08, 0x07, // uid
+		0x22, 0x02, 'h', 'i', // field 4 (bytes)
+		0x2d, 0x01, 0x02, 0x03, 0x04, // field 5 (fixed32)
+		0x31, 0, 0, 0, 0, 0, 0, 0, 0, // field 6 (fixed64)
+		0x10, 0x09, // gid
+	}
+	r, err := Unmarshal(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (Resource{UID: 7, GID: 9}); r != expected {
+		t.Errorf("expected %+v, got %+v", expected, r)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for _, buf := range [][]byte{
+		{0x08},
+		{0x08, 0xff},
+		{0x22, 0x05, 'h', 'i'},
+		{0x2d, 0x01},
+		{0x0b},
+	} {
+		if r, err := Unmarshal(buf); err == nil {
+			t.Errorf("Unmarshal(%x): expected error, got %+v", buf, r)
+		}
+	}
+}
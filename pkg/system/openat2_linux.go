@@ -0,0 +1,75 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From uapi/linux/openat2.h.
+const (
+	ResolveNoXdev       = 0x01
+	ResolveNoMagiclinks = 0x02
+	ResolveNoSymlinks   = 0x04
+	ResolveBeneath      = 0x08
+	ResolveInRoot       = 0x10
+)
+
+// The syscall number of openat2(2) is the same on all architectures.
+const _SYS_OPENAT2 = 437
+
+// OpenHow is the argument structure of openat2(2).
+type OpenHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// Openat2 is a wrapper around openat2(2), which was added in Linux 5.6. Errors
+// are returned as an *os.PathError (if the kernel doesn't support openat2(2),
+// its Err is unix.ENOSYS). Lookups which fail with EAGAIN (because of a
+// concurrent rename, when using ResolveInRoot or ResolveBeneath) are retried a
+// few times.
+func Openat2(dirfd int, path string, how *OpenHow) (int, error) {
+	pathPtr, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, &os.PathError{Op: "openat2", Path: path, Err: err}
+	}
+
+	var errno syscall.Errno
+	for i := 0; i < 32; i++ {
+		fd, _, e := unix.Syscall6(_SYS_OPENAT2, // int openat2(
+			uintptr(dirfd),                   // int dirfd,
+			uintptr(unsafe.Pointer(pathPtr)), // const char *pathname,
+			uintptr(unsafe.Pointer(how)),     // struct open_how *how,
+			unsafe.Sizeof(*how),              // size_t size);
+			0, 0)
+		if e == 0 {
+			return int(fd), nil
+		}
+		errno = e
+		if errno != unix.EAGAIN && errno != unix.EINTR {
+			break
+		}
+	}
+	return -1, &os.PathError{Op: "openat2", Path: path, Err: errno}
+}
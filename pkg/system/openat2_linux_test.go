@@ -0,0 +1,83 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenat2InRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestOpenat2InRoot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/a", filepath.Join(dir, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../../..", filepath.Join(dir, "a", "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	rootFd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(rootFd)
+
+	for _, test := range []struct {
+		path, expected string
+	}{
+		{".", "."},
+		{"a/b", "a/b"},
+		{"abs/b", "a/b"},
+		{"../../a", "a"},
+		{"a/up", "."},
+		{"a/up/abs/b/../..", "."},
+	} {
+		fd, err := Openat2(rootFd, test.path, &OpenHow{
+			Flags:   unix.O_PATH | unix.O_CLOEXEC,
+			Resolve: ResolveInRoot,
+		})
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == unix.ENOSYS {
+				t.Skip("openat2 not supported")
+			}
+			t.Errorf("%s: unexpected error: %v", test.path, err)
+			continue
+		}
+		got, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		unix.Close(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := filepath.Join(dir, test.expected); got != expected {
+			t.Errorf("%s: resolved to %s, expected %s", test.path, got, expected)
+		}
+	}
+}
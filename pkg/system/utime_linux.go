@@ -20,6 +20,7 @@ package system
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -31,10 +32,6 @@ import (
 // set, to allow changing the time of a symlink rather than the file it points
 // to.
 func Lutimes(path string, atime, mtime time.Time) error {
-	var times [2]unix.Timespec
-	times[0] = unix.NsecToTimespec(atime.UnixNano())
-	times[1] = unix.NsecToTimespec(mtime.UnixNano())
-
 	// Split up the path.
 	dir, file := filepath.Split(path)
 	dir = filepath.Clean(dir)
@@ -47,15 +44,32 @@ func Lutimes(path string, atime, mtime time.Time) error {
 	}
 	defer dirFile.Close()
 
+	if errno := lutimesat(int(dirFile.Fd()), file, atime, mtime); errno != 0 {
+		return &os.PathError{Op: "lutimes", Path: path, Err: errno}
+	}
+	return nil
+}
+
+// Lutimesat is equivalent to Lutimes, except that path is resolved relative
+// to the directory referred to by dirfd.
+func Lutimesat(dirfd int, path string, atime, mtime time.Time) error {
+	if errno := lutimesat(dirfd, path, atime, mtime); errno != 0 {
+		return &os.PathError{Op: "lutimesat", Path: path, Err: errno}
+	}
+	return nil
+}
+
+func lutimesat(dirfd int, path string, atime, mtime time.Time) syscall.Errno {
+	var times [2]unix.Timespec
+	times[0] = unix.NsecToTimespec(atime.UnixNano())
+	times[1] = unix.NsecToTimespec(mtime.UnixNano())
+
 	// The interface for this is really, really silly.
 	_, _, errno := unix.RawSyscall6(unix.SYS_UTIMENSAT, // int utimensat(
-		uintptr(dirFile.Fd()),              // int dirfd,
-		uintptr(assertPtrFromString(file)), // char *pathname,
+		uintptr(dirfd),                     // int dirfd,
+		uintptr(assertPtrFromString(path)), // char *pathname,
 		uintptr(unsafe.Pointer(&times[0])), // struct timespec times[2],
 		uintptr(_AT_SYMLINK_NOFOLLOW),      // int flags);
 		0, 0)
-	if errno != 0 {
-		return &os.PathError{Op: "lutimes", Path: path, Err: errno}
-	}
-	return nil
+	return errno
 }
@@ -0,0 +1,127 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package xattrfilter implements policies which decide which extended
+// attributes are included when generating image layers and which are restored
+// when extracting image layers.
+package xattrfilter
+
+import (
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// rule is a single entry in a Filter.
+type rule struct {
+	// allow is whether xattrs matching this rule are permitted.
+	allow bool
+
+	// pattern is either an exact xattr name, or a prefix if it ends with "*".
+	pattern string
+}
+
+// matches returns whether the xattr name is matched by the rule.
+func (r rule) matches(name string) bool {
+	if strings.HasSuffix(r.pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(r.pattern, "*"))
+	}
+	return name == r.pattern
+}
+
+// String returns the textual representation of the rule, which can be parsed
+// by Parse.
+func (r rule) String() string {
+	if r.allow {
+		return "+" + r.pattern
+	}
+	return "-" + r.pattern
+}
+
+// Filter is an ordered set of allow and deny rules for xattr names. The last
+// rule which matches a given xattr name decides whether it is allowed, and
+// xattrs which don't match any rule are allowed.
+type Filter struct {
+	rules []rule
+}
+
+// DefaultRules is the set of rules used if no policy has been specified. This
+// drops security.selinux because SELinux labels are host-specific (and
+// setting them generically is not permitted by most policies).
+var DefaultRules = []string{"-security.selinux"}
+
+// Default returns the default Filter (described by DefaultRules).
+func Default() Filter {
+	filter, err := Parse(DefaultRules)
+	if err != nil {
+		// Should _never_ be reached.
+		log.Fatalf("[internal error] default xattr rules are invalid: %v", err)
+	}
+	return filter
+}
+
+// Parse parses a set of rules into a Filter. Each rule is of the form
+// "[+-]pattern", where "+" allows and "-" denies xattrs matching the pattern.
+// The pattern is either an exact xattr name ("security.capability") or a
+// prefix ending with "*" ("user.*"). A bare "*" matches every xattr.
+func Parse(specs []string) (Filter, error) {
+	var filter Filter
+	for _, spec := range specs {
+		if len(spec) < 2 {
+			return Filter{}, errors.Errorf("invalid xattr rule %q: must be of the form [+-]pattern", spec)
+		}
+
+		var r rule
+		switch spec[0] {
+		case '+':
+			r.allow = true
+		case '-':
+			r.allow = false
+		default:
+			return Filter{}, errors.Errorf("invalid xattr rule %q: must start with '+' or '-'", spec)
+		}
+		r.pattern = spec[1:]
+		if strings.Contains(strings.TrimSuffix(r.pattern, "*"), "*") {
+			return Filter{}, errors.Errorf("invalid xattr rule %q: '*' is only permitted at the end of a pattern", spec)
+		}
+		filter.rules = append(filter.rules, r)
+	}
+	return filter, nil
+}
+
+// Allowed returns whether the xattr with the given name is permitted by the
+// filter.
+func (f Filter) Allowed(name string) bool {
+	allowed := true
+	for _, r := range f.rules {
+		if r.matches(name) {
+			allowed = r.allow
+		}
+	}
+	return allowed
+}
+
+// Rules returns the textual representation of the filter, such that
+// Parse(f.Rules()) is equivalent to f.
+func (f Filter) Rules() []string {
+	var specs []string
+	for _, r := range f.rules {
+		specs = append(specs, r.String())
+	}
+	return specs
+}
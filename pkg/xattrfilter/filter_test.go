@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2017 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xattrfilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterAllowed(t *testing.T) {
+	for _, test := range []struct {
+		rules   []string
+		name    string
+		allowed bool
+	}{
+		{nil, "user.foo", true},
+		{[]string{"-user.*"}, "user.foo", false},
+		{[]string{"-user.*"}, "user", true},
+		{[]string{"-user.*"}, "trusted.foo", true},
+		{[]string{"-user.*", "+user.keep"}, "user.keep", true},
+		{[]string{"-user.*", "+user.keep"}, "user.drop", false},
+		{[]string{"+user.keep", "-user.*"}, "user.keep", false},
+		{[]string{"-*", "+security.capability"}, "security.capability", true},
+		{[]string{"-*", "+security.capability"}, "security.selinux", false},
+		{[]string{"-security.selinux"}, "security.selinux", false},
+		{[]string{"-security.selinux"}, "security.selinuxfoo", true},
+	} {
+		filter, err := Parse(test.rules)
+		if err != nil {
+			t.Errorf("unexpected error parsing %v: %v", test.rules, err)
+			continue
+		}
+		if got := filter.Allowed(test.name); got != test.allowed {
+			t.Errorf("Parse(%v).Allowed(%q): got %v expected %v", test.rules, test.name, got, test.allowed)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"+",
+		"user.*",
+		"*user.foo",
+		"+user.*.foo",
+		"!user.foo",
+	} {
+		if _, err := Parse([]string{rule}); err == nil {
+			t.Errorf("expected error parsing %q", rule)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules := []string{"-user.*", "+user.keep", "-security.selinux"}
+	filter, err := Parse(rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := filter.Rules(); !reflect.DeepEqual(got, rules) {
+		t.Errorf("unexpected rules: got %v expected %v", got, rules)
+	}
+	if !Default().Allowed("user.foo") || Default().Allowed("security.selinux") {
+		t.Errorf("default filter has unexpected behaviour")
+	}
+}
+
+// TestDefault checks the exact set of default rules, which both unpack and
+// repack rely on to drop host-specific SELinux labels.
+func TestDefault(t *testing.T) {
+	expected := []string{"-security.selinux"}
+	if !reflect.DeepEqual(DefaultRules, expected) {
+		t.Errorf("unexpected default rules: got %v expected %v", DefaultRules, expected)
+	}
+	if got := Default().Rules(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected default filter rules: got %v expected %v", got, expected)
+	}
+}
@@ -0,0 +1,143 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci attach [invalid arguments]" {
+	FILES="$(setup_tmpdir)"
+	echo '{"spdxVersion": "SPDX-2.3"}' > "$FILES/image.spdx.json"
+
+	# Missing --type or files.
+	umoci attach --image "${IMAGE}:${TAG}" "$FILES/image.spdx.json"
+	[ "$status" -ne 0 ]
+	umoci attach --image "${IMAGE}:${TAG}" --type sbom
+	[ "$status" -ne 0 ]
+	# Unknown type.
+	umoci attach --image "${IMAGE}:${TAG}" --type nonexistent "$FILES/image.spdx.json"
+	[ "$status" -ne 0 ]
+	# Invalid annotation.
+	umoci attach --image "${IMAGE}:${TAG}" --type sbom --annotation "=value" "$FILES/image.spdx.json"
+	[ "$status" -ne 0 ]
+	# Non-existent tag and file.
+	umoci attach --image "${IMAGE}:${TAG}-nonexistent" --type sbom "$FILES/image.spdx.json"
+	[ "$status" -ne 0 ]
+	umoci attach --image "${IMAGE}:${TAG}" --type sbom "$FILES/nonexistent.spdx.json"
+	[ "$status" -ne 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --type nonexistent
+	[ "$status" -ne 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --output ""
+	[ "$status" -ne 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci attach" {
+	FILES="$(setup_tmpdir)"
+	OUTPUT="$(setup_tmpdir)"
+	echo '{"spdxVersion": "SPDX-2.3"}' > "$FILES/image.spdx.json"
+	echo '{"_type": "https://in-toto.io/Statement/v1"}' > "$FILES/provenance.json"
+
+	# There are no referrers yet.
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" == 0 ]]
+
+	umoci attach --image "${IMAGE}:${TAG}" --type sbom "$FILES/image.spdx.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci attach --image "${IMAGE}:${TAG}" --type attestation --annotation "com.example.kind=provenance" "$FILES/provenance.json:application/vnd.in-toto.provenance+json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" == 2 ]]
+	[[ "$(jq -SMr '.[0].artifactType' <<<"$output")" == "application/spdx+json" ]]
+	[[ "$(jq -SMr '.[0].blobs[0].mediaType' <<<"$output")" == "application/spdx+json" ]]
+	[[ "$(jq -SMr '.[0].blobs[0].annotations["org.opencontainers.image.title"]' <<<"$output")" == "image.spdx.json" ]]
+	[[ "$(jq -SMr '.[1].artifactType' <<<"$output")" == "application/vnd.in-toto+json" ]]
+	[[ "$(jq -SMr '.[1].blobs[0].mediaType' <<<"$output")" == "application/vnd.in-toto.provenance+json" ]]
+	[[ "$(jq -SMr '.[1].annotations["com.example.kind"]' <<<"$output")" == "provenance" ]]
+
+	# The artifact manifest refers to the tagged manifest.
+	manifest="$(jq -SMr '.[0].descriptor.digest' <<<"$output" | cut -d: -f2)"
+	root="$(jq -SMr ".manifests[] | select(.annotations[\"org.opencontainers.image.ref.name\"] == \"${TAG}\") | .digest" "${IMAGE}/index.json")"
+	sane_run jq -SMr '.subject.digest' "${IMAGE}/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$root" ]]
+
+	# Only the SBOM is retrieved with --type.
+	umoci referrers --image "${IMAGE}:${TAG}" --type sbom --output "$OUTPUT/sboms"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	diff -u "$FILES/image.spdx.json" "$OUTPUT/sboms/image.spdx.json"
+	! [ -e "$OUTPUT/sboms/provenance.json" ]
+
+	# The referrers survive a gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci referrers --image "${IMAGE}:${TAG}" --output "$OUTPUT/all"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 3 ]
+	diff -u "$FILES/image.spdx.json" "$OUTPUT/all/image.spdx.json"
+	diff -u "$FILES/provenance.json" "$OUTPUT/all/provenance.json"
+
+	# Modifying the image leaves the referrers attached to the old manifest.
+	umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" == 0 ]]
+
+	# ... which are removed by gc, once the old manifest is.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '[.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == null)] | length' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == 0 ]]
+}
+
+@test "umoci referrers [signatures]" {
+	KEYS="$(setup_tmpdir)"
+	openssl ecparam -name prime256v1 -genkey -noout | openssl pkcs8 -topk8 -nocrypt -out "$KEYS/signing.key"
+
+	umoci sign --image "${IMAGE}:${TAG}" --key "$KEYS/signing.key"
+	[ "$status" -eq 0 ]
+
+	umoci referrers --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr 'length' <<<"$output")" == 1 ]]
+	[[ "$(jq -SMr '.[0].artifactType' <<<"$output")" == "application/vnd.dev.cosign.artifact.sig.v1+json" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,164 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# fake_build_runtime creates an OCI runtime which records the process of the
+# bundle it was asked to run, and creates a file in the rootfs.
+function fake_build_runtime() {
+	RUNTIME_DIR="$(setup_tmpdir)"
+	cat >"$RUNTIME_DIR/runtime" <<-'EOF_RUNTIME'
+	#!/bin/sh
+	# Called as "runtime run --bundle <bundle> <id>".
+	bundle="$3"
+	jq -c '.process.args' "$bundle/config.json" >>"$RUNTIME_DIR/process-args"
+	echo "created by run" >"$bundle/rootfs/run-file"
+	exit "${RUNTIME_STATUS:-0}"
+	EOF_RUNTIME
+	chmod +x "$RUNTIME_DIR/runtime"
+	export RUNTIME_DIR
+}
+
+@test "umoci build [invalid arguments]" {
+	BUILD_DIR="$(setup_tmpdir)"
+
+	umoci build --image "${IMAGE}:${TAG}-built"
+	[ "$status" -ne 0 ]
+
+	umoci build --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/nonexistent.json"
+	[ "$status" -ne 0 ]
+
+	# Invalid specs.
+	for spec in \
+		'{}' \
+		'{"from": "invalid/tag"}' \
+		'{"from": "'"${TAG}"'", "steps": [{}]}' \
+		'{"from": "'"${TAG}"'", "steps": [{"run": []}]}' \
+		'{"from": "'"${TAG}"'", "steps": [{"run": "true", "copy": {"src": "a", "dest": "/a"}}]}' \
+		'{"from": "'"${TAG}"'", "steps": [{"copy": {"src": "a"}}]}' \
+		'{"from": "'"${TAG}"'", "steps": [{"config": {"tag": "other"}}]}' \
+		'{"from": "'"${TAG}"'", "steps": [{"config": {"config.env": [1]}}]}'; do
+		echo "$spec" >"$BUILD_DIR/spec.json"
+		umoci build --runtime true --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/spec.json"
+		[ "$status" -ne 0 ]
+	done
+
+	# Nothing was built.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-built"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci build" {
+	fake_build_runtime
+	BUILD_DIR="$(setup_tmpdir)"
+
+	mkdir -p "$BUILD_DIR/files/sub"
+	echo "file a" >"$BUILD_DIR/files/a"
+	echo "file b" >"$BUILD_DIR/files/sub/b"
+	echo "single file" >"$BUILD_DIR/single"
+	cat >"$BUILD_DIR/spec.json" <<-EOF
+	{
+		"from": "${TAG}",
+		"steps": [
+			{"run": "echo hello"},
+			{"copy": {"src": "files", "dest": "/umoci-files"}},
+			{"copy": {"src": "single", "dest": "/etc/"}},
+			{"config": {"config.env": ["UMOCI_BUILD=1"], "config.workingdir": "/umoci-files"}},
+			{"run": ["/bin/true", "arg"]}
+		]
+	}
+	EOF
+
+	umoci build --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/spec.json" </dev/null
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both run steps were run.
+	[[ "$(sed -n 1p "$RUNTIME_DIR/process-args")" == '["/bin/sh","-c","echo hello"]' ]]
+	[[ "$(sed -n 2p "$RUNTIME_DIR/process-args")" == '["/bin/true","arg"]' ]]
+
+	# The changes are in the built image.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-built"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep -E '^added +/run-file '
+	echo "$output" | grep -E '^added +/umoci-files/a +file 0644 0:0'
+	echo "$output" | grep -E '^added +/umoci-files/sub/b '
+	echo "$output" | grep -E '^added +/etc/single '
+
+	umoci cat --image "${IMAGE}:${TAG}-built" /umoci-files/sub/b
+	[ "$status" -eq 0 ]
+	[[ "$output" == "file b" ]]
+
+	# The configuration was modified.
+	umoci stat --image "${IMAGE}:${TAG}-built" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci build: run /bin/true arg" ]]
+
+	umoci raw runtime-config --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/config.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.process.cwd' "$BUILD_DIR/config.json"
+	[[ "$output" == "/umoci-files" ]]
+	sane_run jq -SMr '.process.env[]' "$BUILD_DIR/config.json"
+	[[ "$output" == *"UMOCI_BUILD=1"* ]]
+
+	# The base image was not modified.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci build [failed step]" {
+	fake_build_runtime
+	BUILD_DIR="$(setup_tmpdir)"
+
+	echo '{"from": "'"${TAG}"'", "steps": [{"run": "false"}]}' >"$BUILD_DIR/spec.json"
+	RUNTIME_STATUS=1 umoci build --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/spec.json" </dev/null
+	[ "$status" -ne 0 ]
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-built"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci build [no steps]" {
+	BUILD_DIR="$(setup_tmpdir)"
+
+	echo '{"from": "'"${TAG}"'"}' >"$BUILD_DIR/spec.json"
+	umoci build --image "${IMAGE}:${TAG}-built" "$BUILD_DIR/spec.json"
+	[ "$status" -eq 0 ]
+
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-built"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,114 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci cat [invalid arguments]" {
+	umoci cat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci cat --image "${IMAGE}:${TAG}" /etc/passwd /etc/group
+	[ "$status" -ne 0 ]
+
+	umoci cat --image "${IMAGE}:${TAG}" /umoci-nonexistent
+	[ "$status" -ne 0 ]
+
+	# Directories cannot be read.
+	umoci cat --image "${IMAGE}:${TAG}" /etc
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci cat" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	umoci cat --image "${IMAGE}:${TAG}" /etc/passwd
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(cat "$BUNDLE/rootfs/etc/passwd")" ]]
+
+	# Modify the image.
+	echo "umoci cat" > "$BUNDLE/rootfs/etc/umoci-cat"
+	rm -f "$BUNDLE/rootfs/etc/group"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci cat --image "${IMAGE}:${TAG}-new" /etc/umoci-cat
+	[ "$status" -eq 0 ]
+	[[ "$output" == "umoci cat" ]]
+
+	# Removed files no longer exist.
+	umoci cat --image "${IMAGE}:${TAG}-new" /etc/group
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci extract [invalid arguments]" {
+	DEST="$(setup_tmpdir)"
+
+	umoci extract --image "${IMAGE}:${TAG}" /etc
+	[ "$status" -ne 0 ]
+
+	# The destination must not exist.
+	umoci extract --image "${IMAGE}:${TAG}" /etc "$DEST"
+	[ "$status" -ne 0 ]
+
+	umoci extract --image "${IMAGE}:${TAG}" /umoci-nonexistent "$DEST/nonexistent"
+	[ "$status" -ne 0 ]
+	[ ! -e "$DEST/nonexistent" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci extract" {
+	BUNDLE="$(setup_tmpdir)"
+	DEST="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# A directory is extracted with the same contents as in the bundle.
+	umoci extract --image "${IMAGE}:${TAG}" /etc "$DEST/etc"
+	[ "$status" -eq 0 ]
+	sane_run diff -r --no-dereference "$BUNDLE/rootfs/etc" "$DEST/etc"
+	[ "$status" -eq 0 ]
+	[ ! -e "$DEST/usr" ]
+
+	# A single file can be extracted.
+	umoci extract --image "${IMAGE}:${TAG}" /etc/passwd "$DEST/passwd"
+	[ "$status" -eq 0 ]
+	[ -f "$DEST/passwd" ]
+	sane_run cmp "$BUNDLE/rootfs/etc/passwd" "$DEST/passwd"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
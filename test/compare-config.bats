@@ -0,0 +1,203 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci compare-config" {
+	image-verify "${IMAGE}"
+
+	# Identical images have no differences.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-same"
+	[ "$status" -eq 0 ]
+	umoci compare-config --image "${IMAGE}:${TAG}" "${TAG}-same"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.env="COMPARE_TEST=1" --config.label="compare.test=yes" \
+		--config.entrypoint="/bin/compare-test"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci compare-config --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"config.Env[COMPARE_TEST]"* ]]
+	[[ "$output" == *"config.Labels[compare.test]"* ]]
+	[[ "$output" == *"config.Entrypoint"* ]]
+
+	# The reverse comparison removes the label.
+	umoci compare-config --image "${IMAGE}:${TAG}-new" --json "${TAG}"
+	[ "$status" -eq 0 ]
+	changesFile="$(setup_tmpdir)/changes"
+	echo "$output" > "$changesFile"
+	sane_run jq -SMr '.[] | select(.field == "config.Labels[compare.test]") | .type' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "removed" ]]
+	sane_run jq -SMr '.[] | select(.field == "config.Labels[compare.test]") | .old' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "yes" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci compare-config [docker fields]" {
+	image-verify "${IMAGE}"
+
+	# Each of the Docker-specific fields is compared.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-docker" --no-history \
+		--config.healthcheck=CMD-SHELL --config.healthcheck="true" \
+		--config.shell=/bin/bash --config.shell=-c --config.onbuild="RUN make"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci compare-config --image "${IMAGE}:${TAG}" --json "${TAG}-docker"
+	[ "$status" -eq 0 ]
+	changesFile="$(setup_tmpdir)/changes"
+	echo "$output" > "$changesFile"
+	sane_run jq -SMr '.[].field' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(printf 'config.Healthcheck\nconfig.Shell\nconfig.OnBuild')" ]]
+	sane_run jq -SMr '.[] | select(.field == "config.Healthcheck") | .new.Test | join(" ")' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "CMD-SHELL true" ]]
+
+	# Changing a single field is also detected.
+	umoci config --image "${IMAGE}:${TAG}-docker" --tag "${TAG}-docker2" --no-history \
+		--config.healthcheck=CMD-SHELL --config.healthcheck="false"
+	[ "$status" -eq 0 ]
+	umoci compare-config --image "${IMAGE}:${TAG}-docker" --json "${TAG}-docker2"
+	[ "$status" -eq 0 ]
+	echo "$output" > "$changesFile"
+	sane_run jq -SMr '.[] | "\(.type) \(.field)"' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "modified config.Healthcheck" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci compare-config [history]" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SMr '.history | length')"
+
+	# Images which only differ in their history are not identical.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-history"
+	[ "$status" -eq 0 ]
+	umoci edit-history --image "${IMAGE}:${TAG}-history" --entry=-1 --comment "compare-config"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci compare-config --image "${IMAGE}:${TAG}" --json "${TAG}-history"
+	[ "$status" -eq 0 ]
+	changesFile="$(setup_tmpdir)/changes"
+	echo "$output" > "$changesFile"
+	sane_run jq -SMr '.[] | "\(.type) \(.field) \(.new.comment)"' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "modified history[$(($nhistory - 1))] compare-config" ]]
+
+	# Added history entries are listed.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-history2" --history.comment "new entry"
+	[ "$status" -eq 0 ]
+	umoci compare-config --image "${IMAGE}:${TAG}" --json "${TAG}-history2"
+	[ "$status" -eq 0 ]
+	echo "$output" > "$changesFile"
+	sane_run jq -SMr '.[] | select(.field == "history['"$nhistory"']") | .type' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "added" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci compare-config [layers]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "compare-config" > "$BUNDLE/rootfs/compare-config"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci compare-config --image "${IMAGE}:${TAG}" --json "${TAG}-new"
+	[ "$status" -eq 0 ]
+	changesFile="$(setup_tmpdir)/changes"
+	echo "$output" > "$changesFile"
+
+	# Exactly one layer was added.
+	sane_run jq -SMr '[.[] | select(.field | startswith("layers["))] | length' "$changesFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+	sane_run jq -SMr '.[] | select(.field | startswith("layers[")) | .type' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "added" ]]
+
+	# The diff_ids and the history entry of the new layer are also listed.
+	sane_run jq -SMr '.[] | select(.field == "rootfs.diff_ids") | (.new | length) - (.old | length)' "$changesFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 1 ]
+	sane_run jq -SMr '[.[] | select(.field | startswith("history[")) | .type] | join(" ")' "$changesFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "added" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci compare-config --with" {
+	OTHER_IMAGE="$(setup_tmpdir)/other"
+
+	image-verify "${IMAGE}"
+
+	umoci init --layout "$OTHER_IMAGE"
+	[ "$status" -eq 0 ]
+	umoci new --image "$OTHER_IMAGE:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$OTHER_IMAGE"
+
+	umoci compare-config --image "${IMAGE}:${TAG}" --with "$OTHER_IMAGE:${TAG}" --json
+	[ "$status" -eq 0 ]
+	changesFile="$(setup_tmpdir)/changes"
+	echo "$output" > "$changesFile"
+
+	# All of the layers were removed.
+	sane_run jq -SMr '[.[] | select(.field | startswith("layers[")) | select(.type != "removed")] | length' "$changesFile"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# Cannot specify both --with and a tag.
+	umoci compare-config --image "${IMAGE}:${TAG}" --with "$OTHER_IMAGE:${TAG}" "${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Missing tags are errors.
+	umoci compare-config --image "${IMAGE}:${TAG}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,108 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci completion" {
+	umoci completion bash
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"complete -F _umoci umoci"* ]]
+
+	# Make sure the bash script is at least syntactically valid.
+	sane_run bash -c "'$UMOCI' completion bash | bash -n"
+	[ "$status" -eq 0 ]
+
+	umoci completion zsh
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"compdef _umoci umoci"* ]]
+
+	umoci completion fish
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"complete -c umoci"* ]]
+
+	# Unknown shells and missing arguments.
+	umoci completion ksh
+	[ "$status" -ne 0 ]
+	umoci completion
+	[ "$status" -ne 0 ]
+	umoci completion bash zsh
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci completion [candidates]" {
+	# Subcommands.
+	umoci __complete unp
+	[ "$status" -eq 0 ]
+	[[ "$output" == "unpack" ]]
+
+	umoci __complete raw stat-
+	[ "$status" -eq 0 ]
+	[[ "$output" == "stat-blob" ]]
+
+	# Hidden commands are not completed.
+	umoci __complete __
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Flags.
+	umoci __complete unpack --ima
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--image" ]]
+
+	umoci __complete --log ""
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 5 ]
+	[[ "${lines[*]}" == *"debug"* ]]
+
+	# Layout paths.
+	umoci __complete unpack --image "${IMAGE%/*}/"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${IMAGE}/"* ]]
+	[[ "$output" == *"${IMAGE}:"* ]]
+
+	umoci __complete gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${IMAGE}/"* ]]
+
+	# Tags, which are read from the image index.
+	umoci tag --image "${IMAGE}:${TAG}" "${TAG}-completion"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci __complete unpack --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${IMAGE}:${TAG}-completion"* ]]
+
+	umoci __complete unpack "--image=${IMAGE}:${TAG}-"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "--image=${IMAGE}:${TAG}-completion" ]]
+
+	# Positional arguments are completed as paths.
+	touch "$BATS_TMPDIR/completion-file"
+	umoci __complete unpack --image "${IMAGE}:${TAG}" "$BATS_TMPDIR/completion-f"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$BATS_TMPDIR/completion-file" ]]
+	rm -f "$BATS_TMPDIR/completion-file"
+}
@@ -653,6 +653,8 @@ function teardown() {
 	[[ "$(echo "$output" | jq -SMr '.history[-1].empty_layer')" == "true" ]]
 	# The author should've changed.
 	[[ "$(echo "$output" | jq -SMr '.history[-1].author')" == "Aleksa Sarai <asarai@suse.com>" ]]
+	# The history entry should use --created.
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2016-03-25T12:34:02.655002+11:00" ]]
 
 	image-verify "${IMAGE}"
 }
@@ -694,6 +696,33 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --no-history" {
+	# --no-history conflicts with --history.*.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--no-history --history.author="Not Aleksa <someone@else.com>" \
+		--author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -ne 0 ]
+
+	# Modify something without adding a history entry.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--no-history --author="Aleksa Sarai <asarai@suse.com>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Make sure that the history was not modified.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLinesA="$(echo "$output" | jq -SMr '.history | length')"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLinesB="$(echo "$output" | jq -SMr '.history | length')"
+
+	[ "$numLinesB" -eq "$numLinesA" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --config.label" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -765,3 +794,451 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --config.[healthcheck+shell+onbuild]" {
+	# Set the Docker-specific fields.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.healthcheck=CMD-SHELL --config.healthcheck="curl -f http://localhost/" \
+		--config.healthcheck.interval=30s --config.healthcheck.retries=3 \
+		--config.shell=/bin/bash --config.shell=-c --config.onbuild="RUN make"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modifying other fields must preserve them.
+	umoci config --image "${IMAGE}:${TAG}-new" --config.user="nobody" --config.onbuild="RUN make install"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMc '.config.Healthcheck' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '{"Interval":30000000000,"Retries":3,"Test":["CMD-SHELL","curl -f http://localhost/"]}' ]]
+	sane_run jq -SMc '.config.Shell' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/bin/bash","-c"]' ]]
+	sane_run jq -SMc '.config.OnBuild' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["RUN make","RUN make install"]' ]]
+	sane_run jq -SMr '.config.User' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "nobody" ]]
+
+	# Clearing them removes them from the configuration.
+	umoci config --image "${IMAGE}:${TAG}-new" --clear=config.healthcheck --clear=config.shell --clear=config.onbuild
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMc '.config | [.Healthcheck, .Shell, .OnBuild]' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '[null,null,null]' ]]
+
+	# Invalid values are rejected.
+	umoci config --image "${IMAGE}:${TAG}" --config.healthcheck=NONE --config.healthcheck=true
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --config.healthcheck.timeout=-1s
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --[platform+all-platforms]" {
+	# Create an image index with a manifest for two platforms.
+	sane_run jq -SMc '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | {mediaType, digest, size}' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+	index="$(jq -SMc -n --argjson m "$manifest" '{schemaVersion: 2, manifests: [($m + {platform: {os: "linux", architecture: "amd64"}}), ($m + {platform: {os: "linux", architecture: "arm64"}})]}')"
+	indexDigest="$(echo -n "$index" | sha256sum | cut -d' ' -f1)"
+	echo -n "$index" > "$IMAGE/blobs/sha256/$indexDigest"
+	jq -SMc --arg d "sha256:$indexDigest" --argjson s "${#index}" '.manifests += [{mediaType: "application/vnd.oci.image.index.v1+json", digest: $d, size: $s, annotations: {"org.opencontainers.image.ref.name": "multi"}}]' "$IMAGE/index.json" > "$IMAGE/index.json.new"
+	mv "$IMAGE/index.json.new" "$IMAGE/index.json"
+	image-verify "${IMAGE}"
+
+	# Without a platform selector the tag is ambiguous.
+	umoci config --image "${IMAGE}:multi" --config.user="nobody"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:multi" --platform linux/s390x --config.user="nobody"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:multi" --platform linux/arm64 --all-platforms --config.user="nobody"
+	[ "$status" -ne 0 ]
+
+	# Only modify one platform.
+	umoci config --image "${IMAGE}:multi" --tag multi-arm --platform linux/arm64 --config.user="armuser"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify all platforms.
+	umoci config --image "${IMAGE}:multi" --tag multi-all --all-platforms --config.user="alluser"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Outputs the configured user of the given platform of a tag.
+	function platform_user() {
+		local blob="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "$IMAGE/index.json")"
+		blob="$(jq -SMr '.manifests[] | select(.platform.architecture == "'"$2"'") | .digest' "$IMAGE/blobs/sha256/${blob#sha256:}")"
+		blob="$(jq -SMr '.config.digest' "$IMAGE/blobs/sha256/${blob#sha256:}")"
+		jq -SMr '.config.User // ""' "$IMAGE/blobs/sha256/${blob#sha256:}"
+	}
+
+	[[ "$(platform_user multi-arm amd64)" != "armuser" ]]
+	[[ "$(platform_user multi-arm arm64)" == "armuser" ]]
+	[[ "$(platform_user multi-all amd64)" == "alluser" ]]
+	[[ "$(platform_user multi-all arm64)" == "alluser" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --{manifest,descriptor,index}.annotation" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--manifest.annotation="com.example.manifest=1" \
+		--descriptor.annotation="com.example.descriptor=2" \
+		--index.annotation="com.example.index=3"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Each annotation must be in the right place.
+	sane_run jq -SMr '.annotations["com.example.index"]' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "3" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .annotations["com.example.descriptor"]' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.annotations["com.example.manifest"]' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	# The old tag's descriptor must not be modified.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .annotations["com.example.descriptor"]' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# Remove the annotations again.
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--manifest.annotation.remove="com.example.manifest" \
+		--descriptor.annotation.remove="com.example.descriptor" \
+		--clear=index.annotations
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.annotations["com.example.index"]' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .annotations["com.example.descriptor"]' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.annotations["com.example.manifest"]' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# Annotations must be key=value pairs.
+	umoci config --image "${IMAGE}:${TAG}" --descriptor.annotation="invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.{env,label}.remove --config.{cmd,entrypoint}.append" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--clear=config.env --clear=config.labels \
+		--config.env="APP_A=1" --config.env="APP_B=2" --config.env="KEEP=3" \
+		--config.label="com.example.a=1" --config.label="com.example.b=2" --config.label="org.other=3" \
+		--config.entrypoint="/init" --config.cmd="sh"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--config.env.remove="APP_*" --config.env="APP_C=4" \
+		--config.label.remove="com.example.*" \
+		--config.entrypoint.append="--debug" \
+		--config.cmd.append="-c" --config.cmd.append="echo hello"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMc '.config.Env' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["KEEP=3","APP_C=4"]' ]]
+	sane_run jq -SMc '.config.Labels' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '{"org.other":"3"}' ]]
+	sane_run jq -SMc '.config.Entrypoint' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/init","--debug"]' ]]
+	sane_run jq -SMc '.config.Cmd' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["sh","-c","echo hello"]' ]]
+
+	# Invalid patterns are rejected.
+	umoci config --image "${IMAGE}:${TAG}-new" --config.env.remove="[invalid"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}-new" --config.label.remove="[invalid"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.{exposedports,volume,stopsignal} [validation]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.exposedports="53/UDP" --config.exposedports="8000-8010" \
+		--config.volume="/data/../srv/" --config.stopsignal="term"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMc '.config.ExposedPorts | keys' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["53/udp","8000-8010"]' ]]
+	sane_run jq -SMc '.config.Volumes | keys' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/srv"]' ]]
+	sane_run jq -SMr '.config.StopSignal' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "SIGTERM" ]]
+
+	# Malformed values are rejected.
+	for port in "http" "0" "65536" "80/icmp" "8010-8000"; do
+		umoci config --image "${IMAGE}:${TAG}-new" --config.exposedports="$port"
+		[ "$status" -ne 0 ]
+	done
+	umoci config --image "${IMAGE}:${TAG}-new" --config.volume="relative/path"
+	[ "$status" -ne 0 ]
+	for signal in "SIGFOO" "SIGINFO" "0" "65"; do
+		umoci config --image "${IMAGE}:${TAG}-new" --config.stopsignal="$signal"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --config.user.resolve" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.user="root:root" --config.user.resolve
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMr '.config.User' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:0" ]]
+
+	# Unknown users are rejected.
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--config.user="nonexistent-umoci-user" --config.user.resolve
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --patch" {
+	cat >"$BATS_TMPDIR/patch.json" <<-EOF
+	{
+		"author": "Patched Author",
+		"config": {
+			"User": "nobody",
+			"Env": ["A=1", "B=2"],
+			"Labels": {"org.example.added": "1"},
+			"Shell": ["/bin/bash", "-c"]
+		}
+	}
+	EOF
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.label="org.example.removed=1" --config.label="org.example.kept=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Flags are applied after the patch.
+	umoci config --image "${IMAGE}:${TAG}-new" --patch "$BATS_TMPDIR/patch.json" --config.env="C=3"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMr '.author' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "Patched Author" ]]
+	sane_run jq -SMr '.config.User' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "nobody" ]]
+	sane_run jq -SMc '.config.Env' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["A=1","B=2","C=3"]' ]]
+	sane_run jq -SMc '.config.Labels' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '{"org.example.added":"1","org.example.kept":"1","org.example.removed":"1"}' ]]
+	sane_run jq -SMc '.config.Shell' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/bin/bash","-c"]' ]]
+
+	# Patches can remove values, and can be read from stdin.
+	echo '{"config": {"User": null, "Labels": {"org.example.removed": null}}}' >"$BATS_TMPDIR/remove.json"
+	umoci config --image "${IMAGE}:${TAG}-new" --patch - <"$BATS_TMPDIR/remove.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMr '.config.User // "none"' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "none" ]]
+	sane_run jq -SMc '.config.Labels' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '{"org.example.added":"1","org.example.kept":"1"}' ]]
+
+	# Applying the same patch again doesn't modify the configuration.
+	umoci config --image "${IMAGE}:${TAG}-new" --tag "${TAG}-again" --no-history --patch "$BATS_TMPDIR/patch.json"
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}-again" --tag "${TAG}-again2" --no-history --patch "$BATS_TMPDIR/patch.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-again"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	first="$output"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-again2"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$first" ]]
+
+	# Invalid patches are rejected.
+	for patch in '[]' 'null' '{"config": {"Usr": "typo"}}' '{"rootfs": {}}' '{"config": {"Env": "A=1"}}'; do
+		echo "$patch" >"$BATS_TMPDIR/patch.json"
+		umoci config --image "${IMAGE}:${TAG}-new" --patch "$BATS_TMPDIR/patch.json"
+		[ "$status" -ne 0 ]
+	done
+	umoci config --image "${IMAGE}:${TAG}-new" --patch "$BATS_TMPDIR/nonexistent.json"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --from-image" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-source" \
+		--config.env="SOURCE=1" --config.entrypoint="/bin/source" --config.shell="/bin/bash"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The source image can be in a different image layout.
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	umoci new --image "${NEW_IMAGE}:rootfs"
+	[ "$status" -eq 0 ]
+	image-verify "${NEW_IMAGE}"
+
+	# Flags are applied after the configuration is copied.
+	umoci config --image "${NEW_IMAGE}:rootfs" --from-image "${IMAGE}:${TAG}-source" --config.env="EXTRA=1"
+	[ "$status" -eq 0 ]
+	image-verify "${NEW_IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "rootfs") | .digest' "$NEW_IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$NEW_IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$NEW_IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	sane_run jq -SMr '.config.Env[]' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"SOURCE=1"* ]]
+	[[ "$output" == *"EXTRA=1"* ]]
+	sane_run jq -SMc '.config.Entrypoint' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/bin/source"]' ]]
+	sane_run jq -SMc '.config.Shell' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '["/bin/bash"]' ]]
+	# The layers are not copied.
+	sane_run jq -SMr '.rootfs.diff_ids | length' "$config"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# Invalid or missing sources are rejected.
+	umoci config --image "${NEW_IMAGE}:rootfs" --from-image "${IMAGE}:nonexistent"
+	[ "$status" -ne 0 ]
+	umoci config --image "${NEW_IMAGE}:rootfs" --from-image "${BATS_TMPDIR}/nonexistent:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci config --image "${NEW_IMAGE}:rootfs" --from-image ":${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${NEW_IMAGE}"
+}
+
+@test "umoci config --dry-run" {
+	cp "$IMAGE/index.json" "$BATS_TMPDIR/index.json"
+	numBlobs="$(find "$IMAGE/blobs" -type f | wc -l)"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user="nobody" --dry-run
+	[ "$status" -eq 0 ]
+	echo "$output" >"$BATS_TMPDIR/dry-run.json"
+
+	# The image is not modified.
+	sane_run cmp "$IMAGE/index.json" "$BATS_TMPDIR/index.json"
+	[ "$status" -eq 0 ]
+	[ "$(find "$IMAGE/blobs" -type f | wc -l)" -eq "$numBlobs" ]
+	image-verify "${IMAGE}"
+
+	# The changes are described.
+	sane_run jq -SMr '.references[0].name' "$BATS_TMPDIR/dry-run.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}-new" ]]
+	sane_run jq -SMr '.references[0].old' "$BATS_TMPDIR/dry-run.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '.blobs | length' "$BATS_TMPDIR/dry-run.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 2 ]
+
+	# Replacing an existing tag includes a patch of the configuration.
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nobody" --dry-run
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.references[0].manifests[0].config.config.User' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "nobody" ]]
+
+	sane_run cmp "$IMAGE/index.json" "$BATS_TMPDIR/index.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,137 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci convert [missing args]" {
+	umoci convert --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}" --format appc
+	[ "$status" -ne 0 ]
+
+	umoci convert --image "${IMAGE}:${TAG}-nonexistent" --format docker
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci convert" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	origManifest="$output"
+
+	umoci convert --image "${IMAGE}:${TAG}" --tag "${TAG}-docker" --format docker
+	[ "$status" -eq 0 ]
+
+	# Check all of the media types.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-docker"'") | .mediaType' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-docker"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.mediaType' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+	sane_run jq -SMr '.config.mediaType' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.container.image.v1+json" ]]
+	sane_run jq -SMr '.layers[].mediaType' "$manifest"
+	[ "$status" -eq 0 ]
+	for line in "${lines[@]}"; do
+		[[ "$line" == "application/vnd.docker.image.rootfs.diff.tar.gzip" ]]
+	done
+
+	# The converted image must survive a gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "$manifest" ]
+
+	# Most commands require the OCI format.
+	umoci config --image "${IMAGE}:${TAG}-docker" --config.user="nobody"
+	[ "$status" -ne 0 ]
+
+	# Converting back must produce the original manifest.
+	umoci convert --image "${IMAGE}:${TAG}-docker" --format oci
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-docker"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$origManifest" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci convert [index]" {
+	# Create an image index with a manifest for two platforms.
+	sane_run jq -SMc '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | {mediaType, digest, size}' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$output"
+	index="$(jq -SMc -n --argjson m "$manifest" '{schemaVersion: 2, manifests: [($m + {platform: {os: "linux", architecture: "amd64"}}), ($m + {platform: {os: "linux", architecture: "arm64"}})]}')"
+	indexDigest="$(echo -n "$index" | sha256sum | cut -d' ' -f1)"
+	echo -n "$index" > "$IMAGE/blobs/sha256/$indexDigest"
+	jq -SMc --arg d "sha256:$indexDigest" --argjson s "${#index}" '.manifests += [{mediaType: "application/vnd.oci.image.index.v1+json", digest: $d, size: $s, annotations: {"org.opencontainers.image.ref.name": "multi"}}]' "$IMAGE/index.json" > "$IMAGE/index.json.new"
+	mv "$IMAGE/index.json.new" "$IMAGE/index.json"
+	image-verify "${IMAGE}"
+
+	umoci convert --image "${IMAGE}:multi" --format docker
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	list="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.mediaType' "$list"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.list.v2+json" ]]
+	sane_run jq -SMr '[.manifests[].mediaType] | unique | .[]' "$list"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+	sane_run jq -SMr '[.manifests[].platform.architecture] | join(",")' "$list"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "amd64,arm64" ]]
+
+	# The manifest list must survive a gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "$list" ]
+
+	# Converting back must produce the original index.
+	umoci convert --image "${IMAGE}:multi" --format oci
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .mediaType' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.oci.image.index.v1+json" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "multi") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$index" ]]
+
+	image-verify "${IMAGE}"
+}
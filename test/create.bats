@@ -65,6 +65,78 @@ function teardown() {
 	image-verify "$NEWIMAGE"
 }
 
+@test "umoci init --template [invalid]" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+	TEMPLATE="$(setup_tmpdir)/template.json"
+
+	# Missing template.
+	umoci init --layout "$NEWIMAGE" --template "$TEMPLATE"
+	[ "$status" -ne 0 ]
+	[ ! -e "$NEWIMAGE" ]
+
+	# Invalid templates must be rejected before the layout is created.
+	for template in \
+		'not json' \
+		'{"images": [{"from": "'"${IMAGE}:${TAG}"'"}]}' \
+		'{"images": [{"tag": "a", "from": ""}]}' \
+		'{"images": [{"tag": "a:b", "from": "'"${IMAGE}:${TAG}"'"}]}' \
+		'{"images": [{"tag": "a", "from": "docker://UPPERCASE/image"}]}' \
+		'{"images": [{"tag": "a", "from": "'"${IMAGE}:${TAG}"'"}, {"tag": "a", "from": "'"${IMAGE}:${TAG}"'"}]}'; do
+		echo "$template" >"$TEMPLATE"
+		umoci init --layout "$NEWIMAGE" --template "$TEMPLATE"
+		[ "$status" -ne 0 ]
+		[ ! -e "$NEWIMAGE" ]
+	done
+
+	# Images which cannot be added cause the layout to be removed.
+	echo '{"images": [{"tag": "a", "from": "'"${IMAGE}:${TAG}"'"}, {"tag": "b", "from": "'"${IMAGE}:nonexistent"'"}]}' >"$TEMPLATE"
+	umoci init --layout "$NEWIMAGE" --template "$TEMPLATE"
+	[ "$status" -ne 0 ]
+	[ ! -e "$NEWIMAGE" ]
+}
+
+@test "umoci init --template" {
+	TEMPLATE_DIR="$(setup_tmpdir)"
+	NEWIMAGE="$(setup_tmpdir)/image"
+
+	# Local images are relative to the template.
+	cp -r "${IMAGE}" "$TEMPLATE_DIR/source"
+	cat >"$TEMPLATE_DIR/template.json" <<-EOF
+	{
+		"images": [
+			{"tag": "first", "from": "source:${TAG}"},
+			{"tag": "second", "from": "${IMAGE}:${TAG}"}
+		]
+	}
+	EOF
+
+	umoci init --layout "$NEWIMAGE" --template "$TEMPLATE_DIR/template.json"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	umoci ls --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "$output" == *"first"* ]]
+	[[ "$output" == *"second"* ]]
+
+	# The images must be identical to the source.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	oldDigest="$output"
+	sane_run jq -SMr '.manifests[] | .digest' "$NEWIMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "$oldDigest" ]]
+	[[ "${lines[1]}" == "$oldDigest" ]]
+
+	# The contents must be usable.
+	BUNDLE="$(setup_tmpdir)"
+	umoci unpack --image "${NEWIMAGE}:first" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+}
+
 @test "umoci new [missing args]" {
 	umoci new
 	[ "$status" -ne 0 ]
@@ -85,14 +157,12 @@ function teardown() {
 	# Create a new image with another tag.
 	umoci new --image "${NEWIMAGE}:latest"
 	[ "$status" -eq 0 ]
-	# XXX: oci-image-validate doesn't like empty images (without layers)
-	#image-verify "$NEWIMAGE"
+	image-verify "$NEWIMAGE"
 
 	# Modify the config.
 	umoci config --image "${NEWIMAGE}" --config.user "1234:1332"
 	[ "$status" -eq 0 ]
-	# XXX: oci-image-validate doesn't like empty images (without layers)
-	#image-verify "$NEWIMAGE"
+	image-verify "$NEWIMAGE"
 
 	# Unpack the image.
 	umoci unpack --image "${NEWIMAGE}" "$BUNDLE"
@@ -125,6 +195,98 @@ function teardown() {
 	# There should be no non-empty_layers.
 	[[ "$(echo "$output" | jq -SM '[.history[] | .empty_layer == null] | any')" == "false" ]]
 
-	# XXX: oci-image-validate doesn't like empty images (without layers)
-	#image-verify "$NEWIMAGE"
+	image-verify "$NEWIMAGE"
+}
+
+@test "umoci new --artifact-type [invalid]" {
+	# Artifact flags without an artifact.
+	umoci new --image "${IMAGE}:artifact" --blob /etc/passwd
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:artifact" --config-file /etc/passwd
+	[ "$status" -ne 0 ]
+
+	# Empty types.
+	umoci new --image "${IMAGE}:artifact" --artifact-type ""
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:artifact" --config-media-type "" --config-file /etc/passwd
+	[ "$status" -ne 0 ]
+
+	# The config needs a media type (which isn't an image configuration).
+	umoci new --image "${IMAGE}:artifact" --artifact-type application/vnd.example --config-file /etc/passwd
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:artifact" --config-media-type application/vnd.example.config
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:artifact" --config-media-type application/vnd.oci.image.config.v1+json --config-file /etc/passwd
+	[ "$status" -ne 0 ]
+
+	# Missing blobs.
+	umoci new --image "${IMAGE}:artifact" --artifact-type application/vnd.example --blob ""
+	[ "$status" -ne 0 ]
+	umoci new --image "${IMAGE}:artifact" --artifact-type application/vnd.example --blob "$(setup_tmpdir)/nonexistent"
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"artifact"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci new --artifact-type" {
+	DATA="$(setup_tmpdir)"
+	echo "wasm module" >"$DATA/module.wasm"
+	echo "notes" >"$DATA/notes:v1.txt"
+	echo '{"name": "chart"}' >"$DATA/config.json"
+	echo "chart" >"$DATA/chart.tgz"
+
+	# Artifact with an empty config.
+	umoci new --image "${IMAGE}:wasm" --artifact-type application/vnd.wasm.content.layer.v1+wasm \
+		--blob "$DATA/module.wasm:application/wasm" --blob "$DATA/notes:v1.txt"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:wasm" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.artifact.artifact_type')" == "application/vnd.wasm.content.layer.v1+wasm" ]]
+	[[ "$(echo "$output" | jq -SMr '.artifact.config.mediaType')" == "application/vnd.oci.empty.v1+json" ]]
+	[[ "$(echo "$output" | jq -SMr '.artifact.blobs | length')" == 2 ]]
+	[[ "$(echo "$output" | jq -SMr '.artifact.blobs[0].mediaType')" == "application/wasm" ]]
+	[[ "$(echo "$output" | jq -SMr '.artifact.blobs[1].mediaType')" == "application/octet-stream" ]]
+	[[ "$(echo "$output" | jq -SMr '.artifact.blobs[1].annotations["org.opencontainers.image.title"]')" == "notes:v1.txt" ]]
+
+	# The blobs can be read back.
+	digest="$(echo "$output" | jq -SMr '.artifact.blobs[0].digest')"
+	[[ "$(cat "${IMAGE}/blobs/sha256/${digest#sha256:}")" == "wasm module" ]]
+
+	umoci stat --image "${IMAGE}:wasm"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"ARTIFACT TYPE: application/vnd.wasm.content.layer.v1+wasm"* ]]
+	[[ "$output" == *"module.wasm"* ]]
+
+	# Artifact whose config media type is its type.
+	umoci new --image "${IMAGE}:chart" --config-media-type application/vnd.cncf.helm.config.v1+json \
+		--config-file "$DATA/config.json" --blob "$DATA/chart.tgz:application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci inspect --image "${IMAGE}:chart"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.manifest.config.mediaType')" == "application/vnd.cncf.helm.config.v1+json" ]]
+	[[ "$(echo "$output" | jq -SMr '.config.name')" == "chart" ]]
+	umoci stat --image "${IMAGE}:chart" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.artifact.artifact_type')" == "application/vnd.cncf.helm.config.v1+json" ]]
+
+	# Artifacts cannot be modified or unpacked as images.
+	umoci config --image "${IMAGE}:chart" --config.user "1000"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:chart" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+
+	# Artifacts are kept by GC.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -f "${IMAGE}/blobs/sha256/${digest#sha256:}" ]
+
+	image-verify "${IMAGE}"
 }
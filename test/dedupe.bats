@@ -0,0 +1,87 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci dedupe [missing args]" {
+	umoci dedupe
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci dedupe" {
+	image-verify "${IMAGE}"
+
+	# Store the top layer again, compressed with a different level.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.layers[-1].digest' "$manifest"
+	[ "$status" -eq 0 ]
+	layer="$output"
+
+	LAYER="$(setup_tmpdir)/layer.tar"
+	umoci raw dump-layer --layout "${IMAGE}" "$layer" "$LAYER"
+	[ "$status" -eq 0 ]
+	gzip -1 -n -c "$LAYER" > "$LAYER.gz"
+	duplicate="sha256:$(sha256sum "$LAYER.gz" | cut -d' ' -f1)"
+	[[ "$duplicate" != "$layer" ]]
+	cp "$LAYER.gz" "$IMAGE/blobs/sha256/${duplicate#sha256:}"
+
+	umoci replace-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-duplicate" --blob -- -1 "$duplicate"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	umoci dedupe --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both tags must use the same (smaller) blob.
+	for tag in "${TAG}" "${TAG}-duplicate"; do
+		sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$tag"'") | .digest' "$IMAGE/index.json"
+		[ "$status" -eq 0 ]
+		sane_run jq -SMr '.layers[-1].digest' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+		[ "$status" -eq 0 ]
+		layers+=("$output")
+	done
+	[[ "${layers[0]}" == "${layers[1]}" ]]
+
+	# Only the canonical blob must be left.
+	[[ "${layers[0]}" == "$layer" || "${layers[0]}" == "$duplicate" ]]
+	[ -f "$IMAGE/blobs/sha256/${layers[0]#sha256:}" ]
+	if [[ "${layers[0]}" == "$layer" ]]; then
+		[ ! -f "$IMAGE/blobs/sha256/${duplicate#sha256:}" ]
+	else
+		[ ! -f "$IMAGE/blobs/sha256/${layer#sha256:}" ]
+	fi
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nblobs" ]
+
+	image-verify "${IMAGE}"
+}
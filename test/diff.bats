@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci diff [invalid arguments]" {
+	umoci diff --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}" extra
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" --bundle "$(setup_tmpdir)" "${TAG}"
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" "invalid/tag"
+	[ "$status" -ne 0 ]
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci diff" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# An image is identical to itself.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "[]" ]]
+
+	# Modify the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "umoci diff" > "$BUNDLE/rootfs/etc/umoci-diff"
+	echo "extra" >> "$BUNDLE/rootfs/etc/passwd"
+	chmod 0600 "$BUNDLE/rootfs/etc/group"
+	rm -rf "$BUNDLE/rootfs/etc/shadow"
+
+	# The bundle can be compared before repacking.
+	umoci diff --image "${IMAGE}:${TAG}" --bundle "$BUNDLE" --json
+	[ "$status" -eq 0 ]
+	bundleDiff="$output"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep -E '^added +/etc/umoci-diff +file 0644'
+	echo "$output" | grep -E '^modified +/etc/passwd +size'
+	echo "$output" | grep -E '^modified +/etc/group +mode 0644 -> 0600'
+	echo "$output" | grep -E '^deleted +/etc/shadow '
+
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$bundleDiff" ]]
+	diffFile="$(setup_tmpdir)/diff"
+	echo "$output" > "$diffFile"
+
+	sane_run jq -SMr '.[] | select(.path == "etc/umoci-diff") | .type + " " + (.new.size | tostring)' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "added 11" ]]
+	sane_run jq -SMr '.[] | select(.path == "etc/group") | (.old.mode | tostring) + " " + (.new.mode | tostring)' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "420 384" ]]
+	sane_run jq -SMr '.[] | select(.path == "etc/shadow") | .type + " " + (.new == null | tostring)' "$diffFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "deleted true" ]]
+
+	image-verify "${IMAGE}"
+}
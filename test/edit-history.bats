@@ -0,0 +1,97 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci edit-history" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --history.author "Builder <builder@host.internal.example.com>" --history.created_by "built on host.internal.example.com"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	history="$output"
+	numHistory="$(echo "$history" | jq -SM '.history | length')"
+	[[ "$(echo "$history" | jq -SMr '.history[-1].author')" == "Builder <builder@host.internal.example.com>" ]]
+
+	# Modify the most recent entry.
+	umoci edit-history --image "${IMAGE}:${TAG}-new" --entry=-1 --comment "edited" --created "2000-01-01T00:00:00Z"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$numHistory" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "edited" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2000-01-01T00:00:00Z" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].author')" == "Builder <builder@host.internal.example.com>" ]]
+
+	# Scrub the hostname from the entire history.
+	umoci edit-history --image "${IMAGE}:${TAG}-new" --replace "host.internal.example.com=example.com"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].author')" == "Builder <builder@example.com>" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "built on example.com" ]]
+	! (echo "$output" | grep "internal")
+
+	# The layers must be unchanged.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$(echo "$history" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" ]]
+
+	# The original tag must be unchanged.
+	[[ "$(echo "$output" | jq -SM '.history | length')" == "$(($numHistory - 1))" ]]
+}
+
+@test "umoci edit-history [invalid]" {
+	image-verify "${IMAGE}"
+
+	# No modifications.
+	umoci edit-history --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Out of range.
+	umoci edit-history --image "${IMAGE}:${TAG}" --entry 1000 --comment "x"
+	[ "$status" -ne 0 ]
+
+	# Bad values.
+	umoci edit-history --image "${IMAGE}:${TAG}" --entry 0 --empty-layer "maybe"
+	[ "$status" -ne 0 ]
+	umoci edit-history --image "${IMAGE}:${TAG}" --replace "nothing"
+	[ "$status" -ne 0 ]
+	umoci edit-history --image "${IMAGE}:${TAG}" --created "yesterday"
+	[ "$status" -ne 0 ]
+
+	# Every layer must keep a history entry.
+	umoci edit-history --image "${IMAGE}:${TAG}" --empty-layer true
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
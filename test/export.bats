@@ -0,0 +1,95 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci export [invalid arguments]" {
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+
+	# Missing --output.
+	umoci export --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	# Unknown formats.
+	umoci export --image "${IMAGE}:${TAG}" --format tarball -o "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	# Invalid repository tags.
+	umoci export --image "${IMAGE}:${TAG}" --repo-tag "image@sha256:invalid" -o "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}" --format oci-archive --repo-tag "image:latest" -o "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	# Missing tags.
+	umoci export --image "${IMAGE}:${TAG}-nonexistent" -o "$ARCHIVE"
+	[ "$status" -ne 0 ]
+	[ ! -e "$ARCHIVE" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export --format docker-archive" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" --repo-tag "example.com/image:exported" -o "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+
+	# The archive must have a manifest.json referencing its contents.
+	sane_run tar -xf "$ARCHIVE_DIR/image.tar" -C "$ARCHIVE_DIR"
+	[ "$status" -eq 0 ]
+	sane_run jq -r '.[0].RepoTags[0]' "$ARCHIVE_DIR/manifest.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "example.com/image:exported" ]]
+	sane_run jq -r '.[0].Config' "$ARCHIVE_DIR/manifest.json"
+	[ "$status" -eq 0 ]
+	[ -f "$ARCHIVE_DIR/$output" ]
+	for layer in $(jq -r '.[0].Layers[]' "$ARCHIVE_DIR/manifest.json"); do
+		# Layers are stored uncompressed under their diff_id.
+		sane_run sha256sum "$ARCHIVE_DIR/$layer"
+		[ "$status" -eq 0 ]
+		[[ "$layer" == "${output%% *}/layer.tar" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci export --format oci-archive" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	umoci export --image "${IMAGE}:${TAG}" --format oci-archive -o "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+
+	# The archive is a valid image layout containing only the exported tag.
+	sane_run tar -xf "$ARCHIVE_DIR/image.tar" -C "$ARCHIVE_DIR"
+	[ "$status" -eq 0 ]
+	image-verify "$ARCHIVE_DIR"
+
+	umoci ls --layout "$ARCHIVE_DIR"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "$TAG" ]]
+
+	umoci verify --layout "$ARCHIVE_DIR"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -184,3 +184,108 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci gc --dry-run" {
+	image-verify "${IMAGE}"
+
+	# Initial gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# Modify the image so that the old config and manifest are unreferenced.
+	umoci config --image "${IMAGE}:${TAG}" --author="Some Author"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt "$nblobs" ]
+	nblobs="${#lines[@]}"
+
+	# A dry-run lists the unreferenced blobs without removing them.
+	umoci gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	for line in "${lines[@]}"; do
+		[[ "$line" == "sha256:"* ]]
+		[ -f "$IMAGE/blobs/sha256/${line#sha256:}" ]
+	done
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci gc --keep-newer-than" {
+	image-verify "${IMAGE}"
+
+	umoci gc --layout "${IMAGE}" --keep-newer-than -1h
+	[ "$status" -ne 0 ]
+
+	# Modify the image so that the old config and manifest are unreferenced.
+	umoci config --image "${IMAGE}:${TAG}" --author="Some Author"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# The unreferenced blobs are recent, so they are kept.
+	umoci gc --layout "${IMAGE}" --keep-newer-than 1h
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Without the policy they are removed.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -lt "$nblobs" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci gc --keep-tagged-history" {
+	image-verify "${IMAGE}"
+
+	umoci gc --layout "${IMAGE}" --keep-tagged-history -1
+	[ "$status" -ne 0 ]
+
+	# Modify the image, recording the previous image of the tag.
+	umoci config --image "${IMAGE}:${TAG}" --author="Some Author"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The previous image is kept, so it can still be restored.
+	umoci gc --layout "${IMAGE}" --keep-tagged-history 1
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Without the policy the previous image is removed.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -74,6 +74,78 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci repack"+ ]]
 
+	umoci squash --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci squash"+ ]]
+
+	umoci squash -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci squash"+ ]]
+
+	umoci remove-layer --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci remove-layer"+ ]]
+
+	umoci replace-layer --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci replace-layer"+ ]]
+
+	umoci reorder-layers --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci reorder-layers"+ ]]
+
+	umoci edit-history --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci edit-history"+ ]]
+
+	umoci recompress --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci recompress"+ ]]
+
+	umoci normalize --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci normalize"+ ]]
+
+	umoci convert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci convert"+ ]]
+
+	umoci pull --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci pull"+ ]]
+
+	umoci push --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci push"+ ]]
+
+	umoci export --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci export"+ ]]
+
+	umoci import --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci import"+ ]]
+
+	umoci mount --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci mount"+ ]]
+
+	umoci unmount --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci unmount"+ ]]
+
+	umoci run --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci run"+ ]]
+
+	umoci shell --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci shell"+ ]]
+
+	umoci build --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci build"+ ]]
+
 	umoci new --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci new"+ ]]
@@ -90,6 +162,22 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci tag"+ ]]
 
+	umoci index --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index"+ ]]
+
+	umoci index add --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index add"+ ]]
+
+	umoci index remove --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index remove"+ ]]
+
+	umoci index set --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci index set"+ ]]
+
 	umoci raw --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci raw"+ ]]
@@ -138,6 +226,18 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci inspect --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci inspect"+ ]]
+
+	umoci inspect -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci inspect"+ ]]
+
+	umoci diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -146,6 +246,26 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
 
+	umoci verify --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify"+ ]]
+
+	umoci sign --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci sign"+ ]]
+
+	umoci verify-signature --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci verify-signature"+ ]]
+
+	umoci rollback --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rollback"+ ]]
+
+	umoci dedupe --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci dedupe"+ ]]
+
 	umoci init --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci init"+ ]]
@@ -162,11 +282,115 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci list"+ ]]
 
-	umoci ls --help
+	umoci list-tags --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci list"+ ]]
 
-	umoci ls -h
+	umoci list-tags -h
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci list"+ ]]
+
+	umoci ls --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci ls"+ ]]
+
+	umoci ls -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci ls"+ ]]
+
+	umoci cat --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci cat"+ ]]
+
+	umoci extract --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci extract"+ ]]
+
+	umoci watch --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
+	umoci watch -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci watch"+ ]]
+
+	umoci completion --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci completion"+ ]]
+
+	umoci completion -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci completion"+ ]]
+
+	umoci prune --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci prune"+ ]]
+
+	umoci prune -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci prune"+ ]]
+
+	umoci rename --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rename"+ ]]
+
+	umoci rename -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci rename"+ ]]
+
+	umoci history --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci history"+ ]]
+
+	umoci history -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci history"+ ]]
+
+	umoci compare-config --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci compare-config"+ ]]
+
+	umoci compare-config -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci compare-config"+ ]]
+
+	umoci validate --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci validate"+ ]]
+
+	umoci validate -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci validate"+ ]]
+
+	umoci serve --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci serve -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci serve"+ ]]
+
+	umoci attach --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci attach"+ ]]
+
+	umoci attach -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci attach"+ ]]
+
+	umoci referrers --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci referrers -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci referrers"+ ]]
+
+	umoci insert --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
+
+	umoci insert -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci insert"+ ]]
 }
@@ -0,0 +1,140 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci history" {
+	image-verify "${IMAGE}"
+
+	# Add an empty entry.
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nobody" --history.comment="history-test"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# The most recent entry is shown first, and is empty.
+	[[ "${lines[0]}" == "LAYER"* ]]
+	[[ "${lines[1]}" == "<empty>"* ]]
+	[[ "${lines[1]}" == *"history-test"* ]]
+
+	# The history has the same entries as umoci-stat(1).
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+	sane_run jq -SMr '.history | length' "$statFile"
+	[ "$status" -eq 0 ]
+	nentries="$output"
+
+	umoci history --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$(($nentries + 1))" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history --json" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	umoci history --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	historyFile="$(setup_tmpdir)/history"
+	echo "$output" > "$historyFile"
+
+	# The entries are the same as umoci-stat(1), but most recent first.
+	sane_run jq -SMc '.history | reverse' "$statFile"
+	[ "$status" -eq 0 ]
+	expected="$output"
+	sane_run jq -SMc '.' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# Every non-empty entry has a layer and a diff_id.
+	sane_run jq -SMr '[.[] | select(.empty_layer != true) | .layer != null and .diff_id != ""] | all' "$historyFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history --format" {
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	historyFile="$(setup_tmpdir)/history"
+	echo "$output" > "$historyFile"
+
+	umoci history --image "${IMAGE}:${TAG}" --format '{{.CreatedBy | json}}'
+	[ "$status" -eq 0 ]
+	formatOutput="$output"
+	sane_run jq -SMc '.[].created_by' "$historyFile"
+	[[ "$formatOutput" == "$output" ]]
+
+	# --format and --json are mutually exclusive.
+	umoci history --image "${IMAGE}:${TAG}" --format '{{.DiffID}}' --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history --no-trunc" {
+	image-verify "${IMAGE}"
+
+	umoci history --image "${IMAGE}:${TAG}" --no-trunc
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"sha256:"* ]]
+
+	umoci history --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"sha256:"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci history [missing args]" {
+	umoci history
+	[ "$status" -ne 0 ]
+
+	umoci history --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+}
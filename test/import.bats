@@ -0,0 +1,91 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci import [invalid arguments]" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	# Missing archive.
+	umoci import --image "${IMAGE}:imported"
+	[ "$status" -ne 0 ]
+	umoci import --image "${IMAGE}:imported" ""
+	[ "$status" -ne 0 ]
+	umoci import --image "${IMAGE}:imported" "$ARCHIVE_DIR/nonexistent.tar"
+	[ "$status" -ne 0 ]
+
+	# Unknown formats.
+	umoci export --image "${IMAGE}:${TAG}" -o "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+	umoci import --image "${IMAGE}:imported" --format tarball "$ARCHIVE_DIR/image.tar"
+	[ "$status" -ne 0 ]
+	umoci import --image "${IMAGE}:imported" --format oci-archive "$ARCHIVE_DIR/image.tar"
+	[ "$status" -ne 0 ]
+
+	# Unknown names.
+	umoci import --image "${IMAGE}:imported" --archive-name nonexistent "$ARCHIVE_DIR/image.tar"
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"imported"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci import [round-trip]" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+	NEW_IMAGE="$(setup_tmpdir)/image"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	ORIGINAL="$output"
+
+	for format in docker-archive oci-archive; do
+		umoci export --image "${IMAGE}:${TAG}" --format "$format" -o "$ARCHIVE_DIR/$format.tar"
+		[ "$status" -eq 0 ]
+
+		# The format is detected automatically, and the archive can be
+		# read from stdin.
+		umoci import --image "${NEW_IMAGE}:$format" - <"$ARCHIVE_DIR/$format.tar"
+		[ "$status" -eq 0 ]
+		image-verify "${NEW_IMAGE}"
+
+		# The history must be unchanged (though layers may be recompressed).
+		umoci stat --image "${NEW_IMAGE}:$format" --json
+		[ "$status" -eq 0 ]
+		[[ "$(jq -S '[.history[] | del(.layer)]' <<<"$output")" == "$(jq -S '[.history[] | del(.layer)]' <<<"$ORIGINAL")" ]]
+	done
+
+	# The blobs of an oci-archive are imported verbatim.
+	umoci stat --image "${NEW_IMAGE}:oci-archive" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$ORIGINAL" ]]
+
+	umoci verify --layout "${NEW_IMAGE}"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,151 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# index_entries prints the entries of the image index that the given tag refers
+# to, as compact JSON.
+function index_entries() {
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	jq -SMc '.manifests' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+}
+
+@test "umoci index add" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm" --architecture=arm --os=linux
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-amd64" --architecture=amd64 --os=linux
+	[ "$status" -eq 0 ]
+
+	# Create a new index, taking the platform from the configuration.
+	umoci index add --image "${IMAGE}:release" "${TAG}-amd64"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v7 --os.version 1.0 --annotation tier=2 "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run index_entries release
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr 'length')" == 2 ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].platform | "\(.os)/\(.architecture)"')" == "linux/amd64" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].platform | "\(.os)/\(.architecture)/\(.variant)/\(.["os.version"])"')" == "linux/arm/v7/1.0" ]]
+	[[ "$(echo "$output" | jq -SMr '.[1].annotations.tier')" == 2 ]]
+
+	# Platforms cannot be added twice.
+	umoci index add --image "${IMAGE}:release" "${TAG}-amd64"
+	[ "$status" -ne 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v7 --os.version 1.0 "${TAG}-arm"
+	[ "$status" -ne 0 ]
+
+	# The source must exist and be a single manifest.
+	umoci index add --image "${IMAGE}:release" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+	umoci index add --image "${IMAGE}:other" release
+	[ "$status" -ne 0 ]
+
+	# Each platform can be modified separately.
+	umoci config --image "${IMAGE}:release" --platform linux/arm --config.user "arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Tags referring to a manifest are converted to an index.
+	umoci index add --image "${IMAGE}:${TAG}-amd64" --tag wrapped "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run index_entries wrapped
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.[].platform.architecture] | join(",")')" == "amd64,arm" ]]
+}
+
+@test "umoci index remove" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm" --architecture=arm --os=linux
+	[ "$status" -eq 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-amd64" --architecture=amd64 --os=linux
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" "${TAG}-amd64"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v6 "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v7 "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only indexes can be modified.
+	umoci index remove --image "${IMAGE}:${TAG}" linux/amd64
+	[ "$status" -ne 0 ]
+	# Invalid platforms.
+	umoci index remove --image "${IMAGE}:release" linux
+	[ "$status" -ne 0 ]
+	umoci index remove --image "${IMAGE}:release" linux/ppc64le
+	[ "$status" -ne 0 ]
+
+	# Without a variant, every variant is removed.
+	umoci index remove --image "${IMAGE}:release" --tag release-amd64 linux/arm
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run index_entries release-amd64
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.[].platform.architecture] | join(",")')" == "amd64" ]]
+
+	umoci index remove --image "${IMAGE}:release" linux/arm/v6
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run index_entries release
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.[].platform | "\(.architecture)\(.variant // "")"] | join(",")')" == "amd64,armv7" ]]
+}
+
+@test "umoci index set" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm" --architecture=arm --os=linux
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v6 "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v7 --annotation a=b "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Nothing to modify.
+	umoci index set --image "${IMAGE}:release" linux/arm/v7
+	[ "$status" -ne 0 ]
+	# The platform must match exactly one entry.
+	umoci index set --image "${IMAGE}:release" --os.version 1.0 linux/arm
+	[ "$status" -ne 0 ]
+	# The platforms must remain unique.
+	umoci index set --image "${IMAGE}:release" --variant v6 linux/arm/v7
+	[ "$status" -ne 0 ]
+
+	umoci index set --image "${IMAGE}:release" --variant v8 --os.version 1.0 --annotation c=d --annotation.remove a linux/arm/v7
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run index_entries release
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.[1].platform | "\(.variant)/\(.["os.version"])"')" == "v8/1.0" ]]
+	[[ "$(echo "$output" | jq -SMc '.[1].annotations')" == '{"c":"d"}' ]]
+	[[ "$(echo "$output" | jq -SMr '.[0].platform.variant')" == "v6" ]]
+}
@@ -0,0 +1,131 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci insert [invalid arguments]" {
+	SOURCE="$(setup_tmpdir)"
+	echo "file" > "$SOURCE/file"
+	tar -C "$SOURCE" -cf "$SOURCE/archive.tar" file
+
+	# Missing or extra arguments.
+	umoci insert --image "${IMAGE}:${TAG}" "$SOURCE"
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" "$SOURCE" /target extra
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$SOURCE/archive.tar" "$SOURCE" /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar "" /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$SOURCE/archive.tar" --from-stdin /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$SOURCE/archive.tar" --rootless /target
+	[ "$status" -ne 0 ]
+	# Non-existent source, archive and tag.
+	umoci insert --image "${IMAGE}:${TAG}" "$SOURCE/nonexistent" /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$SOURCE/nonexistent.tar" /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}-nonexistent" "$SOURCE" /target
+	[ "$status" -ne 0 ]
+	# A file cannot be opaque, or replace the root.
+	umoci insert --image "${IMAGE}:${TAG}" --opaque "$SOURCE/file" /target
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" "$SOURCE/file" /
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	mkdir -p "$SOURCE/dir/sub"
+	echo "inserted file" > "$SOURCE/file"
+	echo "inserted sub file" > "$SOURCE/dir/sub/file"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" "$SOURCE/file" /etc/inserted
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci insert --image "${IMAGE}:${TAG}-new" --history.comment "insert dir" "$SOURCE/dir" /opt/inserted
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Each insert adds a layer with a history entry.
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$(($numLayers + 2))" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-2].created_by')" == "umoci insert $SOURCE/file /etc/inserted" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "insert dir" ]]
+
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	diff -u "$SOURCE/file" "$BUNDLE/bundle/rootfs/etc/inserted"
+	diff -u "$SOURCE/dir/sub/file" "$BUNDLE/bundle/rootfs/opt/inserted/sub/file"
+}
+
+@test "umoci insert --tar" {
+	SOURCE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	mkdir -p "$SOURCE/build/bin" "$SOURCE/other"
+	echo "tool" > "$SOURCE/build/bin/tool"
+	echo "other" > "$SOURCE/other/file"
+	tar -C "$SOURCE/build" -cf "$SOURCE/build.tar" .
+	tar -C "$SOURCE/other" -cf "$SOURCE/other.tar" .
+
+	umoci insert --image "${IMAGE}:${TAG}" --tar "$SOURCE/build.tar" /opt/tool
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Merge another archive (from stdin) into the same directory.
+	sane_run bash -c "'$UMOCI' insert --image '${IMAGE}:${TAG}' --from-stdin /opt/tool < '$SOURCE/other.tar'"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE/merged"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/merged"
+	diff -u "$SOURCE/build/bin/tool" "$BUNDLE/merged/rootfs/opt/tool/bin/tool"
+	diff -u "$SOURCE/other/file" "$BUNDLE/merged/rootfs/opt/tool/file"
+
+	# With --opaque, only the new archive is left.
+	sane_run bash -c "'$UMOCI' insert --image '${IMAGE}:${TAG}' --tar - --opaque /opt/tool < '$SOURCE/other.tar'"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE/opaque"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/opaque"
+	diff -u "$SOURCE/other/file" "$BUNDLE/opaque/rootfs/opt/tool/file"
+	! [ -e "$BUNDLE/opaque/rootfs/opt/tool/bin" ]
+}
@@ -0,0 +1,123 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci inspect [missing args]" {
+	umoci inspect
+	[ "$status" -ne 0 ]
+
+	umoci inspect --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+
+	umoci inspect --image "${IMAGE}:${TAG}" --type layers
+	[ "$status" -ne 0 ]
+
+	umoci inspect --image "${IMAGE}:${TAG}" --raw
+	[ "$status" -ne 0 ]
+
+	umoci inspect --image "${IMAGE}:${TAG}" --type descriptor --raw
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci inspect" {
+	image-verify "${IMAGE}"
+
+	umoci inspect --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	inspectOutput="$output"
+
+	# The descriptor is the entry in the index.
+	manifestDigest="$(echo "$inspectOutput" | jq -SMr '.descriptor.digest')"
+	sane_run jq -SMr --arg tag "${TAG}" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$manifestDigest" ]]
+
+	# The tag refers to a manifest directly.
+	[[ "$(echo "$inspectOutput" | jq -SMr '.index')" == "null" ]]
+	umoci inspect --image "${IMAGE}:${TAG}" --type index
+	[ "$status" -ne 0 ]
+
+	# The documents match the blobs.
+	sane_run jq -SMc . "$IMAGE/blobs/sha256/${manifestDigest#sha256:}"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$inspectOutput" | jq -SMc '.manifest')" == "$output" ]]
+
+	configDigest="$(echo "$inspectOutput" | jq -SMr '.manifest.config.digest')"
+	sane_run jq -SMc . "$IMAGE/blobs/sha256/${configDigest#sha256:}"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$inspectOutput" | jq -SMc '.config')" == "$output" ]]
+
+	umoci inspect --image "${IMAGE}:${TAG}" --type config
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMc .)" == "$(echo "$inspectOutput" | jq -SMc '.config')" ]]
+
+	# --raw outputs the blob unmodified (the output is piped because bats strips
+	# trailing newlines from $output).
+	umoci inspect --image "${IMAGE}:${TAG}" --type manifest --raw
+	[ "$status" -eq 0 ]
+	sane_run bash -c "'$UMOCI' inspect --image '${IMAGE}:${TAG}' --type manifest --raw | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "${output%% *}" == "${manifestDigest#sha256:}" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci inspect --platform" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm" --architecture arm
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" "${TAG}"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:release" --platform linux/arm/v7 "${TAG}-arm"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The tag is ambiguous without --platform.
+	umoci inspect --image "${IMAGE}:release"
+	[ "$status" -ne 0 ]
+
+	umoci inspect --image "${IMAGE}:release" --platform linux/arm/v7
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.config.architecture')" == "arm" ]]
+	[ "$(echo "$output" | jq -SMr '.index.manifests | length')" -eq 2 ]
+	indexDigest="$(echo "$output" | jq -SMr '.descriptor.digest')"
+
+	umoci inspect --image "${IMAGE}:release" --platform linux/arm/v7 --type index --raw
+	[ "$status" -eq 0 ]
+	sane_run bash -c "'$UMOCI' inspect --image '${IMAGE}:release' --platform linux/arm/v7 --type index --raw | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "${output%% *}" == "${indexDigest#sha256:}" ]]
+
+	umoci inspect --image "${IMAGE}:release" --all-platforms --type config
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SMr 'length')" -eq 2 ]
+
+	umoci inspect --image "${IMAGE}:release" --all-platforms --type config --raw
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,110 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci --json [modify tags]" {
+	umoci --json config --image "${IMAGE}:${TAG}" --tag "${TAG}-json" --config.env="A=1"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.tag' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}-json" ]]
+
+	# The descriptor is the tag's entry in the index.
+	umoci --json tag --image "${IMAGE}:${TAG}-json" "${TAG}-json2"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.descriptor.digest' <<<"$output"
+	[ "$status" -eq 0 ]
+	digest="$output"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-json"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$digest" ]]
+
+	# Removed tags have a null descriptor.
+	umoci --json rm --image "${IMAGE}:${TAG}-json2"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == '{"descriptor":null,"tag":"'"${TAG}-json2"'"}' ]]
+
+	# Without --json, nothing is output.
+	umoci config --image "${IMAGE}:${TAG}-json" --config.env="B=2"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --json [gc]" {
+	umoci rm --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	umoci --json gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.dry_run' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	umoci --json gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.dry_run, (.removed | length > 0)' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "false" ]]
+	[[ "${lines[1]}" == "true" ]]
+
+	# Nothing left to remove.
+	umoci --json gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.removed' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "[]" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --json [listing commands]" {
+	# The global flag is the same as the command's own --json.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	expected="$output"
+	umoci --json stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	umoci list --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	expected="$output"
+	umoci --json list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# --format cannot be used with the global --json.
+	umoci --json stat --image "${IMAGE}:${TAG}" --format '{{.}}'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
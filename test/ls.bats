@@ -0,0 +1,130 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci ls [invalid arguments]" {
+	umoci ls
+	[ "$status" -ne 0 ]
+
+	umoci ls --image "${IMAGE}:${TAG}" --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci ls --image "${IMAGE}:${TAG}" /etc /usr
+	[ "$status" -ne 0 ]
+
+	umoci ls --layout "${IMAGE}" /etc
+	[ "$status" -ne 0 ]
+
+	umoci ls --image "${IMAGE}:${TAG}" /umoci-nonexistent
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci ls --layout" {
+	# ls --layout is the same as list.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	lsOutput="$output"
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$lsOutput" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci ls --image" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The listing matches the unpacked rootfs.
+	umoci ls --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	lsFiles="$(setup_tmpdir)/ls"
+	echo "$output" > "$lsFiles"
+	sane_run find "$BUNDLE/rootfs" -mindepth 1 -printf '/%P\n'
+	[ "$status" -eq 0 ]
+	findFiles="$(setup_tmpdir)/find"
+	echo "$output" | LC_ALL=C sort > "$findFiles"
+	LC_ALL=C sort "$lsFiles" | diff -u "$findFiles" -
+
+	# Modify the image.
+	echo "umoci ls" > "$BUNDLE/rootfs/etc/umoci-ls"
+	rm -rf "$BUNDLE/rootfs/etc/shadow"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Whiteouts are applied and the path is restricted.
+	umoci ls --image "${IMAGE}:${TAG}-new" /etc
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "/etc" ]]
+	echo "$output" | grep -Fx '/etc/umoci-ls'
+	! echo "$output" | grep -Fx '/etc/shadow'
+	! echo "$output" | grep -v '^/etc'
+
+	# The new file comes from the new layer.
+	umoci ls --verbose --image "${IMAGE}:${TAG}-new" /etc/umoci-ls
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	echo "$output" | grep -E '^-rw-r--r-- +0:0 +9 ?B +/etc/umoci-ls'
+
+	umoci ls --json --image "${IMAGE}:${TAG}-new" /etc/umoci-ls
+	[ "$status" -eq 0 ]
+	lsJSON="$(setup_tmpdir)/ls.json"
+	echo "$output" > "$lsJSON"
+	umoci stat --json --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '.history | map(select(.layer != null)) | length')"
+	sane_run jq -SMr '.[0].type + " " + (.[0].size | tostring) + " " + (.[0].layer | tostring)' "$lsJSON"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "file 9 $((nlayers - 1))" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci ls --format" {
+	umoci ls --image "${IMAGE}:${TAG}" /etc
+	[ "$status" -eq 0 ]
+	lsOutput="$output"
+
+	umoci ls --image "${IMAGE}:${TAG}" --format '/{{.Path}}' /etc
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$lsOutput" ]]
+
+	umoci ls --image "${IMAGE}:${TAG}" --format '{{.Type}} {{.Size}}' /etc/passwd
+	[ "$status" -eq 0 ]
+	[[ "$output" == "file "* ]]
+
+	umoci ls --image "${IMAGE}:${TAG}" --format '{{.Path}}' --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,82 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci mount [invalid arguments]" {
+	# Missing mountpoint.
+	umoci mount --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci mount --image "${IMAGE}:${TAG}" ""
+	[ "$status" -ne 0 ]
+	umoci unmount
+	[ "$status" -ne 0 ]
+
+	# Invalid options.
+	umoci mount --image "${IMAGE}:${TAG}" --workers 0 "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+	umoci mount --image "${IMAGE}:${TAG}-nonexistent" "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	# Not a mountpoint.
+	umoci unmount "$(setup_tmpdir)"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci mount" {
+	requires root
+
+	MOUNTPOINT="$(setup_tmpdir)"
+	STORE="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci mount --image "${IMAGE}:${TAG}" --overlay-store "$STORE" "$MOUNTPOINT"
+	[ "$status" -eq 0 ]
+
+	# The mount has the same contents as an unpacked rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run diff -r --no-dereference "$BUNDLE/rootfs" "$MOUNTPOINT"
+	[ "$status" -eq 0 ]
+
+	# The mount is read-only.
+	sane_run touch "$MOUNTPOINT/new-file"
+	[ "$status" -ne 0 ]
+
+	umoci unmount "$MOUNTPOINT"
+	[ "$status" -eq 0 ]
+	[ -z "$(ls -A "$MOUNTPOINT")" ]
+
+	# Layers are re-used from the store.
+	umoci mount --image "${IMAGE}:${TAG}" --overlay-store "$STORE" "$MOUNTPOINT"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"reusing extracted layer"* ]]
+	umoci unmount "$MOUNTPOINT"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
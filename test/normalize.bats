@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci normalize [invalid arguments]" {
+	umoci normalize --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+	umoci normalize --image "${IMAGE}:${TAG}" --clamp-time not-a-time
+	[ "$status" -ne 0 ]
+	umoci normalize --image "${IMAGE}:${TAG}" --layer-format lzma
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci normalize" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMc '.rootfs' "$config"
+	[ "$status" -eq 0 ]
+	rootfs="$output"
+
+	# Normalize the image, which must not change the diff_ids.
+	umoci normalize --image "${IMAGE}:${TAG}" --tag "${TAG}-normalized" --clamp-time 1990-01-01T00:00:00Z
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "BLOB"* ]]
+	[[ "${lines[1]}" == "manifest"* ]]
+	[[ "${lines[2]}" == "config"* ]]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-normalized"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMc '.rootfs' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$rootfs" ]]
+
+	# Every timestamp must be clamped.
+	sane_run jq -SMr '[.created, .history[]?.created] | map(select(. != null and . > "1990-01-01T00:00:00Z")) | length' "$config"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# Rewrite the layers too, after which normalizing again must be a no-op.
+	umoci normalize --image "${IMAGE}:${TAG}-normalized" --clamp-time 1990-01-01T00:00:00Z --rewrite-layers
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-normalized"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	normalized="$output"
+
+	umoci normalize --image "${IMAGE}:${TAG}-normalized" --clamp-time 1990-01-01T00:00:00Z --rewrite-layers
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-normalized"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$normalized" ]]
+
+	# The normalized image must have the same contents.
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}-normalized" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
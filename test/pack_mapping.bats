@@ -122,3 +122,72 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci unpack [multiple --uid-map --gid-map ranges]" {
+	# We do a bunch of remapping tricks, which we can't really do if we're not root.
+	requires root
+
+	image-verify "${IMAGE}"
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Unpack the image with several ranges (in one flag and across flags).
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65534,65534:65534:1" --gid-map "0:200000:1000" --gid-map "1000:1000:1" --gid-map "1001:201001:64534" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# The mappings are stored in the bundle and the runtime config.
+	sane_run jq -SMr '.map_options.uid_mappings | length' "$BUNDLE_A/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2" ]]
+	sane_run jq -SMr '.linux.gidMappings | length' "$BUNDLE_A/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "3" ]]
+
+	# Create files owned by IDs in each of the ranges.
+	echo "first range" > "$BUNDLE_A/rootfs/first range"
+	chown "101000:200100" "$BUNDLE_A/rootfs/first range"
+	echo "nobody" > "$BUNDLE_A/rootfs/nobody"
+	chown "65534:1000" "$BUNDLE_A/rootfs/nobody"
+	echo "last range" > "$BUNDLE_A/rootfs/last range"
+	chown "100000:202000" "$BUNDLE_A/rootfs/last range"
+
+	# Repack the image using the same mappings.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack it with no mapping, and check the owners were reverse-mapped.
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/first range"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1000:100" ]]
+	sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/nobody"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "65534:1000" ]]
+	sane_run stat -c '%u:%g' "$BUNDLE_B/rootfs/last range"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0:2000" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [invalid --uid-map ranges]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Overlapping ranges are ambiguous.
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:65536,65534:65534:1" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --gid-map "0:100000:10" --gid-map "100:100005:10" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Empty ranges are not permitted.
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:100000:0" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,151 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci prune [missing args]" {
+	umoci prune
+	[ "$status" -ne 0 ]
+
+	# A policy must be given.
+	umoci prune --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --match '[abc'
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --older-than -1h
+	[ "$status" -ne 0 ]
+
+	umoci prune --layout "${IMAGE}" --match '*' --gc --dry-run
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci prune --match" {
+	image-verify "${IMAGE}"
+
+	umoci tag --image "${IMAGE}:${TAG}" ci-1
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" ci-2
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" release
+	[ "$status" -eq 0 ]
+
+	# Nothing is removed with --dry-run.
+	umoci prune --layout "${IMAGE}" --match 'ci-*' --dry-run
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[*]}" == *"ci-1"* ]]
+	[[ "${lines[*]}" == *"ci-2"* ]]
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"ci-1"* ]]
+
+	umoci prune --layout "${IMAGE}" --match 'ci-*' --match 'release'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "$output" == "${TAG}" ]]
+}
+
+@test "umoci prune --older-than" {
+	image-verify "${IMAGE}"
+
+	# An old tag and a fresh tag.
+	umoci config --image "${IMAGE}:${TAG}" --created "2000-01-01T00:00:00Z" --tag old
+	[ "$status" -eq 0 ]
+	umoci new --image "${IMAGE}:fresh"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci prune --layout "${IMAGE}" --match 'old' --match 'fresh' --older-than 24h
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"old"* ]]
+	[[ "$output" == *"fresh"* ]]
+	[[ "$output" == *"${TAG}"* ]]
+
+	# Nothing is older than a century.
+	umoci prune --layout "${IMAGE}" --older-than 876000h --dry-run
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci prune --rollback-only" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nobody"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci prune --layout "${IMAGE}" --rollback-only
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The tag is kept, but can no longer be rolled back.
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"${TAG}"* ]]
+
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci prune --gc" {
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nobody" --tag pruned
+	[ "$status" -eq 0 ]
+
+	umoci --json prune --layout "${IMAGE}" --match pruned --gc
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.pruned[]' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "pruned" ]]
+
+	# The blobs of the pruned tag were removed, so another gc does nothing.
+	umoci gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
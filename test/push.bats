@@ -0,0 +1,66 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci push [invalid arguments]" {
+	# Missing destination.
+	umoci push --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci push --image "${IMAGE}:${TAG}" ""
+	[ "$status" -ne 0 ]
+
+	# Invalid references.
+	umoci push --image "${IMAGE}:${TAG}" docker://UPPERCASE/image
+	[ "$status" -ne 0 ]
+
+	# Invalid chunk sizes.
+	umoci push --image "${IMAGE}:${TAG}" --chunk-size invalid --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+	umoci push --image "${IMAGE}:${TAG}" --chunk-size 0 --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+
+	# Invalid retries and resume files.
+	umoci push --image "${IMAGE}:${TAG}" --chunk-size 1MB --retries -1 --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+	umoci push --image "${IMAGE}:${TAG}" --resume-file "$BATS_TMPDIR/resume.json" --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+	umoci push --image "${IMAGE}:${TAG}" --chunk-size 1MB --resume-file "" --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+
+	# Invalid formats.
+	umoci push --image "${IMAGE}:${TAG}" --format invalid --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+
+	# Missing tags.
+	umoci push --image "${IMAGE}:${TAG}-nonexistent" --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+
+	# Unreachable registries are reported.
+	umoci push --image "${IMAGE}:${TAG}" --plain-http docker://localhost:1/image
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,125 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw add-blob [missing args]" {
+	umoci raw add-blob --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci raw cat-blob --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci raw stat-blob --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci raw rm-blob --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+
+	umoci raw cat-blob --layout "${IMAGE}" not-a-digest
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw add-blob" {
+	INPUT_DIR="$(setup_tmpdir)"
+	echo "some blob contents" > "$INPUT_DIR/blob"
+	expected="sha256:$(sha256sum "$INPUT_DIR/blob" | cut -d' ' -f1)"
+
+	# Add the blob from a file and from stdin.
+	umoci raw add-blob --layout "${IMAGE}" "$INPUT_DIR/blob"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+	[ -f "$IMAGE/blobs/sha256/${expected#sha256:}" ]
+
+	sane_run bash -c "'$UMOCI' raw add-blob --layout '$IMAGE' - < '$INPUT_DIR/blob'"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+	image-verify "${IMAGE}"
+
+	# The contents are unchanged.
+	sane_run bash -c "'$UMOCI' raw cat-blob --layout '$IMAGE' '$expected' | cmp - '$INPUT_DIR/blob'"
+	[ "$status" -eq 0 ]
+
+	# The blob is not referenced by anything.
+	umoci raw stat-blob --layout "${IMAGE}" --json "$expected"
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SMr '.size')" -eq "$(stat -c '%s' "$INPUT_DIR/blob")" ]
+	[[ "$(echo "$output" | jq -SMr '.verified')" == "true" ]]
+	[ "$(echo "$output" | jq -SMr '.references | length')" -eq 0 ]
+
+	umoci raw stat-blob --layout "${IMAGE}" "$expected"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"$expected"* ]]
+
+	# So it can be removed.
+	umoci raw rm-blob --layout "${IMAGE}" "$expected"
+	[ "$status" -eq 0 ]
+	! [ -e "$IMAGE/blobs/sha256/${expected#sha256:}" ]
+	image-verify "${IMAGE}"
+
+	umoci raw cat-blob --layout "${IMAGE}" "$expected"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci raw cat-blob [corrupted]" {
+	INPUT_DIR="$(setup_tmpdir)"
+	echo "some blob contents" > "$INPUT_DIR/blob"
+
+	umoci raw add-blob --layout "${IMAGE}" "$INPUT_DIR/blob"
+	[ "$status" -eq 0 ]
+	blobDigest="$output"
+
+	# Corrupt the blob.
+	echo "other contents" > "$IMAGE/blobs/sha256/${blobDigest#sha256:}"
+
+	umoci raw cat-blob --layout "${IMAGE}" "$blobDigest"
+	[ "$status" -ne 0 ]
+
+	umoci raw stat-blob --layout "${IMAGE}" --json "$blobDigest"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.verified')" == "false" ]]
+}
+
+@test "umoci raw rm-blob [referenced]" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr --arg tag "${TAG}" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifestDigest="$output"
+
+	umoci raw stat-blob --layout "${IMAGE}" --json "$manifestDigest"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.references[]')" == *"${TAG}"* ]]
+
+	# Referenced blobs are not removed without --force.
+	umoci raw rm-blob --layout "${IMAGE}" "$manifestDigest"
+	[ "$status" -ne 0 ]
+	[ -f "$IMAGE/blobs/sha256/${manifestDigest#sha256:}" ]
+	image-verify "${IMAGE}"
+
+	umoci raw rm-blob --layout "${IMAGE}" --force "$manifestDigest"
+	[ "$status" -eq 0 ]
+	! [ -e "$IMAGE/blobs/sha256/${manifestDigest#sha256:}" ]
+}
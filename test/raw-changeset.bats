@@ -0,0 +1,94 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+@test "umoci raw changeset" {
+	BUNDLE="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	rm -rf "$BUNDLE/rootfs/etc"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	umoci raw changeset "$BUNDLE" "$LAYER"
+	[ "$status" -eq 0 ]
+
+	# The layer contains the changes (and whiteouts).
+	sane_run tar -tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *".wh.etc"* ]]
+	[[ "$(tar -xOf "$LAYER" newfile)" == "new file" ]]
+
+	# Writing to stdout gives the same layer.
+	sane_run bash -c "'$UMOCI' raw changeset '$BUNDLE' - | tar -t"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw changeset --from" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Change the second bundle.
+	rm -rf "$BUNDLE_B/rootfs/etc"
+	echo "new file" > "$BUNDLE_B/rootfs/newfile"
+
+	umoci raw changeset --from "$BUNDLE_A" "$BUNDLE_B" "$LAYER"
+	[ "$status" -eq 0 ]
+
+	sane_run tar -tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *".wh.etc"* ]]
+
+	# The reverse changeset restores the removed paths.
+	umoci raw changeset --from "$BUNDLE_B" "$BUNDLE_A" "$LAYER"
+	[ "$status" -eq 0 ]
+	sane_run tar -tf "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *".wh.newfile"* ]]
+	[[ "$output" == *"etc/"* ]]
+
+	image-verify "${IMAGE}"
+}
@@ -56,6 +56,30 @@ function teardown() {
 	[ -z "$output" ]
 }
 
+@test "umoci raw runtime-config --rootless=auto" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci raw runtime-config --rootless=auto --image "${IMAGE}:${TAG}" "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	# Enabling rootless mode must be reported (even with the default log
+	# level) and result in a rootless configuration.
+	expected=0
+	if [[ "$output" == *"--rootless=auto: enabling rootless mode:"* ]]; then
+		expected=1
+	fi
+	sane_run jq -SMr '.linux.uidMappings // [] | length' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# An unprivileged user always needs rootless mode.
+	if [[ "$ROOTLESS" != 0 ]]; then
+		[[ "$expected" == 1 ]]
+	fi
+}
+
 @test "umoci raw runtime-config [missing args]" {
 	umoci config
 	[ "$status" -ne 0 ]
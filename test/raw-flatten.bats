@@ -0,0 +1,72 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw flatten" {
+	BUNDLE="$(setup_tmpdir)"
+	ARCHIVE="$(setup_tmpdir)/rootfs.tar"
+
+	image-verify "${IMAGE}"
+
+	# Add a layer which removes and modifies some files.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	rm -rf "$BUNDLE/rootfs/etc"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Flatten the image to a file.
+	umoci raw flatten --image "${IMAGE}:${TAG}" "$ARCHIVE"
+	[ "$status" -eq 0 ]
+
+	# The archive has the same contents as the rootfs.
+	sane_run tar -tf "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	! grep -qE '^etc(/|$)' <<<"$output"
+	! [[ "$output" == *".wh."* ]]
+	[[ "$(tar -xOf "$ARCHIVE" newfile)" == "new file" ]]
+
+	# Flattening to stdout gives the same archive.
+	sane_run bash -c "'$UMOCI' raw flatten --image '${IMAGE}:${TAG}' - | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(sha256sum < "$ARCHIVE")" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw flatten [missing args]" {
+	umoci raw flatten --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	umoci raw flatten "$(setup_tmpdir)/rootfs.tar"
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,69 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci raw pack-layer" {
+	BUNDLE="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci raw changeset "$BUNDLE" "$LAYER"
+	[ "$status" -eq 0 ]
+
+	# Pack the layer from stdin.
+	sane_run bash -c "'$UMOCI' raw pack-layer --layout '$IMAGE' - < '$LAYER'"
+	[ "$status" -eq 0 ]
+	digest="$output"
+	[[ "$digest" == "sha256:"* ]]
+	[ -f "$IMAGE/blobs/sha256/${digest#sha256:}" ]
+
+	# Packing from a file gives the same blob.
+	umoci raw pack-layer --layout "${IMAGE}" "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$digest" ]]
+
+	# Dumping the blob gives back the original layer.
+	sane_run bash -c "'$UMOCI' raw dump-layer --layout '$IMAGE' --diff-id 'sha256:$(sha256sum "$LAYER" | cut -d' ' -f1)' '$digest' - | cmp - '$LAYER'"
+	[ "$status" -eq 0 ]
+
+	# A mismatched diff_id must fail (and not leave the output behind).
+	umoci raw dump-layer --layout "${IMAGE}" --diff-id "$digest" "$digest" "$LAYER.out"
+	[ "$status" -ne 0 ]
+	! [ -e "$LAYER.out" ]
+
+	# Unknown formats are rejected.
+	umoci raw pack-layer --layout "${IMAGE}" --layer-format invalid "$LAYER"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,75 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+@test "umoci raw reassemble" {
+	BUNDLE="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --tar-split --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The top layer can be reassembled byte-for-byte.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffid="$(echo "$output" | jq -SMr '.history | map(select(.diff_id)) | .[-1].diff_id')"
+
+	umoci raw reassemble "$BUNDLE" "$diffid" "$LAYER"
+	[ "$status" -eq 0 ]
+	[[ "sha256:$(sha256sum "$LAYER" | cut -d' ' -f1)" == "$diffid" ]]
+
+	# Reassembling to stdout gives the same layer.
+	sane_run bash -c "'$UMOCI' raw reassemble '$BUNDLE' '$diffid' - | sha256sum"
+	[ "$status" -eq 0 ]
+	[[ "sha256:${output%% *}" == "$diffid" ]]
+
+	# Once a file in the layer is modified, the layer cannot be reassembled.
+	file="$(tar -tvf "$LAYER" | awk '$1 ~ /^-/ && $3 > 0 { print $NF }' | head -n1)"
+	[ -n "$file" ]
+	echo "modified" >> "$BUNDLE/rootfs/$file"
+	umoci raw reassemble "$BUNDLE" "$diffid" "$LAYER"
+	[ "$status" -ne 0 ]
+	! [ -e "$LAYER" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci raw reassemble [no --tar-split]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	diffid="$(echo "$output" | jq -SMr '.history | map(select(.diff_id)) | .[-1].diff_id')"
+
+	umoci raw reassemble "$BUNDLE" "$diffid" -
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,216 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci recompress [invalid arguments]" {
+	# Invalid layers.
+	umoci recompress --image "${IMAGE}:${TAG}" 100000
+	[ "$status" -ne 0 ]
+	umoci recompress --image "${IMAGE}:${TAG}" not-a-layer
+	[ "$status" -ne 0 ]
+
+	# Unsupported formats.
+	umoci recompress --image "${IMAGE}:${TAG}" --layer-format zstd:chunked
+	[ "$status" -ne 0 ]
+	umoci recompress --image "${IMAGE}:${TAG}" --layer-format lzma
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '[.layers[].digest] | join(" ")' "$manifest"
+	[ "$status" -eq 0 ]
+	layers="$output"
+	sane_run jq -SMc '.history' "$config"
+	[ "$status" -eq 0 ]
+	history="$output"
+
+	# Recompress every layer as eStargz.
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-estargz" --layer-format estargz
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-estargz"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	# The layer blobs must be new, but the history must not change. The
+	# diff_ids change because eStargz adds a table of contents to each layer.
+	sane_run jq -SMr '.layers[].digest' "$manifest"
+	[ "$status" -eq 0 ]
+	for layer in "${lines[@]}"; do
+		[[ " $layers " != *" $layer "* ]]
+	done
+	sane_run jq -SMr '[.layers[] | select(.annotations["containerd.io/snapshot/stargz/toc.digest"] == null)] | length' "$manifest"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+	sane_run jq -SMc '.history' "$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$history" ]]
+	sane_run jq -SMc '.rootfs' "$config"
+	[ "$status" -eq 0 ]
+	rootfs="$output"
+
+	# Recompress only the top layer back to gzip.
+	umoci recompress --image "${IMAGE}:${TAG}-estargz" --layer-format gzip -- -1
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-estargz"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.layers[-1].annotations["containerd.io/snapshot/stargz/toc.digest"]' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	sane_run jq -SMr '[.layers[:-1][] | select(.annotations["containerd.io/snapshot/stargz/toc.digest"] == null)] | length' "$manifest"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# gzip doesn't modify the layer, so the diff_ids must not change.
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.rootfs' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$rootfs" ]]
+
+	# The recompressed image must have the same contents.
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}-estargz" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress [zstd]" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMc '.rootfs' "$config"
+	[ "$status" -eq 0 ]
+	rootfs="$output"
+
+	# Recompress every layer with zstd.
+	umoci recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-zstd" --layer-format zstd
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-zstd"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '[.layers[] | select(.mediaType != "application/vnd.oci.image.layer.v1.tar+zstd")] | length' "$manifest"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+
+	# The layer blobs are zstd streams with the same diff_ids.
+	sane_run jq -SMr '.layers[0].digest' "$manifest"
+	[ "$status" -eq 0 ]
+	layer="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[[ "$(head -c4 "$layer" | od -An -tx1 | tr -d ' ')" == "28b52ffd" ]]
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.rootfs' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$rootfs" ]]
+
+	# The zstd image must have the same contents.
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}-zstd" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Converting back to gzip doesn't change the diff_ids either.
+	umoci recompress --image "${IMAGE}:${TAG}-zstd" --layer-format gzip
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-zstd"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '[.layers[] | select(.mediaType != "application/vnd.oci.image.layer.v1.tar+gzip")] | length' "$manifest"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq 0 ]
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMc '.rootfs' "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$rootfs" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci recompress [--workers]" {
+	image-verify "${IMAGE}"
+
+	# The result doesn't depend on the number of workers.
+	umoci --workers 1 recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-sequential"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci --workers 4 recompress --image "${IMAGE}:${TAG}" --tag "${TAG}-parallel"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-sequential"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	sequential="$output"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-parallel"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$sequential" ]]
+
+	umoci --workers 0 recompress --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,89 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci reorder-layers" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+	baseLayers="$(seq 0 $(($numLayers - 1)))"
+
+	# Add three layers, the first and last of which modify the same file.
+	for file in a b a; do
+		rm -rf "$BUNDLE"
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		echo "$file $(date +%N)" >>"$BUNDLE/rootfs/$file"
+		umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+	expectedA="$(cat "$BUNDLE/rootfs/a")"
+
+	# Moving the unrelated layer is fine.
+	umoci reorder-layers --image "${IMAGE}:${TAG}" --tag "${TAG}-moved" --overlap-policy error \
+		$baseLayers $(($numLayers + 1)) $numLayers $(($numLayers + 2))
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-moved" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$(($numLayers + 3))" ]]
+	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "true" ]]
+
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-moved" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/a")" == "$expectedA" ]]
+
+	# Swapping the layers which modify the same file is detected.
+	umoci reorder-layers --image "${IMAGE}:${TAG}" --tag "${TAG}-swapped" --overlap-policy error \
+		$baseLayers $(($numLayers + 2)) $(($numLayers + 1)) $numLayers
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"modify /a"* ]]
+
+	umoci reorder-layers --image "${IMAGE}:${TAG}" --tag "${TAG}-swapped" --overlap-policy warn \
+		$baseLayers $(($numLayers + 2)) $(($numLayers + 1)) $numLayers
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"modify /a"* ]]
+	image-verify "${IMAGE}"
+
+	# Invalid orders are rejected.
+	umoci reorder-layers --image "${IMAGE}:${TAG}" $baseLayers
+	[ "$status" -ne 0 ]
+	umoci reorder-layers --image "${IMAGE}:${TAG}" $baseLayers $numLayers $numLayers $numLayers
+	[ "$status" -ne 0 ]
+	umoci reorder-layers --image "${IMAGE}:${TAG}" --overlap-policy invalid $baseLayers
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
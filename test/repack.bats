@@ -264,6 +264,42 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci repack --no-history" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some small change.
+	touch "$BUNDLE/a_small_change"
+
+	# --no-history conflicts with --history.*.
+	umoci repack --image "${IMAGE}:${TAG}-new" --no-history --history.comment="comment" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Repack the image without a history entry.
+	umoci repack --image "${IMAGE}:${TAG}-new" --no-history "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The history is unchanged.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLinesA="$(echo "$output" | jq -SMr '.history | length')"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLinesB="$(echo "$output" | jq -SMr '.history | length')"
+
+	[ "$numLinesB" -eq "$numLinesA" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [hardlink]" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -372,6 +408,67 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack [rootless devices]" {
+	# We need to be root to create the devices in the first place.
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	BUNDLE_D="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image and add some devices.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	mkdir -p "$BUNDLE_A/rootfs/dev"
+	mknod "$BUNDLE_A/rootfs/dev/null" c 1 3
+	mknod "$BUNDLE_A/rootfs/dev/sda" b 8 0
+
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --device-policy=error refuses to unpack devices in rootless mode.
+	umoci unpack --rootless --device-policy error --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	# --device-policy=skip doesn't create anything.
+	umoci unpack --rootless --device-policy skip --image "${IMAGE}:${TAG}" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	! [ -e "$BUNDLE_C/rootfs/dev/null" ]
+	! [ -e "$BUNDLE_C/rootfs/dev/sda" ]
+	sane_run jq -SMr '.devices | map(.path + " " + .type) | join(",")' "$BUNDLE_C/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "dev/null char,dev/sda block" ]]
+
+	# The default is to create placeholders.
+	umoci unpack --rootless --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(stat -c '%F' "$BUNDLE_B/rootfs/dev/null")" == "regular empty file" ]]
+	[[ "$(stat -c '%F' "$BUNDLE_B/rootfs/dev/sda")" == "regular empty file" ]]
+
+	# Unmodified placeholders are repacked as the original devices.
+	touch "$BUNDLE_B/rootfs/dev/null"
+	echo "not a device" > "$BUNDLE_B/rootfs/dev/sda"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_D"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_D"
+	[[ "$(stat -c '%F %t:%T' "$BUNDLE_D/rootfs/dev/null")" == "character special file 1:3" ]]
+	[[ "$(stat -c '%F' "$BUNDLE_D/rootfs/dev/sda")" == "regular file" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [xattrs]" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -636,3 +733,527 @@ function teardown() {
 	! [ -e "$BUNDLE_D/rootfs/some nutty/path name" ]
 	! [ -e "$BUNDLE_D/rootfs/some nutty/path name/ here" ]
 }
+
+@test "umoci repack [SOURCE_DATE_EPOCH]" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Unpack the image twice.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# Make the same changes to both bundles (at different times).
+	echo "new file" > "$BUNDLE_A/rootfs/newfile"
+	rm -f "$BUNDLE_A/rootfs/etc/passwd"
+	sleep 1s
+	echo "new file" > "$BUNDLE_B/rootfs/newfile"
+	rm -f "$BUNDLE_B/rootfs/etc/passwd"
+
+	# Repack both bundles with the same SOURCE_DATE_EPOCH.
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-a" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	sleep 1s
+	SOURCE_DATE_EPOCH=1234567890 umoci repack --image "${IMAGE}:${TAG}-b" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The resulting images must be identical.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-a"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	digestA="$output"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-b"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	digestB="$output"
+	[ -n "$digestA" ]
+	[[ "$digestA" == "$digestB" ]]
+
+	# The history entry must use SOURCE_DATE_EPOCH.
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2009-02-13T23:31:30Z" ]]
+}
+
+@test "umoci repack --layer-format estargz" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	dd if=/dev/urandom of="$BUNDLE/rootfs/largefile" bs=1M count=10
+
+	# Repack the image as an eStargz layer.
+	umoci repack --layer-format estargz --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must have the eStargz annotations.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.layers[-1].annotations["containerd.io/snapshot/stargz/toc.digest"]' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == sha256:* ]]
+
+	# The layer must still be a valid tar+gzip layer, containing the TOC.
+	sane_run jq -SMr '.layers[-1].digest' "$manifest"
+	[ "$status" -eq 0 ]
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *".no.prefetch.landmark"* ]]
+	[[ "$output" == *"largefile"* ]]
+	[[ "$output" == *"stargz.index.json"* ]]
+
+	# Make sure the image can be unpacked.
+	BUNDLE_NEW="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE_NEW"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_NEW"
+	cmp "$BUNDLE/rootfs/largefile" "$BUNDLE_NEW/rootfs/largefile"
+
+	# Unknown formats are rejected.
+	umoci repack --layer-format zstd:chunked --image "${IMAGE}:${TAG}-zstd" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --split-layer-size" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Remove some files (which become whiteouts).
+	chmod +w "$BUNDLE/rootfs/etc/." && rm -rf "$BUNDLE/rootfs/etc"
+	chmod +w "$BUNDLE/rootfs/bin/." && rm "$BUNDLE/rootfs/bin/sh"
+
+	# Add large files which end up in different layers, with a hardlink to the
+	# first file stored next to the last one.
+	mkdir -p "$BUNDLE/rootfs/aaa" "$BUNDLE/rootfs/mmm" "$BUNDLE/rootfs/zzz"
+	dd if=/dev/urandom of="$BUNDLE/rootfs/aaa/large1" bs=1M count=1
+	dd if=/dev/urandom of="$BUNDLE/rootfs/mmm/large2" bs=1M count=1
+	dd if=/dev/urandom of="$BUNDLE/rootfs/zzz/large3" bs=1M count=1
+	ln "$BUNDLE/rootfs/aaa/large1" "$BUNDLE/rootfs/zzz/link1"
+
+	# Repack the same changes both split and unsplit.
+	umoci repack --split-layer-size 1500K --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci repack --image "${IMAGE}:${TAG}-full" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The changes must have been split into several layers, each with its own
+	# history entry.
+	umoci stat --image "${IMAGE}:${TAG}-full" --json
+	[ "$status" -eq 0 ]
+	nlayers="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer != true)] | length')"
+	umoci stat --image "${IMAGE}:${TAG}-split" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer != true)] | length')" -eq "$((nlayers + 2))" ]
+	[[ "$(echo "$output" | jq -SMr '.history[-3].created_by')" == "umoci repack (part 1/3)" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-2].created_by')" == "umoci repack (part 2/3)" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci repack (part 3/3)" ]]
+
+	# Both images must have the same rootfs.
+	BUNDLE_SPLIT="$(setup_tmpdir)"
+	BUNDLE_FULL="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-split" "$BUNDLE_SPLIT"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_SPLIT"
+	umoci unpack --image "${IMAGE}:${TAG}-full" "$BUNDLE_FULL"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_FULL"
+	sane_run diff -r "$BUNDLE_SPLIT/rootfs" "$BUNDLE_FULL/rootfs"
+	[ "$status" -eq 0 ]
+
+	# Including the whiteouts and the hardlink.
+	! [ -e "$BUNDLE_SPLIT/rootfs/etc" ]
+	! [ -e "$BUNDLE_SPLIT/rootfs/bin/sh" ]
+	sane_run stat -c 'ino=%i nlink=%h' "$BUNDLE_SPLIT/rootfs/aaa/large1"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"nlink=2" ]]
+	original="$output"
+	sane_run stat -c 'ino=%i nlink=%h' "$BUNDLE_SPLIT/rootfs/zzz/link1"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$original" ]]
+
+	# Ensure that gomtree succeeds on the original bundle.
+	gomtree -p "$BUNDLE/rootfs" -f "$BUNDLE_SPLIT"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [--mtree-keyword]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image without recording timestamps.
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keyword=-tar_time "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run jq -SMr '.mtree_keywords | index("tar_time")' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# Only change timestamps.
+	touch -d "2001-01-01" "$BUNDLE/rootfs/etc/passwd"
+
+	# The new layer must be empty.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Invalid keywords are rejected.
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keyword=+nonexistent "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --mtree-keyword=-type "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack [.umociignore and --exclude]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files, only some of which should be included.
+	mkdir -p "$BUNDLE/rootfs/root/.cache/pip" "$BUNDLE/rootfs/scratch"
+	echo "cache" > "$BUNDLE/rootfs/root/.cache/pip/blob"
+	echo "swap" > "$BUNDLE/rootfs/etc/.passwd.swp"
+	echo "scratch" > "$BUNDLE/rootfs/scratch/file"
+	echo "keep" > "$BUNDLE/rootfs/keepme"
+	echo "keep" > "$BUNDLE/rootfs/important.swp"
+	cat >"$BUNDLE/.umociignore" <<EOF
+# Build caches.
+/root/.cache
+*.swp
+!/important.swp
+EOF
+
+	# Repack the image.
+	umoci repack --exclude /scratch --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the contents of the new layer.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"keepme"* ]]
+	[[ "$output" == *"important.swp"* ]]
+	[[ "$output" != *".cache"* ]]
+	[[ "$output" != *"passwd.swp"* ]]
+	[[ "$output" != *"scratch"* ]]
+
+	# Invalid patterns are rejected.
+	umoci repack --exclude "/[" --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --socket-policy" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a socket and a FIFO.
+	sane_run python3 -c 'import socket, sys; socket.socket(socket.AF_UNIX).bind(sys.argv[1])' "$BUNDLE/rootfs/socket"
+	[ "$status" -eq 0 ]
+	mkfifo "$BUNDLE/rootfs/fifo"
+
+	# Unknown policies are rejected.
+	umoci repack --socket-policy invalid --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Sockets cause an error if requested.
+	umoci repack --socket-policy error --image "${IMAGE}:${TAG}-error" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# By default, sockets are skipped but FIFOs are kept.
+	umoci repack --image "${IMAGE}:${TAG}-skip" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-skip"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tvzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	grep -qE '^p.* fifo$' <<<"$output"
+	! grep -qE ' socket$' <<<"$output"
+
+	# Placeholders are stored as empty regular files.
+	umoci repack --socket-policy placeholder --image "${IMAGE}:${TAG}-placeholder" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-placeholder"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tvzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	grep -qE '^p.* fifo$' <<<"$output"
+	grep -qE '^-.* 0 .* socket$' <<<"$output"
+}
+
+@test "umoci repack --setuid-policy --max-mode" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files with undesirable modes.
+	echo "setuid" > "$BUNDLE/rootfs/setuid"
+	chmod 4755 "$BUNDLE/rootfs/setuid"
+	echo "writable" > "$BUNDLE/rootfs/writable"
+	chmod 0777 "$BUNDLE/rootfs/writable"
+
+	# Invalid values are rejected.
+	umoci repack --setuid-policy invalid --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --max-mode 01777 --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --max-mode 0999 --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Setuid files cause an error if requested.
+	umoci repack --setuid-policy error --image "${IMAGE}:${TAG}-error" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Strip the setuid bits and mask the modes.
+	umoci repack --setuid-policy strip --max-mode 0755 --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tvzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	grep -qE '^-rwxr-xr-x .* setuid$' <<<"$output"
+	grep -qE '^-rwxr-xr-x .* writable$' <<<"$output"
+}
+
+@test "umoci repack --metadata-only" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image and add a large file.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	head -c 2M </dev/urandom >"$BUNDLE/rootfs/large"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only change the metadata of the large file.
+	rm -rf "$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	chmod 0600 "$BUNDLE/rootfs/large"
+	echo "small" >"$BUNDLE/rootfs/small"
+
+	# Invalid values are rejected.
+	umoci repack --metadata-only invalid --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --metadata-only warn --metadata-only-min-size invalid --image "${IMAGE}:${TAG}-invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# With warn, the file is included but a warning is output.
+	umoci repack --metadata-only warn --image "${IMAGE}:${TAG}-warn" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"only the metadata of large changed"* ]]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-warn"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	grep -qE '^large$' <<<"$output"
+
+	# With skip (above the minimum size), the file is omitted.
+	umoci repack --metadata-only skip --metadata-only-min-size 1MB --image "${IMAGE}:${TAG}-skip" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-skip"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	! grep -qE '^large$' <<<"$output"
+	grep -qE '^small$' <<<"$output"
+}
+
+@test "umoci repack --dry-run" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" >"$BUNDLE/rootfs/newfile"
+
+	cp "$IMAGE/index.json" "$BATS_TMPDIR/index.json"
+	numBlobs="$(find "$IMAGE/blobs" -type f | wc -l)"
+
+	umoci repack --image "${IMAGE}:${TAG}" --dry-run "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" >"$BATS_TMPDIR/dry-run.json"
+
+	# The image is not modified.
+	sane_run cmp "$IMAGE/index.json" "$BATS_TMPDIR/index.json"
+	[ "$status" -eq 0 ]
+	[ "$(find "$IMAGE/blobs" -type f | wc -l)" -eq "$numBlobs" ]
+	image-verify "${IMAGE}"
+
+	# The new layer is described.
+	sane_run jq -SMr '.references[0].name' "$BATS_TMPDIR/dry-run.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "${TAG}" ]]
+	sane_run jq -SMr '.blobs[] | select(.mediaType == "application/vnd.oci.image.layer.v1.tar+gzip") | .digest' "$BATS_TMPDIR/dry-run.json"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# Repacking afterwards still works.
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --refresh-bundle" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	oldMtree="$(echo "$BUNDLE"/sha256_*.mtree)"
+
+	umoci repack --image "${IMAGE}:${TAG}" --refresh-bundle --dry-run "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Repack a change, refreshing the bundle.
+	echo "first file" >"$BUNDLE/rootfs/first-file"
+	umoci repack --image "${IMAGE}:${TAG}" --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	bundle-verify "$BUNDLE"
+
+	# The bundle now refers to the new image.
+	umoci inspect --image "${IMAGE}:${TAG}" --type descriptor
+	[ "$status" -eq 0 ]
+	newDigest="$(echo "$output" | jq -SMr '.digest')"
+	! [ -e "$oldMtree" ]
+	[ -f "$BUNDLE/${newDigest/:/_}.mtree" ]
+	sane_run jq -SMr '.from_descriptor_path.descriptor_walk[0].digest' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$newDigest" ]]
+
+	# Repacking again only includes the new changes.
+	echo "second file" >"$BUNDLE/rootfs/second-file"
+	umoci repack --image "${IMAGE}:${TAG}" --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci ls --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SMr '.[] | select(.path == "first-file") | .layer')" -lt \
+	  "$(echo "$output" | jq -SMr '.[] | select(.path == "second-file") | .layer')" ]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	lastLayer="$(echo "$output" | jq -SMr '[.history[] | select(.empty_layer | not)][-1].layer.digest')"
+	sane_run bash -c "'$UMOCI' raw dump-layer --layout '$IMAGE' '$lastLayer' - | tar -t"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"second-file"* ]]
+	[[ "$output" != *"first-file"* ]]
+}
+
+@test "umoci repack --created --author --created-annotation" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" >"$BUNDLE/rootfs/newfile"
+
+	# Invalid timestamps are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --created "invalid" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --created "2020-01-02T03:04:05Z" \
+		--author "Jane Doe <jane@example.com>" --created-annotation "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.annotations["org.opencontainers.image.created"]' "$manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2020-01-02T03:04:05Z" ]]
+	sane_run jq -SMr '.config.digest' "$manifest"
+	[ "$status" -eq 0 ]
+	config="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+
+	# Both the image and the new history entry use the given values.
+	sane_run jq -SMr '.created, .history[-1].created' "$config"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "2020-01-02T03:04:05Z" ]]
+	[[ "${lines[1]}" == "2020-01-02T03:04:05Z" ]]
+	sane_run jq -SMr '.author, .history[-1].author' "$config"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "Jane Doe <jane@example.com>" ]]
+	[[ "${lines[1]}" == "Jane Doe <jane@example.com>" ]]
+
+	# The --history.* options take precedence for the history entry.
+	umoci repack --image "${IMAGE}:${TAG}-history" --created "2020-01-02T03:04:05Z" \
+		--history.created "2021-01-01T00:00:00Z" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-history" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created')" == "2021-01-01T00:00:00Z" ]]
+}
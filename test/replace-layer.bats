@@ -0,0 +1,135 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci remove-layer" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayers="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+
+	# Add a layer, and then remove it by its diff_id.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "secret" > "$BUNDLE/rootfs/secret"
+	umoci repack --image "${IMAGE}:${TAG}-secret" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$(($numLayers + 1))" ]]
+
+	manifest=$(cat "${IMAGE}/index.json" | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-secret"'") | .digest' | cut -d: -f2)
+	config=$(cat "${IMAGE}/blobs/sha256/$manifest" | jq -r '.config.digest' | cut -d: -f2)
+	diffID=$(cat "${IMAGE}/blobs/sha256/$config" | jq -r '.rootfs.diff_ids[-1]')
+
+	umoci remove-layer --image "${IMAGE}:${TAG}-secret" "$diffID"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == "$numLayers" ]]
+	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "true" ]]
+
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-secret" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	! [ -e "$BUNDLE_B/rootfs/secret" ]
+
+	# Invalid layers are rejected.
+	umoci remove-layer --image "${IMAGE}:${TAG}" "$numLayers"
+	[ "$status" -ne 0 ]
+	umoci remove-layer --image "${IMAGE}:${TAG}" "$diffID"
+	[ "$status" -ne 0 ]
+	umoci remove-layer --image "${IMAGE}:${TAG}" "not-a-layer"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci replace-layer" {
+	BUNDLE="$(setup_tmpdir)"
+	LAYER="$(setup_tmpdir)/layer.tar"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "broken" > "$BUNDLE/rootfs/patched"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Generate a replacement for the top layer.
+	echo "fixed" > "$BUNDLE/rootfs/patched"
+	umoci raw changeset "$BUNDLE" "$LAYER"
+	[ "$status" -eq 0 ]
+
+	umoci replace-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-patched" -- -1 "$LAYER"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-patched" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history[-1].created_by')" == *"umoci replace-layer"* ]]
+
+	BUNDLE_B="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-patched" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	[[ "$(cat "$BUNDLE_B/rootfs/patched")" == "fixed" ]]
+
+	# Replacing with an existing blob gives the same image.
+	umoci raw pack-layer --layout "${IMAGE}" "$LAYER"
+	[ "$status" -eq 0 ]
+	digest="$output"
+
+	umoci replace-layer --image "${IMAGE}:${TAG}" --tag "${TAG}-blob" --no-history --blob -- -1 "$digest"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	BUNDLE_C="$(setup_tmpdir)"
+	umoci unpack --image "${IMAGE}:${TAG}-blob" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	[[ "$(cat "$BUNDLE_C/rootfs/patched")" == "fixed" ]]
+
+	# Blobs which are not in the image are rejected.
+	umoci replace-layer --image "${IMAGE}:${TAG}" --blob 0 "sha256:$(printf '0%.0s' {1..64})"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
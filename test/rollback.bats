@@ -0,0 +1,83 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci rollback [missing args]" {
+	umoci rollback
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci rollback" {
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	original="$output"
+
+	# Nothing has been recorded for the tag yet.
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Modify the image, replacing the tag.
+	umoci config --image "${IMAGE}:${TAG}" --config.user="nobody"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	modified="$output"
+	[[ "$modified" != "$original" ]]
+
+	# The tag is restored to the original image.
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$original" ]]
+
+	# Rolling back again undoes the rollback.
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$modified" ]]
+
+	# Once the original image has been garbage collected it can't be restored.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci rollback --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$modified" ]]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,112 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# fake_runtime creates an OCI runtime which records its arguments and the
+# process of the bundle it was asked to run, and creates a file in the rootfs.
+function fake_runtime() {
+	RUNTIME_DIR="$(setup_tmpdir)"
+	cat >"$RUNTIME_DIR/runtime" <<-'EOF_RUNTIME'
+	#!/bin/sh
+	# Called as "runtime run --bundle <bundle> <id>".
+	bundle="$3"
+	echo "$@" >"$RUNTIME_DIR/args"
+	jq -c '.process.args' "$bundle/config.json" >"$RUNTIME_DIR/process-args"
+	echo "created by runtime" >"$bundle/rootfs/runtime-file"
+	exit "${RUNTIME_STATUS:-0}"
+	EOF_RUNTIME
+	chmod +x "$RUNTIME_DIR/runtime"
+	export RUNTIME_DIR
+}
+
+@test "umoci run [invalid arguments]" {
+	BUNDLE="$(setup_tmpdir)/bundle"
+
+	# Exactly one of --image and --bundle.
+	umoci run --runtime true
+	[ "$status" -ne 0 ]
+	umoci run --runtime true --image "${IMAGE}:${TAG}" --bundle "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# --repack and --tag only make sense with --image.
+	umoci run --runtime true --bundle "$BUNDLE" --repack
+	[ "$status" -ne 0 ]
+	umoci run --runtime true --image "${IMAGE}:${TAG}" --tag "new-${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Unknown runtimes.
+	umoci run --runtime umoci-nonexistent-runtime --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci run --bundle" {
+	fake_runtime
+	BUNDLE="$(setup_tmpdir)/bundle"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	sane_run sha256sum "$BUNDLE/config.json"
+	CONFIG_DIGEST="$output"
+
+	umoci run --runtime "$RUNTIME_DIR/runtime" --bundle "$BUNDLE" echo hello </dev/null
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$RUNTIME_DIR/args")" == "run --bundle $BUNDLE "* ]]
+	[[ "$(cat "$RUNTIME_DIR/process-args")" == '["echo","hello"]' ]]
+	[ -f "$BUNDLE/rootfs/runtime-file" ]
+
+	# The config.json must have been restored.
+	sane_run sha256sum "$BUNDLE/config.json"
+	[[ "$output" == "$CONFIG_DIGEST" ]]
+
+	# A failed container is reported.
+	RUNTIME_STATUS=3 umoci run --runtime "$RUNTIME_DIR/runtime" --bundle "$BUNDLE" </dev/null
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci run --image --repack" {
+	fake_runtime
+
+	# A failed container is not repacked.
+	RUNTIME_STATUS=1 umoci run --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --repack --tag "${TAG}-failed" </dev/null
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-failed"* ]]
+
+	umoci run --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --repack --tag "${TAG}-ran" </dev/null
+	[ "$status" -eq 0 ]
+
+	# The changes made in the container are in the new tag.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-ran"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"added /runtime-file"* ]]
+
+	image-verify "${IMAGE}"
+}
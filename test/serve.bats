@@ -0,0 +1,238 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+load helpers
+
+function setup() {
+	setup_image
+	SERVE_PORT="$((20000 + RANDOM % 20000))"
+}
+
+function teardown() {
+	if [ -n "$serve_pid" ]; then
+		kill -TERM "$serve_pid" || true
+		wait "$serve_pid" || true
+	fi
+	teardown_tmpdirs
+	teardown_image
+}
+
+# start_serve starts serving a layout in the background (with the given
+# arguments) and waits until the server is listening.
+function start_serve() {
+	"$UMOCI" serve --listen "localhost:$SERVE_PORT" "$@" &
+	serve_pid="$!"
+	for _ in $(seq 50); do
+		(echo >"/dev/tcp/localhost/$SERVE_PORT") 2>/dev/null && return 0
+		sleep 0.1
+	done
+	return 1
+}
+
+# tag_digest outputs the digest of the given <image>:<tag>.
+function tag_digest() {
+	jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${1##*:}"'") | .digest' "${1%:*}/index.json"
+}
+
+@test "umoci serve [invalid arguments]" {
+	# Missing layout.
+	umoci serve
+	[ "$status" -ne 0 ]
+
+	# Unexpected positional arguments.
+	umoci serve --layout "${IMAGE}" extra
+	[ "$status" -ne 0 ]
+
+	# TLS needs both a certificate and a key.
+	umoci serve --layout "${IMAGE}" --tls-cert /dev/null
+	[ "$status" -ne 0 ]
+	umoci serve --layout "${IMAGE}" --tls-key /dev/null
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci serve [read-only]" {
+	start_serve --layout "${IMAGE}"
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	# Pull the image from the served layout.
+	umoci pull --plain-http --image "${NEWIMAGE}:pulled" "docker://localhost:$SERVE_PORT/some/image:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	# The pulled image must be identical.
+	oldDigest="$(tag_digest "${IMAGE}:${TAG}")"
+	newDigest="$(tag_digest "${NEWIMAGE}:pulled")"
+	[[ "$oldDigest" == "$newDigest" ]]
+
+	# Unknown tags cannot be pulled.
+	umoci pull --plain-http --image "${NEWIMAGE}:missing" "docker://localhost:$SERVE_PORT/some/image:nonexistent"
+	[ "$status" -ne 0 ]
+
+	# Pushing to a read-only layout fails.
+	umoci push --plain-http --image "${NEWIMAGE}:pulled" "docker://localhost:$SERVE_PORT/some/image:pushed"
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"pushed"* ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci serve --read-write" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	start_serve --layout "$NEWIMAGE" --repository "some/image" --read-write
+
+	# Push the image to the served layout.
+	umoci push --plain-http --image "${IMAGE}:${TAG}" "docker://localhost:$SERVE_PORT/some/image:pushed"
+	[ "$status" -eq 0 ]
+
+	# Other repositories are not served.
+	umoci push --plain-http --image "${IMAGE}:${TAG}" "docker://localhost:$SERVE_PORT/other/image:pushed"
+	[ "$status" -ne 0 ]
+
+	# The image must have been tagged.
+	umoci ls --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "$output" == "pushed" ]]
+
+	oldDigest="$(tag_digest "${IMAGE}:${TAG}")"
+	newDigest="$(tag_digest "${NEWIMAGE}:pushed")"
+	[[ "$oldDigest" == "$newDigest" ]]
+
+	image-verify "$NEWIMAGE"
+}
+
+@test "umoci serve [multi-platform]" {
+	# Create a multi-platform image.
+	umoci new --image "${IMAGE}:other"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:multi" --platform linux/amd64 "${TAG}"
+	[ "$status" -eq 0 ]
+	umoci index add --image "${IMAGE}:multi" --platform linux/arm64 other
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	start_serve --layout "${IMAGE}"
+
+	# Only the manifest for the platform is pulled.
+	umoci pull --plain-http --platform linux/arm64 --image "${NEWIMAGE}:arm64" "docker://localhost:$SERVE_PORT/image:multi"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+	[[ "$(tag_digest "${NEWIMAGE}:arm64")" == "$(tag_digest "${IMAGE}:other")" ]]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "arm64") | .platform.architecture' "$NEWIMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm64" ]]
+
+	umoci pull --plain-http --platform linux/s390x --image "${NEWIMAGE}:s390x" "docker://localhost:$SERVE_PORT/image:multi"
+	[ "$status" -ne 0 ]
+
+	# Images can be converted while they are pulled.
+	umoci pull --plain-http --format docker --image "${NEWIMAGE}:docker" "docker://localhost:$SERVE_PORT/image:multi"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "docker") | .mediaType' "$NEWIMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.list.v2+json" ]]
+
+	# Images already using the format are not modified.
+	umoci pull --plain-http --format oci --image "${NEWIMAGE}:oci" "docker://localhost:$SERVE_PORT/image:multi"
+	[ "$status" -eq 0 ]
+	[[ "$(tag_digest "${NEWIMAGE}:oci")" == "$(tag_digest "${IMAGE}:multi")" ]]
+}
+
+@test "umoci push --format [served]" {
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci index add --image "${IMAGE}:multi" --platform linux/amd64 "${TAG}"
+	[ "$status" -eq 0 ]
+	ORIG_INDEX="$(setup_tmpdir)/index.json"
+	cp "${IMAGE}/index.json" "$ORIG_INDEX"
+
+	start_serve --layout "$NEWIMAGE" --read-write
+
+	# Image indexes can be pushed as Docker manifest lists.
+	umoci push --plain-http --format docker --image "${IMAGE}:multi" "docker://localhost:$SERVE_PORT/image:pushed"
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "pushed") | .mediaType' "$NEWIMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "application/vnd.docker.distribution.manifest.list.v2+json" ]]
+
+	# The source image must not have been modified.
+	sane_run diff -u "$ORIG_INDEX" "${IMAGE}/index.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci pull --registries-conf [served mirror]" {
+	start_serve --layout "${IMAGE}"
+
+	NEWIMAGE="$(setup_tmpdir)/image"
+	umoci init --layout "$NEWIMAGE"
+	[ "$status" -eq 0 ]
+
+	# The upstream registry is unreachable, so the image can only be pulled
+	# from the (insecure) mirror.
+	REGISTRIES_CONF="$(setup_tmpdir)/registries.conf"
+	cat >"$REGISTRIES_CONF" <<-EOF
+	[[registry]]
+	location = "localhost:1/upstream"
+
+	[[registry.mirror]]
+	location = "localhost:$SERVE_PORT/mirror"
+	insecure = true
+	EOF
+
+	umoci pull --registries-conf "$REGISTRIES_CONF" --image "${NEWIMAGE}:pulled" "docker://localhost:1/upstream/image:${TAG}"
+	[ "$status" -eq 0 ]
+	image-verify "$NEWIMAGE"
+
+	oldDigest="$(tag_digest "${IMAGE}:${TAG}")"
+	newDigest="$(tag_digest "${NEWIMAGE}:pulled")"
+	[[ "$oldDigest" == "$newDigest" ]]
+
+	# Without the mirror the pull fails.
+	umoci pull --plain-http --image "${NEWIMAGE}:direct" "docker://localhost:1/upstream/image:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Blocked registries cannot be pulled from, even through mirrors.
+	sed -i '/^location = "localhost:1\/upstream"$/a blocked = true' "$REGISTRIES_CONF"
+	umoci pull --registries-conf "$REGISTRIES_CONF" --image "${NEWIMAGE}:blocked" "docker://localhost:1/upstream/image:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,110 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# fake_shell_runtime creates an OCI runtime which records the process of the
+# bundle it was asked to run, and creates a file in the rootfs.
+function fake_shell_runtime() {
+	RUNTIME_DIR="$(setup_tmpdir)"
+	cat >"$RUNTIME_DIR/runtime" <<-'EOF_RUNTIME'
+	#!/bin/sh
+	# Called as "runtime run --bundle <bundle> <id>".
+	bundle="$3"
+	jq -c '.process.args' "$bundle/config.json" >"$RUNTIME_DIR/process-args"
+	jq -c '.linux.namespaces | map(.type)' "$bundle/config.json" >"$RUNTIME_DIR/namespaces"
+	echo "created in shell" >"$bundle/rootfs/shell-file"
+	exit "${RUNTIME_STATUS:-0}"
+	EOF_RUNTIME
+	chmod +x "$RUNTIME_DIR/runtime"
+	export RUNTIME_DIR
+}
+
+@test "umoci shell [invalid arguments]" {
+	# --image is mandatory.
+	umoci shell --runtime true
+	[ "$status" -ne 0 ]
+
+	# No positional arguments.
+	umoci shell --runtime true --image "${IMAGE}:${TAG}" sh
+	[ "$status" -ne 0 ]
+
+	# Invalid tags.
+	umoci shell --runtime true --image "${IMAGE}:${TAG}" --commit "invalid/tag"
+	[ "$status" -ne 0 ]
+
+	# Conflicting cache flags.
+	umoci shell --runtime true --image "${IMAGE}:${TAG}" --layer-cache "$(setup_tmpdir)" --no-layer-cache
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci shell" {
+	fake_shell_runtime
+	CACHE="$(setup_tmpdir)"
+
+	umoci shell --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" </dev/null
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$RUNTIME_DIR/process-args")" == '["/bin/sh"]' ]]
+	[[ "$(cat "$RUNTIME_DIR/namespaces")" == *'"user"'* ]]
+
+	# The layer cache was populated.
+	sane_run find "$CACHE" -mindepth 1
+	[ "${#lines[@]}" -gt 0 ]
+
+	# --shell changes the command.
+	umoci shell --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" --shell /bin/bash </dev/null
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$RUNTIME_DIR/process-args")" == '["/bin/bash"]' ]]
+
+	# Without --commit, no tags were created.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci shell --commit" {
+	fake_shell_runtime
+
+	# A failed shell is not committed.
+	RUNTIME_STATUS=1 umoci shell --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --no-layer-cache --commit "${TAG}-failed" </dev/null
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-failed"* ]]
+
+	umoci shell --runtime "$RUNTIME_DIR/runtime" --image "${IMAGE}:${TAG}" --no-layer-cache --commit "${TAG}-shell" </dev/null
+	[ "$status" -eq 0 ]
+
+	# The changes made in the container are in the new tag.
+	umoci diff --image "${IMAGE}:${TAG}" "${TAG}-shell"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"added /shell-file"* ]]
+
+	image-verify "${IMAGE}"
+}
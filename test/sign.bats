@@ -0,0 +1,118 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+function generate_key() {
+	openssl ecparam -name prime256v1 -genkey -noout | openssl pkcs8 -topk8 -nocrypt -out "$1.key"
+	openssl pkey -in "$1.key" -pubout -out "$1.pub"
+}
+
+@test "umoci sign [invalid arguments]" {
+	KEYS="$(setup_tmpdir)"
+	generate_key "$KEYS/signing"
+
+	umoci sign --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci sign --image "${IMAGE}:${TAG}" --key "$KEYS/signing.key" extra
+	[ "$status" -ne 0 ]
+	umoci sign --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub"
+	[ "$status" -ne 0 ]
+	umoci sign --image "${IMAGE}:${TAG}-nonexistent" --key "$KEYS/signing.key"
+	[ "$status" -ne 0 ]
+
+	umoci verify-signature --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.key"
+	[ "$status" -ne 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub" --certificate-identity jane@example.com
+	[ "$status" -ne 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --certificate-identity jane@example.com
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci sign" {
+	KEYS="$(setup_tmpdir)"
+	BUNDLE="$(setup_tmpdir)"
+	generate_key "$KEYS/signing"
+	generate_key "$KEYS/other"
+
+	image-verify "${IMAGE}"
+
+	# The image is not signed yet.
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub" "$BUNDLE/bundle"
+	[ "$status" -ne 0 ]
+	! [ -d "$BUNDLE/bundle/rootfs" ]
+
+	umoci sign --image "${IMAGE}:${TAG}" --key "$KEYS/signing.key"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The signature survives a gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub"
+	[ "$status" -eq 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/other.pub"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# Modifying the image invalidates the signature.
+	umoci config --image "${IMAGE}:${TAG}" --config.user "nobody"
+	[ "$status" -eq 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci sign --signature-file" {
+	KEYS="$(setup_tmpdir)"
+	generate_key "$KEYS/signing"
+
+	umoci sign --image "${IMAGE}:${TAG}" --key "$KEYS/signing.key" --reference "registry.example.com/image" --signature-file "$KEYS/sig.json"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.payload | @base64d | fromjson | .critical.identity["docker-reference"]' "$KEYS/sig.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "registry.example.com/image" ]]
+
+	# The signature is not stored in the image.
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub"
+	[ "$status" -ne 0 ]
+	umoci verify-signature --image "${IMAGE}:${TAG}" --key "$KEYS/signing.pub" --signature-file "$KEYS/sig.json"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
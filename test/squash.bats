@@ -0,0 +1,100 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci squash" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Add two layers, the second of which removes paths from both the first
+	# layer and the base image.
+	mkdir -p "$BUNDLE_A/rootfs/squash/dir"
+	echo "first" > "$BUNDLE_A/rootfs/squash/file"
+	echo "removed" > "$BUNDLE_A/rootfs/squash/dir/removed"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+
+	echo "second" > "$BUNDLE_A/rootfs/squash/file"
+	rm -rf "$BUNDLE_A/rootfs/squash/dir" "$BUNDLE_A/rootfs/etc"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayersA="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+
+	# Squash the two new layers.
+	umoci squash --image "${IMAGE}:${TAG}" --first -2 --tag "${TAG}-squashed"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	numLayersB="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')"
+	[ "$numLayersB" -eq "$(($numLayersA - 1))" ]
+	[[ "$(echo "$output" | jq -SM '.history[-1].created_by')" == '"umoci squash"' ]]
+
+	# The squashed image must have the same root filesystem.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	[[ "$(cat "$BUNDLE_B/rootfs/squash/file")" == "second" ]]
+	! [ -e "$BUNDLE_B/rootfs/squash/dir" ]
+	! [ -e "$BUNDLE_B/rootfs/etc" ]
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_C"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Squashing the entire image leaves a single layer.
+	umoci squash --image "${IMAGE}:${TAG}-squashed" --tag "${TAG}-single"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-single" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.history[] | select(.empty_layer != true)] | length')" == 1 ]]
+
+	# Invalid ranges are rejected.
+	umoci squash --image "${IMAGE}:${TAG}" --first "$numLayersA"
+	[ "$status" -ne 0 ]
+	umoci squash --image "${IMAGE}:${TAG}" --first -1 --last 0
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -48,6 +48,37 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --format" {
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# The template has the same fields as the JSON output.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{len .History}}'
+	[ "$status" -eq 0 ]
+	sane_run jq -SMr '.history | length' "$statFile"
+	[[ "${lines[0]}" == "$output" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{range .History}}{{.CreatedBy | json}}{{"\n"}}{{end}}'
+	[ "$status" -eq 0 ]
+	formatOutput="$output"
+	sane_run jq -SMc '.history[].created_by' "$statFile"
+	[[ "$formatOutput" == "$output" ]]
+
+	# Invalid templates and fields are rejected.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.NonExistent}}'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.History}}' --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 # We can't really test the output for non-JSON output, but we can smoke test it.
 @test "umoci stat [smoke]" {
 	image-verify "${IMAGE}"
@@ -66,6 +97,28 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --image -" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	expected="$output"
+
+	# Stat the image from an archive on stdin.
+	umoci export --image "${IMAGE}:${TAG}" --format oci-archive -o "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+
+	umoci stat --image - --json < "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# Invalid archives are rejected.
+	umoci stat --image - < /dev/null
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci stat [missing args]" {
 	umoci stat
 	[ "$status" -ne 0 ]
@@ -51,6 +51,56 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --format" {
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	listOutput="$output"
+
+	umoci list --layout "${IMAGE}" --format '{{.Name}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$listOutput" ]]
+
+	umoci list-tags --layout "${IMAGE}" --format 'tag={{.Name | upper}}'
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "tag=$(echo "$listOutput" | head -n1 | tr '[:lower:]' '[:upper:]')" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci list --long" {
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	nrefs="${#lines[@]}"
+
+	# The long listing has a header and one line per tag.
+	umoci list --layout "${IMAGE}" --long
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((nrefs + 1))" ]
+	[[ "${lines[0]}" == "NAME"*"DIGEST"*"SIZE"*"PLATFORMS"*"CREATED" ]]
+
+	# The JSON output matches the index.
+	umoci list --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	listJSON="$output"
+	[ "$(echo "$listJSON" | jq -SMr 'length')" -eq "$nrefs" ]
+
+	sane_run jq -SMr --arg tag "${TAG}" '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$listJSON" | jq -SMr --arg tag "${TAG}" '.[] | select(.name == $tag) | .digest')" == "$output" ]]
+	[ "$(echo "$listJSON" | jq -SMr --arg tag "${TAG}" '.[] | select(.name == $tag) | .size')" -gt 0 ]
+	[[ "$(echo "$listJSON" | jq -SMr --arg tag "${TAG}" '.[] | select(.name == $tag) | .platforms[0]')" == */* ]]
+
+	# The same fields are available to --format.
+	umoci list --layout "${IMAGE}" --format '{{.Name}} {{.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(echo "$listJSON" | jq -SMr '.[] | "\(.name) \(.digest)"')" ]]
+
+	umoci list --layout "${IMAGE}" --json --format '{{.Name}}'
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [missing args]" {
 	umoci ls
 	[ "$status" -ne 0 ]
@@ -172,3 +222,106 @@ function teardown() {
 	umoci rm
 	[ "$status" -ne 0 ]
 }
+
+@test "umoci rename" {
+	image-verify "${IMAGE}"
+
+	for tag in v1.2.3 v1.2.4 v1.3.0; do
+		umoci tag --image "${IMAGE}:${TAG}" "$tag"
+		[ "$status" -eq 0 ]
+	done
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "v1.2.3") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	digest="$output"
+
+	# Nothing is renamed with --dry-run.
+	umoci rename --layout "${IMAGE}" --dry-run 'v1.2.*' 'release-1.2.{1}'
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	[[ "${lines[0]}" == "v1.2.3 -> release-1.2.3" ]]
+	[[ "${lines[1]}" == "v1.2.4 -> release-1.2.4" ]]
+
+	umoci rename --layout "${IMAGE}" 'v1.2.*' 'release-1.2.{1}'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"v1.2."* ]]
+	[[ "$output" == *"release-1.2.3"* ]]
+	[[ "$output" == *"release-1.2.4"* ]]
+	[[ "$output" == *"v1.3.0"* ]]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "release-1.2.3") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$digest" ]]
+
+	# Regular expressions.
+	umoci --json rename --layout "${IMAGE}" --regex 'release-([0-9]+)\.([0-9]+)\.([0-9]+)' 'r{1}-{2}-{3}'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.renamed[] | .from + " " + .to' <<<"$output"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "release-1.2.3 r1-2-3" ]]
+	[[ "${lines[1]}" == "release-1.2.4 r1-2-4" ]]
+}
+
+@test "umoci rename [conflict]" {
+	image-verify "${IMAGE}"
+
+	umoci tag --image "${IMAGE}:${TAG}" a-1
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" a-2
+	[ "$status" -eq 0 ]
+	umoci tag --image "${IMAGE}:${TAG}" b-1
+	[ "$status" -eq 0 ]
+
+	sane_run cat "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	index="$output"
+
+	# The new name is used by another tag.
+	umoci rename --layout "${IMAGE}" 'a-*' 'b-{1}'
+	[ "$status" -ne 0 ]
+
+	# Several tags would have the same new name.
+	umoci rename --layout "${IMAGE}" 'a-*' 'c'
+	[ "$status" -ne 0 ]
+
+	# The new name is not a valid tag.
+	umoci rename --layout "${IMAGE}" 'a-*' 'a/{1}'
+	[ "$status" -ne 0 ]
+
+	# Invalid patterns or replacements.
+	umoci rename --layout "${IMAGE}" 'a-[12' 'c-{1}'
+	[ "$status" -ne 0 ]
+	umoci rename --layout "${IMAGE}" 'a-*' 'c-{2}'
+	[ "$status" -ne 0 ]
+
+	# The image must be unchanged.
+	sane_run cat "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$index" ]]
+
+	# Only the matching tags are renamed.
+	umoci rename --layout "${IMAGE}" --regex '([ab])-1' '{1}-x'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci list --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"a-x"* ]]
+	[[ "$output" == *"b-x"* ]]
+	[[ "$output" == *"a-2"* ]]
+	[[ "$output" != *"-1"* ]]
+}
+
+@test "umoci rename [missing args]" {
+	umoci rename
+	[ "$status" -ne 0 ]
+
+	umoci rename --layout "${IMAGE}" 'a-*'
+	[ "$status" -ne 0 ]
+}
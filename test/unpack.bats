@@ -64,6 +64,31 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --image -" {
+	ARCHIVE_DIR="$(setup_tmpdir)"
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Unpack the image from an archive on stdin.
+	umoci export --image "${IMAGE}:${TAG}" --format oci-archive -o "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+
+	umoci unpack --image - "$BUNDLE_B" < "$ARCHIVE_DIR/image.tar"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The bundles are the same.
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack [missing args]" {
 	BUNDLE="$(setup_tmpdir)"
 
@@ -119,6 +144,98 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci unpack --workers" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image sequentially.
+	umoci unpack --workers 1 --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Unpack it again with several workers.
+	umoci unpack --workers 4 --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The staged layers must have been cleaned up.
+	[ -z "$(ls -d "$BUNDLE_B"/.staging-* 2>/dev/null)" ]
+
+	# Ensure that gomtree suceeds on the new unpacked bundle.
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# By default layers are applied one at a time, without staging them.
+	umoci --log debug unpack --image "${IMAGE}:${TAG}" "$(setup_tmpdir)/bundle"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"stage layer"* ]]
+
+	# The global --workers is used if it is set.
+	BUNDLE_C="$(setup_tmpdir)"
+	umoci --workers 3 unpack --image "${IMAGE}:${TAG}" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	gomtree -p "$BUNDLE_C/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# An invalid number of workers is rejected.
+	umoci unpack --workers 0 --image "${IMAGE}:${TAG}" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+	umoci --workers 0 unpack --image "${IMAGE}:${TAG}" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --rootless=auto" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	umoci --log=info unpack --rootless=auto --image "${IMAGE}:${TAG}" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/bundle"
+
+	# The detected mode must be reported and recorded in the bundle.
+	[[ "$output" == *"--rootless=auto:"* ]]
+	expected=false
+	if [[ "$output" == *"enabling rootless mode:"* ]]; then
+		expected=true
+	fi
+	sane_run jq -SMr '.map_options.rootless' "$BUNDLE/bundle/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$expected" ]]
+
+	# An unprivileged user always needs rootless mode.
+	if [[ "$ROOTLESS" != 0 ]]; then
+		[[ "$expected" == true ]]
+	fi
+
+	# Repacking uses the same mode.
+	umoci repack --image "${IMAGE}:${TAG}-auto" "$BUNDLE/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --rootless=on is the same as --rootless.
+	umoci unpack --rootless=on --image "${IMAGE}:${TAG}" "$BUNDLE/on"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE/on"
+	sane_run jq -SMr '.map_options.rootless' "$BUNDLE/on/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# Unknown modes are rejected.
+	umoci unpack --rootless=maybe --image "${IMAGE}:${TAG}" "$BUNDLE/maybe"
+	[ "$status" -ne 0 ]
+	[ ! -d "$BUNDLE/maybe" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci unpack [setuid]" {
 	BUNDLE_A="$(setup_tmpdir)"
 	BUNDLE_B="$(setup_tmpdir)"
@@ -152,3 +269,343 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci unpack --overlay-layers" {
+	BUNDLE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image into separate layer directories.
+	umoci unpack --image "${IMAGE}:${TAG}" --overlay-layers "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest_digest="$output"
+	manifest="$IMAGE/blobs/sha256/$(echo "$manifest_digest" | cut -d: -f2)"
+	config="$IMAGE/blobs/sha256/$(jq -SMr '.config.digest' "$manifest" | cut -d: -f2)"
+
+	# The rootfs is left empty and each layer has its own directory, named
+	# after its diff_id.
+	[ -f "$BUNDLE/config.json" ]
+	[ -d "$BUNDLE/rootfs" ]
+	[ -z "$(ls -A "$BUNDLE/rootfs")" ]
+	expected="$(jq -SMr '.rootfs.diff_ids[] | sub(":"; "_")' "$config" | sort -u)"
+	[ -n "$expected" ]
+	[[ "$(ls "$BUNDLE/layers")" == "$expected" ]]
+
+	# No mtree manifest is generated, so repack must fail.
+	[ -e "$BUNDLE/umoci.json" ]
+	! [ -e "$BUNDLE/${manifest_digest/:/_}.mtree" ]
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --overlay-layers [repeated layer]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Add the same empty layer twice.
+	EMPTY="$(setup_tmpdir)/empty.tar"
+	tar cf "$EMPTY" --files-from /dev/null
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-repeated" --tar "$EMPTY" /
+	[ "$status" -eq 0 ]
+	umoci insert --image "${IMAGE}:${TAG}-repeated" --tar "$EMPTY" /
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-repeated"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	config="$IMAGE/blobs/sha256/$(jq -SMr '.config.digest' "$manifest" | cut -d: -f2)"
+	[[ "$(jq -SMr '.rootfs.diff_ids[-1]' "$config")" == "$(jq -SMr '.rootfs.diff_ids[-2]' "$config")" ]]
+
+	# The repeated layer is only extracted once.
+	umoci unpack --image "${IMAGE}:${TAG}-repeated" --overlay-layers "$BUNDLE"
+	[ "$status" -eq 0 ]
+	expected="$(jq -SMr '.rootfs.diff_ids[] | sub(":"; "_")' "$config" | sort -u)"
+	[[ "$(ls "$BUNDLE/layers")" == "$expected" ]]
+	[ "$(ls "$BUNDLE/layers" | wc -l)" -eq "$(($(jq -SMr '.rootfs.diff_ids | length' "$config") - 1))" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --overlay-store" {
+	requires root
+
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	STORE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image using the layer store.
+	umoci unpack --image "${IMAGE}:${TAG}" --overlay-store "$STORE" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A/bundle"
+	[ -e "$BUNDLE_A/bundle/rootfs/bin/sh" ]
+	nlayers="$(ls "$STORE" | wc -l)"
+
+	# Modify and repack the image.
+	echo "new file" > "$BUNDLE_A/bundle/rootfs/newfile"
+	[ -f "$BUNDLE_A/bundle/upper/newfile" ]
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpacking the new image should only extract the new layer.
+	umoci unpack --image "${IMAGE}:${TAG}-new" --overlay-store "$STORE" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B/bundle"
+	[ "$(ls "$STORE" | wc -l)" -eq "$((nlayers + 1))" ]
+	[ -f "$BUNDLE_B/bundle/rootfs/newfile" ]
+
+	umount "$BUNDLE_A/bundle/rootfs" "$BUNDLE_B/bundle/rootfs"
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --layer-cache" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+	BUNDLE_C="$(setup_tmpdir)"
+	CACHE="$(setup_tmpdir)"
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image, which populates the cache with a snapshot per layer.
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" "$BUNDLE_A/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A/bundle"
+	[ "$(ls "$CACHE" | wc -l)" -gt 0 ]
+
+	# Unpacking again (with hardlinks) must produce the same rootfs.
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" --layer-cache-mode hardlink "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B/bundle"
+	gomtree -p "$BUNDLE_B/bundle/rootfs" -f "$BUNDLE_A"/bundle/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Repacking a hardlinked bundle must only include the actual changes.
+	echo "new file" > "$BUNDLE_B/bundle/rootfs/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE_B/bundle"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run tar tzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "newfile" ]]
+
+	# A size limit causes snapshots to be evicted.
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" --layer-cache-size 1 "$BUNDLE_C/bundle"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C/bundle"
+	[ "$(ls "$CACHE" | wc -l)" -eq 0 ]
+
+	# The layer cache cannot be used with overlayfs layers.
+	umoci unpack --image "${IMAGE}:${TAG}" --layer-cache "$CACHE" --overlay-layers "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [mismatched diff_ids]" {
+	image-verify "${IMAGE}"
+
+	# Create a copy of the image whose config has a bad diff_id for the first
+	# layer (the layer blobs themselves are unmodified).
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	config="$IMAGE/blobs/sha256/$(jq -SMr '.config.digest' "$manifest" | cut -d: -f2)"
+
+	newconfig="$(setup_tmpdir)/config.json"
+	jq -cM '.rootfs.diff_ids[0] = "sha256:0000000000000000000000000000000000000000000000000000000000000000"' "$config" > "$newconfig"
+	newconfig_digest="$(sha256sum "$newconfig" | cut -d' ' -f1)"
+	cp "$newconfig" "$IMAGE/blobs/sha256/$newconfig_digest"
+
+	newmanifest="$(setup_tmpdir)/manifest.json"
+	jq -cM '.config.digest = "sha256:'"$newconfig_digest"'" | .config.size = '"$(stat -c '%s' "$newconfig")" "$manifest" > "$newmanifest"
+	newmanifest_digest="$(sha256sum "$newmanifest" | cut -d' ' -f1)"
+	cp "$newmanifest" "$IMAGE/blobs/sha256/$newmanifest_digest"
+
+	newindex="$(setup_tmpdir)/index.json"
+	jq -cM '.manifests += [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:'"$newmanifest_digest"'", "size": '"$(stat -c '%s' "$newmanifest")"', "annotations": {"org.opencontainers.image.ref.name": "'"${TAG}-baddiff"'"}}]' "$IMAGE/index.json" > "$newindex"
+	cp "$newindex" "$IMAGE/index.json"
+
+	BUNDLE_A="$(setup_tmpdir)/bundle"
+	BUNDLE_B="$(setup_tmpdir)/bundle"
+
+	# The unpack must fail, and not leave a bundle behind.
+	umoci unpack --image "${IMAGE}:${TAG}-baddiff" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"diffid mismatch"* ]]
+	! [ -e "$BUNDLE_A" ]
+
+	# With --no-verify the mismatch is only a warning.
+	umoci unpack --image "${IMAGE}:${TAG}-baddiff" --no-verify "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"ignoring diffid mismatch"* ]]
+	bundle-verify "$BUNDLE_B"
+
+	# Unverified layers cannot be stored in a layer cache.
+	umoci unpack --image "${IMAGE}:${TAG}-baddiff" --no-verify --layer-cache "$(setup_tmpdir)" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --resume" {
+	image-verify "${IMAGE}"
+
+	BUNDLE_A="$(setup_tmpdir)/bundle"
+	BUNDLE_B="$(setup_tmpdir)/bundle"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# A completed unpack has no checkpoint, and so cannot be resumed.
+	sane_run jq -SMr '.checkpoint' "$BUNDLE_A/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+	umoci unpack --resume --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -ne 0 ]
+
+	# Simulate an unpack which was interrupted after the first layer.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	manifest_digest="$(jq -SMr '.from_descriptor_path.descriptor_walk[-1].digest' "$BUNDLE_B/umoci.json")"
+	manifest="$IMAGE/blobs/sha256/$(echo "$manifest_digest" | cut -d: -f2)"
+	config="$IMAGE/blobs/sha256/$(jq -SMr '.config.digest' "$manifest" | cut -d: -f2)"
+	layer0="$(jq -SMr '.rootfs.diff_ids[0]' "$config")"
+	jq -cM '.checkpoint = {"layers": ["'"$layer0"'"]}' "$BUNDLE_B/umoci.json" > "$BUNDLE_B/umoci.json.new"
+	mv "$BUNDLE_B/umoci.json.new" "$BUNDLE_B/umoci.json"
+	rm -f "$BUNDLE_B/config.json" "$BUNDLE_B"/*.mtree
+
+	# Resuming with different options must fail.
+	umoci unpack --resume --image "${IMAGE}:${TAG}" --no-posix-acls "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+
+	umoci unpack --resume --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	sane_run jq -SMr '.checkpoint' "$BUNDLE_B/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "null" ]]
+
+	# Both bundles must have the same rootfs.
+	sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE_B/rootfs"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --dirlink-policy" {
+	image-verify "${IMAGE}"
+
+	BUNDLE="$(setup_tmpdir)/bundle"
+
+	# Create a layer with a symlink to a directory.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	mkdir -p "$BUNDLE/rootfs/merged/dir"
+	ln -s merged/dir "$BUNDLE/rootfs/dirlink"
+	umoci repack --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	rm -rf "$BUNDLE"
+
+	# And a layer which replaces it with a directory.
+	umoci unpack --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	rm "$BUNDLE/rootfs/dirlink"
+	mkdir "$BUNDLE/rootfs/dirlink"
+	echo "file" > "$BUNDLE/rootfs/dirlink/file"
+	umoci repack --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	rm -rf "$BUNDLE"
+	image-verify "${IMAGE}"
+
+	# By default the symlink is replaced.
+	umoci unpack --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -d "$BUNDLE/rootfs/dirlink" ] && ! [ -L "$BUNDLE/rootfs/dirlink" ]
+	! [ -e "$BUNDLE/rootfs/merged/dir/file" ]
+	rm -rf "$BUNDLE"
+
+	# With follow, the directory is extracted through the symlink.
+	umoci unpack --dirlink-policy follow --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -L "$BUNDLE/rootfs/dirlink" ]
+	[ -f "$BUNDLE/rootfs/merged/dir/file" ]
+	rm -rf "$BUNDLE"
+
+	# With error, the unpack fails.
+	umoci unpack --dirlink-policy error --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE" ]
+
+	umoci unpack --dirlink-policy invalid --image "${IMAGE}:${TAG}-dirlink" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --manifest-format" {
+	image-verify "${IMAGE}"
+
+	BUNDLE="$(setup_tmpdir)/bundle"
+
+	umoci unpack --manifest-format binary --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only the binary manifest is stored.
+	[ -f "$BUNDLE"/sha256_*.bmtree ]
+	! [ -e "$BUNDLE"/sha256_*.mtree ]
+	sane_run jq -SMr '.manifest_format' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "binary" ]]
+
+	# Make some changes, which must be detected with the binary manifest.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	rm -rf "$BUNDLE/rootfs/etc"
+
+	# Convert the manifest to mtree, which gomtree can check.
+	umoci raw convert-manifest --format mtree "$BUNDLE"
+	[ "$status" -eq 0 ]
+	! [ -e "$BUNDLE"/sha256_*.bmtree ]
+	sane_run gomtree -p "$BUNDLE/rootfs" -f "$BUNDLE"/sha256_*.mtree
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"newfile"* ]]
+
+	# And back again.
+	umoci raw convert-manifest --format binary "$BUNDLE"
+	[ "$status" -eq 0 ]
+	! [ -e "$BUNDLE"/sha256_*.mtree ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The repacked image must contain the same changes.
+	NEW_BUNDLE="$(setup_tmpdir)/bundle"
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$NEW_BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -f "$NEW_BUNDLE/rootfs/newfile" ]
+	! [ -e "$NEW_BUNDLE/rootfs/etc" ]
+
+	# Invalid formats are rejected.
+	umoci unpack --manifest-format invalid --image "${IMAGE}:${TAG}" "$(setup_tmpdir)/bundle"
+	[ "$status" -ne 0 ]
+	umoci raw convert-manifest --format invalid "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
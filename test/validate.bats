@@ -0,0 +1,103 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci validate" {
+	umoci validate --layout "${IMAGE}" --quiet
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+
+	umoci validate --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.errors')" == "0" ]]
+	[[ "$(echo "$output" | jq -SMr '.findings | map(select(.severity == "error")) | length')" == "0" ]]
+}
+
+@test "umoci validate [unreferenced blob]" {
+	INPUT_DIR="$(setup_tmpdir)"
+	echo "some blob contents" > "$INPUT_DIR/blob"
+
+	umoci raw add-blob --layout "${IMAGE}" "$INPUT_DIR/blob"
+	[ "$status" -eq 0 ]
+	blobDigest="$output"
+
+	# Unreferenced blobs are not errors.
+	umoci validate --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr --arg loc "blobs/sha256/${blobDigest#sha256:}" '.findings[] | select(.location == $loc) | .severity')" == "info" ]]
+
+	# ... unless they are corrupted.
+	echo "other contents" > "$IMAGE/blobs/sha256/${blobDigest#sha256:}"
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"error: blobs/sha256/${blobDigest#sha256:}: blob is corrupted"* ]]
+}
+
+@test "umoci validate [oci-layout]" {
+	echo '{"imageLayoutVersion": "9.9.9"}' > "$IMAGE/oci-layout"
+
+	umoci validate --layout "${IMAGE}" --json
+	[ "$status" -ne 0 ]
+	[[ "$(echo "$output" | jq -SMr '.findings[0].location')" == "oci-layout" ]]
+	[[ "$(echo "$output" | jq -SMr '.findings[0].severity')" == "error" ]]
+
+	rm "$IMAGE/oci-layout"
+	umoci validate --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci validate [media types]" {
+	image-verify "${IMAGE}"
+
+	# Use a Docker media type for the tag, which is only a warning.
+	jq -SMc --arg tag "${TAG}" '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .mediaType) |= "application/vnd.docker.distribution.manifest.v2+json"' "$IMAGE/index.json" > "$IMAGE/index.json.new"
+	mv "$IMAGE/index.json.new" "$IMAGE/index.json"
+
+	umoci validate --layout "${IMAGE}" --quiet
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"warning: index.json: descriptor has non-OCI mediaType"* ]]
+
+	umoci validate --layout "${IMAGE}" --strict
+	[ "$status" -ne 0 ]
+
+	# Malformed media types are errors.
+	jq -SMc --arg tag "${TAG}" '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == $tag) | .mediaType) |= "not a media type"' "$IMAGE/index.json" > "$IMAGE/index.json.new"
+	mv "$IMAGE/index.json.new" "$IMAGE/index.json"
+
+	umoci validate --layout "${IMAGE}" --quiet
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"error: index.json: descriptor has malformed mediaType"* ]]
+}
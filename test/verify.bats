@@ -0,0 +1,71 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci verify [missing args]" {
+	umoci verify
+	[ "$status" -ne 0 ]
+	umoci verify --layout "${IMAGE}" "invalid/tag"
+	[ "$status" -ne 0 ]
+	umoci verify --layout "${IMAGE}" "${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci verify" {
+	image-verify "${IMAGE}"
+
+	umoci verify --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci verify --layout "${IMAGE}" "${TAG}"
+	[ "$status" -eq 0 ]
+	umoci verify --layout "${IMAGE}" --json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "[]" ]]
+
+	# Corrupt the first layer of the image.
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	sane_run jq -SMr '.layers[0].digest' "$manifest"
+	[ "$status" -eq 0 ]
+	layer="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	chmod +w "$layer"
+	echo "corrupted" >> "$layer"
+
+	umoci verify --layout "${IMAGE}" "${TAG}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"${TAG}: "*"blob is corrupted"* ]]
+
+	umoci verify --layout "${IMAGE}" "${TAG}" --json
+	[ "$status" -ne 0 ]
+	echo "${lines[0]}" | jq -e '.[0].problem | startswith("blob is corrupted")'
+
+	# Remove the layer entirely.
+	rm -f "$layer"
+	umoci verify --layout "${IMAGE}" "${TAG}"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"blob is missing"* ]]
+}
@@ -0,0 +1,208 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016, 2017 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# layer_contents lists the contents of the top layer of the given tag.
+function layer_contents() {
+	sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$1"'") | .digest' "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	manifest="$IMAGE/blobs/sha256/$(echo "$output" | cut -d: -f2)"
+	tar tvzf "$IMAGE/blobs/sha256/$(jq -SMr '.layers[-1].digest' "$manifest" | cut -d: -f2)" | sort
+}
+
+@test "umoci watch" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Start watching the bundle, and wait until the log has been created.
+	"$UMOCI" watch "$BUNDLE" &
+	watch_pid="$!"
+	for _ in $(seq 50); do
+		[ -e "$BUNDLE/umoci-watch.log" ] && break
+		sleep 0.1
+	done
+	[ -e "$BUNDLE/umoci-watch.log" ]
+
+	# Make some changes.
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	mkdir -p "$BUNDLE/rootfs/newdir/subdir"
+	echo "nested" > "$BUNDLE/rootfs/newdir/subdir/file"
+	rm -f "$BUNDLE/rootfs/etc/group"
+	chmod 0600 "$BUNDLE/rootfs/etc/passwd"
+	mv "$BUNDLE/rootfs/usr/bin" "$BUNDLE/rootfs/usr/bin-moved"
+
+	# Stop watching.
+	kill -TERM "$watch_pid"
+	wait "$watch_pid"
+	[ -s "$BUNDLE/umoci-watch.log" ]
+
+	# Repack with and without the watch log.
+	umoci repack --watch-log --image "${IMAGE}:${TAG}-watch" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	umoci repack --image "${IMAGE}:${TAG}-full" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layers must have the same contents.
+	[[ "$(layer_contents "${TAG}-watch")" == "$(layer_contents "${TAG}-full")" ]]
+	[[ "$(layer_contents "${TAG}-watch")" == *"newdir/subdir/file"* ]]
+}
+
+@test "umoci watch --image" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Start watching the bundle, repacking changes automatically.
+	"$UMOCI" watch --image "${IMAGE}:${TAG}-auto" --debounce 200ms "$BUNDLE" &
+	watch_pid="$!"
+	for _ in $(seq 50); do
+		[ -e "$BUNDLE/umoci-watch.log" ] && break
+		sleep 0.1
+	done
+	[ -e "$BUNDLE/umoci-watch.log" ]
+
+	# Make a change and wait for it to be repacked.
+	echo "first" > "$BUNDLE/rootfs/newfile"
+	for _ in $(seq 100); do
+		grep -q '"'"${TAG}-auto-1"'"' "$IMAGE/index.json" && break
+		sleep 0.1
+	done
+
+	# Make another change, which is repacked into the next tag.
+	echo "second" > "$BUNDLE/rootfs/newfile"
+	echo "other" > "$BUNDLE/rootfs/otherfile"
+	for _ in $(seq 100); do
+		grep -q '"'"${TAG}-auto-2"'"' "$IMAGE/index.json" && break
+		sleep 0.1
+	done
+
+	# Stop watching.
+	kill -TERM "$watch_pid"
+	wait "$watch_pid"
+	image-verify "${IMAGE}"
+
+	# Each tag contains all of the changes up to that point.
+	umoci cat --image "${IMAGE}:${TAG}-auto-1" /newfile
+	[ "$status" -eq 0 ]
+	[[ "$output" == "first" ]]
+	[[ "$(layer_contents "${TAG}-auto-1")" != *"otherfile"* ]]
+
+	umoci cat --image "${IMAGE}:${TAG}-auto-2" /newfile
+	[ "$status" -eq 0 ]
+	[[ "$output" == "second" ]]
+	[[ "$(layer_contents "${TAG}-auto-2")" == *"otherfile"* ]]
+
+	# The new tags are based on the original image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	nhistory="$(echo "$output" | jq -SM '.history | length')"
+	umoci stat --image "${IMAGE}:${TAG}-auto-2" --json
+	[ "$status" -eq 0 ]
+	[ "$(echo "$output" | jq -SM '.history | length')" -eq "$(($nhistory + 1))" ]
+}
+
+@test "umoci watch [restarted]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Watch the bundle and make a change.
+	"$UMOCI" watch "$BUNDLE" &
+	watch_pid="$!"
+	for _ in $(seq 50); do
+		[ -e "$BUNDLE/umoci-watch.log" ] && break
+		sleep 0.1
+	done
+	[ -e "$BUNDLE/umoci-watch.log" ]
+	echo "first" > "$BUNDLE/rootfs/firstfile"
+	kill -TERM "$watch_pid"
+	wait "$watch_pid"
+
+	# Make a change while nothing is watching the bundle.
+	echo "unwatched" > "$BUNDLE/rootfs/unwatchedfile"
+
+	# Watch the bundle again and make another change.
+	"$UMOCI" watch "$BUNDLE" &
+	watch_pid="$!"
+	for _ in $(seq 50); do
+		grep -q '"incomplete":true' "$BUNDLE/umoci-watch.log" && break
+		sleep 0.1
+	done
+	grep -q '"incomplete":true' "$BUNDLE/umoci-watch.log"
+	echo "second" > "$BUNDLE/rootfs/secondfile"
+	kill -TERM "$watch_pid"
+	wait "$watch_pid"
+
+	# The unwatched change must still be included in the repacked layer.
+	umoci repack --watch-log --image "${IMAGE}:${TAG}-watch" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(layer_contents "${TAG}-watch")" == *"firstfile"* ]]
+	[[ "$(layer_contents "${TAG}-watch")" == *"unwatchedfile"* ]]
+	[[ "$(layer_contents "${TAG}-watch")" == *"secondfile"* ]]
+}
+
+@test "umoci watch --debounce [without --image]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	umoci watch --debounce 1s "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --watch-log [incomplete log]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack the image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# --watch-log requires a log.
+	umoci repack --watch-log --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# An incomplete log results in the entire rootfs being checked.
+	echo '{"incomplete":true}' > "$BUNDLE/umoci-watch.log"
+	echo "new file" > "$BUNDLE/rootfs/newfile"
+	umoci repack --watch-log --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[[ "$(layer_contents "${TAG}-new")" == *"newfile"* ]]
+}